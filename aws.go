@@ -5,9 +5,12 @@
 package bookpipeline
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -19,16 +22,46 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
 )
 
 const defaultAwsRegion = `eu-west-2`
 
+// LongPollSeconds is how long CheckQueue waits for a message to
+// arrive before returning, which is the maximum SQS allows. Long
+// polling like this means far fewer requests are made to check
+// queues which are usually empty.
+const LongPollSeconds = 20
+
+// The types of object which can be uploaded with a different storage
+// class with UploadClass. ObjectIntermediate is for large files which
+// are only needed while a book is being processed, like binarised
+// page images, and ObjectFinal is for everything else.
+const (
+	ObjectIntermediate = "intermediate"
+	ObjectFinal        = "final"
+)
+
 type Qmsg struct {
 	Id, Handle, Body string
 }
 
+// MsgBook returns the name of the book a queue message is for.
+// Messages are either a book name or a page of a book, like
+// bookname/0001.png, either of which may be followed by a space and
+// further details, like the training to use.
+func MsgBook(body string) string {
+	name := strings.SplitN(body, " ", 2)[0]
+	return strings.SplitN(name, "/", 2)[0]
+}
+
 type InstanceDetails struct {
 	Id, Name, Ip, Spot, Type, State, LaunchTime string
+	// Launched is when the instance was last launched, which
+	// LaunchTime is a string of
+	Launched time.Time
+	// Region is the region the instance is running in
+	Region string
 }
 
 type ObjMeta struct {
@@ -43,11 +76,34 @@ type AwsConn struct {
 	// these should be set before running Init(), or left to defaults
 	Region string
 	Logger *log.Logger
+	// UploadPartSize is the size in bytes of each part of a multipart
+	// upload. Files larger than this are uploaded in several parts,
+	// each of which can be retried independently. It cannot be less
+	// than 5MB.
+	UploadPartSize int64
+	// UploadConcurrency is the number of parts of a multipart upload
+	// which are sent at the same time.
+	UploadConcurrency int
+	// HTTPClient is used for all requests to AWS if it is set, which
+	// is useful for advanced cases like trusting a custom certificate
+	// authority or setting timeouts. Otherwise the AWS SDK's default
+	// client is used, which goes through any proxy set with the
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+	HTTPClient *http.Client
+	// Failover enables switching to replicas of the pipeline's
+	// queues and buckets in other regions if the primary region
+	// has an outage. It is disabled if this is nil.
+	Failover *Failover
+	// StorageClasses sets the S3 storage class, like STANDARD_IA,
+	// that each type of object is uploaded with by UploadClass, keyed
+	// by the type, like ObjectIntermediate. Objects of any other type
+	// are uploaded with the STANDARD class.
+	StorageClasses map[string]string
 
 	sess         *session.Session
 	ec2svc       *ec2.EC2
 	s3svc        *s3.S3
-	sqssvc       *sqs.SQS
+	sqssvc       sqsiface.SQSAPI
 	downloader   *s3manager.Downloader
 	uploader     *s3manager.Uploader
 	wipequrl     string
@@ -57,35 +113,99 @@ type AwsConn struct {
 	analysequrl  string
 	testqurl     string
 	wipstorageid string
+	failover     *failoverState
 }
 
-// MinimalInit does the bare minimum to initialise aws services
+// MinimalInit does the bare minimum to initialise aws services.
+// Credentials and region are found using the standard AWS SDK
+// configuration chain, so environment variables, the shared config
+// and credentials files, and IAM roles can all be used. If Region is
+// set it overrides any region configured elsewhere, and if no region
+// is found anywhere the default region is used.
 func (a *AwsConn) MinimalInit() error {
-	if a.Region == "" {
-		a.Region = defaultAwsRegion
-	}
 	if a.Logger == nil {
-		a.Logger = log.New(os.Stdout, "", 0)
+		a.Logger = NewLogger(os.Stdout, 0, LogDebug)
+	}
+
+	if a.UploadPartSize > 0 && a.UploadPartSize < s3manager.MinUploadPartSize {
+		return fmt.Errorf("Upload part size %d is too small, it must be at least %d", a.UploadPartSize, s3manager.MinUploadPartSize)
+	}
+
+	for t, class := range a.StorageClasses {
+		if !validStorageClass(class) {
+			return fmt.Errorf("Invalid storage class %s for %s objects, it must be one of %s", class, t, strings.Join(uploadStorageClasses, ", "))
+		}
+	}
+
+	var cfg aws.Config
+	if a.Region != "" {
+		cfg.Region = aws.String(a.Region)
 	}
+	cfg.HTTPClient = a.HTTPClient
 
 	var err error
-	a.sess, err = session.NewSession(&aws.Config{
-		Region: aws.String(a.Region),
+	a.sess, err = session.NewSessionWithOptions(session.Options{
+		Config:            cfg,
+		SharedConfigState: session.SharedConfigEnable,
 	})
 	if err != nil {
 		return errors.New(fmt.Sprintf("Failed to set up aws session: %s", err))
 	}
+	if aws.StringValue(a.sess.Config.Region) == "" {
+		a.sess.Config.Region = aws.String(defaultAwsRegion)
+	}
+	a.Region = *a.sess.Config.Region
+	if a.Failover != nil {
+		err = a.initFailover(cfg)
+		if err != nil {
+			return err
+		}
+	}
 	a.ec2svc = ec2.New(a.sess)
 	a.s3svc = s3.New(a.sess)
 	a.sqssvc = sqs.New(a.sess)
 	a.downloader = s3manager.NewDownloader(a.sess)
-	a.uploader = s3manager.NewUploader(a.sess)
+	a.uploader = s3manager.NewUploader(a.sess, a.configureUploader)
 
 	a.wipstorageid = storageWip
 
 	return nil
 }
 
+// configureUploader sets the part size and concurrency of an
+// uploader, if they have been set in the AwsConn
+func (a *AwsConn) configureUploader(u *s3manager.Uploader) {
+	if a.UploadPartSize > 0 {
+		u.PartSize = a.UploadPartSize
+	}
+	if a.UploadConcurrency > 0 {
+		u.Concurrency = a.UploadConcurrency
+	}
+}
+
+// uploadStorageClasses are the S3 storage classes which objects can
+// be uploaded with. The archive classes, like GLACIER, are left out,
+// as objects stored with them can't be downloaded without being
+// restored first, which the pipeline doesn't do.
+var uploadStorageClasses = []string{
+	s3.StorageClassStandard,
+	s3.StorageClassStandardIa,
+	s3.StorageClassOnezoneIa,
+	s3.StorageClassIntelligentTiering,
+	s3.StorageClassReducedRedundancy,
+}
+
+// validStorageClass checks that class is one of the S3 storage
+// classes that objects can be uploaded with
+func validStorageClass(class string) bool {
+	for _, c := range uploadStorageClasses {
+		if class == c {
+			return true
+		}
+	}
+	return false
+}
+
 // Init initialises aws services, also finding the urls needed to
 // address SQS queues directly.
 func (a *AwsConn) Init() error {
@@ -94,7 +214,7 @@ func (a *AwsConn) Init() error {
 		return err
 	}
 
-	a.Logger.Println("Getting preprocess queue URL")
+	a.Logger.Println(DebugTag + "Getting preprocess queue URL")
 	result, err := a.sqssvc.GetQueueUrl(&sqs.GetQueueUrlInput{
 		QueueName: aws.String(queuePreProc),
 	})
@@ -103,7 +223,7 @@ func (a *AwsConn) Init() error {
 	}
 	a.prequrl = *result.QueueUrl
 
-	a.Logger.Println("Getting preprocess no wipe queue URL")
+	a.Logger.Println(DebugTag + "Getting preprocess no wipe queue URL")
 	result, err = a.sqssvc.GetQueueUrl(&sqs.GetQueueUrlInput{
 		QueueName: aws.String(queuePreNoWipe),
 	})
@@ -112,7 +232,7 @@ func (a *AwsConn) Init() error {
 	}
 	a.prenwqurl = *result.QueueUrl
 
-	a.Logger.Println("Getting wipeonly queue URL")
+	a.Logger.Println(DebugTag + "Getting wipeonly queue URL")
 	result, err = a.sqssvc.GetQueueUrl(&sqs.GetQueueUrlInput{
 		QueueName: aws.String(queueWipeOnly),
 	})
@@ -121,7 +241,7 @@ func (a *AwsConn) Init() error {
 	}
 	a.wipequrl = *result.QueueUrl
 
-	a.Logger.Println("Getting OCR Page queue URL")
+	a.Logger.Println(DebugTag + "Getting OCR Page queue URL")
 	result, err = a.sqssvc.GetQueueUrl(&sqs.GetQueueUrlInput{
 		QueueName: aws.String(queueOcrPage),
 	})
@@ -130,7 +250,7 @@ func (a *AwsConn) Init() error {
 	}
 	a.ocrpgqurl = *result.QueueUrl
 
-	a.Logger.Println("Getting analyse queue URL")
+	a.Logger.Println(DebugTag + "Getting analyse queue URL")
 	result, err = a.sqssvc.GetQueueUrl(&sqs.GetQueueUrlInput{
 		QueueName: aws.String(queueAnalyse),
 	})
@@ -139,12 +259,31 @@ func (a *AwsConn) Init() error {
 	}
 	a.analysequrl = *result.QueueUrl
 
+	if a.failover != nil {
+		for _, q := range []struct{ url, name string }{
+			{a.prequrl, queuePreProc},
+			{a.prenwqurl, queuePreNoWipe},
+			{a.wipequrl, queueWipeOnly},
+			{a.ocrpgqurl, queueOcrPage},
+			{a.analysequrl, queueAnalyse},
+		} {
+			err = a.addFailoverQueue(q.url, q.name)
+			if err != nil {
+				return err
+			}
+		}
+		err = a.checkFailoverBuckets()
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 // TestInit initialises extra aws services needed for running tests.
 func (a *AwsConn) TestInit() error {
-	a.Logger.Println("Getting test queue URL")
+	a.Logger.Println(DebugTag + "Getting test queue URL")
 	result, err := a.sqssvc.GetQueueUrl(&sqs.GetQueueUrlInput{
 		QueueName: aws.String(queueTest),
 	})
@@ -152,15 +291,18 @@ func (a *AwsConn) TestInit() error {
 		return errors.New(fmt.Sprintf("Error getting test queue URL: %s\n", err))
 	}
 	a.testqurl = *result.QueueUrl
+	if a.failover != nil {
+		return a.addFailoverQueue(a.testqurl, queueTest)
+	}
 	return nil
 }
 
 func (a *AwsConn) CheckQueue(url string, timeout int64) (Qmsg, error) {
-	msgResult, err := a.sqssvc.ReceiveMessage(&sqs.ReceiveMessageInput{
+	msgResult, err := a.activeSQS().ReceiveMessage(&sqs.ReceiveMessageInput{
 		MaxNumberOfMessages: aws.Int64(1),
 		VisibilityTimeout:   &timeout,
-		WaitTimeSeconds:     aws.Int64(20),
-		QueueUrl:            &url,
+		WaitTimeSeconds:     aws.Int64(LongPollSeconds),
+		QueueUrl:            aws.String(a.queueURL(url)),
 	})
 	if err != nil {
 		return Qmsg{}, err
@@ -170,7 +312,7 @@ func (a *AwsConn) CheckQueue(url string, timeout int64) (Qmsg, error) {
 		msg := Qmsg{Id: *msgResult.Messages[0].MessageId,
 			Handle: *msgResult.Messages[0].ReceiptHandle,
 			Body:   *msgResult.Messages[0].Body}
-		a.Logger.Println("Message received:", msg.Body)
+		a.Logger.Println(DebugTag+"Message received:", msg.Body)
 		return msg, nil
 	} else {
 		return Qmsg{}, nil
@@ -179,10 +321,10 @@ func (a *AwsConn) CheckQueue(url string, timeout int64) (Qmsg, error) {
 
 func (a *AwsConn) LogAndPurgeQueue(url string) error {
 	for {
-		msgResult, err := a.sqssvc.ReceiveMessage(&sqs.ReceiveMessageInput{
+		msgResult, err := a.activeSQS().ReceiveMessage(&sqs.ReceiveMessageInput{
 			MaxNumberOfMessages: aws.Int64(10),
 			VisibilityTimeout:   aws.Int64(300),
-			QueueUrl:            &url,
+			QueueUrl:            aws.String(a.queueURL(url)),
 		})
 		if err != nil {
 			return err
@@ -191,8 +333,8 @@ func (a *AwsConn) LogAndPurgeQueue(url string) error {
 		if len(msgResult.Messages) > 0 {
 			for _, m := range msgResult.Messages {
 				a.Logger.Println(*m.Body)
-				_, err = a.sqssvc.DeleteMessage(&sqs.DeleteMessageInput{
-					QueueUrl:      &url,
+				_, err = a.activeSQS().DeleteMessage(&sqs.DeleteMessageInput{
+					QueueUrl:      aws.String(a.queueURL(url)),
 					ReceiptHandle: m.ReceiptHandle,
 				})
 				if err != nil {
@@ -209,10 +351,10 @@ func (a *AwsConn) LogAndPurgeQueue(url string) error {
 // LogQueue prints the body of all messages in a queue to the log
 func (a *AwsConn) LogQueue(url string) error {
 	for {
-		msgResult, err := a.sqssvc.ReceiveMessage(&sqs.ReceiveMessageInput{
+		msgResult, err := a.activeSQS().ReceiveMessage(&sqs.ReceiveMessageInput{
 			MaxNumberOfMessages: aws.Int64(10),
 			VisibilityTimeout:   aws.Int64(300),
-			QueueUrl:            &url,
+			QueueUrl:            aws.String(a.queueURL(url)),
 		})
 		if err != nil {
 			return err
@@ -232,11 +374,30 @@ func (a *AwsConn) LogQueue(url string) error {
 // RemovePrefixesFromQueue removes any messages in a queue whose
 // body starts with the specified prefix.
 func (a *AwsConn) RemovePrefixesFromQueue(url string, prefix string) error {
+	return a.removeFromQueue(url, func(body string) bool {
+		return strings.HasPrefix(body, prefix)
+	})
+}
+
+// RemoveBookFromQueue removes any messages in a queue for a book, as
+// found by MsgBook. Unlike RemovePrefixesFromQueue this leaves the
+// messages of any other books whose names start with the same text.
+// Messages which are currently being processed are hidden, so can't
+// be removed.
+func (a *AwsConn) RemoveBookFromQueue(url string, bookname string) error {
+	return a.removeFromQueue(url, func(body string) bool {
+		return MsgBook(body) == bookname
+	})
+}
+
+// removeFromQueue removes any messages in a queue for which match
+// returns true.
+func (a *AwsConn) removeFromQueue(url string, match func(string) bool) error {
 	for {
-		msgResult, err := a.sqssvc.ReceiveMessage(&sqs.ReceiveMessageInput{
+		msgResult, err := a.activeSQS().ReceiveMessage(&sqs.ReceiveMessageInput{
 			MaxNumberOfMessages: aws.Int64(10),
 			VisibilityTimeout:   aws.Int64(300),
-			QueueUrl:            &url,
+			QueueUrl:            aws.String(a.queueURL(url)),
 		})
 		if err != nil {
 			return err
@@ -244,12 +405,12 @@ func (a *AwsConn) RemovePrefixesFromQueue(url string, prefix string) error {
 
 		if len(msgResult.Messages) > 0 {
 			for _, m := range msgResult.Messages {
-				if !strings.HasPrefix(*m.Body, prefix) {
+				if !match(*m.Body) {
 					continue
 				}
-				a.Logger.Printf("Removing %s from queue\n", *m.Body)
-				_, err = a.sqssvc.DeleteMessage(&sqs.DeleteMessageInput{
-					QueueUrl:      &url,
+				a.Logger.Printf(DebugTag+"Removing %s from queue\n", *m.Body)
+				_, err = a.activeSQS().DeleteMessage(&sqs.DeleteMessageInput{
+					QueueUrl:      aws.String(a.queueURL(url)),
 					ReceiptHandle: m.ReceiptHandle,
 				})
 				if err != nil {
@@ -274,9 +435,9 @@ func (a *AwsConn) RemovePrefixesFromQueue(url string, prefix string) error {
 // fails, and if so will attempt to find the message on the queue, and
 // return it, as the handle will have changed.
 func (a *AwsConn) QueueHeartbeat(msg Qmsg, qurl string, duration int64) (Qmsg, error) {
-	_, err := a.sqssvc.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+	_, err := a.activeSQS().ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
 		ReceiptHandle:     &msg.Handle,
-		QueueUrl:          &qurl,
+		QueueUrl:          aws.String(a.queueURL(qurl)),
 		VisibilityTimeout: &duration,
 	})
 	if err != nil {
@@ -287,18 +448,18 @@ func (a *AwsConn) QueueHeartbeat(msg Qmsg, qurl string, duration int64) (Qmsg, e
 		if ok && aerr.Code() == "InvalidParameterValue" {
 			// First try to set the visibilitytimeout to zero to immediately
 			// make the message available to receive
-			_, _ = a.sqssvc.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+			_, _ = a.activeSQS().ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
 				ReceiptHandle:     &msg.Handle,
-				QueueUrl:          &qurl,
+				QueueUrl:          aws.String(a.queueURL(qurl)),
 				VisibilityTimeout: aws.Int64(0),
 			})
 
 			for i := 0; i < int(duration)*5; i++ {
-				msgResult, err := a.sqssvc.ReceiveMessage(&sqs.ReceiveMessageInput{
+				msgResult, err := a.activeSQS().ReceiveMessage(&sqs.ReceiveMessageInput{
 					MaxNumberOfMessages: aws.Int64(10),
 					VisibilityTimeout:   &duration,
 					WaitTimeSeconds:     aws.Int64(1),
-					QueueUrl:            &qurl,
+					QueueUrl:            aws.String(a.queueURL(qurl)),
 				})
 				if err != nil {
 					return Qmsg{}, errors.New(fmt.Sprintf("Heartbeat error looking for message to update heartbeat: %s", err))
@@ -333,9 +494,9 @@ func (a *AwsConn) QueueHeartbeat(msg Qmsg, qurl string, duration int64) (Qmsg, e
 func (a *AwsConn) GetQueueDetails(url string) (string, string, error) {
 	numAvailable := "ApproximateNumberOfMessages"
 	numInProgress := "ApproximateNumberOfMessagesNotVisible"
-	attrs, err := a.sqssvc.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+	attrs, err := a.activeSQS().GetQueueAttributes(&sqs.GetQueueAttributesInput{
 		AttributeNames: []*string{&numAvailable, &numInProgress},
-		QueueUrl:       &url,
+		QueueUrl:       aws.String(a.queueURL(url)),
 	})
 	if err != nil {
 		return "", "", errors.New(fmt.Sprintf("Failed to get queue attributes: %s", err))
@@ -373,8 +534,8 @@ func (a *AwsConn) TestQueueId() string {
 
 func (a *AwsConn) ListObjects(bucket string, prefix string) ([]string, error) {
 	var names []string
-	err := a.s3svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
-		Bucket: aws.String(bucket),
+	err := a.activeS3().ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(a.bucketName(bucket)),
 		Prefix: aws.String(prefix),
 	}, func(page *s3.ListObjectsV2Output, last bool) bool {
 		for _, r := range page.Contents {
@@ -387,8 +548,8 @@ func (a *AwsConn) ListObjects(bucket string, prefix string) ([]string, error) {
 
 func (a *AwsConn) ListObjectsWithMeta(bucket string, prefix string) ([]ObjMeta, error) {
 	var objs []ObjMeta
-	err := a.s3svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
-		Bucket: aws.String(bucket),
+	err := a.activeS3().ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(a.bucketName(bucket)),
 		Prefix: aws.String(prefix),
 	}, func(page *s3.ListObjectsV2Output, last bool) bool {
 		for _, r := range page.Contents {
@@ -403,8 +564,8 @@ func (a *AwsConn) ListObjectsWithMeta(bucket string, prefix string) ([]ObjMeta,
 // first object with the specified prefix.
 func (a *AwsConn) ListObjectWithMeta(bucket string, prefix string) (ObjMeta, error) {
 	var obj ObjMeta
-	err := a.s3svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
-		Bucket:  aws.String(bucket),
+	err := a.activeS3().ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:  aws.String(a.bucketName(bucket)),
 		Prefix:  aws.String(prefix),
 		MaxKeys: aws.Int64(1),
 	}, func(page *s3.ListObjectsV2Output, last bool) bool {
@@ -421,8 +582,8 @@ func (a *AwsConn) ListObjectWithMeta(bucket string, prefix string) (ObjMeta, err
 
 func (a *AwsConn) ListObjectPrefixes(bucket string) ([]string, error) {
 	var prefixes []string
-	err := a.s3svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
-		Bucket:    aws.String(bucket),
+	err := a.activeS3().ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(a.bucketName(bucket)),
 		Delimiter: aws.String("/"),
 	}, func(page *s3.ListObjectsV2Output, last bool) bool {
 		for _, r := range page.CommonPrefixes {
@@ -443,8 +604,8 @@ func (a *AwsConn) DeleteObjects(bucket string, keys []string) error {
 		// so if necessary delete those collected so far and empty
 		// the objs queue
 		if i%1000 == 1 {
-			_, err := a.s3svc.DeleteObjects(&s3.DeleteObjectsInput{
-				Bucket: aws.String(bucket),
+			_, err := a.activeS3().DeleteObjects(&s3.DeleteObjectsInput{
+				Bucket: aws.String(a.bucketName(bucket)),
 				Delete: &s3.Delete{
 					Objects: objs,
 					Quiet:   aws.Bool(true),
@@ -456,8 +617,8 @@ func (a *AwsConn) DeleteObjects(bucket string, keys []string) error {
 			objs = []*s3.ObjectIdentifier{}
 		}
 	}
-	_, err := a.s3svc.DeleteObjects(&s3.DeleteObjectsInput{
-		Bucket: aws.String(bucket),
+	_, err := a.activeS3().DeleteObjects(&s3.DeleteObjectsInput{
+		Bucket: aws.String(a.bucketName(bucket)),
 		Delete: &s3.Delete{
 			Objects: objs,
 			Quiet:   aws.Bool(true),
@@ -468,13 +629,13 @@ func (a *AwsConn) DeleteObjects(bucket string, keys []string) error {
 
 // CreateBucket creates a new S3 bucket
 func (a *AwsConn) CreateBucket(name string) error {
-	_, err := a.s3svc.CreateBucket(&s3.CreateBucketInput{
+	_, err := a.activeS3().CreateBucket(&s3.CreateBucketInput{
 		Bucket: aws.String(name),
 	})
 	if err != nil {
 		aerr, ok := err.(awserr.Error)
 		if ok && (aerr.Code() == s3.ErrCodeBucketAlreadyExists || aerr.Code() == s3.ErrCodeBucketAlreadyOwnedByYou) {
-			a.Logger.Println("Bucket already exists:", name)
+			a.Logger.Println(DebugTag+"Bucket already exists:", name)
 		} else {
 			return errors.New(fmt.Sprintf("Error creating bucket %s: %v", name, err))
 		}
@@ -486,7 +647,7 @@ func (a *AwsConn) CreateBucket(name string) error {
 // Note the queue attributes are currently hardcoded; it may make sense
 // to specify them as arguments in the future.
 func (a *AwsConn) CreateQueue(name string) error {
-	_, err := a.sqssvc.CreateQueue(&sqs.CreateQueueInput{
+	_, err := a.activeSQS().CreateQueue(&sqs.CreateQueueInput{
 		QueueName: aws.String(name),
 		Attributes: map[string]*string{
 			"VisibilityTimeout":             aws.String("120"),     // 2 minutes
@@ -510,50 +671,85 @@ func (a *AwsConn) CreateQueue(name string) error {
 }
 
 func (a *AwsConn) AddToQueue(url string, msg string) error {
-	_, err := a.sqssvc.SendMessage(&sqs.SendMessageInput{
+	_, err := a.activeSQS().SendMessage(&sqs.SendMessageInput{
 		MessageBody: &msg,
-		QueueUrl:    &url,
+		QueueUrl:    aws.String(a.queueURL(url)),
 	})
 	return err
 }
 
 func (a *AwsConn) DelFromQueue(url string, handle string) error {
-	_, err := a.sqssvc.DeleteMessage(&sqs.DeleteMessageInput{
-		QueueUrl:      &url,
+	_, err := a.activeSQS().DeleteMessage(&sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(a.queueURL(url)),
 		ReceiptHandle: &handle,
 	})
 	return err
 }
 
 func (a *AwsConn) Download(bucket string, key string, path string) error {
+	return a.DownloadWithContext(context.Background(), bucket, key, path)
+}
+
+// DownloadWithContext downloads a file from S3, as with Download, but
+// stops if ctx is cancelled, removing the partially downloaded file.
+func (a *AwsConn) DownloadWithContext(ctx context.Context, bucket string, key string, path string) error {
 	f, err := os.Create(path)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	_, err = a.downloader.Download(f,
+	_, err = a.activeDownloader().DownloadWithContext(ctx, f,
 		&s3.GetObjectInput{
-			Bucket: aws.String(bucket),
+			Bucket: aws.String(a.bucketName(bucket)),
 			Key:    &key,
 		})
 	if err != nil {
+		f.Close()
 		_ = os.Remove(path)
 	}
 	return err
 }
 
+// Upload uploads a file to S3. Files larger than the upload part
+// size are sent as a multipart upload, with several parts uploaded
+// concurrently, so that a failure only requires the affected part
+// to be retried rather than the whole file.
 func (a *AwsConn) Upload(bucket string, key string, path string) error {
+	return a.UploadClass(bucket, key, path, ObjectFinal)
+}
+
+// UploadClass uploads a file to S3 like Upload, using the storage
+// class set for objects of type objtype in StorageClasses.
+func (a *AwsConn) UploadClass(bucket string, key string, path string, objtype string) error {
 	file, err := os.Open(path)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	_, err = a.uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-		Body:   file,
+	class, ok := a.StorageClasses[objtype]
+	if !ok {
+		class = s3.StorageClassStandard
+	}
+
+	_, err = a.activeUploader().Upload(&s3manager.UploadInput{
+		Bucket:       aws.String(a.bucketName(bucket)),
+		Key:          aws.String(key),
+		Body:         file,
+		StorageClass: aws.String(class),
+	})
+	return err
+}
+
+// Copy copies an object to another bucket (or key) within S3. The
+// copy is done server-side, so the data doesn't need to be
+// downloaded and uploaded again.
+func (a *AwsConn) Copy(srcbucket string, srckey string, dstbucket string, dstkey string) error {
+	_, err := a.activeS3().CopyObject(&s3.CopyObjectInput{
+		Bucket:     aws.String(a.bucketName(dstbucket)),
+		Key:        aws.String(dstkey),
+		CopySource: aws.String(url.PathEscape(a.bucketName(srcbucket) + "/" + srckey)),
 	})
 	return err
 }
@@ -582,6 +778,7 @@ func instanceDetailsFromPage(page *ec2.DescribeInstancesOutput) []InstanceDetail
 			d.Type = *i.InstanceType
 			d.Id = *i.InstanceId
 			d.LaunchTime = i.LaunchTime.String()
+			d.Launched = *i.LaunchTime
 			d.State = *i.State.Name
 
 			details = append(details, d)
@@ -595,6 +792,7 @@ func (a *AwsConn) GetInstanceDetails() ([]InstanceDetails, error) {
 	var details []InstanceDetails
 	err := a.ec2svc.DescribeInstancesPages(&ec2.DescribeInstancesInput{}, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
 		for _, d := range instanceDetailsFromPage(page) {
+			d.Region = a.Region
 			details = append(details, d)
 		}
 		return !lastPage
@@ -623,7 +821,7 @@ func (a *AwsConn) StartInstances(n int) error {
 // Log records an item in the with the Logger. Arguments are handled
 // as with fmt.Println.
 func (a *AwsConn) Log(v ...interface{}) {
-	a.Logger.Println(v...)
+	LogMessage(a.Logger, v...)
 }
 
 // mkpipeline sets up necessary buckets and queues for the pipeline
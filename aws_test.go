@@ -0,0 +1,403 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// mockS3 records the S3 calls made by an uploader, without
+// sending anything anywhere
+type mockS3 struct {
+	s3iface.S3API
+	mu      sync.Mutex
+	puts    int
+	parts   int
+	classes []string
+}
+
+// mockRequest creates a request which does nothing when sent
+func mockRequest(name string, method string, in interface{}, out interface{}) *request.Request {
+	op := &request.Operation{Name: name, HTTPMethod: method, HTTPPath: "/"}
+	return request.New(aws.Config{}, metadata.ClientInfo{}, request.Handlers{}, nil, op, in, out)
+}
+
+func (m *mockS3) PutObjectRequest(in *s3.PutObjectInput) (*request.Request, *s3.PutObjectOutput) {
+	m.mu.Lock()
+	m.puts++
+	m.classes = append(m.classes, aws.StringValue(in.StorageClass))
+	m.mu.Unlock()
+	out := &s3.PutObjectOutput{}
+	return mockRequest("PutObject", "PUT", in, out), out
+}
+
+func (m *mockS3) GetObjectRequest(in *s3.GetObjectInput) (*request.Request, *s3.GetObjectOutput) {
+	out := &s3.GetObjectOutput{}
+	return mockRequest("GetObject", "GET", in, out), out
+}
+
+func (m *mockS3) CreateMultipartUploadWithContext(ctx aws.Context, in *s3.CreateMultipartUploadInput, opts ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String("test")}, nil
+}
+
+func (m *mockS3) UploadPartWithContext(ctx aws.Context, in *s3.UploadPartInput, opts ...request.Option) (*s3.UploadPartOutput, error) {
+	_, err := io.Copy(ioutil.Discard, in.Body)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	m.parts++
+	m.mu.Unlock()
+	return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf("part%d", *in.PartNumber))}, nil
+}
+
+func (m *mockS3) CompleteMultipartUploadWithContext(ctx aws.Context, in *s3.CompleteMultipartUploadInput, opts ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (m *mockS3) AbortMultipartUploadWithContext(ctx aws.Context, in *s3.AbortMultipartUploadInput, opts ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func Test_Upload(t *testing.T) {
+	partsize := s3manager.MinUploadPartSize
+
+	cases := []struct {
+		name  string
+		size  int64
+		puts  int
+		parts int
+	}{
+		{"small", 1024, 1, 0},
+		{"large", partsize*2 + 1, 0, 3},
+	}
+
+	dir, err := ioutil.TempDir("", "bookpipelinetest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fn := filepath.Join(dir, c.name)
+			err := ioutil.WriteFile(fn, make([]byte, c.size), 0600)
+			if err != nil {
+				t.Fatalf("Could not create test file: %v", err)
+			}
+
+			mock := &mockS3{}
+			a := &AwsConn{Logger: log.New(ioutil.Discard, "", 0), UploadPartSize: partsize, UploadConcurrency: 2}
+			a.uploader = s3manager.NewUploaderWithClient(mock, a.configureUploader)
+
+			err = a.Upload("bucket", c.name, fn)
+			if err != nil {
+				t.Fatalf("Error uploading: %v", err)
+			}
+			if mock.puts != c.puts {
+				t.Fatalf("Expected %d simple puts, got %d", c.puts, mock.puts)
+			}
+			if mock.parts != c.parts {
+				t.Fatalf("Expected %d multipart parts, got %d", c.parts, mock.parts)
+			}
+		})
+	}
+}
+
+// Test_UploadClass tests that objects are uploaded with the storage
+// class set for their type, and STANDARD otherwise
+func Test_UploadClass(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookpipelinetest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "0001_bin0.2.png")
+	err = ioutil.WriteFile(fn, make([]byte, 1024), 0600)
+	if err != nil {
+		t.Fatalf("Could not create test file: %v", err)
+	}
+
+	cases := []struct {
+		name    string
+		objtype string
+		class   string
+	}{
+		{"intermediate", ObjectIntermediate, s3.StorageClassStandardIa},
+		{"final", ObjectFinal, s3.StorageClassStandard},
+		{"unknown", "other", s3.StorageClassStandard},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mock := &mockS3{}
+			a := &AwsConn{Logger: log.New(ioutil.Discard, "", 0), StorageClasses: map[string]string{ObjectIntermediate: s3.StorageClassStandardIa}}
+			a.uploader = s3manager.NewUploaderWithClient(mock)
+
+			err := a.UploadClass("bucket", "book/0001_bin0.2.png", fn, c.objtype)
+			if err != nil {
+				t.Fatalf("Error uploading: %v", err)
+			}
+			if len(mock.classes) != 1 || mock.classes[0] != c.class {
+				t.Fatalf("Expected upload with storage class %s, got %v", c.class, mock.classes)
+			}
+		})
+	}
+
+	t.Run("upload", func(t *testing.T) {
+		mock := &mockS3{}
+		a := &AwsConn{Logger: log.New(ioutil.Discard, "", 0), StorageClasses: map[string]string{ObjectIntermediate: s3.StorageClassStandardIa}}
+		a.uploader = s3manager.NewUploaderWithClient(mock)
+
+		err := a.Upload("bucket", "book/graph.png", fn)
+		if err != nil {
+			t.Fatalf("Error uploading: %v", err)
+		}
+		if len(mock.classes) != 1 || mock.classes[0] != s3.StorageClassStandard {
+			t.Fatalf("Expected Upload to use the STANDARD storage class, got %v", mock.classes)
+		}
+	})
+
+	for _, class := range []string{"CHEAP", s3.StorageClassGlacier, s3.StorageClassDeepArchive} {
+		t.Run("invalid "+class, func(t *testing.T) {
+			a := &AwsConn{Logger: log.New(ioutil.Discard, "", 0), StorageClasses: map[string]string{ObjectIntermediate: class}}
+			err := a.MinimalInit()
+			if err == nil {
+				t.Fatalf("Expected an error for the storage class %s", class)
+			}
+		})
+	}
+}
+
+// Test_MinimalInitConfig tests that the region and credentials are
+// found from the environment when there are no shared config files
+func Test_MinimalInitConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookpipelinetest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "notpresent"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "notpresent"))
+	t.Setenv("AWS_ACCESS_KEY_ID", "testkeyid")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "testsecret")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+	t.Setenv("AWS_PROFILE", "")
+
+	cases := []struct {
+		name     string
+		env      string
+		region   string
+		expected string
+	}{
+		{"env", "us-east-1", "", "us-east-1"},
+		{"override", "us-east-1", "ap-south-1", "ap-south-1"},
+		{"default", "", "", defaultAwsRegion},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			t.Setenv("AWS_REGION", c.env)
+			a := &AwsConn{Region: c.region, Logger: log.New(ioutil.Discard, "", 0)}
+			err := a.MinimalInit()
+			if err != nil {
+				t.Fatalf("Error in MinimalInit: %v", err)
+			}
+			if a.Region != c.expected {
+				t.Fatalf("Expected region %s, got %s", c.expected, a.Region)
+			}
+			if *a.s3svc.Config.Region != c.expected {
+				t.Fatalf("Expected S3 region %s, got %s", c.expected, *a.s3svc.Config.Region)
+			}
+			creds, err := a.sess.Config.Credentials.Get()
+			if err != nil {
+				t.Fatalf("Error getting credentials: %v", err)
+			}
+			if creds.AccessKeyID != "testkeyid" || creds.SecretAccessKey != "testsecret" {
+				t.Fatalf("Credentials not taken from environment, got %s", creds.AccessKeyID)
+			}
+		})
+	}
+}
+
+// recordingTransport records the host of each request made through
+// it, and responds to each one with an access denied error
+type recordingTransport struct {
+	mu    sync.Mutex
+	hosts []string
+}
+
+func (r *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.mu.Lock()
+	r.hosts = append(r.hosts, req.URL.Host)
+	r.mu.Unlock()
+	return &http.Response{
+		StatusCode: http.StatusForbidden,
+		Status:     "403 Forbidden",
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+// setTestAwsEnv sets the environment so that a connection can be set
+// up without any real configuration or credentials
+func setTestAwsEnv(t *testing.T, dir string) {
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "notpresent"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "notpresent"))
+	t.Setenv("AWS_ACCESS_KEY_ID", "testkeyid")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "testsecret")
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_CA_BUNDLE", "")
+}
+
+// Test_HTTPClient tests that a custom HTTP client is used for both
+// S3 and SQS requests
+func Test_HTTPClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookpipelinetest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	setTestAwsEnv(t, dir)
+
+	rt := &recordingTransport{}
+	a := &AwsConn{
+		Region:     "eu-west-2",
+		Logger:     log.New(ioutil.Discard, "", 0),
+		HTTPClient: &http.Client{Transport: rt},
+	}
+	err = a.Init()
+	if err == nil {
+		t.Fatalf("Expected an error from Init with a transport which denies all requests, got none")
+	}
+	_, err = a.ListObjects("bucket", "prefix")
+	if err == nil {
+		t.Fatalf("Expected an error from ListObjects with a transport which denies all requests, got none")
+	}
+
+	var sawsqs, saws3 bool
+	for _, h := range rt.hosts {
+		if strings.HasPrefix(h, "sqs.") {
+			sawsqs = true
+		}
+		if strings.Contains(h, "s3.") {
+			saws3 = true
+		}
+	}
+	if !sawsqs || !saws3 {
+		t.Fatalf("Expected both SQS and S3 requests to use custom transport, got requests to %v", rt.hosts)
+	}
+}
+
+// Test_ProxyEnv tests that the proxy environment variables are
+// respected when no custom HTTP client is set, by the client being
+// left to the AWS SDK's default, which uses a transport which finds
+// the proxy from the environment
+func Test_ProxyEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookpipelinetest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	setTestAwsEnv(t, dir)
+
+	a := &AwsConn{Region: "eu-west-2", Logger: log.New(ioutil.Discard, "", 0)}
+	err = a.MinimalInit()
+	if err != nil {
+		t.Fatalf("Error in MinimalInit: %v", err)
+	}
+	c := a.sess.Config.HTTPClient
+	if c == nil {
+		t.Fatalf("Expected an HTTP client to be set")
+	}
+	rt := c.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	tr, ok := rt.(*http.Transport)
+	if !ok || tr.Proxy == nil {
+		t.Fatalf("Expected a transport with a proxy function to be set")
+	}
+}
+
+// mockSQS records the ReceiveMessage requests made, without sending
+// anything anywhere
+type mockSQS struct {
+	sqsiface.SQSAPI
+	received []*sqs.ReceiveMessageInput
+}
+
+func (m *mockSQS) ReceiveMessage(in *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	m.received = append(m.received, in)
+	return &sqs.ReceiveMessageOutput{}, nil
+}
+
+// Test_CheckQueueLongPoll tests that CheckQueue uses long polling
+// rather than returning immediately if there are no messages
+func Test_CheckQueueLongPoll(t *testing.T) {
+	mock := &mockSQS{}
+	a := &AwsConn{Logger: log.New(ioutil.Discard, "", 0), sqssvc: mock}
+
+	msg, err := a.CheckQueue("queue", 120)
+	if err != nil {
+		t.Fatalf("Error checking queue: %v", err)
+	}
+	if msg.Handle != "" {
+		t.Fatalf("Expected no message, got %v", msg)
+	}
+	if len(mock.received) != 1 {
+		t.Fatalf("Expected 1 ReceiveMessage request, got %d", len(mock.received))
+	}
+	in := mock.received[0]
+	if in.WaitTimeSeconds == nil || *in.WaitTimeSeconds != LongPollSeconds {
+		t.Fatalf("Expected long polling for %d seconds, got %v", LongPollSeconds, in.WaitTimeSeconds)
+	}
+	if *in.VisibilityTimeout != 120 || *in.QueueUrl != "queue" {
+		t.Fatalf("Unexpected request %v", in)
+	}
+}
+
+func Test_MsgBook(t *testing.T) {
+	cases := []struct {
+		body     string
+		expected string
+	}{
+		{"book1", "book1"},
+		{"book1 eng", "book1"},
+		{"book1 eng binmethod=none", "book1"},
+		{"book1/0001.png", "book1"},
+		{"book1/0001_bin0.2.png rescribev9", "book1"},
+		{"book10", "book10"},
+	}
+	for _, c := range cases {
+		t.Run(c.body, func(t *testing.T) {
+			got := MsgBook(c.body)
+			if got != c.expected {
+				t.Fatalf("Expected %s, got %s", c.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// DefaultFailoverAfter is the number of failed requests in a row
+// after which an AwsConn switches to its next failover region, if
+// Failover.After isn't set.
+const DefaultFailoverAfter = 5
+
+// Failover configures an AwsConn to switch to replicas of the
+// pipeline's queues and buckets in other regions if requests to the
+// primary region keep failing, for example during an outage. The
+// replicas must be set up separately, for example with mkpipeline
+// and S3 replication; the failover regions are only used once the
+// primary region is failing, each in turn if the one before it also
+// fails, and the AwsConn doesn't switch back.
+//
+// Messages received from a queue in one region can't be deleted or
+// have their visibility changed in a replica queue, so any books
+// being processed when a switch happens will need to be added to the
+// replica queue again once they fail.
+type Failover struct {
+	// Regions are the regions containing the replicas, in the order
+	// they are switched to
+	Regions []string
+	// Buckets maps each failover region to a map of the name of each
+	// bucket in the primary region to the name of its replica in
+	// that region. Bucket names are unique across all regions, so
+	// each replica needs a different name. Any bucket not listed is
+	// expected to have a replica named after it with "-" and the
+	// region added, like rescribeinprogress-eu-west-1. Init checks
+	// that the replica of the bucket of books in progress, and each
+	// replica listed here, exists in every failover region, so that
+	// a missing replica is found before it is needed.
+	Buckets map[string]map[string]string
+	// After is the number of requests to S3 or SQS in a row which
+	// must fail with a server or connection error before switching
+	// to the next failover region. If it is zero DefaultFailoverAfter
+	// is used.
+	After int
+}
+
+// ParseFailoverRegions parses a comma separated list of failover
+// regions, as used by the -failover flag, returning a Failover using
+// them with the default replica bucket names, or nil if s is empty.
+func ParseFailoverRegions(s string) *Failover {
+	var regions []string
+	for _, r := range strings.Split(s, ",") {
+		r = strings.TrimSpace(r)
+		if r != "" {
+			regions = append(regions, r)
+		}
+	}
+	if len(regions) == 0 {
+		return nil
+	}
+	return &Failover{Regions: regions}
+}
+
+// replicaBucket returns the name of the replica of a bucket in a
+// failover region
+func (f *Failover) replicaBucket(bucket string, region string) string {
+	if b, ok := f.Buckets[region][bucket]; ok {
+		return b
+	}
+	return bucket + "-" + region
+}
+
+// regionClients are the clients for a failover region
+type regionClients struct {
+	region     string
+	s3svc      *s3.S3
+	sqssvc     sqsiface.SQSAPI
+	downloader *s3manager.Downloader
+	uploader   *s3manager.Uploader
+	// qurls maps the URL of each queue in the primary region to
+	// the URL of its replica
+	qurls map[string]string
+}
+
+// failoverState contains the clients for each failover region, and
+// tracks which region should be used
+type failoverState struct {
+	mu       sync.Mutex
+	failures int
+	// active is the index of the failover region in use, or -1 if
+	// the primary region is in use
+	active  int
+	regions []*regionClients
+}
+
+// initFailover sets up the clients for the failover regions, using
+// the same settings as the primary region given in cfg, and starts
+// watching requests to each region for failures. It must be called
+// before the primary region's clients are created.
+func (a *AwsConn) initFailover(cfg aws.Config) error {
+	if len(a.Failover.Regions) == 0 {
+		return errors.New("No failover regions set")
+	}
+
+	a.failover = &failoverState{active: -1}
+	seen := map[string]bool{a.Region: true}
+	for _, region := range a.Failover.Regions {
+		if seen[region] {
+			return fmt.Errorf("Failover region %s must be different from %s and every other failover region", region, a.Region)
+		}
+		seen[region] = true
+
+		cfg.Region = aws.String(region)
+		sess, err := session.NewSessionWithOptions(session.Options{
+			Config:            cfg,
+			SharedConfigState: session.SharedConfigEnable,
+		})
+		if err != nil {
+			return errors.New(fmt.Sprintf("Failed to set up aws session for failover region %s: %s", region, err))
+		}
+		sess.Handlers.Complete.PushBack(a.recordResult)
+		a.failover.regions = append(a.failover.regions, &regionClients{
+			region:     region,
+			s3svc:      s3.New(sess),
+			sqssvc:     sqs.New(sess),
+			downloader: s3manager.NewDownloader(sess),
+			uploader:   s3manager.NewUploader(sess, a.configureUploader),
+			qurls:      make(map[string]string),
+		})
+	}
+	a.sess.Handlers.Complete.PushBack(a.recordResult)
+	return nil
+}
+
+// addFailoverQueue finds the URL of the replica of a queue in each
+// failover region, so that it can be used in place of url
+func (a *AwsConn) addFailoverQueue(url string, name string) error {
+	for _, rc := range a.failover.regions {
+		result, err := rc.sqssvc.GetQueueUrl(&sqs.GetQueueUrlInput{
+			QueueName: aws.String(name),
+		})
+		if err != nil {
+			return errors.New(fmt.Sprintf("Error getting failover URL for queue %s in region %s: %s", name, rc.region, err))
+		}
+		rc.qurls[url] = *result.QueueUrl
+	}
+	return nil
+}
+
+// checkFailoverBuckets checks that the replica of the WIP bucket, and
+// every replica bucket listed in a.Failover.Buckets, exists in each
+// failover region
+func (a *AwsConn) checkFailoverBuckets() error {
+	for _, rc := range a.failover.regions {
+		buckets := []string{a.Failover.replicaBucket(storageWip, rc.region)}
+		for _, b := range a.Failover.Buckets[rc.region] {
+			buckets = append(buckets, b)
+		}
+		for _, b := range buckets {
+			_, err := rc.s3svc.HeadBucket(&s3.HeadBucketInput{
+				Bucket: aws.String(b),
+			})
+			if err != nil {
+				return errors.New(fmt.Sprintf("Error checking failover bucket %s in region %s: %s", b, rc.region, err))
+			}
+		}
+	}
+	return nil
+}
+
+// isOutage returns whether a request failed because of a problem on
+// the AWS side, rather than a problem with the request itself, which
+// is the kind of failure which failing over may help with.
+func isOutage(r *request.Request) bool {
+	if r.Error == nil {
+		return false
+	}
+	aerr, ok := r.Error.(awserr.Error)
+	if ok && aerr.Code() == request.CanceledErrorCode {
+		return false
+	}
+	return r.HTTPResponse == nil || r.HTTPResponse.StatusCode == 0 || r.HTTPResponse.StatusCode >= 500
+}
+
+// recordResult is run after each request to any region, switching to
+// the next failover region once enough requests to S3 or SQS in the
+// region in use have failed in a row with an outage.
+func (a *AwsConn) recordResult(r *request.Request) {
+	svc := r.ClientInfo.ServiceName
+	if svc != s3.ServiceName && svc != sqs.ServiceName {
+		return
+	}
+
+	a.failover.mu.Lock()
+	defer a.failover.mu.Unlock()
+	current := a.Region
+	if a.failover.active >= 0 {
+		current = a.failover.regions[a.failover.active].region
+	}
+	if aws.StringValue(r.Config.Region) != current || a.failover.active == len(a.failover.regions)-1 {
+		return
+	}
+	if !isOutage(r) {
+		a.failover.failures = 0
+		return
+	}
+	a.failover.failures++
+	after := a.Failover.After
+	if after <= 0 {
+		after = DefaultFailoverAfter
+	}
+	if a.failover.failures >= after {
+		a.failover.active++
+		a.Logger.Printf("%d requests to region %s failed in a row, switching to failover region %s\n", a.failover.failures, current, a.failover.regions[a.failover.active].region)
+		a.failover.failures = 0
+	}
+}
+
+// activeFailover returns the clients for the failover region in use,
+// or nil if the primary region is in use
+func (a *AwsConn) activeFailover() *regionClients {
+	if a.failover == nil {
+		return nil
+	}
+	a.failover.mu.Lock()
+	defer a.failover.mu.Unlock()
+	if a.failover.active < 0 {
+		return nil
+	}
+	return a.failover.regions[a.failover.active]
+}
+
+// activeS3 returns the S3 client for the region in use
+func (a *AwsConn) activeS3() *s3.S3 {
+	if rc := a.activeFailover(); rc != nil {
+		return rc.s3svc
+	}
+	return a.s3svc
+}
+
+// activeSQS returns the SQS client for the region in use
+func (a *AwsConn) activeSQS() sqsiface.SQSAPI {
+	if rc := a.activeFailover(); rc != nil {
+		return rc.sqssvc
+	}
+	return a.sqssvc
+}
+
+// activeDownloader returns the S3 downloader for the region in use
+func (a *AwsConn) activeDownloader() *s3manager.Downloader {
+	if rc := a.activeFailover(); rc != nil {
+		return rc.downloader
+	}
+	return a.downloader
+}
+
+// activeUploader returns the S3 uploader for the region in use
+func (a *AwsConn) activeUploader() *s3manager.Uploader {
+	if rc := a.activeFailover(); rc != nil {
+		return rc.uploader
+	}
+	return a.uploader
+}
+
+// queueURL returns the URL to use for the queue with the primary
+// region URL given, which is its replica once failed over. Queue URLs
+// are always given and returned by AwsConn as those of the primary
+// region, so that they don't change for callers after failing over.
+func (a *AwsConn) queueURL(url string) string {
+	rc := a.activeFailover()
+	if rc == nil {
+		return url
+	}
+	if u, ok := rc.qurls[url]; ok {
+		return u
+	}
+	return url
+}
+
+// bucketName returns the name to use for the bucket given, which is
+// its replica once failed over
+func (a *AwsConn) bucketName(bucket string) string {
+	rc := a.activeFailover()
+	if rc == nil {
+		return bucket
+	}
+	return a.Failover.replicaBucket(bucket, rc.region)
+}
@@ -0,0 +1,227 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// regionTransport simulates S3 and SQS in several regions, any of
+// which can be made to fail with a server error. ListObjects returns
+// a single key naming the host and path of the request, so that it is
+// clear which region and bucket were used.
+type regionTransport struct {
+	mu      sync.Mutex
+	down    string
+	missing string
+	queues  []string
+	account string
+}
+
+func (rt *regionTransport) setDown(region string) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.down = region
+}
+
+func (rt *regionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.mu.Lock()
+	down := rt.down
+	rt.mu.Unlock()
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     make(http.Header),
+		Request:    req,
+	}
+	body := ""
+	switch {
+	case down != "" && strings.Contains(req.URL.Host, "."+down+"."):
+		resp.StatusCode = http.StatusInternalServerError
+		resp.Status = "500 Internal Server Error"
+	case rt.missing != "" && req.Method == http.MethodHead && strings.Contains(req.URL.Host+req.URL.Path, rt.missing):
+		resp.StatusCode = http.StatusNotFound
+		resp.Status = "404 Not Found"
+	case strings.HasPrefix(req.URL.Host, "sqs."):
+		b, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		form, err := url.ParseQuery(string(b))
+		if err != nil {
+			return nil, err
+		}
+		switch form.Get("Action") {
+		case "GetQueueUrl":
+			body = fmt.Sprintf("<GetQueueUrlResponse><GetQueueUrlResult><QueueUrl>https://%s/%s/%s</QueueUrl></GetQueueUrlResult></GetQueueUrlResponse>", req.URL.Host, rt.account, form.Get("QueueName"))
+		case "ReceiveMessage":
+			rt.mu.Lock()
+			rt.queues = append(rt.queues, form.Get("QueueUrl"))
+			rt.mu.Unlock()
+			body = "<ReceiveMessageResponse><ReceiveMessageResult></ReceiveMessageResult></ReceiveMessageResponse>"
+		default:
+			return nil, fmt.Errorf("Unexpected SQS action %s", form.Get("Action"))
+		}
+	default:
+		body = fmt.Sprintf("<ListBucketResult><IsTruncated>false</IsTruncated><Contents><Key>%s%s</Key></Contents></ListBucketResult>", req.URL.Host, req.URL.Path)
+	}
+	resp.Body = ioutil.NopCloser(strings.NewReader(body))
+	return resp, nil
+}
+
+// Test_Failover tests that repeated server errors from the primary
+// region cause the failover region's clients, replica buckets and
+// queues to be used, and that repeated errors from that region cause
+// the next failover region to be used
+func Test_Failover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookpipelinetest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	setTestAwsEnv(t, dir)
+
+	rt := &regionTransport{account: "123456789012"}
+	a := &AwsConn{
+		Region:     "eu-west-2",
+		Logger:     log.New(ioutil.Discard, "", 0),
+		HTTPClient: &http.Client{Transport: rt},
+		Failover: &Failover{
+			Regions: []string{"eu-west-1", "eu-central-1"},
+			Buckets: map[string]map[string]string{"eu-west-1": {storageWip: storageWip + "-replica"}},
+			After:   2,
+		},
+	}
+	err = a.Init()
+	if err != nil {
+		t.Fatalf("Error in Init: %v", err)
+	}
+	primaryqurl := a.PreQueueId()
+
+	// list returns the single object listed in the WIP bucket
+	list := func() (string, error) {
+		objs, err := a.ListObjects(a.WIPStorageId(), "book/")
+		if err != nil {
+			return "", err
+		}
+		if len(objs) != 1 {
+			return "", fmt.Errorf("Expected 1 object, got %v", objs)
+		}
+		return objs[0], nil
+	}
+
+	obj, err := list()
+	if err != nil {
+		t.Fatalf("Error listing objects before failure: %v", err)
+	}
+	if !strings.Contains(obj, "eu-west-2") || strings.Contains(obj, "replica") {
+		t.Fatalf("Expected primary bucket to be used before failure, got %s", obj)
+	}
+
+	rt.setDown("eu-west-2")
+	for i := 0; i < a.Failover.After; i++ {
+		_, err = list()
+		if err == nil {
+			t.Fatalf("Expected an error listing objects while primary region is down, got none")
+		}
+	}
+
+	obj, err = list()
+	if err != nil {
+		t.Fatalf("Error listing objects after failover: %v", err)
+	}
+	if !strings.Contains(obj, "eu-west-1") || !strings.Contains(obj, storageWip+"-replica") {
+		t.Fatalf("Expected replica bucket in failover region to be used, got %s", obj)
+	}
+
+	_, err = a.CheckQueue(a.PreQueueId(), 10)
+	if err != nil {
+		t.Fatalf("Error checking queue after failover: %v", err)
+	}
+	if a.PreQueueId() != primaryqurl {
+		t.Fatalf("Expected queue id to stay the same after failover, got %s", a.PreQueueId())
+	}
+	last := rt.queues[len(rt.queues)-1]
+	if !strings.Contains(last, "sqs.eu-west-1.") || !strings.HasSuffix(last, "/"+queuePreProc) {
+		t.Fatalf("Expected replica queue in failover region to be used, got %s", last)
+	}
+
+	rt.setDown("eu-west-1")
+	for i := 0; i < a.Failover.After; i++ {
+		_, err = list()
+		if err == nil {
+			t.Fatalf("Expected an error listing objects while failover region is down, got none")
+		}
+	}
+
+	obj, err = list()
+	if err != nil {
+		t.Fatalf("Error listing objects after second failover: %v", err)
+	}
+	if !strings.Contains(obj, "eu-central-1") || !strings.Contains(obj, storageWip+"-eu-central-1") {
+		t.Fatalf("Expected default replica bucket in second failover region to be used, got %s", obj)
+	}
+	_, err = a.CheckQueue(a.PreQueueId(), 10)
+	if err != nil {
+		t.Fatalf("Error checking queue after second failover: %v", err)
+	}
+	last = rt.queues[len(rt.queues)-1]
+	if !strings.Contains(last, "sqs.eu-central-1.") || !strings.HasSuffix(last, "/"+queuePreProc) {
+		t.Fatalf("Expected replica queue in second failover region to be used, got %s", last)
+	}
+
+	missing := &AwsConn{
+		Region:     "eu-west-2",
+		Logger:     log.New(ioutil.Discard, "", 0),
+		HTTPClient: &http.Client{Transport: &regionTransport{account: "123456789012", missing: storageWip + "-eu-central-1"}},
+		Failover:   &Failover{Regions: []string{"eu-west-1", "eu-central-1"}},
+	}
+	err = missing.Init()
+	if err == nil || !strings.Contains(err.Error(), storageWip+"-eu-central-1") {
+		t.Fatalf("Expected an error for a missing replica bucket, got %v", err)
+	}
+
+	for _, regions := range [][]string{{}, {"eu-west-2"}, {"eu-west-1", "eu-west-1"}} {
+		bad := &AwsConn{Region: "eu-west-2", Logger: log.New(ioutil.Discard, "", 0), Failover: &Failover{Regions: regions}}
+		err = bad.MinimalInit()
+		if err == nil {
+			t.Fatalf("Expected an error using failover regions %v, got none", regions)
+		}
+	}
+}
+
+func Test_ParseFailoverRegions(t *testing.T) {
+	cases := []struct {
+		s        string
+		expected []string
+	}{
+		{"", nil},
+		{"eu-west-1", []string{"eu-west-1"}},
+		{"eu-west-1, eu-central-1,", []string{"eu-west-1", "eu-central-1"}},
+	}
+	for _, c := range cases {
+		t.Run(c.s, func(t *testing.T) {
+			f := ParseFailoverRegions(c.s)
+			if c.expected == nil {
+				if f != nil {
+					t.Fatalf("Expected no failover, got %v", f.Regions)
+				}
+				return
+			}
+			if f == nil || strings.Join(f.Regions, " ") != strings.Join(c.expected, " ") {
+				t.Fatalf("Expected failover regions %v, got %v", c.expected, f)
+			}
+		})
+	}
+}
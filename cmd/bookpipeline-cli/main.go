@@ -0,0 +1,36 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+// bookpipeline-cli manages the book pipeline, combining several
+// separate tools into subcommands of a single program:
+//
+//	upload       booktopipeline
+//	get          getpipelinebook
+//	ls           lspipeline
+//	rm           rmbook
+//	cancel       cancelbook
+//	pause
+//	rewipe       rewipe
+//	spot         spotme
+//	verify       verifybook
+//	queue add    addtoqueue
+//	queue trim   trimqueue
+//	queue log    logwholequeue
+//
+// Run "bookpipeline-cli command -h" for the usage of each command.
+package main
+
+import (
+	"log"
+	"os"
+
+	"rescribe.xyz/bookpipeline/internal/cli"
+)
+
+func main() {
+	err := cli.Run(os.Args[1:])
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
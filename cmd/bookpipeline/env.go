@@ -0,0 +1,98 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"rescribe.xyz/bookpipeline/internal/pipeline"
+)
+
+// maxQueueTimeoutSecs is the longest visibility timeout SQS allows
+const maxQueueTimeoutSecs = 12 * 60 * 60
+
+// minQueueTimeoutSecs is the shortest queue timeout allowed, as a
+// message must stay hidden until the first heartbeat has extended
+// it, with time to spare in case the heartbeat is slow
+const minQueueTimeoutSecs = 2 * pipeline.HeartbeatSeconds
+
+// settings are the timings and default training used by the main
+// loop, which can be overridden with environment variables
+type settings struct {
+	queueTimeoutSecs   int64
+	pauseBetweenChecks time.Duration
+	maxPauseJitter     time.Duration
+	logSaveTime        time.Duration
+	training           string
+}
+
+func (s settings) String() string {
+	return fmt.Sprintf("queue timeout %ds, pause between checks %s, max pause jitter %s, log save time %s, training %s",
+		s.queueTimeoutSecs, s.pauseBetweenChecks, s.maxPauseJitter, s.logSaveTime, s.training)
+}
+
+// envDuration parses the duration in environment variable name, if
+// it is set, checking that it is at least min
+func envDuration(getenv func(string) string, name string, d *time.Duration, min time.Duration) error {
+	v := getenv(name)
+	if v == "" {
+		return nil
+	}
+	parsed, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("Invalid %s %s, should be a duration like 3m: %v", name, v, err)
+	}
+	if parsed < min {
+		return fmt.Errorf("Invalid %s %s, should be at least %s", name, v, min)
+	}
+	*d = parsed
+	return nil
+}
+
+// envSettings returns the settings to use, which are the defaults
+// unless they are overridden by environment variables, as returned
+// by getenv. An error is returned if any are invalid.
+func envSettings(getenv func(string) string) (settings, error) {
+	s := settings{
+		queueTimeoutSecs:   QueueTimeoutSecs,
+		pauseBetweenChecks: PauseBetweenChecks,
+		maxPauseJitter:     MaxPauseJitter,
+		logSaveTime:        LogSaveTime,
+		training:           DefaultTraining,
+	}
+
+	if v := getenv("BOOKPIPELINE_QUEUE_TIMEOUT_SECS"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < minQueueTimeoutSecs || n > maxQueueTimeoutSecs {
+			return s, fmt.Errorf("Invalid BOOKPIPELINE_QUEUE_TIMEOUT_SECS %s, should be a number of seconds between %d and %d", v, minQueueTimeoutSecs, maxQueueTimeoutSecs)
+		}
+		s.queueTimeoutSecs = n
+	}
+
+	err := envDuration(getenv, "BOOKPIPELINE_PAUSE_BETWEEN_CHECKS", &s.pauseBetweenChecks, time.Second)
+	if err != nil {
+		return s, err
+	}
+	err = envDuration(getenv, "BOOKPIPELINE_MAX_PAUSE_JITTER", &s.maxPauseJitter, 0)
+	if err != nil {
+		return s, err
+	}
+	err = envDuration(getenv, "BOOKPIPELINE_LOG_SAVE_TIME", &s.logSaveTime, time.Second)
+	if err != nil {
+		return s, err
+	}
+
+	if v := getenv("BOOKPIPELINE_TRAINING"); v != "" {
+		if strings.ContainsAny(v, " \t\n") {
+			return s, fmt.Errorf("Invalid BOOKPIPELINE_TRAINING %s, should not contain spaces", v)
+		}
+		s.training = v
+	}
+
+	return s, nil
+}
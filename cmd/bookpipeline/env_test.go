@@ -0,0 +1,64 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnvSettings(t *testing.T) {
+	def := settings{
+		queueTimeoutSecs:   QueueTimeoutSecs,
+		pauseBetweenChecks: PauseBetweenChecks,
+		maxPauseJitter:     MaxPauseJitter,
+		logSaveTime:        LogSaveTime,
+		training:           DefaultTraining,
+	}
+
+	cases := []struct {
+		name     string
+		env      map[string]string
+		expected func(s settings) settings
+		err      bool
+	}{
+		{"defaults", map[string]string{}, func(s settings) settings { return s }, false},
+		{"queuetimeout", map[string]string{"BOOKPIPELINE_QUEUE_TIMEOUT_SECS": "300"}, func(s settings) settings { s.queueTimeoutSecs = 300; return s }, false},
+		{"pause", map[string]string{"BOOKPIPELINE_PAUSE_BETWEEN_CHECKS": "30s"}, func(s settings) settings { s.pauseBetweenChecks = 30 * time.Second; return s }, false},
+		{"jitter", map[string]string{"BOOKPIPELINE_MAX_PAUSE_JITTER": "0s"}, func(s settings) settings { s.maxPauseJitter = 0; return s }, false},
+		{"logsave", map[string]string{"BOOKPIPELINE_LOG_SAVE_TIME": "5m"}, func(s settings) settings { s.logSaveTime = 5 * time.Minute; return s }, false},
+		{"training", map[string]string{"BOOKPIPELINE_TRAINING": "eng"}, func(s settings) settings { s.training = "eng"; return s }, false},
+		{"badqueuetimeout", map[string]string{"BOOKPIPELINE_QUEUE_TIMEOUT_SECS": "2m"}, nil, true},
+		{"zeroqueuetimeout", map[string]string{"BOOKPIPELINE_QUEUE_TIMEOUT_SECS": "0"}, nil, true},
+		{"shortqueuetimeout", map[string]string{"BOOKPIPELINE_QUEUE_TIMEOUT_SECS": "90"}, nil, true},
+		{"minqueuetimeout", map[string]string{"BOOKPIPELINE_QUEUE_TIMEOUT_SECS": "120"}, func(s settings) settings { s.queueTimeoutSecs = 120; return s }, false},
+		{"longqueuetimeout", map[string]string{"BOOKPIPELINE_QUEUE_TIMEOUT_SECS": "50000"}, nil, true},
+		{"badpause", map[string]string{"BOOKPIPELINE_PAUSE_BETWEEN_CHECKS": "180"}, nil, true},
+		{"shortpause", map[string]string{"BOOKPIPELINE_PAUSE_BETWEEN_CHECKS": "1ms"}, nil, true},
+		{"negativejitter", map[string]string{"BOOKPIPELINE_MAX_PAUSE_JITTER": "-1m"}, nil, true},
+		{"badlogsave", map[string]string{"BOOKPIPELINE_LOG_SAVE_TIME": "often"}, nil, true},
+		{"badtraining", map[string]string{"BOOKPIPELINE_TRAINING": "eng lat"}, nil, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			getenv := func(k string) string { return c.env[k] }
+			s, err := envSettings(getenv)
+			if c.err {
+				if err == nil {
+					t.Fatalf("Expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			expected := c.expected(def)
+			if s != expected {
+				t.Fatalf("Expected settings %v, got %v", expected, s)
+			}
+		})
+	}
+}
@@ -15,15 +15,33 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"regexp"
+	"strings"
+	"syscall"
 	"time"
 
 	"rescribe.xyz/bookpipeline"
 
 	"rescribe.xyz/bookpipeline/internal/pipeline"
+	"rescribe.xyz/bookpipeline/internal/postproc"
 )
 
-const usage = `Usage: bookpipeline [-v] [-c conn] [-np] [-nw] [-nop] [-na] [-t training] [-shutdown true/false] [-autostop secs]
+const usage = `Usage: bookpipeline [-v] [-loglevel level] [-c conn]
+                    [-np] [-nw] [-nop] [-na] [-test] [-t training] [-l]
+                    [-dict wordlists] [-split pages] [-splitsize mb]
+                    [-mintextconf conf] [-minconf conf] [-reorient conf]
+                    [-confworkers n] [-appendreport] [-labelbelow conf]
+                    [-maxlabels n] [-scalehocr] [-streampdf] [-columns]
+                    [-tar] [-targzip] [-taronly] [-textrules file]
+                    [-params] [-publish bucket] [-posthook command]
+                    [-posthooktimeout secs] [-shutdown true/false]
+                    [-autostop secs] [-workers n] [-script name]
+                    [-whitelist chars] [-blacklist chars] [-psm modes]
+                    [-autocrop] [-croppad px] [-tsv]
+                    [-trainingstore bucket] [-intermediateclass class]
+                    [-failover regions] [-tmpdir dir]
 
 Watches the preprocess, wipeonly, ocrpage and analyse queues for messages.
 When one is found this general process is followed:
@@ -38,6 +56,176 @@ When one is found this general process is followed:
 - The book name is removed from the queue it was taken from, and
   added to the next queue for future processing
 
+If the -loglevel flag is given, only log messages at or above that
+level are shown: 'error', 'warn', 'info' or 'debug'. Debug messages
+include every file downloaded and uploaded, and every check of an
+empty queue. -v shows everything, like 'debug'.
+
+If the -publish flag is given, the final results of each book (the
+PDFs, best hOCR files, graph and so on) are copied to the bucket set
+once analysis has finished, in a directory named after the book.
+
+If the -posthook flag is given, that command is run once each book
+has been analysed (and published, if -publish is given), with the
+name of the book and the location of its results, like
+bucket/bookname, as arguments. These are also set in the environment
+as BOOKPIPELINE_BOOK and BOOKPIPELINE_LOCATION, along with
+BOOKPIPELINE_PUBLISHED, which is the location the book was published
+to, or empty if it wasn't. This can be used for any further steps,
+like uploading the book to a repository. If the command fails its
+output is logged, but the book is still counted as done. If it takes
+longer than the number of seconds given by -posthooktimeout it is
+killed, so that a hook which hangs can't hold up the pipeline.
+
+If the -minconf flag is given, any book whose average confidence is
+below it is marked as needing review rather than done, by saving a
+needsreview file alongside its results, which lspipeline shows.
+Books needing review are not published with -publish.
+
+If the -reorient flag is given, any page whose best version has a
+lower confidence than it is checked to see whether it was scanned
+upside down, by rotating its image by 180 degrees and OCRing it
+again. If the rotated version has a much higher confidence it is
+used instead, and the page is listed in a reoriented file alongside
+the results.
+
+By default the pages of the confidence graph outside the top and
+bottom tenth of confidences are labelled with their page number. If
+-labelbelow is given only pages with a lower confidence are labelled
+instead, and if -maxlabels is given at most that many pages are
+labelled, those with the lowest confidence.
+
+If -confworkers is given, analysis calculates the confidence of up
+to that many hOCR files at once, which can speed up the analysis of
+large books on machines with several cores. The results are the same
+however many are used.
+
+If -streampdf is given, each page of the PDFs is written to disk as
+it is added, rather than each PDF being built up in memory, so that
+the memory needed stays roughly the same however many pages a book
+has. This is useful for very large books, particularly colour ones,
+though small PDFs are a little larger as the whole font is embedded.
+
+If -columns is given, the searchable text of pages with several
+columns is put in reading order in the PDFs, one column after
+another, rather than in the order tesseract found the lines, which
+can mix up the lines of different columns. This makes searching and
+selecting text in multi-column books work as expected.
+
+If the -tar flag is given, the best hOCR and text of each page, and
+the best, conf, words.jsonl and pagesizes files, are also saved
+together in a single archive, bookname.tar, or bookname.tar.gz if
+-targzip is also given. This can be downloaded and unpacked with getpipelinebook -tar.
+With -taronly those files are only saved in the archive, rather than
+also being saved individually, so that fewer objects are stored for
+each book; the PDFs and graph are still saved individually. Books
+processed with -taronly can only be downloaded with getpipelinebook
+-tar, and can't be published with -publish.
+
+If -textrules is given, the substitutions in that file are applied to
+the text of each page saved with -tar or published with -publish, to
+correct errors the OCR makes systematically, like reading a long s as an f. Each line of the
+file is a regular expression and its replacement, separated by a
+tab, and lines starting with # are ignored. The hOCR is unchanged.
+
+If -params is given, the parameters each book is processed with are
+saved to params.json alongside its images, so that its results can
+be reproduced later. This records the training, the binarisation
+method and thresholds, whether it was wiped and the wipe settings
+used, any options sent with the book, and the version of bookpipeline
+used. Once the book has been analysed the versions of tesseract used
+to OCR it are added. It can be downloaded with getpipelinebook. The
+version of tesseract each page is OCRed with is also recorded in the
+page's .ocr.json file.
+
+If -workers is given, up to that many messages are processed at
+once, each in its own temporary directory and with its own
+heartbeat. While all of the workers are busy the queues are not
+checked. This can make better use of large machines, particularly
+for OCR of individual pages.
+
+If -script is given, OCR only recognises characters used in that
+script (latin, greek or cyrillic), which can also be given as a
+language code such as eng, grc or rus. This can reduce
+misrecognitions of characters which can't appear in the books. The
+characters recognised can instead be given directly with -whitelist,
+and particular characters can be excluded with -blacklist. By
+default all characters in the training can be recognised.
+
+If -psm is given with a comma separated list of tesseract page
+segmentation modes, like 3,6,11, each page is OCRed once with each
+mode, and the best result is chosen during analysis in the same way
+as the best binarisation is. This can help with books with unusual
+layouts, like tables or sparse text, at the cost of more OCR time.
+
+If -autocrop is given, each page is cropped to the ink on it before
+it is OCRed, leaving -croppad pixels of space around it, which can
+speed up OCR of pages with large blank margins. The positions of the
+words in the hOCR are then moved back to match the uncropped page,
+so the PDFs are unaffected.
+
+If -tsv is given, tesseract's TSV output is saved alongside the hOCR
+of each page, and analysis reads the confidence of each page from it
+rather than from the hOCR, which is quicker for large books. Pages
+OCRed without -tsv are still analysed from their hOCR.
+
+If -trainingstore is given, any training which isn't installed is
+fetched from the trainings/ prefix of that bucket, as
+trainings/name.traineddata, the first time it is needed, and saved
+in $TESSDATA_PREFIX for later pages. This means new trainings can be
+deployed just by uploading them to the bucket.
+
+If -intermediateclass is given, the preprocessed page images, which
+are only needed until a book has been OCRed, are stored with that S3
+storage class, like STANDARD_IA, rather than STANDARD, which can cut
+storage costs. Everything else is still stored as STANDARD. The
+archive classes, like GLACIER, can't be used, as the images couldn't
+be downloaded for OCR without being restored first.
+
+If -failover is given with a comma separated list of AWS regions,
+like eu-west-1,eu-central-1, the queues and buckets replicated in
+those regions are switched to, in turn, if requests to the region in
+use keep failing, for example during an outage. Each replica queue
+has the same name as the original, and each replica bucket has the
+region added to its name, like rescribeinprogress-eu-west-1. The
+replicas must be set up separately.
+
+Each book is processed in its own directory inside the system
+temporary directory, which is $TMPDIR if it is set. As large books
+can take up a lot of space, another location, like a directory on a
+large volume, can be given with -tmpdir; it is created if it doesn't
+exist.
+
+If the -test flag is given the test queue is also watched, and any
+message on it is just logged and removed from the queue. This is
+useful for testing the queue machinery without doing any real OCR.
+
+Processing can be paused with "bookpipeline-cli pause", which
+creates a flag in storage that every bookpipeline process checks for
+each minute. While it is set no new jobs are taken from the queues,
+but any jobs already being processed carry on as usual, and the
+process doesn't stop or shut down because of having no work to do.
+Processing is resumed with "bookpipeline-cli pause -resume".
+
+If bookpipeline is interrupted or terminated while processing a book,
+the message is made visible on its queue again straight away, so that
+another process can pick it up without waiting for it to time out.
+
+The timings used, and the default training, can be changed with
+these environment variables, which are checked at startup:
+
+  BOOKPIPELINE_QUEUE_TIMEOUT_SECS    seconds a message is hidden for
+                                     when it is taken from a queue, at
+                                     least twice the heartbeat interval
+  BOOKPIPELINE_PAUSE_BETWEEN_CHECKS  pause between checks of each
+                                     queue, like 3m
+  BOOKPIPELINE_MAX_PAUSE_JITTER      most time randomly added to each
+                                     pause, like 1m
+  BOOKPIPELINE_LOG_SAVE_TIME         interval between saving logs,
+                                     like 1m
+  BOOKPIPELINE_TRAINING              default training, which is used
+                                     unless -t is given
+
 Optionally important messages can be emailed by the process; to enable
 this put a text file in {UserConfigDir}/bookpipeline/mailsettings with
 the contents: {smtpserver} {port} {username} {password} {from} {to}
@@ -45,14 +233,21 @@ the contents: {smtpserver} {port} {username} {password} {from} {to}
 
 const QueueTimeoutSecs = 2 * 60
 const PauseBetweenChecks = 3 * time.Minute
+
+// MaxPauseJitter is the most time randomly added to each pause
+// between checks, so that many idle processes don't all check the
+// queues at the same time
+const MaxPauseJitter = 1 * time.Minute
 const LogSaveTime = 1 * time.Minute
 
-// null writer to enable non-verbose logging to be discarded
-type NullWriter bool
+// PauseCheckTime is how often to check whether the pipeline has been
+// paused or resumed
+const PauseCheckTime = 1 * time.Minute
+const DefaultTraining = "rescribev9"
 
-func (w NullWriter) Write(p []byte) (n int, err error) {
-	return len(p), nil
-}
+// thresholds are the Sauvola k values used to binarise pages when
+// preprocessing, unless a single binarisation is requested
+var thresholds = []float64{0.1, 0.2, 0.4, 0.5}
 
 type Clouder interface {
 	Init() error
@@ -60,6 +255,7 @@ type Clouder interface {
 	DeleteObjects(bucket string, keys []string) error
 	Download(bucket string, key string, fn string) error
 	Upload(bucket string, key string, path string) error
+	Copy(srcbucket string, srckey string, dstbucket string, dstkey string) error
 	CheckQueue(url string, timeout int64) (bookpipeline.Qmsg, error)
 	AddToQueue(url string, msg string) error
 	DelFromQueue(url string, handle string) error
@@ -74,6 +270,7 @@ type Pipeliner interface {
 	OCRPageQueueId() string
 	AnalyseQueueId() string
 	TestQueueId() string
+	TestInit() error
 	WIPStorageId() string
 	GetLogger() *log.Logger
 	Log(v ...interface{})
@@ -91,49 +288,208 @@ func resetTimer(t *time.Timer, d time.Duration) {
 	}
 }
 
+// origPattern matches the original page images of a book
+var origPattern = regexp.MustCompile(`[0-9]{4}.(jpg|png)$`)
+
+// preprocessBook preprocesses a book from a message on the preprocess
+// queue, or the preprocess (no wipe) queue if nowipe is set, sending
+// each page to the OCR page queue once it is done
+func preprocessBook(ctx context.Context, msg bookpipeline.Qmsg, conn Pipeliner, process func(context.Context, chan string, chan string, chan error, *log.Logger), nowipe bool) error {
+	fromQueue := conn.PreQueueId()
+	if nowipe {
+		fromQueue = conn.PreNoWipeQueueId()
+	}
+	return pipeline.ProcessBook(ctx, msg, conn, process, origPattern, fromQueue, conn.OCRPageQueueId())
+}
+
+// saveParams saves the parameters a job from the queue qid is
+// processed with to the book's params.json, with the default training
+// if the job doesn't set one. If the parameters can't be found the
+// error is logged and nothing is saved.
+func saveParams(conn Pipeliner, qid string, job pipeline.JobMsg, thresholds []float64, training string) {
+	var p pipeline.Params
+	var err error
+	switch qid {
+	case conn.WipeQueueId():
+		p, err = pipeline.WipeJobParams(job)
+	case conn.PreNoWipeQueueId():
+		p, err = pipeline.JobParams(job, thresholds, true)
+	default:
+		p, err = pipeline.JobParams(job, thresholds, false)
+	}
+	if err != nil {
+		conn.Log("Error finding parameters for", job.Bookname, "so not saving them", err)
+		return
+	}
+	if p.Training == "" {
+		p.Training = training
+	}
+	err = pipeline.UploadParams(conn, job.Bookname, p)
+	if err != nil {
+		conn.Log("Error saving parameters", err)
+	}
+}
+
+// publishBook publishes a book to bucket, unless it needs review,
+// returning the location it was published to, or "" if it wasn't
+func publishBook(conn Pipeliner, bookname string, bucket string, rules []postproc.Rule) string {
+	review, err := pipeline.NeedsReview(conn, bookname)
+	if err != nil {
+		conn.Log("Error checking whether", bookname, "needs review", err)
+		return ""
+	}
+	if review {
+		conn.Log("Not publishing", bookname, "as it needs review")
+		return ""
+	}
+	conn.Log("Publishing", bookname, "to", bucket)
+	_, err = pipeline.Publish(conn, bookname, bucket, bookname, rules)
+	if err != nil {
+		conn.Log("Error publishing", bookname, err)
+		return ""
+	}
+	return bucket + "/" + bookname
+}
+
 func main() {
+	s, err := envSettings(os.Getenv)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
 	verbose := flag.Bool("v", false, "verbose")
-	training := flag.String("t", "rescribev9", "default tesseract training file to use (without the .traineddata part)")
+	loglevel := flag.String("loglevel", "", "log only messages at or above this level: error, warn, info or debug")
+	training := flag.String("t", s.training, "default tesseract training file to use (without the .traineddata part)")
 	nopreproc := flag.Bool("np", false, "disable preprocessing")
 	nowipe := flag.Bool("nw", false, "disable wipeonly")
 	noocrpg := flag.Bool("nop", false, "disable ocr on individual pages")
 	noanalyse := flag.Bool("na", false, "disable analysis")
+	testq := flag.Bool("test", false, "enable test queue, which just logs and removes any messages on it")
 	autostop := flag.Int64("autostop", 300, "automatically stop process if no work has been available for this number of seconds (to disable autostop set to 0)")
 	autoshutdown := flag.Bool("shutdown", false, "automatically shut down host computer if there has been no work to do for the duration set with -autostop")
 	conntype := flag.String("c", "aws", "connection type ('aws' or 'local')")
+	split := flag.Int("split", 0, "split PDFs into volumes of at most this many pages")
+	splitsize := flag.Int("splitsize", 0, "split PDFs into volumes of roughly this many megabytes at most")
+	mintextconf := flag.Float64("mintextconf", 0, "leave words with a lower confidence than this out of the searchable text of PDFs")
+	minconf := flag.Float64("minconf", 0, "mark books with a lower average confidence than this as needing review rather than done")
+	reorient := flag.Float64("reorient", 0, "OCR pages with a lower confidence than this again rotated by 180 degrees, using the rotated version if it is much better")
+	appendreport := flag.Bool("appendreport", false, "add pages to the end of each PDF with a confidence graph and summary")
+	labelbelow := flag.Float64("labelbelow", 0, "only label pages of the confidence graph with a confidence below this")
+	maxlabels := flag.Int("maxlabels", 0, "label at most this many pages of the confidence graph, those with the lowest confidence (0 for no limit)")
+	scalehocr := flag.Bool("scalehocr", false, "scale hOCR coordinates to the size of the colour images in colour PDFs, if they differ from the binarised images OCRed")
+	streampdf := flag.Bool("streampdf", false, "write each page of the PDFs to disk as it is added, rather than building them in memory")
+	columns := flag.Bool("columns", false, "put the searchable text of pages with several columns in reading order, one column after another")
+	tarresults := flag.Bool("tar", false, "also save the final results of each book in a single tar archive")
+	targzip := flag.Bool("targzip", false, "compress the tar archive created with -tar")
+	taronly := flag.Bool("taronly", false, "save the final results of each book only in a single tar archive, rather than also individually")
+	publish := flag.String("publish", "", "bucket to copy the final results of each book to once it is complete")
+	posthook := flag.String("posthook", "", "command to run once each book has been analysed, given the book name and location of its results")
+	posthooktimeout := flag.Int64("posthooktimeout", 600, "number of seconds to let the -posthook command run for before killing it (to disable the timeout set to 0)")
+	confworkers := flag.Int("confworkers", 1, "number of hOCR files to calculate the confidence of at once during analysis")
+	lineconf := flag.Bool("l", false, "use line confidence instead of word confidence when choosing the best version of each page")
+	saveparams := flag.Bool("params", false, "save the parameters each book is processed with to params.json, for reproducibility")
+	textrules := flag.String("textrules", "", "file of regular expression substitutions to correct the text of each page saved with -tar or published with -publish")
+	dict := flag.String("dict", "", "word lists to also use when choosing the best version of each page, as a comma separated list of training=wordlist, so each matches the language of the training; a word list without a training is used for any other training")
+	workers := flag.Int("workers", 1, "number of messages to process at once")
+	script := flag.String("script", "", "only recognise characters of this script or language (e.g. latin, greek, cyrillic, eng, grc)")
+	whitelist := flag.String("whitelist", "", "only recognise these characters")
+	blacklist := flag.String("blacklist", "", "never recognise these characters")
+	psms := flag.String("psm", "", "comma separated list of page segmentation modes to OCR each page with, choosing the best (e.g. 3,6,11)")
+	autocrop := flag.Bool("autocrop", false, "crop each page to the ink on it before OCR")
+	croppad := flag.Int("croppad", 20, "pixels of space to leave around the ink on each page with -autocrop")
+	tsv := flag.Bool("tsv", false, "also save tesseract's TSV output for each page, which analysis reads confidences from more quickly than hOCR")
+	trainingstore := flag.String("trainingstore", "", "bucket to fetch trainings which aren't installed from, saving them to $TESSDATA_PREFIX")
+	intermediateclass := flag.String("intermediateclass", "", "S3 storage class to store preprocessed page images with (e.g. STANDARD_IA)")
+	failover := flag.String("failover", "", "comma separated list of AWS regions with replicas of the queues and buckets to switch to if the region in use has an outage (e.g. eu-west-1,eu-central-1)")
+	tmpdir := flag.String("tmpdir", "", "directory to create temporary working directories in (defaults to $TMPDIR or the system temporary directory)")
 
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), usage)
 		flag.PrintDefaults()
 	}
 	flag.Parse()
+	s.training = *training
+
+	if *workers < 1 {
+		log.Fatalln("Error: -workers must be at least 1")
+	}
+	if *confworkers < 1 {
+		log.Fatalln("Error: -confworkers must be at least 1")
+	}
+	if *taronly && *publish != "" {
+		log.Fatalln("Error: -taronly can't be used with -publish")
+	}
+
+	ocropts := pipeline.OcrOptions{Whitelist: *whitelist, Blacklist: *blacklist, AutoCrop: *autocrop, CropPad: *croppad, Tsv: *tsv}
+	if *script != "" {
+		if *whitelist != "" {
+			log.Fatalln("Error: -script and -whitelist can't be used together")
+		}
+		var err error
+		ocropts.Whitelist, err = pipeline.ScriptWhitelist(*script)
+		if err != nil {
+			log.Fatalln("Error with script:", err)
+		}
+	}
+	if *psms != "" {
+		var err error
+		ocropts.Psms, err = pipeline.ParsePsms(*psms)
+		if err != nil {
+			log.Fatalln("Error with -psm:", err)
+		}
+	}
 
-	var verboselog *log.Logger
-	if *verbose {
-		verboselog = log.New(os.Stdout, "", 0)
-	} else {
-		var n NullWriter
-		verboselog = log.New(n, "", 0)
+	err = pipeline.SetTempDir(*tmpdir)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	dicts, err := pipeline.ParseDictionaries(*dict)
+	if err != nil {
+		log.Fatalln("Error with -dict:", err)
+	}
+	for _, d := range dicts {
+		_, err := os.Stat(d)
+		if err != nil {
+			log.Fatalln("Error with word list:", err)
+		}
+	}
+
+	var rules []postproc.Rule
+	if *textrules != "" {
+		var err error
+		rules, err = postproc.LoadRules(*textrules)
+		if err != nil {
+			log.Fatalln("Error with text rules:", err)
+		}
+	}
+
+	verboselog, err := bookpipeline.VerboseLogger(*verbose, *loglevel, os.Stdout, 0)
+	if err != nil {
+		log.Fatalln(err)
 	}
 
-	origPattern := regexp.MustCompile(`[0-9]{4}.jpg$`)
 	wipePattern := regexp.MustCompile(`[0-9]{4,6}(.bin)?.png$`)
 	ocredPattern := regexp.MustCompile(`.hocr$`)
 
-	var ctx context.Context
-	ctx = context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	var conn Pipeliner
 	switch *conntype {
 	case "aws":
-		conn = &bookpipeline.AwsConn{Region: "eu-west-2", Logger: verboselog}
+		c := &bookpipeline.AwsConn{Logger: verboselog}
+		if *intermediateclass != "" {
+			c.StorageClasses = map[string]string{bookpipeline.ObjectIntermediate: *intermediateclass}
+		}
+		c.Failover = bookpipeline.ParseFailoverRegions(*failover)
+		conn = c
 	case "local":
-		conn = &bookpipeline.LocalConn{Logger: verboselog}
+		conn = &bookpipeline.LocalConn{Logger: verboselog, TempDir: filepath.Join(pipeline.TempDir(), "bookpipeline")}
 	default:
 		log.Fatalln("Unknown connection type")
 	}
 
-	var err error
 	if *conntype != "local" {
 		_, err = pipeline.GetMailSettings()
 		if err != nil {
@@ -146,7 +502,20 @@ func main() {
 	if err != nil {
 		log.Fatalln("Error setting up connection:", err)
 	}
+	if *trainingstore != "" {
+		if os.Getenv("TESSDATA_PREFIX") == "" {
+			log.Fatalln("Error: TESSDATA_PREFIX must be set to use -trainingstore")
+		}
+		ocropts.Trainings = &pipeline.TrainingCache{Conn: conn, Bucket: *trainingstore}
+	}
+	if *testq {
+		err = conn.TestInit()
+		if err != nil {
+			log.Fatalln("Error setting up test queue:", err)
+		}
+	}
 	conn.Log("Finished setting up session")
+	conn.Log("Using settings:", s)
 
 	starttime := time.Now().Unix()
 	hostname, err := os.Hostname()
@@ -156,7 +525,9 @@ func main() {
 	var checkWipeQueue <-chan time.Time
 	var checkOCRPageQueue <-chan time.Time
 	var checkAnalyseQueue <-chan time.Time
+	var checkTestQueue <-chan time.Time
 	var stopIfQuiet *time.Timer
+	var checkPause <-chan time.Time
 	var savelognow *time.Ticker
 	if !*nopreproc {
 		checkPreQueue = time.After(0)
@@ -170,77 +541,137 @@ func main() {
 	if !*noanalyse {
 		checkAnalyseQueue = time.After(0)
 	}
+	if *testq {
+		checkTestQueue = time.After(0)
+	}
 	checkPreNoWipeQueue = time.After(0)
+	checkPause = time.After(0)
 	var quietTime = time.Duration(*autostop) * time.Second
 	stopIfQuiet = time.NewTimer(quietTime)
 	if quietTime == 0 {
 		stopIfQuiet.Stop()
 	}
 
-	savelognow = time.NewTicker(LogSaveTime)
+	savelognow = time.NewTicker(s.logSaveTime)
 	if *conntype == "local" {
 		savelognow.Stop()
 	}
 
+	// On being asked to stop, cancel any processing, which will make
+	// the book being processed visible on the queue again for another
+	// process to take over, rather than waiting for it to time out.
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigc
+		conn.Log("Signal received, stopping pipeline")
+		cancel()
+	}()
+
+	// start runs a job in the worker pool, stopping the quiet timer
+	// while any jobs are running
+	p := newPool(*workers)
+	start := func(job func()) {
+		if p.busy == 0 {
+			stopTimer(stopIfQuiet)
+		}
+		p.run(job)
+	}
+
 	for {
+		if ctx.Err() != nil {
+			p.wait()
+			_ = pipeline.SaveLogs(conn, starttime, hostname)
+			return
+		}
 		select {
-		case <-checkPreQueue:
-			msg, err := conn.CheckQueue(conn.PreQueueId(), QueueTimeoutSecs)
-			checkPreQueue = time.After(PauseBetweenChecks)
+		case <-p.ready(checkPreQueue):
+			msg, err := conn.CheckQueue(conn.PreQueueId(), s.queueTimeoutSecs)
+			checkPreQueue = time.After(pipeline.Jitter(s.pauseBetweenChecks, s.maxPauseJitter))
 			if err != nil {
 				conn.Log("Error checking preprocess queue", err)
 				continue
 			}
 			if msg.Handle == "" {
-				conn.Log("No message received on preprocess queue, sleeping")
+				conn.Log(bookpipeline.DebugTag + "No message received on preprocess queue, sleeping")
 				continue
 			}
 			conn.Log("Message received on preprocess queue, processing", msg.Body)
-			stopTimer(stopIfQuiet)
-			err = pipeline.ProcessBook(ctx, msg, conn, pipeline.Preprocess([]float64{0.1, 0.2, 0.4, 0.5}, false), origPattern, conn.PreQueueId(), conn.OCRPageQueueId())
-			resetTimer(stopIfQuiet, quietTime)
+			job := pipeline.ParseJobMessage(msg.Body)
+			process, err := pipeline.PreprocessFor(job, thresholds, false)
 			if err != nil {
-				conn.Log("Error during preprocess", err)
+				conn.Log("Error during preprocess, deleting message from queue", err)
+				_ = conn.DelFromQueue(conn.PreQueueId(), msg.Handle)
+				continue
 			}
-		case <-checkPreNoWipeQueue:
-			msg, err := conn.CheckQueue(conn.PreNoWipeQueueId(), QueueTimeoutSecs)
-			checkPreNoWipeQueue = time.After(PauseBetweenChecks)
+			start(func() {
+				if *saveparams {
+					saveParams(conn, conn.PreQueueId(), job, thresholds, *training)
+				}
+				err := preprocessBook(ctx, msg, conn, process, false)
+				if err != nil {
+					conn.Log("Error during preprocess", err)
+				}
+			})
+		case <-p.ready(checkPreNoWipeQueue):
+			msg, err := conn.CheckQueue(conn.PreNoWipeQueueId(), s.queueTimeoutSecs)
+			checkPreNoWipeQueue = time.After(pipeline.Jitter(s.pauseBetweenChecks, s.maxPauseJitter))
 			if err != nil {
 				conn.Log("Error checking preprocess (no wipe) queue", err)
 				continue
 			}
 			if msg.Handle == "" {
-				conn.Log("No message received on preprocess (no wipe) queue, sleeping")
+				conn.Log(bookpipeline.DebugTag + "No message received on preprocess (no wipe) queue, sleeping")
 				continue
 			}
 			conn.Log("Message received on preprocess (no wipe) queue, processing", msg.Body)
-			stopTimer(stopIfQuiet)
-			err = pipeline.ProcessBook(ctx, msg, conn, pipeline.Preprocess([]float64{0.1, 0.2, 0.4, 0.5}, true), origPattern, conn.PreQueueId(), conn.OCRPageQueueId())
-			resetTimer(stopIfQuiet, quietTime)
+			job := pipeline.ParseJobMessage(msg.Body)
+			process, err := pipeline.PreprocessFor(job, thresholds, true)
 			if err != nil {
-				conn.Log("Error during preprocess (no wipe)", err)
+				conn.Log("Error during preprocess (no wipe), deleting message from queue", err)
+				_ = conn.DelFromQueue(conn.PreNoWipeQueueId(), msg.Handle)
+				continue
 			}
-		case <-checkWipeQueue:
-			msg, err := conn.CheckQueue(conn.WipeQueueId(), QueueTimeoutSecs)
-			checkWipeQueue = time.After(PauseBetweenChecks)
+			start(func() {
+				if *saveparams {
+					saveParams(conn, conn.PreNoWipeQueueId(), job, thresholds, *training)
+				}
+				err := preprocessBook(ctx, msg, conn, process, true)
+				if err != nil {
+					conn.Log("Error during preprocess (no wipe)", err)
+				}
+			})
+		case <-p.ready(checkWipeQueue):
+			msg, err := conn.CheckQueue(conn.WipeQueueId(), s.queueTimeoutSecs)
+			checkWipeQueue = time.After(pipeline.Jitter(s.pauseBetweenChecks, s.maxPauseJitter))
 			if err != nil {
 				conn.Log("Error checking wipeonly queue", err)
 				continue
 			}
 			if msg.Handle == "" {
-				conn.Log("No message received on wipeonly queue, sleeping")
+				conn.Log(bookpipeline.DebugTag + "No message received on wipeonly queue, sleeping")
 				continue
 			}
-			stopTimer(stopIfQuiet)
 			conn.Log("Message received on wipeonly queue, processing", msg.Body)
-			err = pipeline.ProcessBook(ctx, msg, conn, pipeline.Wipe, wipePattern, conn.WipeQueueId(), conn.OCRPageQueueId())
-			resetTimer(stopIfQuiet, quietTime)
+			job := pipeline.ParseJobMessage(msg.Body)
+			process, err := pipeline.WipeFor(job)
 			if err != nil {
-				conn.Log("Error during wipe", err)
+				conn.Log("Error during wipe, deleting message from queue", err)
+				_ = conn.DelFromQueue(conn.WipeQueueId(), msg.Handle)
+				continue
 			}
-		case <-checkOCRPageQueue:
-			msg, err := conn.CheckQueue(conn.OCRPageQueueId(), QueueTimeoutSecs)
-			checkOCRPageQueue = time.After(PauseBetweenChecks)
+			start(func() {
+				if *saveparams {
+					saveParams(conn, conn.WipeQueueId(), job, thresholds, *training)
+				}
+				err := pipeline.ProcessBook(ctx, msg, conn, process, wipePattern, conn.WipeQueueId(), conn.OCRPageQueueId())
+				if err != nil {
+					conn.Log("Error during wipe", err)
+				}
+			})
+		case <-p.ready(checkOCRPageQueue):
+			msg, err := conn.CheckQueue(conn.OCRPageQueueId(), s.queueTimeoutSecs)
+			checkOCRPageQueue = time.After(pipeline.Jitter(s.pauseBetweenChecks, s.maxPauseJitter))
 			if err != nil {
 				conn.Log("Error checking OCR Page queue", err)
 				continue
@@ -251,31 +682,108 @@ func main() {
 			// Have OCRPageQueue checked immediately after completion, as chances are high that
 			// there will be more pages that should be done without delay
 			checkOCRPageQueue = time.After(0)
-			stopTimer(stopIfQuiet)
 			conn.Log("Message received on OCR Page queue, processing", msg.Body)
-			err = pipeline.OcrPage(ctx, msg, conn, pipeline.Ocr(*training, ""), conn.OCRPageQueueId(), conn.AnalyseQueueId())
-			resetTimer(stopIfQuiet, quietTime)
-			if err != nil {
-				conn.Log("Error during OCR Page process", err)
-			}
-		case <-checkAnalyseQueue:
-			msg, err := conn.CheckQueue(conn.AnalyseQueueId(), QueueTimeoutSecs)
-			checkAnalyseQueue = time.After(PauseBetweenChecks)
+			start(func() {
+				bookname := filepath.Dir(strings.Split(msg.Body, " ")[0])
+				err := pipeline.RecordTesseractVersion(conn, bookname, "")
+				if err != nil {
+					conn.Log("Error recording tesseract version", err)
+				}
+				err = pipeline.OcrPage(ctx, msg, conn, pipeline.OcrWithOptions(*training, "", ocropts), ocropts, conn.OCRPageQueueId(), conn.AnalyseQueueId())
+				if err != nil {
+					conn.Log("Error during OCR Page process", err)
+				}
+			})
+		case <-p.ready(checkAnalyseQueue):
+			msg, err := conn.CheckQueue(conn.AnalyseQueueId(), s.queueTimeoutSecs)
+			checkAnalyseQueue = time.After(pipeline.Jitter(s.pauseBetweenChecks, s.maxPauseJitter))
 			if err != nil {
 				conn.Log("Error checking analyse queue", err)
 				continue
 			}
 			if msg.Handle == "" {
-				conn.Log("No message received on analyse queue, sleeping")
+				conn.Log(bookpipeline.DebugTag + "No message received on analyse queue, sleeping")
 				continue
 			}
-			stopTimer(stopIfQuiet)
 			conn.Log("Message received on analyse queue, processing", msg.Body)
-			err = pipeline.ProcessBook(ctx, msg, conn, pipeline.Analyse(conn, false), ocredPattern, conn.AnalyseQueueId(), "")
-			resetTimer(stopIfQuiet, quietTime)
+			start(func() {
+				bookname := pipeline.ParseJobMessage(msg.Body).Bookname
+				err := pipeline.ProcessBook(ctx, msg, conn, pipeline.Analyse(conn, pipeline.AnalyseOptions{Bookname: bookname, Dictionaries: dicts, LineConf: *lineconf, SplitPages: *split, SplitBytes: *splitsize * 1024 * 1024, MinTextConf: *mintextconf, MinBookConf: *minconf, ConfWorkers: *confworkers, AppendReport: *appendreport, ScaleHocr: *scalehocr, StreamPdf: *streampdf, ColumnOrder: *columns, Tar: *tarresults, TarGzip: *targzip, TarOnly: *taronly, TextRules: *textrules, ReorientConf: *reorient, ReorientOcr: ocropts, GraphLabelBelow: *labelbelow, GraphMaxLabels: *maxlabels}), ocredPattern, conn.AnalyseQueueId(), "")
+				if err != nil {
+					conn.Log("Error during analysis", err)
+					return
+				}
+				if *saveparams {
+					err = pipeline.RecordParamsTesseractVersion(conn, bookname)
+					if err != nil {
+						conn.Log("Error recording tesseract version in parameters", err)
+					}
+				}
+				published := ""
+				if *publish != "" {
+					published = publishBook(conn, bookname, *publish, rules)
+				}
+				if *posthook != "" {
+					conn.Log("Running post hook for", bookname)
+					hookctx, cancel := ctx, context.CancelFunc(func() {})
+					if *posthooktimeout > 0 {
+						hookctx, cancel = context.WithTimeout(ctx, time.Duration(*posthooktimeout)*time.Second)
+					}
+					err = pipeline.RunPostHook(hookctx, *posthook, bookname, conn.WIPStorageId()+"/"+bookname, published)
+					cancel()
+					if err != nil {
+						conn.Log("Error running post hook", err)
+					}
+				}
+			})
+		case <-p.ready(checkTestQueue):
+			msg, err := conn.CheckQueue(conn.TestQueueId(), s.queueTimeoutSecs)
+			checkTestQueue = time.After(pipeline.Jitter(s.pauseBetweenChecks, s.maxPauseJitter))
+			if err != nil {
+				conn.Log("Error checking test queue", err)
+				continue
+			}
+			if msg.Handle == "" {
+				conn.Log(bookpipeline.DebugTag + "No message received on test queue, sleeping")
+				continue
+			}
+			conn.Log("Message received on test queue, processing", msg.Body)
+			start(func() {
+				err := pipeline.Echo(msg, conn, conn.TestQueueId())
+				if err != nil {
+					conn.Log("Error during test", err)
+				}
+			})
+		case <-p.done:
+			p.finished()
+			if p.busy == 0 && !p.paused {
+				resetTimer(stopIfQuiet, quietTime)
+			}
+		case <-checkPause:
+			checkPause = time.After(PauseCheckTime)
+			changed, err := p.checkPaused(conn)
 			if err != nil {
-				conn.Log("Error during analysis", err)
+				conn.Log("Error checking whether the pipeline is paused", err)
+				continue
+			}
+			if !changed {
+				continue
+			}
+			// don't stop because of being quiet while paused, so
+			// that the instance is still there when resumed
+			if p.paused {
+				conn.Log("Pipeline paused, not taking any new jobs until it is resumed")
+				if p.busy == 0 && quietTime > 0 {
+					stopTimer(stopIfQuiet)
+				}
+			} else {
+				conn.Log("Pipeline resumed")
+				if p.busy == 0 {
+					resetTimer(stopIfQuiet, quietTime)
+				}
 			}
+		case <-ctx.Done():
+			continue
 		case <-savelognow.C:
 			conn.Log("Saving logs")
 			err = pipeline.SaveLogs(conn, starttime, hostname)
@@ -0,0 +1,182 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"rescribe.xyz/bookpipeline"
+	"rescribe.xyz/bookpipeline/internal/pipeline"
+)
+
+// TestPreprocessNoWipe checks that a book on the preprocess (no wipe)
+// queue is taken off that queue once it is done, and put back on it
+// if processing is cancelled
+func TestPreprocessNoWipe(t *testing.T) {
+	cases := []struct {
+		name   string
+		cancel bool
+	}{
+		{"done", false},
+		{"cancelled", true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "prenowipetest")
+			if err != nil {
+				t.Fatalf("Could not create temporary directory: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			conn := &bookpipeline.LocalConn{Logger: log.New(ioutil.Discard, "", 0), TempDir: dir}
+			err = conn.Init()
+			if err != nil {
+				t.Fatalf("Could not initialise connection: %v", err)
+			}
+
+			img := filepath.Join(dir, "img.png")
+			err = ioutil.WriteFile(img, []byte("image"), 0644)
+			if err != nil {
+				t.Fatalf("Could not create test image: %v", err)
+			}
+			err = conn.Upload(conn.WIPStorageId(), "nowipebook/0001.png", img)
+			if err != nil {
+				t.Fatalf("Could not upload test image: %v", err)
+			}
+			err = conn.AddToQueue(conn.PreNoWipeQueueId(), "nowipebook")
+			if err != nil {
+				t.Fatalf("Could not add book to queue: %v", err)
+			}
+			msg, err := conn.CheckQueue(conn.PreNoWipeQueueId(), 60)
+			if err != nil || msg.Handle == "" {
+				t.Fatalf("Could not get message from queue: %v", err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// a fake preprocess, which either "binarises" each page by
+			// copying it, or waits until it is cancelled
+			process := func(ctx context.Context, in chan string, up chan string, errc chan error, logger *log.Logger) {
+				for path := range in {
+					if c.cancel {
+						continue
+					}
+					bin := strings.TrimSuffix(path, ".png") + "_bin0.1.png"
+					err := os.Rename(path, bin)
+					if err != nil {
+						errc <- err
+						return
+					}
+					up <- bin
+				}
+				if c.cancel {
+					<-ctx.Done()
+					errc <- ctx.Err()
+					return
+				}
+				close(up)
+			}
+			if c.cancel {
+				go func() {
+					time.Sleep(100 * time.Millisecond)
+					cancel()
+				}()
+			}
+
+			err = preprocessBook(ctx, msg, conn, process, true)
+			if c.cancel && err != context.Canceled {
+				t.Fatalf("Expected context cancelled error, got %v", err)
+			}
+			if !c.cancel && err != nil {
+				t.Fatalf("Error preprocessing book: %v", err)
+			}
+
+			// a cancelled book should be visible again straight away,
+			// and a finished one gone
+			again, err := conn.CheckQueue(conn.PreNoWipeQueueId(), 60)
+			if err != nil {
+				t.Fatalf("Could not check queue: %v", err)
+			}
+			if c.cancel && again.Body != "nowipebook" {
+				t.Fatalf("Expected book to be put back on the queue, got %q", again.Body)
+			}
+			if !c.cancel && again.Handle != "" {
+				t.Fatalf("Expected queue to be empty, got %q", again.Body)
+			}
+
+			if !c.cancel {
+				pg, err := conn.CheckQueue(conn.OCRPageQueueId(), 60)
+				if err != nil {
+					t.Fatalf("Could not check OCR page queue: %v", err)
+				}
+				if pg.Body != "nowipebook/0001_bin0.1.png" {
+					t.Fatalf("Expected page to be sent to the OCR page queue, got %q", pg.Body)
+				}
+			}
+		})
+	}
+}
+
+// TestSaveParams checks that the parameters a book is processed with
+// are saved to its params.json, and that nothing is saved for a job
+// with invalid options
+func TestSaveParams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "saveparamstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conn := &bookpipeline.LocalConn{Logger: log.New(ioutil.Discard, "", 0), TempDir: dir}
+	err = conn.Init()
+	if err != nil {
+		t.Fatalf("Could not initialise connection: %v", err)
+	}
+
+	cases := []struct {
+		name     string
+		qid      string
+		body     string
+		expected *pipeline.Params
+	}{
+		{"preprocess", conn.PreQueueId(), "book1 binmethod=wolf", &pipeline.Params{Training: "lat", BinMethod: "wolf", Wipe: true}},
+		{"nowipe", conn.PreNoWipeQueueId(), "book2 eng", &pipeline.Params{Training: "eng", BinMethod: "sauvola", Wipe: false}},
+		{"wipeonly", conn.WipeQueueId(), "book3", &pipeline.Params{Training: "lat", Wipe: true}},
+		{"invalid", conn.PreQueueId(), "book4 binmethod=bad", nil},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			job := pipeline.ParseJobMessage(c.body)
+			saveParams(conn, c.qid, job, []float64{0.1, 0.2}, "lat")
+
+			p, err := pipeline.GetParams(conn, job.Bookname)
+			if c.expected == nil {
+				if err != pipeline.ErrNoParams {
+					t.Fatalf("Expected no parameters to be saved, got %+v, %v", p, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected parameters to be saved: %v", err)
+			}
+			if p.Training != c.expected.Training || p.BinMethod != c.expected.BinMethod || p.Wipe != c.expected.Wipe {
+				t.Fatalf("Expected parameters %+v, got %+v", *c.expected, p)
+			}
+			if p.PipelineVersion == "" {
+				t.Fatalf("Expected a pipeline version to be saved, got %+v", p)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"rescribe.xyz/bookpipeline/internal/pipeline"
+)
+
+// pool runs jobs in their own goroutines, with at most size running
+// at once. It is used from the single main loop, which should
+// receive from done each time a job finishes and then call finished.
+// While paused is set no new jobs are taken, but any running jobs
+// carry on.
+type pool struct {
+	size   int
+	busy   int
+	paused bool
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newPool(size int) *pool {
+	if size < 1 {
+		size = 1
+	}
+	// done is buffered so that jobs never block on finishing
+	return &pool{size: size, done: make(chan struct{}, size)}
+}
+
+// ready returns c if a worker is free, or nil otherwise, so that in
+// a select statement a queue is only checked when there is a worker
+// free to process a message from it. As c is not received from while
+// all workers are busy, the check will happen as soon as one is free.
+// While the pool is paused no worker is ever ready.
+func (p *pool) ready(c <-chan time.Time) <-chan time.Time {
+	if p.paused || p.busy >= p.size {
+		return nil
+	}
+	return c
+}
+
+// run starts f in a new worker
+func (p *pool) run(f func()) {
+	p.busy++
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		f()
+		p.done <- struct{}{}
+	}()
+}
+
+// finished records that a job has finished
+func (p *pool) finished() {
+	p.busy--
+}
+
+// wait waits for all running jobs to finish
+func (p *pool) wait() {
+	p.wg.Wait()
+}
+
+// checkPaused pauses or unpauses the pool according to whether the
+// pipeline has been paused with pipeline.Pause, returning whether
+// this changed.
+func (p *pool) checkPaused(conn pipeline.Lister) (bool, error) {
+	paused, err := pipeline.IsPaused(conn)
+	if err != nil {
+		return false, err
+	}
+	if paused == p.paused {
+		return false, nil
+	}
+	p.paused = paused
+	return true, nil
+}
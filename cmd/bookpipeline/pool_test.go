@@ -0,0 +1,269 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"rescribe.xyz/bookpipeline"
+	"rescribe.xyz/bookpipeline/internal/pipeline"
+)
+
+// TestPool checks that with 2 workers two pages of the same book are
+// OCRed at once, without interfering with each other
+func TestPool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pooltest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conn := &bookpipeline.LocalConn{Logger: log.New(ioutil.Discard, "", 0), TempDir: dir}
+	err = conn.Init()
+	if err != nil {
+		t.Fatalf("Could not initialise connection: %v", err)
+	}
+
+	pages := []string{"pooltest/0001_bin0.1.png", "pooltest/0002_bin0.1.png"}
+	img := filepath.Join(dir, "img.png")
+	err = ioutil.WriteFile(img, []byte("image"), 0644)
+	if err != nil {
+		t.Fatalf("Could not create test image: %v", err)
+	}
+	for _, pg := range pages {
+		err = conn.Upload(conn.WIPStorageId(), pg, img)
+		if err != nil {
+			t.Fatalf("Could not upload %s: %v", pg, err)
+		}
+		err = conn.AddToQueue(conn.OCRPageQueueId(), pg)
+		if err != nil {
+			t.Fatalf("Could not add %s to queue: %v", pg, err)
+		}
+	}
+
+	// a fake OCR process which records the directory of each page and
+	// waits until all pages have started before finishing
+	started := make(chan string, len(pages))
+	proceed := make(chan struct{})
+	process := func(ctx context.Context, in chan string, up chan string, errc chan error, logger *log.Logger) {
+		for path := range in {
+			started <- filepath.Dir(path)
+			<-proceed
+			hocr := strings.TrimSuffix(path, ".png") + ".hocr"
+			err := ioutil.WriteFile(hocr, []byte("hocr"), 0644)
+			if err != nil {
+				errc <- err
+				return
+			}
+			up <- hocr
+		}
+		close(up)
+	}
+
+	ctx := context.Background()
+	check := make(chan time.Time, 1)
+	p := newPool(2)
+	errs := make(chan error, len(pages))
+	for range pages {
+		check <- time.Now()
+		if p.ready(check) == nil {
+			t.Fatalf("Expected a worker to be ready, with %d busy", p.busy)
+		}
+		<-check
+		msg, err := conn.CheckQueue(conn.OCRPageQueueId(), 60)
+		if err != nil || msg.Handle == "" {
+			t.Fatalf("Could not get message from queue: %v", err)
+		}
+		p.run(func() {
+			errs <- pipeline.OcrPage(ctx, msg, conn, process, pipeline.OcrOptions{}, conn.OCRPageQueueId(), "")
+		})
+	}
+	if p.ready(check) != nil {
+		t.Fatalf("Expected no worker to be ready, with %d busy", p.busy)
+	}
+
+	var dirs []string
+	for range pages {
+		select {
+		case d := <-started:
+			dirs = append(dirs, d)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out waiting for pages to be processed at once")
+		}
+	}
+	close(proceed)
+	if dirs[0] == dirs[1] {
+		t.Fatalf("Expected pages to be processed in different directories, both used %s", dirs[0])
+	}
+
+	for range pages {
+		<-p.done
+		p.finished()
+		err = <-errs
+		if err != nil {
+			t.Fatalf("Error processing page: %v", err)
+		}
+	}
+	p.wait()
+	if p.busy != 0 {
+		t.Fatalf("Expected no workers to be busy, got %d", p.busy)
+	}
+
+	objs, err := conn.ListObjects(conn.WIPStorageId(), "pooltest")
+	if err != nil {
+		t.Fatalf("Could not list objects: %v", err)
+	}
+	var hocrs []string
+	for _, o := range objs {
+		if strings.HasSuffix(o, ".hocr") {
+			hocrs = append(hocrs, o)
+		}
+	}
+	sort.Strings(hocrs)
+	expected := []string{"pooltest/0001_bin0.1.hocr", "pooltest/0002_bin0.1.hocr"}
+	if strings.Join(hocrs, " ") != strings.Join(expected, " ") {
+		t.Fatalf("Expected %v to be uploaded, got %v", expected, hocrs)
+	}
+
+	msg, err := conn.CheckQueue(conn.OCRPageQueueId(), 60)
+	if err != nil {
+		t.Fatalf("Could not check queue: %v", err)
+	}
+	if msg.Handle != "" {
+		t.Fatalf("Expected queue to be empty, got %s", msg.Body)
+	}
+
+	for _, d := range dirs {
+		_, err = os.Stat(d)
+		if !os.IsNotExist(err) {
+			t.Fatalf("Expected temporary directory %s to be removed", d)
+		}
+	}
+}
+
+// TestPoolPause checks that once the pipeline is paused no more
+// messages are taken from the queue, while a page which is already
+// being OCRed carries on and finishes
+func TestPoolPause(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pausetest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conn := &bookpipeline.LocalConn{Logger: log.New(ioutil.Discard, "", 0), TempDir: dir}
+	err = conn.Init()
+	if err != nil {
+		t.Fatalf("Could not initialise connection: %v", err)
+	}
+
+	pages := []string{"pausetest/0001_bin0.1.png", "pausetest/0002_bin0.1.png"}
+	img := filepath.Join(dir, "img.png")
+	err = ioutil.WriteFile(img, []byte("image"), 0644)
+	if err != nil {
+		t.Fatalf("Could not create test image: %v", err)
+	}
+	for _, pg := range pages {
+		err = conn.Upload(conn.WIPStorageId(), pg, img)
+		if err != nil {
+			t.Fatalf("Could not upload %s: %v", pg, err)
+		}
+		err = conn.AddToQueue(conn.OCRPageQueueId(), pg)
+		if err != nil {
+			t.Fatalf("Could not add %s to queue: %v", pg, err)
+		}
+	}
+
+	// a fake OCR process which waits to be told to finish
+	started := make(chan struct{})
+	proceed := make(chan struct{})
+	process := func(ctx context.Context, in chan string, up chan string, errc chan error, logger *log.Logger) {
+		for path := range in {
+			close(started)
+			<-proceed
+			hocr := strings.TrimSuffix(path, ".png") + ".hocr"
+			err := ioutil.WriteFile(hocr, []byte("hocr"), 0644)
+			if err != nil {
+				errc <- err
+				return
+			}
+			up <- hocr
+		}
+		close(up)
+	}
+
+	check := make(chan time.Time, 1)
+	check <- time.Now()
+	p := newPool(2)
+	if p.ready(check) == nil {
+		t.Fatalf("Expected a worker to be ready before pausing")
+	}
+	<-check
+	msg, err := conn.CheckQueue(conn.OCRPageQueueId(), 60)
+	if err != nil || msg.Handle == "" {
+		t.Fatalf("Could not get message from queue: %v", err)
+	}
+	errs := make(chan error, 1)
+	p.run(func() {
+		errs <- pipeline.OcrPage(context.Background(), msg, conn, process, pipeline.OcrOptions{}, conn.OCRPageQueueId(), "")
+	})
+	<-started
+
+	err = pipeline.Pause(conn)
+	if err != nil {
+		t.Fatalf("Error pausing: %v", err)
+	}
+	changed, err := p.checkPaused(conn)
+	if err != nil || !changed {
+		t.Fatalf("Expected pool to be paused, got changed %v, error %v", changed, err)
+	}
+	check <- time.Now()
+	if p.ready(check) != nil {
+		t.Fatalf("Expected no worker to be ready while paused, with %d busy", p.busy)
+	}
+
+	close(proceed)
+	<-p.done
+	p.finished()
+	err = <-errs
+	if err != nil {
+		t.Fatalf("Error processing page while paused: %v", err)
+	}
+	if p.ready(check) != nil {
+		t.Fatalf("Expected no worker to be ready while paused after the job finished")
+	}
+	_, err = os.Stat(filepath.Join(dir, conn.WIPStorageId(), "pausetest", "0001_bin0.1.hocr"))
+	if err != nil {
+		t.Fatalf("Expected in-flight page to be OCRed while paused: %v", err)
+	}
+
+	err = pipeline.Resume(conn)
+	if err != nil {
+		t.Fatalf("Error resuming: %v", err)
+	}
+	changed, err = p.checkPaused(conn)
+	if err != nil || !changed {
+		t.Fatalf("Expected pool to be resumed, got changed %v, error %v", changed, err)
+	}
+	if p.ready(check) == nil {
+		t.Fatalf("Expected a worker to be ready after resuming")
+	}
+	<-check
+	msg, err = conn.CheckQueue(conn.OCRPageQueueId(), 60)
+	if err != nil {
+		t.Fatalf("Could not check queue: %v", err)
+	}
+	if msg.Body != pages[1] {
+		t.Fatalf("Expected %s to still be on the queue after pausing, got %s", pages[1], msg.Body)
+	}
+}
@@ -0,0 +1,20 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+// cancelbook removes a stuck book's messages from every queue.
+package main
+
+import (
+	"log"
+	"os"
+
+	"rescribe.xyz/bookpipeline/internal/cli"
+)
+
+func main() {
+	err := cli.Cancel("cancelbook", os.Args[1:])
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
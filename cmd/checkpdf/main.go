@@ -0,0 +1,64 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+// checkpdf checks PDFs for issues which commonly cause problems with
+// PDF readers.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"rescribe.xyz/bookpipeline/internal/pipeline"
+)
+
+const usage = `Usage: checkpdf file.pdf [file.pdf]...
+
+Checks PDFs for issues which commonly cause problems with PDF
+readers, so that a PDF can be confirmed to be sound before it is
+shared. The issues checked for are:
+
+- Numbers in page content without whitespace after them
+- Infinite or NaN numbers in page content
+- Fonts which are not embedded
+- Pages with no size
+
+Any issues found are printed, and checkpdf exits with status 1 if
+any were found in any file.
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		return
+	}
+
+	found := false
+	for _, fn := range flag.Args() {
+		issues, err := pipeline.CheckPdf(fn)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if len(issues) == 0 {
+			fmt.Printf("%s: OK\n", fn)
+			continue
+		}
+		found = true
+		for _, i := range issues {
+			fmt.Printf("%s: %s\n", fn, i)
+		}
+	}
+
+	if found {
+		os.Exit(1)
+	}
+}
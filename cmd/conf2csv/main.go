@@ -0,0 +1,58 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+// conf2csv writes the confidence of every word of a book as CSV.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"rescribe.xyz/bookpipeline/internal/pipeline"
+)
+
+const usage = `Usage: conf2csv [-o file.csv] bookdir
+
+Writes the text, confidence and bounding box of every word in the
+best version of each page of a book as CSV, for analysing the OCR
+results of a book, or of many books, with other tools. The columns
+are page, word_index, text, confidence and bbox, where word_index
+counts the words on each page from 0, and bbox is the bounding box
+of the word as "x0 y0 x1 y1".
+
+bookdir should contain the results downloaded by getpipelinebook,
+including the best file and the best hOCR of each page. The CSV is
+written to standard output, unless a file is given with -o.
+`
+
+func main() {
+	out := flag.String("o", "", "File to save the CSV to, rather than writing to standard output")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		return
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatalln("Error creating CSV file:", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	err := pipeline.WriteConfCSV(w, flag.Arg(0))
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+// diffruns compares two OCR runs of the same book page by page.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"rescribe.xyz/bookpipeline/internal/pipeline"
+)
+
+const usage = `Usage: diffruns [-threshold conf] olddir newdir
+
+Compares two runs of the same book, such as before and after
+changing the training or preprocessing, page by page. For each page
+the confidence of its best version in each run is printed, along
+with the change and whether the page has improved or regressed, and
+then the words which have changed between the runs, with removed
+words prefixed by '-' and added words by '+'. Regressed pages are
+highlighted in capitals, and a summary is printed at the end.
+
+A page only counts as improved or regressed if its confidence has
+changed by more than the -threshold.
+
+olddir and newdir should each contain the results of a run
+downloaded by getpipelinebook, including the best and conf files and
+the best hOCR of each page.
+`
+
+func main() {
+	threshold := flag.Float64("threshold", 1, "change in confidence below which a page is counted as unchanged")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		flag.Usage()
+		return
+	}
+
+	diffs, err := pipeline.DiffRuns(flag.Arg(0), flag.Arg(1), *threshold)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	err = pipeline.WriteRunsDiff(os.Stdout, diffs)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
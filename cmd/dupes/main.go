@@ -0,0 +1,90 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+// dupes finds consecutive pages of a book which look like duplicates
+// of each other, as can happen when a scanner feeds two pages at once.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"rescribe.xyz/bookpipeline/internal/pipeline"
+)
+
+const usage = `Usage: dupes [-d distance] [-dropdupes] bookdir
+
+Finds consecutive pages in bookdir which look like duplicates of each
+other, and prints them. Pages are compared using a perceptual hash,
+so pages which were scanned twice will still be found even though the
+images differ slightly. Blank pages are never considered duplicates,
+as books often contain several blank pages in a row.
+
+With -dropdupes the second page of each duplicate pair is moved into
+a 'duplicates' directory inside bookdir, so that it will not be
+included when the book is uploaded with booktopipeline. Check the
+pages found before using this.
+`
+
+func main() {
+	dist := flag.Int("d", 5, "maximum number of bits the hashes of two pages can differ by to be considered duplicates (out of 64)")
+	drop := flag.Bool("dropdupes", false, "move the second page of each duplicate pair into a 'duplicates' directory")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		return
+	}
+
+	bookdir := flag.Arg(0)
+	files, err := ioutil.ReadDir(bookdir)
+	if err != nil {
+		log.Fatalln("Failed to read directory", bookdir, err)
+	}
+	var paths []string
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		ext := strings.ToLower(filepath.Ext(f.Name()))
+		if ext != ".jpg" && ext != ".jpeg" && ext != ".png" {
+			continue
+		}
+		paths = append(paths, filepath.Join(bookdir, f.Name()))
+	}
+
+	dupes, err := pipeline.FindDuplicates(paths, *dist)
+	if err != nil {
+		log.Fatalln("Error finding duplicates:", err)
+	}
+
+	for _, d := range dupes {
+		fmt.Printf("%s\t%s\t%d\n", d.First, d.Second, d.Distance)
+	}
+
+	if !*drop || len(dupes) == 0 {
+		return
+	}
+
+	dupedir := filepath.Join(bookdir, "duplicates")
+	err = os.MkdirAll(dupedir, 0755)
+	if err != nil {
+		log.Fatalln("Failed to create directory", dupedir, err)
+	}
+	for _, d := range dupes {
+		err = os.Rename(d.Second, filepath.Join(dupedir, filepath.Base(d.Second)))
+		if err != nil {
+			log.Fatalln("Failed to move duplicate", d.Second, err)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+// estimate estimates how long a batch of books will take to process
+// with the pipeline, and how much it will cost.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"rescribe.xyz/bookpipeline/internal/pipeline"
+)
+
+const usage = `Usage: estimate -pagetime secs [-instances n] [-price cost] [-pages n | dir]
+
+Estimates how long a batch of books will take to process with the
+pipeline, and how much it will cost, before it is uploaded.
+
+The number of pages is either given with -pages, or counted from the
+page images in dir, which can be a single book or a directory of
+books. -pagetime is how many seconds one server takes to process a
+page through every stage of the pipeline, which is best found by
+timing a recent book processed with the same settings. -price is the
+cost of running one server for an hour.
+
+The pages are assumed to be shared evenly between -instances
+servers, each of which stops once there is nothing left for it to
+do, so adding servers makes the batch finish sooner without costing
+more.
+`
+
+func main() {
+	pages := flag.Int("pages", 0, "number of pages to estimate for, rather than counting them in dir")
+	pagetime := flag.Float64("pagetime", 0, "seconds one server takes to process a page")
+	instances := flag.Int("instances", 1, "number of servers processing the batch")
+	price := flag.Float64("price", 0, "cost of running one server for an hour")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() > 1 || (flag.NArg() == 0 && *pages == 0) || (flag.NArg() == 1 && *pages != 0) {
+		flag.Usage()
+		return
+	}
+
+	n := *pages
+	if flag.NArg() == 1 {
+		var err error
+		n, err = pipeline.CountPages(flag.Arg(0))
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	opts := pipeline.EstimateOptions{
+		PageTime:    time.Duration(*pagetime * float64(time.Second)),
+		Instances:   *instances,
+		HourlyPrice: *price,
+	}
+	e, err := pipeline.EstimateBatch(n, opts)
+	if err != nil {
+		log.Fatalln("Error estimating:", err)
+	}
+
+	fmt.Printf("Pages:        %d\n", e.Pages)
+	fmt.Printf("Servers:      %d\n", e.Instances)
+	fmt.Printf("Time:         %s\n", e.Time.Round(time.Minute))
+	fmt.Printf("Server hours: %.1f\n", e.InstanceHours)
+	fmt.Printf("Cost:         %.2f\n", e.Cost)
+}
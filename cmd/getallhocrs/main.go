@@ -40,7 +40,7 @@ func main() {
 	verboselog := log.New(os.Stdout, "", log.LstdFlags)
 
 	var conn Pipeliner
-	conn = &bookpipeline.AwsConn{Region: "eu-west-2", Logger: verboselog}
+	conn = &bookpipeline.AwsConn{Logger: verboselog}
 
 	err := conn.Init()
 	if err != nil {
@@ -51,7 +51,7 @@ func main() {
 	}
 
 	var conn QueuePipeliner
-	conn = &bookpipeline.AwsConn{Region: "eu-west-2"}
+	conn = &bookpipeline.AwsConn{}
 
 	err := conn.Init()
 	if err != nil {
@@ -46,7 +46,7 @@ func main() {
 	verboselog := log.New(n, "", log.LstdFlags)
 
 	var conn Pipeliner
-	conn = &bookpipeline.AwsConn{Region: "eu-west-2", Logger: verboselog}
+	conn = &bookpipeline.AwsConn{Logger: verboselog}
 
 	err := conn.Init()
 	if err != nil {
@@ -15,6 +15,7 @@ import (
 	"strings"
 
 	"rescribe.xyz/bookpipeline"
+	"rescribe.xyz/bookpipeline/internal/pipeline"
 )
 
 const usage = `Usage: getsamplepages [-prefix prefix]
@@ -51,7 +52,7 @@ func main() {
 	verboselog := log.New(n, "", log.LstdFlags)
 
 	var conn Pipeliner
-	conn = &bookpipeline.AwsConn{Region: "eu-west-2", Logger: verboselog}
+	conn = &bookpipeline.AwsConn{Logger: verboselog}
 
 	err := conn.Init()
 	if err != nil {
@@ -92,8 +93,7 @@ func main() {
 
 		fmt.Printf("Downloading page %s from %s\n", pg, name)
 
-		for _, suffix := range []string{".png", ".hocr"} {
-			fn := pg + suffix
+		for _, fn := range []string{pipeline.HocrImage(lines[0]), lines[0]} {
 			err = conn.Download(conn.WIPStorageId(), p+fn, name+fn)
 			if err != nil {
 				log.Fatalf("Download of %s%s failed: %v\n", p, fn, err)
@@ -9,16 +9,23 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"strings"
 
 	"rescribe.xyz/bookpipeline"
+
+	"rescribe.xyz/bookpipeline/internal/pipeline"
 )
 
 const usage = `Usage: getstats
 
-Downloads every 'conf' and 'best' file, and one hocr file, from a
-set of OCRed books. This is useful for statistics.
+Downloads every 'conf', 'best', 'meta.json', 'params.json' and
+'tessversion' file, and one hocr file, from a set of OCRed books.
+This is useful for statistics.
+
+The version of tesseract used to OCR each book is also printed, if it
+was recorded.
 `
 
 // null writer to enable non-verbose logging to be discarded
@@ -35,6 +42,22 @@ type Pipeliner interface {
 	WIPStorageId() string
 }
 
+// tesseractVersion returns the versions of tesseract listed in a
+// tessversion file, separated by ", "
+func tesseractVersion(fn string) (string, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return "", err
+	}
+	var versions []string
+	for _, l := range strings.Split(string(b), "\n") {
+		if l != "" {
+			versions = append(versions, l)
+		}
+	}
+	return strings.Join(versions, ", "), nil
+}
+
 func main() {
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), usage)
@@ -46,7 +69,7 @@ func main() {
 	verboselog := log.New(n, "", log.LstdFlags)
 
 	var conn Pipeliner
-	conn = &bookpipeline.AwsConn{Region: "eu-west-2", Logger: verboselog}
+	conn = &bookpipeline.AwsConn{Logger: verboselog}
 
 	err := conn.MinimalInit()
 	if err != nil {
@@ -59,7 +82,7 @@ func main() {
 		log.Fatalln("Failed to get list of files", err)
 	}
 
-	log.Println("Downloading all best and conf files found")
+	log.Println("Downloading all best, conf, meta.json and params.json files found")
 	for _, i := range objs {
 		parts := strings.Split(i, "/")
 		if parts[len(parts)-1] == "best" {
@@ -76,6 +99,34 @@ func main() {
 				log.Fatalln("Failed to download file", i, err)
 			}
 		}
+		if parts[len(parts)-1] == pipeline.MetaFile {
+			fmt.Printf("Downloading %s to %s\n", i, parts[0]+"-meta.json")
+			err = conn.Download(conn.WIPStorageId(), i, parts[0]+"-meta.json")
+			if err != nil {
+				log.Fatalln("Failed to download file", i, err)
+			}
+		}
+		if parts[len(parts)-1] == pipeline.TessVersionFile {
+			fmt.Printf("Downloading %s to %s\n", i, parts[0]+"-tessversion")
+			err = conn.Download(conn.WIPStorageId(), i, parts[0]+"-tessversion")
+			if err != nil {
+				log.Fatalln("Failed to download file", i, err)
+			}
+			v, err := tesseractVersion(parts[0] + "-tessversion")
+			if err != nil {
+				log.Fatalln("Failed to read tesseract version", i, err)
+			}
+			if v != "" {
+				fmt.Printf("%s was OCRed with %s\n", parts[0], v)
+			}
+		}
+		if parts[len(parts)-1] == pipeline.ParamsFile {
+			fmt.Printf("Downloading %s to %s\n", i, parts[0]+"-params.json")
+			err = conn.Download(conn.WIPStorageId(), i, parts[0]+"-params.json")
+			if err != nil {
+				log.Fatalln("Failed to download file", i, err)
+			}
+		}
 	}
 
 	var bookpagesgot []string
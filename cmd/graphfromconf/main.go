@@ -0,0 +1,80 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+// graphfromconf recreates the confidence graph of a book from its
+// conf and best files.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"rescribe.xyz/bookpipeline"
+	"rescribe.xyz/bookpipeline/internal/pipeline"
+)
+
+const usage = `Usage: graphfromconf [-o graph.png] [-xlabel label] [-noguides] [-labelbelow conf] [-maxlabels n] bookdir...
+
+Recreates the graph of the confidence of each page of a book from the
+conf file, and the best file if there is one, written by the analysis
+of the book, without needing to analyse it again. This is useful for
+restyling the graphs of books which have already been downloaded with
+getpipelinebook. If there is no best file, the highest confidence of
+each page in the conf file is used.
+
+The graph is saved as graph.png in each bookdir, replacing any that is
+already there, unless another file is given with -o, which can only
+be used with a single bookdir.
+
+By default the pages outside the top and bottom tenth of confidences
+are labelled with their page number. With -labelbelow only the pages
+with a lower confidence are labelled instead, and with -maxlabels at
+most that many pages are labelled, those with the lowest confidence,
+which keeps the graphs of poor books readable.
+`
+
+func main() {
+	out := flag.String("o", "", "File to save the graph to, rather than bookdir/graph.png")
+	xlabel := flag.String("xlabel", "Page number", "Label for the x axis")
+	noguides := flag.Bool("noguides", false, "Leave out the lines marking good, medium and bad confidence")
+	labelbelow := flag.Float64("labelbelow", 0, "Only label pages with a confidence below this")
+	maxlabels := flag.Int("maxlabels", 0, "Label at most this many pages, those with the lowest confidence (0 for no limit)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 || (*out != "" && flag.NArg() > 1) {
+		flag.Usage()
+		return
+	}
+
+	opts := bookpipeline.GraphOptions{
+		XAxis:      *xlabel,
+		Guidelines: !*noguides,
+		LabelBelow: *labelbelow,
+		MaxLabels:  *maxlabels,
+	}
+
+	for _, dir := range flag.Args() {
+		fn := *out
+		if fn == "" {
+			fn = filepath.Join(dir, "graph.png")
+		}
+		f, err := os.Create(fn)
+		if err != nil {
+			log.Fatalln("Error creating file", fn, err)
+		}
+		err = pipeline.GraphFromConf(dir, opts, f)
+		f.Close()
+		if err != nil {
+			_ = os.Remove(fn)
+			log.Fatalf("Error creating graph for %s: %v\n", dir, err)
+		}
+	}
+}
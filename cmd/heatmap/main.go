@@ -0,0 +1,56 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+// heatmap creates images of each page of a book with the words tinted
+// by their OCR confidence.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"rescribe.xyz/bookpipeline/internal/pipeline"
+)
+
+const usage = `Usage: heatmap [-v] bookdir
+
+Creates an image of each page of a book with the bounding box of
+each word tinted by its OCR confidence, from red for the lowest
+confidence through yellow to green for the highest. This makes it
+easy to spot areas which are systematically poorly recognised, like
+a column of marginalia or a table.
+
+bookdir should contain the results downloaded by getpipelinebook
+with -png, so that the best hOCR and image of each page, and the
+best and conf files, are available. The images are saved in
+bookdir/heatmap.
+`
+
+func main() {
+	verbose := flag.Bool("v", false, "Print the name of each heatmap created")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		return
+	}
+
+	done, err := pipeline.WriteHeatmaps(flag.Arg(0))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if *verbose {
+		for _, fn := range done {
+			fmt.Println(fn)
+		}
+	}
+	if len(done) == 0 {
+		log.Fatalln("No page images found to create heatmaps from")
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+// importocr creates the usual results of the pipeline, like the
+// searchable PDF and confidence graph, from page images with OCR
+// which has already been done elsewhere, as hOCR or ALTO.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"rescribe.xyz/bookpipeline"
+	"rescribe.xyz/bookpipeline/internal/pipeline"
+	"rescribe.xyz/bookpipeline/internal/postproc"
+)
+
+const usage = `Usage: importocr [-v] [-loglevel level] [-fullpdf] [-mintextconf conf] [-columns] [-textrules file] bookdir [savedir]
+
+Creates the usual results of the pipeline from a directory of page
+images which have already been OCRed elsewhere, without OCRing them
+again. Only the analysis stage of the pipeline is run, locally, to
+choose the best version of each page and create the conf and best
+files, the confidence graph, the searchable PDFs and the text of
+each page.
+
+Each page image, a .jpg, .jpeg or .png file, should have an OCR file with
+the same name apart from its extension: .hocr or .html for hOCR, or
+.xml for ALTO, which is converted to hOCR. The confidence of each
+word of ALTO is taken from its WC attribute, so the confidence graph
+is only useful if the OCR which made it recorded these.
+
+The results are saved in savedir, which defaults to a directory
+named after bookdir in the current directory, with the text of each
+page saved in a text directory inside it.
+
+With -textrules the substitutions in that file are applied to the
+text of each page, to correct errors the OCR makes systematically,
+like reading a long s as an f. Each line of the file is a regular
+expression and its replacement, separated by a tab, and lines
+starting with # are ignored. The hOCR is unchanged.
+`
+
+func main() {
+	verbose := flag.Bool("v", false, "verbose")
+	loglevel := flag.String("loglevel", "", "log only messages at or above this level: error, warn, info or debug")
+	fullpdf := flag.Bool("fullpdf", false, "also create a PDF using the images at full quality")
+	mintextconf := flag.Float64("mintextconf", 0, "leave words with a lower confidence out of the searchable text of the PDFs")
+	columns := flag.Bool("columns", false, "put the searchable text of pages with several columns in reading order")
+	textrules := flag.String("textrules", "", "file of regular expression substitutions to correct the text of each page with")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 || flag.NArg() > 2 {
+		flag.Usage()
+		return
+	}
+
+	bookdir := flag.Arg(0)
+	bookname := strings.ReplaceAll(filepath.Base(filepath.Clean(bookdir)), " ", "_")
+	savedir := bookname
+	if flag.NArg() > 1 {
+		savedir = flag.Arg(1)
+	}
+
+	var rules []postproc.Rule
+	if *textrules != "" {
+		var err error
+		rules, err = postproc.LoadRules(*textrules)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	verboselog, err := bookpipeline.VerboseLogger(*verbose, *loglevel, os.Stdout, log.LstdFlags)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	tempdir, err := pipeline.MkTempDir("bookpipeline")
+	if err != nil {
+		log.Fatalln("Error setting up temporary directory:", err)
+	}
+	defer os.RemoveAll(tempdir)
+
+	conn := &bookpipeline.LocalConn{Logger: verboselog, TempDir: tempdir}
+	err = conn.Init()
+	if err != nil {
+		log.Fatalln("Error setting up connection:", err)
+	}
+
+	ctx := context.Background()
+	opts := pipeline.AnalyseOptions{MkFullPdf: *fullpdf, MinTextConf: *mintextconf, ColumnOrder: *columns}
+	fmt.Printf("Analysing OCR and compiling PDFs\n")
+	err = pipeline.ImportOcr(ctx, bookdir, bookname, conn, opts)
+	if err != nil {
+		os.RemoveAll(tempdir)
+		log.Fatalln("Error importing OCR:", err)
+	}
+
+	fmt.Printf("Saving results to %s\n", savedir)
+	err = os.MkdirAll(savedir, 0755)
+	if err != nil {
+		os.RemoveAll(tempdir)
+		log.Fatalf("Error creating directory %s: %v\n", savedir, err)
+	}
+	for _, f := range []func(context.Context, string, string, pipeline.Downloader) error{
+		pipeline.DownloadBestPages,
+		pipeline.DownloadAnalyses,
+	} {
+		err = f(ctx, savedir, bookname, conn)
+		if err != nil {
+			os.RemoveAll(tempdir)
+			log.Fatalln("Error saving results:", err)
+		}
+	}
+	err = pipeline.DownloadPdfs(ctx, savedir, bookname, conn, pipeline.PdfColour)
+	if err != nil {
+		os.RemoveAll(tempdir)
+		log.Fatalln("Error saving PDFs:", err)
+	}
+	err = pipeline.SaveBestText(savedir, bookname, rules)
+	if err != nil {
+		os.RemoveAll(tempdir)
+		log.Fatalln("Error saving text:", err)
+	}
+}
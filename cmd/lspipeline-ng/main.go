@@ -9,6 +9,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
 	"os/exec"
 	"sort"
 	"strings"
@@ -16,9 +17,11 @@ import (
 	"time"
 
 	"rescribe.xyz/bookpipeline"
+	"rescribe.xyz/bookpipeline/internal/cli"
+	"rescribe.xyz/bookpipeline/internal/pipeline"
 )
 
-const usage = `Usage: lspipeline-ng [-i key] [-n num] [-nobooks]
+const usage = `Usage: lspipeline-ng [-i key] [-n num] [-exclude names] [-nobooks]
 
 Lists useful things related to the pipeline.
 
@@ -30,6 +33,12 @@ Lists useful things related to the pipeline.
 
 The -ng version does concurrent requests for book status to speed
 that process up significantly.
+
+Logs aren't fetched from persistent instances which don't run
+bookpipeline, which are recognised by name. These are the comma
+separated names given with -exclude, which defaults to the value of
+the BOOKPIPELINE_EXCLUDE_INSTANCES environment variable, or
+"workhorse" if that isn't set.
 `
 
 type LsPipeliner interface {
@@ -41,6 +50,7 @@ type LsPipeliner interface {
 	GetQueueDetails(url string) (string, string, error)
 	GetInstanceDetails() ([]bookpipeline.InstanceDetails, error)
 	ListObjectWithMeta(bucket string, prefix string) (bookpipeline.ObjMeta, error)
+	ListObjectsWithMeta(bucket string, prefix string) ([]bookpipeline.ObjMeta, error)
 	ListObjectPrefixes(bucket string) ([]string, error)
 	WIPStorageId() string
 }
@@ -109,13 +119,31 @@ func (o ObjMetas) Less(i, j int) bool {
 // it was completed, or if it has not finished, the date of any
 // book file.
 func getBookDetails(conn LsPipeliner, key string) (date time.Time, done bool, err error) {
-	// First try to get the graph.png file from the book, which marks
-	// it as done
-	obj, err := conn.ListObjectWithMeta(conn.WIPStorageId(), key+"graph.png")
-	if err == nil {
+	// First try to get the done marker from the book, which is
+	// saved last by analysis
+	obj, err := conn.ListObjectWithMeta(conn.WIPStorageId(), key+pipeline.DoneFile)
+	if err == nil && obj.Name == key+pipeline.DoneFile {
 		return obj.Date, true, nil
 	}
 
+	// Books analysed before the done marker was saved have graph.png
+	// saved last instead, so if it is there check that the other
+	// core results are too
+	obj, err = conn.ListObjectWithMeta(conn.WIPStorageId(), key+"graph.png")
+	if err == nil {
+		objs, err := conn.ListObjectsWithMeta(conn.WIPStorageId(), key)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		var names []string
+		for _, o := range objs {
+			names = append(names, o.Name)
+		}
+		if pipeline.ResultsComplete(names) {
+			return obj.Date, true, nil
+		}
+	}
+
 	// Otherwise get any file from the book to get a date to sort by
 	obj, err = conn.ListObjectWithMeta(conn.WIPStorageId(), key)
 	if err != nil {
@@ -124,33 +152,41 @@ func getBookDetails(conn LsPipeliner, key string) (date time.Time, done bool, er
 	return obj.Date, false, nil
 }
 
-// getBookDetailsChan gets the details for a book putting it into either the
-// done or inprogress channels as appropriate, or sending an error to errc
-// on failure.
-func getBookDetailsChan(conn LsPipeliner, wg *sync.WaitGroup, key string, done chan bookpipeline.ObjMeta, inprogress chan bookpipeline.ObjMeta, errc chan error) {
+// bookDetails are the details of a book found by getBookDetailsChan,
+// or the error which prevented them from being found
+type bookDetails struct {
+	meta bookpipeline.ObjMeta
+	done bool
+	err  error
+}
+
+// getBookDetailsChan gets the details for a book, sending them to the
+// details channel, along with any error.
+func getBookDetailsChan(conn LsPipeliner, key string, details chan bookDetails) {
 	date, isdone, err := getBookDetails(conn, key)
 	if err != nil {
-		wg.Done()
-		errc <- err
+		details <- bookDetails{err: fmt.Errorf("Error getting details of %s: %v", key, err)}
 		return
 	}
 	meta := bookpipeline.ObjMeta{Name: strings.TrimSuffix(key, "/"), Date: date}
-	if isdone {
-		done <- meta
-	} else {
-		inprogress <- meta
-	}
-	wg.Done()
+	details <- bookDetails{meta: meta, done: isdone}
 }
 
+// maxBookRequests is the most book details requests getBookStatus
+// makes at once
+const maxBookRequests = 30
+
 // getBookStatus returns a list of in progress and done books.
 // It determines this by finding all prefixes, and splitting them
-// into two lists, those which have a 'graph.png' file (the done
-// list), and those which do not (the inprogress list). They are
-// sorted according to the date of the graph.png file, or the date
-// of a random file with the prefix if no graph.png was found.
+// into two lists, those which have all of the core results of
+// analysis, as checked by pipeline.ResultsComplete (the done list),
+// and those which do not (the inprogress list). They are sorted
+// according to the date of the done marker or graph.png file, or
+// the date of a random file with the prefix if the book isn't done.
 // It spins up many goroutines to do query the book status and
-// dates, as it is far faster to do concurrently.
+// dates, as it is far faster to do concurrently. If the details of
+// some books can't be found, the rest are still returned, along
+// with an error listing each failure.
 func getBookStatus(conn LsPipeliner) (inprogress []string, done []string, err error) {
 	prefixes, err := conn.ListObjectPrefixes(conn.WIPStorageId())
 	if err != nil {
@@ -158,36 +194,33 @@ func getBookStatus(conn LsPipeliner) (inprogress []string, done []string, err er
 		return
 	}
 
-	donec := make(chan bookpipeline.ObjMeta, 100)
-	inprogressc := make(chan bookpipeline.ObjMeta, 100)
-	errc := make(chan error)
-
-	// This is a bit messy, but it works. We get the book details in blocks of
-	// 30 simultaneous requests, using wait groups to pause once each 20 have
-	// been sent.
-	go func() {
-		var wg sync.WaitGroup
-		for i, p := range prefixes {
-			wg.Add(1)
-			go getBookDetailsChan(conn, &wg, p, donec, inprogressc, errc)
-			if i%30 == 0 {
-				wg.Wait()
-			}
-		}
-	}()
+	// the details channel is buffered so that every goroutine can
+	// always finish, whatever happens to the receiver
+	details := make(chan bookDetails, len(prefixes))
+	sem := make(chan bool, maxBookRequests)
+	var wg sync.WaitGroup
+	for _, p := range prefixes {
+		wg.Add(1)
+		go func(p string) {
+			defer wg.Done()
+			sem <- true
+			getBookDetailsChan(conn, p, details)
+			<-sem
+		}(p)
+	}
+	wg.Wait()
+	close(details)
 
 	var inprogressmeta, donemeta ObjMetas
-
-	// there will be exactly as many sends to donec or inprogressc
-	// as there are prefixes
-	for range prefixes {
-		select {
-		case i := <-donec:
-			donemeta = append(donemeta, i)
-		case i := <-inprogressc:
-			inprogressmeta = append(inprogressmeta, i)
-		case err = <-errc:
-			return inprogress, done, err
+	var errs []string
+	for d := range details {
+		switch {
+		case d.err != nil:
+			errs = append(errs, d.err.Error())
+		case d.done:
+			donemeta = append(donemeta, d.meta)
+		default:
+			inprogressmeta = append(inprogressmeta, d.meta)
 		}
 	}
 
@@ -201,6 +234,11 @@ func getBookStatus(conn LsPipeliner) (inprogress []string, done []string, err er
 		inprogress = append(inprogress, i.Name)
 	}
 
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		err = fmt.Errorf("Failed to get the status of %d books: %s", len(errs), strings.Join(errs, "; "))
+	}
+
 	return
 }
 
@@ -209,10 +247,8 @@ func getBookStatus(conn LsPipeliner) (inprogress []string, done []string, err er
 func getBookStatusChan(conn LsPipeliner, inprogressc chan string, donec chan string) {
 	inprogress, done, err := getBookStatus(conn)
 	if err != nil {
+		// any books whose status was found are still listed
 		log.Println("Error getting book status:", err)
-		close(inprogressc)
-		close(donec)
-		return
 	}
 	for _, i := range inprogress {
 		inprogressc <- i
@@ -255,6 +291,7 @@ func getRecentSSHLogsChan(ips []string, id string, lognum int, logs chan string)
 func main() {
 	keyfile := flag.String("i", "", "private key file for SSH")
 	lognum := flag.Int("n", 5, "number of lines to include in SSH logs")
+	exclude := flag.String("exclude", cli.ExcludedInstances(os.Getenv), "comma separated names of instances not to get logs from")
 	nobooks := flag.Bool("nobooks", false, "disable listing books completed and not completed (which takes some time)")
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), usage)
@@ -267,7 +304,7 @@ func main() {
 	verboselog = log.New(n, "", 0)
 
 	var conn LsPipeliner
-	conn = &bookpipeline.AwsConn{Region: "eu-west-2", Logger: verboselog}
+	conn = &bookpipeline.AwsConn{Logger: verboselog}
 	err := conn.Init()
 	if err != nil {
 		log.Fatalln("Failed to set up cloud connection:", err)
@@ -286,6 +323,7 @@ func main() {
 	}
 
 	var ips []string
+	excluded := cli.ExcludedNames(*exclude)
 
 	fmt.Println("# Instances")
 	for i := range instances {
@@ -295,7 +333,7 @@ func main() {
 		}
 		if i.Ip != "" {
 			fmt.Printf(", IP: %s", i.Ip)
-			if i.State == "running" && i.Name != "workhorse" {
+			if i.State == "running" && !excluded[i.Name] {
 				ips = append(ips, i.Ip)
 			}
 		}
@@ -0,0 +1,118 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"rescribe.xyz/bookpipeline"
+	"rescribe.xyz/bookpipeline/internal/pipeline"
+)
+
+// mockLister is a connection with a fixed set of books, some of which
+// are done, some of which only have a graph, and some of which fail
+// to be listed
+type mockLister struct {
+	LsPipeliner
+	books     map[string]time.Time
+	done      map[string]bool
+	graphonly map[string]bool
+	marked    map[string]bool
+	bad       map[string]bool
+}
+
+func (m *mockLister) WIPStorageId() string { return "wip" }
+
+func (m *mockLister) ListObjectPrefixes(bucket string) ([]string, error) {
+	var prefixes []string
+	for b := range m.books {
+		prefixes = append(prefixes, b+"/")
+	}
+	return prefixes, nil
+}
+
+func (m *mockLister) ListObjectWithMeta(bucket string, prefix string) (bookpipeline.ObjMeta, error) {
+	book := strings.Split(prefix, "/")[0]
+	if m.bad[book] {
+		return bookpipeline.ObjMeta{}, fmt.Errorf("access denied")
+	}
+	if strings.HasSuffix(prefix, "graph.png") && !m.done[book] && !m.graphonly[book] {
+		return bookpipeline.ObjMeta{}, fmt.Errorf("not found")
+	}
+	if strings.HasSuffix(prefix, pipeline.DoneFile) && !m.marked[book] {
+		return bookpipeline.ObjMeta{}, fmt.Errorf("not found")
+	}
+	return bookpipeline.ObjMeta{Name: prefix, Date: m.books[book]}, nil
+}
+
+func (m *mockLister) ListObjectsWithMeta(bucket string, prefix string) ([]bookpipeline.ObjMeta, error) {
+	book := strings.Split(prefix, "/")[0]
+	names := []string{"0001.jpg"}
+	switch {
+	case m.done[book]:
+		names = append(names, "best", book+".colour.pdf", "graph.png")
+	case m.graphonly[book]:
+		names = append(names, "graph.png")
+	case m.marked[book]:
+		names = append(names, "best", book+".colour.pdf", pipeline.DoneFile)
+	}
+	var objs []bookpipeline.ObjMeta
+	for _, n := range names {
+		objs = append(objs, bookpipeline.ObjMeta{Name: prefix + n, Date: m.books[book]})
+	}
+	return objs, nil
+}
+
+func Test_getBookStatus(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	conn := &mockLister{
+		books: make(map[string]time.Time),
+		done:  map[string]bool{},
+		// book07 has a graph but no other results, so is in progress
+		graphonly: map[string]bool{"book07": true},
+		// book08 has the done marker but no graph, so is done
+		marked: map[string]bool{"book08": true},
+		bad:    map[string]bool{"book05": true},
+	}
+	// more books than the number of requests made at once
+	var expectedDone, expectedInprogress []string
+	for i := 0; i < 2*maxBookRequests; i++ {
+		b := fmt.Sprintf("book%02d", i)
+		conn.books[b] = start.Add(time.Duration(i) * time.Hour)
+		switch {
+		case conn.bad[b]:
+		case conn.marked[b]:
+			expectedDone = append(expectedDone, b)
+		case i%2 == 0:
+			conn.done[b] = true
+			expectedDone = append(expectedDone, b)
+		default:
+			expectedInprogress = append(expectedInprogress, b)
+		}
+	}
+
+	inprogress, done, err := getBookStatus(conn)
+	if err == nil {
+		t.Fatalf("Expected an error for book05, got none")
+	}
+	if !strings.Contains(err.Error(), "book05") {
+		t.Fatalf("Expected error to name book05, got %v", err)
+	}
+	if strings.Join(done, " ") != strings.Join(expectedDone, " ") {
+		t.Fatalf("Expected done books %v, got %v", expectedDone, done)
+	}
+	if strings.Join(inprogress, " ") != strings.Join(expectedInprogress, " ") {
+		t.Fatalf("Expected in progress books %v, got %v", expectedInprogress, inprogress)
+	}
+
+	conn.bad = map[string]bool{}
+	_, _, err = getBookStatus(conn)
+	if err != nil {
+		t.Fatalf("Expected no error with no bad books, got %v", err)
+	}
+}
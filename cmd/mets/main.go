@@ -0,0 +1,76 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+// mets creates a METS document for a book, listing the image and OCR
+// file of each page, for ingest into digital library systems.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"rescribe.xyz/bookpipeline/internal/pipeline"
+)
+
+const usage = `Usage: mets [-o mets.xml] [-name name] bookdir...
+
+Creates a minimal METS document for a book which has been downloaded
+with getpipelinebook, listing the image and OCR file of each page, as
+is needed to ingest the book into many digital library systems. The
+pages are taken from the best file, and each refers to the image its
+best hOCR was made from. If there is an ALTO version of the best hOCR
+of a page, with the same name but ending in .xml, it is used as the
+OCR file instead of the hOCR. The image and OCR file of every page
+must be in bookdir, so the images of the best pages also need to be
+downloaded, with getpipelinebook -png.
+
+The files are referred to by their names, so the METS should be kept
+alongside them. It is saved as mets.xml in each bookdir, replacing
+any that is already there, unless another file is given with -o,
+which can only be used with a single bookdir.
+`
+
+func main() {
+	out := flag.String("o", "", "File to save the METS to, rather than bookdir/mets.xml")
+	name := flag.String("name", "", "Identifier for the book in the METS, rather than the name of bookdir")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 || ((*out != "" || *name != "") && flag.NArg() > 1) {
+		flag.Usage()
+		return
+	}
+
+	for _, dir := range flag.Args() {
+		pages, err := pipeline.MetsPages(dir)
+		if err != nil {
+			log.Fatalf("Error listing pages of %s: %v\n", dir, err)
+		}
+
+		bookname := *name
+		if bookname == "" {
+			bookname = filepath.Base(filepath.Clean(dir))
+		}
+		fn := *out
+		if fn == "" {
+			fn = filepath.Join(dir, "mets.xml")
+		}
+		f, err := os.Create(fn)
+		if err != nil {
+			log.Fatalln("Error creating file", fn, err)
+		}
+		err = pipeline.WriteMets(f, bookname, pages)
+		f.Close()
+		if err != nil {
+			_ = os.Remove(fn)
+			log.Fatalf("Error creating METS for %s: %v\n", dir, err)
+		}
+	}
+}
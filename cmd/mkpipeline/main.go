@@ -24,7 +24,7 @@ func main() {
 	}
 
 	var conn MkPipeliner
-	conn = &bookpipeline.AwsConn{Region: "eu-west-2", Logger: log.New(os.Stdout, "", 0)}
+	conn = &bookpipeline.AwsConn{Logger: log.New(os.Stdout, "", 0)}
 	err := conn.MinimalInit()
 	if err != nil {
 		log.Fatalln("Failed to set up cloud connection:", err)
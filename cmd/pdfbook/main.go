@@ -8,35 +8,126 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
+	"time"
 
 	"rescribe.xyz/bookpipeline"
+	"rescribe.xyz/bookpipeline/internal/pipeline"
+	"rescribe.xyz/utils/pkg/hocr"
 )
 
-const usage = `Usage: pdfbook [-c] [-s] dir out.pdf
+const usage = `Usage: pdfbook [-c] [-s] [-layout layout] [-split pages] [-splitsize mb] [-mintextconf conf] [-appendreport] [-scalehocr] [-dpi dpi] [-font font.ttf] [-pdfname template] [-footer text] [-cover] [-stream] [-columns] [-exclude pages] dir [out.pdf]
 
 Creates a searchable PDF from a directory of hOCR and image files.
 
+If out.pdf is not given, the PDF is saved in the current directory,
+named using the -pdfname template, in which {book} is replaced with
+the name of dir and {date} with the current date. Any spaces in the
+name of dir are replaced with underscores.
+
+The PDF can be split into several volumes with the -split or -splitsize
+flags, in which case they will be saved as out_part1.pdf, out_part2.pdf,
+and so on.
+
+Words with a confidence below that set with -mintextconf are left out
+of the searchable text, though the images of their pages are still
+included.
+
+With -scalehocr, the hOCR coordinates are scaled to fit each image,
+if the image is a different size to the one that was OCRed, such as
+when the OCR of a binarised image is used with the colour original.
+
+Pages are sized according to the DPI of their images, so that they
+have their true physical size, if it is known. The DPI of every page
+can be set with -dpi, and if the directory contains a dpi.json file
+(as recorded by booktopipeline -dpi and downloaded by
+getpipelinebook) the DPI of each page is read from it, taking
+precedence over -dpi. Otherwise a default page size is used.
+
+The searchable text uses the DejaVu Sans Condensed font, which
+covers most alphabets. For books with characters it doesn't cover,
+which would otherwise be lost when the text is selected or searched,
+a different TrueType font can be given with -font.
+
+With -appendreport, pages are added to the end of the PDF with a
+graph of the confidence of each page, and a summary of the
+confidences. If a graph.png file exists in the directory it is used,
+otherwise the graph is created from the hOCR files.
+
+To record where the OCR came from, -footer stamps some text, like
+"OCR by Rescribe, {date}", in a margin added below each page, with
+{date} replaced by the current date. With -cover, a cover page is
+added to the start of the PDF (and each volume of a split PDF) with
+the name of the book, the date, and any metadata in a meta.json file
+in the directory (as set with booktopipeline -meta).
+
+For very large books, -stream writes each page to disk as it is
+added, in a temporary file alongside out.pdf, rather than building
+the whole PDF in memory, so that the memory needed stays roughly the
+same however many pages there are.
+
+With -columns, the searchable text of pages with several columns is
+put in reading order, one column after another, rather than in the
+order of the hOCR, which can mix up the lines of different columns.
+
 If a 'best' file exists in the directory, each hOCR listed in it is
 used to provide the searchable text for each page. Otherwise pdfbook
 just looks for a .hocr with the same file base as the image for the
 searchable text.
+
+If the directory contains an order.json file (as saved by
+booktopipeline -order and downloaded by getpipelinebook), the pages
+listed in the best file, or in the hocr directory of a nested book,
+are put in the order it gives rather than in filename order.
+
+Pages can be left out of the PDF, such as covers, blank pages or
+duplicate scans, by listing them with -exclude, as a comma separated
+list of page numbers like 0,1,350, or in an exclude.txt file in the
+directory (as set with booktopipeline -exclude and downloaded by
+getpipelinebook). Pages are identified by the number at the end of
+the name of their files, as shown on the confidence graph.
+
+The directory can also be a book saved by rescribe, which has the
+best hOCR of each page in a hocr directory and the binarised image
+it was made from in a png directory, alongside the original images.
+This nested layout is detected automatically, or can be chosen with
+-layout nested (or -layout flat for the usual layout). For a nested
+book both a binarised and a colour PDF are created, named like
+out.binarised.pdf and out.colour.pdf, using the original images for
+the colour PDF. If the original image of any page can't be found
+only the binarised PDF is created.
 `
 
 type Pdfer interface {
 	Setup() error
 	AddPage(imgpath, hocrpath string, smaller bool) error
+	AddReport(graphpath string, summary []string) error
 	Save(path string) error
 }
 
+// reportPdf wraps a SplitPdf, recording the hOCR file of each page
+// added, so that a report on them can be added at the end
+type reportPdf struct {
+	*bookpipeline.SplitPdf
+	hocrs []string
+}
+
+func (p *reportPdf) AddPage(imgpath, hocrpath string, smaller bool) error {
+	p.hocrs = append(p.hocrs, hocrpath)
+	return p.SplitPdf.AddPage(imgpath, hocrpath, smaller)
+}
+
 const pageWidth = 5 // pageWidth in inches
 
 // pxToPt converts a pixel value into a pt value (72 pts per inch)
@@ -60,13 +151,44 @@ func imgPath(hocrpath string, colour bool) string {
 			imgname = nosuffix + ".jpg"
 		}
 	} else {
-		imgname = nosuffix + ".png"
+		imgname = pipeline.HocrImage(name)
 	}
 	return path.Join(d, imgname)
 }
 
-// addBest adds the pages in dir/best to a PDF
-func addBest(dir string, pdf Pdfer, colour, smaller bool) error {
+// readOrder reads the page order manifest in dir, returning an empty
+// one if there isn't one
+func readOrder(dir string) (pipeline.PageOrder, error) {
+	fn := filepath.Join(dir, pipeline.OrderFile)
+	_, err := os.Stat(fn)
+	if os.IsNotExist(err) {
+		return pipeline.PageOrder{}, nil
+	}
+	return pipeline.ReadPageOrder(fn)
+}
+
+// readExclusions returns the pages to exclude listed in list, a comma
+// separated list of page numbers, along with any listed in the
+// exclusions file in dir
+func readExclusions(dir string, list string) (pipeline.PageExclusions, error) {
+	excl, err := pipeline.ParsePageExclusions(list)
+	if err != nil {
+		return excl, err
+	}
+	inbook, err := pipeline.ReadPageExclusions(filepath.Join(dir, pipeline.ExcludeFile))
+	if err != nil {
+		return excl, err
+	}
+	for n := range inbook {
+		excl[n] = true
+	}
+	return excl, nil
+}
+
+// addBest adds the pages in dir/best to a PDF, in the order given by
+// the page order manifest in dir, if there is one, leaving out any
+// pages in excl
+func addBest(dir string, pdf Pdfer, colour, smaller bool, excl pipeline.PageExclusions) error {
 	f, err := os.Open(path.Join(dir, "best"))
 	if err != nil {
 		log.Fatalln("Failed to open best file", err)
@@ -84,6 +206,13 @@ func addBest(dir string, pdf Pdfer, colour, smaller bool) error {
 	}
 	sort.Strings(files)
 
+	order, err := readOrder(dir)
+	if err != nil {
+		return err
+	}
+	order.Sort(files)
+	files = excl.Filter(files)
+
 	for _, f := range files {
 		hocrpath := path.Join(dir, f)
 		img := imgPath(hocrpath, colour)
@@ -95,9 +224,205 @@ func addBest(dir string, pdf Pdfer, colour, smaller bool) error {
 	return nil
 }
 
+// addReport adds pages with the confidence graph and a summary of the
+// confidences of each page to the end of the pdf
+func addReport(dir string, pdf *reportPdf) error {
+	confs := make(map[string]*bookpipeline.Conf)
+	for _, h := range pdf.hocrs {
+		avg, err := hocr.GetAvgConf(h)
+		if err != nil {
+			continue
+		}
+		confs[h] = &bookpipeline.Conf{Path: h, Conf: avg}
+	}
+
+	graphpath := path.Join(dir, "graph.png")
+	_, err := os.Stat(graphpath)
+	if os.IsNotExist(err) {
+		f, err := ioutil.TempFile("", "pdfbookgraph*.png")
+		if err != nil {
+			return fmt.Errorf("Error creating temporary file: %v", err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		graphpath = f.Name()
+		err = bookpipeline.Graph(confs, filepath.Base(dir), f)
+		if err != nil {
+			log.Printf("Error creating graph, continuing without it: %v\n", err)
+			graphpath = ""
+		}
+		f.Close()
+	}
+
+	return pdf.AddReport(graphpath, bookpipeline.ConfSummary(confs))
+}
+
+// coverLines returns the lines of text for a cover page for the book
+// in dir, with its name, any metadata saved in dir, and the date
+func coverLines(dir string, bookname string, date time.Time) ([]string, error) {
+	lines := []string{bookname, ""}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, pipeline.MetaFile))
+	if err != nil && !os.IsNotExist(err) {
+		return lines, fmt.Errorf("Error reading metadata: %v", err)
+	}
+	if err == nil {
+		meta := make(map[string]string)
+		err = json.Unmarshal(b, &meta)
+		if err != nil {
+			return lines, fmt.Errorf("Error parsing metadata: %v", err)
+		}
+		var keys []string
+		for k := range meta {
+			if k == pipeline.ContentHashKey {
+				continue
+			}
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			lines = append(lines, k+": "+meta[k])
+		}
+	}
+
+	return append(lines, "Created: "+date.Format("2006-01-02")), nil
+}
+
+// isNested reports whether dir has the nested layout of a book
+// saved by rescribe, with hocr and png directories
+func isNested(dir string) bool {
+	for _, d := range []string{"hocr", "png"} {
+		fi, err := os.Stat(filepath.Join(dir, d))
+		if err != nil || !fi.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// nestedPage is a page of a book in the nested layout, with the
+// paths of its hOCR, binarised image and original colour image
+type nestedPage struct {
+	hocr, bin, colour string
+}
+
+// pipelineNum matches the number appended to the names of page
+// images when they are uploaded to the pipeline
+var pipelineNum = regexp.MustCompile(`_[0-9]{4,}$`)
+
+// nestedPages returns the pages of a book in the nested layout. The
+// hOCR of each page is in dir/hocr, the binarised image it was made
+// from in dir/png, and the original image in dir, named as it was
+// before the pipeline appended a number to it and replaced any
+// spaces. The colour image is left empty for any page whose original
+// can't be found. The pages are in the order given by the page order
+// manifest in dir, if there is one, otherwise in filename order. Any
+// pages in excl are left out.
+func nestedPages(dir string, excl pipeline.PageExclusions) ([]nestedPage, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read directory %s: %v", dir, err)
+	}
+	originals := make(map[string]string)
+	for _, f := range files {
+		ext := strings.ToLower(filepath.Ext(f.Name()))
+		if f.IsDir() || (ext != ".jpg" && ext != ".jpeg" && ext != ".png") {
+			continue
+		}
+		base := strings.TrimSuffix(f.Name(), filepath.Ext(f.Name()))
+		originals[strings.ReplaceAll(base, " ", "_")] = filepath.Join(dir, f.Name())
+	}
+
+	hocrs, err := filepath.Glob(filepath.Join(dir, "hocr", "*.hocr"))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find hOCR files: %v", err)
+	}
+	if len(hocrs) == 0 {
+		return nil, fmt.Errorf("No hOCR files found in %s", filepath.Join(dir, "hocr"))
+	}
+	sort.Strings(hocrs)
+
+	order, err := readOrder(dir)
+	if err != nil {
+		return nil, err
+	}
+	order.Sort(hocrs)
+	hocrs = excl.Filter(hocrs)
+
+	var pages []nestedPage
+	for _, h := range hocrs {
+		base := strings.TrimSuffix(filepath.Base(h), ".hocr")
+		name := pipelineNum.ReplaceAllString(strings.SplitN(base, "_bin", 2)[0], "")
+		pages = append(pages, nestedPage{
+			hocr:   h,
+			bin:    filepath.Join(dir, "png", pipeline.HocrImage(base)),
+			colour: originals[name],
+		})
+	}
+	return pages, nil
+}
+
+// makeNested creates binarised and colour PDFs of a book in the
+// nested layout in dir, named after out, returning the names of the
+// PDFs saved. The colour PDF is only created if the original image
+// of every page is found. newPdf should return a new PDF to add the
+// pages to. Any pages in excl are left out.
+func makeNested(dir string, out string, newPdf func() *reportPdf, smaller bool, appendreport bool, excl pipeline.PageExclusions) ([]string, error) {
+	pages, err := nestedPages(dir, excl)
+	if err != nil {
+		return nil, err
+	}
+
+	colour := true
+	for _, pg := range pages {
+		if pg.colour == "" {
+			log.Printf("No original image found for %s, so only creating a binarised PDF\n", pg.hocr)
+			colour = false
+			break
+		}
+	}
+
+	base := strings.TrimSuffix(out, ".pdf")
+	var saved []string
+	for _, kind := range []string{"binarised", "colour"} {
+		if kind == "colour" && !colour {
+			continue
+		}
+		pdf := newPdf()
+		err = pdf.Setup()
+		if err != nil {
+			return saved, fmt.Errorf("Failed to set up PDF: %v", err)
+		}
+		defer pdf.Close()
+		for _, pg := range pages {
+			img := pg.bin
+			if kind == "colour" {
+				img = pg.colour
+			}
+			err = pdf.AddPage(img, pg.hocr, smaller)
+			if err != nil {
+				return saved, fmt.Errorf("Failed to add page %s: %v", pg.hocr, err)
+			}
+		}
+		if appendreport {
+			err = addReport(dir, pdf)
+			if err != nil {
+				return saved, fmt.Errorf("Failed to add report: %v", err)
+			}
+		}
+		fn := base + "." + kind + ".pdf"
+		err = pdf.Save(fn)
+		if err != nil {
+			return saved, fmt.Errorf("Failed to save %s: %v", fn, err)
+		}
+		saved = append(saved, fn)
+	}
+	return saved, nil
+}
+
 // walker walks each hocr file in a directory and adds a page to
-// the pdf for each one.
-func walker(pdf Pdfer, colour, smaller bool) filepath.WalkFunc {
+// the pdf for each one, other than those in excl.
+func walker(pdf Pdfer, colour, smaller bool, excl pipeline.PageExclusions) filepath.WalkFunc {
 	return func(fpath string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -105,7 +430,7 @@ func walker(pdf Pdfer, colour, smaller bool) filepath.WalkFunc {
 		if info.IsDir() {
 			return nil
 		}
-		if path.Ext(fpath) != ".hocr" {
+		if path.Ext(fpath) != ".hocr" || excl.Excluded(fpath) {
 			return nil
 		}
 		return pdf.AddPage(imgPath(fpath, colour), fpath, smaller)
@@ -115,42 +440,138 @@ func walker(pdf Pdfer, colour, smaller bool) filepath.WalkFunc {
 func main() {
 	colour := flag.Bool("c", false, "colour")
 	smaller := flag.Bool("s", false, "smaller")
+	split := flag.Int("split", 0, "split the PDF into volumes of at most this many pages")
+	splitsize := flag.Int("splitsize", 0, "split the PDF into volumes of roughly this many megabytes at most")
+	mintextconf := flag.Float64("mintextconf", 0, "leave words with a lower confidence than this out of the searchable text")
+	appendreport := flag.Bool("appendreport", false, "add pages to the end of the PDF with a confidence graph and summary")
+	scalehocr := flag.Bool("scalehocr", false, "scale hOCR coordinates to the size of each image, if it differs from the image OCRed")
+	dpi := flag.Float64("dpi", 0, "DPI of the images, used to give the pages their true physical size")
+	font := flag.String("font", "", "TrueType font to use for the searchable text, rather than the default")
+	pdfname := flag.String("pdfname", bookpipeline.DefaultPdfName, "template for the name of the PDF if out.pdf isn't given, which can include {book} and {date}")
+	footer := flag.String("footer", "", "text to stamp at the bottom of each page, which can include {date}")
+	cover := flag.Bool("cover", false, "add a cover page with the name of the book, its metadata and the date")
+	stream := flag.Bool("stream", false, "write each page to disk as it is added, rather than building the PDF in memory")
+	columns := flag.Bool("columns", false, "put the searchable text of pages with several columns in reading order, one column after another")
+	exclude := flag.String("exclude", "", "comma separated list of page numbers to leave out of the PDF, as well as any in dir/exclude.txt")
+	layout := flag.String("layout", "auto", "layout of the directory: 'flat', 'nested' (as saved by rescribe), or 'auto' to detect it")
 	flag.Usage = func() {
-		fmt.Fprintln(flag.CommandLine.Output(), usage)
+		fmt.Fprintf(flag.CommandLine.Output(), usage)
 		flag.PrintDefaults()
 	}
 	flag.Parse()
 
-	if flag.NArg() != 2 {
+	if flag.NArg() < 1 || flag.NArg() > 2 {
 		flag.Usage()
 		return
 	}
 
-	pdf := new(bookpipeline.Fpdf)
-	err := pdf.Setup()
+	now := time.Now()
+	bookname := filepath.Base(filepath.Clean(flag.Arg(0)))
+	out := flag.Arg(1)
+	if out == "" {
+		out = bookpipeline.PdfName(*pdfname, bookname, now)
+	}
+
+	var coverlines []string
+	if *cover {
+		var err error
+		coverlines, err = coverLines(flag.Arg(0), bookname, now)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	footertext := strings.ReplaceAll(*footer, "{date}", now.Format("2006-01-02"))
+
+	var dpis pipeline.DPIs
+	dpifn := filepath.Join(flag.Arg(0), pipeline.DPIFile)
+	if _, err := os.Stat(dpifn); err == nil {
+		dpis, err = pipeline.ReadDPIs(dpifn)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if *dpi < 0 {
+		log.Fatalln("Error: -dpi must be a positive number")
+	}
+
+	excl, err := readExclusions(flag.Arg(0), *exclude)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var fontbytes []byte
+	if *font != "" {
+		var err error
+		fontbytes, err = ioutil.ReadFile(*font)
+		if err != nil {
+			log.Fatalln("Error reading font:", err)
+		}
+	}
+
+	newPdf := func() *reportPdf {
+		return &reportPdf{SplitPdf: &bookpipeline.SplitPdf{MaxPages: *split, MaxBytes: *splitsize * 1024 * 1024, MinTextConf: *mintextconf, ScaleHocr: *scalehocr, DPI: *dpi, PageDPI: dpis.Page, Font: fontbytes, Footer: footertext, Cover: coverlines, Stream: *stream, TempDir: filepath.Dir(out), ColumnOrder: *columns}}
+	}
+
+	nested := false
+	switch *layout {
+	case "auto":
+		nested = isNested(flag.Arg(0))
+	case "nested":
+		nested = true
+	case "flat":
+	default:
+		log.Fatalln("Unknown layout", *layout)
+	}
+
+	if nested {
+		saved, err := makeNested(flag.Arg(0), out, newPdf, *smaller, *appendreport, excl)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		for _, fn := range saved {
+			fmt.Println("Saved", fn)
+		}
+		return
+	}
+
+	pdf := newPdf()
+	err = pdf.Setup()
 	if err != nil {
 		log.Fatalln("Failed to set up PDF", err)
 	}
+	// log.Fatalln doesn't run deferred functions, so remove any
+	// temporary file the PDF is streamed to before exiting
+	fatal := func(v ...interface{}) {
+		_ = pdf.Close()
+		log.Fatalln(v...)
+	}
 
 	_, err = os.Stat(path.Join(flag.Arg(0), "best"))
 	if err != nil && !os.IsNotExist(err) {
-		log.Fatalln("Failed to stat best", err)
+		fatal("Failed to stat best", err)
 	}
 
 	if os.IsNotExist(err) {
-		err = filepath.Walk(flag.Arg(0), walker(pdf, *colour, *smaller))
+		err = filepath.Walk(flag.Arg(0), walker(pdf, *colour, *smaller, excl))
 		if err != nil {
-			log.Fatalln("Failed to walk", flag.Arg(0), err)
+			fatal("Failed to walk", flag.Arg(0), err)
 		}
 	} else {
-		err = addBest(flag.Arg(0), pdf, *colour, *smaller)
+		err = addBest(flag.Arg(0), pdf, *colour, *smaller, excl)
+		if err != nil {
+			fatal("Failed to add best pages", err)
+		}
+	}
+
+	if *appendreport {
+		err = addReport(flag.Arg(0), pdf)
 		if err != nil {
-			log.Fatalln("Failed to add best pages", err)
+			fatal("Failed to add report", err)
 		}
 	}
 
-	err = pdf.Save(flag.Arg(1))
+	err = pdf.Save(out)
 	if err != nil {
-		log.Fatalln("Failed to save", flag.Arg(1), err)
+		fatal("Failed to save", out, err)
 	}
 }
@@ -0,0 +1,305 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"rescribe.xyz/bookpipeline"
+	"rescribe.xyz/bookpipeline/internal/pipeline"
+	"rescribe.xyz/pdf"
+)
+
+const testHocr = `<?xml version="1.0" encoding="UTF-8"?>
+<html><body>
+<div class='ocr_page' id='page_1' title='image "page.png"; bbox 0 0 20 20'>
+<div class='ocr_carea' id='block_1_1'><p class='ocr_par' id='par_1_1'>
+<span class='ocr_line' id='line_1_1' title='bbox 0 0 20 10'>
+<span class='ocrx_word' id='word_1_1' title='bbox 0 0 20 10; x_wconf 90'>test</span>
+</span>
+</p></div>
+</div>
+</body></html>
+`
+
+// writeImage saves a blank image to fn, as a JPEG or PNG depending
+// on its extension
+func writeImage(fn string) error {
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	img := image.NewGray(image.Rect(0, 0, 20, 20))
+	if filepath.Ext(fn) == ".png" {
+		return png.Encode(f, img)
+	}
+	return jpeg.Encode(f, img, nil)
+}
+
+func TestNestedPdfs(t *testing.T) {
+	cases := []struct {
+		name      string
+		originals []string
+		expected  []string
+	}{
+		{"colour", []string{"0001.jpg", "page two.png"}, []string{"book.binarised.pdf", "book.colour.pdf"}},
+		{"nocolour", []string{"0001.jpg"}, []string{"book.binarised.pdf"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "pdfbooktest")
+			if err != nil {
+				t.Fatalf("Could not create temporary directory: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			bookdir := filepath.Join(dir, "book")
+			for _, d := range []string{"hocr", "png"} {
+				err = os.MkdirAll(filepath.Join(bookdir, d), 0755)
+				if err != nil {
+					t.Fatalf("Could not create directory: %v", err)
+				}
+			}
+			for _, pg := range []string{"0001_0000_bin0.2", "page_two_0001_bin0.1"} {
+				err = ioutil.WriteFile(filepath.Join(bookdir, "hocr", pg+".hocr"), []byte(testHocr), 0644)
+				if err != nil {
+					t.Fatalf("Could not create hOCR: %v", err)
+				}
+				err = writeImage(filepath.Join(bookdir, "png", pg+".png"))
+				if err != nil {
+					t.Fatalf("Could not create image: %v", err)
+				}
+			}
+			for _, fn := range c.originals {
+				err = writeImage(filepath.Join(bookdir, fn))
+				if err != nil {
+					t.Fatalf("Could not create image: %v", err)
+				}
+			}
+
+			if !isNested(bookdir) {
+				t.Fatalf("Expected %s to be detected as nested", bookdir)
+			}
+
+			newPdf := func() *reportPdf {
+				return &reportPdf{SplitPdf: &bookpipeline.SplitPdf{}}
+			}
+			out := filepath.Join(dir, "book.pdf")
+			saved, err := makeNested(bookdir, out, newPdf, true, false, nil)
+			if err != nil {
+				t.Fatalf("Error making PDFs: %v", err)
+			}
+
+			var names []string
+			for _, fn := range saved {
+				names = append(names, filepath.Base(fn))
+				b, err := ioutil.ReadFile(fn)
+				if err != nil {
+					t.Fatalf("Could not read %s: %v", fn, err)
+				}
+				if !bytes.HasPrefix(b, []byte("%PDF")) {
+					t.Fatalf("Expected %s to be a PDF", fn)
+				}
+			}
+			if strings.Join(names, " ") != strings.Join(c.expected, " ") {
+				t.Fatalf("Expected PDFs %v, got %v", c.expected, names)
+			}
+		})
+	}
+}
+
+func TestNestedPages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pdfbooktest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if isNested(dir) {
+		t.Fatalf("Expected %s not to be detected as nested", dir)
+	}
+
+	err = os.Mkdir(filepath.Join(dir, "hocr"), 0755)
+	if err != nil {
+		t.Fatalf("Could not create directory: %v", err)
+	}
+	for _, fn := range []string{"hocr/a_b_0000_bin0.2.hocr", "hocr/c_0001_bin0.1.hocr", "a b.JPG", "graph.png"} {
+		err = ioutil.WriteFile(filepath.Join(dir, fn), []byte(""), 0644)
+		if err != nil {
+			t.Fatalf("Could not create %s: %v", fn, err)
+		}
+	}
+
+	pages, err := nestedPages(dir, nil)
+	if err != nil {
+		t.Fatalf("Error finding pages: %v", err)
+	}
+	expected := []nestedPage{
+		{filepath.Join(dir, "hocr", "a_b_0000_bin0.2.hocr"), filepath.Join(dir, "png", "a_b_0000_bin0.2.png"), filepath.Join(dir, "a b.JPG")},
+		{filepath.Join(dir, "hocr", "c_0001_bin0.1.hocr"), filepath.Join(dir, "png", "c_0001_bin0.1.png"), ""},
+	}
+	if len(pages) != len(expected) {
+		t.Fatalf("Expected pages %v, got %v", expected, pages)
+	}
+	for i := range expected {
+		if pages[i] != expected[i] {
+			t.Fatalf("Expected page %v, got %v", expected[i], pages[i])
+		}
+	}
+}
+
+// writeWidthImage saves a blank png of width w to fn, so that the page
+// it is used for can be identified by its width
+func writeWidthImage(fn string, w int) error {
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return png.Encode(f, image.NewGray(image.Rect(0, 0, w, 20)))
+}
+
+// TestBestOrder tests that the pages of a PDF follow the page order
+// manifest, with pages not listed after those which are
+func TestBestOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pdfbooktest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	pages := []struct {
+		name  string
+		width int
+	}{
+		{"a_0000_bin0.2", 100},
+		{"b_0001_bin0.2", 200},
+		{"c_0002_bin0.2", 300},
+	}
+	var best []string
+	for _, pg := range pages {
+		err = ioutil.WriteFile(filepath.Join(dir, pg.name+".hocr"), []byte(testHocr), 0644)
+		if err != nil {
+			t.Fatalf("Could not create hOCR: %v", err)
+		}
+		err = writeWidthImage(filepath.Join(dir, pg.name+".png"), pg.width)
+		if err != nil {
+			t.Fatalf("Could not create image: %v", err)
+		}
+		best = append(best, pg.name+".hocr")
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "best"), []byte(strings.Join(best, "\n")+"\n"), 0644)
+	if err != nil {
+		t.Fatalf("Could not create best file: %v", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, pipeline.OrderFile), []byte(`{"c_0002.jpg": 0, "a_0000.jpg": 5}`), 0644)
+	if err != nil {
+		t.Fatalf("Could not create page order manifest: %v", err)
+	}
+
+	p := &reportPdf{SplitPdf: &bookpipeline.SplitPdf{DPI: 72}}
+	err = p.Setup()
+	if err != nil {
+		t.Fatalf("Could not set up PDF: %v", err)
+	}
+	err = addBest(dir, p, false, false, nil)
+	if err != nil {
+		t.Fatalf("Error adding pages: %v", err)
+	}
+	fn := filepath.Join(dir, "book.pdf")
+	err = p.Save(fn)
+	if err != nil {
+		t.Fatalf("Error saving PDF: %v", err)
+	}
+
+	r, err := pdf.Open(fn)
+	if err != nil {
+		t.Fatalf("Could not open PDF: %v", err)
+	}
+	var widths []int
+	for n := 1; n <= r.NumPage(); n++ {
+		box := r.Page(n).V.Key("MediaBox")
+		widths = append(widths, int(box.Index(2).Float64()-box.Index(0).Float64()+0.5))
+	}
+	expected := []int{300, 100, 200}
+	if fmt.Sprint(widths) != fmt.Sprint(expected) {
+		t.Fatalf("Expected pages with widths %v, got %v", expected, widths)
+	}
+}
+
+// TestBestExclude tests that pages given with -exclude, or listed in
+// the book's exclude.txt, are left out of the PDF
+func TestBestExclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pdfbooktest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var best []string
+	for i, name := range []string{"a_0000_bin0.2", "b_0001_bin0.2", "c_0002_bin0.2", "d_0003_bin0.2"} {
+		err = ioutil.WriteFile(filepath.Join(dir, name+".hocr"), []byte(testHocr), 0644)
+		if err != nil {
+			t.Fatalf("Could not create hOCR: %v", err)
+		}
+		err = writeWidthImage(filepath.Join(dir, name+".png"), (i+1)*100)
+		if err != nil {
+			t.Fatalf("Could not create image: %v", err)
+		}
+		best = append(best, name+".hocr")
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "best"), []byte(strings.Join(best, "\n")+"\n"), 0644)
+	if err != nil {
+		t.Fatalf("Could not create best file: %v", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, pipeline.ExcludeFile), []byte("3\n"), 0644)
+	if err != nil {
+		t.Fatalf("Could not create exclusions file: %v", err)
+	}
+
+	excl, err := readExclusions(dir, "0")
+	if err != nil {
+		t.Fatalf("Error reading exclusions: %v", err)
+	}
+	p := &reportPdf{SplitPdf: &bookpipeline.SplitPdf{DPI: 72}}
+	err = p.Setup()
+	if err != nil {
+		t.Fatalf("Could not set up PDF: %v", err)
+	}
+	err = addBest(dir, p, false, false, excl)
+	if err != nil {
+		t.Fatalf("Error adding pages: %v", err)
+	}
+	fn := filepath.Join(dir, "book.pdf")
+	err = p.Save(fn)
+	if err != nil {
+		t.Fatalf("Error saving PDF: %v", err)
+	}
+
+	r, err := pdf.Open(fn)
+	if err != nil {
+		t.Fatalf("Could not open PDF: %v", err)
+	}
+	var widths []int
+	for n := 1; n <= r.NumPage(); n++ {
+		box := r.Page(n).V.Key("MediaBox")
+		widths = append(widths, int(box.Index(2).Float64()-box.Index(0).Float64()+0.5))
+	}
+	expected := []int{200, 300}
+	if fmt.Sprint(widths) != fmt.Sprint(expected) {
+		t.Fatalf("Expected pages with widths %v, got %v", expected, widths)
+	}
+}
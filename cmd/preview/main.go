@@ -0,0 +1,101 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+// preview runs the preprocessing done by the pipeline on a single
+// page image, to help choose preprocessing settings for a book.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"rescribe.xyz/bookpipeline/internal/pipeline"
+)
+
+const usage = `Usage: preview [-k 0.1,0.2] [-nowipe] [-bt type] [-bw size] [-m perc] [-ws size] page.jpg [outdir]
+
+Runs the preprocessing done by the pipeline on a single page image,
+saving the results into outdir, or the current directory if it is
+not specified. This makes it easy to check how well a set of
+preprocessing settings works for a book before processing the whole
+thing.
+
+A binarised version of the page is saved for each threshold given
+with -k, named like page_bin0.1.png. Unless -nowipe is set a wiped
+version of each is saved too, named like page_wiped_bin0.1.png.
+The other settings default to those used by the pipeline.
+`
+
+// floatsFlag is a flag.Value for a comma separated list of numbers
+type floatsFlag []float64
+
+func (f *floatsFlag) String() string {
+	var s []string
+	for _, v := range *f {
+		s = append(s, fmt.Sprintf("%.1f", v))
+	}
+	return strings.Join(s, ",")
+}
+
+func (f *floatsFlag) Set(s string) error {
+	var vals []float64
+	for _, v := range strings.Split(s, ",") {
+		n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return fmt.Errorf("Invalid threshold %s", v)
+		}
+		vals = append(vals, n)
+	}
+	*f = vals
+	return nil
+}
+
+func main() {
+	def := pipeline.DefaultPreprocSettings
+	thresholds := floatsFlag{0.1, 0.2, 0.4, 0.5}
+	flag.Var(&thresholds, "k", "Comma separated list of thresholds to binarise with")
+	nowipe := flag.Bool("nowipe", false, "Only binarise, without wiping")
+	bt := flag.String("bt", def.BinType, "Binarisation type (binary or zeroinv)")
+	bw := flag.Int("bw", def.BinWsize, "Window size for sauvola binarisation, set automatically if 0")
+	m := flag.Int("m", def.WipeMinWidthPerc, "Minimum percentage of the page width for the content width calculation to be considered valid")
+	ws := flag.Int("ws", def.WipeWsize, "Window size for wiping")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 || flag.NArg() > 2 {
+		flag.Usage()
+		return
+	}
+
+	outdir := "."
+	if flag.NArg() == 2 {
+		outdir = flag.Arg(1)
+		err := os.MkdirAll(outdir, 0755)
+		if err != nil {
+			log.Fatalf("Error creating directory %s: %v", outdir, err)
+		}
+	}
+
+	s := def
+	s.BinType = *bt
+	s.BinWsize = *bw
+	s.WipeMinWidthPerc = *m
+	s.WipeWsize = *ws
+
+	done, err := pipeline.Preview(flag.Arg(0), outdir, thresholds, !*nowipe, s)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, fn := range done {
+		fmt.Println(fn)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+// publish copies the final results of a book to another storage
+// bucket.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"rescribe.xyz/bookpipeline"
+
+	"rescribe.xyz/bookpipeline/internal/pipeline"
+	"rescribe.xyz/bookpipeline/internal/postproc"
+)
+
+const usage = `Usage: publish [-c conn] [-prefix prefix] [-textrules file] [-v] [-loglevel level] bucket bookname
+
+Copies the final results of a completed book (the PDFs, the best
+hOCR files, the best file, the confidence graph, the words file, any
+archive of the results and any metadata) to another storage bucket,
+along with the text of each page, leaving the book in the working
+bucket untouched.
+
+The files are copied to a directory named after the book, unless
+-prefix is set.
+
+If -textrules is given, the substitutions in that file are applied to
+the text of each page, as with bookpipeline -textrules. The hOCR is
+unchanged.
+`
+
+type PublishPipeliner interface {
+	MinimalInit() error
+	Copy(srcbucket string, srckey string, dstbucket string, dstkey string) error
+	Download(bucket string, key string, fn string) error
+	ListObjects(bucket string, prefix string) ([]string, error)
+	Log(v ...interface{})
+	Upload(bucket string, key string, path string) error
+	WIPStorageId() string
+}
+
+func main() {
+	verbose := flag.Bool("v", false, "verbose")
+	loglevel := flag.String("loglevel", "", "log only messages at or above this level: error, warn, info or debug")
+	conntype := flag.String("c", "aws", "connection type ('aws' or 'local')")
+	prefix := flag.String("prefix", "", "directory to copy the files to in the bucket (defaults to the book name)")
+	textrules := flag.String("textrules", "", "file of regular expression substitutions to correct the text of each page")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		flag.Usage()
+		return
+	}
+
+	bucket := flag.Arg(0)
+	bookname := flag.Arg(1)
+	if *prefix == "" {
+		*prefix = bookname
+	}
+
+	var rules []postproc.Rule
+	if *textrules != "" {
+		var err error
+		rules, err = postproc.LoadRules(*textrules)
+		if err != nil {
+			log.Fatalln("Error with text rules:", err)
+		}
+	}
+
+	verboselog, err := bookpipeline.VerboseLogger(*verbose, *loglevel, os.Stdout, log.LstdFlags)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var conn PublishPipeliner
+	switch *conntype {
+	case "aws":
+		conn = &bookpipeline.AwsConn{Logger: verboselog}
+	case "local":
+		conn = &bookpipeline.LocalConn{Logger: verboselog}
+	default:
+		log.Fatalln("Unknown connection type")
+	}
+
+	err = conn.MinimalInit()
+	if err != nil {
+		log.Fatalln("Error setting up cloud connection:", err)
+	}
+
+	published, err := pipeline.Publish(conn, bookname, bucket, *prefix, rules)
+	if err != nil {
+		log.Fatalln("Error publishing book:", err)
+	}
+
+	fmt.Printf("Published %d files to %s/%s\n", len(published), bucket, *prefix)
+}
@@ -154,7 +154,7 @@ func getGoogleBook(ctx context.Context, gbookcmd string, id string, basedir stri
 		return "", err
 	}
 
-	tmpdir, err := ioutil.TempDir("", "bookpipeline")
+	tmpdir, err := pipeline.MkTempDir("bookpipeline")
 	if err != nil {
 		return "", fmt.Errorf("Error setting up temporary directory: %v", err)
 	}
@@ -23,6 +23,7 @@ import (
 	"fyne.io/fyne/v2/storage"
 	"fyne.io/fyne/v2/theme"
 	"fyne.io/fyne/v2/widget"
+	"rescribe.xyz/bookpipeline"
 )
 
 var progressPoints = map[float64]string{
@@ -377,8 +378,9 @@ func letsGo(ctx context.Context, log *log.Logger, cmd string, tessdir string, gb
 			return
 		}
 
-		// happens if extractPdfImgs recovers from a PDF panic,
-		// which will occur if we encounter an image we can't decode
+		// happens if extractPdfImgs recovers from a PDF panic on
+		// every page, which will occur if we encounter images we
+		// can't decode
 		if bookdir == "" {
 			msg := fmt.Sprintf("Error opening PDF\nThe format of this PDF is not supported, extract the images to .jpg manually into a\nfolder first, using a tool like the PDF image extractor at https://pdfcandy.com/extract-images.html.\n")
 			dialog.ShowError(errors.New(msg), win)
@@ -402,7 +404,15 @@ func letsGo(ctx context.Context, log *log.Logger, cmd string, tessdir string, gb
 		training = training[start:end]
 	}
 
-	err = startProcess(ctx, log, cmd, bookdir, bookname, training, savedir, tessdir, wipe, bigpdf)
+	opts := processOptions{
+		tessCommand:  cmd,
+		trainingName: training,
+		nowipe:       wipe,
+		fullpdf:      bigpdf,
+		pdfname:      bookpipeline.DefaultPdfName,
+		workers:      1,
+	}
+	err = startProcess(ctx, log, bookdir, bookname, savedir, opts)
 	if err != nil && strings.HasSuffix(err.Error(), "context canceled") {
 		progressBar.SetValue(0.0)
 		return
@@ -0,0 +1,210 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"rescribe.xyz/pdf"
+	"rescribe.xyz/utils/pkg/hocr"
+)
+
+// extractPdfText extracts the embedded text of each page of a PDF,
+// returning a map of page numbers to their text. Pages without any
+// text, or whose text can't be decoded, are left out.
+func extractPdfText(path string) (pages map[int]string, err error) {
+	defer func() {
+		// the pdf library can also panic when opening a PDF it can't
+		// decode, so recover from that and return an error instead
+		r := recover()
+		if r != nil {
+			pages = nil
+			err = fmt.Errorf("Error extracting text from PDF: %v", r)
+		}
+	}()
+
+	p, err := pdf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pages = make(map[int]string)
+	for pgnum := 1; pgnum <= p.NumPage(); pgnum++ {
+		text, err := pdfPageText(p, pgnum)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Only using OCR for page %d, as its embedded text couldn't be read: %v\n", pgnum, err)
+			continue
+		}
+		if strings.TrimSpace(text) != "" {
+			pages[pgnum] = text
+		}
+	}
+	return pages, nil
+}
+
+// pdfPageText returns the embedded text of a page of a PDF
+func pdfPageText(p *pdf.Reader, pgnum int) (text string, err error) {
+	defer func() {
+		// the pdf library will panic if it sees an encoding it can't
+		// decode, so recover from that and return an error instead
+		r := recover()
+		if r != nil {
+			text = ""
+			err = fmt.Errorf("Error extracting text from page %d: %v", pgnum, r)
+		}
+	}()
+
+	pg := p.Page(pgnum)
+	if pg.V.IsNull() {
+		return "", nil
+	}
+	return contentText(pg.Content().Text), nil
+}
+
+// singleImageText returns the embedded text of only the pages which
+// have a single hOCR file in hocrs. The embedded text is of the whole
+// page, so for a page with several images it would otherwise be used
+// for each of them, repeating it.
+func singleImageText(embedded map[int]string, hocrs []string) map[int]string {
+	images := make(map[int]int)
+	for _, fn := range hocrs {
+		pg, ok := pdfPageNum(fn)
+		if ok {
+			images[pg]++
+		}
+	}
+	single := make(map[int]string)
+	for pg, t := range embedded {
+		if images[pg] == 1 {
+			single[pg] = t
+		}
+	}
+	return single
+}
+
+// contentText joins the pieces of text on a PDF page, which are often
+// individual characters, into lines and words, based on their
+// positions
+func contentText(texts []pdf.Text) string {
+	var b strings.Builder
+	for i, t := range texts {
+		if i > 0 {
+			prev := texts[i-1]
+			switch {
+			case math.Abs(t.Y-prev.Y) > prev.FontSize/2:
+				b.WriteString("\n")
+			case t.X > prev.X+prev.W+prev.FontSize/10:
+				b.WriteString(" ")
+			}
+		}
+		b.WriteString(t.S)
+	}
+	return b.String()
+}
+
+// pdfPageNum returns the number of the PDF page an hOCR file is of,
+// from the page number extractPdfImgs gives to the start of the name
+// of each image it extracts.
+func pdfPageNum(hocrfn string) (int, bool) {
+	base := filepath.Base(hocrfn)
+	i := strings.Index(base, "-")
+	if i == -1 {
+		return 0, false
+	}
+	n, err := strconv.Atoi(base[:i])
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// wordlike returns whether a word looks like it was correctly
+// recognised, with only letters, possibly with some punctuation
+// around them, and no capitals after the first letter unless the
+// whole word is capitalised
+func wordlike(w string) bool {
+	w = strings.TrimFunc(w, unicode.IsPunct)
+	if w == "" {
+		return false
+	}
+	for i, r := range w {
+		if !unicode.IsLetter(r) && r != '-' && r != '\'' {
+			return false
+		}
+		if i > 0 && unicode.IsUpper(r) && w != strings.ToUpper(w) {
+			return false
+		}
+	}
+	return true
+}
+
+// embeddedTextScore estimates the quality of the embedded text of a
+// page on the same 0-100 scale as OCR confidence, so they can be
+// compared. It is the proportion of words that look like words,
+// scaled down if the embedded text has fewer words than the OCR
+// found, as poor text layers often only cover part of the page.
+// Anything that contains no letters, such as numbers, is ignored.
+func embeddedTextScore(text string, ocrwords int) float64 {
+	var good, total int
+	for _, w := range strings.Fields(text) {
+		if strings.IndexFunc(w, unicode.IsLetter) == -1 {
+			continue
+		}
+		total++
+		if wordlike(w) {
+			good++
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	score := float64(good) / float64(total) * 100
+	if total < ocrwords {
+		score *= float64(total) / float64(ocrwords)
+	}
+	return score
+}
+
+// countWords returns the number of words containing letters in text
+func countWords(text string) int {
+	n := 0
+	for _, w := range strings.Fields(text) {
+		if strings.IndexFunc(w, unicode.IsLetter) != -1 {
+			n++
+		}
+	}
+	return n
+}
+
+// pageText returns the text of an hOCR file. If embedded contains
+// the text embedded in the PDF for the page, and it scores better
+// with embeddedTextScore than the average confidence of the OCR, the
+// embedded text is returned instead.
+func pageText(hocrfn string, embedded map[int]string) (string, error) {
+	t, err := hocr.GetText(hocrfn)
+	if err != nil {
+		return "", fmt.Errorf("Error getting text from hocr file %s: %v", hocrfn, err)
+	}
+	pg, ok := pdfPageNum(hocrfn)
+	if !ok || embedded[pg] == "" {
+		return t, nil
+	}
+
+	conf, err := hocr.GetAvgConf(hocrfn)
+	if err != nil {
+		// a page with no words is left to the embedded text
+		conf = 0
+	}
+	if embeddedTextScore(embedded[pg], countWords(t)) > conf {
+		return embedded[pg], nil
+	}
+	return t, nil
+}
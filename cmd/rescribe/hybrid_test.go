@@ -0,0 +1,122 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeHocr saves an hOCR file with a single line of words, each
+// with the confidence given
+func writeHocr(path string, conf int, words ...string) error {
+	s := "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<html><body>\n" +
+		"<div class='ocr_page' id='page_1' title='image \"page.png\"; bbox 0 0 1000 1000'>\n" +
+		"<div class='ocr_carea' id='block_1_1'><p class='ocr_par' id='par_1_1'>\n" +
+		"<span class='ocr_line' id='line_1_1' title='bbox 0 0 1000 100'>\n"
+	for i, w := range words {
+		s += fmt.Sprintf("<span class='ocrx_word' id='word_1_%d' title='bbox %d 10 %d 60; x_wconf %d'>%s</span>\n", i+1, i*100, i*100+90, conf, w)
+	}
+	s += "</span>\n</p></div>\n</div>\n</body></html>\n"
+	return ioutil.WriteFile(path, []byte(s), 0644)
+}
+
+func TestHybridText(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rescribehybrid")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ocrwords := []string{"Tbe", "quick", "hrown", "fox", "jumpcd"}
+	var hocrs []string
+	for i := 1; i <= 3; i++ {
+		fn := filepath.Join(dir, fmt.Sprintf("%04d-Im0_%04d_bin0.2.hocr", i, i-1))
+		err = writeHocr(fn, 70, ocrwords...)
+		if err != nil {
+			t.Fatalf("Could not write hOCR: %v", err)
+		}
+		hocrs = append(hocrs, fn)
+	}
+
+	// page 1 has good embedded text, page 2 has none, and page 3
+	// has a poor text layer covering only part of the page
+	embedded := map[int]string{
+		1: "The quick brown\nfox jumped",
+		3: "Th3 qU1ck",
+	}
+
+	cases := []struct {
+		name         string
+		hocr         string
+		embedded     map[int]string
+		usesEmbedded bool
+	}{
+		{"goodembedded", hocrs[0], embedded, true},
+		{"noembedded", hocrs[1], embedded, false},
+		{"poorembedded", hocrs[2], embedded, false},
+		{"nothybrid", hocrs[0], nil, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := pageText(c.hocr, c.embedded)
+			if err != nil {
+				t.Fatalf("Error getting page text: %v", err)
+			}
+			if c.usesEmbedded {
+				if got != embedded[1] {
+					t.Fatalf("Expected embedded text %q, got %q", embedded[1], got)
+				}
+				return
+			}
+			for _, w := range ocrwords {
+				if !strings.Contains(got, w) {
+					t.Fatalf("Expected OCR text, got %q", got)
+				}
+			}
+		})
+	}
+}
+
+func TestSingleImageText(t *testing.T) {
+	embedded := map[int]string{1: "one", 2: "two", 3: "three"}
+	hocrs := []string{
+		"0001-Im0_0000_bin0.2.hocr",
+		"0002-Im0_0001_bin0.2.hocr",
+		"0002-Im1_0002_bin0.2.hocr",
+	}
+	got := singleImageText(embedded, hocrs)
+	if len(got) != 1 || got[1] != "one" {
+		t.Fatalf("Expected only the text of page 1, which has a single image, got %v", got)
+	}
+}
+
+func TestEmbeddedTextScore(t *testing.T) {
+	cases := []struct {
+		name     string
+		text     string
+		ocrwords int
+		expected float64
+	}{
+		{"good", "The quick brown fox", 4, 100},
+		{"capitals", "THE QUICK brown fox", 4, 100},
+		{"garbled", "Th3 qU1ck brown fox", 4, 50},
+		{"partial", "The quick", 4, 50},
+		{"numbers", "The 12 quick 1800", 2, 100},
+		{"empty", "", 4, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := embeddedTextScore(c.text, c.ocrwords)
+			if got != c.expected {
+				t.Fatalf("Expected score %.1f, got %.1f", c.expected, got)
+			}
+		})
+	}
+}
@@ -13,10 +13,9 @@ import (
 	"archive/zip"
 	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"image"
-	"image/draw"
 	"image/jpeg"
 	"image/png"
 	"io"
@@ -24,39 +23,83 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"runtime"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"golang.org/x/image/tiff"
 	"rescribe.xyz/bookpipeline"
 	"rescribe.xyz/bookpipeline/internal/pipeline"
+	"rescribe.xyz/bookpipeline/internal/postproc"
 	"rescribe.xyz/pdf"
-	"rescribe.xyz/utils/pkg/hocr"
 )
 
-const usage = `Usage: rescribe [-v] [-gui] [-systess] [-tesscmd cmd] [-gbookcmd cmd] [-t training] bookdir/book.pdf [savedir]
+const usage = `Usage: rescribe [-v] [-loglevel level] [-gui] [-systess] [-tesscmd cmd] [-gbookcmd cmd] [-t training] [-keepallpdfs] [-keepalternatives] [-mode mode] [-textrules file] [-hybrid] [-pdfname template] [-workers n] [-tmpdir dir] [-watch] bookdir/book.pdf [savedir]
 
 Process and OCR a book using the Rescribe pipeline on a local machine.
 
 OCR results are saved into the bookdir directory unless savedir is
-specified.
+specified. Once finished a short summary of the results is printed,
+including the average confidence and the lowest confidence pages.
+
+The searchable PDF is named using the -pdfname template, in which
+{book} is replaced with the book name and {date} with the current
+date. Any spaces in the book name are replaced with underscores.
+
+With -keepalternatives the hOCR of every version of each page, one
+for each binarisation threshold, is also saved in an alternatives
+directory, so that another version can be consulted when the best
+one is wrong.
+
+With -textrules the substitutions in that file are applied to the
+text files, to correct errors the OCR makes systematically, like
+reading a long s as an f. Each line of the file is a regular
+expression and its replacement, separated by a tab, and lines
+starting with # are ignored. The hOCR and PDF are unchanged.
+
+With -hybrid, when OCRing a PDF which already has some text embedded
+in it, the embedded text of each page is compared to the OCR, and is
+used for the text files instead if it looks better than the OCR is
+confident. This is useful for PDFs with a partial or poor text layer.
+The hOCR and PDF always use the OCR, as do pages made up of several
+images, since the embedded text can't be divided between them.
+
+The processing each book needs is detected from its images, unless
+it is given with -mode, which can be 'preprocess' (binarise and
+wipe), 'wipeonly' (for prebinarised books), 'nowipe' (binarise
+without wiping) or 'colour' (OCR each page in greyscale, without
+binarising or wiping). The -wipe flag is ignored if -mode is set.
+
+With -watch, bookdir is an inbox directory which is watched for new
+books. Each book directory which appears in it is processed once its
+files have stopped changing for a few seconds, and then moved into
+savedir, or into a 'done' directory inside the inbox if savedir isn't
+given, with the results saved alongside it. Any book which fails is
+left unchanged in the inbox, and is tried again if it changes.
+This continues until rescribe is stopped.
+
+Temporary files are saved in the system temporary directory, which is
+$TMPDIR if it is set, unless another directory is given with -tmpdir.
+It is created if it doesn't exist.
 `
 
 const QueueTimeoutSecs = 2 * 60
-const PauseBetweenChecks = 1 * time.Second
 const LogSaveTime = 1 * time.Minute
 
-var thresholds = []float64{0.1, 0.2, 0.3}
+// PauseBetweenChecks is how long to wait before checking a queue
+// again after finding it empty
+var PauseBetweenChecks = 1 * time.Second
 
-// null writer to enable non-verbose logging to be discarded
-type NullWriter bool
+// QuietTime is how long all workers must be idle, with every queue
+// empty, before processing of a book is considered finished
+var QuietTime = 1 * time.Second
 
-func (w NullWriter) Write(p []byte) (n int, err error) {
-	return len(p), nil
-}
+var thresholds = []float64{0.1, 0.2, 0.3}
 
 type Clouder interface {
 	Init() error
@@ -78,6 +121,7 @@ type Pipeliner interface {
 	OCRPageQueueId() string
 	AnalyseQueueId() string
 	WIPStorageId() string
+	GetQueueDetails(url string) (string, string, error)
 	GetLogger() *log.Logger
 	Log(v ...interface{})
 }
@@ -146,6 +190,7 @@ func main() {
 	}
 
 	verbose := flag.Bool("v", false, "verbose")
+	loglevel := flag.String("loglevel", "", "log only messages at or above this level: error, warn, info or debug")
 	usegui := flag.Bool("gui", false, "Use graphical user interface")
 	systess := flag.Bool("systess", false, "Use the system installed Tesseract, rather than the copy embedded in rescribe.")
 	training := flag.String("t", "rescribev9_fast.traineddata", `Path to the tesseract training file to use.
@@ -158,6 +203,17 @@ These training files are included in rescribe, and are always available:
 	tesscmd := flag.String("tesscmd", deftesscmd, "The Tesseract executable to run. You may need to set this to the full path of Tesseract.exe if you're on Windows.")
 	wipe := flag.Bool("wipe", false, "Use wiper tool to remove noise like gutters from page before processing.")
 	fullpdf := flag.Bool("fullpdf", false, "Use highest image quality for searchable PDF (requires lots of RAM).")
+	keepallpdfs := flag.Bool("keepallpdfs", false, "Keep both the colour and binarised PDFs, as book.colour.pdf and book.binarised.pdf, rather than just one searchable PDF.")
+	keepalternatives := flag.Bool("keepalternatives", false, "Also save the hOCR of every version of each page, not just the best, in an alternatives directory.")
+	mode := flag.String("mode", "", "Processing mode, bypassing autodetection: 'preprocess', 'wipeonly', 'nowipe' or 'colour'.")
+	textrules := flag.String("textrules", "", "File of regular expression substitutions to correct the text files with.")
+	hybrid := flag.Bool("hybrid", false, "Use the text embedded in a PDF for the text files of any pages where it looks better than the OCR.")
+	pdfname := flag.String("pdfname", bookpipeline.DefaultPdfName, "Template for the name of the searchable PDF, which can include {book} and {date}.")
+	tmpdir := flag.String("tmpdir", "", "Directory to save temporary files in, which should have plenty of space for large books. Defaults to $TMPDIR or the system temporary directory.")
+	workers := flag.Int("workers", 1, "Number of pages to process at once. Setting this to the number of processor cores can make processing large books much faster, at the expense of more memory use.")
+	watch := flag.Bool("watch", false, "Watch bookdir for new book directories, processing each as it appears and then moving it to savedir.")
+	flag.DurationVar(&PauseBetweenChecks, "checkinterval", PauseBetweenChecks, "How long to wait before checking an empty queue again.")
+	flag.DurationVar(&QuietTime, "quiettime", QuietTime, "How long processing must be idle, with every queue empty, before a book is considered finished. Increase this if processing stops before a book is finished, for example on a slow disk.")
 
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), usage)
@@ -172,19 +228,29 @@ These training files are included in rescribe, and are always available:
 
 	var err error
 
-	var verboselog *log.Logger
-	if *verbose {
-		verboselog = log.New(os.Stdout, "", 0)
-	} else {
-		var n NullWriter
-		verboselog = log.New(n, "", 0)
+	verboselog, err := bookpipeline.VerboseLogger(*verbose, *loglevel, os.Stdout, 0)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	err = pipeline.SetTempDir(*tmpdir)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var rules []postproc.Rule
+	if *textrules != "" {
+		rules, err = postproc.LoadRules(*textrules)
+		if err != nil {
+			log.Fatalln(err)
+		}
 	}
 
 	tessdir := ""
 	trainingPath := *training
 	tessCommand := *tesscmd
 
-	tessdir, err = ioutil.TempDir("", "tesseract")
+	tessdir, err = pipeline.MkTempDir("tesseract")
 	if err != nil {
 		log.Fatalln("Error setting up tesseract directory:", err)
 	}
@@ -318,24 +384,89 @@ These training files are included in rescribe, and are always available:
 		log.Fatalln("Error opening book file/dir:", err)
 	}
 
-	var ctx context.Context
-	ctx = context.Background()
+	// On being asked to stop, cancel processing, so that temporary
+	// files are cleaned up before exiting.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigc
+		fmt.Println("\nStopping, and removing temporary files")
+		cancel()
+	}()
+
+	// cleanup removes the temporary directories used
+	cleanup := func(pdfdir string) {
+		err := os.RemoveAll(tessdir)
+		if err != nil {
+			log.Printf("Error removing tesseract directory %s: %v", tessdir, err)
+		}
+		if pdfdir != "" {
+			_ = os.RemoveAll(filepath.Clean(filepath.Join(pdfdir, "..")))
+		}
+	}
+
+	opts := processOptions{
+		tessCommand:      tessCommand,
+		trainingName:     trainingName,
+		nowipe:           !*wipe,
+		mode:             *mode,
+		fullpdf:          *fullpdf,
+		keepallpdfs:      *keepallpdfs,
+		keepalternatives: *keepalternatives,
+		pdfname:          *pdfname,
+		rules:            rules,
+		workers:          *workers,
+	}
+
+	if *watch {
+		if !fi.IsDir() {
+			cleanup("")
+			log.Fatalln("Error: -watch needs a directory to watch")
+		}
+		donedir := filepath.Join(bookdir, "done")
+		if flag.NArg() > 1 {
+			donedir = flag.Arg(1)
+		}
+		process := func(ctx context.Context, dir string, savedir string) error {
+			name := strings.ReplaceAll(filepath.Base(dir), " ", "_")
+			return startProcess(ctx, verboselog, dir, name, savedir, opts)
+		}
+		fmt.Printf("Watching %s for new books, which will be moved to %s once processed\n", bookdir, donedir)
+		err = pipeline.WatchDir(ctx, bookdir, pipeline.WatchOptions{Done: donedir}, process, verboselog)
+		cleanup("")
+		if err != nil && err != context.Canceled {
+			log.Fatalln(err)
+		}
+		return
+	}
 
 	// TODO: support google book downloading, as done with the GUI
 
 	// try opening as a PDF, and extracting
+	var embedded map[int]string
 	if !fi.IsDir() {
 		if flag.NArg() < 2 {
 			savedir = strings.TrimSuffix(bookdir, ".pdf")
 		}
 
+		if *hybrid {
+			embedded, err = extractPdfText(bookdir)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: Only using OCR, as the embedded text couldn't be read: %v\n", err)
+			}
+		}
+
 		bookdir, err = extractPdfImgs(ctx, bookdir)
 		if err != nil {
+			cleanup(bookdir)
 			log.Fatalln("Error opening file as PDF:", err)
 		}
 		// if this occurs then extractPdfImgs() will have recovered from
-		// a panic in the pdf package
+		// a panic in the pdf package on opening the PDF or on every page
 		if bookdir == "" {
+			cleanup("")
 			log.Fatalln("Error opening file as PDF: image type not supported, you will need to extract images manually.")
 		}
 
@@ -344,25 +475,24 @@ These training files are included in rescribe, and are always available:
 		ispdf = true
 	}
 
-	err = startProcess(ctx, verboselog, tessCommand, bookdir, bookname, trainingName, savedir, tessdir, !*wipe, *fullpdf)
-	if err != nil {
-		log.Fatalln(err)
-	}
-
-	if !*systess {
-		err = os.RemoveAll(tessdir)
-		if err != nil {
-			log.Printf("Error removing tesseract directory %s: %v", tessdir, err)
-		}
+	pdfdir := ""
+	if ispdf {
+		pdfdir = bookdir
 	}
 
-	if ispdf {
-		os.RemoveAll(filepath.Clean(filepath.Join(bookdir, "..")))
+	opts.embedded = embedded
+	err = startProcess(ctx, verboselog, bookdir, bookname, savedir, opts)
+	cleanup(pdfdir)
+	if err != nil {
+		log.Fatalln(err)
 	}
 }
 
 // extractPdfImgs extracts all images embedded in a PDF to a
-// temporary directory, which is returned on success.
+// temporary directory, which is returned on success. Any page which
+// the pdf library can't decode is skipped with a warning, and if no
+// images could be extracted from any page because of that an empty
+// directory name is returned.
 func extractPdfImgs(ctx context.Context, path string) (string, error) {
 	defer func() {
 		// unfortunately the pdf library will panic if it sees an encoding
@@ -380,86 +510,130 @@ func extractPdfImgs(ctx context.Context, path string) (string, error) {
 
 	bookname := strings.TrimSuffix(filepath.Base(path), ".pdf")
 
-	tempdir, err := ioutil.TempDir("", "bookpipeline")
+	basedir, err := pipeline.MkTempDir("bookpipeline")
 	if err != nil {
 		return "", fmt.Errorf("Error setting up temporary directory: %v", err)
 	}
-	tempdir = filepath.Join(tempdir, bookname)
+	tempdir := filepath.Join(basedir, bookname)
 	err = os.Mkdir(tempdir, 0755)
 	if err != nil {
 		return "", fmt.Errorf("Error setting up temporary directory: %v", err)
 	}
 
+	skipped := 0
 	for pgnum := 1; pgnum <= p.NumPage(); pgnum++ {
 		select {
 		case <-ctx.Done():
+			_ = os.RemoveAll(basedir)
 			return "", ctx.Err()
 		default:
 		}
-		if p.Page(pgnum).V.IsNull() {
+		err = extractPdfPageImgs(p, pgnum, tempdir)
+		if errors.Is(err, errPdfUnsupported) {
+			fmt.Fprintf(os.Stderr, "Warning: Skipping page %d of PDF: %v\n", pgnum, err)
+			skipped++
 			continue
 		}
-		var rotate int64
-		for v := p.Page(pgnum).V; !v.IsNull(); v = v.Key("Parent") {
-			if r := v.Key("Rotate"); !r.IsNull() {
-				rotate = r.Int64()
-			}
-		}
-		res := p.Page(pgnum).Resources()
-		if res.Kind() != pdf.Dict {
-			continue
-		}
-		xobj := res.Key("XObject")
-		if xobj.Kind() != pdf.Dict {
-			continue
-		}
-		// BUG: for some PDFs this includes images multiple times for each page
-		for _, k := range xobj.Keys() {
-			obj := xobj.Key(k)
-			if obj.Kind() != pdf.Stream {
-				continue
-			}
-
-			fn := fmt.Sprintf("%04d-%s.jpg", pgnum, k)
-			path := filepath.Join(tempdir, fn)
-			w, err := os.Create(path)
-			defer w.Close()
-			if err != nil {
-				return tempdir, fmt.Errorf("Error creating file to extract PDF image: %v\n", err)
-			}
-			r := obj.Reader()
-			defer r.Close()
-			_, err = io.Copy(w, r)
-			if err != nil {
-				return tempdir, fmt.Errorf("Error writing extracted image %s from PDF: %v\n", fn, err)
-			}
-			w.Close()
-			r.Close()
-
-			err = rmIfNotImage(path)
-			if err != nil {
-				return tempdir, fmt.Errorf("Error removing extracted image %s from PDF: %v\n", fn, err)
-			}
-
-			if rotate != 0 {
-				err = rotateImage(path, rotate)
-				if err != nil {
-					return tempdir, fmt.Errorf("Error rotating extracted image %s from PDF: %v\n", fn, err)
-				}
-			}
+		if err != nil {
+			return tempdir, err
 		}
 	}
 	// TODO: check for places where there are multiple images per page, and only keep largest ones where that's the case
 
 	select {
 	case <-ctx.Done():
+		_ = os.RemoveAll(basedir)
 		return "", ctx.Err()
 	default:
 	}
 
+	if skipped > 0 {
+		imgs, err := ioutil.ReadDir(tempdir)
+		if err == nil && len(imgs) == 0 {
+			_ = os.RemoveAll(basedir)
+			return "", nil
+		}
+	}
+
 	return tempdir, nil
 }
 
+// errPdfUnsupported is returned by extractPdfPageImgs if the pdf
+// library panicked while reading a page.
+var errPdfUnsupported = errors.New("unsupported PDF encoding")
+
+// extractPdfPageImgs extracts the images embedded in a page of a PDF
+// to dir. The pdf library will panic if it sees an encoding it can't
+// decode, so that is recovered from, any images already extracted
+// from the page are removed, and errPdfUnsupported is returned, so
+// that the rest of the PDF can still be extracted.
+func extractPdfPageImgs(p *pdf.Reader, pgnum int, dir string) (err error) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			partial, _ := filepath.Glob(filepath.Join(dir, fmt.Sprintf("%04d-*", pgnum)))
+			for _, path := range partial {
+				_ = os.Remove(path)
+			}
+			err = fmt.Errorf("%w: %v", errPdfUnsupported, r)
+		}
+	}()
+
+	if p.Page(pgnum).V.IsNull() {
+		return nil
+	}
+	var rotate int64
+	for v := p.Page(pgnum).V; !v.IsNull(); v = v.Key("Parent") {
+		if r := v.Key("Rotate"); !r.IsNull() {
+			rotate = r.Int64()
+		}
+	}
+	res := p.Page(pgnum).Resources()
+	if res.Kind() != pdf.Dict {
+		return nil
+	}
+	xobj := res.Key("XObject")
+	if xobj.Kind() != pdf.Dict {
+		return nil
+	}
+	// BUG: for some PDFs this includes images multiple times for each page
+	for _, k := range xobj.Keys() {
+		obj := xobj.Key(k)
+		if obj.Kind() != pdf.Stream {
+			continue
+		}
+
+		fn := fmt.Sprintf("%04d-%s.jpg", pgnum, k)
+		path := filepath.Join(dir, fn)
+		w, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("Error creating file to extract PDF image: %v\n", err)
+		}
+		defer w.Close()
+		r := obj.Reader()
+		defer r.Close()
+		_, err = io.Copy(w, r)
+		if err != nil {
+			return fmt.Errorf("Error writing extracted image %s from PDF: %v\n", fn, err)
+		}
+		w.Close()
+		r.Close()
+
+		err = rmIfNotImage(path)
+		if err != nil {
+			return fmt.Errorf("Error removing extracted image %s from PDF: %v\n", fn, err)
+		}
+
+		if rotate != 0 {
+			err = pipeline.RotateImage(path, rotate)
+			if err != nil {
+				return fmt.Errorf("Error rotating extracted image %s from PDF: %v\n", fn, err)
+			}
+		}
+	}
+	return nil
+}
+
 // rmIfNotImage attempts to decode a given file as an image. If it is
 // decode-able as PNG, then rename file extension from .jpg to .png,
 // if it is decode-able as TIFF then convert to PNG and rename file
@@ -527,93 +701,23 @@ func rmIfNotImage(f string) error {
 	return nil
 }
 
-// rotateImage rotates an image at the given path by the given angle
-func rotateImage(path string, angle int64) error {
-	switch angle {
-	case 90:
-		// proceed with the rest of the function
-	case 180, 270:
-		// rotate the image again first, as many times as necessary.
-		// this is inefficient but easy.
-		err := rotateImage(path, angle-90)
-		if err != nil {
-			return fmt.Errorf("error with a rotation run: %w", err)
-		}
-	default:
-		return fmt.Errorf("Rotation angle of %d is not supported", angle)
-	}
-
-	r, err := os.Open(path)
-	defer r.Close()
-	if err != nil {
-		return fmt.Errorf("Failed to open image: %w", err)
-	}
-	img, err := png.Decode(r)
-	if err != nil {
-		r.Close()
-		r, err = os.Open(path)
-		defer r.Close()
-		if err != nil {
-			return fmt.Errorf("Failed to open image: %w", err)
-		}
-		img, err = jpeg.Decode(r)
-	}
-	if err != nil {
-		r.Close()
-		r, err = os.Open(path)
-		defer r.Close()
-		if err != nil {
-			return fmt.Errorf("Failed to open image: %w", err)
-		}
-		img, err = tiff.Decode(r)
-	}
-	if err != nil {
-		return fmt.Errorf("Failed to decode image as png, jpeg or tiff: %w", err)
-	}
-
-	b := img.Bounds()
-
-	orig := image.NewRGBA(b)
-	draw.Draw(orig, b, img, b.Min, draw.Src)
-
-	newb := image.Rectangle{
-		Min: image.Point{X: 0, Y: 0},
-		Max: image.Point{X: b.Dy(), Y: b.Dx()},
-	}
-	new := image.NewRGBA(newb)
-
-	for x := b.Min.X; x < b.Max.X; x++ {
-		desty := newb.Min.Y + x
-		for y := b.Max.Y; y > b.Min.Y; y-- {
-			destx := b.Dy() - y + newb.Min.X
-			new.SetRGBA(destx, desty, orig.RGBAAt(x, y))
-		}
-	}
-
-	err = r.Close()
-	if err != nil {
-		return fmt.Errorf("Failed to close image: %w", err)
-	}
-	w, err := os.Create(path)
-	if err != nil {
-		return fmt.Errorf("Failed to create rotated image: %w", err)
-	}
-	defer w.Close()
-
-	if !strings.HasSuffix(path, ".jpg") {
-		err = jpeg.Encode(w, new, nil)
-	} else {
-		err = png.Encode(w, new)
-	}
-	if err != nil {
-		return fmt.Errorf("Failed to encode rotated image: %w", err)
-	}
-
-	return nil
+// processOptions are the settings startProcess processes a book with
+type processOptions struct {
+	tessCommand      string // tesseract command to run
+	trainingName     string // training to OCR with
+	nowipe           bool   // don't wipe the sides of each page
+	mode             string // preprocessing mode, see uploadbook
+	fullpdf          bool   // save a PDF with the original images
+	keepallpdfs      bool   // keep every PDF rather than just one
+	keepalternatives bool   // keep the alternative versions of each page
+	pdfname          string // name of the PDF, see bookpipeline.PdfName
+	rules            []postproc.Rule
+	embedded         map[int]string // text embedded in a PDF, by page
+	workers          int
 }
 
-func startProcess(ctx context.Context, logger *log.Logger, tessCommand string, bookdir string, bookname string, trainingName string, savedir string, tessdir string, nowipe bool, fullpdf bool) error {
-	cmd := exec.Command(tessCommand, "--help")
+func startProcess(ctx context.Context, logger *log.Logger, bookdir string, bookname string, savedir string, opts processOptions) error {
+	cmd := exec.Command(opts.tessCommand, "--help")
 	pipeline.HideCmd(cmd)
 	_, err := cmd.Output()
 	if err != nil {
@@ -625,10 +729,13 @@ func startProcess(ctx context.Context, logger *log.Logger, tessCommand string, b
 		return fmt.Errorf(errmsg)
 	}
 
-	tempdir, err := ioutil.TempDir("", "bookpipeline")
+	tempdir, err := pipeline.MkTempDir("bookpipeline")
 	if err != nil {
 		return fmt.Errorf("Error setting up temporary directory: %v", err)
 	}
+	// ensure the temporary directory is removed however processing
+	// ends, including if it is cancelled
+	defer os.RemoveAll(tempdir)
 
 	var conn Pipeliner
 	conn = &bookpipeline.LocalConn{Logger: logger, TempDir: tempdir}
@@ -642,16 +749,14 @@ func startProcess(ctx context.Context, logger *log.Logger, tessCommand string, b
 
 	fmt.Printf("Copying book to pipeline\n")
 
-	err = uploadbook(ctx, bookdir, bookname, conn, nowipe)
+	err = uploadbook(ctx, bookdir, bookname, conn, opts.nowipe, opts.mode, opts.workers)
 	if err != nil {
-		_ = os.RemoveAll(tempdir)
 		return fmt.Errorf("Error uploading book: %v", err)
 	}
 
 	fmt.Printf("Processing book\n")
-	err = processbook(ctx, trainingName, tessCommand, conn, fullpdf)
+	err = processbook(ctx, opts.trainingName, opts.tessCommand, conn, opts.fullpdf, opts.workers)
 	if err != nil {
-		_ = os.RemoveAll(tempdir)
 		return fmt.Errorf("Error processing book: %v", err)
 	}
 
@@ -660,9 +765,8 @@ func startProcess(ctx context.Context, logger *log.Logger, tessCommand string, b
 	if err != nil {
 		return fmt.Errorf("Error creating save directory %s: %v", savedir, err)
 	}
-	err = downloadbook(savedir, bookname, conn)
+	err = downloadbook(ctx, savedir, bookname, conn, opts.keepalternatives)
 	if err != nil {
-		_ = os.RemoveAll(tempdir)
 		return fmt.Errorf("Error saving book: %v", err)
 	}
 
@@ -676,13 +780,15 @@ func startProcess(ctx context.Context, logger *log.Logger, tessCommand string, b
 		return fmt.Errorf("Error looking for .hocr files: %v", err)
 	}
 
-	err = addFullTxt(hocrs, bookname)
+	embedded := singleImageText(opts.embedded, hocrs)
+
+	err = addFullTxt(hocrs, bookname, opts.rules, embedded)
 	if err != nil {
 		log.Fatalf("Error creating full txt version: %v", err)
 	}
 
 	for _, v := range hocrs {
-		err = addTxtVersion(v)
+		err = addTxtVersion(v, opts.rules, embedded)
 		if err != nil {
 			log.Fatalf("Error creating txt version of %s: %v", v, err)
 		}
@@ -697,7 +803,7 @@ func startProcess(ctx context.Context, logger *log.Logger, tessCommand string, b
 			log.Fatalf("Error moving hocr %s to hocr directory: %v", v, err)
 		}
 
-		pngname := strings.Replace(v, ".hocr", ".png", 1)
+		pngname := pipeline.HocrImage(v)
 		err = os.MkdirAll(filepath.Join(savedir, "png"), 0755)
 		if err != nil {
 			log.Fatalf("Error creating png directory: %v", err)
@@ -710,20 +816,72 @@ func startProcess(ctx context.Context, logger *log.Logger, tessCommand string, b
 
 	}
 
-	// For simplicity, remove .binarised.pdf and rename .colour.pdf to .pdf
-	// providing they both exist, otherwise just rename whichever exists
-	// to .pdf.
+	pdfname := bookpipeline.PdfName(opts.pdfname, bookname, time.Now())
+	err = finalisePdfs(savedir, bookname, pdfname, opts.fullpdf, opts.keepallpdfs)
+	if err != nil {
+		return err
+	}
+
+	summary, err := bookSummary(savedir, bookname, pdfname)
+	if err != nil {
+		// the book is saved, so just note the problem rather than failing
+		fmt.Printf("Could not summarise the results: %v\n", err)
+		return nil
+	}
+	fmt.Printf("Finished processing book\n")
+	for _, l := range summary {
+		fmt.Printf("  %s\n", l)
+	}
+
+	return nil
+}
+
+// bookSummary returns a short summary of a book saved in savedir,
+// as lines of text, listing the number of pages, the average
+// confidence, the lowest confidence pages, and the paths of the
+// results. The confidences are read from the conf and best files
+// created by Analyse.
+func bookSummary(savedir string, bookname string, pdfname string) ([]string, error) {
+	confs, err := pipeline.ReadBestConfs(savedir)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := bookpipeline.ConfSummary(confs)
+
+	lines = append(lines, "Results saved to:")
+	for _, fn := range []string{pdfname, bookname + ".txt", "text", "hocr", "png"} {
+		path := filepath.Join(savedir, fn)
+		_, err = os.Stat(path)
+		if err == nil {
+			lines = append(lines, "    "+path)
+		}
+	}
+
+	return lines, nil
+}
+
+// finalisePdfs tidies up the PDFs downloaded to savedir. For
+// simplicity, .binarised.pdf is removed and .colour.pdf renamed to
+// pdfname providing they both exist, otherwise whichever exists is
+// renamed. If keepall is set, both are kept with their original names
+// instead.
+func finalisePdfs(savedir string, bookname string, pdfname string, fullpdf bool, keepall bool) error {
 	binpath := filepath.Join(savedir, bookname+".binarised.pdf")
 	colourpath := filepath.Join(savedir, bookname+".colour.pdf")
 	fullsizepath := filepath.Join(savedir, bookname+".original.pdf")
-	pdfpath := filepath.Join(savedir, bookname+" searchable.pdf")
+	pdfpath := filepath.Join(savedir, pdfname)
 
 	// If full size pdf is requested, replace colour.pdf with it
 	if fullpdf {
 		_ = os.Rename(fullsizepath, colourpath)
 	}
 
-	_, err = os.Stat(binpath)
+	if keepall {
+		return nil
+	}
+
+	_, err := os.Stat(binpath)
 	binexists := err == nil || os.IsExist(err)
 	_, err = os.Stat(colourpath)
 	colourexists := err == nil || os.IsExist(err)
@@ -740,16 +898,16 @@ func startProcess(ctx context.Context, logger *log.Logger, tessCommand string, b
 	return nil
 }
 
-func addTxtVersion(hocrfn string) error {
+func addTxtVersion(hocrfn string, rules []postproc.Rule, embedded map[int]string) error {
 	dir := filepath.Dir(hocrfn)
 	err := os.MkdirAll(filepath.Join(dir, "text"), 0755)
 	if err != nil {
 		log.Fatalf("Error creating text directory: %v", err)
 	}
 
-	t, err := hocr.GetText(hocrfn)
+	t, err := pageText(hocrfn, embedded)
 	if err != nil {
-		return fmt.Errorf("Error getting text from hocr file %s: %v", hocrfn, err)
+		return err
 	}
 
 	basefn := filepath.Base(hocrfn)
@@ -758,7 +916,7 @@ func addTxtVersion(hocrfn string) error {
 	}
 	fn := filepath.Join(dir, "text", basefn+".txt")
 
-	err = ioutil.WriteFile(fn, []byte(t), 0644)
+	err = ioutil.WriteFile(fn, []byte(postproc.ApplyRules(t, rules)), 0644)
 	if err != nil {
 		return fmt.Errorf("Error creating text file %s: %v", fn, err)
 	}
@@ -766,15 +924,15 @@ func addTxtVersion(hocrfn string) error {
 	return nil
 }
 
-func addFullTxt(hocrs []string, bookname string) error {
+func addFullTxt(hocrs []string, bookname string, rules []postproc.Rule, embedded map[int]string) error {
 	if len(hocrs) == 0 {
 		return nil
 	}
 	var full string
 	for i, v := range hocrs {
-		t, err := hocr.GetText(v)
+		t, err := pageText(v, embedded)
 		if err != nil {
-			return fmt.Errorf("Error getting text from hocr file %s: %v", v, err)
+			return err
 		}
 		if i > 0 {
 			full += "\n"
@@ -784,7 +942,7 @@ func addFullTxt(hocrs []string, bookname string) error {
 
 	dir := filepath.Dir(hocrs[0])
 	fn := filepath.Join(dir, bookname+".txt")
-	err := ioutil.WriteFile(fn, []byte(full), 0644)
+	err := ioutil.WriteFile(fn, []byte(postproc.ApplyRules(full, rules)), 0644)
 	if err != nil {
 		return fmt.Errorf("Error creating text file %s: %v", fn, err)
 	}
@@ -792,12 +950,22 @@ func addFullTxt(hocrs []string, bookname string) error {
 	return nil
 }
 
-func uploadbook(ctx context.Context, dir string, name string, conn Pipeliner, nowipe bool) error {
-	_, err := os.Stat(dir)
+func uploadbook(ctx context.Context, dir string, name string, conn Pipeliner, nowipe bool, mode string, workers int) error {
+	job := pipeline.JobMsg{Bookname: name}
+	qid := ""
+	var err error
+	if mode != "" {
+		qid, err = pipeline.ModeQueue(mode, conn, &job)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = os.Stat(dir)
 	if err != nil && !os.IsExist(err) {
 		return fmt.Errorf("Error: directory %s not found", dir)
 	}
-	err = pipeline.CheckImages(ctx, dir)
+	err = pipeline.CheckImages(ctx, dir, workers)
 	if err != nil {
 		return fmt.Errorf("Error with images in %s: %v", dir, err)
 	}
@@ -806,10 +974,12 @@ func uploadbook(ctx context.Context, dir string, name string, conn Pipeliner, no
 		return fmt.Errorf("Error saving images to process from %s: %v", dir, err)
 	}
 
-	qid := pipeline.DetectQueueType(dir, conn, nowipe)
+	if qid == "" {
+		qid = pipeline.DetectQueueType(dir, conn, nowipe)
+	}
 	fmt.Printf("Uploading to queue %s\n", qid)
 
-	err = conn.AddToQueue(qid, name)
+	err = conn.AddToQueue(qid, job.String())
 	if err != nil {
 		return fmt.Errorf("Error adding book job to queue %s: %v", qid, err)
 	}
@@ -817,31 +987,90 @@ func uploadbook(ctx context.Context, dir string, name string, conn Pipeliner, no
 	return nil
 }
 
-func downloadbook(dir string, name string, conn Pipeliner) error {
-	err := pipeline.DownloadBestPages(dir, name, conn)
+func downloadbook(ctx context.Context, dir string, name string, conn Pipeliner, keepalternatives bool) error {
+	err := pipeline.DownloadBestPages(ctx, dir, name, conn)
 	if err != nil {
 		return fmt.Errorf("No images found")
 	}
 
-	err = pipeline.DownloadBestPngs(dir, name, conn)
+	err = pipeline.DownloadBestPngs(ctx, dir, name, conn)
 	if err != nil {
 		return fmt.Errorf("No images found")
 	}
 
-	err = pipeline.DownloadPdfs(dir, name, conn)
+	err = pipeline.DownloadPdfs(ctx, dir, name, conn, pipeline.PdfBoth)
 	if err != nil {
 		return fmt.Errorf("Error downloading PDFs: %v", err)
 	}
 
-	err = pipeline.DownloadAnalyses(dir, name, conn)
+	err = pipeline.DownloadAnalyses(ctx, dir, name, conn)
 	if err != nil {
 		return fmt.Errorf("Error downloading analyses: %v", err)
 	}
 
+	if keepalternatives {
+		err = pipeline.DownloadAlternatives(ctx, dir, name, conn)
+		if err != nil {
+			return fmt.Errorf("Error downloading alternative versions of pages: %v", err)
+		}
+	}
+
 	return nil
 }
 
-func processbook(ctx context.Context, training string, tesscmd string, conn Pipeliner, fullpdf bool) error {
+// processbook processes the book in conn using the given number of
+// workers at once, until they have all been idle for QuietTime with
+// every queue empty, or one of them fails.
+func processbook(ctx context.Context, training string, tesscmd string, conn Pipeliner, fullpdf bool, workers int) error {
+	if workers < 1 {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var busy int32
+	errc := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			errc <- processworker(ctx, training, tesscmd, conn, fullpdf, &busy)
+		}()
+	}
+
+	var err error
+	for i := 0; i < workers; i++ {
+		e := <-errc
+		if e != nil && err == nil {
+			// stop the other workers, keeping the first error
+			err = e
+			cancel()
+		}
+	}
+	return err
+}
+
+// queuesEmpty returns whether every queue used by processbook has no
+// messages, either waiting or in progress.
+func queuesEmpty(conn Pipeliner) (bool, error) {
+	for _, q := range []string{conn.PreQueueId(), conn.PreNoWipeQueueId(), conn.WipeQueueId(), conn.OCRPageQueueId(), conn.AnalyseQueueId()} {
+		avail, inprog, err := conn.GetQueueDetails(q)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if avail != "0" || inprog != "0" {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// processworker checks each queue in turn and processes any messages
+// found, returning once it and any other workers have been idle for
+// QuietTime and every queue is empty. busy is the number of workers
+// currently processing a message, which is shared between them.
+func processworker(ctx context.Context, training string, tesscmd string, conn Pipeliner, fullpdf bool, busy *int32) error {
 	origPattern := regexp.MustCompile(`[0-9]{4}.(jpg|png)$`)
 	wipePattern := regexp.MustCompile(`[0-9]{4,6}(.bin)?.(jpg|png)$`)
 	ocredPattern := regexp.MustCompile(`.hocr$`)
@@ -857,7 +1086,7 @@ func processbook(ctx context.Context, training string, tesscmd string, conn Pipe
 	checkWipeQueue = time.After(0)
 	checkOCRPageQueue = time.After(0)
 	checkAnalyseQueue = time.After(0)
-	var quietTime = 1 * time.Second
+	quietTime := QuietTime
 	stopIfQuiet = time.NewTimer(quietTime)
 	if quietTime == 0 {
 		stopIfQuiet.Stop()
@@ -874,13 +1103,15 @@ func processbook(ctx context.Context, training string, tesscmd string, conn Pipe
 				return fmt.Errorf("Error checking preprocess no wipe queue: %v", err)
 			}
 			if msg.Handle == "" {
-				conn.Log("No message received on preprocess no wipe queue, sleeping")
+				conn.Log(bookpipeline.DebugTag + "No message received on preprocess no wipe queue, sleeping")
 				continue
 			}
 			stopTimer(stopIfQuiet)
+			atomic.AddInt32(busy, 1)
 			conn.Log("Message received on preprocess no wipe queue, processing", msg.Body)
 			fmt.Printf("  Preprocessing book (binarising only, no wiping)\n")
 			err = pipeline.ProcessBook(ctx, msg, conn, pipeline.Preprocess(thresholds, true), origPattern, conn.PreNoWipeQueueId(), conn.OCRPageQueueId())
+			atomic.AddInt32(busy, -1)
 			resetTimer(stopIfQuiet, quietTime)
 			if err != nil {
 				return fmt.Errorf("Error during preprocess (no wipe): %v", err)
@@ -893,13 +1124,20 @@ func processbook(ctx context.Context, training string, tesscmd string, conn Pipe
 				return fmt.Errorf("Error checking preprocess queue: %v", err)
 			}
 			if msg.Handle == "" {
-				conn.Log("No message received on preprocess queue, sleeping")
+				conn.Log(bookpipeline.DebugTag + "No message received on preprocess queue, sleeping")
 				continue
 			}
 			stopTimer(stopIfQuiet)
+			atomic.AddInt32(busy, 1)
 			conn.Log("Message received on preprocess queue, processing", msg.Body)
 			fmt.Printf("  Preprocessing book (binarising and wiping)\n")
-			err = pipeline.ProcessBook(ctx, msg, conn, pipeline.Preprocess(thresholds, false), origPattern, conn.PreQueueId(), conn.OCRPageQueueId())
+			process, err := pipeline.PreprocessFor(pipeline.ParseJobMessage(msg.Body), thresholds, false)
+			if err != nil {
+				atomic.AddInt32(busy, -1)
+				return fmt.Errorf("Error during preprocess: %v", err)
+			}
+			err = pipeline.ProcessBook(ctx, msg, conn, process, origPattern, conn.PreQueueId(), conn.OCRPageQueueId())
+			atomic.AddInt32(busy, -1)
 			resetTimer(stopIfQuiet, quietTime)
 			if err != nil {
 				return fmt.Errorf("Error during preprocess: %v", err)
@@ -912,13 +1150,15 @@ func processbook(ctx context.Context, training string, tesscmd string, conn Pipe
 				return fmt.Errorf("Error checking wipeonly queue, %v", err)
 			}
 			if msg.Handle == "" {
-				conn.Log("No message received on wipeonly queue, sleeping")
+				conn.Log(bookpipeline.DebugTag + "No message received on wipeonly queue, sleeping")
 				continue
 			}
 			stopTimer(stopIfQuiet)
+			atomic.AddInt32(busy, 1)
 			conn.Log("Message received on wipeonly queue, processing", msg.Body)
 			fmt.Printf("  Preprocessing book (wiping only)\n")
 			err = pipeline.ProcessBook(ctx, msg, conn, pipeline.Wipe, wipePattern, conn.WipeQueueId(), conn.OCRPageQueueId())
+			atomic.AddInt32(busy, -1)
 			resetTimer(stopIfQuiet, quietTime)
 			if err != nil {
 				return fmt.Errorf("Error during wipe: %v", err)
@@ -937,9 +1177,15 @@ func processbook(ctx context.Context, training string, tesscmd string, conn Pipe
 			// there will be more pages that should be done without delay
 			checkOCRPageQueue = time.After(0)
 			stopTimer(stopIfQuiet)
+			atomic.AddInt32(busy, 1)
 			conn.Log("Message received on OCR Page queue, processing", msg.Body)
 			fmt.Printf(".")
-			err = pipeline.OcrPage(ctx, msg, conn, pipeline.Ocr(training, tesscmd), conn.OCRPageQueueId(), conn.AnalyseQueueId())
+			err = pipeline.RecordTesseractVersion(conn, filepath.Dir(strings.Split(msg.Body, " ")[0]), tesscmd)
+			if err != nil {
+				conn.Log("Error recording tesseract version", err)
+			}
+			err = pipeline.OcrPage(ctx, msg, conn, pipeline.Ocr(training, tesscmd), pipeline.OcrOptions{}, conn.OCRPageQueueId(), conn.AnalyseQueueId())
+			atomic.AddInt32(busy, -1)
 			resetTimer(stopIfQuiet, quietTime)
 			if err != nil {
 				return fmt.Errorf("\nError during OCR Page process: %v", err)
@@ -951,18 +1197,42 @@ func processbook(ctx context.Context, training string, tesscmd string, conn Pipe
 				return fmt.Errorf("Error checking analyse queue: %v", err)
 			}
 			if msg.Handle == "" {
-				conn.Log("No message received on analyse queue, sleeping")
+				conn.Log(bookpipeline.DebugTag + "No message received on analyse queue, sleeping")
 				continue
 			}
 			stopTimer(stopIfQuiet)
+			atomic.AddInt32(busy, 1)
 			conn.Log("Message received on analyse queue, processing", msg.Body)
 			fmt.Printf("\n  Analysing OCR and compiling PDFs\n")
-			err = pipeline.ProcessBook(ctx, msg, conn, pipeline.Analyse(conn, fullpdf), ocredPattern, conn.AnalyseQueueId(), "")
+			err = pipeline.ProcessBook(ctx, msg, conn, pipeline.Analyse(conn, pipeline.AnalyseOptions{Bookname: pipeline.ParseJobMessage(msg.Body).Bookname, MkFullPdf: fullpdf}), ocredPattern, conn.AnalyseQueueId(), "")
+			atomic.AddInt32(busy, -1)
 			resetTimer(stopIfQuiet, quietTime)
 			if err != nil {
 				return fmt.Errorf("Error during analysis: %v", err)
 			}
 		case <-stopIfQuiet.C:
+			if atomic.LoadInt32(busy) > 0 {
+				// another worker may yet add more to the queues
+				resetTimer(stopIfQuiet, quietTime)
+				continue
+			}
+			// a message may be in progress between stages, or
+			// have been missed since the last check, so only
+			// finish once every queue is confirmed to be empty
+			empty, err := queuesEmpty(conn)
+			if err != nil {
+				return fmt.Errorf("Error checking queues are empty: %v", err)
+			}
+			if !empty {
+				conn.Log(bookpipeline.DebugTag + "Queues are not yet empty, checking them again")
+				checkPreQueue = time.After(0)
+				checkPreNoWipeQueue = time.After(0)
+				checkWipeQueue = time.After(0)
+				checkOCRPageQueue = time.After(0)
+				checkAnalyseQueue = time.After(0)
+				resetTimer(stopIfQuiet, quietTime)
+				continue
+			}
 			conn.Log("Processing finished")
 			return nil
 		}
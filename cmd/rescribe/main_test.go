@@ -0,0 +1,395 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+func TestFinalisePdfs(t *testing.T) {
+	cases := []struct {
+		name     string
+		pdfs     []string
+		pdfname  string
+		keepall  bool
+		expected []string
+	}{
+		{"default", []string{"book.binarised.pdf", "book.colour.pdf"}, "book.pdf", false, []string{"book.pdf"}},
+		{"binonly", []string{"book.binarised.pdf"}, "book.pdf", false, []string{"book.pdf"}},
+		{"pdfname", []string{"book.binarised.pdf", "book.colour.pdf"}, "book searchable.pdf", false, []string{"book searchable.pdf"}},
+		{"keepall", []string{"book.binarised.pdf", "book.colour.pdf"}, "book.pdf", true, []string{"book.binarised.pdf", "book.colour.pdf"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "rescribetest")
+			if err != nil {
+				t.Fatalf("Could not create temporary directory: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			for _, fn := range c.pdfs {
+				err = ioutil.WriteFile(filepath.Join(dir, fn), []byte(fn), 0644)
+				if err != nil {
+					t.Fatalf("Could not create %s: %v", fn, err)
+				}
+			}
+
+			err = finalisePdfs(dir, "book", c.pdfname, false, c.keepall)
+			if err != nil {
+				t.Fatalf("Error finalising PDFs: %v", err)
+			}
+
+			matches, err := filepath.Glob(filepath.Join(dir, "*.pdf"))
+			if err != nil {
+				t.Fatalf("Error listing PDFs: %v", err)
+			}
+			var found []string
+			for _, m := range matches {
+				found = append(found, filepath.Base(m))
+			}
+			sort.Strings(found)
+			if strings.Join(found, ",") != strings.Join(c.expected, ",") {
+				t.Fatalf("Expected PDFs %v, got %v", c.expected, found)
+			}
+
+			// the colour PDF should be the one kept by default
+			if !c.keepall && len(c.pdfs) == 2 {
+				b, err := ioutil.ReadFile(filepath.Join(dir, c.pdfname))
+				if err != nil {
+					t.Fatalf("Could not read searchable PDF: %v", err)
+				}
+				if string(b) != "book.colour.pdf" {
+					t.Fatalf("Expected searchable PDF to be the colour PDF, got %s", b)
+				}
+			}
+		})
+	}
+}
+
+func TestBookSummary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rescribetest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := "/tmp/book/0000_bin0.1.hocr\t50\n" +
+		"/tmp/book/0000_bin0.2.hocr\t70\n" +
+		"/tmp/book/0001_bin0.2.hocr\t90\n" +
+		"/tmp/book/0002_bin0.2.hocr\t40\n" +
+		"/tmp/book/0002_bin0.3.hocr\t20\n"
+	best := "0000_bin0.2.hocr\n0001_bin0.2.hocr\n0002_bin0.2.hocr\n"
+	files := map[string]string{"conf": conf, "best": best, "book.pdf": "pdf"}
+	for fn, content := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, fn), []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("Could not create %s: %v", fn, err)
+		}
+	}
+
+	summary, err := bookSummary(dir, "book", "book.pdf")
+	if err != nil {
+		t.Fatalf("Error summarising book: %v", err)
+	}
+
+	expected := []string{
+		"Pages: 3",
+		"Average confidence: 67",
+		"Lowest confidence pages:",
+		"    0002_bin0.2.hocr: 40",
+		"    0000_bin0.2.hocr: 70",
+		"    0001_bin0.2.hocr: 90",
+		"Results saved to:",
+		"    " + filepath.Join(dir, "book.pdf"),
+	}
+	if strings.Join(summary, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Expected summary:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(summary, "\n"))
+	}
+}
+
+// writeTestPdf saves a PDF with a page for each image stream given,
+// each of which is embedded with the filter given, or none if it is
+// empty
+func writeTestPdf(path string, imgs [][]byte, filters []string) error {
+	var b bytes.Buffer
+	var offsets []int
+	obj := func(s string) {
+		offsets = append(offsets, b.Len())
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", len(offsets), s)
+	}
+
+	b.WriteString("%PDF-1.4\n")
+	var kids []string
+	for i := range imgs {
+		kids = append(kids, fmt.Sprintf("%d 0 R", 3+i*2))
+	}
+	obj("<< /Type /Catalog /Pages 2 0 R >>")
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(imgs)))
+	for i, img := range imgs {
+		obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 100 100] /Resources << /XObject << /Im0 %d 0 R >> >> >>", 4+i*2))
+		filter := ""
+		if filters[i] != "" {
+			filter = " /Filter /" + filters[i]
+		}
+		obj(fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width 100 /Height 100 /BitsPerComponent 8 /ColorSpace /DeviceGray%s /Length %d >>\nstream\n%s\nendstream", filter, len(img), img))
+	}
+
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, o := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", o)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	return ioutil.WriteFile(path, b.Bytes(), 0644)
+}
+
+// TestExtractPdfImgsUnsupported checks that a page the pdf library
+// panics on is skipped, and the images from the rest of the pages
+// are still extracted
+func TestExtractPdfImgsUnsupported(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "rescribepdftest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	tempdirs := filepath.Join(tmp, "tempdirs")
+	err = os.Mkdir(tempdirs, 0755)
+	if err != nil {
+		t.Fatalf("Could not create directory: %v", err)
+	}
+	t.Setenv("TMPDIR", tempdirs)
+
+	var img bytes.Buffer
+	err = png.Encode(&img, image.NewGray(image.Rect(0, 0, 100, 100)))
+	if err != nil {
+		t.Fatalf("Could not encode image: %v", err)
+	}
+
+	cases := []struct {
+		name     string
+		filters  []string
+		expected []string
+	}{
+		{"supported", []string{"", "", ""}, []string{"0001-Im0.png", "0002-Im0.png", "0003-Im0.png"}},
+		{"onepage", []string{"", "UnknownDecode", ""}, []string{"0001-Im0.png", "0003-Im0.png"}},
+		{"allpages", []string{"UnknownDecode", "UnknownDecode", "UnknownDecode"}, nil},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(tmp, c.name+".pdf")
+			imgs := [][]byte{img.Bytes(), img.Bytes(), img.Bytes()}
+			err := writeTestPdf(path, imgs, c.filters)
+			if err != nil {
+				t.Fatalf("Could not write PDF: %v", err)
+			}
+
+			dir, err := extractPdfImgs(context.Background(), path)
+			if err != nil {
+				t.Fatalf("Error extracting images from PDF: %v", err)
+			}
+			if c.expected == nil {
+				if dir != "" {
+					t.Fatalf("Expected no directory to be returned as no pages could be extracted, got %s", dir)
+				}
+				return
+			}
+			defer os.RemoveAll(filepath.Dir(dir))
+
+			found, err := ioutil.ReadDir(dir)
+			if err != nil {
+				t.Fatalf("Could not read directory: %v", err)
+			}
+			var names []string
+			for _, f := range found {
+				names = append(names, f.Name())
+			}
+			if strings.Join(names, " ") != strings.Join(c.expected, " ") {
+				t.Fatalf("Expected %v to be extracted, got %v", c.expected, names)
+			}
+		})
+	}
+
+	// the temporary directory is removed if nothing could be extracted
+	left, err := ioutil.ReadDir(tempdirs)
+	if err != nil {
+		t.Fatalf("Could not read directory: %v", err)
+	}
+	if len(left) != 0 {
+		t.Fatalf("Expected temporary directories to be removed, found %d", len(left))
+	}
+}
+
+func TestStartProcessCancel(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping as a shell script is used in place of tesseract")
+	}
+	if testing.Short() {
+		t.Skip("Skipping test which runs the whole process")
+	}
+
+	tmp, err := ioutil.TempDir("", "rescribetest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	// ensure any temporary directories made by startProcess are
+	// created in tmp, so they can be checked for
+	tempdirs := filepath.Join(tmp, "tempdirs")
+	err = os.Mkdir(tempdirs, 0755)
+	if err != nil {
+		t.Fatalf("Could not create directory: %v", err)
+	}
+	t.Setenv("TMPDIR", tempdirs)
+
+	// a fake tesseract which signals it has started and then hangs
+	started := filepath.Join(tmp, "started")
+	tesscmd := filepath.Join(tmp, "tesseract")
+	script := "#!/bin/sh\n" +
+		"if [ \"$1\" = \"--help\" ]; then exit 0; fi\n" +
+		"touch " + started + "\n" +
+		"exec sleep 60\n"
+	err = ioutil.WriteFile(tesscmd, []byte(script), 0755)
+	if err != nil {
+		t.Fatalf("Could not create fake tesseract: %v", err)
+	}
+
+	bookdir := filepath.Join(tmp, "book")
+	err = os.Mkdir(bookdir, 0755)
+	if err != nil {
+		t.Fatalf("Could not create book directory: %v", err)
+	}
+	img := image.NewGray(image.Rect(0, 0, 100, 100))
+	for x := 20; x < 80; x++ {
+		img.Set(x, 50, color.Black)
+	}
+	f, err := os.Create(filepath.Join(bookdir, "0001.png"))
+	if err != nil {
+		t.Fatalf("Could not create image: %v", err)
+	}
+	err = png.Encode(f, img)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Could not encode image: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger := log.New(ioutil.Discard, "", 0)
+	errc := make(chan error)
+	go func() {
+		opts := processOptions{tessCommand: tesscmd, trainingName: "eng", nowipe: true, workers: 1}
+		errc <- startProcess(ctx, logger, bookdir, "book", filepath.Join(tmp, "save"), opts)
+	}()
+
+	deadline := time.After(time.Minute)
+	for {
+		_, err = os.Stat(started)
+		if err == nil {
+			break
+		}
+		select {
+		case err = <-errc:
+			t.Fatalf("Processing finished before tesseract started: %v", err)
+		case <-deadline:
+			t.Fatalf("Timed out waiting for tesseract to start")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	cancel()
+
+	select {
+	case err = <-errc:
+		if err == nil {
+			t.Fatalf("Expected an error after cancelling, got none")
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatalf("Processing did not stop promptly after cancelling")
+	}
+
+	dirs, err := filepath.Glob(filepath.Join(tempdirs, "bookpipeline*"))
+	if err != nil {
+		t.Fatalf("Error looking for temporary directories: %v", err)
+	}
+	if len(dirs) > 0 {
+		t.Fatalf("Temporary directories not removed after cancelling: %v", dirs)
+	}
+}
+
+// TestProcessbookSlowStage tests that processing doesn't finish while
+// a message is still in progress on a queue, even if the gap before
+// the next stage is much longer than the quiet time
+func TestProcessbookSlowStage(t *testing.T) {
+	origQuiet, origPause := QuietTime, PauseBetweenChecks
+	defer func() { QuietTime, PauseBetweenChecks = origQuiet, origPause }()
+	QuietTime = 100 * time.Millisecond
+	PauseBetweenChecks = 10 * time.Millisecond
+
+	tempdir, err := ioutil.TempDir("", "rescribetest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tempdir)
+	conn := &bookpipeline.LocalConn{Logger: log.New(ioutil.Discard, "", 0), TempDir: tempdir}
+	err = conn.Init()
+	if err != nil {
+		t.Fatalf("Could not set up connection: %v", err)
+	}
+
+	// a message which is being slowly processed elsewhere, so is
+	// hidden from the workers
+	err = conn.AddToQueue(conn.OCRPageQueueId(), "book/0001.png")
+	if err != nil {
+		t.Fatalf("Could not add message to queue: %v", err)
+	}
+	msg, err := conn.CheckQueue(conn.OCRPageQueueId(), QueueTimeoutSecs)
+	if err != nil || msg.Handle == "" {
+		t.Fatalf("Could not take message from queue: %v", err)
+	}
+
+	errc := make(chan error)
+	go func() {
+		errc <- processbook(context.Background(), "eng", "tesseract", conn, false, 2)
+	}()
+
+	select {
+	case err = <-errc:
+		t.Fatalf("Processing finished while a message was still in progress: %v", err)
+	case <-time.After(10 * QuietTime):
+	}
+
+	err = conn.DelFromQueue(conn.OCRPageQueueId(), msg.Handle)
+	if err != nil {
+		t.Fatalf("Could not delete message from queue: %v", err)
+	}
+
+	select {
+	case err = <-errc:
+		if err != nil {
+			t.Fatalf("Error processing book: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Processing did not finish once the queues were empty")
+	}
+}
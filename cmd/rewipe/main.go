@@ -0,0 +1,21 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+// rewipe sends a prebinarised book back to the pipeline to be wiped
+// again with different settings.
+package main
+
+import (
+	"log"
+	"os"
+
+	"rescribe.xyz/bookpipeline/internal/cli"
+)
+
+func main() {
+	err := cli.Rewipe("rewipe", os.Args[1:])
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
@@ -6,42 +6,15 @@
 package main
 
 import (
-	"flag"
-	"fmt"
 	"log"
+	"os"
 
-	"rescribe.xyz/bookpipeline"
+	"rescribe.xyz/bookpipeline/internal/cli"
 )
 
-const usage = `Usage: spotme [-n num]
-
-Create new spot instances for the book pipeline.
-`
-
-type SpotPipeliner interface {
-	MinimalInit() error
-	StartInstances(n int) error
-}
-
 func main() {
-	num := flag.Int("n", 1, "number of instances to start")
-	flag.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), usage)
-		flag.PrintDefaults()
-	}
-	flag.Parse()
-
-	var conn SpotPipeliner
-	conn = &bookpipeline.AwsConn{}
-	err := conn.MinimalInit()
-	if err != nil {
-		log.Fatalln("Failed to set up cloud connection:", err)
-	}
-
-	log.Println("Starting spot instances")
-	err = conn.StartInstances(*num)
+	err := cli.Spot("spotme", os.Args[1:])
 	if err != nil {
-		log.Fatalln("Failed to start a spot instance:", err)
+		log.Fatalln(err)
 	}
-	log.Println("Spot instance request sent successfully")
 }
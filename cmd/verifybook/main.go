@@ -0,0 +1,21 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+// verifybook checks that every preprocessed page of a book in the
+// pipeline has been OCRed, listing any pages which have not.
+package main
+
+import (
+	"log"
+	"os"
+
+	"rescribe.xyz/bookpipeline/internal/cli"
+)
+
+func main() {
+	err := cli.Verify("verifybook", os.Args[1:])
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"sort"
+)
+
+// pdfLine is a line of the (invisible) text of a page, with the
+// position of its left, top and right edges in pt
+type pdfLine struct {
+	x0, y0, x1 float64
+	words      []pdfWord
+}
+
+// wideLine is the proportion of the width of the text on a page above
+// which a line is considered to span several columns, like a heading
+const wideLine = 0.6
+
+// columnOrder returns the lines of a page in reading order for a
+// page with several columns: each column is read from top to bottom
+// before the next column to its right. Columns are found from the
+// gaps between the lines, so that they needn't be marked in the
+// hOCR. Lines which span several columns, like headings, are kept in
+// their place, with the columns above them read before them and
+// those below read after them.
+func columnOrder(lines []pdfLine) []pdfLine {
+	if len(lines) < 2 {
+		return lines
+	}
+	minx, maxx := lines[0].x0, lines[0].x1
+	for _, l := range lines {
+		if l.x0 < minx {
+			minx = l.x0
+		}
+		if l.x1 > maxx {
+			maxx = l.x1
+		}
+	}
+	wide := func(l pdfLine) bool {
+		return l.x1-l.x0 > (maxx-minx)*wideLine
+	}
+
+	// the columns are the horizontal extents covered by narrow lines
+	var cols [][2]float64
+	var narrow []pdfLine
+	for _, l := range lines {
+		if !wide(l) {
+			narrow = append(narrow, l)
+		}
+	}
+	sort.Slice(narrow, func(i, j int) bool { return narrow[i].x0 < narrow[j].x0 })
+	for _, l := range narrow {
+		if len(cols) > 0 && l.x0 <= cols[len(cols)-1][1] {
+			if l.x1 > cols[len(cols)-1][1] {
+				cols[len(cols)-1][1] = l.x1
+			}
+			continue
+		}
+		cols = append(cols, [2]float64{l.x0, l.x1})
+	}
+	if len(cols) < 2 {
+		return lines
+	}
+	column := func(l pdfLine) int {
+		mid := (l.x0 + l.x1) / 2
+		for i, c := range cols {
+			if mid <= c[1] {
+				return i
+			}
+		}
+		return len(cols) - 1
+	}
+
+	sorted := make([]pdfLine, len(lines))
+	copy(sorted, lines)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].y0 < sorted[j].y0 })
+
+	// lines are gathered into bands between the wide lines, and each
+	// band is read column by column
+	var ordered, band []pdfLine
+	flush := func() {
+		sort.SliceStable(band, func(i, j int) bool {
+			ci, cj := column(band[i]), column(band[j])
+			if ci != cj {
+				return ci < cj
+			}
+			return band[i].y0 < band[j].y0
+		})
+		ordered = append(ordered, band...)
+		band = nil
+	}
+	for _, l := range sorted {
+		if wide(l) {
+			flush()
+			ordered = append(ordered, l)
+			continue
+		}
+		band = append(band, l)
+	}
+	flush()
+	return ordered
+}
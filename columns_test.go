@@ -0,0 +1,154 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testHocrColumns is a two column page with a heading and a footnote
+// across both columns, with the lines of the columns interleaved, as
+// tesseract sometimes finds them
+const testHocrColumns = `<?xml version="1.0" encoding="UTF-8"?>
+<html><body>
+<div class='ocr_page' id='page_1' title='image "page.png"; bbox 0 0 1000 1000'>
+<div class='ocr_carea' id='block_1_1'><p class='ocr_par' id='par_1_1'>
+<span class='ocr_line' id='line_1_1' title='bbox 100 50 900 100'><span class='ocrx_word' id='word_1_1' title='bbox 100 50 900 100; x_wconf 90'>heading</span></span>
+<span class='ocr_line' id='line_1_2' title='bbox 100 200 450 250'><span class='ocrx_word' id='word_1_2' title='bbox 100 200 450 250; x_wconf 90'>leftone</span></span>
+<span class='ocr_line' id='line_1_3' title='bbox 550 200 900 250'><span class='ocrx_word' id='word_1_3' title='bbox 550 200 900 250; x_wconf 90'>rightone</span></span>
+<span class='ocr_line' id='line_1_4' title='bbox 100 300 430 350'><span class='ocrx_word' id='word_1_4' title='bbox 100 300 430 350; x_wconf 90'>lefttwo</span></span>
+<span class='ocr_line' id='line_1_5' title='bbox 560 300 900 350'><span class='ocrx_word' id='word_1_5' title='bbox 560 300 900 350; x_wconf 90'>righttwo</span></span>
+<span class='ocr_line' id='line_1_6' title='bbox 550 400 880 450'><span class='ocrx_word' id='word_1_6' title='bbox 550 400 880 450; x_wconf 90'>rightthree</span></span>
+<span class='ocr_line' id='line_1_7' title='bbox 100 400 450 450'><span class='ocrx_word' id='word_1_7' title='bbox 100 400 450 450; x_wconf 90'>leftthree</span></span>
+<span class='ocr_line' id='line_1_8' title='bbox 100 900 900 950'><span class='ocrx_word' id='word_1_8' title='bbox 100 900 900 950; x_wconf 90'>footnote</span></span>
+</p></div>
+</div>
+</body></html>
+`
+
+func Test_columnOrder(t *testing.T) {
+	line := func(x0, y0, x1 float64, text string) pdfLine {
+		return pdfLine{x0: x0, y0: y0, x1: x1, words: []pdfWord{{text: text}}}
+	}
+	cases := []struct {
+		name     string
+		lines    []pdfLine
+		expected string
+	}{
+		{"single", []pdfLine{line(10, 10, 90, "a"), line(10, 20, 80, "b"), line(15, 30, 90, "c")}, "a b c"},
+		{"two", []pdfLine{line(10, 10, 40, "a"), line(60, 10, 90, "c"), line(10, 20, 40, "b"), line(60, 20, 90, "d")}, "a b c d"},
+		{"heading", []pdfLine{line(10, 0, 90, "h"), line(60, 10, 90, "c"), line(10, 10, 40, "a"), line(10, 20, 40, "b")}, "h a b c"},
+		{"bands", []pdfLine{line(10, 10, 40, "a"), line(60, 10, 90, "b"), line(10, 20, 90, "w"), line(60, 30, 90, "d"), line(10, 30, 40, "c")}, "a b w c d"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var got []string
+			for _, l := range columnOrder(c.lines) {
+				got = append(got, l.words[0].text)
+			}
+			if strings.Join(got, " ") != c.expected {
+				t.Fatalf("Expected %s, got %s", c.expected, strings.Join(got, " "))
+			}
+		})
+	}
+}
+
+// Test_ColumnOrder tests that the text layer of a two column page is
+// in column order with ColumnOrder, and in hOCR order without it
+func Test_ColumnOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookpipelinetest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	imgpath := filepath.Join(dir, "page.png")
+	f, err := os.Create(imgpath)
+	if err != nil {
+		t.Fatalf("Could not create image: %v", err)
+	}
+	err = png.Encode(f, image.NewGray(image.Rect(0, 0, 1000, 1000)))
+	f.Close()
+	if err != nil {
+		t.Fatalf("Could not encode image: %v", err)
+	}
+	hocrpath := filepath.Join(dir, "page.hocr")
+	err = ioutil.WriteFile(hocrpath, []byte(testHocrColumns), 0644)
+	if err != nil {
+		t.Fatalf("Could not create hOCR: %v", err)
+	}
+
+	hocrorder := []string{"heading", "leftone", "rightone", "lefttwo", "righttwo", "rightthree", "leftthree", "footnote"}
+	colorder := []string{"heading", "leftone", "lefttwo", "leftthree", "rightone", "righttwo", "rightthree", "footnote"}
+
+	cases := []struct {
+		name     string
+		columns  bool
+		stream   bool
+		expected []string
+	}{
+		{"hocr", false, false, hocrorder},
+		{"columns", true, false, colorder},
+		{"streamhocr", false, true, hocrorder},
+		{"streamcolumns", true, true, colorder},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pdf := &SplitPdf{ColumnOrder: c.columns, Stream: c.stream, TempDir: dir}
+			err := pdf.Setup()
+			if err != nil {
+				t.Fatalf("Could not set up PDF: %v", err)
+			}
+			if !c.stream {
+				// disable compression so the content stream can be checked
+				pdf.vols[0].fpdf.SetCompression(false)
+			}
+			err = pdf.AddPage(imgpath, hocrpath, false)
+			if err != nil {
+				t.Fatalf("Could not add page: %v", err)
+			}
+			out := filepath.Join(dir, c.name+".pdf")
+			err = pdf.Save(out)
+			if err != nil {
+				t.Fatalf("Could not save PDF: %v", err)
+			}
+
+			// find where each word is in the text of the page
+			var pos []int
+			if c.stream {
+				_, texts, err := pdfPages(out, true)
+				if err != nil || len(texts) != 1 {
+					t.Fatalf("Could not read text of PDF: %v", err)
+				}
+				for _, w := range c.expected {
+					pos = append(pos, strings.Index(texts[0], w+" "))
+				}
+			} else {
+				b, err := ioutil.ReadFile(out)
+				if err != nil {
+					t.Fatalf("Could not read saved PDF: %v", err)
+				}
+				for _, w := range c.expected {
+					pos = append(pos, bytes.Index(b, utf16be(w+" ")))
+				}
+			}
+			for i, p := range pos {
+				if p == -1 {
+					t.Fatalf("Word %s not found in text layer", c.expected[i])
+				}
+				if i > 0 && p < pos[i-1] {
+					t.Fatalf("Expected text in order %v, but %s comes before %s", c.expected, c.expected[i], c.expected[i-1])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"time"
+)
+
+// InstancePrices are the approximate on-demand prices of running an
+// instance, in US dollars per hour, keyed by region and then instance
+// type. They are only used to give a rough idea of spending, so they
+// don't need to be kept exactly up to date. Spot instances usually
+// cost less than this, so estimates for them are an upper bound.
+var InstancePrices = map[string]map[string]float64{
+	"eu-west-1": {
+		"t2.micro":   0.0126,
+		"t3.micro":   0.0114,
+		"t3.medium":  0.0456,
+		"c5.large":   0.096,
+		"c5.xlarge":  0.192,
+		"c5.2xlarge": 0.384,
+		"c5.4xlarge": 0.768,
+		"m5.large":   0.107,
+		"m5.xlarge":  0.214,
+		"m5.2xlarge": 0.428,
+	},
+	"eu-west-2": {
+		"t2.micro":   0.0132,
+		"t3.micro":   0.0118,
+		"t3.medium":  0.0472,
+		"c5.large":   0.101,
+		"c5.xlarge":  0.202,
+		"c5.2xlarge": 0.404,
+		"c5.4xlarge": 0.808,
+		"m5.large":   0.111,
+		"m5.xlarge":  0.222,
+		"m5.2xlarge": 0.444,
+	},
+	"us-east-1": {
+		"t2.micro":   0.0116,
+		"t3.micro":   0.0104,
+		"t3.medium":  0.0416,
+		"c5.large":   0.085,
+		"c5.xlarge":  0.17,
+		"c5.2xlarge": 0.34,
+		"c5.4xlarge": 0.68,
+		"m5.large":   0.096,
+		"m5.xlarge":  0.192,
+		"m5.2xlarge": 0.384,
+	},
+}
+
+// Uptime returns how long an instance has been running for at the
+// time now, based on when it was last launched. Zero is returned for
+// instances which aren't running.
+func (d InstanceDetails) Uptime(now time.Time) time.Duration {
+	if d.State != "running" || d.Launched.IsZero() || now.Before(d.Launched) {
+		return 0
+	}
+	return now.Sub(d.Launched)
+}
+
+// EstimatedCost returns an estimate of the cost in US dollars of
+// running an instance from when it was last launched until now, using
+// InstancePrices. If the price of the instance type in its region
+// isn't known, ok is false.
+func (d InstanceDetails) EstimatedCost(now time.Time) (cost float64, ok bool) {
+	price, ok := InstancePrices[d.Region][d.Type]
+	if !ok {
+		return 0, false
+	}
+	return price * d.Uptime(now).Hours(), true
+}
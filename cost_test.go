@@ -0,0 +1,46 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func Test_EstimatedCost(t *testing.T) {
+	launched := time.Date(2022, 3, 1, 9, 0, 0, 0, time.UTC)
+	now := launched.Add(3*time.Hour + 30*time.Minute)
+
+	cases := []struct {
+		name   string
+		d      InstanceDetails
+		uptime time.Duration
+		cost   float64
+		ok     bool
+	}{
+		{"running", InstanceDetails{Type: "m5.large", State: "running", Region: "eu-west-2", Launched: launched}, 210 * time.Minute, 0.3885, true},
+		{"otherregion", InstanceDetails{Type: "m5.large", State: "running", Region: "us-east-1", Launched: launched}, 210 * time.Minute, 0.336, true},
+		{"stopped", InstanceDetails{Type: "m5.large", State: "stopped", Region: "eu-west-2", Launched: launched}, 0, 0, true},
+		{"unknowntype", InstanceDetails{Type: "x9.huge", State: "running", Region: "eu-west-2", Launched: launched}, 210 * time.Minute, 0, false},
+		{"unknownregion", InstanceDetails{Type: "m5.large", State: "running", Region: "mars-north-1", Launched: launched}, 210 * time.Minute, 0, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			uptime := c.d.Uptime(now)
+			if uptime != c.uptime {
+				t.Fatalf("Expected uptime %v, got %v", c.uptime, uptime)
+			}
+			cost, ok := c.d.EstimatedCost(now)
+			if ok != c.ok {
+				t.Fatalf("Expected ok to be %v, got %v", c.ok, ok)
+			}
+			if math.Abs(cost-c.cost) > 0.00001 {
+				t.Fatalf("Expected cost %f, got %f", c.cost, cost)
+			}
+		})
+	}
+}
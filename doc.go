@@ -28,7 +28,10 @@ information on the booktopipeline tool simply run the following:
   booktopipeline -h
 
 To get the pipeline tools to work for you, you'll need to change the settings
-in cloudsettings.go, and set up your ~/.aws/credentials appropriately.
+in cloudsettings.go, and set up your AWS credentials appropriately. The
+standard AWS configuration methods are all supported, so credentials and the
+region to use can be set with environment variables like AWS_ACCESS_KEY_ID
+and AWS_REGION, in ~/.aws/credentials and ~/.aws/config, or with an IAM role.
 
 Managing servers
 
@@ -122,6 +125,22 @@ step the best one is chosen, based on the confidence of the OCR output.
   example message: APolishGentleman_MemoirByAdamKruczkiewicz
   example message: APolishGentleman_MemoirByAdamKruczkiewicz rescribelatv7
 
+Options can also be added to the end of the message, in the form
+key=value. The "single" option requests that each page is only
+binarised once, either with a given Sauvola k value or with Otsu's
+method, which is faster and good enough for clean scans. The single
+version of each page will then trivially be chosen as the best.
+
+  example message: APolishGentleman_MemoirByAdamKruczkiewicz single=0.3
+  example message: APolishGentleman_MemoirByAdamKruczkiewicz rescribelatv7 single=otsu
+
+The "binmethod" option chooses the binarisation method, which is
+normally Sauvola's. It can be set to "otsu" or "wolf" (the method of
+Wolf and Jolion), in which case each page is binarised only once. For
+"wolf" the k value can be set with the "single" option.
+
+  example message: APolishGentleman_MemoirByAdamKruczkiewicz binmethod=wolf single=0.4
+
 queueWipeOnly
 
 This queue works the same as queuePreProc, except that it doesn't
@@ -159,7 +178,9 @@ queueAnalyse
 A message on the queueAnalyse queue contains only a book name. The
 confidences for each page are calculated and saved in the 'conf' file, and
 the best version of each page is decided upon and saved in the 'best' file.
-PDFs are then generated, and the confidence graph is generated.
+The position and confidence of each word on the best version of each page
+is saved in the 'words.jsonl' file, with one line of JSON per page. PDFs
+are then generated, and the confidence graph is generated.
 
   example message: APolishGentleman_MemoirByAdamKruczkiewicz
 
@@ -22,6 +22,7 @@ const goodCutoff = 70
 const mediumCutoff = 65
 const badCutoff = 60
 const yticknum = 40
+const maxSummaryPages = 10
 
 type Conf struct {
 	Path, Code string
@@ -48,6 +49,27 @@ func createLine(xvalues []float64, y float64, c drawing.Color) chart.ContinuousS
 	}
 }
 
+// GraphOptions are the settings used by GraphWithOptions.
+type GraphOptions struct {
+	// XAxis is the label for the x axis.
+	XAxis string
+
+	// Guidelines adds lines marking good, medium and bad confidence,
+	// and the top and bottom 10% of confidences.
+	Guidelines bool
+
+	// LabelBelow labels only the points with a confidence below it
+	// with their page number. If zero, with Guidelines the points
+	// outside the top and bottom 10% of confidences are labelled,
+	// and otherwise every point is.
+	LabelBelow float64
+
+	// MaxLabels labels at most this many points, those with the
+	// lowest confidence, so that graphs of poor books aren't
+	// cluttered with labels. If zero there is no limit.
+	MaxLabels int
+}
+
 // Graph creates a graph of the confidence of each page in a book
 func Graph(confs map[string]*Conf, bookname string, w io.Writer) error {
 	return GraphOpts(confs, bookname, "Page number", true, w)
@@ -55,6 +77,41 @@ func Graph(confs map[string]*Conf, bookname string, w io.Writer) error {
 
 // GraphOpts creates a graph of confidences
 func GraphOpts(confs map[string]*Conf, bookname string, xaxis string, guidelines bool, w io.Writer) error {
+	return GraphWithOptions(confs, bookname, GraphOptions{XAxis: xaxis, Guidelines: guidelines}, w)
+}
+
+// labelPoints returns the points of a graph to label with their page
+// number, as set by opts, given the confidences marking the bottom
+// and top 10% of points.
+func labelPoints(graphconf []GraphConf, lowconf float64, highconf float64, opts GraphOptions) []GraphConf {
+	var labels []GraphConf
+	for _, c := range graphconf {
+		switch {
+		case opts.LabelBelow > 0:
+			if c.Conf < opts.LabelBelow {
+				labels = append(labels, c)
+			}
+		case !opts.Guidelines || c.Conf > highconf || c.Conf < lowconf:
+			labels = append(labels, c)
+		}
+	}
+	if opts.MaxLabels > 0 && len(labels) > opts.MaxLabels {
+		sort.Slice(labels, func(i, j int) bool {
+			if labels[i].Conf == labels[j].Conf {
+				return labels[i].Pgnum < labels[j].Pgnum
+			}
+			return labels[i].Conf < labels[j].Conf
+		})
+		labels = labels[:opts.MaxLabels]
+	}
+	return labels
+}
+
+// GraphWithOptions creates a graph of confidences, using the settings
+// in opts
+func GraphWithOptions(confs map[string]*Conf, bookname string, opts GraphOptions, w io.Writer) error {
+	xaxis := opts.XAxis
+	guidelines := opts.Guidelines
 	if len(confs) < 2 {
 		return errors.New("Not enough valid confidences")
 	}
@@ -171,10 +228,8 @@ func GraphOpts(confs map[string]*Conf, bookname string, xaxis string, guidelines
 
 	// Create annotations
 	var annotations []chart.Value2
-	for _, c := range graphconf {
-		if !guidelines || (c.Conf > highconf || c.Conf < lowconf) {
-			annotations = append(annotations, chart.Value2{Label: fmt.Sprintf("%.0f", c.Pgnum), XValue: c.Pgnum, YValue: c.Conf})
-		}
+	for _, c := range labelPoints(graphconf, lowconf, highconf, opts) {
+		annotations = append(annotations, chart.Value2{Label: fmt.Sprintf("%.0f", c.Pgnum), XValue: c.Pgnum, YValue: c.Conf})
 	}
 	annotations = append(annotations, chart.Value2{Label: fmt.Sprintf("%.0f", lowconf), XValue: xvalues[len(xvalues)-1], YValue: lowconf})
 	annotations = append(annotations, chart.Value2{Label: fmt.Sprintf("%.0f", highconf), XValue: xvalues[len(xvalues)-1], YValue: highconf})
@@ -218,3 +273,35 @@ func GraphOpts(confs map[string]*Conf, bookname string, xaxis string, guidelines
 	}
 	return graph.Render(chart.PNG, w)
 }
+
+// ConfSummary returns a short summary of the confidences of the
+// pages of a book, as lines of text, listing the number of pages,
+// the average confidence, and the pages with the lowest confidence.
+func ConfSummary(confs map[string]*Conf) []string {
+	var sorted []*Conf
+	var total float64
+	for _, c := range confs {
+		sorted = append(sorted, c)
+		total += c.Conf
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Conf == sorted[j].Conf {
+			return sorted[i].Path < sorted[j].Path
+		}
+		return sorted[i].Conf < sorted[j].Conf
+	})
+
+	lines := []string{fmt.Sprintf("Pages: %d", len(sorted))}
+	if len(sorted) == 0 {
+		return lines
+	}
+	lines = append(lines, fmt.Sprintf("Average confidence: %.0f", total/float64(len(sorted))))
+	lines = append(lines, "Lowest confidence pages:")
+	for i, c := range sorted {
+		if i >= maxSummaryPages {
+			break
+		}
+		lines = append(lines, fmt.Sprintf("    %s: %.0f", filepath.Base(c.Path), c.Conf))
+	}
+	return lines
+}
@@ -0,0 +1,62 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func Test_labelPoints(t *testing.T) {
+	confs := []float64{80, 45, 90, 30, 75, 50, 85, 20, 60, 40, 70, 95}
+	var graphconf []GraphConf
+	for i, c := range confs {
+		graphconf = append(graphconf, GraphConf{Pgnum: float64(i + 1), Conf: c})
+	}
+
+	cases := []struct {
+		name     string
+		opts     GraphOptions
+		expected []float64
+	}{
+		{"all", GraphOptions{}, []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}},
+		{"guidelines", GraphOptions{Guidelines: true}, []float64{8, 12}},
+		{"below", GraphOptions{Guidelines: true, LabelBelow: 50}, []float64{2, 4, 8, 10}},
+		{"max", GraphOptions{MaxLabels: 5}, []float64{2, 4, 6, 8, 10}},
+		{"belowmax", GraphOptions{LabelBelow: 50, MaxLabels: 2}, []float64{4, 8}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			labels := labelPoints(graphconf, 30, 90, c.opts)
+			var got []float64
+			for _, l := range labels {
+				got = append(got, l.Pgnum)
+			}
+			sort.Float64s(got)
+			if fmt.Sprint(got) != fmt.Sprint(c.expected) {
+				t.Fatalf("Expected pages %v to be labelled, got %v", c.expected, got)
+			}
+		})
+	}
+}
+
+func Test_GraphWithOptions(t *testing.T) {
+	confs := make(map[string]*Conf)
+	for i := 1; i <= 20; i++ {
+		path := fmt.Sprintf("%04d_bin0.2.hocr", i)
+		confs[path] = &Conf{Path: path, Conf: float64(40 + i*2)}
+	}
+	var buf bytes.Buffer
+	err := GraphWithOptions(confs, "test", GraphOptions{XAxis: "Page number", Guidelines: true, LabelBelow: 60, MaxLabels: 5}, &buf)
+	if err != nil {
+		t.Fatalf("Error creating graph: %v", err)
+	}
+	if buf.Len() == 0 {
+		t.Fatalf("Graph is empty")
+	}
+}
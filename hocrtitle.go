@@ -0,0 +1,52 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"strconv"
+	"strings"
+)
+
+// WordTitle is the properties given in the title of an ocrx_word
+// element of hOCR, as parsed by ParseWordTitle.
+type WordTitle struct {
+	Bbox [4]int
+	Conf float64
+	// HasConf is set if the title includes a confidence, so a word
+	// with a confidence of 0 can be told apart from one without any
+	HasConf bool
+}
+
+// ParseWordTitle gets the bbox and x_wconf properties from the title
+// of an ocrx_word element. This avoids using regular expressions, as
+// it is called for every word of every page.
+func ParseWordTitle(title string) WordTitle {
+	var t WordTitle
+	for _, prop := range strings.Split(title, ";") {
+		f := strings.Fields(prop)
+		if len(f) == 0 {
+			continue
+		}
+		switch f[0] {
+		case "bbox":
+			if len(f) != 5 {
+				continue
+			}
+			for i := range t.Bbox {
+				t.Bbox[i], _ = strconv.Atoi(f[i+1])
+			}
+		case "x_wconf":
+			if len(f) != 2 {
+				continue
+			}
+			c, err := strconv.ParseFloat(f[1], 64)
+			if err == nil {
+				t.Conf = c
+				t.HasConf = true
+			}
+		}
+	}
+	return t
+}
@@ -0,0 +1,32 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"testing"
+)
+
+func TestParseWordTitle(t *testing.T) {
+	cases := []struct {
+		title    string
+		expected WordTitle
+	}{
+		{"bbox 10 20 30 40; x_wconf 91", WordTitle{Bbox: [4]int{10, 20, 30, 40}, Conf: 91, HasConf: true}},
+		{"x_wconf 0;bbox 1 2 3 4", WordTitle{Bbox: [4]int{1, 2, 3, 4}, Conf: 0, HasConf: true}},
+		{"bbox 10 20 30 40", WordTitle{Bbox: [4]int{10, 20, 30, 40}}},
+		{"bbox 10 20 30; x_wconf 12.5", WordTitle{Conf: 12.5, HasConf: true}},
+		{"x_wconf high", WordTitle{}},
+		{"", WordTitle{}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.title, func(t *testing.T) {
+			got := ParseWordTitle(c.title)
+			if got != c.expected {
+				t.Fatalf("Expected %v, got %v", c.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"fmt"
+	"log"
+
+	"rescribe.xyz/bookpipeline"
+
+	"rescribe.xyz/bookpipeline/internal/pipeline"
+)
+
+const cancelUsage = ` [-c conn] [-mark] bookname
+
+Cancels a book which is stuck in the pipeline, by removing all of its
+messages from every queue. Messages for other books are left alone,
+even if their names start with the same text.
+
+Any message for the book which is being processed at the time can't
+be removed, and will return to its queue if processing fails. With
+-mark the book is also marked as cancelled, so that bookpipeline
+deletes any such messages without processing them. The mark is
+removed along with the rest of the book by rmbook.
+`
+
+// CancelPipeliner is a pipeline.Canceller which can be initialised
+type CancelPipeliner interface {
+	Init() error
+	pipeline.Canceller
+}
+
+// Cancel removes a book from every queue, as run by cancelbook.
+func Cancel(name string, args []string) error {
+	fs := newFlagSet(name, cancelUsage)
+	conntype := fs.String("c", "aws", "connection type ('aws' or 'local')")
+	mark := fs.Bool("mark", false, "also mark the book as cancelled, so any messages for it being processed are deleted")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return nil
+	}
+
+	var n NullWriter
+	verboselog := log.New(n, "", log.LstdFlags)
+
+	var conn CancelPipeliner
+	switch *conntype {
+	case "aws":
+		conn = &bookpipeline.AwsConn{Logger: verboselog}
+	case "local":
+		conn = &bookpipeline.LocalConn{Logger: verboselog}
+	default:
+		return fmt.Errorf("Unknown connection type")
+	}
+	err := conn.Init()
+	if err != nil {
+		return fmt.Errorf("Error setting up cloud connection: %v", err)
+	}
+
+	bookname := fs.Arg(0)
+	err = pipeline.CancelBook(conn, bookname, *mark)
+	if err != nil {
+		return err
+	}
+	if *mark {
+		fmt.Println("Removed", bookname, "from every queue and marked it as cancelled")
+		return nil
+	}
+	fmt.Println("Removed", bookname, "from every queue")
+	return nil
+}
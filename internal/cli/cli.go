@@ -0,0 +1,110 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+// Package cli contains the logic of the commands used to manage the
+// book pipeline, so that they can be run either as separate programs,
+// like booktopipeline and lspipeline, or as subcommands of the single
+// bookpipeline-cli program.
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// NullWriter is used so non-verbose logging may be discarded
+type NullWriter bool
+
+func (w NullWriter) Write(p []byte) (n int, err error) {
+	return len(p), nil
+}
+
+// command is a subcommand of bookpipeline-cli. Either run is set, or
+// sub is set to a list of further subcommands.
+type command struct {
+	name string
+	desc string
+	run  func(name string, args []string) error
+	sub  []command
+}
+
+// commands are the subcommands of bookpipeline-cli
+var commands = []command{
+	{name: "upload", desc: "uploads a book and adds it to a queue (booktopipeline)", run: Upload},
+	{name: "get", desc: "downloads the pipeline results for a book (getpipelinebook)", run: Get},
+	{name: "ls", desc: "lists instances, queues and books (lspipeline)", run: Ls},
+	{name: "rm", desc: "removes a book from storage (rmbook)", run: Rm},
+	{name: "cancel", desc: "removes a stuck book's messages from every queue (cancelbook)", run: Cancel},
+	{name: "pause", desc: "stops bookpipeline taking new jobs, or resumes it with -resume", run: Pause},
+	{name: "rewipe", desc: "wipes a prebinarised book again with different settings (rewipe)", run: Rewipe},
+	{name: "spot", desc: "starts new spot instances (spotme)", run: Spot},
+	{name: "verify", desc: "checks every preprocessed page of a book has been OCRed (verifybook)", run: Verify},
+	{name: "queue", desc: "manages queues", sub: []command{
+		{name: "add", desc: "adds a message to a queue (addtoqueue)", run: QueueAdd},
+		{name: "trim", desc: "deletes messages with a prefix from a queue (trimqueue)", run: QueueTrim},
+		{name: "log", desc: "logs all messages in a queue (logwholequeue)", run: QueueLog},
+	}},
+}
+
+// newFlagSet returns a flag set for the command called name, which
+// prints usage, prefixed with the name, if the flags are invalid or
+// help is requested.
+func newFlagSet(name string, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s%s", name, usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// printCommands prints the usage of prog, listing its subcommands
+func printCommands(w io.Writer, prog string, cmds []command) {
+	fmt.Fprintf(w, "Usage: %s command [arguments]\n\nThe commands are:\n\n", prog)
+	for _, c := range cmds {
+		fmt.Fprintf(w, "  %-8s %s\n", c.name, c.desc)
+	}
+	fmt.Fprintf(w, "\nUse \"%s command -h\" for more information about a command.\n", prog)
+}
+
+// dispatch runs the subcommand of prog named by the first of args,
+// passing it the rest of the arguments. Usage is printed to w if no
+// subcommand is given, or help is requested.
+func dispatch(w io.Writer, prog string, cmds []command, args []string) error {
+	if len(args) == 0 {
+		printCommands(w, prog, cmds)
+		return fmt.Errorf("No command given")
+	}
+	switch args[0] {
+	case "-h", "-help", "--help", "help":
+		printCommands(w, prog, cmds)
+		return nil
+	}
+
+	for _, c := range cmds {
+		if c.name != args[0] {
+			continue
+		}
+		name := prog + " " + c.name
+		if c.sub != nil {
+			return dispatch(w, name, c.sub, args[1:])
+		}
+		return c.run(name, args[1:])
+	}
+
+	var names []string
+	for _, c := range cmds {
+		names = append(names, c.name)
+	}
+	return fmt.Errorf("Unknown command %s for %s, should be one of: %s", args[0], prog, strings.Join(names, ", "))
+}
+
+// Run runs the bookpipeline-cli subcommand given in args, which
+// should not include the program name.
+func Run(args []string) error {
+	return dispatch(os.Stderr, "bookpipeline-cli", commands, args)
+}
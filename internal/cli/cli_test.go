@@ -0,0 +1,118 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_dispatch(t *testing.T) {
+	var ran string
+	var ranargs []string
+	record := func(name string, args []string) error {
+		ran = name
+		ranargs = args
+		return nil
+	}
+	cmds := []command{
+		{name: "ls", run: record},
+		{name: "get", run: record},
+		{name: "queue", sub: []command{
+			{name: "add", run: record},
+		}},
+	}
+
+	cases := []struct {
+		args     []string
+		expected string
+		err      string
+	}{
+		{[]string{"ls", "-nobooks"}, "prog ls", ""},
+		{[]string{"get", "book"}, "prog get", ""},
+		{[]string{"queue", "add", "ocrpage", "book"}, "prog queue add", ""},
+		{[]string{"lsx"}, "", "Unknown command lsx"},
+		{[]string{"queue", "frob"}, "", "Unknown command frob"},
+		{[]string{}, "", "No command given"},
+		{[]string{"-h"}, "", ""},
+	}
+
+	for _, c := range cases {
+		t.Run(strings.Join(c.args, " "), func(t *testing.T) {
+			ran = ""
+			ranargs = nil
+			var out bytes.Buffer
+			err := dispatch(&out, "prog", cmds, c.args)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("Expected error containing '%s', got %v", c.err, err)
+				}
+				if ran != "" {
+					t.Fatalf("Expected no command to be run, but %s was", ran)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if ran != c.expected {
+				t.Fatalf("Expected '%s' to be run, got '%s'", c.expected, ran)
+			}
+			if ran == "" {
+				if !strings.Contains(out.String(), "ls") {
+					t.Fatalf("Expected usage listing commands, got %s", out.String())
+				}
+				return
+			}
+			expectedargs := c.args[len(strings.Fields(c.expected))-1:]
+			if strings.Join(ranargs, " ") != strings.Join(expectedargs, " ") {
+				t.Fatalf("Expected arguments %v, got %v", expectedargs, ranargs)
+			}
+		})
+	}
+}
+
+// Test_commands checks that each subcommand of bookpipeline-cli runs
+// the right implementation
+func Test_commands(t *testing.T) {
+	expected := map[string]func(string, []string) error{
+		"upload":     Upload,
+		"get":        Get,
+		"ls":         Ls,
+		"rm":         Rm,
+		"cancel":     Cancel,
+		"pause":      Pause,
+		"rewipe":     Rewipe,
+		"spot":       Spot,
+		"verify":     Verify,
+		"queue add":  QueueAdd,
+		"queue trim": QueueTrim,
+		"queue log":  QueueLog,
+	}
+
+	found := make(map[string]func(string, []string) error)
+	for _, c := range commands {
+		if c.sub == nil {
+			found[c.name] = c.run
+		}
+		for _, s := range c.sub {
+			found[c.name+" "+s.name] = s.run
+		}
+	}
+
+	if len(found) != len(expected) {
+		t.Fatalf("Expected %d commands, got %d", len(expected), len(found))
+	}
+	for name, f := range expected {
+		if found[name] == nil {
+			t.Fatalf("Command %s not found", name)
+		}
+		if reflect.ValueOf(found[name]).Pointer() != reflect.ValueOf(f).Pointer() {
+			t.Fatalf("Command %s runs the wrong implementation", name)
+		}
+	}
+}
@@ -0,0 +1,407 @@
+// Copyright 2019 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"rescribe.xyz/bookpipeline"
+
+	"rescribe.xyz/bookpipeline/internal/pipeline"
+)
+
+const getUsage = ` [-c conn] [-a] [-analyses list] [-combinedhocr] [-exclude pages] [-graph] [-html] [-imgtype type] [-keepalternatives] [-originalnames] [-pdf] [-pdftype type] [-png] [-skipexisting] [-tar] [-zip] [-v] [-loglevel level] bookname
+
+Downloads the pipeline results for a book.
+
+By default this downloads the best hOCR version for each page, the
+binarised and (if available) colour PDF, and the best, conf,
+graph.png and pagesizes analysis files. The pagesizes file lists the
+width and height of the best version of each page. If bookpipeline
+saved the parameters the book was processed with, with -params, they
+are also downloaded, as params.json, and if the book was uploaded with
+a page order manifest it is downloaded as order.json, and if any
+pages were excluded from the PDFs and text the list of them is
+downloaded as exclude.txt.
+
+With -analyses only some of the analysis files are downloaded, given
+as a comma separated list of conf, graph, pagesizes, dpi, params,
+order and exclude, such as -analyses conf to skip the large
+graph.png. An empty list downloads none of them. The conf file is
+always downloaded with -html, as the report is made from it.
+
+With -pdftype only the binarised or colour PDFs are downloaded,
+rather than both. The colour PDFs include the one made from the full
+size images, if bookpipeline made one.
+
+With -png the image of the best version of each page is downloaded.
+By default this is the binarised image the best hOCR was made from,
+but -imgtype can be used to download the original colour image
+instead, or both.
+
+With -tar the archive of the results created by bookpipeline -tar is
+downloaded and unpacked instead of the individual best hOCR pages and
+analysis files, which is much faster for books with many pages.
+
+With -html the best image of each page is also downloaded, and an
+HTML report is created, report.html, which lists the pages from the
+lowest confidence to the highest with a thumbnail of each, so that
+the worst pages can be checked first.
+
+With -originalnames the files from each page, like its best hOCR,
+are renamed to match the original filename of the page image given
+to booktopipeline, rather than the name it was given in the
+pipeline. For example page_0001_bin0.2.hocr could be renamed to
+page_bin0.2.hocr if the original image was page.jpg. Note that the
+names are not changed inside the best and conf files, and that this
+can't be used with -html.
+
+With -keepalternatives the hOCR of every version of each page, one
+for each binarisation threshold, is also downloaded into an
+alternatives directory, so that another version can be consulted
+when the best one is wrong.
+
+With -combinedhocr the best hOCR pages are also combined into a
+single hOCR file for the whole book, named bookname.hocr. Any pages
+listed in the book's exclude.txt, or given with -exclude as a comma
+separated list of page numbers like 0,1,350, are left out of it,
+though their hOCR is still downloaded.
+
+With -zip the files are packaged into a single archive, bookname.zip,
+rather than being saved in a bookname directory. The archive unpacks
+into a bookname directory, just as if -zip wasn't used.
+
+With -a each file which fails to download is retried a few times,
+and if it still fails the rest are downloaded anyway, and the files
+which failed are listed at the end. Running it again with
+-skipexisting then only downloads the files which are missing.
+
+If interrupted, the download stops after removing any partially
+downloaded file.
+`
+
+// writeCombinedHocr combines the hOCR pages listed in the best file
+// in dir into a single file, name.hocr, ordered by filename, leaving
+// out any pages in excl.
+func writeCombinedHocr(dir string, name string, excl pipeline.PageExclusions) error {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "best"))
+	if err != nil {
+		return fmt.Errorf("Error reading best file: %v", err)
+	}
+	var hocrs []string
+	for _, n := range strings.Fields(string(b)) {
+		hocrs = append(hocrs, filepath.Join(dir, n))
+	}
+	sort.Strings(hocrs)
+	hocrs = excl.Filter(hocrs)
+
+	combined, err := pipeline.CombineHocr(hocrs)
+	if err != nil {
+		return err
+	}
+	fn := filepath.Join(dir, name+".hocr")
+	err = ioutil.WriteFile(fn, combined, 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing %s: %v", fn, err)
+	}
+	return nil
+}
+
+// Get downloads the pipeline results for a book, as run by
+// getpipelinebook.
+func Get(name string, args []string) error {
+	fs := newFlagSet(name, getUsage)
+	all := fs.Bool("a", false, "Get all files for book")
+	analyseslist := fs.String("analyses", strings.Join(pipeline.Analyses, ","), "Comma separated list of analysis files to download (from "+strings.Join(pipeline.Analyses, ", ")+")")
+	combinedhocr := fs.Bool("combinedhocr", false, "Also combine the best hOCR pages into a single hOCR file for the book")
+	conntype := fs.String("c", "aws", "connection type ('aws' or 'local')")
+	excludelist := fs.String("exclude", "", "Comma separated list of page numbers to leave out of the combined hOCR, as well as any in the book's exclude.txt")
+	htmlreport := fs.Bool("html", false, "Also download the best image of each page, and create an HTML report listing the pages from the lowest confidence to the highest")
+	imgtype := fs.String("imgtype", pipeline.ImgBinarised, "Which images to download with -png ('binarised', 'colour' or 'both')")
+	keepalternatives := fs.Bool("keepalternatives", false, "Also download the hOCR of every version of each page into an alternatives directory")
+	originalnames := fs.Bool("originalnames", false, "Rename the files from each page to match the original filenames of the page images")
+	graph := fs.Bool("graph", false, "Only download graphs (can be used alongside -pdf)")
+	binarisedpdf := fs.Bool("binarisedpdf", false, "Only download binarised PDF (can be used alongside -graph)")
+	colourpdf := fs.Bool("colourpdf", false, "Only download colour PDF (can be used alongside -graph)")
+	pdf := fs.Bool("pdf", false, "Only download PDFs (can be used alongside -graph)")
+	pdftype := fs.String("pdftype", pipeline.PdfBoth, "Which PDFs to download ('binarised', 'colour' or 'both')")
+	png := fs.Bool("png", false, "Should only download the images of the best pages")
+	skipexisting := fs.Bool("skipexisting", false, "With -a, don't download files which are already in the book directory")
+	tarresults := fs.Bool("tar", false, "Download and unpack the results archive rather than individual best pages and analyses")
+	zipresults := fs.Bool("zip", false, "Save the files in a single zip archive, bookname.zip, rather than a directory")
+	verbose := fs.Bool("v", false, "Verbose")
+	loglevel := fs.String("loglevel", "", "Log only messages at or above this level: error, warn, info or debug")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return nil
+	}
+
+	// the HTML report links to the images by their names in the
+	// pipeline, so would be broken by renaming them
+	if *originalnames && *htmlreport {
+		return fmt.Errorf("-originalnames can't be used with -html")
+	}
+
+	switch *pdftype {
+	case pipeline.PdfBinarised, pipeline.PdfColour, pipeline.PdfBoth:
+	default:
+		return fmt.Errorf("Unknown PDF type %s, should be binarised, colour or both", *pdftype)
+	}
+
+	switch *imgtype {
+	case pipeline.ImgBinarised, pipeline.ImgColour, pipeline.ImgBoth:
+	default:
+		return fmt.Errorf("Unknown image type %s, should be binarised, colour or both", *imgtype)
+	}
+
+	analyses, err := pipeline.ParseAnalyses(*analyseslist)
+	if err != nil {
+		return err
+	}
+	// the HTML report is made from the confidences in the conf file
+	if *htmlreport {
+		hasconf := false
+		for _, a := range analyses {
+			if a == "conf" {
+				hasconf = true
+			}
+		}
+		if !hasconf {
+			analyses = append(analyses, "conf")
+		}
+	}
+
+	exclusions, err := pipeline.ParsePageExclusions(*excludelist)
+	if err != nil {
+		return err
+	}
+
+	verboselog, err := bookpipeline.VerboseLogger(*verbose, *loglevel, os.Stdout, log.LstdFlags)
+	if err != nil {
+		return err
+	}
+
+	var conn pipeline.MinPipeliner
+	switch *conntype {
+	case "aws":
+		conn = &bookpipeline.AwsConn{Logger: verboselog}
+	case "local":
+		conn = &bookpipeline.LocalConn{Logger: verboselog}
+	default:
+		return fmt.Errorf("Unknown connection type")
+	}
+
+	verboselog.Println("Setting up AWS session")
+	err = conn.MinimalInit()
+	if err != nil {
+		return fmt.Errorf("Error setting up cloud connection: %v", err)
+	}
+	verboselog.Println("Finished setting up AWS session")
+
+	bookname := fs.Arg(0)
+
+	// On being asked to stop, cancel any download in progress, so
+	// that no partially downloaded files are left behind.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigc
+		verboselog.Println("Signal received, stopping download")
+		cancel()
+	}()
+
+	// with -zip the files are downloaded to a temporary directory,
+	// which is then zipped
+	dir := bookname
+	if *zipresults {
+		tmp, err := pipeline.MkTempDir("getpipelinebook")
+		if err != nil {
+			return fmt.Errorf("Error creating temporary directory: %v", err)
+		}
+		defer os.RemoveAll(tmp)
+		dir = filepath.Join(tmp, bookname)
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %s: %v", dir, err)
+	}
+
+	// finish zips the downloaded files, if -zip is set
+	finish := func() error {
+		if !*zipresults {
+			return nil
+		}
+		verboselog.Println("Saving files to", bookname+".zip")
+		return pipeline.ZipDir(dir, bookname+".zip")
+	}
+
+	if *all {
+		verboselog.Println("Downloading all files for", bookname)
+		err = pipeline.DownloadAll(ctx, dir, bookname, conn, *skipexisting)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *binarisedpdf {
+		key := filepath.Join(bookname, bookname+".binarised.pdf")
+		fn := filepath.Join(dir, bookname+".binarised.pdf")
+		verboselog.Println("Downloading file", key)
+		err = conn.Download(conn.WIPStorageId(), key, fn)
+		if err != nil {
+			return fmt.Errorf("Failed to download file %s: %v", key, err)
+		}
+	}
+
+	if *colourpdf {
+		key := filepath.Join(bookname, bookname+".colour.pdf")
+		fn := filepath.Join(dir, bookname+".colour.pdf")
+		verboselog.Println("Downloading file", key)
+		err = conn.Download(conn.WIPStorageId(), key, fn)
+		if err != nil {
+			return fmt.Errorf("Failed to download file %s: %v", key, err)
+		}
+	}
+
+	if *graph {
+		key := filepath.Join(bookname, "graph.png")
+		fn := filepath.Join(dir, "graph.png")
+		verboselog.Println("Downloading file", key)
+		err = conn.Download(conn.WIPStorageId(), key, fn)
+		if err != nil {
+			return fmt.Errorf("Failed to download file %s: %v", key, err)
+		}
+	}
+
+	if *pdf {
+		verboselog.Println("Downloading PDFs")
+		err = pipeline.DownloadPdfs(ctx, dir, bookname, conn, *pdftype)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *png {
+		verboselog.Println("Downloading best images")
+		err = pipeline.DownloadBestImages(ctx, dir, bookname, conn, *imgtype)
+		if err != nil {
+			return err
+		}
+	}
+
+	// getBestPages downloads the best hOCR pages, from the results
+	// archive if -tar is set
+	getBestPages := func() error {
+		if *tarresults {
+			verboselog.Println("Downloading and unpacking results archive")
+			return pipeline.DownloadTar(ctx, dir, bookname, conn)
+		}
+		verboselog.Println("Downloading best pages")
+		return pipeline.DownloadBestPages(ctx, dir, bookname, conn)
+	}
+
+	if *combinedhocr {
+		err = getBestPages()
+		if err != nil {
+			return err
+		}
+		// the book's own exclusions are added to any given with
+		// -exclude
+		excludefn := filepath.Join(dir, pipeline.ExcludeFile)
+		err = conn.Download(conn.WIPStorageId(), bookname+"/"+pipeline.ExcludeFile, excludefn)
+		if err == nil {
+			booked, err := pipeline.ReadPageExclusions(excludefn)
+			if err != nil {
+				return err
+			}
+			for n := range booked {
+				exclusions[n] = true
+			}
+		} else {
+			_ = os.Remove(excludefn)
+		}
+		verboselog.Println("Combining best pages")
+		err = writeCombinedHocr(dir, bookname, exclusions)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *binarisedpdf || *colourpdf || *graph || *pdf {
+		return finish()
+	}
+
+	if !*combinedhocr {
+		err = getBestPages()
+		if err != nil {
+			return err
+		}
+	}
+
+	verboselog.Println("Downloading PDFs")
+	pipeline.DownloadPdfs(ctx, dir, bookname, conn, *pdftype)
+	if err != nil {
+		return err
+	}
+
+	verboselog.Println("Downloading analyses")
+	err = pipeline.DownloadSelectedAnalyses(ctx, dir, bookname, conn, analyses)
+	if err != nil {
+		return err
+	}
+
+	if *keepalternatives {
+		verboselog.Println("Downloading alternative versions of pages")
+		err = pipeline.DownloadAlternatives(ctx, dir, bookname, conn)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *htmlreport {
+		verboselog.Println("Downloading best PNGs")
+		err = pipeline.DownloadBestPngs(ctx, dir, bookname, conn)
+		if err != nil {
+			return err
+		}
+		verboselog.Println("Creating HTML report")
+		err = pipeline.WriteHtmlReport(dir, bookname)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *originalnames {
+		verboselog.Println("Renaming files to the original filenames")
+		err = pipeline.DownloadOriginalNames(ctx, dir, bookname, conn)
+		if err != nil {
+			return err
+		}
+		names, err := pipeline.ReadOriginalNames(dir)
+		if err != nil {
+			return err
+		}
+		_, err = pipeline.RenameToOriginals(dir, names)
+		if err != nil {
+			return err
+		}
+	}
+
+	return finish()
+}
@@ -0,0 +1,441 @@
+// Copyright 2019 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"rescribe.xyz/bookpipeline"
+
+	"rescribe.xyz/bookpipeline/internal/pipeline"
+)
+
+const lsUsage = ` [-i key] [-user user] [-ssh-opts opts] [-n num] [-timeout duration] [-exclude names] [-nobooks] [-meta key=value] [-stalled duration]
+
+Lists useful things related to the pipeline.
+
+- Instances running, with how long they have been up and a rough
+  estimate of their cost so far
+- Messages in each queue
+- Books not completed
+- Books done
+- Last n lines of bookpipeline logs from each running instance
+
+Logs are fetched from all instances at once, and any instance which
+doesn't respond within the -timeout duration is skipped. The user
+to log in as can be changed with -user, and any extra arguments for
+ssh given with -ssh-opts, for example -ssh-opts "-p 2222". These come
+before the default of "-o StrictHostKeyChecking no", so can override
+it.
+
+Logs aren't fetched from persistent instances which don't run
+bookpipeline, which are recognised by name. These are the comma
+separated names given with -exclude, which defaults to the value of
+the BOOKPIPELINE_EXCLUDE_INSTANCES environment variable, or
+"workhorse" if that isn't set.
+
+Books not completed are listed with their progress through the
+current stage, if any has been recorded, and are marked as STALLED
+if their progress hasn't been updated within the -stalled duration.
+Books done are marked as NEEDS REVIEW if their average confidence
+was below the -minconf setting of bookpipeline.
+
+The cost estimates use the approximate on-demand prices of common
+instance types, so spot instances will usually have cost less.
+
+If -meta is given only books with that metadata value are listed,
+along with all of their metadata.
+`
+
+type LsPipeliner interface {
+	Init() error
+	PreQueueId() string
+	WipeQueueId() string
+	OCRPageQueueId() string
+	AnalyseQueueId() string
+	GetQueueDetails(url string) (string, string, error)
+	GetInstanceDetails() ([]bookpipeline.InstanceDetails, error)
+	ListObjectsWithMeta(bucket string, prefix string) ([]bookpipeline.ObjMeta, error)
+	ListObjectPrefixes(bucket string) ([]string, error)
+	ListObjects(bucket string, prefix string) ([]string, error)
+	Download(bucket string, key string, fn string) error
+	Log(v ...interface{})
+	WIPStorageId() string
+}
+
+// DefaultExcludedInstances are the names of the instances which logs
+// aren't fetched from, unless BOOKPIPELINE_EXCLUDE_INSTANCES or the
+// -exclude flag is set
+const DefaultExcludedInstances = "workhorse"
+
+// ExcludedInstances returns the names of the instances which logs
+// aren't fetched from, as a comma separated list
+func ExcludedInstances(getenv func(string) string) string {
+	if v := getenv("BOOKPIPELINE_EXCLUDE_INSTANCES"); v != "" {
+		return v
+	}
+	return DefaultExcludedInstances
+}
+
+// ExcludedNames returns the set of names in the comma separated list
+// s
+func ExcludedNames(s string) map[string]bool {
+	names := make(map[string]bool)
+	for _, n := range strings.Split(s, ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			names[n] = true
+		}
+	}
+	return names
+}
+
+// logIPs returns the IP addresses of the running instances which
+// aren't named in the comma separated list excluded, which are the
+// ones to fetch logs from
+func logIPs(instances []bookpipeline.InstanceDetails, excluded string) []string {
+	skip := ExcludedNames(excluded)
+	var ips []string
+	for _, i := range instances {
+		if i.Ip != "" && i.State == "running" && !skip[i.Name] {
+			ips = append(ips, i.Ip)
+		}
+	}
+	return ips
+}
+
+type queueDetails struct {
+	name, numAvailable, numInProgress string
+}
+
+func getInstances(conn LsPipeliner, detailsc chan bookpipeline.InstanceDetails) {
+	details, err := conn.GetInstanceDetails()
+	if err != nil {
+		log.Println("Error getting instance details:", err)
+	}
+	for _, d := range details {
+		detailsc <- d
+	}
+	close(detailsc)
+}
+
+func getQueueDetails(conn LsPipeliner, qdetails chan queueDetails) {
+	queues := []struct{ name, id string }{
+		{"preprocess", conn.PreQueueId()},
+		{"wipeonly", conn.WipeQueueId()},
+		{"ocrpage", conn.OCRPageQueueId()},
+		{"analyse", conn.AnalyseQueueId()},
+	}
+	for _, q := range queues {
+		avail, inprog, err := conn.GetQueueDetails(q.id)
+		if err != nil {
+			log.Println("Error getting queue details:", err)
+		}
+		var qd queueDetails
+		qd.name = q.name
+		qd.numAvailable = avail
+		qd.numInProgress = inprog
+		qdetails <- qd
+	}
+	close(qdetails)
+}
+
+type ObjMetas []bookpipeline.ObjMeta
+
+// used by sort.Sort
+func (o ObjMetas) Len() int {
+	return len(o)
+}
+
+// used by sort.Sort
+func (o ObjMetas) Swap(i, j int) {
+	o[i], o[j] = o[j], o[i]
+}
+
+// used by sort.Sort
+func (o ObjMetas) Less(i, j int) bool {
+	return o[i].Date.Before(o[j].Date)
+}
+
+// getBookStatus returns a list of in progress and done books.
+// It determines this by finding all prefixes, and splitting them
+// into two lists, those which have all of the core results of
+// analysis, as checked by pipeline.ResultsComplete (the done list),
+// and those which do not (the inprogress list). They are sorted
+// according to the date of the done marker or graph.png file, or
+// the date of a random file with the prefix if the book isn't done.
+func getBookStatus(conn LsPipeliner) (inprogress []string, done []string, err error) {
+	prefixes, err := conn.ListObjectPrefixes(conn.WIPStorageId())
+	var inprogressmeta, donemeta ObjMetas
+	if err != nil {
+		log.Println("Error getting object prefixes:", err)
+		return
+	}
+	for _, p := range prefixes {
+		objs, err := conn.ListObjectsWithMeta(conn.WIPStorageId(), p)
+		if err != nil || len(objs) == 0 {
+			inprogressmeta = append(inprogressmeta, bookpipeline.ObjMeta{Name: p})
+			continue
+		}
+		var names []string
+		var marker, graph, latest bookpipeline.ObjMeta
+		for _, o := range objs {
+			names = append(names, o.Name)
+			switch o.Name {
+			case p + pipeline.DoneFile:
+				marker = o
+			case p + "graph.png":
+				graph = o
+			}
+			if o.Date.After(latest.Date) {
+				latest = o
+			}
+		}
+		if pipeline.ResultsComplete(names) {
+			// the done marker is saved last by analysis, or graph.png
+			// for books analysed before the marker was saved
+			finished := latest
+			switch {
+			case marker.Name != "":
+				finished = marker
+			case graph.Name != "":
+				finished = graph
+			}
+			donemeta = append(donemeta, bookpipeline.ObjMeta{Name: p, Date: finished.Date})
+		} else {
+			inprogressmeta = append(inprogressmeta, bookpipeline.ObjMeta{Name: p, Date: objs[0].Date})
+		}
+	}
+	sort.Sort(donemeta)
+	for _, i := range donemeta {
+		done = append(done, strings.TrimSuffix(i.Name, "/"))
+	}
+	sort.Sort(inprogressmeta)
+	for _, i := range inprogressmeta {
+		inprogress = append(inprogress, strings.TrimSuffix(i.Name, "/"))
+	}
+
+	return
+}
+
+// withProgress returns the name of a book along with its progress,
+// if any has been recorded, noting if it has stalled
+func withProgress(conn LsPipeliner, book string, stalled time.Duration) string {
+	p, err := pipeline.GetProgress(conn, book)
+	if err != nil {
+		log.Println("Error getting progress:", err)
+		return book
+	}
+	if p.Updated.IsZero() {
+		return book
+	}
+	s := fmt.Sprintf("%s [%s, updated %s ago]", book, p, time.Since(p.Updated).Round(time.Second))
+	if p.Stalled(time.Now(), stalled) {
+		s += " STALLED"
+	}
+	return s
+}
+
+// withReview returns the name of a done book, noting if it was
+// marked as needing review
+func withReview(conn LsPipeliner, book string) string {
+	review, err := pipeline.NeedsReview(conn, book)
+	if err != nil {
+		log.Println("Error checking whether book needs review:", err)
+		return book
+	}
+	if review {
+		return book + " NEEDS REVIEW"
+	}
+	return book
+}
+
+// filterBooksChan sends each book which has the metadata key set to
+// value to a channel, along with its metadata. If stalled is not 0,
+// the progress of each book is also sent. If done is set, books
+// needing review are marked.
+func filterBooksChan(conn LsPipeliner, books []string, key string, value string, stalled time.Duration, done bool, c chan string) error {
+	matched, err := pipeline.FindBooksWithMeta(conn, books, key, value)
+	if err != nil {
+		return err
+	}
+	for _, m := range matched {
+		var keys []string
+		for k := range m.Meta {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var kv []string
+		for _, k := range keys {
+			kv = append(kv, fmt.Sprintf("%s=%s", k, m.Meta[k]))
+		}
+		name := m.Book
+		if stalled != 0 {
+			name = withProgress(conn, m.Book, stalled)
+		}
+		if done {
+			name = withReview(conn, m.Book)
+		}
+		c <- fmt.Sprintf("%s (%s)", name, strings.Join(kv, ", "))
+	}
+	return nil
+}
+
+// getBookStatusChan runs getBookStatus and sends its results to
+// channels for the done and receive arrays. If metakey is set, only
+// books with that metadata value are sent. Books in progress are sent
+// along with their progress, and marked if it hasn't been updated
+// within the stalled duration.
+func getBookStatusChan(conn LsPipeliner, inprogressc chan string, donec chan string, metakey string, metavalue string, stalled time.Duration) {
+	inprogress, done, err := getBookStatus(conn)
+	if err != nil {
+		log.Println("Error getting book status:", err)
+		close(inprogressc)
+		close(donec)
+		return
+	}
+	if metakey != "" {
+		err = filterBooksChan(conn, inprogress, metakey, metavalue, stalled, false, inprogressc)
+		if err != nil {
+			log.Println("Error filtering books by metadata:", err)
+		}
+		close(inprogressc)
+		err = filterBooksChan(conn, done, metakey, metavalue, 0, true, donec)
+		if err != nil {
+			log.Println("Error filtering books by metadata:", err)
+		}
+		close(donec)
+		return
+	}
+	for _, i := range inprogress {
+		inprogressc <- withProgress(conn, i, stalled)
+	}
+	close(inprogressc)
+	for _, i := range done {
+		donec <- withReview(conn, i)
+	}
+	close(donec)
+}
+
+// Ls lists useful things related to the book pipeline, as run by
+// lspipeline.
+func Ls(name string, args []string) error {
+	fs := newFlagSet(name, lsUsage)
+	keyfile := fs.String("i", "", "private key file for SSH")
+	user := fs.String("user", "admin", "user to log in to instances as with SSH")
+	sshopts := fs.String("ssh-opts", "", "extra arguments to pass to ssh")
+	lognum := fs.Int("n", 5, "number of lines to include in SSH logs")
+	timeout := fs.Duration("timeout", 30*time.Second, "time to wait for SSH logs from each instance")
+	nobooks := fs.Bool("nobooks", false, "disable listing books completed and not completed (which takes some time)")
+	stalled := fs.Duration("stalled", 30*time.Minute, "mark books not completed as stalled if their progress hasn't been updated for this long")
+	meta := fs.String("meta", "", "only list books with this metadata, in the form key=value")
+	exclude := fs.String("exclude", ExcludedInstances(os.Getenv), "comma separated names of instances not to get logs from")
+	fs.Parse(args)
+
+	sshargs, err := pipeline.ParseSSHOpts(*sshopts)
+	if err != nil {
+		return err
+	}
+
+	var metakey, metavalue string
+	if *meta != "" {
+		var err error
+		metakey, metavalue, err = pipeline.ParseMeta(*meta)
+		if err != nil {
+			return err
+		}
+	}
+
+	var verboselog *log.Logger
+	var n NullWriter
+	verboselog = log.New(n, "", 0)
+
+	var conn LsPipeliner
+	conn = &bookpipeline.AwsConn{Logger: verboselog}
+	err = conn.Init()
+	if err != nil {
+		return fmt.Errorf("Failed to set up cloud connection: %v", err)
+	}
+
+	instances := make(chan bookpipeline.InstanceDetails, 100)
+	queues := make(chan queueDetails)
+	inprogress := make(chan string, 100)
+	done := make(chan string, 100)
+	logs := make(chan pipeline.HostLog, 10)
+
+	go getInstances(conn, instances)
+	go getQueueDetails(conn, queues)
+	if !*nobooks {
+		go getBookStatusChan(conn, inprogress, done, metakey, metavalue, *stalled)
+	}
+
+	var alldetails []bookpipeline.InstanceDetails
+	var totalcost float64
+	now := time.Now()
+
+	fmt.Println("# Instances")
+	for i := range instances {
+		alldetails = append(alldetails, i)
+		fmt.Printf("ID: %s, Type: %s, LaunchTime: %s, State: %s", i.Id, i.Type, i.LaunchTime, i.State)
+		if up := i.Uptime(now); up > 0 {
+			fmt.Printf(", Uptime: %s", up.Round(time.Minute))
+			if cost, ok := i.EstimatedCost(now); ok {
+				fmt.Printf(", EstimatedCost: $%.2f", cost)
+				totalcost += cost
+			}
+		}
+		if i.Name != "" {
+			fmt.Printf(", Name: %s", i.Name)
+		}
+		if i.Ip != "" {
+			fmt.Printf(", IP: %s", i.Ip)
+		}
+		if i.Spot != "" {
+			fmt.Printf(", SpotRequest: %s", i.Spot)
+		}
+		fmt.Printf("\n")
+	}
+	if totalcost > 0 {
+		fmt.Printf("Estimated cost of running instances since launch: $%.2f\n", totalcost)
+	}
+
+	ips := logIPs(alldetails, *exclude)
+	sshoptions := pipeline.SSHOptions{User: *user, KeyFile: *keyfile, Opts: sshargs}
+	go pipeline.GetSSHLogs(pipeline.ExecRunner, ips, sshoptions, *lognum, *timeout, logs)
+
+	fmt.Println("\n# Queues")
+	for i := range queues {
+		fmt.Printf("%s: %s available, %s in progress\n", i.name, i.numAvailable, i.numInProgress)
+	}
+
+	if len(ips) > 0 {
+		fmt.Println("\n# Recent logs")
+		for i := range logs {
+			if i.Err != nil {
+				log.Printf("Error getting SSH logs for %s: %s\n", i.Host, i.Err)
+				continue
+			}
+			fmt.Printf("\n%s\n%s", i.Host, i.Log)
+		}
+	}
+
+	if !*nobooks {
+		fmt.Println("\n# Books not completed")
+		for i := range inprogress {
+			fmt.Println(i)
+		}
+
+		fmt.Println("\n# Books done")
+		for i := range done {
+			fmt.Println(i)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"rescribe.xyz/bookpipeline"
+	"rescribe.xyz/bookpipeline/internal/pipeline"
+)
+
+func Test_logIPs(t *testing.T) {
+	instances := []bookpipeline.InstanceDetails{
+		{Name: "workhorse", Ip: "10.0.0.1", State: "running"},
+		{Name: "persistent-ocr", Ip: "10.0.0.2", State: "running"},
+		{Name: "", Ip: "10.0.0.3", State: "running"},
+		{Name: "", Ip: "10.0.0.4", State: "stopped"},
+		{Name: "", Ip: "", State: "running"},
+	}
+
+	cases := []struct {
+		name     string
+		env      string
+		flag     string
+		expected []string
+	}{
+		{"default", "", "", []string{"10.0.0.2", "10.0.0.3"}},
+		{"env", "persistent-ocr", "", []string{"10.0.0.1", "10.0.0.3"}},
+		{"flag", "persistent-ocr", "workhorse, persistent-ocr", []string{"10.0.0.3"}},
+		{"none", "", ",", []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			exclude := ExcludedInstances(func(k string) string {
+				if k == "BOOKPIPELINE_EXCLUDE_INSTANCES" {
+					return c.env
+				}
+				return ""
+			})
+			if c.flag != "" {
+				exclude = c.flag
+			}
+			ips := logIPs(instances, exclude)
+			if strings.Join(ips, " ") != strings.Join(c.expected, " ") {
+				t.Fatalf("Expected IPs %v, got %v", c.expected, ips)
+			}
+		})
+	}
+}
+
+// statusLister is a connection with a fixed set of books, each with
+// the files given
+type statusLister struct {
+	LsPipeliner
+	books map[string][]string
+}
+
+func (s *statusLister) WIPStorageId() string { return "wip" }
+
+func (s *statusLister) ListObjectPrefixes(bucket string) ([]string, error) {
+	var prefixes []string
+	for b := range s.books {
+		prefixes = append(prefixes, b+"/")
+	}
+	return prefixes, nil
+}
+
+func (s *statusLister) ListObjectsWithMeta(bucket string, prefix string) ([]bookpipeline.ObjMeta, error) {
+	book := strings.TrimSuffix(prefix, "/")
+	var objs []bookpipeline.ObjMeta
+	for i, f := range s.books[book] {
+		d := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(len(book)+i) * time.Hour)
+		objs = append(objs, bookpipeline.ObjMeta{Name: prefix + f, Date: d})
+	}
+	return objs, nil
+}
+
+func Test_getBookStatus(t *testing.T) {
+	conn := &statusLister{books: map[string][]string{
+		"done":       {"0001.jpg", "best", "done.colour.pdf", "graph.png"},
+		"nograph":    {"0001.jpg", "best", "nograph.colour.pdf"},
+		"withmarker": {"0001.jpg", pipeline.DoneFile},
+		"graphonly":  {"0001.jpg", "graph.png"},
+		"nopdf":      {"0001.jpg", "best", "graph.png"},
+		"nobest":     {"0001.jpg", "nobest.binarised.pdf", "graph.png"},
+		"started":    {"0001.jpg"},
+	}}
+
+	inprogress, done, err := getBookStatus(conn)
+	if err != nil {
+		t.Fatalf("Error getting book status: %v", err)
+	}
+	if strings.Join(done, " ") != "done nograph withmarker" {
+		t.Fatalf("Expected only the books with all results or the done marker to be done, got %v", done)
+	}
+	if len(inprogress) != 4 {
+		t.Fatalf("Expected 4 books in progress, got %v", inprogress)
+	}
+	for _, b := range []string{"graphonly", "nopdf", "nobest", "started"} {
+		if !strings.Contains(" "+strings.Join(inprogress, " ")+" ", " "+b+" ") {
+			t.Fatalf("Expected %s to be in progress, got %v", b, inprogress)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"fmt"
+	"log"
+
+	"rescribe.xyz/bookpipeline"
+
+	"rescribe.xyz/bookpipeline/internal/pipeline"
+)
+
+const pauseUsage = ` [-c conn] [-resume]
+
+Pauses the pipeline, so that bookpipeline stops taking new jobs from
+the queues, but keeps running. Any jobs already being processed carry
+on as usual. This is useful during maintenance, to avoid stopping and
+restarting instances. Each bookpipeline process checks whether the
+pipeline is paused every minute.
+
+Processing is resumed with -resume.
+`
+
+// PausePipeliner is a pipeline.Pauser which can be initialised
+type PausePipeliner interface {
+	MinimalInit() error
+	pipeline.Pauser
+}
+
+// Pause pauses or resumes the pipeline.
+func Pause(name string, args []string) error {
+	fs := newFlagSet(name, pauseUsage)
+	conntype := fs.String("c", "aws", "connection type ('aws' or 'local')")
+	resume := fs.Bool("resume", false, "resume processing")
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return nil
+	}
+
+	var n NullWriter
+	verboselog := log.New(n, "", log.LstdFlags)
+
+	var conn PausePipeliner
+	switch *conntype {
+	case "aws":
+		conn = &bookpipeline.AwsConn{Logger: verboselog}
+	case "local":
+		conn = &bookpipeline.LocalConn{Logger: verboselog}
+	default:
+		return fmt.Errorf("Unknown connection type")
+	}
+	err := conn.MinimalInit()
+	if err != nil {
+		return fmt.Errorf("Error setting up cloud connection: %v", err)
+	}
+
+	if *resume {
+		err = pipeline.Resume(conn)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Resumed the pipeline")
+		return nil
+	}
+
+	err = pipeline.Pause(conn)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Paused the pipeline; no new jobs will be started until it is resumed with -resume")
+	return nil
+}
@@ -0,0 +1,192 @@
+// Copyright 2019 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"fmt"
+	"log"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+const queueNames = `
+Valid queue names:
+- preprocess
+- wipeonly
+- ocrpage
+- analyse
+`
+
+const queueAddUsage = ` [-c conn] qname msg
+
+Adds a message to a queue.
+
+This is handy to work around bugs when things are misbehaving.
+` + queueNames
+
+const queueTrimUsage = ` qname prefix
+
+Deletes any messages in a queue that match a specified prefix.
+` + queueNames
+
+const queueLogUsage = ` qname
+
+Gets all messages in a queue.
+
+This can be useful for debugging queue issues.
+` + queueNames
+
+// QueueIder returns the ids of the main pipeline queues
+type QueueIder interface {
+	PreQueueId() string
+	WipeQueueId() string
+	OCRPageQueueId() string
+	AnalyseQueueId() string
+}
+
+type QueuePipeliner interface {
+	Init() error
+	AddToQueue(url string, msg string) error
+	QueueIder
+}
+
+type TrimQueuePipeliner interface {
+	Init() error
+	RemovePrefixesFromQueue(url string, prefix string) error
+	QueueIder
+}
+
+type LogQueuePipeliner interface {
+	Init() error
+	LogQueue(url string) error
+	QueueIder
+}
+
+// queueId returns the id of the queue called qname
+func queueId(conn QueueIder, qname string) (string, error) {
+	qdetails := []struct {
+		id, name string
+	}{
+		{conn.PreQueueId(), "preprocess"},
+		{conn.WipeQueueId(), "wipeonly"},
+		{conn.OCRPageQueueId(), "ocrpage"},
+		{conn.AnalyseQueueId(), "analyse"},
+	}
+
+	for _, n := range qdetails {
+		if n.name == qname {
+			return n.id, nil
+		}
+	}
+	return "", fmt.Errorf("Error, no queue named %s", qname)
+}
+
+// QueueAdd adds a message to a queue, as run by addtoqueue.
+func QueueAdd(name string, args []string) error {
+	fs := newFlagSet(name, queueAddUsage)
+	conntype := fs.String("c", "aws", "connection type ('aws' or 'local')")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return nil
+	}
+
+	var n NullWriter
+	quietlog := log.New(n, "", 0)
+	var conn QueuePipeliner
+
+	switch *conntype {
+	case "aws":
+		conn = &bookpipeline.AwsConn{Logger: quietlog}
+	case "local":
+		conn = &bookpipeline.LocalConn{Logger: quietlog}
+	default:
+		return fmt.Errorf("Unknown connection type")
+	}
+
+	err := conn.Init()
+	if err != nil {
+		return fmt.Errorf("Error setting up cloud connection: %v", err)
+	}
+
+	qname := fs.Arg(0)
+	msg := fs.Arg(1)
+
+	qid, err := queueId(conn, qname)
+	if err != nil {
+		return err
+	}
+
+	err = conn.AddToQueue(qid, msg)
+	if err != nil {
+		return fmt.Errorf("Error adding message to %s queue: %v", qname, err)
+	}
+	fmt.Println("Added message to the queue.")
+	return nil
+}
+
+// QueueTrim deletes any messages in a queue that match a specified
+// prefix, as run by trimqueue.
+func QueueTrim(name string, args []string) error {
+	fs := newFlagSet(name, queueTrimUsage)
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return nil
+	}
+
+	var conn TrimQueuePipeliner
+	conn = &bookpipeline.AwsConn{}
+
+	err := conn.Init()
+	if err != nil {
+		return fmt.Errorf("Error setting up cloud connection: %v", err)
+	}
+
+	qname := fs.Arg(0)
+	qid, err := queueId(conn, qname)
+	if err != nil {
+		return err
+	}
+
+	err = conn.RemovePrefixesFromQueue(qid, fs.Arg(1))
+	if err != nil {
+		return fmt.Errorf("Error removing prefixes from queue %s: %v", qname, err)
+	}
+	return nil
+}
+
+// QueueLog gets all messages in a queue, as run by logwholequeue.
+func QueueLog(name string, args []string) error {
+	fs := newFlagSet(name, queueLogUsage)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return nil
+	}
+
+	var conn LogQueuePipeliner
+	conn = &bookpipeline.AwsConn{}
+
+	err := conn.Init()
+	if err != nil {
+		return fmt.Errorf("Error setting up cloud connection: %v", err)
+	}
+
+	qname := fs.Arg(0)
+	qid, err := queueId(conn, qname)
+	if err != nil {
+		return err
+	}
+
+	err = conn.LogQueue(qid)
+	if err != nil {
+		return fmt.Errorf("Error getting queue %s: %v", qname, err)
+	}
+	return nil
+}
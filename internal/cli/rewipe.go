@@ -0,0 +1,100 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"rescribe.xyz/bookpipeline"
+
+	"rescribe.xyz/bookpipeline/internal/pipeline"
+)
+
+const rewipeUsage = ` [-c conn] [-t training] [-hthresh n] [-vthresh n] [-noadapt] [-v] [-loglevel level] bookname
+
+Wipes a prebinarised book again with different settings, for books
+which still have junk at the edges after going through the wipeonly
+queue.
+
+The wiped pages, their hOCR, and the graph are deleted, and the book
+is added to the wipeonly queue again, so that bookpipeline wipes,
+OCRs and analyses it again, choosing the best version of each page
+from the new results. Higher thresholds wipe more aggressively.
+
+By default the thresholds are adapted to the amount of ink on each
+page, and the window used to find the content to the width of each
+page. Thresholds set with -hthresh or -vthresh are used exactly as
+given instead, and -noadapt turns off all adaptation, so that the
+default settings are used as they are for every page. This
+adaptation is only done when wiping prebinarised pages on the
+wipeonly queue; books which are binarised and wiped by the
+preprocess queue always use its fixed wipe settings.
+`
+
+// RewipePipeliner is a pipeline.Rewiper which can be initialised
+type RewipePipeliner interface {
+	Init() error
+	pipeline.Rewiper
+}
+
+// Rewipe sends a prebinarised book back to be wiped again with
+// different settings, as run by rewipe.
+func Rewipe(name string, args []string) error {
+	def := pipeline.DefaultWipeSettings
+	fs := newFlagSet(name, rewipeUsage)
+	conntype := fs.String("c", "aws", "connection type ('aws' or 'local')")
+	training := fs.String("t", "", "Training to use (training filename without the .traineddata part)")
+	hthresh := fs.Float64("hthresh", def.HThresh, "Proportion of dark pixels for an area to be considered content, when finding the content horizontally")
+	vthresh := fs.Float64("vthresh", def.VThresh, "Proportion of dark pixels for an area to be considered content, when finding the content vertically")
+	noadapt := fs.Bool("noadapt", false, "Don't adapt the wipe settings to each page (only used by the wipeonly queue)")
+	verbose := fs.Bool("v", false, "Verbose")
+	loglevel := fs.String("loglevel", "", "Log only messages at or above this level: error, warn, info or debug")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return nil
+	}
+	if *hthresh <= 0 || *hthresh >= 1 || *vthresh <= 0 || *vthresh >= 1 {
+		return fmt.Errorf("Error: -hthresh and -vthresh must be between 0 and 1")
+	}
+
+	verboselog, err := bookpipeline.VerboseLogger(*verbose, *loglevel, os.Stdout, log.LstdFlags)
+	if err != nil {
+		return err
+	}
+
+	var conn RewipePipeliner
+	switch *conntype {
+	case "aws":
+		conn = &bookpipeline.AwsConn{Logger: verboselog}
+	case "local":
+		conn = &bookpipeline.LocalConn{Logger: verboselog}
+	default:
+		return fmt.Errorf("Unknown connection type")
+	}
+	err = conn.Init()
+	if err != nil {
+		return fmt.Errorf("Error setting up cloud connection: %v", err)
+	}
+
+	ws := def
+	ws.HThresh = *hthresh
+	ws.VThresh = *vthresh
+	if *noadapt {
+		ws.AdaptWindow = false
+		ws.AdaptThresh = false
+	}
+	bookname := fs.Arg(0)
+	err = pipeline.Rewipe(conn, bookname, *training, ws)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Sent book to be rewiped:", bookname)
+	return nil
+}
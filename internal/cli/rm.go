@@ -0,0 +1,77 @@
+// Copyright 2020 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"fmt"
+	"log"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+const rmUsage = ` [-dryrun] bookname
+
+Removes a book from cloud storage.
+`
+
+type RmPipeliner interface {
+	MinimalInit() error
+	WIPStorageId() string
+	DeleteObjects(bucket string, keys []string) error
+	ListObjects(bucket string, prefix string) ([]string, error)
+}
+
+// Rm removes a book from cloud storage, as run by rmbook.
+func Rm(name string, args []string) error {
+	fs := newFlagSet(name, rmUsage)
+	dryrun := fs.Bool("dryrun", false, "print which files would be deleted but don't delete")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return nil
+	}
+
+	var n NullWriter
+	verboselog := log.New(n, "", log.LstdFlags)
+
+	var conn RmPipeliner
+	conn = &bookpipeline.AwsConn{Logger: verboselog}
+
+	fmt.Println("Setting up cloud connection")
+	err := conn.MinimalInit()
+	if err != nil {
+		return fmt.Errorf("Error setting up cloud connection: %v", err)
+	}
+
+	bookname := fs.Arg(0) + "/"
+
+	fmt.Println("Getting list of files for book")
+	objs, err := conn.ListObjects(conn.WIPStorageId(), bookname)
+	if err != nil {
+		return fmt.Errorf("Error in listing book items: %v", err)
+	}
+
+	if len(objs) == 0 {
+		return fmt.Errorf("No files found for book: %s", bookname)
+	}
+
+	if *dryrun {
+		fmt.Printf("I would delete these files:\n")
+		for _, v := range objs {
+			fmt.Println(v)
+		}
+		return nil
+	}
+
+	fmt.Println("Deleting all files for book")
+	err = conn.DeleteObjects(conn.WIPStorageId(), objs)
+	if err != nil {
+		return fmt.Errorf("Error deleting book files: %v", err)
+	}
+
+	fmt.Println("Finished deleting files")
+	return nil
+}
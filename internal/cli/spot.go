@@ -0,0 +1,45 @@
+// Copyright 2019 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"fmt"
+	"log"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+const spotUsage = ` [-n num]
+
+Create new spot instances for the book pipeline.
+`
+
+type SpotPipeliner interface {
+	MinimalInit() error
+	StartInstances(n int) error
+}
+
+// Spot creates new spot instances for the book pipeline, as run by
+// spotme.
+func Spot(name string, args []string) error {
+	fs := newFlagSet(name, spotUsage)
+	num := fs.Int("n", 1, "number of instances to start")
+	fs.Parse(args)
+
+	var conn SpotPipeliner
+	conn = &bookpipeline.AwsConn{}
+	err := conn.MinimalInit()
+	if err != nil {
+		return fmt.Errorf("Failed to set up cloud connection: %v", err)
+	}
+
+	log.Println("Starting spot instances")
+	err = conn.StartInstances(*num)
+	if err != nil {
+		return fmt.Errorf("Failed to start a spot instance: %v", err)
+	}
+	log.Println("Spot instance request sent successfully")
+	return nil
+}
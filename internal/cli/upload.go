@@ -0,0 +1,326 @@
+// Copyright 2019 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"rescribe.xyz/bookpipeline"
+
+	"rescribe.xyz/bookpipeline/internal/pipeline"
+)
+
+const uploadUsage = ` [-c conn] [-t training] [-mode mode] [-prebinarised] [-notbinarised] [-nowipe] [-single k] [-binmethod method] [-partsize mb] [-concurrency n] [-checkworkers n] [-meta key=value] [-trainings manifest.json] [-order manifest.json] [-exclude pages] [-dpi dpi] [-v] [-loglevel level] bookdir [bookname]
+
+Uploads the book in bookdir to the S3 'inprogress' bucket and adds it
+to the 'preprocess' or 'wipeonly' SQS queue. The queue to send to is
+autodetected based on the number of .jpg and .png files; more .jpg
+than .png means it will be presumed to be not binarised, and it will
+go to the 'preprocess' queue. The queue can be manually selected by
+using the flags -prebinarised (for the wipeonly queue) or
+-notbinarised (for the preprocess queue).
+
+If the processing a book needs is already known, it can be given
+with -mode, which bypasses the autodetection and the flags above
+entirely. The modes are 'preprocess' (binarise and wipe), 'wipeonly'
+(for prebinarised books), 'nowipe' (binarise without wiping) and
+'colour' (no binarisation or wiping, OCRing each page in greyscale,
+the same as -binmethod none). It can't be combined with
+-prebinarised, -notbinarised, -nowipe or -binmethod.
+
+For books where wiping would remove real content, like maps or
+illustrations which run to the edge of the page, the -nowipe flag
+sends the book to the 'nowipe' queue instead. Pages on this queue are
+binarised at several thresholds in the same way as the preprocess
+queue, but are not wiped. It can't be used with -prebinarised, as
+wiping is the only preprocessing done to prebinarised books.
+
+For clean scans where one binarisation is good enough the -single flag
+can be used, which binarises each page only once, either with the
+Sauvola k value given or with Otsu's method if it is set to 'otsu',
+rather than trying several thresholds and choosing the best.
+
+The binarisation method can be chosen with -binmethod; the default is
+'sauvola', and 'otsu' and 'wolf' can also be used, in which case each
+page is binarised only once. With 'wolf' the k value can be set with
+-single. For born-digital or very clean scans which OCR best without
+binarisation, 'none' can be used, which just converts each page to
+greyscale and OCRs that. Books using 'none' are always sent to the
+'preprocess' queue, and are not wiped.
+
+Before uploading, every image is checked to ensure it can be decoded.
+This is done for several images at once, by default 4, which can be
+changed with -checkworkers.
+
+A hash of the book's images is saved in its metadata, and if another
+book has already been uploaded with the same images a warning is
+printed, to help prevent the same scans being processed twice.
+
+For books which need different trainings for different pages, a
+training manifest can be given with -trainings. This is a JSON file
+mapping page numbers, or ranges of page numbers, to trainings, like
+{"5": "grc", "10-12": "grc"}. Pages are numbered from 0 for the first
+image, in filename order. Any pages not listed use the training set
+with -t, or the default training if that isn't set.
+
+If the pages shouldn't be in filename order, such as when the front
+matter was scanned after the rest of the book, a page order manifest
+can be given with -order. This is a JSON file mapping the filenames
+of the images to their position in the book, like
+{"cover.jpg": 0, "preface.jpg": 1, "page1.jpg": 2}. The PDFs and
+text are then put together in that order, with any images not listed
+coming after those which are, in filename order. It is saved in
+order.json, using the names the images are given in the pipeline.
+
+Pages which shouldn't be in the PDFs or text, such as blank pages or
+duplicate scans, can be listed with -exclude, as a comma separated
+list of page numbers like 0,1,350, numbered from 0 for the first
+image as for -trainings. They are still processed, and their files
+kept, but are left out of the PDFs and text. The list is saved in
+exclude.txt.
+
+The original filename of each image is saved in originalnames.json,
+mapped to the name it is given in the pipeline, so that the results
+can be renamed back to match the originals with getpipelinebook
+-originalnames.
+
+Metadata about the book, like the library it came from or its
+shelfmark, can be added with the -meta flag, which can be repeated.
+This is saved in a meta.json file alongside the images of the book.
+
+If the resolution the book was scanned at is known it can be given
+with -dpi, so that the pages of the PDFs are made at their true
+physical size. With -dpi auto the DPI recorded in each image is used
+instead, which handles books with pages scanned at different
+resolutions; any images without a DPI recorded use the default page
+size. The DPI is saved in a dpi.json file alongside the images of the
+book.
+
+If bookdir is '-', a newline separated list of paths to the page
+images is read from standard input instead, and just those images are
+uploaded, in the order they are listed rather than sorted by name. A
+bookname must be given in this case.
+
+If bookname is omitted the last part of the bookdir is used.
+`
+
+// metaFlags is a flag.Value which collects repeated key=value
+// metadata flags into a map
+type metaFlags map[string]string
+
+func (m metaFlags) String() string {
+	var s []string
+	for k, v := range m {
+		s = append(s, k+"="+v)
+	}
+	return strings.Join(s, " ")
+}
+
+func (m metaFlags) Set(s string) error {
+	k, v, err := pipeline.ParseMeta(s)
+	if err != nil {
+		return err
+	}
+	m[k] = v
+	return nil
+}
+
+// Upload uploads a book to cloud storage and adds the name to a
+// queue ready to be processed by the bookpipeline tool, as run by
+// booktopipeline.
+func Upload(name string, args []string) error {
+	fs := newFlagSet(name, uploadUsage)
+	verbose := fs.Bool("v", false, "Verbose")
+	loglevel := fs.String("loglevel", "", "Log only messages at or above this level: error, warn, info or debug")
+	conntype := fs.String("c", "aws", "connection type ('aws' or 'local')")
+	wipeonly := fs.Bool("prebinarised", false, "Prebinarised: only preprocessing will be to wipe")
+	dobinarise := fs.Bool("notbinarised", false, "Not binarised: all preprocessing will be done including binarisation")
+	nowipe := fs.Bool("nowipe", false, "No wipe: Disable wiping as part of preprocessing")
+	mode := fs.String("mode", "", "Processing mode, bypassing autodetection: 'preprocess', 'wipeonly', 'nowipe' or 'colour'")
+	training := fs.String("t", "", "Training to use (training filename without the .traineddata part)")
+	partsize := fs.Int64("partsize", 0, "Size in MB of each part when uploading large images in several parts (0 for the default, minimum 5)")
+	concurrency := fs.Int("concurrency", 0, "Number of parts of a large image to upload at the same time (0 for the default)")
+	checkworkers := fs.Int("checkworkers", pipeline.DefaultCheckWorkers, "Number of images to check at once")
+	binmethod := fs.String("binmethod", "", "Binarisation method: 'sauvola' (the default), 'otsu', 'wolf' or 'none' (greyscale only)")
+	single := fs.String("single", "", "Single binarisation: binarise only once with this k value (e.g. 0.3), or 'otsu'")
+	trainings := fs.String("trainings", "", "Training manifest file, mapping page numbers to the training to use for them")
+	orderfile := fs.String("order", "", "Page order manifest file, mapping image filenames to their position in the book")
+	excludelist := fs.String("exclude", "", "Comma separated list of page numbers to leave out of the PDFs and text")
+	dpi := fs.String("dpi", "", "DPI the book was scanned at, or 'auto' to use the DPI recorded in each image")
+	meta := make(metaFlags)
+	fs.Var(meta, "meta", "Metadata to save with the book, in the form key=value (can be repeated)")
+
+	fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 3 {
+		fs.Usage()
+		return nil
+	}
+
+	bookdir := fs.Arg(0)
+	var bookname string
+	if fs.NArg() > 1 {
+		bookname = fs.Arg(1)
+	} else if bookdir == "-" {
+		return fmt.Errorf("Error: A bookname must be given when reading images from standard input")
+	} else {
+		bookname = filepath.Base(bookdir)
+	}
+
+	// images is the list of images to upload if bookdir is "-",
+	// otherwise every image in bookdir is uploaded
+	var images []string
+	if bookdir == "-" {
+		var err error
+		images, err = pipeline.ReadImageList(os.Stdin)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx := context.Background()
+
+	verboselog, err := bookpipeline.VerboseLogger(*verbose, *loglevel, os.Stdout, log.LstdFlags)
+	if err != nil {
+		return err
+	}
+
+	var conn pipeline.BookUploader
+	switch *conntype {
+	case "aws":
+		conn = &bookpipeline.AwsConn{Logger: verboselog, UploadPartSize: *partsize * 1024 * 1024, UploadConcurrency: *concurrency}
+	case "local":
+		conn = &bookpipeline.LocalConn{Logger: verboselog}
+	default:
+		return fmt.Errorf("Unknown connection type")
+	}
+	err = conn.Init()
+	if err != nil {
+		return fmt.Errorf("Failed to set up cloud connection: %v", err)
+	}
+
+	job := pipeline.JobMsg{Bookname: bookname, Training: *training, Opts: make(map[string]string)}
+	if *single != "" {
+		job.Opts["single"] = *single
+	}
+	if *binmethod != "" {
+		job.Opts["binmethod"] = *binmethod
+	}
+	var qid string
+	if *mode != "" {
+		if *wipeonly || *dobinarise || *nowipe || *binmethod != "" {
+			return fmt.Errorf("Error: -mode can't be used with -prebinarised, -notbinarised, -nowipe or -binmethod")
+		}
+		qid, err = pipeline.ModeQueue(*mode, conn, &job)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = pipeline.PreprocessFor(job, nil, false)
+	if err != nil {
+		return err
+	}
+
+	opts := pipeline.UploadOptions{
+		Images:       images,
+		CheckWorkers: *checkworkers,
+		Meta:         meta,
+		WarnLog:      log.Default(),
+	}
+	if *dpi == "auto" {
+		opts.AutoDPI = true
+	} else if *dpi != "" {
+		opts.DPI, err = pipeline.ParseDPI(*dpi)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *trainings != "" {
+		b, err := ioutil.ReadFile(*trainings)
+		if err != nil {
+			return fmt.Errorf("Error reading training manifest: %v", err)
+		}
+		opts.Trainings, err = pipeline.ParseTrainingManifest(b)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *orderfile != "" {
+		b, err := ioutil.ReadFile(*orderfile)
+		if err != nil {
+			return fmt.Errorf("Error reading page order manifest: %v", err)
+		}
+		opts.Order, err = pipeline.ParsePageOrder(b)
+		if err != nil {
+			return err
+		}
+	}
+
+	opts.Exclusions, err = pipeline.ParsePageExclusions(*excludelist)
+	if err != nil {
+		return err
+	}
+
+	if qid == "" {
+		qid, err = uploadQueue(conn, bookdir, *wipeonly, *dobinarise, *nowipe, *binmethod)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = pipeline.UploadBook(ctx, conn, bookdir, bookname, opts)
+	if err != nil {
+		return err
+	}
+
+	err = conn.AddToQueue(qid, job.String())
+	if err != nil {
+		return fmt.Errorf("Error adding book to queue: %v", err)
+	}
+
+	var qname string
+	if qid == conn.PreQueueId() {
+		qname = "preprocess"
+	} else if qid == conn.WipeQueueId() {
+		qname = "wipeonly"
+	} else {
+		qname = "nowipe"
+	}
+
+	fmt.Println("Uploaded book to queue", qname)
+	return nil
+}
+
+// uploadQueue returns the queue that a book being uploaded from
+// bookdir should be added to, based on the flags given to Upload.
+func uploadQueue(conn pipeline.Queuer, bookdir string, wipeonly bool, dobinarise bool, nowipe bool, binmethod string) (string, error) {
+	if nowipe && wipeonly {
+		return "", fmt.Errorf("Error: -nowipe can't be used with -prebinarised")
+	}
+
+	qid := pipeline.DetectQueueType(bookdir, conn, nowipe)
+
+	// Flags set override the queue selection
+	if wipeonly {
+		qid = conn.WipeQueueId()
+	}
+	if dobinarise && !nowipe {
+		qid = conn.PreQueueId()
+	}
+	if binmethod == "none" {
+		if wipeonly {
+			return "", fmt.Errorf("Error: -prebinarised can't be used with -binmethod none")
+		}
+		qid = conn.PreQueueId()
+	}
+	return qid, nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"testing"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+// Test_uploadQueue tests that the flags given to Upload select the
+// right queue
+func Test_uploadQueue(t *testing.T) {
+	conn := &bookpipeline.LocalConn{}
+
+	cases := []struct {
+		name       string
+		wipeonly   bool
+		dobinarise bool
+		nowipe     bool
+		binmethod  string
+		expected   string
+		err        bool
+	}{
+		{"default", false, false, false, "", conn.PreQueueId(), false},
+		{"prebinarised", true, false, false, "", conn.WipeQueueId(), false},
+		{"notbinarised", false, true, false, "", conn.PreQueueId(), false},
+		{"nowipe", false, false, true, "", conn.PreNoWipeQueueId(), false},
+		{"nowipenotbinarised", false, true, true, "", conn.PreNoWipeQueueId(), false},
+		{"nowipeprebinarised", true, false, true, "", "", true},
+		{"none", false, false, false, "none", conn.PreQueueId(), false},
+		{"noneprebinarised", true, false, false, "none", "", true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			qid, err := uploadQueue(conn, "bookdir", c.wipeonly, c.dobinarise, c.nowipe, c.binmethod)
+			if c.err {
+				if err == nil {
+					t.Fatalf("Expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if qid != c.expected {
+				t.Fatalf("Expected queue %s, got %s", c.expected, qid)
+			}
+		})
+	}
+}
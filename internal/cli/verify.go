@@ -0,0 +1,92 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"rescribe.xyz/bookpipeline"
+
+	"rescribe.xyz/bookpipeline/internal/pipeline"
+)
+
+const verifyUsage = ` [-c conn] [-psm modes] [-v] [-loglevel level] bookname
+
+Checks that every preprocessed page of a book has been OCRed, listing
+any pages which have no hOCR. The pipeline does the same check before
+sending a book to be analysed, so this is useful to find out why a
+book has stalled before the analyse step.
+
+If the book was OCRed with several page segmentation modes, with
+bookpipeline -psm, the same modes should be given with -psm, so that
+pages missing the hOCR for any of them are listed.
+`
+
+// VerifyPipeliner is a pipeline.Lister which can be initialised
+type VerifyPipeliner interface {
+	MinimalInit() error
+	pipeline.Lister
+}
+
+// Verify checks that every preprocessed page of a book has hOCR, as
+// run by verifybook.
+func Verify(name string, args []string) error {
+	fs := newFlagSet(name, verifyUsage)
+	conntype := fs.String("c", "aws", "connection type ('aws' or 'local')")
+	psmlist := fs.String("psm", "", "comma separated list of page segmentation modes the book was OCRed with (e.g. 3,6,11)")
+	verbose := fs.Bool("v", false, "Verbose")
+	loglevel := fs.String("loglevel", "", "Log only messages at or above this level: error, warn, info or debug")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return nil
+	}
+
+	var psms []int
+	if *psmlist != "" {
+		var err error
+		psms, err = pipeline.ParsePsms(*psmlist)
+		if err != nil {
+			return err
+		}
+	}
+
+	verboselog, err := bookpipeline.VerboseLogger(*verbose, *loglevel, os.Stdout, log.LstdFlags)
+	if err != nil {
+		return err
+	}
+
+	var conn VerifyPipeliner
+	switch *conntype {
+	case "aws":
+		conn = &bookpipeline.AwsConn{Logger: verboselog}
+	case "local":
+		conn = &bookpipeline.LocalConn{Logger: verboselog}
+	default:
+		return fmt.Errorf("Unknown connection type")
+	}
+	err = conn.MinimalInit()
+	if err != nil {
+		return fmt.Errorf("Error setting up cloud connection: %v", err)
+	}
+
+	bookname := fs.Arg(0)
+	missing, err := pipeline.VerifyPagesComplete(conn, bookname, psms)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		for _, pg := range missing {
+			fmt.Println(pg)
+		}
+		return fmt.Errorf("%d pages of %s have not been OCRed", len(missing), bookname)
+	}
+
+	fmt.Println("All pages of", bookname, "have been OCRed")
+	return nil
+}
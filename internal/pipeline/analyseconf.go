@@ -0,0 +1,129 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+// hocrConf is the confidence of one hOCR file, as found by
+// getHocrConf
+type hocrConf struct {
+	page  string
+	conf  *bookpipeline.Conf
+	score float64
+	// skip is set for hOCRs with no words, which are left out of
+	// the analysis
+	skip bool
+	err  error
+}
+
+// getHocrConf finds the confidence of an hOCR file of the book
+// bookname, and the page it is a version of, and scores it for
+// choosing the best version of the page, using the word list in
+// dicts for the training it was OCRed with, if there is one. As with
+// AnalyseOptions.Bookname, if bookname is empty the name of the
+// directory of the hOCR file is used.
+func getHocrConf(conn Downloader, bookname string, path string, dicts dictionaries, lineconf bool, logger *log.Logger) hocrConf {
+	// books OCRed before invalid UTF-8 was replaced during OCR
+	// may still contain some, which would stop them being parsed
+	lines, err := SanitiseHocrFile(path)
+	if err != nil {
+		return hocrConf{err: err}
+	}
+	if len(lines) > 0 {
+		logger.Printf("Replaced invalid UTF-8 in %s on lines %v\n", path, lines)
+	}
+	params, ok := getOcrParams(conn, bookname, path)
+	// the TSV saved during OCR is used if there is one, as it is
+	// much quicker to read than the hOCR, but only if the OCR
+	// parameters show it was saved along with this hOCR, so that one
+	// left from an earlier OCR of the page is never used
+	var avg float64
+	var text string
+	var tsv string
+	var hastsv bool
+	if ok && params.Tsv {
+		tsv, hastsv = getTsv(conn, bookname, path)
+	}
+	if hastsv {
+		logger.Println("Calculating confidence for", path, "from", tsv)
+		avg, text, err = getTsvConfText(tsv, lineconf)
+	} else {
+		logger.Println("Calculating confidence for", path)
+		avg, text, err = getConfText(path, lineconf)
+	}
+	if err != nil && err.Error() == "No words found" {
+		return hocrConf{skip: true}
+	}
+	if err != nil {
+		return hocrConf{err: fmt.Errorf("Error retrieving confidence for %s: %s", path, err)}
+	}
+	r := hocrConf{score: avg, conf: &bookpipeline.Conf{Path: path, Conf: avg}}
+	if words := dicts.forTraining(params.Training); words != nil {
+		// weight the confidence and dictionary match equally
+		r.score = (avg + words.ratio(text)*100) / 2
+	}
+	if ok {
+		r.page = params.Page
+		r.conf.Code = params.code()
+		return r
+	}
+	// books OCRed before the OCR parameters were saved with each
+	// hOCR have the binarisation in the filename
+	base := filepath.Base(path)
+	codestart := strings.Index(base, "_bin")
+	if codestart == -1 {
+		return hocrConf{err: fmt.Errorf("No OCR parameters found for %s, and its name doesn't include _bin", path)}
+	}
+	r.page = base[0:codestart]
+	r.conf.Code = base[codestart:]
+	return r
+}
+
+// getHocrConfs finds the confidence of each hOCR file read from
+// toanalyse with getHocrConf, using the given number of workers at
+// once. The results are sent to the returned channel, in no
+// particular order, which is closed once toanalyse has been
+// consumed. After an error no more files are processed, though
+// toanalyse is still consumed so it isn't blocked.
+func getHocrConfs(ctx context.Context, conn Downloader, bookname string, toanalyse chan string, workers int, dicts dictionaries, lineconf bool, logger *log.Logger) chan hocrConf {
+	if workers < 1 {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	results := make(chan hocrConf)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range toanalyse {
+				if ctx.Err() != nil {
+					results <- hocrConf{err: ctx.Err()}
+					continue
+				}
+				r := getHocrConf(conn, bookname, path, dicts, lineconf, logger)
+				if r.err != nil {
+					cancel()
+				}
+				results <- r
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		cancel()
+		close(results)
+	}()
+	return results
+}
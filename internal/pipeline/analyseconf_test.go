@@ -0,0 +1,141 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+// writeSampleHocrs saves a copy of the sample hOCR for each of
+// several binarisations of a number of pages
+func writeSampleHocrs(dir string, pages int) ([]string, error) {
+	b, err := ioutil.ReadFile(sampleHocr)
+	if err != nil {
+		return nil, err
+	}
+	var hocrs []string
+	for pg := 1; pg <= pages; pg++ {
+		for _, bin := range []string{"0.1", "0.2", "0.3"} {
+			fn := filepath.Join(dir, fmt.Sprintf("%04d_bin%s.hocr", pg, bin))
+			err = ioutil.WriteFile(fn, b, 0644)
+			if err != nil {
+				return nil, err
+			}
+			hocrs = append(hocrs, fn)
+		}
+	}
+	return hocrs, nil
+}
+
+// Test_AnalyseConfWorkers tests that Analyse gives the same results
+// however many workers calculate the confidences
+func Test_AnalyseConfWorkers(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	conn := newTestConn(t, vlog)
+
+	dir, err := ioutil.TempDir("", "confworkerstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var hocrs []string
+	for pg := 1; pg <= 10; pg++ {
+		for i, bin := range []string{"0.1", "0.2", "0.3"} {
+			fn := filepath.Join(dir, fmt.Sprintf("%04d_bin%s.hocr", pg, bin))
+			err = writeHocr(fn, 50+(pg*7+i*13)%40, "some", "words")
+			if err != nil {
+				t.Fatalf("Could not write hOCR file %s: %v", fn, err)
+			}
+			hocrs = append(hocrs, fn)
+		}
+	}
+
+	var serial []string
+	for _, workers := range []int{0, 1, 4, 16} {
+		t.Run(fmt.Sprintf("%d", workers), func(t *testing.T) {
+			_, err := runAnalyse(Analyse(conn, AnalyseOptions{ConfWorkers: workers}), hocrs, vlog)
+			if err != nil {
+				t.Fatalf("Error in Analyse: %v\nLog: %s", err, slog.log)
+			}
+			var results []string
+			for _, name := range []string{"best", "conf"} {
+				b, err := ioutil.ReadFile(filepath.Join(dir, name))
+				if err != nil {
+					t.Fatalf("Could not read %s file: %v", name, err)
+				}
+				results = append(results, string(b))
+			}
+			if serial == nil {
+				serial = results
+				return
+			}
+			for i := range results {
+				if results[i] != serial[i] {
+					t.Fatalf("Expected the same results as serial analysis:\n%s\ngot:\n%s", serial[i], results[i])
+				}
+			}
+		})
+	}
+
+	t.Run("error", func(t *testing.T) {
+		fn := filepath.Join(dir, "nobinarisation.hocr")
+		err := writeHocr(fn, 80, "some", "words")
+		if err != nil {
+			t.Fatalf("Could not write hOCR file %s: %v", fn, err)
+		}
+		_, err = runAnalyse(Analyse(conn, AnalyseOptions{ConfWorkers: 4}), append(hocrs, fn), vlog)
+		if err == nil {
+			t.Fatalf("Expected an error analysing an hOCR without a binarisation")
+		}
+	})
+}
+
+func BenchmarkGetHocrConfs(b *testing.B) {
+	dir, err := ioutil.TempDir("", "confworkersbench")
+	if err != nil {
+		b.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	hocrs, err := writeSampleHocrs(dir, 20)
+	if err != nil {
+		b.Fatalf("Could not write hOCR files: %v", err)
+	}
+	conn := &bookpipeline.LocalConn{Logger: log.New(ioutil.Discard, "", 0)}
+	err = conn.Init()
+	if err != nil {
+		b.Fatalf("Could not initialise local connection: %v", err)
+	}
+
+	for _, workers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("workers%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				toanalyse := make(chan string)
+				go func() {
+					for _, h := range hocrs {
+						toanalyse <- h
+					}
+					close(toanalyse)
+				}()
+				for r := range getHocrConfs(context.Background(), conn, "", toanalyse, workers, nil, false, conn.Logger) {
+					if r.err != nil {
+						b.Fatalf("Error getting confidence: %v", r.err)
+					}
+				}
+			}
+		})
+	}
+}
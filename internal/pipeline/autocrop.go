@@ -0,0 +1,90 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"fmt"
+	"image"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+)
+
+// AutoCrop crops an image to the bounding box of its ink, with pad
+// pixels of space around it where the image allows, so that large
+// blank margins don't slow down OCR or confuse its layout analysis.
+// Ink is any pixel no lighter than the threshold found with Otsu's
+// method, so this works with both binarised and greyscale images.
+// The cropped image shares its pixels with img and keeps its
+// coordinates, so its Bounds().Min is the offset of the crop. If
+// there is no ink img is returned unchanged.
+func AutoCrop(img *image.Gray, pad int) *image.Gray {
+	thresh := otsuThreshold(img)
+	b := img.Bounds()
+	ink := image.Rectangle{}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if img.GrayAt(x, y).Y > thresh {
+				continue
+			}
+			ink = ink.Union(image.Rect(x, y, x+1, y+1))
+		}
+	}
+	if ink.Empty() {
+		return img
+	}
+	return img.SubImage(ink.Inset(-pad).Intersect(b)).(*image.Gray)
+}
+
+// cropForOcr crops the image at inPath with AutoCrop, saving the
+// result as a png at outPath. It returns the offset of the crop and
+// the size of the original image, as needed by offsetHocrFile.
+func cropForOcr(inPath string, outPath string, pad int) (image.Point, image.Point, error) {
+	gray, err := loadGray(inPath)
+	if err != nil {
+		return image.Point{}, image.Point{}, err
+	}
+	cropped := AutoCrop(gray, pad)
+	err = saveGray(outPath, cropped)
+	if err != nil {
+		return image.Point{}, image.Point{}, err
+	}
+	return cropped.Bounds().Min, gray.Bounds().Size(), nil
+}
+
+var hocrBboxRe = regexp.MustCompile(`bbox (-?[0-9]+) (-?[0-9]+) (-?[0-9]+) (-?[0-9]+)`)
+
+var hocrPageRe = regexp.MustCompile(`<[^>]*class=['"]ocr_page['"][^>]*>`)
+
+// offsetHocr moves every bbox in an hOCR document by off, so that an
+// hOCR of a cropped image matches the original image, which is of
+// the size given. The bbox of the ocr_page is set to cover the whole
+// original image, as it is used to find the size of the image the
+// hOCR was made from.
+func offsetHocr(b []byte, off image.Point, size image.Point) []byte {
+	b = hocrBboxRe.ReplaceAllFunc(b, func(m []byte) []byte {
+		var c [4]int
+		for i, s := range hocrBboxRe.FindSubmatch(m)[1:] {
+			c[i], _ = strconv.Atoi(string(s))
+		}
+		return []byte(fmt.Sprintf("bbox %d %d %d %d", c[0]+off.X, c[1]+off.Y, c[2]+off.X, c[3]+off.Y))
+	})
+	return hocrPageRe.ReplaceAllFunc(b, func(m []byte) []byte {
+		return hocrBboxRe.ReplaceAll(m, []byte(fmt.Sprintf("bbox 0 0 %d %d", size.X, size.Y)))
+	})
+}
+
+// offsetHocrFile moves every bbox in an hOCR file with offsetHocr
+func offsetHocrFile(fn string, off image.Point, size image.Point) error {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return fmt.Errorf("Error reading hOCR %s: %v", fn, err)
+	}
+	err = ioutil.WriteFile(fn, offsetHocr(b, off, size), 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing hOCR %s: %v", fn, err)
+	}
+	return nil
+}
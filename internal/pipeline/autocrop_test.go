@@ -0,0 +1,181 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// cropWords are the positions of the "words" in the page used to
+// test AutoCrop
+var cropWords = []image.Rectangle{
+	image.Rect(50, 60, 80, 75),
+	image.Rect(120, 200, 150, 215),
+}
+
+// cropPage creates a white page with a black block for each of
+// cropWords
+func cropPage() *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, 200, 300))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.Gray{255}), image.Point{}, draw.Src)
+	for _, w := range cropWords {
+		draw.Draw(img, w, image.NewUniform(color.Gray{0}), image.Point{}, draw.Src)
+	}
+	return img
+}
+
+func Test_AutoCrop(t *testing.T) {
+	cases := []struct {
+		name     string
+		pad      int
+		expected image.Rectangle
+	}{
+		{"nopad", 0, image.Rect(50, 60, 150, 215)},
+		{"pad", 10, image.Rect(40, 50, 160, 225)},
+		{"padpastedges", 100, image.Rect(0, 0, 200, 300)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cropped := AutoCrop(cropPage(), c.pad)
+			if cropped.Bounds() != c.expected {
+				t.Fatalf("Expected crop to %v, got %v", c.expected, cropped.Bounds())
+			}
+		})
+	}
+
+	t.Run("blank", func(t *testing.T) {
+		img := image.NewGray(image.Rect(0, 0, 100, 100))
+		draw.Draw(img, img.Bounds(), image.NewUniform(color.Gray{255}), image.Point{}, draw.Src)
+		cropped := AutoCrop(img, 10)
+		if cropped.Bounds() != img.Bounds() {
+			t.Fatalf("Expected blank image not to be cropped, got %v", cropped.Bounds())
+		}
+	})
+}
+
+// hocrBboxes returns the bbox of each word in an hOCR document
+func hocrBboxes(b []byte) []image.Rectangle {
+	var boxes []image.Rectangle
+	for _, l := range strings.Split(string(b), "\n") {
+		if !strings.Contains(l, "ocrx_word") {
+			continue
+		}
+		var r image.Rectangle
+		m := hocrBboxRe.FindString(l)
+		_, err := fmt.Sscanf(m, "bbox %d %d %d %d", &r.Min.X, &r.Min.Y, &r.Max.X, &r.Max.Y)
+		if err == nil {
+			boxes = append(boxes, r)
+		}
+	}
+	return boxes
+}
+
+// cropHocr returns an hOCR document for a page of the size given,
+// with a word at each of the boxes
+func cropHocr(size image.Point, boxes []image.Rectangle) []byte {
+	s := fmt.Sprintf("<div class='ocr_page' id='page_1' title='image \"page.png\"; bbox 0 0 %d %d; ppageno 0'>\n", size.X, size.Y)
+	for i, r := range boxes {
+		s += fmt.Sprintf("<span class='ocrx_word' id='word_1_%d' title='bbox %d %d %d %d; x_wconf 90'>word</span>\n", i+1, r.Min.X, r.Min.Y, r.Max.X, r.Max.Y)
+	}
+	return []byte(s + "</div>\n")
+}
+
+// Test_AutoCropOffset tests that the words in the hOCR of a cropped
+// page are moved back to their positions in the uncropped page
+func Test_AutoCropOffset(t *testing.T) {
+	page := cropPage()
+	cropped := AutoCrop(page, 10)
+	off := cropped.Bounds().Min
+
+	// the words as they would be found by OCRing the cropped image
+	var boxes []image.Rectangle
+	for _, w := range cropWords {
+		boxes = append(boxes, w.Sub(off))
+	}
+
+	b := offsetHocr(cropHocr(cropped.Bounds().Size(), boxes), off, page.Bounds().Size())
+	got := hocrBboxes(b)
+	if len(got) != len(cropWords) {
+		t.Fatalf("Expected %d words, got %v", len(cropWords), got)
+	}
+	for i, w := range cropWords {
+		if got[i] != w {
+			t.Fatalf("Expected word %d at %v, got %v", i, w, got[i])
+		}
+	}
+	if !strings.Contains(string(b), "bbox 0 0 200 300;") {
+		t.Fatalf("Expected page bbox to cover the uncropped page, got:\n%s", b)
+	}
+}
+
+// Test_OcrAutoCrop tests that OCR with AutoCrop OCRs the cropped
+// page, and saves hOCR matching the uncropped page
+func Test_OcrAutoCrop(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test which uses a shell script")
+	}
+
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	dir, err := ioutil.TempDir("", "autocroptest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	img := filepath.Join(dir, "0001_bin0.2.png")
+	err = saveGray(img, cropPage())
+	if err != nil {
+		t.Fatalf("Could not save image: %v", err)
+	}
+
+	// the fake tesseract fails unless it is given the cropped image,
+	// and finds the first word where it is in that image
+	off := image.Pt(40, 50)
+	hocr := cropHocr(image.Pt(120, 175), []image.Rectangle{cropWords[0].Sub(off)})
+	tesscmd := filepath.Join(dir, "tesseract")
+	script := fmt.Sprintf("#!/bin/sh\ncase \"$3\" in *.crop.png) ;; *) exit 1;; esac\ncat > \"$4.hocr\" <<'EOF'\n%sEOF\n", hocr)
+	err = ioutil.WriteFile(tesscmd, []byte(script), 0755)
+	if err != nil {
+		t.Fatalf("Could not write fake tesseract: %v", err)
+	}
+
+	toocr := make(chan string, 1)
+	up := make(chan string, 1)
+	errc := make(chan error, 1)
+	toocr <- img
+	close(toocr)
+	OcrWithOptions("eng", tesscmd, OcrOptions{AutoCrop: true, CropPad: 10})(context.Background(), toocr, up, errc, vlog)
+	select {
+	case err = <-errc:
+		t.Fatalf("Error running OCR: %v\nLog: %s", err, slog.log)
+	default:
+	}
+
+	b, err := ioutil.ReadFile(<-up)
+	if err != nil {
+		t.Fatalf("Could not read hOCR: %v", err)
+	}
+	got := hocrBboxes(b)
+	if len(got) != 1 || got[0] != cropWords[0] {
+		t.Fatalf("Expected word at %v, got %v", cropWords[0], got)
+	}
+	_, err = os.Stat(filepath.Join(dir, "0001_bin0.2.crop.png"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("Expected cropped image to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,290 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// otsuThreshold finds the threshold which best separates the grey
+// levels of an image into two classes, using Otsu's method.
+func otsuThreshold(img *image.Gray) uint8 {
+	var hist [256]int
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			hist[img.GrayAt(x, y).Y]++
+		}
+	}
+
+	total := b.Dx() * b.Dy()
+	var sum float64
+	for i, n := range hist {
+		sum += float64(i * n)
+	}
+
+	var sumB, maxVar float64
+	var wB int
+	var thresh uint8
+	for i, n := range hist {
+		wB += n
+		if wB == 0 {
+			continue
+		}
+		wF := total - wB
+		if wF == 0 {
+			break
+		}
+		sumB += float64(i * n)
+		mB := sumB / float64(wB)
+		mF := (sum - sumB) / float64(wF)
+		v := float64(wB) * float64(wF) * (mB - mF) * (mB - mF)
+		if v > maxVar {
+			maxVar = v
+			thresh = uint8(i)
+		}
+	}
+	return thresh
+}
+
+// loadGray loads an image, converting it to greyscale
+func loadGray(path string) (*image.Gray, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening image %s: %v", path, err)
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding image %s: %v", path, err)
+	}
+
+	b := img.Bounds()
+	gray := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(gray, gray.Bounds(), img, b.Min, draw.Src)
+	return gray, nil
+}
+
+// saveGray saves a greyscale image as a png
+func saveGray(path string, img *image.Gray) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("Error creating file %s: %v", path, err)
+	}
+	defer out.Close()
+	err = png.Encode(out, img)
+	if err != nil {
+		return fmt.Errorf("Error encoding image %s: %v", path, err)
+	}
+	return nil
+}
+
+// BinariseOtsu binarises an image with a single global threshold
+// found with Otsu's method, saving the result as a png.
+func BinariseOtsu(inPath string, outPath string) error {
+	gray, err := loadGray(inPath)
+	if err != nil {
+		return err
+	}
+
+	thresh := otsuThreshold(gray)
+	for i, v := range gray.Pix {
+		if v > thresh {
+			gray.Pix[i] = 255
+		} else {
+			gray.Pix[i] = 0
+		}
+	}
+
+	return saveGray(outPath, gray)
+}
+
+// wolfThresholds finds the threshold for each pixel of an image with
+// the method of Wolf and Jolion, which adapts Sauvola's method to
+// cope better with low contrast images. Each threshold is based on
+// the mean and standard deviation of the pixels in a window around
+// it, normalised by the darkest pixel and the greatest standard
+// deviation in the image.
+func wolfThresholds(img *image.Gray, k float64, wsize int) []float64 {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	// integral images of the values and their squares, with an extra
+	// row and column of zeros to simplify the sums
+	sum := make([]float64, (w+1)*(h+1))
+	sqsum := make([]float64, (w+1)*(h+1))
+	min := 255.0
+	for y := 0; y < h; y++ {
+		var rowsum, rowsqsum float64
+		for x := 0; x < w; x++ {
+			v := float64(img.Pix[y*img.Stride+x])
+			if v < min {
+				min = v
+			}
+			rowsum += v
+			rowsqsum += v * v
+			sum[(y+1)*(w+1)+x+1] = sum[y*(w+1)+x+1] + rowsum
+			sqsum[(y+1)*(w+1)+x+1] = sqsum[y*(w+1)+x+1] + rowsqsum
+		}
+	}
+
+	means := make([]float64, w*h)
+	devs := make([]float64, w*h)
+	maxdev := 0.0
+	half := wsize / 2
+	for y := 0; y < h; y++ {
+		y0, y1 := y-half, y+half+1
+		if y0 < 0 {
+			y0 = 0
+		}
+		if y1 > h {
+			y1 = h
+		}
+		for x := 0; x < w; x++ {
+			x0, x1 := x-half, x+half+1
+			if x0 < 0 {
+				x0 = 0
+			}
+			if x1 > w {
+				x1 = w
+			}
+			n := float64((x1 - x0) * (y1 - y0))
+			s := sum[y1*(w+1)+x1] - sum[y0*(w+1)+x1] - sum[y1*(w+1)+x0] + sum[y0*(w+1)+x0]
+			sq := sqsum[y1*(w+1)+x1] - sqsum[y0*(w+1)+x1] - sqsum[y1*(w+1)+x0] + sqsum[y0*(w+1)+x0]
+			mean := s / n
+			variance := sq/n - mean*mean
+			dev := 0.0
+			if variance > 0 {
+				dev = math.Sqrt(variance)
+			}
+			means[y*w+x] = mean
+			devs[y*w+x] = dev
+			if dev > maxdev {
+				maxdev = dev
+			}
+		}
+	}
+
+	thresholds := make([]float64, w*h)
+	for i := range thresholds {
+		norm := 0.0
+		if maxdev > 0 {
+			norm = devs[i] / maxdev
+		}
+		thresholds[i] = means[i] - k*(1-norm)*(means[i]-min)
+	}
+	return thresholds
+}
+
+// BinariseWolf binarises an image with the method of Wolf and
+// Jolion, using the k value given, saving the result as a png. The
+// window size is based on the size of the image.
+func BinariseWolf(inPath string, outPath string, k float64) error {
+	gray, err := loadGray(inPath)
+	if err != nil {
+		return err
+	}
+
+	b := gray.Bounds()
+	wsize := b.Dx() / 60
+	if wsize < 15 {
+		wsize = 15
+	}
+	thresholds := wolfThresholds(gray, k, wsize)
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			i := y*gray.Stride + x
+			if float64(gray.Pix[i]) > thresholds[y*b.Dx()+x] {
+				gray.Pix[i] = 255
+			} else {
+				gray.Pix[i] = 0
+			}
+		}
+	}
+
+	return saveGray(outPath, gray)
+}
+
+// preprocessSingle binarises each page once with the binarise
+// function, saving it with the suffix given, and then wipes it with
+// singleWipeSettings unless nowipe is set.
+func preprocessSingle(binarise func(inPath string, outPath string) error, suffix string, nowipe bool) func(context.Context, chan string, chan string, chan error, *log.Logger) {
+	return func(ctx context.Context, pre chan string, up chan string, errc chan error, logger *log.Logger) {
+		for path := range pre {
+			select {
+			case <-ctx.Done():
+				for range pre {
+				} // consume the rest of the receiving channel so it isn't blocked
+				errc <- ctx.Err()
+				return
+			default:
+			}
+			logger.Println("Binarising", path)
+			outpath := strings.TrimSuffix(path, filepath.Ext(path)) + suffix
+			err := binarise(path, outpath)
+			if err == nil && !nowipe {
+				logger.Println("Wiping", outpath)
+				err = wipeFile(outpath, outpath, singleWipeSettings())
+			}
+			if err != nil {
+				for range pre {
+				} // consume the rest of the receiving channel so it isn't blocked
+				errc <- err
+				return
+			}
+			_ = os.Remove(path)
+			up <- outpath
+		}
+		close(up)
+	}
+}
+
+// Greyscale converts an image to greyscale without binarising it,
+// saving the result as a png.
+func Greyscale(inPath string, outPath string) error {
+	gray, err := loadGray(inPath)
+	if err != nil {
+		return err
+	}
+	return saveGray(outPath, gray)
+}
+
+// PreprocessGrey converts each page to greyscale, skipping
+// binarisation entirely. This is for born-digital or very clean scans,
+// which can OCR better without binarisation. The pages are not wiped,
+// as wiping relies on them being binarised. As with the other single
+// pass preprocessing there is only one version of each page for
+// Analyse to choose from.
+func PreprocessGrey() func(context.Context, chan string, chan string, chan error, *log.Logger) {
+	return preprocessSingle(Greyscale, "_bin0.0.png", true)
+}
+
+// PreprocessOtsu binarises each page once using Otsu's method, and
+// then wipes it unless nowipe is set. This is a faster alternative to
+// Preprocess for clean scans, where a single global threshold is
+// fine and there is no need to compare several binarisations.
+func PreprocessOtsu(nowipe bool) func(context.Context, chan string, chan string, chan error, *log.Logger) {
+	return preprocessSingle(BinariseOtsu, "_bin0.0.png", nowipe)
+}
+
+// PreprocessWolf binarises each page once using the method of Wolf
+// and Jolion with the k value given, and then wipes it unless nowipe
+// is set.
+func PreprocessWolf(k float64, nowipe bool) func(context.Context, chan string, chan string, chan error, *log.Logger) {
+	binarise := func(inPath string, outPath string) error {
+		return BinariseWolf(inPath, outPath, k)
+	}
+	return preprocessSingle(binarise, fmt.Sprintf("_bin%.1f.png", k), nowipe)
+}
@@ -0,0 +1,286 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func Test_otsuThreshold(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 10, 10))
+	for i := range img.Pix {
+		if i < 30 {
+			img.Pix[i] = 40
+		} else {
+			img.Pix[i] = 200
+		}
+	}
+	thresh := otsuThreshold(img)
+	if thresh < 40 || thresh >= 200 {
+		t.Fatalf("Threshold %d does not separate the two grey levels", thresh)
+	}
+}
+
+// Test_PreprocessOtsu tests that the single pass preprocessing
+// produces exactly one binarised version of a page
+func Test_PreprocessOtsu(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	// the directory name contains a dot, which must be kept in the
+	// name of the binarised image
+	dir, err := ioutil.TempDir("", "bookpipeline.test")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b, err := ioutil.ReadFile("testdata/good/1.png")
+	if err != nil {
+		t.Fatalf("Could not read test image: %v", err)
+	}
+	in := filepath.Join(dir, "0001.png")
+	err = ioutil.WriteFile(in, b, 0600)
+	if err != nil {
+		t.Fatalf("Could not write test image: %v", err)
+	}
+
+	pre := make(chan string)
+	upc := make(chan string)
+	errc := make(chan error)
+	go PreprocessOtsu(true)(context.Background(), pre, upc, errc, vlog)
+	go func() {
+		pre <- in
+		close(pre)
+	}()
+
+	var done []string
+	for loop := true; loop; {
+		select {
+		case err = <-errc:
+			t.Fatalf("Error preprocessing: %v\nLog: %s", err, slog.log)
+		case p, ok := <-upc:
+			if !ok {
+				loop = false
+				continue
+			}
+			done = append(done, p)
+		}
+	}
+
+	expected := filepath.Join(dir, "0001_bin0.0.png")
+	if len(done) != 1 || done[0] != expected {
+		t.Fatalf("Expected only %s to be produced, got %v", expected, done)
+	}
+
+	f, err := os.Open(expected)
+	if err != nil {
+		t.Fatalf("Could not open binarised image: %v", err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatalf("Could not decode binarised image: %v", err)
+	}
+	gray, ok := img.(*image.Gray)
+	if !ok {
+		t.Fatalf("Binarised image is not greyscale")
+	}
+	for _, v := range gray.Pix {
+		if v != 0 && v != 255 {
+			t.Fatalf("Binarised image contains a grey value %d", v)
+		}
+	}
+}
+
+// runPreprocess copies an image to 0001.png in a temporary directory
+// and runs a preprocessing function on it, returning the paths of
+// the files produced
+func runPreprocess(process func(context.Context, chan string, chan string, chan error, *log.Logger), img string) ([]string, error) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	dir, err := ioutil.TempDir("", "bookpipelinetest")
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(img)
+	if err != nil {
+		return nil, err
+	}
+	in := filepath.Join(dir, "0001.png")
+	err = ioutil.WriteFile(in, b, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	pre := make(chan string)
+	upc := make(chan string)
+	errc := make(chan error)
+	go process(context.Background(), pre, upc, errc, vlog)
+	go func() {
+		pre <- in
+		close(pre)
+	}()
+
+	var done []string
+	for {
+		select {
+		case err = <-errc:
+			return done, fmt.Errorf("%v\nLog: %s", err, slog.log)
+		case p, ok := <-upc:
+			if !ok {
+				return done, nil
+			}
+			done = append(done, p)
+		}
+	}
+}
+
+func Test_wolfThresholds(t *testing.T) {
+	// dark text on a light background, with a darker, low contrast
+	// region where Otsu's method would fail
+	img := image.NewGray(image.Rect(0, 0, 100, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 100; x++ {
+			bg, fg := uint8(220), uint8(30)
+			if x >= 50 {
+				bg, fg = 120, 60
+			}
+			v := bg
+			if x%5 == 0 {
+				v = fg
+			}
+			img.SetGray(x, y, color.Gray{v})
+		}
+	}
+	thresholds := wolfThresholds(img, 0.5, 15)
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 100; x++ {
+			if x > 40 && x < 60 {
+				// skip where the window covers both regions
+				continue
+			}
+			v := float64(img.GrayAt(x, y).Y)
+			th := thresholds[y*100+x]
+			if x%5 == 0 && v > th {
+				t.Fatalf("Text pixel at %d,%d (%v) is above threshold %v", x, y, v, th)
+			}
+			if x%5 != 0 && v <= th {
+				t.Fatalf("Background pixel at %d,%d (%v) is not above threshold %v", x, y, v, th)
+			}
+		}
+	}
+}
+
+// Test_PreprocessGrey tests that with binarisation skipped a colour
+// page is converted to greyscale, and that it is OCRed as it is
+func Test_PreprocessGrey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookpipelinetest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a colour gradient, which should keep its intermediate grey
+	// levels
+	img := image.NewRGBA(image.Rect(0, 0, 64, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 64; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 4), 100, 200, 255})
+		}
+	}
+	colour := filepath.Join(dir, "colour.png")
+	f, err := os.Create(colour)
+	if err != nil {
+		t.Fatalf("Could not create test image: %v", err)
+	}
+	err = png.Encode(f, img)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Could not encode test image: %v", err)
+	}
+
+	process, err := PreprocessFor(ParseJobMessage("book binmethod=none"), []float64{0.1, 0.2}, false)
+	if err != nil {
+		t.Fatalf("Error getting preprocessing function: %v", err)
+	}
+	done, err := runPreprocess(process, colour)
+	if err != nil {
+		t.Fatalf("Error preprocessing: %v", err)
+	}
+	if len(done) != 1 || filepath.Base(done[0]) != "0001_bin0.0.png" {
+		t.Fatalf("Expected only 0001_bin0.0.png to be produced, got %v", done)
+	}
+	defer os.RemoveAll(filepath.Dir(done[0]))
+
+	f, err = os.Open(done[0])
+	if err != nil {
+		t.Fatalf("Could not open greyscale image: %v", err)
+	}
+	defer f.Close()
+	grey, err := png.Decode(f)
+	if err != nil {
+		t.Fatalf("Could not decode greyscale image: %v", err)
+	}
+	g, ok := grey.(*image.Gray)
+	if !ok {
+		t.Fatalf("Preprocessed image is not greyscale")
+	}
+	levels := make(map[uint8]bool)
+	for _, v := range g.Pix {
+		levels[v] = true
+	}
+	if len(levels) <= 2 {
+		t.Fatalf("Expected greyscale image not to be binarised, got levels %v", levels)
+	}
+
+	// use tesseract if it is available, otherwise a fake which just
+	// checks that it is given a greyscale png
+	tesscmd, err := exec.LookPath("tesseract")
+	if err != nil {
+		if runtime.GOOS == "windows" {
+			t.Skip("Skipping OCR which needs tesseract or a shell script")
+		}
+		tesscmd = filepath.Join(dir, "tesseract")
+		script := "#!/bin/sh\ncase \"$3\" in *_bin0.0.png) ;; *) exit 1;; esac\necho '<html><body></body></html>' > \"$4.hocr\"\n"
+		err = ioutil.WriteFile(tesscmd, []byte(script), 0755)
+		if err != nil {
+			t.Fatalf("Could not create fake tesseract: %v", err)
+		}
+	}
+
+	var slog StrLog
+	toocr := make(chan string, 1)
+	up := make(chan string, 1)
+	errc := make(chan error, 1)
+	toocr <- done[0]
+	close(toocr)
+	Ocr("eng", tesscmd)(context.Background(), toocr, up, errc, log.New(&slog, "", 0))
+	select {
+	case err = <-errc:
+		t.Fatalf("Error running OCR: %v\nLog: %s", err, slog.log)
+	default:
+	}
+	hocr := <-up
+	if filepath.Base(hocr) != "0001_bin0.0.hocr" {
+		t.Fatalf("Expected 0001_bin0.0.hocr to be produced, got %s", hocr)
+	}
+	_, err = os.Stat(hocr)
+	if err != nil {
+		t.Fatalf("Expected hOCR to be saved: %v", err)
+	}
+}
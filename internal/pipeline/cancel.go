@@ -0,0 +1,103 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"fmt"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+// CancelledFile is the name of the file which CancelBook saves in a
+// book's directory to mark it as cancelled. Any messages for the
+// book which are taken from a queue by a stage which processes a
+// whole book while it is there are deleted without being processed.
+// It is removed along with the rest of the book by rmbook, and a
+// book can't be uploaded again with the same name until it is.
+const CancelledFile = "cancelled"
+
+// Canceller is needed to cancel a book with CancelBook
+type Canceller interface {
+	AnalyseQueueId() string
+	Log(v ...interface{})
+	OCRPageQueueId() string
+	PreNoWipeQueueId() string
+	PreQueueId() string
+	RemoveBookFromQueue(url string, bookname string) error
+	Upload(bucket string, key string, path string) error
+	WIPStorageId() string
+	WipeQueueId() string
+}
+
+// CancelBook removes every message for a book from each of the
+// queues, so that a book which is stuck stops being processed. Any
+// message for the book which is being processed at the time is
+// hidden, so can't be removed, and will return to its queue if it
+// fails, so with mark the book is also marked as cancelled with
+// CancelledFile, so that any such messages are deleted when they
+// are next taken from a queue.
+func CancelBook(conn Canceller, bookname string, mark bool) error {
+	for _, q := range []string{conn.PreQueueId(), conn.PreNoWipeQueueId(), conn.WipeQueueId(), conn.OCRPageQueueId(), conn.AnalyseQueueId()} {
+		conn.Log("Removing", bookname, "from queue", q)
+		err := conn.RemoveBookFromQueue(q, bookname)
+		if err != nil {
+			return fmt.Errorf("Error removing %s from queue %s: %v", bookname, q, err)
+		}
+	}
+
+	if !mark {
+		return nil
+	}
+
+	return uploadBytes(conn, bookname+"/"+CancelledFile, nil)
+}
+
+// IsCancelled returns whether a book has been marked as cancelled by
+// CancelBook.
+func IsCancelled(conn Lister, bookname string) (bool, error) {
+	key := bookname + "/" + CancelledFile
+	objs, err := conn.ListObjects(conn.WIPStorageId(), key)
+	if err != nil {
+		return false, fmt.Errorf("Error checking for %s: %v", key, err)
+	}
+	for _, o := range objs {
+		if o == key {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// dropIfCancelled deletes a message from fromQueue, rather than it
+// being processed, if its book has been marked as cancelled,
+// returning whether it was. It is only used by stages which process
+// a whole book, as it lists storage each time.
+func dropIfCancelled(conn Pipeliner, msg bookpipeline.Qmsg, fromQueue string) (bool, error) {
+	bookname := bookpipeline.MsgBook(msg.Body)
+	cancelled, err := IsCancelled(conn, bookname)
+	if err != nil || !cancelled {
+		return false, err
+	}
+	conn.Log("Book", bookname, "has been cancelled, so deleting message without processing it", msg.Body)
+	err = conn.DelFromQueue(fromQueue, msg.Handle)
+	if err != nil {
+		return true, fmt.Errorf("Error deleting message %s for cancelled book from queue: %v", msg.Body, err)
+	}
+	return true, nil
+}
+
+// CheckNotCancelled returns an error if a book has been marked as
+// cancelled, as any messages for it would be dropped, so it can't be
+// uploaded again with the same name until it has been removed.
+func CheckNotCancelled(conn Lister, bookname string) error {
+	cancelled, err := IsCancelled(conn, bookname)
+	if err != nil {
+		return err
+	}
+	if cancelled {
+		return fmt.Errorf("Error: Book %s was cancelled, so it must be removed with rmbook before it can be uploaded again", bookname)
+	}
+	return nil
+}
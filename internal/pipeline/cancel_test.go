@@ -0,0 +1,129 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+// queueMessages returns every message currently visible on a queue,
+// hiding each as it is read
+func queueMessages(t *testing.T, conn *bookpipeline.LocalConn, q string) []string {
+	var msgs []string
+	for {
+		msg, err := conn.CheckQueue(q, 60)
+		if err != nil {
+			t.Fatalf("Error checking queue %s: %v", q, err)
+		}
+		if msg.Handle == "" {
+			return msgs
+		}
+		msgs = append(msgs, msg.Body)
+	}
+}
+
+func Test_CancelBook(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	conn := newTestConn(t, vlog)
+
+	// book10 and book1extra start with the name of the cancelled
+	// book, so must be left alone
+	msgs := []string{"book1", "book10", "book1 eng", "other", "book1/0001.png eng", "book10/0001.png", "book1extra"}
+	expected := []string{"book10", "other", "book10/0001.png", "book1extra"}
+	queues := []string{conn.PreQueueId(), conn.PreNoWipeQueueId(), conn.WipeQueueId(), conn.OCRPageQueueId(), conn.AnalyseQueueId()}
+	for _, q := range queues {
+		for _, m := range msgs {
+			err := conn.AddToQueue(q, m)
+			if err != nil {
+				t.Fatalf("Could not add %s to queue %s: %v", m, q, err)
+			}
+		}
+	}
+
+	err := CancelBook(conn, "book1", true)
+	if err != nil {
+		t.Fatalf("Error cancelling book: %v", err)
+	}
+
+	for _, q := range queues {
+		got := queueMessages(t, conn, q)
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("Expected queue %s to contain %v, got %v", q, expected, got)
+		}
+	}
+
+	for _, c := range []struct {
+		book      string
+		cancelled bool
+	}{
+		{"book1", true},
+		{"book10", false},
+	} {
+		cancelled, err := IsCancelled(conn, c.book)
+		if err != nil {
+			t.Fatalf("Error checking whether %s is cancelled: %v", c.book, err)
+		}
+		if cancelled != c.cancelled {
+			t.Fatalf("Expected %s cancelled to be %v, got %v", c.book, c.cancelled, cancelled)
+		}
+		// a cancelled book can't be uploaded again with the same name
+		err = CheckNotCancelled(conn, c.book)
+		if (err != nil) != c.cancelled {
+			t.Fatalf("Expected error checking %s could be uploaded only if cancelled, got %v", c.book, err)
+		}
+	}
+}
+
+// Test_CancelBookInProgress tests that a message which was being
+// processed when its book was cancelled is deleted without being
+// processed when it is next taken from the queue
+func Test_CancelBookInProgress(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	conn := newTestConn(t, vlog)
+
+	err := conn.AddToQueue(conn.PreQueueId(), "book1")
+	if err != nil {
+		t.Fatalf("Could not add to queue: %v", err)
+	}
+	msg, err := conn.CheckQueue(conn.PreQueueId(), 60)
+	if err != nil {
+		t.Fatalf("Error checking queue: %v", err)
+	}
+
+	// the hidden message can't be removed from the queue
+	err = CancelBook(conn, "book1", true)
+	if err != nil {
+		t.Fatalf("Error cancelling book: %v", err)
+	}
+
+	processed := false
+	process := func(ctx context.Context, in chan string, up chan string, errc chan error, logger *log.Logger) {
+		processed = true
+		for range in {
+		}
+		close(up)
+	}
+	err = ProcessBook(context.Background(), msg, conn, process, regexp.MustCompile(`.*`), conn.PreQueueId(), conn.OCRPageQueueId())
+	if err != nil {
+		t.Fatalf("Error processing cancelled book: %v\nLog: %s", err, slog.log)
+	}
+	if processed {
+		t.Fatalf("Expected cancelled book not to be processed")
+	}
+	_, err = conn.QueueHeartbeat(msg, conn.PreQueueId(), 0)
+	if err == nil {
+		t.Fatalf("Expected message for cancelled book to have been deleted")
+	}
+}
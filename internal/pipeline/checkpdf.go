@@ -0,0 +1,263 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"rescribe.xyz/pdf"
+)
+
+// PdfIssue is a problem found in a PDF which may cause trouble for
+// some PDF readers. Page is the page it was found on, starting at 1,
+// or 0 if it isn't specific to a page.
+type PdfIssue struct {
+	Page    int
+	Problem string
+}
+
+func (i PdfIssue) String() string {
+	if i.Page == 0 {
+		return i.Problem
+	}
+	return fmt.Sprintf("Page %d: %s", i.Page, i.Problem)
+}
+
+// isPdfDelim returns whether a byte is a delimiter in PDF syntax
+func isPdfDelim(c byte) bool {
+	return strings.IndexByte("()<>[]{}/%", c) != -1
+}
+
+// isPdfSpace returns whether a byte is whitespace in PDF syntax
+func isPdfSpace(c byte) bool {
+	return strings.IndexByte(" \t\r\n\f\x00", c) != -1
+}
+
+// pdfTokens splits a content stream into its tokens, leaving out
+// strings, comments and inline image data, which can contain
+// anything.
+func pdfTokens(b []byte) []string {
+	var tokens []string
+	for i := 0; i < len(b); {
+		c := b[i]
+		switch {
+		case isPdfSpace(c):
+			i++
+		case c == '%':
+			for i < len(b) && b[i] != '\n' && b[i] != '\r' {
+				i++
+			}
+		case c == '(':
+			depth := 0
+			for ; i < len(b); i++ {
+				if b[i] == '\\' {
+					i++
+					continue
+				}
+				if b[i] == '(' {
+					depth++
+				}
+				if b[i] == ')' {
+					depth--
+					if depth == 0 {
+						i++
+						break
+					}
+				}
+			}
+		case c == '<' && i+1 < len(b) && b[i+1] == '<', c == '>' && i+1 < len(b) && b[i+1] == '>':
+			i += 2
+		case c == '<':
+			for i < len(b) && b[i] != '>' {
+				i++
+			}
+			i++
+		case c == '/':
+			// names can contain digits followed by letters, so are
+			// skipped
+			i++
+			for i < len(b) && !isPdfSpace(b[i]) && !isPdfDelim(b[i]) {
+				i++
+			}
+		case isPdfDelim(c):
+			i++
+		default:
+			start := i
+			for i < len(b) && !isPdfSpace(b[i]) && !isPdfDelim(b[i]) {
+				i++
+			}
+			t := string(b[start:i])
+			tokens = append(tokens, t)
+			if t == "ID" {
+				// skip inline image data, which ends with EI
+				end := bytes.Index(b[i:], []byte("EI"))
+				if end == -1 {
+					return tokens
+				}
+				i += end
+			}
+		}
+	}
+	return tokens
+}
+
+// checkContent checks a page content stream for number operands
+// which aren't followed by whitespace, such as "10.5Td", and for
+// infinite or NaN numbers, which are not valid PDF.
+func checkContent(b []byte) []string {
+	var problems []string
+	for _, t := range pdfTokens(b) {
+		u := strings.TrimLeft(t, "+-")
+		if strings.HasPrefix(u, "Inf") || strings.HasPrefix(u, "NaN") {
+			problems = append(problems, fmt.Sprintf("Invalid number %s", t))
+			continue
+		}
+		// a token starting like a number should be only a number
+		if u == "" || strings.IndexByte("0123456789.", u[0]) == -1 {
+			continue
+		}
+		if _, err := strconv.ParseFloat(t, 64); err != nil {
+			problems = append(problems, fmt.Sprintf("Missing whitespace after number in %s", t))
+		}
+	}
+	return problems
+}
+
+// inherited returns the value of a key for a page, looking through
+// its parent page tree nodes if it isn't set on the page itself, as
+// attributes like MediaBox can be.
+func inherited(v pdf.Value, key string) pdf.Value {
+	for i := 0; i < 100 && !v.IsNull(); i++ {
+		k := v.Key(key)
+		if !k.IsNull() {
+			return k
+		}
+		v = v.Key("Parent")
+	}
+	return pdf.Value{}
+}
+
+// pageContent returns the content of a page, joining the streams
+// together if there are several.
+func pageContent(p pdf.Page) ([]byte, error) {
+	var streams []pdf.Value
+	c := p.V.Key("Contents")
+	switch c.Kind() {
+	case pdf.Stream:
+		streams = append(streams, c)
+	case pdf.Array:
+		for i := 0; i < c.Len(); i++ {
+			streams = append(streams, c.Index(i))
+		}
+	}
+	var content []byte
+	for _, s := range streams {
+		r := s.Reader()
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return content, err
+		}
+		content = append(content, b...)
+		content = append(content, '\n')
+	}
+	return content, nil
+}
+
+// fontEmbedded returns whether a font has its font program embedded
+// in the PDF. For composite (Type0) fonts the descendant font is
+// checked.
+func fontEmbedded(f pdf.Value) bool {
+	if f.Key("Subtype").Name() == "Type0" {
+		f = f.Key("DescendantFonts").Index(0)
+	}
+	// Type3 fonts are defined by PDF content, so are always embedded
+	if f.Key("Subtype").Name() == "Type3" {
+		return true
+	}
+	d := f.Key("FontDescriptor")
+	for _, k := range []string{"FontFile", "FontFile2", "FontFile3"} {
+		if !d.Key(k).IsNull() {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckPdf checks a PDF for issues which commonly cause problems
+// with some PDF readers: page content with numbers missing the
+// whitespace after them, infinite or NaN numbers, fonts which aren't
+// embedded, and pages with no size. An error is only returned if the
+// PDF can't be read at all.
+func CheckPdf(path string) (issues []PdfIssue, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return issues, fmt.Errorf("Error opening %s: %v", path, err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return issues, fmt.Errorf("Error getting size of %s: %v", path, err)
+	}
+
+	// the pdf package panics on some malformed PDFs
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Error reading PDF %s: %v", path, r)
+		}
+	}()
+
+	r, err := pdf.NewReader(f, fi.Size())
+	if err != nil {
+		return issues, fmt.Errorf("Error reading PDF %s: %v", path, err)
+	}
+
+	if r.NumPage() == 0 {
+		issues = append(issues, PdfIssue{Problem: "No pages found"})
+	}
+
+	checkedfonts := make(map[string]bool)
+	for n := 1; n <= r.NumPage(); n++ {
+		p := r.Page(n)
+
+		box := inherited(p.V, "MediaBox")
+		if box.Len() != 4 {
+			issues = append(issues, PdfIssue{n, "No valid MediaBox"})
+		} else {
+			w := box.Index(2).Float64() - box.Index(0).Float64()
+			h := box.Index(3).Float64() - box.Index(1).Float64()
+			if w <= 0 || h <= 0 {
+				issues = append(issues, PdfIssue{n, fmt.Sprintf("Zero size page (%gx%g)", w, h)})
+			}
+		}
+
+		content, err := pageContent(p)
+		if err != nil {
+			issues = append(issues, PdfIssue{n, fmt.Sprintf("Error reading content: %v", err)})
+		}
+		for _, problem := range checkContent(content) {
+			issues = append(issues, PdfIssue{n, problem})
+		}
+
+		for _, name := range p.Fonts() {
+			font := p.Font(name)
+			basefont := font.BaseFont()
+			if checkedfonts[basefont] {
+				continue
+			}
+			checkedfonts[basefont] = true
+			if !fontEmbedded(font.V) {
+				issues = append(issues, PdfIssue{n, fmt.Sprintf("Font %s is not embedded", basefont)})
+			}
+		}
+	}
+
+	return issues, nil
+}
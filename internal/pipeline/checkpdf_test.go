@@ -0,0 +1,142 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+func Test_checkContent(t *testing.T) {
+	cases := []struct {
+		name     string
+		content  string
+		expected []string
+	}{
+		{"clean", "BT /F1 12 Tf 10.5 20 Td (a 10Td string) Tj ET", nil},
+		{"nowhitespace", "BT 10.5 20Td ET", []string{"Missing whitespace after number in 20Td"}},
+		{"nan", "BT NaN 20 Td ET", []string{"Invalid number NaN"}},
+		{"inf", "1 0 0 1 -Inf 0 cm", []string{"Invalid number -Inf"}},
+		{"names", "/F1 12 Tf /Im1x2 Do", nil},
+		{"comment", "% 12Td\n1 0 0 rg", nil},
+		{"hex", "<3132546a> Tj << /MCID 0 >> BDC", nil},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			problems := checkContent([]byte(c.content))
+			if strings.Join(problems, "|") != strings.Join(c.expected, "|") {
+				t.Fatalf("Expected problems %v, got %v", c.expected, problems)
+			}
+		})
+	}
+}
+
+// buildPdf creates a PDF from a list of objects, numbered from 1,
+// with a valid cross-reference table. The first object should be the
+// document catalog.
+func buildPdf(objs []string) []byte {
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.4\n")
+	var offsets []int
+	for i, o := range objs {
+		offsets = append(offsets, b.Len())
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, o)
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(objs)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objs)+1, xref)
+	return b.Bytes()
+}
+
+func Test_CheckPdf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpdftest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	hocrpath := filepath.Join(dir, "page.hocr")
+	err = writeHocr(hocrpath, 90, "clean", "page")
+	if err != nil {
+		t.Fatalf("Could not write hOCR: %v", err)
+	}
+	clean := filepath.Join(dir, "clean.pdf")
+	streamed := filepath.Join(dir, "streamed.pdf")
+	for _, fn := range []string{clean, streamed} {
+		p := &bookpipeline.Fpdf{Stream: fn == streamed, TempDir: dir}
+		err = p.Setup()
+		if err != nil {
+			t.Fatalf("Could not set up PDF: %v", err)
+		}
+		err = p.AddPage("testdata/good/1.png", hocrpath, false)
+		if err != nil {
+			t.Fatalf("Could not add page: %v", err)
+		}
+		err = p.Save(fn)
+		if err != nil {
+			t.Fatalf("Could not save PDF: %v", err)
+		}
+	}
+
+	content := "BT /F1 12 Tf 10 20Td (bad) Tj NaN 0 Td ET"
+	malformed := filepath.Join(dir, "malformed.pdf")
+	err = ioutil.WriteFile(malformed, buildPdf([]string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 /MediaBox [0 0 0 0] >>",
+		"<< /Type /Page /Parent 2 0 R /Contents 4 0 R /Resources << /Font << /F1 5 0 R >> >> >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+	}), 0644)
+	if err != nil {
+		t.Fatalf("Could not write malformed PDF: %v", err)
+	}
+
+	cases := []struct {
+		name     string
+		path     string
+		expected []string
+	}{
+		{"clean", clean, nil},
+		{"streamed", streamed, nil},
+		{"malformed", malformed, []string{
+			"Page 1: Zero size page (0x0)",
+			"Page 1: Missing whitespace after number in 20Td",
+			"Page 1: Invalid number NaN",
+			"Page 1: Font Helvetica is not embedded",
+		}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			issues, err := CheckPdf(c.path)
+			if err != nil {
+				t.Fatalf("Error checking PDF: %v", err)
+			}
+			var found []string
+			for _, i := range issues {
+				found = append(found, i.String())
+			}
+			if strings.Join(found, "|") != strings.Join(c.expected, "|") {
+				t.Fatalf("Expected issues %v, got %v", c.expected, found)
+			}
+		})
+	}
+
+	_, err = CheckPdf(filepath.Join(dir, "missing.pdf"))
+	if err == nil {
+		t.Fatalf("Expected an error checking a missing PDF")
+	}
+}
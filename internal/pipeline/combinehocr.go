@@ -0,0 +1,63 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+)
+
+var (
+	bodyRe    = regexp.MustCompile(`(?s)^(.*?<body[^>]*>)(.*)</body>`)
+	hocrIdRe  = regexp.MustCompile(`\bid=(['"])([^'"]*)(['"])`)
+	tessIdRe  = regexp.MustCompile(`^([a-z]+)_\d+((_\d+)*)$`)
+	ppagenoRe = regexp.MustCompile(`\bppageno \d+`)
+)
+
+// renumberId returns an element id which is unique for page n.
+// Tesseract ids, like "word_1_3", have the page number replaced,
+// and any others are prefixed with the page number.
+func renumberId(id string, n int) string {
+	if tessIdRe.MatchString(id) {
+		return tessIdRe.ReplaceAllString(id, fmt.Sprintf("${1}_%d${2}", n))
+	}
+	return fmt.Sprintf("p%d_%s", n, id)
+}
+
+// CombineHocr combines several hOCR files, each containing a single
+// page, into one hOCR document with each page as a separate ocr_page
+// element, in the order given. The head of the first file is used
+// for the combined document, and the ids and page numbers of each
+// page are changed so that they are unique across the document.
+func CombineHocr(hocrs []string) ([]byte, error) {
+	var b bytes.Buffer
+	for i, path := range hocrs {
+		n := i + 1
+		h, err := ioutil.ReadFile(path)
+		if err != nil {
+			return b.Bytes(), fmt.Errorf("Error reading %s: %v", path, err)
+		}
+		m := bodyRe.FindSubmatch(h)
+		if m == nil {
+			return b.Bytes(), fmt.Errorf("Error combining %s: no body found", path)
+		}
+		if i == 0 {
+			b.Write(m[1])
+		}
+
+		body := hocrIdRe.ReplaceAllFunc(m[2], func(id []byte) []byte {
+			parts := hocrIdRe.FindSubmatch(id)
+			return []byte(fmt.Sprintf("id=%s%s%s", parts[1], renumberId(string(parts[2]), n), parts[3]))
+		})
+		body = ppagenoRe.ReplaceAll(body, []byte(fmt.Sprintf("ppageno %d", i)))
+		b.Write(bytes.TrimRight(body, " \t\r\n"))
+	}
+	if len(hocrs) > 0 {
+		b.WriteString("\n </body>\n</html>\n")
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_renumberId(t *testing.T) {
+	cases := []struct {
+		id       string
+		n        int
+		expected string
+	}{
+		{"page_1", 3, "page_3"},
+		{"word_1_12", 2, "word_2_12"},
+		{"block_1_1_2", 10, "block_10_1_2"},
+		{"custom", 2, "p2_custom"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.id, func(t *testing.T) {
+			id := renumberId(c.id, c.n)
+			if id != c.expected {
+				t.Fatalf("Expected %s, got %s", c.expected, id)
+			}
+		})
+	}
+}
+
+func Test_CombineHocr(t *testing.T) {
+	dir, err := ioutil.TempDir("", "combinehocrtest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var hocrs []string
+	for _, p := range []string{"0001.hocr", "0002.hocr"} {
+		fn := filepath.Join(dir, p)
+		err = writeHocr(fn, 80, "some", "words")
+		if err != nil {
+			t.Fatalf("Could not write hOCR file %s: %v", fn, err)
+		}
+		hocrs = append(hocrs, fn)
+	}
+
+	b, err := CombineHocr(hocrs)
+	if err != nil {
+		t.Fatalf("Error combining hOCR: %v", err)
+	}
+
+	var pages []string
+	ids := make(map[string]bool)
+	d := xml.NewDecoder(strings.NewReader(string(b)))
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Combined hOCR is not valid XML: %v", err)
+		}
+		el, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		var id, class string
+		for _, a := range el.Attr {
+			if a.Name.Local == "id" {
+				id = a.Value
+			}
+			if a.Name.Local == "class" {
+				class = a.Value
+			}
+		}
+		if id == "" {
+			continue
+		}
+		if ids[id] {
+			t.Fatalf("Duplicate id %s in combined hOCR", id)
+		}
+		ids[id] = true
+		if class == "ocr_page" {
+			pages = append(pages, id)
+		}
+	}
+	if len(pages) != 2 || pages[0] != "page_1" || pages[1] != "page_2" {
+		t.Fatalf("Expected pages page_1 and page_2, got %v", pages)
+	}
+
+	_, err = CombineHocr([]string{filepath.Join(dir, "missing.hocr")})
+	if err == nil {
+		t.Fatalf("Expected an error combining a missing file")
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ConfCSVHeader is the header row of the CSV written by WriteConfCSV
+var ConfCSVHeader = []string{"page", "word_index", "text", "confidence", "bbox"}
+
+// WriteConfCSV writes the confidence of every word in the best
+// version of each page of a book downloaded to dir, as listed in its
+// best file, as CSV. Each row gives the name of the page, like 0001,
+// the index of the word on the page counting from 0, the text of the
+// word, its confidence, and its bounding box as "x0 y0 x1 y1". The
+// pages are written in order.
+func WriteConfCSV(w io.Writer, dir string) error {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "best"))
+	if err != nil {
+		return fmt.Errorf("Error reading best file: %v", err)
+	}
+	var hocrs []string
+	for _, l := range strings.Split(string(b), "\n") {
+		if l != "" {
+			hocrs = append(hocrs, l)
+		}
+	}
+	sort.Strings(hocrs)
+
+	cw := csv.NewWriter(w)
+	err = cw.Write(ConfCSVHeader)
+	if err != nil {
+		return fmt.Errorf("Error writing CSV: %v", err)
+	}
+	for _, h := range hocrs {
+		pg, err := getPageWords(filepath.Join(dir, h), HocrImage(h))
+		if err != nil {
+			return err
+		}
+		for i, word := range pg.Words {
+			bbox := fmt.Sprintf("%d %d %d %d", word.Bbox[0], word.Bbox[1], word.Bbox[2], word.Bbox[3])
+			row := []string{pageName(h), strconv.Itoa(i), word.Text, strconv.FormatFloat(word.Conf, 'f', -1, 64), bbox}
+			err = cw.Write(row)
+			if err != nil {
+				return fmt.Errorf("Error writing CSV: %v", err)
+			}
+		}
+	}
+	cw.Flush()
+	err = cw.Error()
+	if err != nil {
+		return fmt.Errorf("Error writing CSV: %v", err)
+	}
+	return nil
+}
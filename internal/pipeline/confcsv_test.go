@@ -0,0 +1,65 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_WriteConfCSV(t *testing.T) {
+	dir, err := ioutil.TempDir("", "confcsvtest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "0001_bin0.2.hocr"), []byte(heatmapHocr), 0644)
+	if err != nil {
+		t.Fatalf("Could not write hOCR: %v", err)
+	}
+	err = writeHocr(filepath.Join(dir, "0002_bin0.1.hocr"), 80, "second", "page,", "quoted")
+	if err != nil {
+		t.Fatalf("Could not write hOCR: %v", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "best"), []byte("0002_bin0.1.hocr\n0001_bin0.2.hocr\n"), 0644)
+	if err != nil {
+		t.Fatalf("Could not write best file: %v", err)
+	}
+
+	var buf bytes.Buffer
+	err = WriteConfCSV(&buf, dir)
+	if err != nil {
+		t.Fatalf("Error in WriteConfCSV: %v", err)
+	}
+
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("Could not parse CSV: %v", err)
+	}
+	if len(rows) != 6 {
+		t.Fatalf("Expected a header and 5 rows, got %v", rows)
+	}
+	if strings.Join(rows[0], ",") != "page,word_index,text,confidence,bbox" {
+		t.Fatalf("Unexpected header: %v", rows[0])
+	}
+	expected := []string{"0001", "1", "high", "95", "60 10 90 30"}
+	if strings.Join(rows[2], "|") != strings.Join(expected, "|") {
+		t.Fatalf("Expected row %v, got %v", expected, rows[2])
+	}
+	for i, r := range rows[3:] {
+		if r[0] != "0002" || r[1] != []string{"0", "1", "2"}[i] || r[3] != "80" {
+			t.Fatalf("Unexpected row for second page: %v", r)
+		}
+	}
+	if rows[4][2] != "page," {
+		t.Fatalf("Expected word with a comma to be kept whole, got %v", rows[4])
+	}
+}
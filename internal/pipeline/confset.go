@@ -0,0 +1,126 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+// ConfSet collects the confidence of each version of each page of a
+// book, so that the best version of each page can be chosen, as is
+// done by Analyse. It is safe to use from multiple goroutines at
+// once, and the zero value is an empty ConfSet ready to use.
+type ConfSet struct {
+	mu     sync.Mutex
+	confs  map[string][]*bookpipeline.Conf
+	scores map[string]float64
+}
+
+// Add adds the confidence of a version of page, along with the score
+// used to choose the best version, which is usually the same as its
+// confidence.
+func (s *ConfSet) Add(page string, conf *bookpipeline.Conf, score float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.confs == nil {
+		s.confs = make(map[string][]*bookpipeline.Conf)
+		s.scores = make(map[string]float64)
+	}
+	s.confs[page] = append(s.confs[page], conf)
+	s.scores[conf.Path] = score
+}
+
+// sorted returns the pages, and the versions of each page, in order,
+// so that the results are the same however the confidences were
+// added. It must be called with s.mu held.
+func (s *ConfSet) sorted() ([]string, map[string][]*bookpipeline.Conf) {
+	var pages []string
+	versions := make(map[string][]*bookpipeline.Conf)
+	for page, confs := range s.confs {
+		pages = append(pages, page)
+		c := append([]*bookpipeline.Conf(nil), confs...)
+		sort.Slice(c, func(i, j int) bool { return c[i].Path < c[j].Path })
+		versions[page] = c
+	}
+	sort.Strings(pages)
+	return pages, versions
+}
+
+// Len returns the number of pages in the set.
+func (s *ConfSet) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.confs)
+}
+
+// Score returns the score of the version of a page at path, or zero
+// if it hasn't been added.
+func (s *ConfSet) Score(path string) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.scores[path]
+}
+
+// Best returns the version of each page with the highest score,
+// keyed by page. Where several versions have the same score the one
+// whose path sorts first is chosen, and a page whose versions all
+// have a score of zero is still included.
+func (s *ConfSet) Best() map[string]*bookpipeline.Conf {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pages, versions := s.sorted()
+	best := make(map[string]*bookpipeline.Conf)
+	for _, page := range pages {
+		for _, c := range versions[page] {
+			if best[page] == nil || s.scores[c.Path] > s.scores[best[page].Path] {
+				best[page] = c
+			}
+		}
+	}
+	return best
+}
+
+// WriteConf writes the confidence of every version of every page to
+// w, one per line, as the path and confidence separated by a tab, in
+// the format of the conf file saved by Analyse.
+func (s *ConfSet) WriteConf(w io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pages, versions := s.sorted()
+	for _, page := range pages {
+		for _, c := range versions[page] {
+			_, err := fmt.Fprintf(w, "%s\t%02.f\n", c.Path, c.Conf)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WriteBest writes the filename of the best version of each page to
+// w, one per line in page order, in the format of the best file saved
+// by Analyse.
+func (s *ConfSet) WriteBest(w io.Writer) error {
+	best := s.Best()
+	var pages []string
+	for page := range best {
+		pages = append(pages, page)
+	}
+	sort.Strings(pages)
+	for _, page := range pages {
+		_, err := fmt.Fprintf(w, "%s\n", filepath.Base(best[page].Path))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+func Test_ConfSet(t *testing.T) {
+	var s ConfSet
+	for _, c := range []struct {
+		page  string
+		path  string
+		conf  float64
+		score float64
+	}{
+		{"0002", "book/0002_bin0.3.hocr", 80, 80},
+		{"0001", "book/0001_bin0.2.hocr", 70, 70},
+		{"0001", "book/0001_bin0.1.hocr", 60, 90},
+		{"0002", "book/0002_bin0.1.hocr", 80, 80},
+		{"0003", "book/0003_bin0.1.hocr", 0, 0},
+	} {
+		s.Add(c.page, &bookpipeline.Conf{Path: c.path, Conf: c.conf}, c.score)
+	}
+
+	if s.Len() != 3 {
+		t.Fatalf("Expected 3 pages, got %d", s.Len())
+	}
+
+	var conf bytes.Buffer
+	err := s.WriteConf(&conf)
+	if err != nil {
+		t.Fatalf("Error writing conf: %v", err)
+	}
+	expected := "book/0001_bin0.1.hocr\t60\nbook/0001_bin0.2.hocr\t70\nbook/0002_bin0.1.hocr\t80\nbook/0002_bin0.3.hocr\t80\nbook/0003_bin0.1.hocr\t00\n"
+	if conf.String() != expected {
+		t.Fatalf("Expected conf:\n%s\ngot:\n%s", expected, conf.String())
+	}
+
+	// the best version is chosen by score rather than confidence,
+	// ties go to the first path, and pages with only zero scores
+	// are still included
+	var best bytes.Buffer
+	err = s.WriteBest(&best)
+	if err != nil {
+		t.Fatalf("Error writing best: %v", err)
+	}
+	expected = "0001_bin0.1.hocr\n0002_bin0.1.hocr\n0003_bin0.1.hocr\n"
+	if best.String() != expected {
+		t.Fatalf("Expected best:\n%s\ngot:\n%s", expected, best.String())
+	}
+}
+
+// Test_ConfSetConcurrent adds confidences to a ConfSet from many
+// goroutines at once, and checks that none are lost and that the
+// results are the same as adding them one at a time. It is most
+// useful with go test -race.
+func Test_ConfSetConcurrent(t *testing.T) {
+	const pages, versions, goroutines = 50, 3, 16
+
+	var serial, concurrent ConfSet
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for pg := g; pg < pages; pg += goroutines {
+				for v := 0; v < versions; v++ {
+					page := fmt.Sprintf("%04d", pg)
+					path := fmt.Sprintf("book/%s_bin0.%d.hocr", page, v+1)
+					conf := float64((pg*7 + v*13) % 100)
+					concurrent.Add(page, &bookpipeline.Conf{Path: path, Conf: conf}, conf)
+				}
+				// read while others are still writing, to check that
+				// doesn't race either
+				_ = concurrent.Best()
+			}
+		}(g)
+	}
+	for pg := 0; pg < pages; pg++ {
+		for v := 0; v < versions; v++ {
+			page := fmt.Sprintf("%04d", pg)
+			path := fmt.Sprintf("book/%s_bin0.%d.hocr", page, v+1)
+			conf := float64((pg*7 + v*13) % 100)
+			serial.Add(page, &bookpipeline.Conf{Path: path, Conf: conf}, conf)
+		}
+	}
+	wg.Wait()
+
+	if concurrent.Len() != pages {
+		t.Fatalf("Expected %d pages, got %d", pages, concurrent.Len())
+	}
+
+	for _, write := range []struct {
+		name string
+		fn   func(*ConfSet, *bytes.Buffer) error
+	}{
+		{"conf", func(s *ConfSet, b *bytes.Buffer) error { return s.WriteConf(b) }},
+		{"best", func(s *ConfSet, b *bytes.Buffer) error { return s.WriteBest(b) }},
+	} {
+		var want, got bytes.Buffer
+		err := write.fn(&serial, &want)
+		if err != nil {
+			t.Fatalf("Error writing serial %s: %v", write.name, err)
+		}
+		err = write.fn(&concurrent, &got)
+		if err != nil {
+			t.Fatalf("Error writing concurrent %s: %v", write.name, err)
+		}
+		if got.String() != want.String() {
+			t.Fatalf("Expected concurrent %s to match serial:\n%s\ngot:\n%s", write.name, want.String(), got.String())
+		}
+		if write.name == "conf" && strings.Count(got.String(), "\n") != pages*versions {
+			t.Fatalf("Expected %d confidences, got:\n%s", pages*versions, got.String())
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"unicode"
+)
+
+// wordList is a set of known words, used to check how much of the
+// text of a page is made up of real words.
+type wordList map[string]bool
+
+// normaliseWord lowercases a word and strips any punctuation from
+// either end of it, so that it can be looked up in a wordList.
+func normaliseWord(w string) string {
+	return strings.ToLower(strings.TrimFunc(w, func(r rune) bool {
+		return unicode.IsPunct(r) || unicode.IsSymbol(r)
+	}))
+}
+
+// loadWordList reads a word list from a file. Words should be
+// separated by whitespace, and will usually be one per line.
+func loadWordList(path string) (wordList, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading word list %s: %v", path, err)
+	}
+	words := make(wordList)
+	for _, w := range strings.Fields(string(b)) {
+		w = normaliseWord(w)
+		if w != "" {
+			words[w] = true
+		}
+	}
+	if len(words) == 0 {
+		return nil, fmt.Errorf("No words found in word list %s", path)
+	}
+	return words, nil
+}
+
+// dictionaries are the word lists for different languages, keyed by
+// the training used to OCR each page, so that the text of a page is
+// checked against the word list for its language. The word list with
+// an empty key is used for pages OCRed with any other training.
+type dictionaries map[string]wordList
+
+// ParseDictionaries parses a comma separated list of word lists, each
+// in the form training=path, to use for pages OCRed with that
+// training. A path on its own is used for pages OCRed with any other
+// training, so a single path can be given to use it for every book.
+func ParseDictionaries(s string) (map[string]string, error) {
+	paths := make(map[string]string)
+	for _, d := range strings.Split(s, ",") {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+		training := ""
+		path := d
+		if kv := strings.SplitN(d, "=", 2); len(kv) == 2 {
+			training, path = kv[0], kv[1]
+			if training == "" || path == "" {
+				return nil, fmt.Errorf("Invalid word list %s, should be in the form training=path", d)
+			}
+		}
+		if _, ok := paths[training]; ok {
+			if training == "" {
+				return nil, fmt.Errorf("More than one word list given for other trainings")
+			}
+			return nil, fmt.Errorf("More than one word list given for training %s", training)
+		}
+		paths[training] = path
+	}
+	return paths, nil
+}
+
+// loadDictionaries reads the word list for each training in paths,
+// as parsed by ParseDictionaries.
+func loadDictionaries(paths map[string]string) (dictionaries, error) {
+	d := make(dictionaries)
+	for training, path := range paths {
+		words, err := loadWordList(path)
+		if err != nil {
+			return nil, err
+		}
+		d[training] = words
+	}
+	return d, nil
+}
+
+// forTraining returns the word list to use for a page OCRed with a
+// training, or nil if there is none.
+func (d dictionaries) forTraining(training string) wordList {
+	if words, ok := d[training]; ok {
+		return words
+	}
+	return d[""]
+}
+
+// ratio returns the proportion of words in the text which are in
+// the word list. Anything that doesn't contain any letters, such as
+// numbers, is ignored.
+func (wl wordList) ratio(text string) float64 {
+	var found, total int
+	for _, w := range strings.Fields(text) {
+		w = normaliseWord(w)
+		if strings.IndexFunc(w, unicode.IsLetter) == -1 {
+			continue
+		}
+		total++
+		if wl[w] {
+			found++
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(found) / float64(total)
+}
@@ -0,0 +1,68 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_wordListRatio(t *testing.T) {
+	wl := wordList{"the": true, "quick": true, "fox": true}
+	cases := []struct {
+		text  string
+		ratio float64
+	}{
+		{"the quick fox", 1},
+		{"The, quick fox.", 1},
+		{"the qvick f0x", 1.0 / 3.0},
+		{"xqz vvk plm", 0},
+		{"the 1642 fox", 1},
+		{"", 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.text, func(t *testing.T) {
+			r := wl.ratio(c.text)
+			if r != c.ratio {
+				t.Fatalf("Expected ratio %f, got %f", c.ratio, r)
+			}
+		})
+	}
+}
+
+func Test_ParseDictionaries(t *testing.T) {
+	cases := []struct {
+		list  string
+		paths map[string]string
+		err   bool
+	}{
+		{"", map[string]string{}, false},
+		{"words.txt", map[string]string{"": "words.txt"}, false},
+		{"eng=english.txt, lat=latin.txt", map[string]string{"eng": "english.txt", "lat": "latin.txt"}, false},
+		{"eng=english.txt,words.txt", map[string]string{"eng": "english.txt", "": "words.txt"}, false},
+		{"eng=english.txt,eng=other.txt", nil, true},
+		{"a.txt,b.txt", nil, true},
+		{"=english.txt", nil, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.list, func(t *testing.T) {
+			paths, err := ParseDictionaries(c.list)
+			if c.err {
+				if err == nil {
+					t.Fatalf("Expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Error parsing: %v", err)
+			}
+			if !reflect.DeepEqual(paths, c.paths) {
+				t.Fatalf("Expected %v, got %v", c.paths, paths)
+			}
+		})
+	}
+}
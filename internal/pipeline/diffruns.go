@@ -0,0 +1,193 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"rescribe.xyz/utils/pkg/hocr"
+)
+
+// The status of a page when comparing two runs of a book
+const (
+	PageUnchanged = "unchanged"
+	PageImproved  = "improved"
+	PageRegressed = "regressed"
+	PageAdded     = "added"
+	PageRemoved   = "removed"
+)
+
+// PageDiff is the difference between the best version of a page in
+// two runs of the same book.
+type PageDiff struct {
+	Page    string
+	Status  string
+	OldConf float64
+	NewConf float64
+	// TextDiff lists the changes to the words of the page, with each
+	// run of removed words prefixed with "- " and each run of added
+	// words prefixed with "+ "
+	TextDiff []string
+}
+
+// Delta returns the change in confidence of the page
+func (p PageDiff) Delta() float64 {
+	return p.NewConf - p.OldConf
+}
+
+// runPage is the best version of a page in a run of a book
+type runPage struct {
+	conf  float64
+	words []string
+}
+
+// readRun reads the confidence and words of the best version of each
+// page of a book downloaded to dir, keyed by page name
+func readRun(dir string) (map[string]runPage, error) {
+	confs, err := ReadBestConfs(dir)
+	if err != nil {
+		return nil, err
+	}
+	pages := make(map[string]runPage)
+	for _, c := range confs {
+		text, err := hocr.GetText(filepath.Join(dir, c.Path))
+		if err != nil {
+			return nil, fmt.Errorf("Error getting text from %s: %v", c.Path, err)
+		}
+		pages[pageName(c.Path)] = runPage{conf: c.Conf, words: strings.Fields(text)}
+	}
+	return pages, nil
+}
+
+// diffWords returns the changes needed to turn the words in a into
+// those in b, found with the longest common subsequence, as used
+// for PageDiff.TextDiff
+func diffWords(a, b []string) []string {
+	// lcs[i][j] is the length of the longest common subsequence of
+	// a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var diff, removed, added []string
+	flush := func() {
+		if len(removed) > 0 {
+			diff = append(diff, "- "+strings.Join(removed, " "))
+		}
+		if len(added) > 0 {
+			diff = append(diff, "+ "+strings.Join(added, " "))
+		}
+		removed, added = nil, nil
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			flush()
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			removed = append(removed, a[i])
+			i++
+		default:
+			added = append(added, b[j])
+			j++
+		}
+	}
+	flush()
+	return diff
+}
+
+// DiffRuns compares two runs of the same book, downloaded to olddir
+// and newdir by getpipelinebook, page by page. A page whose best
+// confidence has fallen by more than threshold is counted as
+// regressed, and one whose confidence has risen by more than
+// threshold as improved. The pages are returned in order.
+func DiffRuns(olddir string, newdir string, threshold float64) ([]PageDiff, error) {
+	oldpages, err := readRun(olddir)
+	if err != nil {
+		return nil, err
+	}
+	newpages, err := readRun(newdir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name := range oldpages {
+		names = append(names, name)
+	}
+	for name := range newpages {
+		if _, ok := oldpages[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var diffs []PageDiff
+	for _, name := range names {
+		o, inold := oldpages[name]
+		n, innew := newpages[name]
+		d := PageDiff{Page: name, OldConf: o.conf, NewConf: n.conf, TextDiff: diffWords(o.words, n.words)}
+		switch {
+		case !inold:
+			d.Status = PageAdded
+		case !innew:
+			d.Status = PageRemoved
+		case d.Delta() < -threshold:
+			d.Status = PageRegressed
+		case d.Delta() > threshold:
+			d.Status = PageImproved
+		default:
+			d.Status = PageUnchanged
+		}
+		diffs = append(diffs, d)
+	}
+	return diffs, nil
+}
+
+// WriteRunsDiff writes a report of the differences between two runs
+// of a book, as found by DiffRuns. Each page is listed with its old
+// and new confidence, the change, and its status, with regressed
+// pages highlighted, followed by the changes to its text.
+func WriteRunsDiff(w io.Writer, diffs []PageDiff) error {
+	counts := make(map[string]int)
+	for _, d := range diffs {
+		counts[d.Status]++
+		status := d.Status
+		if status == PageRegressed {
+			status = "REGRESSED"
+		}
+		_, err := fmt.Fprintf(w, "%s\t%.0f -> %.0f\t%+.0f\t%s\n", d.Page, d.OldConf, d.NewConf, d.Delta(), status)
+		if err != nil {
+			return err
+		}
+		for _, l := range d.TextDiff {
+			_, err = fmt.Fprintf(w, "\t%s\n", l)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	_, err := fmt.Fprintf(w, "\n%d pages: %d regressed, %d improved, %d unchanged, %d added, %d removed\n",
+		len(diffs), counts[PageRegressed], counts[PageImproved], counts[PageUnchanged], counts[PageAdded], counts[PageRemoved])
+	return err
+}
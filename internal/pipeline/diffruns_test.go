@@ -0,0 +1,121 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runPageFile is the best version of a page in a test run of a book
+type runPageFile struct {
+	hocr  string
+	conf  int
+	words []string
+}
+
+// writeRun saves a run of a book in dir, with the best hOCR of each
+// page, along with the best and conf files
+func writeRun(dir string, pages []runPageFile) error {
+	var best, conf string
+	for _, p := range pages {
+		fn := filepath.Join(dir, p.hocr)
+		err := writeHocr(fn, p.conf, p.words...)
+		if err != nil {
+			return err
+		}
+		best += p.hocr + "\n"
+		conf += fmt.Sprintf("%s\t%d\n", fn, p.conf)
+	}
+	err := ioutil.WriteFile(filepath.Join(dir, "best"), []byte(best), 0644)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "conf"), []byte(conf), 0644)
+}
+
+func Test_DiffRuns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diffrunstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	olddir := filepath.Join(dir, "old")
+	newdir := filepath.Join(dir, "new")
+	for _, d := range []string{olddir, newdir} {
+		err = os.Mkdir(d, 0755)
+		if err != nil {
+			t.Fatalf("Could not create directory %s: %v", d, err)
+		}
+	}
+
+	err = writeRun(olddir, []runPageFile{
+		{"0001_bin0.2.hocr", 80, []string{"the", "quick", "fox"}},
+		{"0002_bin0.2.hocr", 60, []string{"tbe", "lazy", "dog"}},
+		{"0003_bin0.2.hocr", 75, []string{"same", "text"}},
+		{"0004_bin0.2.hocr", 70, []string{"gone"}},
+	})
+	if err != nil {
+		t.Fatalf("Could not write old run: %v", err)
+	}
+	// the best binarisation of a page can change between runs
+	err = writeRun(newdir, []runPageFile{
+		{"0001_bin0.2.hocr", 62, []string{"the", "qnick", "f0x"}},
+		{"0002_bin0.3.hocr", 85, []string{"the", "lazy", "dog"}},
+		{"0003_bin0.1.hocr", 76, []string{"same", "text"}},
+		{"0005_bin0.2.hocr", 90, []string{"new"}},
+	})
+	if err != nil {
+		t.Fatalf("Could not write new run: %v", err)
+	}
+
+	diffs, err := DiffRuns(olddir, newdir, 2)
+	if err != nil {
+		t.Fatalf("Error in DiffRuns: %v", err)
+	}
+
+	expected := []struct {
+		page   string
+		status string
+		delta  float64
+		diff   []string
+	}{
+		{"0001", PageRegressed, -18, []string{"- quick fox", "+ qnick f0x"}},
+		{"0002", PageImproved, 25, []string{"- tbe", "+ the"}},
+		{"0003", PageUnchanged, 1, nil},
+		{"0004", PageRemoved, -70, []string{"- gone"}},
+		{"0005", PageAdded, 90, []string{"+ new"}},
+	}
+	if len(diffs) != len(expected) {
+		t.Fatalf("Expected %d pages, got %v", len(expected), diffs)
+	}
+	for i, e := range expected {
+		d := diffs[i]
+		if d.Page != e.page || d.Status != e.status || d.Delta() != e.delta {
+			t.Fatalf("Expected page %s to be %s by %.0f, got %s %s by %.0f", e.page, e.status, e.delta, d.Page, d.Status, d.Delta())
+		}
+		if strings.Join(d.TextDiff, "|") != strings.Join(e.diff, "|") {
+			t.Fatalf("Expected text diff %v for page %s, got %v", e.diff, e.page, d.TextDiff)
+		}
+	}
+
+	var buf bytes.Buffer
+	err = WriteRunsDiff(&buf, diffs)
+	if err != nil {
+		t.Fatalf("Error in WriteRunsDiff: %v", err)
+	}
+	if !strings.Contains(buf.String(), "0001\t80 -> 62\t-18\tREGRESSED\n") {
+		t.Fatalf("Expected regressed page to be highlighted, got:\n%s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "5 pages: 1 regressed, 1 improved, 1 unchanged, 1 added, 1 removed") {
+		t.Fatalf("Unexpected summary in report:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+// DPIFile is the name of the file that the resolution of a book's
+// page images is saved in, if it is known, so that its PDFs can be
+// made at the true physical size. It is saved alongside the images
+// of the book.
+const DPIFile = "dpi.json"
+
+// DPIs records the resolution, in dots per inch, that the pages of a
+// book were scanned at.
+type DPIs struct {
+	// Book is the DPI of any pages not listed in Pages
+	Book float64 `json:"book,omitempty"`
+	// Pages maps the name of a page, as given by UploadImages but
+	// without the suffix, to its DPI
+	Pages map[string]float64 `json:"pages,omitempty"`
+}
+
+// Page returns the DPI of the page that the file fn belongs to, such
+// as 0001.jpg or 0001_bin0.2.png, or zero if it isn't known.
+func (d DPIs) Page(fn string) float64 {
+	if dpi, ok := d.Pages[pageName(fn)]; ok && dpi > 0 {
+		return dpi
+	}
+	return d.Book
+}
+
+// ParseDPI parses a DPI setting, which must be a positive number
+func ParseDPI(s string) (float64, error) {
+	dpi, err := strconv.ParseFloat(s, 64)
+	if err != nil || dpi <= 0 {
+		return 0, fmt.Errorf("Invalid DPI %s, should be a positive number", s)
+	}
+	return dpi, nil
+}
+
+// ImageDPI returns the horizontal DPI recorded in a JPEG (in its JFIF
+// header) or PNG (in its pHYs chunk) image, or zero if none is
+// recorded.
+func ImageDPI(path string) (float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("Error opening %s: %v", path, err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	sig, err := r.Peek(8)
+	if err != nil {
+		return 0, nil
+	}
+	switch {
+	case bytes.Equal(sig[:2], []byte{0xff, 0xd8}):
+		return jpegDPI(r)
+	case bytes.Equal(sig, []byte("\x89PNG\r\n\x1a\n")):
+		return pngDPI(r)
+	}
+	return 0, nil
+}
+
+// jpegDPI returns the DPI recorded in the JFIF APP0 segment of a
+// JPEG, if there is one before the image data
+func jpegDPI(r io.Reader) (float64, error) {
+	var soi [2]byte
+	_, err := io.ReadFull(r, soi[:])
+	if err != nil {
+		return 0, nil
+	}
+	for {
+		var hdr [4]byte
+		_, err = io.ReadFull(r, hdr[:])
+		if err != nil || hdr[0] != 0xff {
+			return 0, nil
+		}
+		marker := hdr[1]
+		n := int(binary.BigEndian.Uint16(hdr[2:])) - 2
+		if n < 0 || marker == 0xda { // start of scan
+			return 0, nil
+		}
+		seg := make([]byte, n)
+		_, err = io.ReadFull(r, seg)
+		if err != nil {
+			return 0, nil
+		}
+		if marker != 0xe0 || n < 12 || !bytes.Equal(seg[:5], []byte("JFIF\x00")) {
+			continue
+		}
+		units := seg[7]
+		x := float64(binary.BigEndian.Uint16(seg[8:]))
+		switch units {
+		case 1: // dots per inch
+			return x, nil
+		case 2: // dots per cm
+			return x * 2.54, nil
+		}
+		return 0, nil
+	}
+}
+
+// pngDPI returns the DPI recorded in the pHYs chunk of a PNG, if
+// there is one before the image data
+func pngDPI(r io.Reader) (float64, error) {
+	var sig [8]byte
+	_, err := io.ReadFull(r, sig[:])
+	if err != nil {
+		return 0, nil
+	}
+	for {
+		var hdr [8]byte
+		_, err = io.ReadFull(r, hdr[:])
+		if err != nil {
+			return 0, nil
+		}
+		n := int64(binary.BigEndian.Uint32(hdr[:4]))
+		typ := string(hdr[4:])
+		if typ == "IDAT" || typ == "IEND" {
+			return 0, nil
+		}
+		if typ != "pHYs" || n != 9 {
+			// skip the chunk data and its crc
+			_, err = io.CopyN(ioutil.Discard, r, n+4)
+			if err != nil {
+				return 0, nil
+			}
+			continue
+		}
+		var phys [9]byte
+		_, err = io.ReadFull(r, phys[:])
+		if err != nil {
+			return 0, nil
+		}
+		if phys[8] != 1 { // unit is not the metre
+			return 0, nil
+		}
+		return float64(binary.BigEndian.Uint32(phys[:4])) * 0.0254, nil
+	}
+}
+
+// FindDPIs returns the DPI recorded in each page image in dir which
+// would be uploaded by UploadImages, mapped to the name of the page
+// it will be given, for use in DPIs.Pages. Images with no DPI
+// recorded are left out.
+func FindDPIs(dir string) (map[string]float64, error) {
+	pages, err := pageNames(dir)
+	if err != nil {
+		return nil, err
+	}
+	return findPageDPIs(pages)
+}
+
+// findPageDPIs returns the DPI recorded in each page image, as with
+// FindDPIs
+func findPageDPIs(pages []pageFile) (map[string]float64, error) {
+	dpis := make(map[string]float64)
+	for _, pg := range pages {
+		dpi, err := ImageDPI(pg.path)
+		if err != nil {
+			return nil, err
+		}
+		if dpi > 0 {
+			dpis[pageName(pg.name)] = dpi
+		}
+	}
+	return dpis, nil
+}
+
+// UploadDPIs saves the DPIs of a book as JSON, and uploads it to the
+// book's directory in conn.WIPStorageId().
+func UploadDPIs(conn Uploader, bookname string, d DPIs) error {
+	return uploadJSON(conn, bookname+"/"+DPIFile, d)
+}
+
+// ReadDPIs reads the DPIs of a book saved in fn by UploadDPIs.
+func ReadDPIs(fn string) (DPIs, error) {
+	var d DPIs
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return d, fmt.Errorf("Error reading %s: %v", fn, err)
+	}
+	err = json.Unmarshal(b, &d)
+	if err != nil {
+		return d, fmt.Errorf("Error parsing DPIs in %s: %v", fn, err)
+	}
+	return d, nil
+}
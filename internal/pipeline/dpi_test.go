@@ -0,0 +1,130 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"bytes"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// jpegWithDensity returns a JPEG image with a JFIF header recording
+// the density given, in the units given (1 for inches, 2 for cm)
+func jpegWithDensity(units byte, density uint16) ([]byte, error) {
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 10, 10)), nil)
+	if err != nil {
+		return nil, err
+	}
+	b := buf.Bytes()
+	d1, d2 := byte(density>>8), byte(density)
+	app0 := []byte{0xff, 0xe0, 0, 16, 'J', 'F', 'I', 'F', 0, 1, 1, units, d1, d2, d1, d2, 0, 0}
+	return append(append(append([]byte{}, b[:2]...), app0...), b[2:]...), nil
+}
+
+// pngWithDensity returns a PNG image with a pHYs chunk recording the
+// density given in pixels per metre
+func pngWithDensity(ppm uint32) ([]byte, error) {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 10, 10)))
+	if err != nil {
+		return nil, err
+	}
+	b := buf.Bytes()
+	// the signature and IHDR chunk take up the first 33 bytes
+	p := []byte{byte(ppm >> 24), byte(ppm >> 16), byte(ppm >> 8), byte(ppm)}
+	phys := append([]byte{0, 0, 0, 9, 'p', 'H', 'Y', 's'}, p...)
+	phys = append(phys, p...)
+	phys = append(phys, 1)
+	crc := crc32.ChecksumIEEE(phys[4:])
+	phys = append(phys, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+	return append(append(append([]byte{}, b[:33]...), phys...), b[33:]...), nil
+}
+
+func Test_ImageDPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dpitest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	err = png.Encode(&buf, image.NewGray(image.Rect(0, 0, 10, 10)))
+	if err != nil {
+		t.Fatalf("Could not create image: %v", err)
+	}
+	plain := buf.Bytes()
+	jpginch, err := jpegWithDensity(1, 300)
+	if err != nil {
+		t.Fatalf("Could not create image: %v", err)
+	}
+	jpgcm, err := jpegWithDensity(2, 118)
+	if err != nil {
+		t.Fatalf("Could not create image: %v", err)
+	}
+	pngm, err := pngWithDensity(11811)
+	if err != nil {
+		t.Fatalf("Could not create image: %v", err)
+	}
+
+	cases := []struct {
+		name string
+		img  []byte
+		dpi  int
+	}{
+		{"none.png", plain, 0},
+		{"inch.jpg", jpginch, 300},
+		{"cm.jpg", jpgcm, 299},
+		{"metre.png", pngm, 299},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fn := filepath.Join(dir, c.name)
+			err := ioutil.WriteFile(fn, c.img, 0644)
+			if err != nil {
+				t.Fatalf("Could not write image: %v", err)
+			}
+			dpi, err := ImageDPI(fn)
+			if err != nil {
+				t.Fatalf("Error getting DPI: %v", err)
+			}
+			if int(dpi) != c.dpi {
+				t.Fatalf("Expected DPI %d, got %v", c.dpi, dpi)
+			}
+			_, _, err = image.Decode(bytes.NewReader(c.img))
+			if err != nil {
+				t.Fatalf("Test image is not valid: %v", err)
+			}
+		})
+	}
+}
+
+func Test_DPIsPage(t *testing.T) {
+	d := DPIs{Book: 300, Pages: map[string]float64{"book_0002": 150}}
+	cases := []struct {
+		fn  string
+		dpi float64
+	}{
+		{"book_0001.jpg", 300},
+		{"book_0002.jpg", 150},
+		{"/tmp/book/book_0002_bin0.2.png", 150},
+	}
+
+	for _, c := range cases {
+		t.Run(c.fn, func(t *testing.T) {
+			dpi := d.Page(c.fn)
+			if dpi != c.dpi {
+				t.Fatalf("Expected DPI %v, got %v", c.dpi, dpi)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"math/bits"
+	"os"
+
+	"golang.org/x/image/draw"
+)
+
+// blankStdDev is the standard deviation of grey levels below which a
+// page is considered to be blank
+const blankStdDev = 8
+
+// PageHash is a perceptual hash of a page image, which is similar for
+// pages that look similar, even if they were scanned separately.
+type PageHash struct {
+	Hash  uint64
+	Blank bool
+}
+
+// DupePair is a pair of consecutive pages which look like duplicates
+type DupePair struct {
+	First, Second string
+	Distance      int
+}
+
+// HashPage calculates a perceptual hash of an image, using the
+// difference hash method, where the image is shrunk to 9x8 pixels
+// and each bit records whether a pixel is brighter than the one to
+// its right. It also records whether the page appears to be blank.
+func HashPage(path string) (PageHash, error) {
+	var h PageHash
+
+	f, err := os.Open(path)
+	if err != nil {
+		return h, fmt.Errorf("Error opening image %s: %v", path, err)
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return h, fmt.Errorf("Error decoding image %s: %v", path, err)
+	}
+
+	small := image.NewGray(image.Rect(0, 0, 9, 8))
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), img, img.Bounds(), draw.Src, nil)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			h.Hash <<= 1
+			if small.GrayAt(x, y).Y > small.GrayAt(x+1, y).Y {
+				h.Hash |= 1
+			}
+		}
+	}
+
+	sample := image.NewGray(image.Rect(0, 0, 64, 64))
+	draw.ApproxBiLinear.Scale(sample, sample.Bounds(), img, img.Bounds(), draw.Src, nil)
+	var sum, sumsq float64
+	for _, v := range sample.Pix {
+		sum += float64(v)
+		sumsq += float64(v) * float64(v)
+	}
+	n := float64(len(sample.Pix))
+	mean := sum / n
+	h.Blank = math.Sqrt(sumsq/n-mean*mean) < blankStdDev
+
+	return h, nil
+}
+
+// FindDuplicates checks each consecutive pair of pages, returning
+// any whose hashes differ by maxdist bits or fewer. Pairs of blank
+// pages are never considered duplicates, as books often legitimately
+// contain several blank pages in a row.
+func FindDuplicates(paths []string, maxdist int) ([]DupePair, error) {
+	var dupes []DupePair
+	var prev PageHash
+	for i, p := range paths {
+		h, err := HashPage(p)
+		if err != nil {
+			return dupes, err
+		}
+		if i > 0 && !h.Blank && !prev.Blank {
+			d := bits.OnesCount64(h.Hash ^ prev.Hash)
+			if d <= maxdist {
+				dupes = append(dupes, DupePair{First: paths[i-1], Second: p, Distance: d})
+			}
+		}
+		prev = h
+	}
+	return dupes, nil
+}
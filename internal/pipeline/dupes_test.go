@@ -0,0 +1,91 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestPage saves a greyscale png with each pixel's value set by
+// the function given
+func writeTestPage(path string, f func(x, y int) uint8) error {
+	img := image.NewGray(image.Rect(0, 0, 200, 300))
+	for y := 0; y < 300; y++ {
+		for x := 0; x < 200; x++ {
+			img.Pix[y*img.Stride+x] = f(x, y)
+		}
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return png.Encode(out, img)
+}
+
+func Test_FindDuplicates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dupestest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	text := func(x, y int) uint8 {
+		if (y/20)%2 == 0 && (x/15)%3 != 0 {
+			return 20
+		}
+		return 230
+	}
+	rescanned := func(x, y int) uint8 {
+		// slightly lighter, with some speckles
+		if (x*7+y*13)%97 == 0 {
+			return 128
+		}
+		return text(x, y) + 10
+	}
+	other := func(x, y int) uint8 {
+		return uint8((x * 255 / 200) ^ (y * 255 / 300))
+	}
+	blank := func(x, y int) uint8 {
+		return 240
+	}
+
+	pages := []struct {
+		name string
+		f    func(x, y int) uint8
+	}{
+		{"0001.png", text},
+		{"0002.png", rescanned},
+		{"0003.png", other},
+		{"0004.png", blank},
+		{"0005.png", blank},
+	}
+	var paths []string
+	for _, p := range pages {
+		fn := filepath.Join(dir, p.name)
+		err = writeTestPage(fn, p.f)
+		if err != nil {
+			t.Fatalf("Could not write test page %s: %v", fn, err)
+		}
+		paths = append(paths, fn)
+	}
+
+	dupes, err := FindDuplicates(paths, 5)
+	if err != nil {
+		t.Fatalf("Error finding duplicates: %v", err)
+	}
+
+	if len(dupes) != 1 {
+		t.Fatalf("Expected 1 duplicate pair, got %d: %v", len(dupes), dupes)
+	}
+	if dupes[0].First != paths[0] || dupes[0].Second != paths[1] {
+		t.Fatalf("Expected %s and %s to be flagged, got %s and %s", paths[0], paths[1], dupes[0].First, dupes[0].Second)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// EstimateOptions are the settings used by EstimateBatch.
+type EstimateOptions struct {
+	// PageTime is how long one server takes to process a page through
+	// every stage of the pipeline.
+	PageTime time.Duration
+
+	// Instances is the number of servers processing the batch.
+	Instances int
+
+	// HourlyPrice is the cost of running one server for an hour.
+	HourlyPrice float64
+}
+
+// Estimate is the estimated time and cost of processing a batch of
+// pages.
+type Estimate struct {
+	Pages     int
+	Instances int
+
+	// Time is how long it will take until every page is processed,
+	// with the pages shared between the servers.
+	Time time.Duration
+
+	// InstanceHours is the total time the servers spend processing
+	// the pages, which is what is paid for, as servers stop once
+	// there is nothing left for them to do.
+	InstanceHours float64
+
+	Cost float64
+}
+
+// EstimateBatch estimates how long a batch of pages will take to
+// process, and how much it will cost, with the settings in opts.
+func EstimateBatch(pages int, opts EstimateOptions) (Estimate, error) {
+	e := Estimate{Pages: pages, Instances: opts.Instances}
+	if pages < 0 {
+		return e, fmt.Errorf("Invalid number of pages %d", pages)
+	}
+	if opts.PageTime <= 0 {
+		return e, fmt.Errorf("Invalid time per page %s, should be more than 0", opts.PageTime)
+	}
+	if opts.Instances < 1 {
+		return e, fmt.Errorf("Invalid number of servers %d, should be at least 1", opts.Instances)
+	}
+	if opts.HourlyPrice < 0 {
+		return e, fmt.Errorf("Invalid price %f, should be 0 or more", opts.HourlyPrice)
+	}
+
+	// the servers finish once the one with the most pages is done
+	perinstance := (pages + opts.Instances - 1) / opts.Instances
+	e.Time = time.Duration(perinstance) * opts.PageTime
+	e.InstanceHours = (time.Duration(pages) * opts.PageTime).Hours()
+	e.Cost = e.InstanceHours * opts.HourlyPrice
+	return e, nil
+}
+
+// CountPages returns the number of page images in dir, including
+// those in any subdirectories, so that a directory containing
+// several books can be counted at once. Hidden files and
+// directories are ignored.
+func CountPages(dir string) (int, error) {
+	n := 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".jpg", ".jpeg", ".png":
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return n, fmt.Errorf("Error counting pages in %s: %v", dir, err)
+	}
+	return n, nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_EstimateBatch(t *testing.T) {
+	cases := []struct {
+		name      string
+		pages     int
+		opts      EstimateOptions
+		time      time.Duration
+		hours     float64
+		cost      float64
+		expecterr bool
+	}{
+		{"single", 3600, EstimateOptions{PageTime: 10 * time.Second, Instances: 1, HourlyPrice: 0.5}, 10 * time.Hour, 10, 5, false},
+		{"fleet", 3600, EstimateOptions{PageTime: 10 * time.Second, Instances: 4, HourlyPrice: 0.5}, 150 * time.Minute, 10, 5, false},
+		{"uneven", 10, EstimateOptions{PageTime: time.Minute, Instances: 3, HourlyPrice: 0.6}, 4 * time.Minute, 10.0 / 60, 0.1, false},
+		{"free", 60, EstimateOptions{PageTime: time.Minute, Instances: 1}, time.Hour, 1, 0, false},
+		{"notime", 10, EstimateOptions{Instances: 1}, 0, 0, 0, true},
+		{"noinstances", 10, EstimateOptions{PageTime: time.Minute}, 0, 0, 0, true},
+		{"negativeprice", 10, EstimateOptions{PageTime: time.Minute, Instances: 1, HourlyPrice: -1}, 0, 0, 0, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e, err := EstimateBatch(c.pages, c.opts)
+			if c.expecterr {
+				if err == nil {
+					t.Fatalf("Expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Error estimating: %v", err)
+			}
+			if e.Time != c.time {
+				t.Fatalf("Expected time %s, got %s", c.time, e.Time)
+			}
+			if math.Abs(e.InstanceHours-c.hours) > 0.0001 {
+				t.Fatalf("Expected %f server hours, got %f", c.hours, e.InstanceHours)
+			}
+			if math.Abs(e.Cost-c.cost) > 0.0001 {
+				t.Fatalf("Expected cost %f, got %f", c.cost, e.Cost)
+			}
+		})
+	}
+}
+
+func Test_CountPages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "countpagestest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, fn := range []string{"book1/0001.jpg", "book1/0002.JPG", "book1/notes.txt", "book2/0001.png", "book2/.hidden.png", ".git/0001.png", "cover.jpeg"} {
+		path := filepath.Join(dir, fn)
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			t.Fatalf("Could not create directory for %s: %v", fn, err)
+		}
+		err = ioutil.WriteFile(path, []byte{}, 0644)
+		if err != nil {
+			t.Fatalf("Could not write %s: %v", fn, err)
+		}
+	}
+
+	n, err := CountPages(dir)
+	if err != nil {
+		t.Fatalf("Error counting pages: %v", err)
+	}
+	if n != 4 {
+		t.Fatalf("Expected 4 pages, got %d", n)
+	}
+}
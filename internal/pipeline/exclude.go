@@ -0,0 +1,105 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ExcludeFile is the name of the file listing the pages of a book to
+// leave out of its PDFs and text. It is saved alongside the images
+// of the book.
+const ExcludeFile = "exclude.txt"
+
+// PageExclusions is a set of pages to leave out of the PDFs and text
+// of a book, such as covers, blank pages and duplicate scans, while
+// still keeping their files. Pages are identified by the number in
+// their filename, like 350 for page_0350_bin0.2.hocr, which is the
+// number shown for them on the confidence graph. It is stored as a
+// list of numbers separated by commas, spaces or newlines, like this:
+//
+//	1, 2, 350
+type PageExclusions map[int]bool
+
+// ParsePageExclusions parses a list of pages to exclude.
+func ParsePageExclusions(s string) (PageExclusions, error) {
+	e := make(PageExclusions)
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	for _, f := range fields {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 {
+			return e, fmt.Errorf("Invalid page number %s in list of pages to exclude", f)
+		}
+		e[n] = true
+	}
+	return e, nil
+}
+
+// ReadPageExclusions reads and parses a list of pages to exclude saved
+// in fn, returning an empty list if it doesn't exist.
+func ReadPageExclusions(fn string) (PageExclusions, error) {
+	b, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return PageExclusions{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %s: %v", fn, err)
+	}
+	return ParsePageExclusions(string(b))
+}
+
+// Excluded returns whether a file belonging to a page of a book, like
+// 0350_bin0.2.hocr, is one of the pages to exclude, using the same
+// page numbers as training manifests.
+func (e PageExclusions) Excluded(fn string) bool {
+	n, ok := pageNumber(fn)
+	return ok && e[n]
+}
+
+// Filter returns the files in fns which don't belong to pages which
+// are excluded, keeping their order.
+func (e PageExclusions) Filter(fns []string) []string {
+	if len(e) == 0 {
+		return fns
+	}
+	var kept []string
+	for _, fn := range fns {
+		if !e.Excluded(fn) {
+			kept = append(kept, fn)
+		}
+	}
+	return kept
+}
+
+// String returns the pages to exclude as a comma separated list, in
+// the form read by ParsePageExclusions.
+func (e PageExclusions) String() string {
+	var pages []int
+	for n, ok := range e {
+		if ok {
+			pages = append(pages, n)
+		}
+	}
+	sort.Ints(pages)
+	var s []string
+	for _, n := range pages {
+		s = append(s, strconv.Itoa(n))
+	}
+	return strings.Join(s, ", ")
+}
+
+// UploadPageExclusions saves the pages of a book to exclude, and
+// uploads them to the book's directory in conn.WIPStorageId().
+func UploadPageExclusions(conn Uploader, bookname string, e PageExclusions) error {
+	return uploadBytes(conn, bookname+"/"+ExcludeFile, []byte(e.String()+"\n"))
+}
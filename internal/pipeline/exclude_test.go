@@ -0,0 +1,156 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"rescribe.xyz/pdf"
+)
+
+func Test_ParsePageExclusions(t *testing.T) {
+	cases := []struct {
+		list     string
+		expected string
+		err      bool
+	}{
+		{"", "", false},
+		{"1,2,350", "1, 2, 350", false},
+		{"350\n2, 1\n", "1, 2, 350", false},
+		{"0007", "7", false},
+		{"1,two", "", true},
+		{"-1", "", true},
+	}
+	for _, c := range cases {
+		t.Run(c.list, func(t *testing.T) {
+			e, err := ParsePageExclusions(c.list)
+			if c.err {
+				if err == nil {
+					t.Fatalf("Expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Error parsing: %v", err)
+			}
+			if e.String() != c.expected {
+				t.Fatalf("Expected %q, got %q", c.expected, e.String())
+			}
+		})
+	}
+
+	e, err := ParsePageExclusions("2, 350")
+	if err != nil {
+		t.Fatalf("Error parsing: %v", err)
+	}
+	fns := []string{"0001_bin0.2.hocr", "0002_bin0.2.hocr", "dir/page_0350_bin0.1_psm6.hocr", "0350.png", "cover.png"}
+	kept := e.Filter(fns)
+	expected := []string{"0001_bin0.2.hocr", "cover.png"}
+	if strings.Join(kept, " ") != strings.Join(expected, " ") {
+		t.Fatalf("Expected %v to be kept, got %v", expected, kept)
+	}
+}
+
+// Test_AnalyseExclude tests that pages listed in the exclusions file
+// of a book are left out of its PDF and text, but that their hOCR is
+// still kept and can be downloaded
+func Test_AnalyseExclude(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	dir, err := ioutil.TempDir("", "excludetest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	bookdir := filepath.Join(dir, "book")
+	err = os.Mkdir(bookdir, 0755)
+	if err != nil {
+		t.Fatalf("Could not create directory: %v", err)
+	}
+	for _, pg := range []string{"0001", "0002", "0003"} {
+		f, err := os.Create(filepath.Join(bookdir, pg+".png"))
+		if err != nil {
+			t.Fatalf("Could not create image: %v", err)
+		}
+		err = png.Encode(f, image.NewGray(image.Rect(0, 0, 1000, 1000)))
+		f.Close()
+		if err != nil {
+			t.Fatalf("Could not encode image: %v", err)
+		}
+		err = writeHocr(filepath.Join(bookdir, pg+".hocr"), 80, "page"+pg)
+		if err != nil {
+			t.Fatalf("Could not write hOCR for %s: %v", pg, err)
+		}
+	}
+
+	conn := newTestConn(t, vlog)
+	err = UploadPageExclusions(conn, "book", PageExclusions{2: true})
+	if err != nil {
+		t.Fatalf("Could not upload pages to exclude: %v", err)
+	}
+
+	err = ImportOcr(context.Background(), bookdir, "book", conn, AnalyseOptions{Tar: true})
+	if err != nil {
+		t.Fatalf("Error analysing book: %v\nLog: %s", err, slog.log)
+	}
+
+	savedir := filepath.Join(dir, "save")
+	err = os.Mkdir(savedir, 0755)
+	if err != nil {
+		t.Fatalf("Could not create directory: %v", err)
+	}
+	err = DownloadBestPages(context.Background(), savedir, "book", conn)
+	if err != nil {
+		t.Fatalf("Error downloading best pages: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(savedir, "0002.hocr")); err != nil {
+		t.Fatalf("Expected hOCR of excluded page to be downloadable: %v", err)
+	}
+
+	err = DownloadPdfs(context.Background(), savedir, "book", conn, PdfColour)
+	if err != nil {
+		t.Fatalf("Error downloading PDFs: %v", err)
+	}
+	r, err := pdf.Open(filepath.Join(savedir, "book.colour.pdf"))
+	if err != nil {
+		t.Fatalf("Could not open PDF: %v", err)
+	}
+	if r.NumPage() != 2 {
+		t.Fatalf("Expected 2 pages in PDF, got %d", r.NumPage())
+	}
+
+	unpacked := filepath.Join(dir, "unpacked")
+	err = os.Mkdir(unpacked, 0755)
+	if err != nil {
+		t.Fatalf("Could not create directory: %v", err)
+	}
+	err = DownloadTar(context.Background(), unpacked, "book", conn)
+	if err != nil {
+		t.Fatalf("Error downloading archive: %v", err)
+	}
+	found, err := filepath.Glob(filepath.Join(unpacked, "*.txt"))
+	if err != nil {
+		t.Fatalf("Could not list text files: %v", err)
+	}
+	var names []string
+	for _, fn := range found {
+		names = append(names, filepath.Base(fn))
+	}
+	sort.Strings(names)
+	expected := []string{"0001.txt", "0003.txt"}
+	if strings.Join(names, " ") != strings.Join(expected, " ") {
+		t.Fatalf("Expected text files %v, got %v", expected, names)
+	}
+}
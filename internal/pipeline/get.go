@@ -6,16 +6,99 @@ package pipeline
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
+
+	"rescribe.xyz/bookpipeline"
 )
 
-func DownloadBestPages(dir string, name string, conn Downloader) error {
+// ContextDownloader is a connection which can stop a download when
+// its context is cancelled
+type ContextDownloader interface {
+	DownloadWithContext(ctx context.Context, bucket string, key string, fn string) error
+}
+
+// partialPrefix returns the prefix of the name of the temporary file
+// which downloadCtx downloads fn to
+func partialPrefix(fn string) string {
+	return "." + filepath.Base(fn) + ".part"
+}
+
+// removePartials removes any temporary files left by downloads of fn
+// which were interrupted by the process being killed
+func removePartials(fn string) {
+	dir := filepath.Dir(fn)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), partialPrefix(fn)) {
+			_ = os.Remove(filepath.Join(dir, f.Name()))
+		}
+	}
+}
+
+// downloadCtx downloads a file, stopping if ctx is cancelled. The file
+// is downloaded to a temporary file alongside fn, which is only
+// renamed to fn once the download has succeeded, so an interrupted
+// download never leaves a truncated file at fn. If conn can't stop a
+// download itself, on cancellation the download is left to finish in
+// the background, and the temporary file is removed once it has.
+func downloadCtx(ctx context.Context, conn Downloader, key string, fn string) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(fn), partialPrefix(fn)+"*")
+	if err != nil {
+		return fmt.Errorf("Error creating temporary file for %s: %v", fn, err)
+	}
+	tmpfn := tmp.Name()
+	tmp.Close()
+
+	if c, ok := conn.(ContextDownloader); ok {
+		err = c.DownloadWithContext(ctx, conn.WIPStorageId(), key, tmpfn)
+		if err != nil {
+			_ = os.Remove(tmpfn)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		return os.Rename(tmpfn, fn)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- conn.Download(conn.WIPStorageId(), key, tmpfn)
+	}()
+	select {
+	case err = <-errc:
+		if err != nil {
+			_ = os.Remove(tmpfn)
+			return err
+		}
+		return os.Rename(tmpfn, fn)
+	case <-ctx.Done():
+		go func() {
+			<-errc
+			_ = os.Remove(tmpfn)
+		}()
+		return ctx.Err()
+	}
+}
+
+func DownloadBestPages(ctx context.Context, dir string, name string, conn Downloader) error {
 	key := filepath.Join(name, "best")
 	fn := filepath.Join(dir, "best")
-	err := conn.Download(conn.WIPStorageId(), key, fn)
+	err := downloadCtx(ctx, conn, key, fn)
 	if err != nil {
 		return fmt.Errorf("Failed to download 'best' file: %v", err)
 	}
@@ -29,8 +112,11 @@ func DownloadBestPages(dir string, name string, conn Downloader) error {
 	for s.Scan() {
 		key = filepath.Join(name, s.Text())
 		fn = filepath.Join(dir, s.Text())
-		conn.Log("Downloading file", key)
-		err = conn.Download(conn.WIPStorageId(), key, fn)
+		conn.Log(bookpipeline.DebugTag+"Downloading file", key)
+		err = downloadCtx(ctx, conn, key, fn)
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return err
+		}
 		if err != nil {
 			return fmt.Errorf("Failed to download file %s: %v", key, err)
 		}
@@ -38,10 +124,56 @@ func DownloadBestPages(dir string, name string, conn Downloader) error {
 	return nil
 }
 
-func DownloadBestPngs(dir string, name string, conn Downloader) error {
+// The image types which can be chosen with DownloadBestImages
+const (
+	ImgBinarised = "binarised"
+	ImgColour    = "colour"
+	ImgBoth      = "both"
+)
+
+// bestImageNames returns the names of the images of the type given,
+// which is ImgBinarised, ImgColour or ImgBoth, which could be the
+// source of a best hOCR file. The binarised image is the one the
+// hOCR was made from. The colour image is the original page image,
+// which may be either a jpg or a png, so both are returned, to be
+// tried in turn.
+func bestImageNames(hocrname string, imgtype string) ([]string, error) {
+	bin := HocrImage(hocrname)
+	base := strings.TrimSuffix(hocrname, ".hocr")
+	if i := strings.LastIndex(base, "_bin"); i != -1 {
+		base = base[:i]
+	}
+	colour := []string{base + ".jpg", base + ".png"}
+	switch imgtype {
+	case ImgBinarised:
+		return []string{bin}, nil
+	case ImgColour:
+		return colour, nil
+	case ImgBoth:
+		return append([]string{bin}, colour...), nil
+	}
+	return nil, fmt.Errorf("Unknown image type %s, should be %s, %s or %s", imgtype, ImgBinarised, ImgColour, ImgBoth)
+}
+
+// DownloadBestPngs downloads the binarised image of the best version
+// of each page.
+func DownloadBestPngs(ctx context.Context, dir string, name string, conn Downloader) error {
+	return DownloadBestImages(ctx, dir, name, conn, ImgBinarised)
+}
+
+// DownloadBestImages downloads the images of the best version of each
+// page, as listed in the best file, of the type given, which is
+// ImgBinarised, ImgColour or ImgBoth. The colour images are the
+// original page images, which are found by trying first a jpg and
+// then a png.
+func DownloadBestImages(ctx context.Context, dir string, name string, conn Downloader, imgtype string) error {
+	_, err := bestImageNames("", imgtype)
+	if err != nil {
+		return err
+	}
 	key := filepath.Join(name, "best")
 	fn := filepath.Join(dir, "best")
-	err := conn.Download(conn.WIPStorageId(), key, fn)
+	err = downloadCtx(ctx, conn, key, fn)
 	if err != nil {
 		return fmt.Errorf("Failed to download 'best' file: %v", err)
 	}
@@ -53,30 +185,122 @@ func DownloadBestPngs(dir string, name string, conn Downloader) error {
 
 	s := bufio.NewScanner(f)
 	for s.Scan() {
-		imgname := strings.Replace(s.Text(), ".hocr", ".png", 1)
-		key = filepath.Join(name, imgname)
-		fn = filepath.Join(dir, imgname)
-		conn.Log("Downloading file", key)
-		err = conn.Download(conn.WIPStorageId(), key, fn)
-		if err != nil {
-			return fmt.Errorf("Failed to download file %s: %v", key, err)
+		names, _ := bestImageNames(s.Text(), imgtype)
+		// the binarised image is always the first if it is wanted,
+		// and the colour images are alternatives of which only one
+		// will exist
+		if imgtype != ImgColour {
+			err = downloadImage(ctx, dir, name, conn, names[:1])
+			if err != nil {
+				return err
+			}
+			names = names[1:]
+		}
+		if len(names) > 0 {
+			err = downloadImage(ctx, dir, name, conn, names)
+			if err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
-func DownloadPdfs(dir string, name string, conn Downloader) error {
+// downloadImage downloads the first image of a book in imgnames
+// which can be downloaded, removing any partial downloads of the
+// others.
+func downloadImage(ctx context.Context, dir string, name string, conn Downloader, imgnames []string) error {
+	var err error
+	for _, imgname := range imgnames {
+		key := filepath.Join(name, imgname)
+		fn := filepath.Join(dir, imgname)
+		conn.Log(bookpipeline.DebugTag+"Downloading file", key)
+		err = downloadCtx(ctx, conn, key, fn)
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return err
+		}
+		if err == nil {
+			return nil
+		}
+		_ = os.Remove(fn)
+	}
+	return fmt.Errorf("Failed to download file %s: %v", filepath.Join(name, imgnames[0]), err)
+}
+
+// The PDF types which can be chosen with DownloadPdfs
+const (
+	PdfBinarised = "binarised"
+	PdfColour    = "colour"
+	PdfBoth      = "both"
+)
+
+// pdfSuffixes returns the suffixes of the PDFs of the type given,
+// which is PdfBinarised, PdfColour or PdfBoth. The colour PDFs
+// include the full size one, if it was made.
+func pdfSuffixes(pdftype string) ([]string, error) {
+	switch pdftype {
+	case PdfBinarised:
+		return []string{".binarised.pdf"}, nil
+	case PdfColour:
+		return []string{".colour.pdf", ".original.pdf"}, nil
+	case PdfBoth:
+		return []string{".colour.pdf", ".binarised.pdf", ".original.pdf"}, nil
+	}
+	return nil, fmt.Errorf("Unknown PDF type %s, should be %s, %s or %s", pdftype, PdfBinarised, PdfColour, PdfBoth)
+}
+
+// pdfVolume returns whether an object name is a PDF of the book with
+// the suffix given, either as a single PDF or as one volume of a PDF
+// which was split into parts.
+func pdfVolume(objname string, name string, suffix string) bool {
+	if objname == name+suffix {
+		return true
+	}
+	prefix := name + strings.TrimSuffix(suffix, ".pdf") + "_part"
+	if !strings.HasPrefix(objname, prefix) || !strings.HasSuffix(objname, ".pdf") {
+		return false
+	}
+	_, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(objname, prefix), ".pdf"))
+	return err == nil
+}
+
+// DownloadPdfs downloads the PDFs of a book of the type given, which
+// is PdfBinarised, PdfColour or PdfBoth. If the PDFs were split into
+// several volumes, every volume is downloaded. An error is only
+// returned if none of them could be downloaded.
+func DownloadPdfs(ctx context.Context, dir string, name string, conn DownloadLister, pdftype string) error {
+	suffixes, err := pdfSuffixes(pdftype)
+	if err != nil {
+		return err
+	}
+	objs, err := conn.ListObjects(conn.WIPStorageId(), name+"/")
+	if err != nil {
+		return fmt.Errorf("Failed to get list of files for book %s: %v", name, err)
+	}
 	anydone := false
 	errmsg := ""
-	for _, suffix := range []string{".colour.pdf", ".binarised.pdf", ".original.pdf"} {
-		key := filepath.Join(name, name+suffix)
-		fn := filepath.Join(dir, name+suffix)
-		err := conn.Download(conn.WIPStorageId(), key, fn)
-		if err != nil {
-			_ = os.Remove(fn)
-			errmsg += fmt.Sprintf("Failed to download PDF %s: %v\n", key, err)
-		} else {
-			anydone = true
+	for _, suffix := range suffixes {
+		found := false
+		for _, key := range objs {
+			objname := filepath.Base(key)
+			if !pdfVolume(objname, name, suffix) {
+				continue
+			}
+			found = true
+			fn := filepath.Join(dir, objname)
+			err := downloadCtx(ctx, conn, key, fn)
+			if err == context.Canceled || err == context.DeadlineExceeded {
+				return err
+			}
+			if err != nil {
+				_ = os.Remove(fn)
+				errmsg += fmt.Sprintf("Failed to download PDF %s: %v\n", key, err)
+			} else {
+				anydone = true
+			}
+		}
+		if !found {
+			errmsg += fmt.Sprintf("No PDF %s found\n", filepath.Join(name, name+suffix))
 		}
 	}
 	if anydone == false {
@@ -85,32 +309,184 @@ func DownloadPdfs(dir string, name string, conn Downloader) error {
 	return nil
 }
 
-func DownloadAnalyses(dir string, name string, conn Downloader) error {
-	for _, a := range []string{"conf", "graph.png"} {
+// Analyses lists the names of the analysis files which can be chosen
+// with DownloadSelectedAnalyses, which are all downloaded by
+// DownloadAnalyses
+var Analyses = []string{"conf", "graph", "pagesizes", "dpi", "params", "order", "exclude"}
+
+// analysisFiles maps the name of each of the Analyses to its file
+var analysisFiles = map[string]string{
+	"conf":      "conf",
+	"graph":     "graph.png",
+	"pagesizes": PageSizesFile,
+	"dpi":       DPIFile,
+	"params":    ParamsFile,
+	"order":     OrderFile,
+	"exclude":   ExcludeFile,
+}
+
+// ParseAnalyses parses a comma separated list of the names of
+// Analyses, like "conf,graph", returning an error if any are unknown.
+// An empty list selects none of them.
+func ParseAnalyses(s string) ([]string, error) {
+	var analyses []string
+	for _, a := range strings.Split(s, ",") {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+		if _, ok := analysisFiles[a]; !ok {
+			return nil, fmt.Errorf("Unknown analysis %s, should be one of %s", a, strings.Join(Analyses, ", "))
+		}
+		analyses = append(analyses, a)
+	}
+	return analyses, nil
+}
+
+func DownloadAnalyses(ctx context.Context, dir string, name string, conn Downloader) error {
+	return DownloadSelectedAnalyses(ctx, dir, name, conn, Analyses)
+}
+
+// DownloadSelectedAnalyses downloads the analysis files of a book
+// named in analyses, which should be from Analyses. Only a failure to
+// download the conf file is an error, as the others are not made for
+// every book.
+func DownloadSelectedAnalyses(ctx context.Context, dir string, name string, conn Downloader, analyses []string) error {
+	for _, sel := range analyses {
+		a, ok := analysisFiles[sel]
+		if !ok {
+			return fmt.Errorf("Unknown analysis %s, should be one of %s", sel, strings.Join(Analyses, ", "))
+		}
 		key := filepath.Join(name, a)
 		fn := filepath.Join(dir, a)
-		err := conn.Download(conn.WIPStorageId(), key, fn)
-		// ignore errors with graph.png, as it will not exist in the case of a 1 page book
-		if err != nil && a != "graph.png" {
+		err := downloadCtx(ctx, conn, key, fn)
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return err
+		}
+		// ignore errors with graph.png, as it will not exist in the case of a 1 page book,
+		// with the page sizes file, as older books don't have one, with the DPI file,
+		// as it is only saved if the DPI of a book is known, and with the parameters
+		// file, as it is only saved if bookpipeline is run with -params, and with
+		// the page order file, as it is only saved if the book was uploaded with one,
+		// and with the exclusions file, as it is only saved if pages are excluded
+		if err != nil && (a == PageSizesFile || a == DPIFile || a == ParamsFile || a == OrderFile || a == ExcludeFile) {
+			_ = os.Remove(fn)
+		}
+		if err != nil && a == "conf" {
 			return fmt.Errorf("Failed to download analysis file %s: %v", key, err)
 		}
 	}
 	return nil
 }
 
-func DownloadAll(dir string, name string, conn DownloadLister) error {
+const downloadRetries = 3
+
+// downloadRetry downloads key to fn with downloadCtx, retrying a few
+// times if it fails, in case the failure was transient. As with
+// downloadCtx, fn is only saved once a download succeeds.
+func downloadRetry(ctx context.Context, conn Downloader, key string, fn string) error {
+	err := downloadCtx(ctx, conn, key, fn)
+	for i := 0; err != nil && i < downloadRetries; i++ {
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return err
+		}
+		conn.Log("Error downloading", key, "retrying:", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(downloadRetryWait):
+		}
+		err = downloadCtx(ctx, conn, key, fn)
+	}
+	return err
+}
+
+// DownloadAll downloads every file of a book into dir. Each file is
+// retried a few times if it fails to download, and if it still fails
+// the rest of the files are downloaded anyway, with an error listing
+// the files which failed returned at the end. With skipexisting any
+// files which are already in dir are not downloaded again, so that a
+// failed download can be finished by running it again. Files are
+// only saved under their own names once they have been downloaded
+// completely, so any which exist are complete, and any temporary
+// files left by an interrupted download are removed.
+func DownloadAll(ctx context.Context, dir string, name string, conn DownloadLister, skipexisting bool) error {
 	objs, err := conn.ListObjects(conn.WIPStorageId(), name)
 	if err != nil {
 		return fmt.Errorf("Failed to get list of files for book %s: %v", name, err)
 	}
+	var failed []string
+	var lasterr error
 	for _, i := range objs {
 		base := filepath.Base(i)
 		fn := filepath.Join(dir, base)
-		conn.Log("Downloading", i)
-		err = conn.Download(conn.WIPStorageId(), i, fn)
+		removePartials(fn)
+		if skipexisting {
+			_, err = os.Stat(fn)
+			if err == nil {
+				conn.Log(bookpipeline.DebugTag+"Skipping", i, "as it has already been downloaded")
+				continue
+			}
+		}
+		conn.Log(bookpipeline.DebugTag+"Downloading", i)
+		err = downloadRetry(ctx, conn, i, fn)
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return err
+		}
 		if err != nil {
-			return fmt.Errorf("Failed to download file %s: %v", i, err)
+			conn.Log("Failed to download", i, err)
+			failed = append(failed, i)
+			lasterr = err
 		}
 	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Failed to download %d of %d files for book %s, the rest were saved in %s: %s (last error: %v)", len(failed), len(objs), name, dir, strings.Join(failed, ", "), lasterr)
+	}
 	return nil
 }
+
+// AlternativesDir is the directory inside a book's results directory
+// which DownloadAlternatives saves the alternative versions of each
+// page into.
+const AlternativesDir = "alternatives"
+
+// DownloadAlternatives downloads the hOCR of every version of each
+// page, one for each binarisation threshold, into the alternatives
+// directory in dir, so that proofreaders can consult another version
+// when the best one is wrong. The versions are listed in the conf
+// file, which should already have been downloaded into dir, so any
+// versions with no words, which Analyse leaves out of it, are not
+// included.
+func DownloadAlternatives(ctx context.Context, dir string, name string, conn Downloader) error {
+	f, err := os.Open(filepath.Join(dir, "conf"))
+	if err != nil {
+		return fmt.Errorf("Failed to open conf file: %v", err)
+	}
+	defer f.Close()
+
+	altdir := filepath.Join(dir, AlternativesDir)
+	err = os.MkdirAll(altdir, 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %s: %v", altdir, err)
+	}
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Split(s.Text(), "\t")
+		if len(fields) != 2 {
+			continue
+		}
+		base := filepath.Base(fields[0])
+		key := filepath.Join(name, base)
+		fn := filepath.Join(altdir, base)
+		conn.Log(bookpipeline.DebugTag+"Downloading file", key)
+		err = downloadCtx(ctx, conn, key, fn)
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to download file %s: %v", key, err)
+		}
+	}
+	return s.Err()
+}
@@ -0,0 +1,582 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowDownloader writes part of each file it is asked to download,
+// and then waits until it is released before finishing
+type slowDownloader struct {
+	mu      sync.Mutex
+	started []string
+	release chan bool
+}
+
+func (d *slowDownloader) Download(bucket string, key string, fn string) error {
+	d.mu.Lock()
+	d.started = append(d.started, key)
+	d.mu.Unlock()
+	err := ioutil.WriteFile(fn, []byte("partial"), 0644)
+	if err != nil {
+		return err
+	}
+	<-d.release
+	return nil
+}
+
+func (d *slowDownloader) ListObjects(bucket string, prefix string) ([]string, error) {
+	return []string{"book/0001.png", "book/0002.png", "book/0003.png"}, nil
+}
+
+func (d *slowDownloader) Log(v ...interface{}) {}
+func (d *slowDownloader) WIPStorageId() string { return "wip" }
+
+func Test_DownloadAllCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "downloadtest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conn := &slowDownloader{release: make(chan bool)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	err = DownloadAll(ctx, dir, "book", conn, false)
+	if err != context.Canceled {
+		t.Fatalf("Expected context cancelled error, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("Download took %v to stop after being cancelled", time.Since(start))
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if len(conn.started) != 1 {
+		t.Fatalf("Expected only the first file to be downloaded, got %v", conn.started)
+	}
+
+	// the download which was in progress is still being written
+	// to a temporary file, but not to its final name
+	_, err = os.Stat(filepath.Join(dir, "0001.png"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("Expected partially downloaded file not to be saved as 0001.png")
+	}
+
+	// once the download finishes the temporary file is removed
+	close(conn.release)
+	var files []os.FileInfo
+	for i := 0; i < 100; i++ {
+		files, err = ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("Could not read directory: %v", err)
+		}
+		if len(files) == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(files) > 0 {
+		t.Fatalf("Partially downloaded file %s was not removed", filepath.Join(dir, files[0].Name()))
+	}
+}
+
+// ctxDownloader writes part of each file it is asked to download,
+// and then waits until its context is cancelled
+type ctxDownloader struct{}
+
+func (d ctxDownloader) Download(bucket string, key string, fn string) error {
+	return d.DownloadWithContext(context.Background(), bucket, key, fn)
+}
+
+func (d ctxDownloader) DownloadWithContext(ctx context.Context, bucket string, key string, fn string) error {
+	err := ioutil.WriteFile(fn, []byte("partial"), 0644)
+	if err != nil {
+		return err
+	}
+	<-ctx.Done()
+	return errors.New("RequestCanceled: request context canceled")
+}
+
+func (d ctxDownloader) Log(v ...interface{}) {}
+func (d ctxDownloader) WIPStorageId() string { return "wip" }
+
+// Test_downloadCtx tests that a download which is cancelled leaves
+// no file behind, and that one which succeeds is saved
+func Test_downloadCtx(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	dir, err := ioutil.TempDir("", "downloadctxtest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	err = downloadCtx(ctx, ctxDownloader{}, "book/0001.png", filepath.Join(dir, "0001.png"))
+	if err != context.Canceled {
+		t.Fatalf("Expected context cancelled error, got %v", err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Could not read directory: %v", err)
+	}
+	if len(files) > 0 {
+		t.Fatalf("Partially downloaded file %s was not removed", filepath.Join(dir, files[0].Name()))
+	}
+
+	conn := newTestConn(t, vlog)
+	err = conn.Upload(conn.WIPStorageId(), "book/0001.png", "testdata/good/1.png")
+	if err != nil {
+		t.Fatalf("Could not upload test file: %v", err)
+	}
+	fn := filepath.Join(dir, "0001.png")
+	err = downloadCtx(context.Background(), conn, "book/0001.png", fn)
+	if err != nil {
+		t.Fatalf("Error downloading file: %v", err)
+	}
+	want, err := ioutil.ReadFile("testdata/good/1.png")
+	if err != nil {
+		t.Fatalf("Could not read test file: %v", err)
+	}
+	got, err := ioutil.ReadFile(fn)
+	if err != nil || string(got) != string(want) {
+		t.Fatalf("Expected downloaded file to match the original: %v", err)
+	}
+	files, err = ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Could not read directory: %v", err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("Expected only the downloaded file, got %d files", len(files))
+	}
+}
+
+// flakyDownloader fails to download each key the number of times in
+// fails, leaving a partial file each time, or always if it is
+// negative
+type flakyDownloader struct {
+	fails    map[string]int
+	attempts map[string]int
+}
+
+func (d *flakyDownloader) Download(bucket string, key string, fn string) error {
+	d.attempts[key]++
+	if d.fails[key] < 0 || d.attempts[key] <= d.fails[key] {
+		_ = ioutil.WriteFile(fn, []byte("partial"), 0644)
+		return errors.New("connection reset")
+	}
+	return ioutil.WriteFile(fn, []byte(key), 0644)
+}
+
+func (d *flakyDownloader) ListObjects(bucket string, prefix string) ([]string, error) {
+	return []string{"book/0001.png", "book/0002.png", "book/0003.png"}, nil
+}
+
+func (d *flakyDownloader) Log(v ...interface{}) {}
+func (d *flakyDownloader) WIPStorageId() string { return "wip" }
+
+// Test_DownloadAllRetry tests that failed downloads are retried, and
+// that if one keeps failing the rest are still downloaded, and the
+// one which failed is reported
+func Test_DownloadAllRetry(t *testing.T) {
+	origWait := downloadRetryWait
+	downloadRetryWait = 0
+	defer func() { downloadRetryWait = origWait }()
+
+	dir, err := ioutil.TempDir("", "downloadretrytest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conn := &flakyDownloader{
+		fails:    map[string]int{"book/0001.png": 2, "book/0002.png": -1},
+		attempts: make(map[string]int),
+	}
+	err = DownloadAll(context.Background(), dir, "book", conn, false)
+	if err == nil {
+		t.Fatalf("Expected an error for the file which always fails")
+	}
+	if !strings.Contains(err.Error(), "book/0002.png") || strings.Contains(err.Error(), "book/0001.png") {
+		t.Fatalf("Expected error to list only book/0002.png, got: %v", err)
+	}
+	if conn.attempts["book/0001.png"] != 3 {
+		t.Fatalf("Expected book/0001.png to succeed on the third attempt, got %d attempts", conn.attempts["book/0001.png"])
+	}
+	if conn.attempts["book/0002.png"] != downloadRetries+1 {
+		t.Fatalf("Expected book/0002.png to be tried %d times, got %d", downloadRetries+1, conn.attempts["book/0002.png"])
+	}
+
+	for _, name := range []string{"0001.png", "0003.png"} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("Expected %s to have been downloaded: %v", name, err)
+		}
+		if string(b) != "book/"+name {
+			t.Fatalf("Expected %s to be complete, got %q", name, b)
+		}
+	}
+	_, err = os.Stat(filepath.Join(dir, "0002.png"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("Expected partially downloaded 0002.png to be removed, got %v", err)
+	}
+
+	// a temporary file left by a download which was killed is
+	// neither mistaken for the file nor left behind
+	partial := filepath.Join(dir, partialPrefix(filepath.Join(dir, "0002.png"))+"123")
+	err = ioutil.WriteFile(partial, []byte("partial"), 0644)
+	if err != nil {
+		t.Fatalf("Could not write partial file: %v", err)
+	}
+
+	// running again with skipexisting only retries the missing file
+	conn.fails = nil
+	conn.attempts = make(map[string]int)
+	err = DownloadAll(context.Background(), dir, "book", conn, true)
+	if err != nil {
+		t.Fatalf("Error downloading again with skipexisting: %v", err)
+	}
+	if len(conn.attempts) != 1 || conn.attempts["book/0002.png"] != 1 {
+		t.Fatalf("Expected only book/0002.png to be downloaded again, got %v", conn.attempts)
+	}
+	_, err = os.Stat(partial)
+	if !os.IsNotExist(err) {
+		t.Fatalf("Expected partial file %s to be removed, got %v", partial, err)
+	}
+}
+
+// Test_DownloadAlternatives tests that the hOCR of every threshold of
+// each page is downloaded, not just the best one
+func Test_DownloadAlternatives(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	dir, err := ioutil.TempDir("", "alternativestest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conn := newTestConn(t, vlog)
+
+	analysedir := filepath.Join(dir, "analyse", "book")
+	err = os.MkdirAll(analysedir, 0755)
+	if err != nil {
+		t.Fatalf("Could not create directory: %v", err)
+	}
+	var hocrs, expected []string
+	for _, pg := range []string{"0001", "0002"} {
+		for i, thresh := range []string{"0.1", "0.2", "0.3"} {
+			name := pg + "_bin" + thresh + ".hocr"
+			fn := filepath.Join(analysedir, name)
+			err = writeHocr(fn, 60+i*10, "alternative", "text")
+			if err != nil {
+				t.Fatalf("Could not write hOCR file %s: %v", fn, err)
+			}
+			err = conn.Upload(conn.WIPStorageId(), "book/"+name, fn)
+			if err != nil {
+				t.Fatalf("Could not upload %s: %v", name, err)
+			}
+			hocrs = append(hocrs, fn)
+			expected = append(expected, name)
+		}
+	}
+
+	done, err := runAnalyse(Analyse(conn, AnalyseOptions{}), hocrs, vlog)
+	if err != nil {
+		t.Fatalf("Error in Analyse: %v\nLog: %s", err, slog.log)
+	}
+	for _, fn := range done {
+		err = conn.Upload(conn.WIPStorageId(), "book/"+filepath.Base(fn), fn)
+		if err != nil {
+			t.Fatalf("Could not upload %s: %v", fn, err)
+		}
+	}
+
+	savedir := filepath.Join(dir, "save")
+	err = os.MkdirAll(savedir, 0755)
+	if err != nil {
+		t.Fatalf("Could not create directory: %v", err)
+	}
+	err = DownloadAnalyses(context.Background(), savedir, "book", conn)
+	if err != nil {
+		t.Fatalf("Error downloading analyses: %v", err)
+	}
+	err = DownloadAlternatives(context.Background(), savedir, "book", conn)
+	if err != nil {
+		t.Fatalf("Error downloading alternatives: %v\nLog: %s", err, slog.log)
+	}
+
+	found, err := ioutil.ReadDir(filepath.Join(savedir, AlternativesDir))
+	if err != nil {
+		t.Fatalf("Could not read alternatives directory: %v", err)
+	}
+	var names []string
+	for _, f := range found {
+		names = append(names, f.Name())
+	}
+	sort.Strings(names)
+	if strings.Join(names, " ") != strings.Join(expected, " ") {
+		t.Fatalf("Expected alternatives %v, got %v", expected, names)
+	}
+}
+
+func Test_DownloadPdfs(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	dir, err := ioutil.TempDir("", "downloadpdfstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conn := newTestConn(t, vlog)
+	for _, suffix := range []string{".binarised.pdf", ".colour.pdf", ".original.pdf"} {
+		fn := filepath.Join(dir, "book"+suffix)
+		err = ioutil.WriteFile(fn, []byte("%PDF-1.3\n"), 0644)
+		if err != nil {
+			t.Fatalf("Could not write %s: %v", fn, err)
+		}
+		err = conn.Upload(conn.WIPStorageId(), "book/book"+suffix, fn)
+		if err != nil {
+			t.Fatalf("Could not upload %s: %v", fn, err)
+		}
+	}
+	// a book split into volumes, which aren't confused with the
+	// single PDFs of a book whose name starts the same
+	for _, n := range []string{"splitbook.colour_part1.pdf", "splitbook.colour_part2.pdf", "splitbook.binarised_part1.pdf", "splitbook.colour_partial.pdf"} {
+		fn := filepath.Join(dir, n)
+		err = ioutil.WriteFile(fn, []byte("%PDF-1.3\n"), 0644)
+		if err != nil {
+			t.Fatalf("Could not write %s: %v", fn, err)
+		}
+		err = conn.Upload(conn.WIPStorageId(), "splitbook/"+n, fn)
+		if err != nil {
+			t.Fatalf("Could not upload %s: %v", fn, err)
+		}
+	}
+
+	cases := []struct {
+		name     string
+		book     string
+		pdftype  string
+		expected []string
+		err      bool
+	}{
+		{"binarised", "book", PdfBinarised, []string{"book.binarised.pdf"}, false},
+		{"colour", "book", PdfColour, []string{"book.colour.pdf", "book.original.pdf"}, false},
+		{"both", "book", PdfBoth, []string{"book.binarised.pdf", "book.colour.pdf", "book.original.pdf"}, false},
+		{"greyscale", "book", "greyscale", nil, true},
+		{"splitcolour", "splitbook", PdfColour, []string{"splitbook.colour_part1.pdf", "splitbook.colour_part2.pdf"}, false},
+		{"splitboth", "splitbook", PdfBoth, []string{"splitbook.binarised_part1.pdf", "splitbook.colour_part1.pdf", "splitbook.colour_part2.pdf"}, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			savedir := filepath.Join(dir, c.name)
+			err := os.MkdirAll(savedir, 0755)
+			if err != nil {
+				t.Fatalf("Could not create directory: %v", err)
+			}
+			err = DownloadPdfs(context.Background(), savedir, c.book, conn, c.pdftype)
+			if err == nil && c.err {
+				t.Fatalf("Expected an error, got none")
+			}
+			if err != nil && !c.err {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			found, err := ioutil.ReadDir(savedir)
+			if err != nil {
+				t.Fatalf("Could not read directory: %v", err)
+			}
+			var names []string
+			for _, f := range found {
+				names = append(names, f.Name())
+			}
+			if strings.Join(names, " ") != strings.Join(c.expected, " ") {
+				t.Fatalf("Expected %v to be downloaded, got %v", c.expected, names)
+			}
+		})
+	}
+}
+
+func Test_DownloadBestImages(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	dir, err := ioutil.TempDir("", "downloadbestimagestest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conn := newTestConn(t, vlog)
+
+	// page 0001 has a jpg original and 0002 a png original, and only
+	// the images of the best versions should be downloaded. The name
+	// of page 0003 contains "_bin" before its threshold.
+	best := "0001_bin0.2.hocr\n0002_bin0.1_psm6.hocr\nscan_binder_0003_bin0.2.hocr\n"
+	files := map[string]string{
+		"best":                        best,
+		"0001.jpg":                    "",
+		"0001_bin0.1.png":             "",
+		"0001_bin0.2.png":             "",
+		"0002.png":                    "",
+		"0002_bin0.1.png":             "",
+		"0002_bin0.2.png":             "",
+		"scan_binder_0003.jpg":        "",
+		"scan_binder_0003_bin0.2.png": "",
+	}
+	for name, content := range files {
+		fn := filepath.Join(dir, name)
+		err = ioutil.WriteFile(fn, []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("Could not write %s: %v", fn, err)
+		}
+		err = conn.Upload(conn.WIPStorageId(), "book/"+name, fn)
+		if err != nil {
+			t.Fatalf("Could not upload %s: %v", fn, err)
+		}
+	}
+
+	cases := []struct {
+		imgtype  string
+		expected []string
+		err      bool
+	}{
+		{ImgBinarised, []string{"0001_bin0.2.png", "0002_bin0.1.png", "best", "scan_binder_0003_bin0.2.png"}, false},
+		{ImgColour, []string{"0001.jpg", "0002.png", "best", "scan_binder_0003.jpg"}, false},
+		{ImgBoth, []string{"0001.jpg", "0001_bin0.2.png", "0002.png", "0002_bin0.1.png", "best", "scan_binder_0003.jpg", "scan_binder_0003_bin0.2.png"}, false},
+		{"greyscale", nil, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.imgtype, func(t *testing.T) {
+			savedir := filepath.Join(dir, "save", c.imgtype)
+			err := os.MkdirAll(savedir, 0755)
+			if err != nil {
+				t.Fatalf("Could not create directory: %v", err)
+			}
+			err = DownloadBestImages(context.Background(), savedir, "book", conn, c.imgtype)
+			if err == nil && c.err {
+				t.Fatalf("Expected an error, got none")
+			}
+			if err != nil && !c.err {
+				t.Fatalf("Expected no error, got %v\nLog: %s", err, slog.log)
+			}
+			found, err := ioutil.ReadDir(savedir)
+			if err != nil {
+				t.Fatalf("Could not read directory: %v", err)
+			}
+			var names []string
+			for _, f := range found {
+				names = append(names, f.Name())
+			}
+			if strings.Join(names, " ") != strings.Join(c.expected, " ") {
+				t.Fatalf("Expected %v to be downloaded, got %v", c.expected, names)
+			}
+		})
+	}
+}
+
+func Test_DownloadSelectedAnalyses(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	dir, err := ioutil.TempDir("", "downloadanalysestest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conn := newTestConn(t, vlog)
+	// there is no dpi file, as the DPI of the book isn't known
+	for _, name := range []string{"conf", "graph.png", PageSizesFile, ParamsFile} {
+		fn := filepath.Join(dir, name)
+		err = ioutil.WriteFile(fn, []byte(name), 0644)
+		if err != nil {
+			t.Fatalf("Could not write %s: %v", fn, err)
+		}
+		err = conn.Upload(conn.WIPStorageId(), "book/"+name, fn)
+		if err != nil {
+			t.Fatalf("Could not upload %s: %v", fn, err)
+		}
+	}
+
+	cases := []struct {
+		analyses string
+		expected []string
+		err      bool
+	}{
+		{"conf", []string{"conf"}, false},
+		{"conf,pagesizes", []string{"conf", PageSizesFile}, false},
+		{"graph, params", []string{"graph.png", ParamsFile}, false},
+		{"dpi", nil, false},
+		{"", nil, false},
+		{strings.Join(Analyses, ","), []string{"conf", "graph.png", PageSizesFile, ParamsFile}, false},
+		{"conf,report", nil, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.analyses, func(t *testing.T) {
+			savedir := filepath.Join(dir, "save", strings.ReplaceAll(t.Name(), "/", "_"))
+			err := os.MkdirAll(savedir, 0755)
+			if err != nil {
+				t.Fatalf("Could not create directory: %v", err)
+			}
+			analyses, err := ParseAnalyses(c.analyses)
+			if err == nil && c.err {
+				t.Fatalf("Expected an error, got none")
+			}
+			if err != nil && !c.err {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if c.err {
+				return
+			}
+			err = DownloadSelectedAnalyses(context.Background(), savedir, "book", conn, analyses)
+			if err != nil {
+				t.Fatalf("Error downloading analyses: %v\nLog: %s", err, slog.log)
+			}
+			found, err := ioutil.ReadDir(savedir)
+			if err != nil {
+				t.Fatalf("Could not read directory: %v", err)
+			}
+			var names []string
+			for _, f := range found {
+				names = append(names, f.Name())
+			}
+			sort.Strings(names)
+			sort.Strings(c.expected)
+			if strings.Join(names, " ") != strings.Join(c.expected, " ") {
+				t.Fatalf("Expected %v to be downloaded, got %v", c.expected, names)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+// ReadGraphConfs reads the confidence of each page of a book from
+// the files written by Analyse in dir, as used for its graph. If
+// there is a best file the confidence of the version of each page
+// listed in it is used, as with ReadBestConfs, otherwise the highest
+// confidence of each page in the conf file is used.
+func ReadGraphConfs(dir string) (map[string]*bookpipeline.Conf, error) {
+	_, err := os.Stat(filepath.Join(dir, "best"))
+	if err == nil {
+		return ReadBestConfs(dir)
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Error checking for best file: %v", err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "conf"))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading conf file: %v", err)
+	}
+	pages := make(map[string]*bookpipeline.Conf)
+	for _, l := range strings.Split(string(b), "\n") {
+		fields := strings.Split(l, "\t")
+		if len(fields) != 2 {
+			continue
+		}
+		var c bookpipeline.Conf
+		c.Path = filepath.Base(fields[0])
+		_, err = fmt.Sscanf(fields[1], "%f", &c.Conf)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing confidence for %s: %v", c.Path, err)
+		}
+		pg := pageName(c.Path)
+		if pages[pg] == nil || c.Conf > pages[pg].Conf {
+			pages[pg] = &c
+		}
+	}
+
+	confs := make(map[string]*bookpipeline.Conf)
+	for _, c := range pages {
+		confs[c.Path] = c
+	}
+	return confs, nil
+}
+
+// GraphFromConf renders the confidence graph of a book from the conf
+// and best files written by Analyse in dir, as read by
+// ReadGraphConfs, so that the graph can be recreated without
+// analysing the book again. The graph is styled with opts.
+func GraphFromConf(dir string, opts bookpipeline.GraphOptions, w io.Writer) error {
+	confs, err := ReadGraphConfs(dir)
+	if err != nil {
+		return err
+	}
+	bookname := filepath.Base(filepath.Clean(dir))
+	err = bookpipeline.GraphWithOptions(confs, bookname, opts, w)
+	if err != nil {
+		return fmt.Errorf("Error creating graph: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+func Test_GraphFromConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graphconftest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	const pages = 12
+	var conf, best string
+	for pg := 1; pg <= pages; pg++ {
+		for i, bin := range []string{"0.1", "0.2", "0.3"} {
+			conf += fmt.Sprintf("%s/%04d_bin%s.hocr\t%d\n", dir, pg, bin, 50+(pg*7+i*13)%40)
+		}
+		best += fmt.Sprintf("%04d_bin0.2.hocr\n", pg)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "conf"), []byte(conf), 0644)
+	if err != nil {
+		t.Fatalf("Could not write conf file: %v", err)
+	}
+
+	for _, withbest := range []bool{false, true} {
+		t.Run(fmt.Sprintf("best%v", withbest), func(t *testing.T) {
+			if withbest {
+				err := ioutil.WriteFile(filepath.Join(dir, "best"), []byte(best), 0644)
+				if err != nil {
+					t.Fatalf("Could not write best file: %v", err)
+				}
+			}
+
+			confs, err := ReadGraphConfs(dir)
+			if err != nil {
+				t.Fatalf("Error reading confidences: %v", err)
+			}
+			if len(confs) != pages {
+				t.Fatalf("Expected %d pages, got %d", pages, len(confs))
+			}
+			for _, c := range confs {
+				pg, err := strconv.Atoi(pageName(c.Path))
+				if err != nil {
+					t.Fatalf("Unexpected path %s: %v", c.Path, err)
+				}
+				if withbest && !strings.HasSuffix(c.Path, "_bin0.2.hocr") {
+					t.Fatalf("Expected the version in the best file to be used, got %s", c.Path)
+				}
+				if !withbest {
+					for i := 0; i < 3; i++ {
+						if other := float64(50 + (pg*7+i*13)%40); other > c.Conf {
+							t.Fatalf("Expected the highest confidence for page %d, got %s with %.0f", pg, c.Path, c.Conf)
+						}
+					}
+				}
+			}
+
+			var buf bytes.Buffer
+			err = GraphFromConf(dir, bookpipeline.GraphOptions{XAxis: "Page number", Guidelines: true}, &buf)
+			if err != nil {
+				t.Fatalf("Error creating graph: %v", err)
+			}
+			_, err = png.Decode(&buf)
+			if err != nil {
+				t.Fatalf("Expected graph to be a PNG: %v", err)
+			}
+		})
+	}
+}
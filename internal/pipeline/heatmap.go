@@ -0,0 +1,130 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// HeatmapDir is the directory WriteHeatmaps saves heatmaps into,
+// relative to the book directory
+const HeatmapDir = "heatmap"
+
+// heatmapAlpha is the opacity of the tint over each word in a heatmap
+const heatmapAlpha = 0x80
+
+// ConfColour returns the colour used for a word with the confidence
+// given in a heatmap, which runs from red for 0 through yellow to
+// green for 100.
+func ConfColour(conf float64) color.NRGBA {
+	if conf < 0 {
+		conf = 0
+	}
+	if conf > 100 {
+		conf = 100
+	}
+	c := color.NRGBA{R: 255, G: 255, A: heatmapAlpha}
+	if conf < 50 {
+		c.G = uint8(conf * 255 / 50)
+	} else {
+		c.R = uint8((100 - conf) * 255 / 50)
+	}
+	return c
+}
+
+// WriteHeatmap saves a copy of the page image imgfn to outfn as a
+// PNG, with the bounding box of each word in the hOCR file hocrfn
+// tinted with ConfColour of its confidence, so that areas which were
+// poorly recognised stand out. If the size of the image differs from
+// the page size in the hOCR, the boxes are scaled to match.
+func WriteHeatmap(hocrfn string, imgfn string, outfn string) error {
+	pg, err := getPageWords(hocrfn, filepath.Base(imgfn))
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(imgfn)
+	if err != nil {
+		return fmt.Errorf("Error opening image %s: %v", imgfn, err)
+	}
+	defer f.Close()
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return fmt.Errorf("Error decoding image %s: %v", imgfn, err)
+	}
+
+	b := src.Bounds()
+	img := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(img, img.Bounds(), src, b.Min, draw.Src)
+
+	xscale, yscale := 1.0, 1.0
+	if pg.Width > 0 && pg.Height > 0 {
+		xscale = float64(b.Dx()) / float64(pg.Width)
+		yscale = float64(b.Dy()) / float64(pg.Height)
+	}
+	for _, w := range pg.Words {
+		r := image.Rect(
+			int(float64(w.Bbox[0])*xscale), int(float64(w.Bbox[1])*yscale),
+			int(float64(w.Bbox[2])*xscale), int(float64(w.Bbox[3])*yscale))
+		draw.Draw(img, r.Intersect(img.Bounds()), image.NewUniform(ConfColour(w.Conf)), image.Point{}, draw.Over)
+	}
+
+	out, err := os.Create(outfn)
+	if err != nil {
+		return fmt.Errorf("Error creating heatmap %s: %v", outfn, err)
+	}
+	err = png.Encode(out, img)
+	if err != nil {
+		out.Close()
+		return fmt.Errorf("Error encoding heatmap %s: %v", outfn, err)
+	}
+	return out.Close()
+}
+
+// WriteHeatmaps writes a heatmap with WriteHeatmap for each page of
+// a book downloaded to dir whose best image (the .png named like its
+// best hOCR) is there too, saving them in dir/heatmap. The names of
+// the heatmaps written are returned.
+func WriteHeatmaps(dir string) ([]string, error) {
+	confs, err := ReadBestConfs(dir)
+	if err != nil {
+		return nil, err
+	}
+	var hocrs []string
+	for name := range confs {
+		hocrs = append(hocrs, name)
+	}
+	sort.Strings(hocrs)
+
+	outdir := filepath.Join(dir, HeatmapDir)
+	err = os.MkdirAll(outdir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating heatmap directory: %v", err)
+	}
+
+	var done []string
+	for _, h := range hocrs {
+		img := HocrImage(h)
+		_, err = os.Stat(filepath.Join(dir, img))
+		if err != nil {
+			continue
+		}
+		outfn := filepath.Join(outdir, img)
+		err = WriteHeatmap(filepath.Join(dir, h), filepath.Join(dir, img), outfn)
+		if err != nil {
+			return done, err
+		}
+		done = append(done, outfn)
+	}
+	return done, nil
+}
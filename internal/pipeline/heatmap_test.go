@@ -0,0 +1,112 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const heatmapHocr = `<?xml version="1.0" encoding="UTF-8"?>
+<html><body>
+<div class='ocr_page' id='page_1' title='image "page.png"; bbox 0 0 100 100'>
+<div class='ocr_carea' id='block_1_1'><p class='ocr_par' id='par_1_1'>
+<span class='ocr_line' id='line_1_1' title='bbox 10 10 90 30'>
+<span class='ocrx_word' id='word_1_1' title='bbox 10 10 40 30; x_wconf 10'>low</span>
+<span class='ocrx_word' id='word_1_2' title='bbox 60 10 90 30; x_wconf 95'>high</span>
+</span>
+</p></div>
+</div>
+</body></html>
+`
+
+// isRed returns whether a colour is clearly tinted red
+func isRed(c color.Color) bool {
+	r, g, b, _ := c.RGBA()
+	return r > g+0x3000 && r > b+0x3000
+}
+
+// isGreen returns whether a colour is clearly tinted green
+func isGreen(c color.Color) bool {
+	r, g, b, _ := c.RGBA()
+	return g > r+0x3000 && g > b+0x3000
+}
+
+func Test_WriteHeatmap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "heatmaptest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	hocrfn := filepath.Join(dir, "0001_bin0.2.hocr")
+	err = ioutil.WriteFile(hocrfn, []byte(heatmapHocr), 0644)
+	if err != nil {
+		t.Fatalf("Could not write hOCR: %v", err)
+	}
+
+	cases := []struct {
+		name  string
+		size  int
+		scale int
+	}{
+		{"same size", 100, 1},
+		{"larger image", 200, 2},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			src := image.NewGray(image.Rect(0, 0, c.size, c.size))
+			for i := range src.Pix {
+				src.Pix[i] = 255
+			}
+			imgfn := filepath.Join(dir, "page.png")
+			f, err := os.Create(imgfn)
+			if err != nil {
+				t.Fatalf("Could not create image: %v", err)
+			}
+			err = png.Encode(f, src)
+			f.Close()
+			if err != nil {
+				t.Fatalf("Could not encode image: %v", err)
+			}
+
+			outfn := filepath.Join(dir, "heatmap.png")
+			err = WriteHeatmap(hocrfn, imgfn, outfn)
+			if err != nil {
+				t.Fatalf("Error writing heatmap: %v", err)
+			}
+
+			f, err = os.Open(outfn)
+			if err != nil {
+				t.Fatalf("Could not open heatmap: %v", err)
+			}
+			defer f.Close()
+			img, err := png.Decode(f)
+			if err != nil {
+				t.Fatalf("Could not decode heatmap: %v", err)
+			}
+
+			low := img.At(25*c.scale, 20*c.scale)
+			if !isRed(low) {
+				t.Fatalf("Expected low confidence word to be red, got %v", low)
+			}
+			high := img.At(75*c.scale, 20*c.scale)
+			if !isGreen(high) {
+				t.Fatalf("Expected high confidence word to be green, got %v", high)
+			}
+			outside := img.At(50*c.scale, 70*c.scale)
+			r, g, b, _ := outside.RGBA()
+			if r != 0xffff || g != 0xffff || b != 0xffff {
+				t.Fatalf("Expected area outside of words to be unchanged, got %v", outside)
+			}
+		})
+	}
+}
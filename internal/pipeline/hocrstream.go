@@ -0,0 +1,170 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+// StreamWords reads an hOCR document from r, calling fn with each
+// word (ocrx_word element) as soon as it has been read. Unlike the
+// functions in the hocr package the whole document is never held in
+// memory, which matters for very large pages on servers with little
+// memory. If fn returns an error, reading stops and the error is
+// returned.
+func StreamWords(r io.Reader, fn func(Word) error) error {
+	return streamHocr(r, func(w Word, line int) error {
+		return fn(w)
+	})
+}
+
+// lineClasses are the hOCR classes which tesseract uses for lines
+var lineClasses = map[string]bool{
+	"ocr_line":      true,
+	"ocr_caption":   true,
+	"ocr_header":    true,
+	"ocr_textfloat": true,
+}
+
+// streamHocr does the work of StreamWords, also passing fn the
+// number of the line each word is in, starting from 1, or 0 if the
+// word isn't in a line.
+func streamHocr(r io.Reader, fn func(Word, int) error) error {
+	d := xml.NewDecoder(r)
+
+	// line is the number of the current line, and linedepth is the
+	// nesting depth within it, or 0 if not in a line
+	var line, linedepth int
+
+	// depth is the nesting depth within the current word, or 0 if
+	// not in a word
+	var depth int
+	var title string
+	var text strings.Builder
+
+	for {
+		t, err := d.RawToken()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Error parsing hOCR: %v", err)
+		}
+		switch el := t.(type) {
+		case xml.StartElement:
+			if linedepth > 0 {
+				linedepth++
+			}
+			if depth > 0 {
+				depth++
+				continue
+			}
+			for _, a := range el.Attr {
+				if a.Name.Local == "class" && lineClasses[a.Value] && linedepth == 0 {
+					line++
+					linedepth = 1
+				}
+				if a.Name.Local == "class" && a.Value == "ocrx_word" {
+					depth = 1
+					text.Reset()
+					title = ""
+					for _, a := range el.Attr {
+						if a.Name.Local == "title" {
+							title = a.Value
+						}
+					}
+				}
+			}
+		case xml.CharData:
+			if depth > 0 {
+				text.Write(el)
+			}
+		case xml.EndElement:
+			if linedepth > 0 {
+				linedepth--
+			}
+			if depth == 0 {
+				continue
+			}
+			depth--
+			if depth > 0 {
+				continue
+			}
+			w := Word{Text: strings.TrimSpace(text.String())}
+			t := bookpipeline.ParseWordTitle(title)
+			w.Bbox, w.Conf = t.Bbox, t.Conf
+			wordline := line
+			if linedepth == 0 {
+				wordline = 0
+			}
+			err = fn(w, wordline)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// getConfText reads an hOCR file, returning the average confidence
+// of its words and its text, with words separated by spaces. If
+// bylines is set the confidence is instead the average of the mean
+// word confidence of each line, so that each line counts equally no
+// matter how many words it contains. This streams the file, so
+// doesn't need to keep the whole document in memory. As with
+// hocr.GetAvgConf, if there are no words an error of "No words
+// found" is returned.
+func getConfText(path string, bylines bool) (float64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", fmt.Errorf("Error opening hOCR %s: %v", path, err)
+	}
+	defer f.Close()
+
+	var total float64
+	var n int
+	var text strings.Builder
+	linetotals := make(map[int]float64)
+	linewords := make(map[int]int)
+	err = streamHocr(f, func(w Word, line int) error {
+		total += w.Conf
+		n++
+		linetotals[line] += w.Conf
+		linewords[line]++
+		if n > 1 {
+			text.WriteString(" ")
+		}
+		text.WriteString(w.Text)
+		return nil
+	})
+	if err != nil {
+		return 0, "", err
+	}
+	if n == 0 {
+		return 0, "", errors.New("No words found")
+	}
+	if !bylines {
+		return total / float64(n), text.String(), nil
+	}
+	// the lines are summed in order, as floating point addition in the
+	// random order of map iteration can give slightly different results
+	var lines []int
+	for l := range linetotals {
+		lines = append(lines, l)
+	}
+	sort.Ints(lines)
+	var linesum float64
+	for _, l := range lines {
+		linesum += linetotals[l] / float64(linewords[l])
+	}
+	return linesum / float64(len(linetotals)), text.String(), nil
+}
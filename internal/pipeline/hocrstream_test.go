@@ -0,0 +1,215 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"rescribe.xyz/utils/pkg/hocr"
+)
+
+const sampleHocr = "testdata/hocr/sample.hocr"
+
+func streamFile(path string) ([]Word, error) {
+	var words []Word
+	f, err := os.Open(path)
+	if err != nil {
+		return words, err
+	}
+	defer f.Close()
+	err = StreamWords(f, func(w Word) error {
+		words = append(words, w)
+		return nil
+	})
+	return words, err
+}
+
+// Test_StreamWords tests that streaming gives the same words and
+// confidences as the hocr package does
+func Test_StreamWords(t *testing.T) {
+	words, err := streamFile(sampleHocr)
+	if err != nil {
+		t.Fatalf("Error streaming words: %v", err)
+	}
+
+	t.Run("confs", func(t *testing.T) {
+		confs, err := hocr.GetWordConfs(sampleHocr)
+		if err != nil {
+			t.Fatalf("Error getting word confidences: %v", err)
+		}
+		if len(words) != len(confs) {
+			t.Fatalf("Expected %d words, got %d", len(confs), len(words))
+		}
+		for i, w := range words {
+			if w.Conf != confs[i] {
+				t.Fatalf("Word %d: expected confidence %f, got %f", i, confs[i], w.Conf)
+			}
+		}
+	})
+
+	t.Run("text", func(t *testing.T) {
+		text, err := hocr.GetText(sampleHocr)
+		if err != nil {
+			t.Fatalf("Error getting text: %v", err)
+		}
+		expected := strings.Fields(text)
+		if len(words) != len(expected) {
+			t.Fatalf("Expected %d words, got %d", len(expected), len(words))
+		}
+		for i, w := range words {
+			if w.Text != expected[i] {
+				t.Fatalf("Word %d: expected '%s', got '%s'", i, expected[i], w.Text)
+			}
+		}
+	})
+
+	t.Run("bbox", func(t *testing.T) {
+		b, err := ioutil.ReadFile(sampleHocr)
+		if err != nil {
+			t.Fatalf("Error reading %s: %v", sampleHocr, err)
+		}
+		h, err := hocr.Parse(b)
+		if err != nil {
+			t.Fatalf("Error parsing %s: %v", sampleHocr, err)
+		}
+		i := 0
+		for _, l := range h.Lines {
+			for _, w := range l.Words {
+				box, err := hocr.BoxCoords(w.Title)
+				if err != nil {
+					t.Fatalf("Error getting bbox: %v", err)
+				}
+				if words[i].Bbox != box {
+					t.Fatalf("Word %d: expected bbox %v, got %v", i, box, words[i].Bbox)
+				}
+				i++
+			}
+		}
+	})
+
+	t.Run("nested", func(t *testing.T) {
+		s := `<html><body><span class='ocr_line'>` +
+			`<span class='ocrx_word' title='bbox 1 2 3 4; x_wconf 91'><strong>bold</strong></span> ` +
+			`<span class='ocrx_word' title='bbox 5 6 7 8; x_wconf 12'>T<em>w</em>o</span>` +
+			`</span></body></html>`
+		var got []Word
+		err := StreamWords(strings.NewReader(s), func(w Word) error {
+			got = append(got, w)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Error streaming words: %v", err)
+		}
+		expected := []Word{
+			{Text: "bold", Bbox: [4]int{1, 2, 3, 4}, Conf: 91},
+			{Text: "Two", Bbox: [4]int{5, 6, 7, 8}, Conf: 12},
+		}
+		if len(got) != len(expected) {
+			t.Fatalf("Expected %v, got %v", expected, got)
+		}
+		for i := range expected {
+			if got[i] != expected[i] {
+				t.Fatalf("Expected %v, got %v", expected, got)
+			}
+		}
+	})
+}
+
+func Test_getConfText(t *testing.T) {
+	avg, text, err := getConfText(sampleHocr, false)
+	if err != nil {
+		t.Fatalf("Error getting confidence: %v", err)
+	}
+	expected, err := hocr.GetAvgConf(sampleHocr)
+	if err != nil {
+		t.Fatalf("Error getting average confidence: %v", err)
+	}
+	if avg != expected {
+		t.Fatalf("Expected confidence %f, got %f", expected, avg)
+	}
+	expectedtext, err := hocr.GetText(sampleHocr)
+	if err != nil {
+		t.Fatalf("Error getting text: %v", err)
+	}
+	if text != strings.Join(strings.Fields(expectedtext), " ") {
+		t.Fatalf("Text differs from that expected: %s", text)
+	}
+
+	dir, err := ioutil.TempDir("", "confreadtest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	lines := filepath.Join(dir, "lines.hocr")
+	err = writeHocrLines(lines, []int{10}, []int{90, 90, 90})
+	if err != nil {
+		t.Fatalf("Could not write %s: %v", lines, err)
+	}
+	avg, _, err = getConfText(lines, false)
+	if err != nil || avg != 70 {
+		t.Fatalf("Expected word confidence 70, got %f (error %v)", avg, err)
+	}
+	avg, _, err = getConfText(lines, true)
+	if err != nil || avg != 50 {
+		t.Fatalf("Expected line confidence 50, got %f (error %v)", avg, err)
+	}
+	// the line confidence should be exactly the same every time, with
+	// enough lines that summing them in a different order would round
+	// differently
+	many := filepath.Join(dir, "many.hocr")
+	var manylines [][]int
+	for i := 0; i < 50; i++ {
+		manylines = append(manylines, []int{i * 7 % 97, i * 13 % 89, 50})
+	}
+	err = writeHocrLines(many, manylines...)
+	if err != nil {
+		t.Fatalf("Could not write %s: %v", many, err)
+	}
+	first, _, err := getConfText(many, true)
+	if err != nil {
+		t.Fatalf("Error getting line confidence: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		avg, _, err = getConfText(many, true)
+		if err != nil || avg != first {
+			t.Fatalf("Expected line confidence %v every time, got %v (error %v)", first, avg, err)
+		}
+	}
+
+	empty := filepath.Join(dir, "empty.hocr")
+	err = ioutil.WriteFile(empty, []byte("<html><body><div class='ocr_page'></div></body></html>"), 0644)
+	if err != nil {
+		t.Fatalf("Could not write %s: %v", empty, err)
+	}
+	_, _, err = getConfText(empty, false)
+	if err == nil || err.Error() != "No words found" {
+		t.Fatalf("Expected 'No words found' error, got %v", err)
+	}
+}
+
+func BenchmarkStreamWords(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _, err := getConfText(sampleHocr, false)
+		if err != nil {
+			b.Fatalf("Error getting confidence: %v", err)
+		}
+	}
+}
+
+func BenchmarkGetAvgConf(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, err := hocr.GetAvgConf(sampleHocr)
+		if err != nil {
+			b.Fatalf("Error getting confidence: %v", err)
+		}
+	}
+}
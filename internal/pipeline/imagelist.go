@@ -0,0 +1,91 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// The functions in this file do the same as CheckImages,
+// UploadImages, OriginalNames, ContentHash and FindDPIs, but for an
+// explicit list of page images rather than a directory. The pages
+// are kept in the order they are listed, rather than being sorted by
+// name, so the list can come from anywhere, like a program
+// generating the page images on the fly.
+
+// ReadImageList reads a newline separated list of paths to page
+// images, as given to booktopipeline on standard input. Blank lines
+// are ignored. An error is returned if any path isn't a .jpg or .png
+// image, or if there are no paths.
+func ReadImageList(r io.Reader) ([]string, error) {
+	var paths []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		path := strings.TrimSpace(s.Text())
+		if path == "" {
+			continue
+		}
+		lsuffix := strings.ToLower(filepath.Ext(path))
+		if lsuffix != ".jpg" && lsuffix != ".jpeg" && lsuffix != ".png" {
+			return nil, fmt.Errorf("Not a .jpg or .png image: %s", path)
+		}
+		paths = append(paths, path)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading image list: %v", err)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("No images found")
+	}
+	return paths, nil
+}
+
+// CheckImageList checks that all of the images listed can be decoded,
+// using up to workers at once, or DefaultCheckWorkers if workers is
+// less than 1.
+func CheckImageList(ctx context.Context, paths []string, workers int) error {
+	return checkImages(ctx, paths, workers)
+}
+
+// UploadImageList uploads each image listed into conn.WIPStorageId(),
+// in the order given, prefixed with the given bookname and a slash.
+// The images are named in the same way as by UploadImages, with
+// sequential numbers following the order of the list.
+func UploadImageList(ctx context.Context, paths []string, bookname string, conn Uploader) error {
+	return uploadPages(ctx, listPageNames(paths), bookname, conn)
+}
+
+// ImageListOriginalNames returns a map of the name each image listed
+// is given by UploadImageList to its original filename.
+func ImageListOriginalNames(paths []string) map[string]string {
+	return originalNames(listPageNames(paths))
+}
+
+// ImageListContentHash returns a hash of the contents of the images
+// listed, in order, as ContentHash does for a directory.
+func ImageListContentHash(paths []string) (string, error) {
+	h := sha256.New()
+	for _, path := range paths {
+		fh, err := FileHash(path)
+		if err != nil {
+			return "", err
+		}
+		_, _ = io.WriteString(h, fh+"\n")
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// FindImageListDPIs returns the DPI recorded in each image listed,
+// as FindDPIs does for a directory.
+func FindImageListDPIs(paths []string) (map[string]float64, error) {
+	return findPageDPIs(listPageNames(paths))
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+// uploadOrderConn is a LocalConn which records the key and path of
+// each file uploaded, in order
+type uploadOrderConn struct {
+	*bookpipeline.LocalConn
+	keys, paths []string
+}
+
+func (u *uploadOrderConn) Upload(bucket string, key string, path string) error {
+	u.keys = append(u.keys, key)
+	u.paths = append(u.paths, path)
+	return u.LocalConn.Upload(bucket, key, path)
+}
+
+func Test_UploadImageList(t *testing.T) {
+	conn := &uploadOrderConn{LocalConn: newTestConn(t, log.New(ioutil.Discard, "", 0))}
+
+	// the pages are listed out of name order, which must be kept
+	stdin := strings.NewReader("testdata/good/2.png\n\ntestdata/good/1.png\n")
+	images, err := ReadImageList(stdin)
+	if err != nil {
+		t.Fatalf("Error in ReadImageList: %v", err)
+	}
+
+	err = CheckImageList(context.Background(), images, 0)
+	if err != nil {
+		t.Fatalf("Error in CheckImageList: %v", err)
+	}
+
+	err = UploadImageList(context.Background(), images, "listbook", conn)
+	if err != nil {
+		t.Fatalf("Error in UploadImageList: %v", err)
+	}
+
+	expectedkeys := []string{"listbook/2_0000.png", "listbook/1_0001.png"}
+	expectedpaths := []string{"testdata/good/2.png", "testdata/good/1.png"}
+	if strings.Join(conn.keys, " ") != strings.Join(expectedkeys, " ") {
+		t.Fatalf("Expected uploads %v, got %v", expectedkeys, conn.keys)
+	}
+	if strings.Join(conn.paths, " ") != strings.Join(expectedpaths, " ") {
+		t.Fatalf("Expected files %v to be uploaded, got %v", expectedpaths, conn.paths)
+	}
+
+	names := ImageListOriginalNames(images)
+	if len(names) != 2 || names["2_0000.png"] != "2.png" || names["1_0001.png"] != "1.png" {
+		t.Fatalf("Unexpected original names: %v", names)
+	}
+}
+
+func Test_ReadImageList(t *testing.T) {
+	cases := []struct {
+		name string
+		list string
+		err  string
+	}{
+		{"good", "a.jpg\nb.JPEG\n c.png \n", ""},
+		{"notimage", "a.jpg\nnotes.txt\n", "Not a .jpg or .png image: notes.txt"},
+		{"empty", "\n\n", "No images found"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			paths, err := ReadImageList(strings.NewReader(c.list))
+			if c.err == "" && err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if c.err != "" && (err == nil || err.Error() != c.err) {
+				t.Fatalf("Expected error '%s', got %v", c.err, err)
+			}
+			if c.err == "" && strings.Join(paths, " ") != "a.jpg b.JPEG c.png" {
+				t.Fatalf("Unexpected paths: %v", paths)
+			}
+		})
+	}
+}
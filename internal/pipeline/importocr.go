@@ -0,0 +1,362 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+// ImportPage is a page image and the existing OCR of it, as found
+// by FindImportPages. Ocr is either hOCR or ALTO. Name is the name
+// the image is given in the pipeline, which has any spaces replaced
+// and a lowercase .jpg or .png extension, as Analyse expects.
+type ImportPage struct {
+	Image string
+	Ocr   string
+	Name  string
+}
+
+// importOcrExts are the extensions of the OCR files which are looked
+// for alongside each page image, in order of preference. Files
+// ending in .xml are expected to be ALTO.
+var importOcrExts = []string{".hocr", ".html", ".xml"}
+
+// isAlto returns whether an OCR file found by FindImportPages is ALTO
+func isAlto(fn string) bool {
+	return strings.ToLower(filepath.Ext(fn)) == ".xml"
+}
+
+// FindImportPages finds each page image in dir, ending in .jpg,
+// .jpeg or .png in any case, which has an OCR file with the same
+// name apart from its extension, which is .hocr or .html for hOCR, or
+// .xml for ALTO. The pages are returned in filename order. It is an
+// error if an image has no OCR file, if two images would be given
+// the same name in the pipeline, or if no pages are found.
+func FindImportPages(dir string) ([]ImportPage, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading directory %s: %v", dir, err)
+	}
+	names := make(map[string]bool)
+	for _, f := range files {
+		names[f.Name()] = true
+	}
+
+	var pages []ImportPage
+	used := make(map[string]string)
+	for _, f := range files {
+		ext, ok := imageExt(filepath.Ext(f.Name()))
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") || !ok {
+			continue
+		}
+		base := strings.TrimSuffix(f.Name(), filepath.Ext(f.Name()))
+		pg := ImportPage{Image: filepath.Join(dir, f.Name()), Name: strings.ReplaceAll(base, " ", "_") + ext}
+		if prev, ok := used[pg.Name]; ok {
+			return nil, fmt.Errorf("Both %s and %s would be named %s", prev, f.Name(), pg.Name)
+		}
+		used[pg.Name] = f.Name()
+		for _, e := range importOcrExts {
+			if names[base+e] {
+				pg.Ocr = filepath.Join(dir, base+e)
+				break
+			}
+		}
+		if pg.Ocr == "" {
+			return nil, fmt.Errorf("No hOCR or ALTO file found for %s", f.Name())
+		}
+		pages = append(pages, pg)
+	}
+	if len(pages) == 0 {
+		return nil, fmt.Errorf("No page images found in %s", dir)
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i].Image < pages[j].Image })
+	return pages, nil
+}
+
+type altoDoc struct {
+	Unit  string     `xml:"Description>MeasurementUnit"`
+	Pages []altoPage `xml:"Layout>Page"`
+}
+
+type altoPage struct {
+	Width  float64
+	Height float64
+	Blocks []altoBlock
+}
+
+// UnmarshalXML reads an ALTO page, collecting every TextBlock in it
+// in document order, as text blocks can be in the margins as well as
+// the print space, and nested inside ComposedBlocks.
+func (p *altoPage) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for _, a := range start.Attr {
+		var err error
+		switch a.Name.Local {
+		case "WIDTH":
+			p.Width, err = strconv.ParseFloat(a.Value, 64)
+		case "HEIGHT":
+			p.Height, err = strconv.ParseFloat(a.Value, 64)
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid page %s %s", a.Name.Local, a.Value)
+		}
+	}
+	for depth := 1; depth > 0; {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Local != "TextBlock" {
+				depth++
+				continue
+			}
+			var b altoBlock
+			err = d.DecodeElement(&b, &t)
+			if err != nil {
+				return err
+			}
+			p.Blocks = append(p.Blocks, b)
+		case xml.EndElement:
+			depth--
+		}
+	}
+	return nil
+}
+
+type altoBlock struct {
+	Lines []altoLine `xml:"TextLine"`
+}
+
+type altoLine struct {
+	Strings []altoString `xml:"String"`
+}
+
+type altoString struct {
+	Content string   `xml:"CONTENT,attr"`
+	Wc      *float64 `xml:"WC,attr"`
+	Hpos    float64  `xml:"HPOS,attr"`
+	Vpos    float64  `xml:"VPOS,attr"`
+	Width   float64  `xml:"WIDTH,attr"`
+	Height  float64  `xml:"HEIGHT,attr"`
+}
+
+// bbox returns the hOCR bounding box of a string
+func (s altoString) bbox() [4]int {
+	return [4]int{
+		int(math.Round(s.Hpos)),
+		int(math.Round(s.Vpos)),
+		int(math.Round(s.Hpos + s.Width)),
+		int(math.Round(s.Vpos + s.Height)),
+	}
+}
+
+// unionBox returns the smallest box containing both a and b, treating
+// an empty box as containing nothing
+func unionBox(a [4]int, b [4]int) [4]int {
+	if a == [4]int{} {
+		return b
+	}
+	if b[0] < a[0] {
+		a[0] = b[0]
+	}
+	if b[1] < a[1] {
+		a[1] = b[1]
+	}
+	if b[2] > a[2] {
+		a[2] = b[2]
+	}
+	if b[3] > a[3] {
+		a[3] = b[3]
+	}
+	return a
+}
+
+// AltoToHocr converts the first page of an ALTO document read from r
+// into hOCR, written to w, for the image named img. The confidence of
+// each word is taken from its WC attribute, scaled to a percentage,
+// and words without one are given a confidence of 0. Only ALTO with
+// coordinates in pixels is supported. If the page has no size the
+// extent of its text is used instead.
+func AltoToHocr(r io.Reader, w io.Writer, img string) error {
+	var doc altoDoc
+	err := xml.NewDecoder(r).Decode(&doc)
+	if err != nil {
+		return fmt.Errorf("Error parsing ALTO: %v", err)
+	}
+	if doc.Unit != "" && doc.Unit != "pixel" {
+		return fmt.Errorf("Unsupported ALTO measurement unit %s, only pixel is supported", doc.Unit)
+	}
+	if len(doc.Pages) == 0 {
+		return fmt.Errorf("No page found in ALTO")
+	}
+	pg := doc.Pages[0]
+
+	var body strings.Builder
+	var pagebox [4]int
+	var nline, nword int
+	for i, b := range pg.Blocks {
+		var blockbox [4]int
+		var lines strings.Builder
+		for _, l := range b.Lines {
+			var linebox [4]int
+			var words strings.Builder
+			for _, s := range l.Strings {
+				nword++
+				var conf float64
+				if s.Wc != nil {
+					conf = *s.Wc * 100
+				}
+				box := s.bbox()
+				linebox = unionBox(linebox, box)
+				fmt.Fprintf(&words, "<span class='ocrx_word' id='word_1_%d' title='bbox %d %d %d %d; x_wconf %.0f'>", nword, box[0], box[1], box[2], box[3], conf)
+				err = xml.EscapeText(&words, []byte(s.Content))
+				if err != nil {
+					return fmt.Errorf("Error writing hOCR: %v", err)
+				}
+				words.WriteString("</span>\n")
+			}
+			if len(l.Strings) == 0 {
+				continue
+			}
+			nline++
+			blockbox = unionBox(blockbox, linebox)
+			fmt.Fprintf(&lines, "<span class='ocr_line' id='line_1_%d' title='bbox %d %d %d %d'>\n%s</span>\n", nline, linebox[0], linebox[1], linebox[2], linebox[3], words.String())
+		}
+		if lines.Len() == 0 {
+			continue
+		}
+		pagebox = unionBox(pagebox, blockbox)
+		fmt.Fprintf(&body, "<div class='ocr_carea' id='block_1_%d' title='bbox %d %d %d %d'>\n<p class='ocr_par' id='par_1_%d' title='bbox %d %d %d %d'>\n%s</p>\n</div>\n",
+			i+1, blockbox[0], blockbox[1], blockbox[2], blockbox[3],
+			i+1, blockbox[0], blockbox[1], blockbox[2], blockbox[3], lines.String())
+	}
+
+	width, height := int(math.Round(pg.Width)), int(math.Round(pg.Height))
+	if width == 0 || height == 0 {
+		width, height = pagebox[2], pagebox[3]
+	}
+	var title strings.Builder
+	err = xml.EscapeText(&title, []byte(img))
+	if err != nil {
+		return fmt.Errorf("Error writing hOCR: %v", err)
+	}
+	_, err = fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<html xmlns=\"http://www.w3.org/1999/xhtml\">\n<head>\n<meta http-equiv=\"Content-Type\" content=\"text/html;charset=utf-8\"/>\n<meta name='ocr-system' content='bookpipeline importocr'/>\n</head>\n<body>\n<div class='ocr_page' id='page_1' title='image \"%s\"; bbox 0 0 %d %d'>\n%s</div>\n</body>\n</html>\n",
+		title.String(), width, height, body.String())
+	if err != nil {
+		return fmt.Errorf("Error writing hOCR: %v", err)
+	}
+	return nil
+}
+
+// importHocr saves the OCR of a page as hOCR in dir, converting it
+// from ALTO if needed, along with the sidecar recording which page
+// it is of, returning the path of the hOCR
+func importHocr(pg ImportPage, dir string) (string, error) {
+	img := pg.Name
+	page := strings.TrimSuffix(img, filepath.Ext(img))
+	hocrfn := filepath.Join(dir, page+".hocr")
+
+	in, err := os.Open(pg.Ocr)
+	if err != nil {
+		return "", fmt.Errorf("Error opening %s: %v", pg.Ocr, err)
+	}
+	defer in.Close()
+	out, err := os.Create(hocrfn)
+	if err != nil {
+		return "", fmt.Errorf("Error creating %s: %v", hocrfn, err)
+	}
+	defer out.Close()
+	if isAlto(pg.Ocr) {
+		err = AltoToHocr(in, out, img)
+		if err != nil {
+			return "", fmt.Errorf("Error converting %s: %v", pg.Ocr, err)
+		}
+	} else {
+		_, err = io.Copy(out, in)
+		if err != nil {
+			return "", fmt.Errorf("Error copying %s: %v", pg.Ocr, err)
+		}
+	}
+	err = out.Close()
+	if err != nil {
+		return "", fmt.Errorf("Error writing %s: %v", hocrfn, err)
+	}
+
+	_, err = writeOcrParams(hocrfn, OcrParams{Page: page, Image: img})
+	if err != nil {
+		return "", err
+	}
+	return hocrfn, nil
+}
+
+// ImportOcr uploads the page images and existing OCR of a book in
+// dir, as found by FindImportPages, into conn as bookname, and runs
+// only the Analyse stage on them, so that the usual best, conf,
+// graph and PDF files are made without running the earlier stages
+// of the pipeline. Any ALTO is converted to hOCR first. The results
+// are left in conn.WIPStorageId() to be downloaded.
+func ImportOcr(ctx context.Context, dir string, bookname string, conn Pipeliner, opts AnalyseOptions) error {
+	pages, err := FindImportPages(dir)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := MkTempDir("bookpipelineimport")
+	if err != nil {
+		return fmt.Errorf("Error setting up temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	for _, pg := range pages {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		hocrfn, err := importHocr(pg, tmp)
+		if err != nil {
+			return err
+		}
+		conn.Log(bookpipeline.DebugTag+"Uploading page", pg.Name)
+		err = conn.Upload(conn.WIPStorageId(), bookname+"/"+pg.Name, pg.Image)
+		if err != nil {
+			return fmt.Errorf("Error uploading %s: %v", pg.Image, err)
+		}
+		for _, fn := range []string{hocrfn, OcrParamsName(hocrfn)} {
+			err = conn.Upload(conn.WIPStorageId(), bookname+"/"+filepath.Base(fn), fn)
+			if err != nil {
+				return fmt.Errorf("Error uploading %s: %v", fn, err)
+			}
+		}
+	}
+
+	err = conn.AddToQueue(conn.AnalyseQueueId(), bookname)
+	if err != nil {
+		return fmt.Errorf("Error adding book to analyse queue: %v", err)
+	}
+	msg, err := conn.CheckQueue(conn.AnalyseQueueId(), HeartbeatSeconds*2)
+	if err != nil {
+		return fmt.Errorf("Error checking analyse queue: %v", err)
+	}
+	if msg.Handle == "" {
+		return fmt.Errorf("Error: book %s not found on analyse queue", bookname)
+	}
+	opts.Bookname = bookname
+	return ProcessBook(ctx, msg, conn, Analyse(conn, opts), regexp.MustCompile(`.hocr$`), conn.AnalyseQueueId(), "")
+}
@@ -0,0 +1,229 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"rescribe.xyz/pdf"
+)
+
+// testAlto is a page of ALTO with two lines, one of whose words has
+// no confidence
+const testAlto = `<?xml version="1.0" encoding="UTF-8"?>
+<alto xmlns="http://www.loc.gov/standards/alto/ns-v4#">
+<Description><MeasurementUnit>pixel</MeasurementUnit></Description>
+<Layout><Page ID="p1" WIDTH="1000" HEIGHT="1000"><PrintSpace>
+<TextBlock ID="b1">
+<TextLine ID="l1"><String CONTENT="imported" WC="0.9" HPOS="100" VPOS="100" WIDTH="200" HEIGHT="50"/><SP/><String CONTENT="&amp;text" WC="0.7" HPOS="320" VPOS="100" WIDTH="100.4" HEIGHT="50"/></TextLine>
+<TextLine ID="l2"><String CONTENT="unsure" HPOS="100" VPOS="200" WIDTH="150" HEIGHT="50"/></TextLine>
+</TextBlock>
+</PrintSpace></Page></Layout>
+</alto>
+`
+
+func Test_AltoToHocr(t *testing.T) {
+	var buf bytes.Buffer
+	err := AltoToHocr(strings.NewReader(testAlto), &buf, "0001.png")
+	if err != nil {
+		t.Fatalf("Error converting ALTO: %v", err)
+	}
+
+	var words []Word
+	err = StreamWords(&buf, func(w Word) error {
+		words = append(words, w)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error reading converted hOCR: %v\n%s", err, buf.String())
+	}
+	expected := []Word{
+		{Text: "imported", Bbox: [4]int{100, 100, 300, 150}, Conf: 90},
+		{Text: "&text", Bbox: [4]int{320, 100, 420, 150}, Conf: 70},
+		{Text: "unsure", Bbox: [4]int{100, 200, 250, 250}, Conf: 0},
+	}
+	if len(words) != len(expected) {
+		t.Fatalf("Expected %d words, got %d: %v", len(expected), len(words), words)
+	}
+	for i, w := range words {
+		if w.Text != expected[i].Text || w.Bbox != expected[i].Bbox || w.Conf != expected[i].Conf {
+			t.Fatalf("Expected word %d to be %v, got %v", i, expected[i], w)
+		}
+	}
+
+	// text blocks in the margins and inside composed blocks are kept
+	nested := strings.Replace(testAlto, "<PrintSpace>", `<TopMargin><TextBlock ID="m1"><TextLine ID="l0"><String CONTENT="header" WC="0.8" HPOS="100" VPOS="10" WIDTH="120" HEIGHT="40"/></TextLine></TextBlock></TopMargin><PrintSpace><ComposedBlock ID="c1">`, 1)
+	nested = strings.Replace(nested, "</PrintSpace>", "</ComposedBlock></PrintSpace>", 1)
+	buf.Reset()
+	err = AltoToHocr(strings.NewReader(nested), &buf, "0001.png")
+	if err != nil {
+		t.Fatalf("Error converting ALTO with nested blocks: %v", err)
+	}
+	words = nil
+	err = StreamWords(&buf, func(w Word) error {
+		words = append(words, w)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error reading converted hOCR: %v\n%s", err, buf.String())
+	}
+	if len(words) != 4 || words[0].Text != "header" || words[1].Text != "imported" {
+		t.Fatalf("Expected the margin and composed block words to be kept, got %v", words)
+	}
+
+	err = AltoToHocr(strings.NewReader(strings.Replace(testAlto, "pixel", "mm10", 1)), &buf, "0001.png")
+	if err == nil {
+		t.Fatalf("Expected an error converting ALTO measured in mm10, got none")
+	}
+}
+
+// Test_ImportOcr tests that importing a book of images with hOCR and
+// ALTO produces a searchable PDF and a confidence graph
+func Test_ImportOcr(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	dir, err := ioutil.TempDir("", "importocrtest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	bookdir := filepath.Join(dir, "book")
+	err = os.Mkdir(bookdir, 0755)
+	if err != nil {
+		t.Fatalf("Could not create directory: %v", err)
+	}
+
+	for i, pg := range []string{"0001", "0002", "0003"} {
+		f, err := os.Create(filepath.Join(bookdir, pg+".png"))
+		if err != nil {
+			t.Fatalf("Could not create image: %v", err)
+		}
+		err = png.Encode(f, image.NewGray(image.Rect(0, 0, 1000, 1000)))
+		f.Close()
+		if err != nil {
+			t.Fatalf("Could not encode image: %v", err)
+		}
+		if pg == "0002" {
+			err = ioutil.WriteFile(filepath.Join(bookdir, pg+".xml"), []byte(testAlto), 0644)
+		} else {
+			err = writeHocr(filepath.Join(bookdir, pg+".hocr"), 60+i*10, "imported", "text")
+		}
+		if err != nil {
+			t.Fatalf("Could not write OCR for %s: %v", pg, err)
+		}
+	}
+
+	conn := newTestConn(t, vlog)
+
+	err = ImportOcr(context.Background(), bookdir, "book", conn, AnalyseOptions{})
+	if err != nil {
+		t.Fatalf("Error importing OCR: %v\nLog: %s", err, slog.log)
+	}
+
+	savedir := filepath.Join(dir, "save")
+	err = os.Mkdir(savedir, 0755)
+	if err != nil {
+		t.Fatalf("Could not create directory: %v", err)
+	}
+	err = DownloadAnalyses(context.Background(), savedir, "book", conn)
+	if err != nil {
+		t.Fatalf("Error downloading analyses: %v", err)
+	}
+	err = DownloadPdfs(context.Background(), savedir, "book", conn, PdfColour)
+	if err != nil {
+		t.Fatalf("Error downloading PDFs: %v", err)
+	}
+
+	fi, err := os.Stat(filepath.Join(savedir, "graph.png"))
+	if err != nil || fi.Size() == 0 {
+		t.Fatalf("Expected a confidence graph to be made: %v\nLog: %s", err, slog.log)
+	}
+
+	pdfpath := filepath.Join(savedir, "book.colour.pdf")
+	issues, err := CheckPdf(pdfpath)
+	if err != nil {
+		t.Fatalf("Error checking PDF: %v", err)
+	}
+	if len(issues) > 0 {
+		t.Fatalf("Problems found in PDF: %v", issues)
+	}
+	f, err := os.Open(pdfpath)
+	if err != nil {
+		t.Fatalf("Could not open PDF: %v", err)
+	}
+	defer f.Close()
+	fi, err = f.Stat()
+	if err != nil {
+		t.Fatalf("Could not get size of PDF: %v", err)
+	}
+	r, err := pdf.NewReader(f, fi.Size())
+	if err != nil {
+		t.Fatalf("Could not read PDF: %v", err)
+	}
+	if r.NumPage() != 3 {
+		t.Fatalf("Expected 3 pages in PDF, got %d", r.NumPage())
+	}
+	for n := 1; n <= r.NumPage(); n++ {
+		if len(r.Page(n).Fonts()) == 0 {
+			t.Fatalf("Expected page %d of PDF to have a text layer", n)
+		}
+	}
+}
+
+func Test_FindImportPages(t *testing.T) {
+	cases := []struct {
+		name     string
+		files    []string
+		expected []string
+		err      bool
+	}{
+		{"lowercase", []string{"0001.jpg", "0001.hocr", "0002.png", "0002.xml"}, []string{"0001.jpg", "0002.png"}, false},
+		{"uppercase", []string{"0001.JPG", "0001.hocr", "0002.PNG", "0002.html"}, []string{"0001.jpg", "0002.png"}, false},
+		{"jpeg", []string{"page one.jpeg", "page one.hocr"}, []string{"page_one.jpg"}, false},
+		{"clash", []string{"0001.jpg", "0001.JPEG", "0001.hocr"}, nil, true},
+		{"noocr", []string{"0001.jpg", "0002.jpg", "0002.hocr"}, nil, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "findimportpagestest")
+			if err != nil {
+				t.Fatalf("Could not create temporary directory: %v", err)
+			}
+			defer os.RemoveAll(dir)
+			for _, fn := range c.files {
+				err = ioutil.WriteFile(filepath.Join(dir, fn), []byte{}, 0644)
+				if err != nil {
+					t.Fatalf("Could not write %s: %v", fn, err)
+				}
+			}
+
+			pages, err := FindImportPages(dir)
+			if err == nil && c.err {
+				t.Fatalf("Expected an error, got none")
+			}
+			if err != nil && !c.err {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			var names []string
+			for _, pg := range pages {
+				names = append(names, pg.Name)
+			}
+			if strings.Join(names, " ") != strings.Join(c.expected, " ") {
+				t.Fatalf("Expected names %v, got %v", c.expected, names)
+			}
+		})
+	}
+}
@@ -0,0 +1,20 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Jitter returns d with a random extra duration of up to max added,
+// so that many processes pausing for the same time don't all stop
+// pausing at once.
+func Jitter(d time.Duration, max time.Duration) time.Duration {
+	if max <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Int63n(int64(max)+1))
+}
@@ -0,0 +1,38 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_Jitter(t *testing.T) {
+	cases := []struct {
+		name string
+		d    time.Duration
+		max  time.Duration
+	}{
+		{"none", 3 * time.Minute, 0},
+		{"minute", 3 * time.Minute, time.Minute},
+		{"small", time.Second, time.Millisecond},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			seen := make(map[time.Duration]bool)
+			for i := 0; i < 1000; i++ {
+				j := Jitter(c.d, c.max)
+				if j < c.d || j > c.d+c.max {
+					t.Fatalf("Jittered pause %v is outside of %v to %v", j, c.d, c.d+c.max)
+				}
+				seen[j] = true
+			}
+			if c.max > 0 && len(seen) < 2 {
+				t.Fatalf("Expected jittered pauses to vary, got %v every time", c.d)
+			}
+		})
+	}
+}
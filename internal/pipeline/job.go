@@ -0,0 +1,107 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"log"
+	"path"
+	"sort"
+	"strings"
+)
+
+// JobMsg is a parsed book message from one of the queues. Book
+// messages are in the form "bookname [training] [key=value ...]",
+// with any options given as space separated key=value pairs after
+// the book name and training. Messages on the OCR page queue are in
+// the same form, but with the path of a page image, like
+// bookname/0001_bin0.2.png, in place of the book name. These are
+// parsed with ParsePageMessage, which saves the path as Page, with
+// Bookname set to the book it belongs to.
+type JobMsg struct {
+	Bookname string
+	Page     string
+	Training string
+	Opts     map[string]string
+}
+
+// ParseJobMessage parses the body of a book message into a JobMsg.
+func ParseJobMessage(body string) JobMsg {
+	var j JobMsg
+	j.Opts = make(map[string]string)
+	for i, f := range strings.Fields(body) {
+		if i == 0 {
+			j.Bookname = f
+			continue
+		}
+		if kv := strings.SplitN(f, "=", 2); len(kv) == 2 {
+			j.Opts[kv[0]] = kv[1]
+			continue
+		}
+		if j.Training == "" {
+			j.Training = f
+		}
+	}
+	return j
+}
+
+// ParsePageMessage parses the body of a message from the OCR page
+// queue into a JobMsg.
+func ParsePageMessage(body string) JobMsg {
+	j := ParseJobMessage(body)
+	j.Page = j.Bookname
+	j.Bookname = path.Dir(j.Page)
+	return j
+}
+
+// String returns the message body for a JobMsg, in the format
+// understood by ParseJobMessage.
+func (j JobMsg) String() string {
+	parts := []string{j.Bookname}
+	if j.Page != "" {
+		parts = []string{j.Page}
+	}
+	if j.Training != "" {
+		parts = append(parts, j.Training)
+	}
+	var keys []string
+	for k := range j.Opts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		parts = append(parts, k+"="+j.Opts[k])
+	}
+	return strings.Join(parts, " ")
+}
+
+// defaultWolfK is the k value used for Wolf binarisation if no other
+// is set with the "single" option
+const defaultWolfK = 0.5
+
+// PreprocessFor returns the preprocessing function appropriate for
+// a job. Normally this is Preprocess with the thresholds given, which
+// binarises with Sauvola's method, but the "binmethod" option can be
+// set to use "otsu" or "wolf" instead, in which case each page is only
+// binarised once, or "none" to skip binarisation and just convert each
+// page to greyscale, with PreprocessGrey. If the "single" option is
+// set only one binarisation is done, with either the k value given or
+// with Otsu's method if the value is "otsu". The parameters used are
+// those given by JobParams.
+func PreprocessFor(job JobMsg, thresholds []float64, nowipe bool) (func(context.Context, chan string, chan string, chan error, *log.Logger), error) {
+	p, err := JobParams(job, thresholds, nowipe)
+	if err != nil {
+		return nil, err
+	}
+	switch p.BinMethod {
+	case "otsu":
+		return PreprocessOtsu(nowipe), nil
+	case "wolf":
+		return PreprocessWolf(p.Thresholds[0], nowipe), nil
+	case "none":
+		return PreprocessGrey(), nil
+	}
+	return Preprocess(p.Thresholds, nowipe), nil
+}
@@ -0,0 +1,196 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_ParseJobMessage(t *testing.T) {
+	cases := []struct {
+		body     string
+		bookname string
+		page     string
+		training string
+		opts     map[string]string
+	}{
+		{"book", "book", "", "", map[string]string{}},
+		{"book rescribev9", "book", "", "rescribev9", map[string]string{}},
+		{"book single=0.3", "book", "", "", map[string]string{"single": "0.3"}},
+		{"book rescribev9 single=otsu", "book", "", "rescribev9", map[string]string{"single": "otsu"}},
+		{"book rescribev9 binmethod=otsu", "book", "", "rescribev9", map[string]string{"binmethod": "otsu"}},
+		{"collection/book rescribev9", "collection/book", "", "rescribev9", map[string]string{}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.body, func(t *testing.T) {
+			j := ParseJobMessage(c.body)
+			if j.Bookname != c.bookname {
+				t.Fatalf("Bookname differs, expected '%s', got '%s'", c.bookname, j.Bookname)
+			}
+			if j.Page != c.page {
+				t.Fatalf("Page differs, expected '%s', got '%s'", c.page, j.Page)
+			}
+			if j.Training != c.training {
+				t.Fatalf("Training differs, expected '%s', got '%s'", c.training, j.Training)
+			}
+			if !reflect.DeepEqual(j.Opts, c.opts) {
+				t.Fatalf("Options differ, expected %v, got %v", c.opts, j.Opts)
+			}
+			if j.String() != c.body {
+				t.Fatalf("String() differs from original message, expected '%s', got '%s'", c.body, j.String())
+			}
+		})
+	}
+}
+
+func Test_ParsePageMessage(t *testing.T) {
+	cases := []struct {
+		body     string
+		bookname string
+		page     string
+		training string
+		opts     map[string]string
+	}{
+		{"book/0001_bin0.2.png", "book", "book/0001_bin0.2.png", "", map[string]string{}},
+		{"book/0001_bin0.2.png rescribev9", "book", "book/0001_bin0.2.png", "rescribev9", map[string]string{}},
+		{"book/0001_bin0.2.png rescribev9 single=otsu", "book", "book/0001_bin0.2.png", "rescribev9", map[string]string{"single": "otsu"}},
+		{"collection/book/0001_bin0.2.png", "collection/book", "collection/book/0001_bin0.2.png", "", map[string]string{}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.body, func(t *testing.T) {
+			j := ParsePageMessage(c.body)
+			if j.Bookname != c.bookname {
+				t.Fatalf("Bookname differs, expected '%s', got '%s'", c.bookname, j.Bookname)
+			}
+			if j.Page != c.page {
+				t.Fatalf("Page differs, expected '%s', got '%s'", c.page, j.Page)
+			}
+			if j.Training != c.training {
+				t.Fatalf("Training differs, expected '%s', got '%s'", c.training, j.Training)
+			}
+			if !reflect.DeepEqual(j.Opts, c.opts) {
+				t.Fatalf("Options differ, expected %v, got %v", c.opts, j.Opts)
+			}
+			if j.String() != c.body {
+				t.Fatalf("String() differs from original message, expected '%s', got '%s'", c.body, j.String())
+			}
+		})
+	}
+}
+
+func Test_PreprocessFor(t *testing.T) {
+	cases := []struct {
+		single    string
+		binmethod string
+		err       bool
+	}{
+		{"", "", false},
+		{"0.3", "", false},
+		{"otsu", "", false},
+		{"0", "", true},
+		{"sauvola", "", true},
+		{"", "sauvola", false},
+		{"", "otsu", false},
+		{"", "wolf", false},
+		{"", "none", false},
+		{"0.4", "wolf", false},
+		{"otsu", "wolf", true},
+		{"", "niblack", true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.single+"_"+c.binmethod, func(t *testing.T) {
+			j := JobMsg{Bookname: "book", Opts: map[string]string{}}
+			if c.single != "" {
+				j.Opts["single"] = c.single
+			}
+			if c.binmethod != "" {
+				j.Opts["binmethod"] = c.binmethod
+			}
+			_, err := PreprocessFor(j, []float64{0.1, 0.2}, false)
+			if err == nil && c.err {
+				t.Fatalf("Expected an error, got none")
+			}
+			if err != nil && !c.err {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+		})
+	}
+}
+
+// Test_PreprocessForBinmethod tests that a message requesting a
+// binarisation method is preprocessed with that method
+func Test_PreprocessForBinmethod(t *testing.T) {
+	cases := []struct {
+		body     string
+		expected string
+	}{
+		{"book binmethod=otsu", "0001_bin0.0.png"},
+		{"book rescribev9 binmethod=otsu", "0001_bin0.0.png"},
+		{"book binmethod=wolf", "0001_bin0.5.png"},
+		{"book binmethod=wolf single=0.3", "0001_bin0.3.png"},
+		{"book binmethod=none", "0001_bin0.0.png"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.body, func(t *testing.T) {
+			process, err := PreprocessFor(ParseJobMessage(c.body), []float64{0.1, 0.2}, true)
+			if err != nil {
+				t.Fatalf("Error getting preprocessing function: %v", err)
+			}
+			done, err := runPreprocess(process, "testdata/good/1.png")
+			if err != nil {
+				t.Fatalf("Error preprocessing: %v", err)
+			}
+			if len(done) != 1 || filepath.Base(done[0]) != c.expected {
+				t.Fatalf("Expected only %s to be produced, got %v", c.expected, done)
+			}
+			_ = os.RemoveAll(filepath.Dir(done[0]))
+		})
+	}
+}
+
+// Test_PreprocessForNoWipe tests that books on the nowipe queue are
+// still binarised at every threshold, but not wiped
+func Test_PreprocessForNoWipe(t *testing.T) {
+	var wiped []bool
+	var used [][]float64
+	oldpreproc := preprocMultiFor
+	preprocMultiFor = func(path string, thresholds []float64, wipe bool, s PreprocSettings) ([]string, error) {
+		wiped = append(wiped, wipe)
+		used = append(used, thresholds)
+		return preprocMulti(path, thresholds, wipe, s)
+	}
+	defer func() { preprocMultiFor = oldpreproc }()
+
+	thresholds := []float64{0.1, 0.2}
+	for _, nowipe := range []bool{false, true} {
+		wiped = nil
+		used = nil
+		process, err := PreprocessFor(ParseJobMessage("book"), thresholds, nowipe)
+		if err != nil {
+			t.Fatalf("Error getting preprocessing function: %v", err)
+		}
+		done, err := runPreprocess(process, "testdata/good/1.png")
+		if err != nil {
+			t.Fatalf("Error preprocessing: %v", err)
+		}
+		if len(done) != len(thresholds) {
+			t.Fatalf("Expected %d binarisations, got %v", len(thresholds), done)
+		}
+		_ = os.RemoveAll(filepath.Dir(done[0]))
+		if len(wiped) != 1 || wiped[0] == nowipe {
+			t.Fatalf("Expected wipe to be %v with nowipe %v, got %v", !nowipe, nowipe, wiped)
+		}
+		if !reflect.DeepEqual(used[0], thresholds) {
+			t.Fatalf("Expected thresholds %v, got %v", thresholds, used[0])
+		}
+	}
+}
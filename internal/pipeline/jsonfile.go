@@ -0,0 +1,93 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// uploadBytes saves b to a temporary file, and uploads it to key in
+// conn.WIPStorageId()
+func uploadBytes(conn Uploader, key string, b []byte) error {
+	f, err := ioutil.TempFile(TempDir(), "bookpipelineupload")
+	if err != nil {
+		return fmt.Errorf("Error creating temporary file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	_, err = f.Write(b)
+	if err != nil {
+		return fmt.Errorf("Error writing %s to %s: %v", key, f.Name(), err)
+	}
+	f.Close()
+
+	err = conn.Upload(conn.WIPStorageId(), key, f.Name())
+	if err != nil {
+		return fmt.Errorf("Error uploading %s: %v", key, err)
+	}
+	return nil
+}
+
+// uploadJSON encodes v as indented JSON, and uploads it to key in
+// conn.WIPStorageId()
+func uploadJSON(conn Uploader, key string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return fmt.Errorf("Error encoding %s: %v", key, err)
+	}
+	return uploadBytes(conn, key, b)
+}
+
+// downloadBytes downloads key from conn.WIPStorageId(), returning its
+// contents, and false if it doesn't exist
+func downloadBytes(conn DownloadLister, key string) ([]byte, bool, error) {
+	objs, err := conn.ListObjects(conn.WIPStorageId(), key)
+	if err != nil {
+		return nil, false, fmt.Errorf("Error listing %s: %v", key, err)
+	}
+	found := false
+	for _, o := range objs {
+		if o == key {
+			found = true
+		}
+	}
+	if !found {
+		return nil, false, nil
+	}
+
+	d, err := ioutil.TempDir(TempDir(), "bookpipelinedownload")
+	if err != nil {
+		return nil, false, fmt.Errorf("Error creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(d)
+	fn := filepath.Join(d, filepath.Base(key))
+	err = conn.Download(conn.WIPStorageId(), key, fn)
+	if err != nil {
+		return nil, false, fmt.Errorf("Error downloading %s: %v", key, err)
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, false, fmt.Errorf("Error reading %s: %v", fn, err)
+	}
+	return b, true, nil
+}
+
+// downloadJSON downloads key from conn.WIPStorageId() and decodes it
+// into v, returning false, and leaving v alone, if it doesn't exist
+func downloadJSON(conn DownloadLister, key string, v interface{}) (bool, error) {
+	b, found, err := downloadBytes(conn, key)
+	if err != nil || !found {
+		return found, err
+	}
+	err = json.Unmarshal(b, v)
+	if err != nil {
+		return true, fmt.Errorf("Error parsing %s: %v", key, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,56 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func Test_uploadJSON(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	dir, err := ioutil.TempDir("", "jsonfiletest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conn := newTestConn(t, vlog)
+
+	v := map[string][]int{"a": {1, 2}, "b": {3}}
+	err = uploadJSON(conn, "book/test.json", v)
+	if err != nil {
+		t.Fatalf("Error uploading JSON: %v", err)
+	}
+
+	var got map[string][]int
+	found, err := downloadJSON(conn, "book/test.json", &got)
+	if err != nil {
+		t.Fatalf("Error downloading JSON: %v", err)
+	}
+	if !found || !reflect.DeepEqual(got, v) {
+		t.Fatalf("Expected to download %v, got %v (found %v)", v, got, found)
+	}
+
+	// a file whose name is a prefix of another isn't found
+	found, err = downloadJSON(conn, "book/test", &got)
+	if err != nil || found {
+		t.Fatalf("Expected a missing file not to be found, got found %v and error %v", found, err)
+	}
+
+	err = uploadBytes(conn, "book/bad.json", []byte("{"))
+	if err != nil {
+		t.Fatalf("Error uploading file: %v", err)
+	}
+	_, err = downloadJSON(conn, "book/bad.json", &got)
+	if err == nil {
+		t.Fatalf("Expected an error parsing invalid JSON, got none")
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MetaFile is the name of the file that any metadata for a book,
+// like the library it came from or its shelfmark, is stored in. It
+// is saved alongside the images of the book.
+const MetaFile = "meta.json"
+
+// ContentHashKey is the metadata key which the content hash of a
+// book's images is saved under.
+const ContentHashKey = "contenthash"
+
+// ContentHashIndexFile is the name of the file which maps the
+// content hash of each book's images to the books which were uploaded
+// with them, so that the books with the same images can be found
+// without reading the metadata of every book. It is saved at the top
+// level of conn.WIPStorageId(), like this:
+//
+//	{"9f86d08...": ["book1", "book1_again"]}
+const ContentHashIndexFile = "contenthashes.json"
+
+// ContentHashIndexer is the connection needed to look up and update
+// the ContentHashIndexFile
+type ContentHashIndexer interface {
+	Download(bucket string, key string, fn string) error
+	ListObjectPrefixes(bucket string) ([]string, error)
+	ListObjects(bucket string, prefix string) ([]string, error)
+	Log(v ...interface{})
+	Upload(bucket string, key string, path string) error
+	WIPStorageId() string
+}
+
+// ParseMeta parses a metadata setting in the form key=value.
+func ParseMeta(s string) (string, string, error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return "", "", fmt.Errorf("Invalid metadata %s, should be in the form key=value", s)
+	}
+	return kv[0], kv[1], nil
+}
+
+// UploadMeta saves metadata for a book as JSON, and uploads it to
+// the book's directory in conn.WIPStorageId().
+func UploadMeta(conn Uploader, bookname string, meta map[string]string) error {
+	return uploadJSON(conn, bookname+"/"+MetaFile, meta)
+}
+
+// GetMeta downloads and parses the metadata for a book. If the book
+// has no metadata an empty map is returned.
+func GetMeta(conn DownloadLister, bookname string) (map[string]string, error) {
+	meta := make(map[string]string)
+	_, err := downloadJSON(conn, bookname+"/"+MetaFile, &meta)
+	return meta, err
+}
+
+// BookMeta is a book along with its metadata.
+type BookMeta struct {
+	Book string
+	Meta map[string]string
+}
+
+// FindBooksWithMeta returns the books which have a metadata key set
+// to the value given, along with all of their metadata.
+func FindBooksWithMeta(conn DownloadLister, books []string, key string, value string) ([]BookMeta, error) {
+	var matched []BookMeta
+	for _, b := range books {
+		meta, err := GetMeta(conn, b)
+		if err != nil {
+			return matched, err
+		}
+		if v, ok := meta[key]; ok && v == value {
+			matched = append(matched, BookMeta{Book: b, Meta: meta})
+		}
+	}
+	return matched, nil
+}
+
+// BooksWithMeta returns the books which have a metadata key set to
+// the value given.
+func BooksWithMeta(conn DownloadLister, books []string, key string, value string) ([]string, error) {
+	found, err := FindBooksWithMeta(conn, books, key, value)
+	var matched []string
+	for _, f := range found {
+		matched = append(matched, f.Book)
+	}
+	return matched, err
+}
+
+// FileHash returns the hex encoded SHA-256 hash of a file.
+func FileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("Error opening %s: %v", path, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", fmt.Errorf("Error hashing %s: %v", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ContentHash returns a hash of the images in a directory which
+// would be uploaded by UploadImages, so that the same scans can be
+// recognised even if they are uploaded under a different name. The
+// hash is of the hashes of each image, sorted by filename, so it is
+// unaffected by the names of the images themselves.
+func ContentHash(dir string) (string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read directory %s: %v", dir, err)
+	}
+
+	h := sha256.New()
+	n := 0
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		lsuffix := strings.ToLower(filepath.Ext(file.Name()))
+		if lsuffix != ".jpg" && lsuffix != ".jpeg" && lsuffix != ".png" {
+			continue
+		}
+		fh, err := FileHash(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return "", err
+		}
+		_, _ = io.WriteString(h, fh+"\n")
+		n++
+	}
+	if n == 0 {
+		return "", fmt.Errorf("No images found in %s", dir)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// getContentHashIndex downloads and parses the ContentHashIndexFile,
+// returning whether it exists
+func getContentHashIndex(conn DownloadLister) (map[string][]string, bool, error) {
+	index := make(map[string][]string)
+	found, err := downloadJSON(conn, ContentHashIndexFile, &index)
+	return index, found && err == nil, err
+}
+
+// scanContentHashes builds an index of content hashes to books, as
+// saved in the ContentHashIndexFile, from the metadata of every book,
+// for books uploaded before the index was kept. Any book whose
+// metadata can't be read is skipped with a warning.
+func scanContentHashes(conn PrefixDownloadLister) (map[string][]string, error) {
+	index := make(map[string][]string)
+	prefixes, err := conn.ListObjectPrefixes(conn.WIPStorageId())
+	if err != nil {
+		return index, fmt.Errorf("Error listing books: %v", err)
+	}
+	for _, p := range prefixes {
+		book := strings.TrimSuffix(p, "/")
+		meta, err := GetMeta(conn, book)
+		if err != nil {
+			conn.Log("Warning: skipping book whose metadata couldn't be read:", err)
+			continue
+		}
+		if hash := meta[ContentHashKey]; hash != "" {
+			index[hash] = append(index[hash], book)
+		}
+	}
+	return index, nil
+}
+
+// BooksWithContentHash returns any books in conn.WIPStorageId()
+// which were uploaded with images with the content hash given. They
+// are looked up in the ContentHashIndexFile, and each is checked to
+// still have the content hash saved in its metadata, so that books
+// which have since been removed aren't returned. Any book which can't
+// be checked is skipped with a warning. If there is no index yet the
+// metadata of every book is checked instead.
+func BooksWithContentHash(conn PrefixDownloadLister, hash string) ([]string, error) {
+	index, found, err := getContentHashIndex(conn)
+	if err != nil {
+		return []string{}, err
+	}
+	if !found {
+		index, err = scanContentHashes(conn)
+		if err != nil {
+			return []string{}, err
+		}
+	}
+	var books []string
+	for _, b := range index[hash] {
+		meta, err := GetMeta(conn, b)
+		if err != nil {
+			conn.Log("Warning: skipping book whose metadata couldn't be read:", err)
+			continue
+		}
+		if meta[ContentHashKey] == hash {
+			books = append(books, b)
+		}
+	}
+	return books, nil
+}
+
+// AddContentHash records in the ContentHashIndexFile that a book was
+// uploaded with images with the content hash given. If there is no
+// index yet it is first built from the metadata of every book. The
+// index is downloaded, updated and uploaded again, so if two books
+// are uploaded at the same moment one of them may be left out, which
+// only means that a later upload of the same images won't be warned
+// about.
+func AddContentHash(conn ContentHashIndexer, bookname string, hash string) error {
+	index, found, err := getContentHashIndex(conn)
+	if err != nil {
+		return err
+	}
+	if !found {
+		index, err = scanContentHashes(conn)
+		if err != nil {
+			return err
+		}
+	}
+	for _, b := range index[hash] {
+		if b == bookname {
+			return nil
+		}
+	}
+	index[hash] = append(index[hash], bookname)
+	return uploadJSON(conn, ContentHashIndexFile, index)
+}
@@ -0,0 +1,255 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_ParseMeta(t *testing.T) {
+	cases := []struct {
+		s     string
+		key   string
+		value string
+		err   bool
+	}{
+		{"source=Bodleian", "source", "Bodleian", false},
+		{"shelfmark=MS. Ashmole 1504", "shelfmark", "MS. Ashmole 1504", false},
+		{"note=a=b", "note", "a=b", false},
+		{"operator=", "operator", "", false},
+		{"source", "", "", true},
+		{"=Bodleian", "", "", true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.s, func(t *testing.T) {
+			k, v, err := ParseMeta(c.s)
+			if c.err && err == nil {
+				t.Fatalf("Expected error, got none")
+			}
+			if !c.err && err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if k != c.key || v != c.value {
+				t.Fatalf("Expected %s=%s, got %s=%s", c.key, c.value, k, v)
+			}
+		})
+	}
+}
+
+func Test_Meta(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	conn := newTestConn(t, vlog)
+	dir := conn.TempDir
+
+	books := map[string]map[string]string{
+		"book1": {"source": "Bodleian", "operator": "nick"},
+		"book2": {"source": "British Library", "shelfmark": "C.12.a.1"},
+	}
+	for b, m := range books {
+		err := UploadMeta(conn, b, m)
+		if err != nil {
+			t.Fatalf("Error uploading metadata for %s: %v", b, err)
+		}
+	}
+	err := conn.Upload(conn.WIPStorageId(), "book3/0001.jpg", "testdata/good/1.png")
+	if err != nil {
+		t.Fatalf("Could not upload test file: %v", err)
+	}
+
+	t.Run("uploaded", func(t *testing.T) {
+		b, err := ioutil.ReadFile(filepath.Join(dir, conn.WIPStorageId(), "book1", MetaFile))
+		if err != nil {
+			t.Fatalf("Could not read uploaded metadata: %v", err)
+		}
+		var meta map[string]string
+		err = json.Unmarshal(b, &meta)
+		if err != nil {
+			t.Fatalf("Could not parse uploaded metadata: %v", err)
+		}
+		if len(meta) != 2 || meta["source"] != "Bodleian" || meta["operator"] != "nick" {
+			t.Fatalf("Uploaded metadata differs from that expected: %v", meta)
+		}
+	})
+
+	t.Run("nometa", func(t *testing.T) {
+		meta, err := GetMeta(conn, "book3")
+		if err != nil {
+			t.Fatalf("Error getting metadata: %v", err)
+		}
+		if len(meta) != 0 {
+			t.Fatalf("Expected no metadata, got %v", meta)
+		}
+	})
+
+	filters := []struct {
+		key, value string
+		books      []string
+	}{
+		{"source", "British Library", []string{"book2"}},
+		{"source", "Bodleian", []string{"book1"}},
+		{"operator", "nick", []string{"book1"}},
+		{"source", "Bibliothèque nationale", []string{}},
+	}
+	for _, f := range filters {
+		t.Run("filter_"+f.key+"_"+f.value, func(t *testing.T) {
+			matched, err := BooksWithMeta(conn, []string{"book1", "book2", "book3"}, f.key, f.value)
+			if err != nil {
+				t.Fatalf("Error filtering books: %v", err)
+			}
+			if len(matched) != len(f.books) {
+				t.Fatalf("Expected books %v, got %v", f.books, matched)
+			}
+			for i := range f.books {
+				if matched[i] != f.books[i] {
+					t.Fatalf("Expected books %v, got %v", f.books, matched)
+				}
+			}
+
+			found, err := FindBooksWithMeta(conn, []string{"book1", "book2", "book3"}, f.key, f.value)
+			if err != nil {
+				t.Fatalf("Error finding books: %v", err)
+			}
+			for i, m := range found {
+				if m.Book != f.books[i] || m.Meta[f.key] != f.value {
+					t.Fatalf("Expected book %s with %s=%s, got %v", f.books[i], f.key, f.value, m)
+				}
+			}
+		})
+	}
+}
+
+// copyImages copies images into a new temporary directory, with the
+// names given
+func copyImages(names []string, imgs []string) (string, error) {
+	dir, err := ioutil.TempDir("", "contenthashtest")
+	if err != nil {
+		return dir, err
+	}
+	for i, n := range names {
+		b, err := ioutil.ReadFile(imgs[i])
+		if err != nil {
+			return dir, err
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, n), b, 0644)
+		if err != nil {
+			return dir, err
+		}
+	}
+	return dir, nil
+}
+
+func Test_ContentHash(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	conn := newTestConn(t, vlog)
+	dir := conn.TempDir
+
+	imgs := []string{"testdata/good/1.png", "testdata/good/2.png"}
+	books := []struct {
+		name  string
+		files []string
+		imgs  []string
+	}{
+		{"original", []string{"a.png", "b.png"}, imgs},
+		{"reupload", []string{"page 1.png", "page 2.png", ".DS_Store"}, []string{imgs[0], imgs[1], imgs[0]}},
+		{"different", []string{"a.png", "b.png"}, []string{imgs[1], imgs[0]}},
+	}
+
+	hashes := make(map[string]string)
+	for _, b := range books {
+		bookdir, err := copyImages(b.files, b.imgs)
+		defer os.RemoveAll(bookdir)
+		if err != nil {
+			t.Fatalf("Could not copy images for %s: %v", b.name, err)
+		}
+		hashes[b.name], err = ContentHash(bookdir)
+		if err != nil {
+			t.Fatalf("Error getting content hash for %s: %v", b.name, err)
+		}
+	}
+
+	if hashes["original"] != hashes["reupload"] {
+		t.Fatalf("Expected identical images to have the same hash, got %s and %s", hashes["original"], hashes["reupload"])
+	}
+	if hashes["original"] == hashes["different"] {
+		t.Fatalf("Expected different images to have different hashes")
+	}
+
+	err := UploadMeta(conn, "original", map[string]string{ContentHashKey: hashes["original"]})
+	if err != nil {
+		t.Fatalf("Error uploading metadata: %v", err)
+	}
+	err = conn.Upload(conn.WIPStorageId(), "nometa/0001.png", imgs[0])
+	if err != nil {
+		t.Fatalf("Could not upload test file: %v", err)
+	}
+	// a book whose metadata can't be parsed is skipped
+	err = conn.Upload(conn.WIPStorageId(), "broken/"+MetaFile, imgs[0])
+	if err != nil {
+		t.Fatalf("Could not upload test file: %v", err)
+	}
+
+	cases := []struct {
+		name     string
+		expected []string
+	}{
+		{"reupload", []string{"original"}},
+		{"different", []string{}},
+	}
+	for _, index := range []bool{false, true} {
+		if index {
+			err = AddContentHash(conn, "original", hashes["original"])
+			if err != nil {
+				t.Fatalf("Error adding to content hash index: %v", err)
+			}
+			// a book which has been removed since it was added
+			// to the index isn't found
+			err = AddContentHash(conn, "removed", hashes["original"])
+			if err != nil {
+				t.Fatalf("Error adding to content hash index: %v", err)
+			}
+			// nor is a book in the index whose metadata can't be read
+			err = AddContentHash(conn, "broken", hashes["original"])
+			if err != nil {
+				t.Fatalf("Error adding to content hash index: %v", err)
+			}
+		}
+		for _, c := range cases {
+			t.Run(fmt.Sprintf("%s_index%v", c.name, index), func(t *testing.T) {
+				matched, err := BooksWithContentHash(conn, hashes[c.name])
+				if err != nil {
+					t.Fatalf("Error finding books with content hash: %v", err)
+				}
+				if strings.Join(matched, " ") != strings.Join(c.expected, " ") {
+					t.Fatalf("Expected books %v, got %v", c.expected, matched)
+				}
+			})
+		}
+	}
+
+	index, found, err := getContentHashIndex(conn)
+	if err != nil || !found {
+		t.Fatalf("Expected content hash index to be saved, got %v", err)
+	}
+	if strings.Join(index[hashes["original"]], " ") != "original removed broken" {
+		t.Fatalf("Expected index to list each book once, got %v", index)
+	}
+
+	_, err = ContentHash(dir)
+	if err == nil {
+		t.Fatalf("Expected an error getting the content hash of a directory with no images")
+	}
+}
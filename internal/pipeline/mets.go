@@ -0,0 +1,186 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// MetsPage is a page of a book, as listed in a METS document, with
+// the names of its image and OCR files, relative to the METS file.
+type MetsPage struct {
+	Image string
+	Ocr   string
+}
+
+type metsDoc struct {
+	XMLName   xml.Name      `xml:"mets"`
+	Xmlns     string        `xml:"xmlns,attr"`
+	Xlink     string        `xml:"xmlns:xlink,attr"`
+	ObjId     string        `xml:"OBJID,attr"`
+	FileGrps  []metsFileGrp `xml:"fileSec>fileGrp"`
+	StructMap metsStructMap `xml:"structMap"`
+}
+
+type metsFileGrp struct {
+	Use   string     `xml:"USE,attr"`
+	Files []metsFile `xml:"file"`
+}
+
+type metsFile struct {
+	Id       string       `xml:"ID,attr"`
+	MimeType string       `xml:"MIMETYPE,attr"`
+	FLocat   metsLocation `xml:"FLocat"`
+}
+
+type metsLocation struct {
+	LocType string `xml:"LOCTYPE,attr"`
+	Href    string `xml:"xlink:href,attr"`
+}
+
+type metsStructMap struct {
+	Type string  `xml:"TYPE,attr"`
+	Div  metsDiv `xml:"div"`
+}
+
+type metsDiv struct {
+	Id    string     `xml:"ID,attr"`
+	Type  string     `xml:"TYPE,attr"`
+	Order int        `xml:"ORDER,attr,omitempty"`
+	Fptrs []metsFptr `xml:"fptr"`
+	Divs  []metsDiv  `xml:"div"`
+}
+
+type metsFptr struct {
+	FileId string `xml:"FILEID,attr"`
+}
+
+// metsMimeType returns the MIME type of a file listed in a METS
+// document, based on its extension. OCR files ending in .xml are
+// expected to be ALTO.
+func metsMimeType(fn string) string {
+	switch strings.ToLower(filepath.Ext(fn)) {
+	case ".png":
+		return "image/png"
+	case ".jpg", ".jpeg":
+		return "image/jpeg"
+	case ".tif", ".tiff":
+		return "image/tiff"
+	case ".xml":
+		return "text/xml"
+	case ".hocr", ".html":
+		return "text/html"
+	}
+	return "application/octet-stream"
+}
+
+// WriteMets writes a minimal METS document for a book to w, listing
+// the image and OCR file of each page in the fileSec, and the pages
+// in order in a physical structMap which points to both files of
+// each page, as is needed to ingest the book into many digital
+// library systems.
+func WriteMets(w io.Writer, bookname string, pages []MetsPage) error {
+	doc := metsDoc{
+		Xmlns: "http://www.loc.gov/METS/",
+		Xlink: "http://www.w3.org/1999/xlink",
+		ObjId: bookname,
+		FileGrps: []metsFileGrp{
+			{Use: "IMAGE"},
+			{Use: "FULLTEXT"},
+		},
+		StructMap: metsStructMap{
+			Type: "PHYSICAL",
+			Div:  metsDiv{Id: "PHYS_0000", Type: "physSequence"},
+		},
+	}
+	for i, pg := range pages {
+		n := fmt.Sprintf("%04d", i+1)
+		img := metsFile{Id: "IMG_" + n, MimeType: metsMimeType(pg.Image), FLocat: metsLocation{LocType: "URL", Href: filepath.ToSlash(pg.Image)}}
+		ocr := metsFile{Id: "OCR_" + n, MimeType: metsMimeType(pg.Ocr), FLocat: metsLocation{LocType: "URL", Href: filepath.ToSlash(pg.Ocr)}}
+		doc.FileGrps[0].Files = append(doc.FileGrps[0].Files, img)
+		doc.FileGrps[1].Files = append(doc.FileGrps[1].Files, ocr)
+		doc.StructMap.Div.Divs = append(doc.StructMap.Div.Divs, metsDiv{
+			Id:    "PHYS_" + n,
+			Type:  "page",
+			Order: i + 1,
+			Fptrs: []metsFptr{{FileId: img.Id}, {FileId: ocr.Id}},
+		})
+	}
+
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return fmt.Errorf("Error writing METS: %v", err)
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	err = enc.Encode(doc)
+	if err != nil {
+		return fmt.Errorf("Error writing METS: %v", err)
+	}
+	_, err = io.WriteString(w, "\n")
+	if err != nil {
+		return fmt.Errorf("Error writing METS: %v", err)
+	}
+	return nil
+}
+
+// MetsPages lists the pages of a book in dir for WriteMets, from the
+// best file written by Analyse, in page order. The image of each page
+// is the one its best hOCR was made from. The OCR file is the ALTO
+// version of the best hOCR, with the same name but ending in .xml, if
+// there is one in dir, and otherwise the best hOCR itself. An error
+// is returned if the image or OCR file of any page isn't in dir, as
+// the METS would otherwise refer to files which don't exist.
+func MetsPages(dir string) ([]MetsPage, error) {
+	f, err := os.Open(filepath.Join(dir, "best"))
+	if err != nil {
+		return nil, fmt.Errorf("Error opening best file: %v", err)
+	}
+	defer f.Close()
+
+	var hocrs []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if l != "" {
+			hocrs = append(hocrs, l)
+		}
+	}
+	if err = s.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading best file: %v", err)
+	}
+	sort.Slice(hocrs, func(i, j int) bool {
+		return pageName(hocrs[i]) < pageName(hocrs[j])
+	})
+
+	var pages []MetsPage
+	var missing []string
+	for _, h := range hocrs {
+		pg := MetsPage{Image: HocrImage(h), Ocr: h}
+		alto := strings.TrimSuffix(h, ".hocr") + ".xml"
+		_, err = os.Stat(filepath.Join(dir, alto))
+		if err == nil {
+			pg.Ocr = alto
+		}
+		for _, fn := range []string{pg.Image, pg.Ocr} {
+			_, err = os.Stat(filepath.Join(dir, fn))
+			if err != nil {
+				missing = append(missing, fn)
+			}
+		}
+		pages = append(pages, pg)
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("Error: files listed in the best file are missing from %s: %s", dir, strings.Join(missing, ", "))
+	}
+	return pages, nil
+}
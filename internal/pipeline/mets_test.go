@@ -0,0 +1,121 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// parsedMets is the parts of a METS document checked by Test_Mets,
+// with the xlink namespace as it is seen when parsing
+type parsedMets struct {
+	FileGrps []struct {
+		Use   string `xml:"USE,attr"`
+		Files []struct {
+			Id     string `xml:"ID,attr"`
+			FLocat struct {
+				Href string `xml:"http://www.w3.org/1999/xlink href,attr"`
+			} `xml:"FLocat"`
+		} `xml:"file"`
+	} `xml:"fileSec>fileGrp"`
+	Pages []struct {
+		Order int `xml:"ORDER,attr"`
+		Fptrs []struct {
+			FileId string `xml:"FILEID,attr"`
+		} `xml:"fptr"`
+	} `xml:"structMap>div>div"`
+}
+
+func Test_Mets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the best file isn't necessarily in page order
+	best := "0002_bin0.1.hocr\n0001_bin0.2.hocr\n0003_bin0.3_psm6.hocr\n"
+	err = ioutil.WriteFile(filepath.Join(dir, "best"), []byte(best), 0644)
+	if err != nil {
+		t.Fatalf("Could not write best file: %v", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "0002_bin0.1.xml"), []byte("<alto/>"), 0644)
+	if err != nil {
+		t.Fatalf("Could not write ALTO file: %v", err)
+	}
+	for _, fn := range []string{"0001_bin0.2.png", "0001_bin0.2.hocr", "0002_bin0.1.png", "0003_bin0.3.png"} {
+		err = ioutil.WriteFile(filepath.Join(dir, fn), []byte{}, 0644)
+		if err != nil {
+			t.Fatalf("Could not write %s: %v", fn, err)
+		}
+	}
+
+	_, err = MetsPages(dir)
+	if err == nil || !strings.Contains(err.Error(), "0003_bin0.3_psm6.hocr") {
+		t.Fatalf("Expected an error for the missing hOCR, got %v", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "0003_bin0.3_psm6.hocr"), []byte{}, 0644)
+	if err != nil {
+		t.Fatalf("Could not write hOCR: %v", err)
+	}
+
+	pages, err := MetsPages(dir)
+	if err != nil {
+		t.Fatalf("Error listing pages: %v", err)
+	}
+	var buf bytes.Buffer
+	err = WriteMets(&buf, "book", pages)
+	if err != nil {
+		t.Fatalf("Error writing METS: %v", err)
+	}
+
+	var mets parsedMets
+	err = xml.Unmarshal(buf.Bytes(), &mets)
+	if err != nil {
+		t.Fatalf("Error parsing METS: %v\n%s", err, buf.String())
+	}
+
+	expected := []struct{ img, ocr string }{
+		{"0001_bin0.2.png", "0001_bin0.2.hocr"},
+		{"0002_bin0.1.png", "0002_bin0.1.xml"},
+		{"0003_bin0.3.png", "0003_bin0.3_psm6.hocr"},
+	}
+
+	files := make(map[string]string)
+	for _, grp := range mets.FileGrps {
+		if len(grp.Files) != len(expected) {
+			t.Fatalf("Expected %d files in %s group, got %d", len(expected), grp.Use, len(grp.Files))
+		}
+		for _, f := range grp.Files {
+			files[f.Id] = f.FLocat.Href
+		}
+	}
+
+	if len(mets.Pages) != len(expected) {
+		t.Fatalf("Expected %d pages in structMap, got %d", len(expected), len(mets.Pages))
+	}
+	for i, pg := range mets.Pages {
+		if pg.Order != i+1 {
+			t.Fatalf("Expected page %d to have ORDER %d, got %d", i, i+1, pg.Order)
+		}
+		if len(pg.Fptrs) != 2 {
+			t.Fatalf("Expected 2 file pointers for page %d, got %d", i+1, len(pg.Fptrs))
+		}
+		img, ok := files[pg.Fptrs[0].FileId]
+		if !ok || img != expected[i].img {
+			t.Fatalf("Expected page %d image %s, got %s (%s)", i+1, expected[i].img, img, pg.Fptrs[0].FileId)
+		}
+		ocr, ok := files[pg.Fptrs[1].FileId]
+		if !ok || ocr != expected[i].ocr {
+			t.Fatalf("Expected page %d OCR %s, got %s (%s)", i+1, expected[i].ocr, ocr, pg.Fptrs[1].FileId)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The processing modes which can be given to ModeQueue, to choose how
+// a book is processed directly rather than relying on DetectQueueType
+const (
+	// ModePreprocess binarises and wipes each page
+	ModePreprocess = "preprocess"
+	// ModeWipeOnly only wipes each page, for prebinarised books
+	ModeWipeOnly = "wipeonly"
+	// ModeNoWipe binarises each page without wiping it
+	ModeNoWipe = "nowipe"
+	// ModeColour doesn't binarise or wipe each page, just converting
+	// it to greyscale, so that all of its tones are kept for OCR
+	ModeColour = "colour"
+)
+
+// Modes are all of the processing modes understood by ModeQueue
+var Modes = []string{ModePreprocess, ModeWipeOnly, ModeNoWipe, ModeColour}
+
+// ModeQueue returns the queue to add a book to so that it is
+// processed with mode, setting any options needed for it in job. The
+// images of the book aren't looked at, so this is for when the right
+// processing is already known.
+func ModeQueue(mode string, conn Queuer, job *JobMsg) (string, error) {
+	switch mode {
+	case ModePreprocess:
+		return conn.PreQueueId(), nil
+	case ModeWipeOnly:
+		return conn.WipeQueueId(), nil
+	case ModeNoWipe:
+		return conn.PreNoWipeQueueId(), nil
+	case ModeColour:
+		if job.Opts == nil {
+			job.Opts = make(map[string]string)
+		}
+		job.Opts["binmethod"] = "none"
+		return conn.PreQueueId(), nil
+	}
+	return "", fmt.Errorf("Invalid mode %s, should be one of %s", mode, strings.Join(Modes, ", "))
+}
@@ -0,0 +1,51 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"testing"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+func Test_ModeQueue(t *testing.T) {
+	conn := &bookpipeline.LocalConn{}
+
+	cases := []struct {
+		mode      string
+		queue     string
+		binmethod string
+	}{
+		{ModePreprocess, conn.PreQueueId(), ""},
+		{ModeWipeOnly, conn.WipeQueueId(), ""},
+		{ModeNoWipe, conn.PreNoWipeQueueId(), ""},
+		{ModeColour, conn.PreQueueId(), "none"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.mode, func(t *testing.T) {
+			job := JobMsg{Bookname: "book", Opts: map[string]string{}}
+			qid, err := ModeQueue(c.mode, conn, &job)
+			if err != nil {
+				t.Fatalf("Error getting queue for mode %s: %v", c.mode, err)
+			}
+			if qid != c.queue {
+				t.Fatalf("Expected queue %s for mode %s, got %s", c.queue, c.mode, qid)
+			}
+			if job.Opts["binmethod"] != c.binmethod {
+				t.Fatalf("Expected binmethod %q for mode %s, got %q", c.binmethod, c.mode, job.Opts["binmethod"])
+			}
+			_, err = PreprocessFor(ParseJobMessage(job.String()), nil, false)
+			if err != nil {
+				t.Fatalf("Error getting preprocessing for mode %s: %v", c.mode, err)
+			}
+		})
+	}
+
+	_, err := ModeQueue("sepia", conn, &JobMsg{})
+	if err == nil {
+		t.Fatalf("Expected an error for an invalid mode")
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// OcrParamsSuffix is the suffix of the sidecar file which records
+// how an hOCR file was produced, which is saved alongside it with
+// the same name, so 0001_bin0.2.hocr has the sidecar
+// 0001_bin0.2.ocr.json.
+const OcrParamsSuffix = ".ocr.json"
+
+// OcrParams records how an hOCR file was produced, so that Analyse
+// can tell which page it is a version of, and how that version
+// differs from the others, without parsing its filename. It is
+// saved as JSON, like this:
+//
+//	{"page": "0001", "image": "0001_bin0.2.png", "binarisation": "0.2", "psm": 6, "training": "eng", "tesseractversion": "tesseract 5.3.0", "tsv": true}
+//
+// Binarisation is the threshold the image was binarised with, Psm
+// the tesseract page segmentation mode used, if one was set,
+// TesseractVersion the version of tesseract which OCRed the page,
+// and Tsv whether a TSV file was saved along with the hOCR.
+type OcrParams struct {
+	Page             string `json:"page"`
+	Image            string `json:"image"`
+	Binarisation     string `json:"binarisation,omitempty"`
+	Psm              int    `json:"psm,omitempty"`
+	Training         string `json:"training,omitempty"`
+	TesseractVersion string `json:"tesseractversion,omitempty"`
+	Tsv              bool   `json:"tsv,omitempty"`
+}
+
+// OcrParamsName returns the name of the sidecar file for an hOCR
+// file.
+func OcrParamsName(hocrfn string) string {
+	return strings.TrimSuffix(hocrfn, ".hocr") + OcrParamsSuffix
+}
+
+// newOcrParams returns the parameters used to OCR the image at path
+// with training and psm, which is -1 if no mode was set.
+func newOcrParams(path string, training string, psm int) OcrParams {
+	img := filepath.Base(path)
+	p := OcrParams{Page: pageName(img), Image: img, Training: training}
+	name := strings.TrimSuffix(img, filepath.Ext(img))
+	if i := strings.Index(name, "_bin"); i != -1 {
+		p.Binarisation = name[i+len("_bin"):]
+	}
+	if psm >= 0 {
+		p.Psm = psm
+	}
+	return p
+}
+
+// code returns a code which distinguishes the version of a page
+// produced with these parameters from the others, in the same form
+// as the suffix of its hOCR file, like _bin0.2_psm6.hocr
+func (p OcrParams) code() string {
+	c := ""
+	if p.Binarisation != "" {
+		c += "_bin" + p.Binarisation
+	}
+	if p.Psm > 0 {
+		c += fmt.Sprintf("_psm%d", p.Psm)
+	}
+	return c + ".hocr"
+}
+
+// writeOcrParams saves the parameters as a sidecar to hocrfn
+func writeOcrParams(hocrfn string, p OcrParams) (string, error) {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return "", fmt.Errorf("Error encoding OCR parameters: %v", err)
+	}
+	fn := OcrParamsName(hocrfn)
+	err = ioutil.WriteFile(fn, b, 0644)
+	if err != nil {
+		return "", fmt.Errorf("Error writing OCR parameters to %s: %v", fn, err)
+	}
+	return fn, nil
+}
+
+// ReadOcrParams reads the sidecar recording how an hOCR file was
+// produced.
+func ReadOcrParams(hocrfn string) (OcrParams, error) {
+	var p OcrParams
+	fn := OcrParamsName(hocrfn)
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return p, fmt.Errorf("Error reading OCR parameters from %s: %v", fn, err)
+	}
+	err = json.Unmarshal(b, &p)
+	if err != nil {
+		return p, fmt.Errorf("Error parsing OCR parameters from %s: %v", fn, err)
+	}
+	if p.Page == "" {
+		return p, fmt.Errorf("No page found in OCR parameters %s", fn)
+	}
+	return p, nil
+}
+
+// getOcrParams returns the parameters an hOCR file of the book
+// bookname was produced with, from its sidecar, downloading it from
+// conn if it isn't already there. If bookname is empty the name of
+// the directory of the hOCR file is used. It returns false if there
+// is no sidecar, as for books OCRed before sidecars were saved.
+func getOcrParams(conn Downloader, bookname string, hocrfn string) (OcrParams, bool) {
+	p, err := ReadOcrParams(hocrfn)
+	if err == nil {
+		return p, true
+	}
+	sidecar := OcrParamsName(hocrfn)
+	if _, err = os.Stat(sidecar); !os.IsNotExist(err) {
+		return p, false
+	}
+	if bookname == "" {
+		bookname = filepath.Base(filepath.Dir(hocrfn))
+	}
+	key := bookname + "/" + filepath.Base(sidecar)
+	err = conn.Download(conn.WIPStorageId(), key, sidecar)
+	if err != nil {
+		_ = os.Remove(sidecar)
+		return p, false
+	}
+	p, err = ReadOcrParams(hocrfn)
+	return p, err == nil
+}
+
+// upOcrParams uploads the sidecar of an hOCR file, if it has one,
+// removing the local copy once it has been uploaded
+func upOcrParams(conn Uploader, bookname string, hocrfn string, logger *log.Logger) error {
+	if !strings.HasSuffix(hocrfn, ".hocr") {
+		return nil
+	}
+	sidecar := OcrParamsName(hocrfn)
+	if _, err := os.Stat(sidecar); os.IsNotExist(err) {
+		return nil
+	}
+	key := bookname + "/" + filepath.Base(sidecar)
+	logger.Println("Uploading", key)
+	err := conn.Upload(conn.WIPStorageId(), key, sidecar)
+	if err != nil {
+		return err
+	}
+	return os.Remove(sidecar)
+}
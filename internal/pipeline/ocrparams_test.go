@@ -0,0 +1,183 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func Test_OcrParams(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test which uses a shell script")
+	}
+
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	dir, err := ioutil.TempDir("", "ocrparamstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tesscmd := filepath.Join(dir, "tesseract")
+	script := "#!/bin/sh\necho '<html><body></body></html>' > \"$4.hocr\"\n"
+	err = ioutil.WriteFile(tesscmd, []byte(script), 0755)
+	if err != nil {
+		t.Fatalf("Could not write fake tesseract: %v", err)
+	}
+	img := filepath.Join(dir, "0001_bin0.2.png")
+	err = ioutil.WriteFile(img, []byte{}, 0644)
+	if err != nil {
+		t.Fatalf("Could not write image: %v", err)
+	}
+
+	toocr := make(chan string, 1)
+	up := make(chan string, 2)
+	errc := make(chan error, 1)
+	toocr <- img
+	close(toocr)
+	OcrWithOptions("eng", tesscmd, OcrOptions{Psms: []int{4, 6}})(context.Background(), toocr, up, errc, vlog)
+	select {
+	case err = <-errc:
+		t.Fatalf("Error running OCR: %v\nLog: %s", err, slog.log)
+	default:
+	}
+
+	for _, psm := range []int{4, 6} {
+		hocrfn := <-up
+		p, err := ReadOcrParams(hocrfn)
+		if err != nil {
+			t.Fatalf("Error reading OCR parameters: %v", err)
+		}
+		expected := OcrParams{Page: "0001", Image: "0001_bin0.2.png", Binarisation: "0.2", Psm: psm, Training: "eng"}
+		if p != expected {
+			t.Fatalf("Expected OCR parameters %v for %s, got %v", expected, hocrfn, p)
+		}
+		if p.code() != filepath.Base(hocrfn)[len("0001"):] {
+			t.Fatalf("Expected code %s to match %s", p.code(), hocrfn)
+		}
+	}
+}
+
+// Test_AnalyseOcrParams tests that Analyse uses the OCR parameters
+// saved with each hOCR to find its page, falling back to the
+// filename for hOCRs without them
+func Test_AnalyseOcrParams(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	conn := newTestConn(t, vlog)
+
+	dir, err := ioutil.TempDir("", "analyseocrparamstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	pages := []struct {
+		hocr   string
+		conf   int
+		params *OcrParams
+	}{
+		// names which don't follow the usual pattern, so can only be
+		// matched to their page by the OCR parameters
+		{"first.hocr", 60, &OcrParams{Page: "0001", Image: "0001_bin0.1.png", Binarisation: "0.1"}},
+		{"second.hocr", 80, &OcrParams{Page: "0001", Image: "0001_bin0.2.png", Binarisation: "0.2"}},
+		{"0002_bin0.1.hocr", 85, nil},
+		{"0002_bin0.2.hocr", 70, nil},
+	}
+	var hocrs []string
+	for _, p := range pages {
+		fn := filepath.Join(dir, p.hocr)
+		err = writeHocr(fn, p.conf, "some", "words")
+		if err != nil {
+			t.Fatalf("Could not write hOCR file %s: %v", fn, err)
+		}
+		if p.params != nil {
+			_, err = writeOcrParams(fn, *p.params)
+			if err != nil {
+				t.Fatalf("Could not write OCR parameters: %v", err)
+			}
+		}
+		hocrs = append(hocrs, fn)
+	}
+
+	_, err = runAnalyse(Analyse(conn, AnalyseOptions{}), hocrs, vlog)
+	if err != nil {
+		t.Fatalf("Error in Analyse: %v\nLog: %s", err, slog.log)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "best"))
+	if err != nil {
+		t.Fatalf("Could not read best file: %v", err)
+	}
+	expected := "second.hocr\n0002_bin0.1.hocr\n"
+	if string(b) != expected {
+		t.Fatalf("Expected best file:\n%s\ngot:\n%s", expected, b)
+	}
+
+	// without its OCR parameters, an hOCR whose name doesn't include
+	// the binarisation can't be analysed
+	err = os.Remove(OcrParamsName(filepath.Join(dir, "first.hocr")))
+	if err != nil {
+		t.Fatalf("Could not remove OCR parameters: %v", err)
+	}
+	_, err = runAnalyse(Analyse(conn, AnalyseOptions{}), hocrs, vlog)
+	if err == nil {
+		t.Fatalf("Expected an error analysing an hOCR without OCR parameters")
+	}
+}
+
+// Test_getOcrParams tests that the OCR parameters of an hOCR file are
+// downloaded from the book it belongs to, including for book names
+// containing "/"
+func Test_getOcrParams(t *testing.T) {
+	cases := []struct {
+		name     string
+		bookname string
+		key      string
+		found    bool
+	}{
+		{"plain", "book", "book/0001_bin0.1", true},
+		{"slash", "collection/book", "collection/book/0001_bin0.1", true},
+		{"nobookname", "", "book/0001_bin0.1", true},
+		{"wrongbook", "collection/book", "book/0001_bin0.1", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conn := newTestConn(t, log.New(ioutil.Discard, "", 0))
+			dir := conn.TempDir
+			params := newOcrParams("0001_bin0.1.png", "eng", -1)
+			sidecar, err := writeOcrParams(filepath.Join(dir, "0001_bin0.1.hocr"), params)
+			if err != nil {
+				t.Fatalf("Could not write OCR parameters: %v", err)
+			}
+			err = conn.Upload(conn.WIPStorageId(), OcrParamsName(c.key+".hocr"), sidecar)
+			if err != nil {
+				t.Fatalf("Could not upload OCR parameters: %v", err)
+			}
+
+			bookdir := filepath.Join(dir, "book")
+			err = os.Mkdir(bookdir, 0700)
+			if err != nil {
+				t.Fatalf("Could not create book directory: %v", err)
+			}
+			p, found := getOcrParams(conn, c.bookname, filepath.Join(bookdir, "0001_bin0.1.hocr"))
+			if found != c.found {
+				t.Fatalf("Expected found to be %v, got %v", c.found, found)
+			}
+			if found && p != params {
+				t.Fatalf("Expected OCR parameters %v, got %v", params, p)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+)
+
+// OrderFile is the name of the file that the page order manifest for
+// a book is stored in. It is saved alongside the images of the book.
+const OrderFile = "order.json"
+
+// PageOrder maps the page images of a book to their position in the
+// book, for books whose pages shouldn't be in filename order, such as
+// those with front matter scanned after the body of the text. It is
+// stored as a JSON object, with each key the filename of a page image
+// and each value its position, like this:
+//
+//	{"cover.jpg": 0, "preface.jpg": 1, "page1.jpg": 2}
+//
+// When given to booktopipeline the keys are the original filenames,
+// and it is saved in OrderFile with the names the images are given in
+// the pipeline instead. Positions need not be consecutive. Any pages
+// not listed come after those which are, in filename order.
+type PageOrder map[string]int
+
+// ParsePageOrder parses and checks a page order manifest.
+func ParsePageOrder(b []byte) (PageOrder, error) {
+	var o PageOrder
+	err := json.Unmarshal(b, &o)
+	if err != nil {
+		return o, fmt.Errorf("Error parsing page order manifest: %v", err)
+	}
+	positions := make(map[int]string)
+	for k, v := range o {
+		if v < 0 {
+			return o, fmt.Errorf("Invalid position %d for %s, should be 0 or more", v, k)
+		}
+		if other, ok := positions[v]; ok {
+			return o, fmt.Errorf("Both %s and %s are at position %d", other, k, v)
+		}
+		positions[v] = k
+	}
+	return o, nil
+}
+
+// ReadPageOrder reads and parses a page order manifest saved in fn.
+func ReadPageOrder(fn string) (PageOrder, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %s: %v", fn, err)
+	}
+	return ParsePageOrder(b)
+}
+
+// PipelineOrder converts a page order manifest listing the original
+// filenames of pages to one listing the names they are given in the
+// pipeline, using names as returned by OriginalNames. An error is
+// returned if any page listed isn't one of the original names.
+func (o PageOrder) PipelineOrder(names map[string]string) (PageOrder, error) {
+	byorig := make(map[string]string)
+	for name, orig := range names {
+		byorig[orig] = name
+	}
+	p := make(PageOrder)
+	for orig, pos := range o {
+		name, ok := byorig[orig]
+		if !ok {
+			return p, fmt.Errorf("Page %s in the page order manifest is not one of the images of the book", orig)
+		}
+		p[name] = pos
+	}
+	return p, nil
+}
+
+// Sort sorts a list of files belonging to pages of a book, like
+// 0001_bin0.2.hocr, 0001_psm6.hocr or 0001_bin0.2_rot180.hocr, into
+// the order of the pages in the manifest. Any
+// files for pages not listed are put after those which are, keeping
+// their existing order, so they should already be sorted by name.
+func (o PageOrder) Sort(fns []string) {
+	positions := make(map[string]int)
+	for k, v := range o {
+		positions[pageName(k)] = v
+	}
+	sort.SliceStable(fns, func(i, j int) bool {
+		pi, iok := positions[pageName(fns[i])]
+		pj, jok := positions[pageName(fns[j])]
+		if iok && jok {
+			return pi < pj
+		}
+		return iok && !jok
+	})
+}
+
+// UploadPageOrder saves the page order manifest for a book as JSON,
+// and uploads it to the book's directory in conn.WIPStorageId().
+func UploadPageOrder(conn Uploader, bookname string, o PageOrder) error {
+	return uploadJSON(conn, bookname+"/"+OrderFile, o)
+}
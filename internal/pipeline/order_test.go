@@ -0,0 +1,48 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_PageOrder(t *testing.T) {
+	for _, bad := range []string{`{"a.jpg": -1}`, `{"a.jpg": 1, "b.jpg": 1}`, `["a.jpg"]`} {
+		_, err := ParsePageOrder([]byte(bad))
+		if err == nil {
+			t.Fatalf("Expected an error parsing %s, got none", bad)
+		}
+	}
+
+	o, err := ParsePageOrder([]byte(`{"page three.jpg": 0, "page one.jpg": 10}`))
+	if err != nil {
+		t.Fatalf("Error parsing page order: %v", err)
+	}
+	names := map[string]string{
+		"page_one_0000.jpg":   "page one.jpg",
+		"page_two_0001.jpg":   "page two.jpg",
+		"page_three_0002.jpg": "page three.jpg",
+	}
+	o, err = o.PipelineOrder(names)
+	if err != nil {
+		t.Fatalf("Error converting page order: %v", err)
+	}
+	if len(o) != 2 || o["page_three_0002.jpg"] != 0 || o["page_one_0000.jpg"] != 10 {
+		t.Fatalf("Expected page order to use the names in the pipeline, got %v", o)
+	}
+
+	_, err = PageOrder{"missing.jpg": 0}.PipelineOrder(names)
+	if err == nil {
+		t.Fatalf("Expected an error for a page which isn't in the book, got none")
+	}
+
+	fns := []string{"page_one_0000_psm6.hocr", "page_three_0002_bin0.1_rot180.hocr", "page_two_0001_bin0.3.hocr"}
+	o.Sort(fns)
+	expected := "page_three_0002_bin0.1_rot180.hocr page_one_0000_psm6.hocr page_two_0001_bin0.3.hocr"
+	if strings.Join(fns, " ") != expected {
+		t.Fatalf("Expected sorted pages %s, got %v", expected, fns)
+	}
+}
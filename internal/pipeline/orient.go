@@ -0,0 +1,172 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ReorientedFile is the name of the file which Analyse saves in a
+// book's directory listing the pages which were found to be upside
+// down, with AnalyseOptions.ReorientConf, and so were OCRed again
+// rotated by 180 degrees.
+const ReorientedFile = "reoriented"
+
+// defaultReorientGain is how much higher the confidence of a page
+// rotated by 180 degrees must be for the rotated version to be used,
+// if AnalyseOptions.ReorientGain isn't set
+const defaultReorientGain = 10
+
+// rotatedSuffix is added to the names of the rotated image of a page,
+// and the hOCR made from it, so 0001_bin0.2.png is rotated to
+// 0001_bin0.2_rot180.png
+const rotatedSuffix = "_rot180"
+
+// reorientation is a page which was found to be upside down
+type reorientation struct {
+	page     string
+	from, to float64 // confidence of the original and rotated versions
+	hocr     string  // path of the hOCR of the rotated version
+	img      string  // path of the rotated image
+}
+
+// ocrImage OCRs a single image with the process ocr, as returned by
+// OcrWithOptions, returning the paths of the hOCR files produced
+func ocrImage(ctx context.Context, ocr func(context.Context, chan string, chan string, chan error, *log.Logger), path string, logger *log.Logger) ([]string, error) {
+	toocr := make(chan string, 1)
+	done := make(chan string)
+	errc := make(chan error, 1)
+	toocr <- path
+	close(toocr)
+	go ocr(ctx, toocr, done, errc, logger)
+
+	var hocrs []string
+	for {
+		select {
+		case h, ok := <-done:
+			if !ok {
+				return hocrs, nil
+			}
+			hocrs = append(hocrs, h)
+		case err := <-errc:
+			return hocrs, err
+		}
+	}
+}
+
+// rmRotated removes the files made when OCRing a rotated page
+func rmRotated(img string, hocrs []string) {
+	_ = os.Remove(img)
+	for _, h := range hocrs {
+		_ = os.Remove(h)
+		_ = os.Remove(OcrParamsName(h))
+		_ = os.Remove(TsvName(h))
+	}
+}
+
+// reorientPages checks whether any page of a book is upside down.
+// The image of the best version of each page in confs with a
+// confidence below opts.ReorientConf is rotated by 180 degrees with
+// RotateImage and OCRed again with the same training, and if its
+// score is at least opts.ReorientGain higher the rotated version is
+// added to confs, so that it becomes the best version of the page.
+// The pages which were rotated are returned, and the files made for
+// the others are removed.
+func reorientPages(ctx context.Context, conn Downloader, confs *ConfSet, savedir string, bookname string, dicts dictionaries, opts AnalyseOptions, logger *log.Logger) ([]reorientation, error) {
+	gain := opts.ReorientGain
+	if gain == 0 {
+		gain = defaultReorientGain
+	}
+
+	best := confs.Best()
+	var pages []string
+	for page, c := range best {
+		if c.Conf < opts.ReorientConf {
+			pages = append(pages, page)
+		}
+	}
+	sort.Strings(pages)
+
+	var reoriented []reorientation
+	for _, page := range pages {
+		if ctx.Err() != nil {
+			return reoriented, ctx.Err()
+		}
+		orig := best[page]
+		params, ok := getOcrParams(conn, bookname, orig.Path)
+		if !ok || params.Training == "" {
+			logger.Println("No training recorded for", orig.Path, "so not checking whether it is upside down")
+			continue
+		}
+
+		img := HocrImage(filepath.Base(orig.Path))
+		rotated := filepath.Join(savedir, strings.TrimSuffix(img, ".png")+rotatedSuffix+".png")
+		logger.Printf("Confidence of %s is %.0f, so checking whether it is upside down\n", orig.Path, orig.Conf)
+		err := conn.Download(conn.WIPStorageId(), bookname+"/"+img, rotated)
+		if err != nil {
+			_ = os.Remove(rotated)
+			logger.Println("Download failed; not checking whether", img, "is upside down:", err)
+			continue
+		}
+		err = RotateImage(rotated, 180)
+		if err != nil {
+			_ = os.Remove(rotated)
+			return reoriented, fmt.Errorf("Error rotating %s: %v", img, err)
+		}
+
+		hocrs, err := ocrImage(ctx, ocrFor(params.Training, "", opts.ReorientOcr), rotated, logger)
+		if err != nil {
+			rmRotated(rotated, hocrs)
+			return reoriented, fmt.Errorf("Error OCRing rotated %s: %v", img, err)
+		}
+
+		var r hocrConf
+		for _, h := range hocrs {
+			c := getHocrConf(conn, bookname, h, dicts, opts.LineConf, logger)
+			if c.err != nil {
+				rmRotated(rotated, hocrs)
+				return reoriented, c.err
+			}
+			if !c.skip && (r.conf == nil || c.score > r.score) {
+				r = c
+			}
+		}
+		if r.conf == nil || r.score < confs.Score(orig.Path)+gain {
+			logger.Println("Rotated version of", orig.Path, "is no better, so keeping it as it is")
+			rmRotated(rotated, hocrs)
+			continue
+		}
+
+		logger.Printf("Page %s is upside down, so using the rotated version, with confidence %.0f rather than %.0f\n", page, r.conf.Conf, orig.Conf)
+		for _, h := range hocrs {
+			if h != r.conf.Path {
+				rmRotated("", []string{h})
+			}
+		}
+		confs.Add(page, r.conf, r.score)
+		reoriented = append(reoriented, reorientation{page: page, from: orig.Conf, to: r.conf.Conf, hocr: r.conf.Path, img: rotated})
+	}
+	return reoriented, nil
+}
+
+// writeReoriented writes the pages which were rotated, one per line
+// with the confidence before and after rotation, separated by tabs,
+// for saving as ReorientedFile
+func writeReoriented(w io.Writer, reoriented []reorientation) error {
+	for _, r := range reoriented {
+		_, err := fmt.Fprintf(w, "%s\t%02.f\t%02.f\n", r.page, r.from, r.to)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
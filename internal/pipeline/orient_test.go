@@ -0,0 +1,162 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Test_AnalyseReorient tests that a page with low confidence which
+// OCRs much better when rotated by 180 degrees is replaced by the
+// rotated version and listed as reoriented, while one which doesn't
+// is left alone
+func Test_AnalyseReorient(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	dir, err := ioutil.TempDir("", "reorienttest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	bookname := filepath.Base(dir)
+
+	conn := newTestConn(t, vlog)
+
+	// 0001 is upside down, 0002 is just poor, and 0003 is fine
+	pages := []struct {
+		name string
+		conf int
+	}{
+		{"0001_bin0.1.hocr", 20},
+		{"0001_bin0.2.hocr", 30},
+		{"0002_bin0.2.hocr", 40},
+		{"0003_bin0.2.hocr", 90},
+	}
+	var hocrs []string
+	for _, p := range pages {
+		fn := filepath.Join(dir, p.name)
+		err = writeHocr(fn, p.conf, "upside", "down")
+		if err != nil {
+			t.Fatalf("Could not write hOCR file %s: %v", fn, err)
+		}
+		_, err = writeOcrParams(fn, newOcrParams(HocrImage(p.name), "lat", -1))
+		if err != nil {
+			t.Fatalf("Could not write OCR parameters for %s: %v", fn, err)
+		}
+		hocrs = append(hocrs, fn)
+
+		img := filepath.Join(conn.TempDir, HocrImage(p.name))
+		err = writeCornerPng(img, 2, 3)
+		if err != nil {
+			t.Fatalf("Could not write image %s: %v", img, err)
+		}
+		err = conn.Upload(conn.WIPStorageId(), bookname+"/"+HocrImage(p.name), img)
+		if err != nil {
+			t.Fatalf("Could not upload %s: %v", img, err)
+		}
+	}
+
+	// rather than running tesseract, give the rotated 0001 a high
+	// confidence and the rotated 0002 one which is only a little
+	// better than before
+	var mu sync.Mutex
+	var ocred []string
+	oldocrfor := ocrFor
+	ocrFor = func(training string, tesscmd string, opts OcrOptions) func(context.Context, chan string, chan string, chan error, *log.Logger) {
+		return func(ctx context.Context, toocr chan string, up chan string, errc chan error, logger *log.Logger) {
+			for path := range toocr {
+				mu.Lock()
+				ocred = append(ocred, training+" "+filepath.Base(path))
+				mu.Unlock()
+				conf := 45
+				if strings.HasPrefix(filepath.Base(path), "0001") {
+					conf = 90
+				}
+				name := strings.TrimSuffix(path, ".png") + ".hocr"
+				err := writeHocr(name, conf, "the", "right", "way", "up")
+				if err != nil {
+					errc <- err
+					return
+				}
+				up <- name
+			}
+			close(up)
+		}
+	}
+	defer func() { ocrFor = oldocrfor }()
+
+	done, err := runAnalyse(Analyse(conn, AnalyseOptions{ReorientConf: 50}), hocrs, vlog)
+	if err != nil {
+		t.Fatalf("Error in Analyse: %v\nLog: %s", err, slog.log)
+	}
+
+	sort.Strings(ocred)
+	expected := "lat 0001_bin0.2_rot180.png lat 0002_bin0.2_rot180.png"
+	if strings.Join(ocred, " ") != expected {
+		t.Fatalf("Expected the rotated pages OCRed to be %s, got %v", expected, ocred)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "best"))
+	if err != nil {
+		t.Fatalf("Could not read best file: %v", err)
+	}
+	expected = "0001_bin0.2_rot180.hocr\n0002_bin0.2.hocr\n0003_bin0.2.hocr\n"
+	if string(b) != expected {
+		t.Fatalf("Expected best:\n%s\ngot:\n%s", expected, b)
+	}
+
+	b, err = ioutil.ReadFile(filepath.Join(dir, ReorientedFile))
+	if err != nil {
+		t.Fatalf("Could not read %s file: %v", ReorientedFile, err)
+	}
+	expected = "0001\t30\t90\n"
+	if string(b) != expected {
+		t.Fatalf("Expected %s:\n%s\ngot:\n%s", ReorientedFile, expected, b)
+	}
+
+	// the rotated image and hOCR are uploaded, along with the list of
+	// reoriented pages
+	uploaded := make(map[string]bool)
+	for _, fn := range done {
+		uploaded[filepath.Base(fn)] = true
+	}
+	for _, fn := range []string{"0001_bin0.2_rot180.png", "0001_bin0.2_rot180.hocr", ReorientedFile} {
+		if !uploaded[fn] {
+			t.Fatalf("Expected %s to be uploaded, got %v", fn, done)
+		}
+	}
+	for _, fn := range []string{"0002_bin0.2_rot180.png", "0002_bin0.2_rot180.hocr"} {
+		if uploaded[fn] {
+			t.Fatalf("Expected %s not to be uploaded", fn)
+		}
+		_, err = os.Stat(filepath.Join(dir, fn))
+		if !os.IsNotExist(err) {
+			t.Fatalf("Expected rotated version %s which wasn't used to be removed, got %v", fn, err)
+		}
+	}
+
+	f, err := os.Open(filepath.Join(dir, "0001_bin0.2_rot180.png"))
+	if err != nil {
+		t.Fatalf("Could not open rotated image: %v", err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatalf("Could not decode rotated image: %v", err)
+	}
+	if r, _, _, _ := img.At(1, 2).RGBA(); r != 0 {
+		t.Fatalf("Expected the image to be rotated by 180 degrees, but the bottom right pixel isn't black")
+	}
+}
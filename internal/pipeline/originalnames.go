@@ -0,0 +1,223 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// OriginalNamesFile is the name of the file that the original
+// filenames of the page images of a book are stored in. It is saved
+// alongside the images of the book, and is a JSON object mapping the
+// name each image is given by UploadImages to its original filename,
+// like this:
+//
+//	{"page_one_0000.jpg": "page one.jpg", "cover_0001.png": "cover.png"}
+const OriginalNamesFile = "originalnames.json"
+
+// pageFile is the original filename of a page image, and the name it
+// is given in the pipeline, along with its path
+type pageFile struct {
+	path, orig, name string
+}
+
+// pageNames returns the page images in dir, in the order they are
+// uploaded by UploadImages, with the names they are given. These
+// have any spaces replaced and sequential numbers appended, like
+// 0001, to ensure they are appropriately named for further
+// processing in the pipeline.
+func pageNames(dir string) ([]pageFile, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read directory %s: %v", dir, err)
+	}
+
+	var paths []string
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		paths = append(paths, filepath.Join(dir, file.Name()))
+	}
+
+	return listPageNames(paths), nil
+}
+
+// imageExt returns the extension a page image with the extension
+// given has in the pipeline, which is lowercase, with .jpeg shortened
+// to .jpg, and whether it is a page image at all, as only .jpg and
+// .png images are processed.
+func imageExt(ext string) (string, bool) {
+	lext := strings.ToLower(ext)
+	if lext == ".jpeg" {
+		lext = ".jpg"
+	}
+	return lext, lext == ".jpg" || lext == ".png"
+}
+
+// listPageNames returns the page images in a list of paths, in the
+// order given, with the names they are given in the pipeline, as
+// with pageNames. Any paths which aren't .jpg or .png images are
+// skipped.
+func listPageNames(paths []string) []pageFile {
+	var pages []pageFile
+	for _, path := range paths {
+		orig := filepath.Base(path)
+		origsuffix := filepath.Ext(orig)
+		lsuffix, ok := imageExt(origsuffix)
+		if !ok {
+			continue
+		}
+		origbase := strings.TrimSuffix(orig, origsuffix)
+		safebase := strings.ReplaceAll(origbase, " ", "_")
+		newname := fmt.Sprintf("%s_%04d%s", safebase, len(pages), lsuffix)
+		pages = append(pages, pageFile{path: path, orig: orig, name: newname})
+	}
+
+	return pages
+}
+
+// OriginalNames returns a map of the name each page image in dir is
+// given by UploadImages to its original filename.
+func OriginalNames(dir string) (map[string]string, error) {
+	pages, err := pageNames(dir)
+	if err != nil {
+		return nil, err
+	}
+	return originalNames(pages), nil
+}
+
+// originalNames returns a map of the name each page is given in the
+// pipeline to its original filename
+func originalNames(pages []pageFile) map[string]string {
+	names := make(map[string]string)
+	for _, pg := range pages {
+		names[pg.name] = pg.orig
+	}
+	return names
+}
+
+// UploadOriginalNames saves the original filenames of a book's page
+// images as JSON, and uploads it to the book's directory in
+// conn.WIPStorageId().
+func UploadOriginalNames(conn Uploader, bookname string, names map[string]string) error {
+	return uploadJSON(conn, bookname+"/"+OriginalNamesFile, names)
+}
+
+// DownloadOriginalNames downloads the original filenames of a book's
+// page images into dir.
+func DownloadOriginalNames(ctx context.Context, dir string, name string, conn Downloader) error {
+	key := filepath.Join(name, OriginalNamesFile)
+	fn := filepath.Join(dir, OriginalNamesFile)
+	err := downloadCtx(ctx, conn, key, fn)
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to download %s: %v", key, err)
+	}
+	return nil
+}
+
+// ReadOriginalNames reads the original filenames of a book's page
+// images from the file saved in dir.
+func ReadOriginalNames(dir string) (map[string]string, error) {
+	fn := filepath.Join(dir, OriginalNamesFile)
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %s: %v", fn, err)
+	}
+	names := make(map[string]string)
+	err = json.Unmarshal(b, &names)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %v", fn, err)
+	}
+	return names, nil
+}
+
+// originalName returns the name file should have to match the
+// original filename of the page it is from, or "" if it isn't from a
+// page. Files from a page start with the page's name in the pipeline
+// without its extension, followed by "_", "." or nothing, such as
+// page_0001_bin0.2.hocr, and this part is replaced with the original
+// filename without its extension, like page_bin0.2.hocr. The page
+// names in bases have no extension, and are mapped to their original
+// filenames in origs.
+func originalName(file string, bases []string, origs map[string]string) string {
+	for _, base := range bases {
+		if !strings.HasPrefix(file, base) {
+			continue
+		}
+		rest := file[len(base):]
+		if rest != "" && rest[0] != '_' && rest[0] != '.' {
+			continue
+		}
+		orig := origs[base]
+		return strings.TrimSuffix(orig, filepath.Ext(orig)) + rest
+	}
+	return ""
+}
+
+// RenameToOriginals renames any files in dir which are from a page
+// of a book, such as the best hOCR of the page, so that they are
+// named after the original filename of the page rather than its name
+// in the pipeline. The names are those returned by OriginalNames.
+// Nothing is renamed if that would result in two files with the same
+// name. The renamed files are returned, mapped to their new names.
+func RenameToOriginals(dir string, names map[string]string) (map[string]string, error) {
+	// map the names without extensions, trying longer names first so
+	// that the longest match is used
+	origs := make(map[string]string)
+	var bases []string
+	for name, orig := range names {
+		base := strings.TrimSuffix(name, filepath.Ext(name))
+		origs[base] = orig
+		bases = append(bases, base)
+	}
+	sort.Slice(bases, func(i, j int) bool {
+		return len(bases[i]) > len(bases[j])
+	})
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read directory %s: %v", dir, err)
+	}
+
+	renames := make(map[string]string)
+	used := make(map[string]string)
+	for _, f := range files {
+		used[f.Name()] = f.Name()
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		n := originalName(f.Name(), bases, origs)
+		if n == "" || n == f.Name() {
+			continue
+		}
+		if other, ok := used[n]; ok {
+			return nil, fmt.Errorf("Error renaming %s to %s: the name is already used by %s", f.Name(), n, other)
+		}
+		used[n] = f.Name()
+		renames[f.Name()] = n
+	}
+
+	for from, to := range renames {
+		err = os.Rename(filepath.Join(dir, from), filepath.Join(dir, to))
+		if err != nil {
+			return nil, fmt.Errorf("Error renaming %s to %s: %v", from, to, err)
+		}
+	}
+
+	return renames, nil
+}
@@ -0,0 +1,172 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func Test_OriginalNames(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	dir, err := ioutil.TempDir("", "originalnamestest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conn := newTestConn(t, vlog)
+
+	bookdir := filepath.Join(dir, "book")
+	err = os.Mkdir(bookdir, 0755)
+	if err != nil {
+		t.Fatalf("Could not create book directory: %v", err)
+	}
+	for _, fn := range []string{"cover.PNG", "page one.jpeg", "page.1.jpg", "notes.txt"} {
+		err = ioutil.WriteFile(filepath.Join(bookdir, fn), []byte(fn), 0644)
+		if err != nil {
+			t.Fatalf("Could not create %s: %v", fn, err)
+		}
+	}
+
+	names, err := OriginalNames(bookdir)
+	if err != nil {
+		t.Fatalf("Error getting original names: %v", err)
+	}
+	expected := map[string]string{
+		"cover_0000.png":    "cover.PNG",
+		"page_one_0001.jpg": "page one.jpeg",
+		"page.1_0002.jpg":   "page.1.jpg",
+	}
+	if len(names) != len(expected) {
+		t.Fatalf("Expected original names %v, got %v", expected, names)
+	}
+	for k, v := range expected {
+		if names[k] != v {
+			t.Fatalf("Expected original name of %s to be %s, got %s", k, v, names[k])
+		}
+	}
+
+	// check the names match those uploaded
+	err = UploadImages(context.Background(), bookdir, "book", conn)
+	if err != nil {
+		t.Fatalf("Error uploading images: %v\nLog: %s", err, slog.log)
+	}
+	err = UploadOriginalNames(conn, "book", names)
+	if err != nil {
+		t.Fatalf("Error uploading original names: %v\nLog: %s", err, slog.log)
+	}
+	objs, err := conn.ListObjects(conn.WIPStorageId(), "book/")
+	if err != nil {
+		t.Fatalf("Error listing objects: %v", err)
+	}
+	for k := range expected {
+		found := false
+		for _, o := range objs {
+			if o == "book/"+k {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("Expected %s to be uploaded, got %v", k, objs)
+		}
+	}
+
+	savedir := filepath.Join(dir, "save")
+	err = os.Mkdir(savedir, 0755)
+	if err != nil {
+		t.Fatalf("Could not create save directory: %v", err)
+	}
+	err = DownloadOriginalNames(context.Background(), savedir, "book", conn)
+	if err != nil {
+		t.Fatalf("Error downloading original names: %v\nLog: %s", err, slog.log)
+	}
+	downloaded, err := ReadOriginalNames(savedir)
+	if err != nil {
+		t.Fatalf("Error reading original names: %v", err)
+	}
+	if len(downloaded) != len(names) {
+		t.Fatalf("Expected downloaded original names %v, got %v", names, downloaded)
+	}
+	for k, v := range names {
+		if downloaded[k] != v {
+			t.Fatalf("Expected downloaded original name of %s to be %s, got %s", k, v, downloaded[k])
+		}
+	}
+
+	outputs := []string{
+		"best",
+		"book.colour.pdf",
+		"cover_0000_bin0.2.hocr",
+		"cover_0000_bin0.2.png",
+		"page.1_0002_bin0.1.hocr",
+		"page_one_0001.txt",
+		"page_one_00010_bin0.1.hocr",
+	}
+	for _, fn := range outputs {
+		err = ioutil.WriteFile(filepath.Join(savedir, fn), []byte(fn), 0644)
+		if err != nil {
+			t.Fatalf("Could not create %s: %v", fn, err)
+		}
+	}
+
+	renames, err := RenameToOriginals(savedir, downloaded)
+	if err != nil {
+		t.Fatalf("Error renaming to originals: %v", err)
+	}
+	if len(renames) != 4 {
+		t.Fatalf("Expected 4 files to be renamed, got %v", renames)
+	}
+
+	files, err := ioutil.ReadDir(savedir)
+	if err != nil {
+		t.Fatalf("Could not read save directory: %v", err)
+	}
+	var got []string
+	for _, f := range files {
+		got = append(got, f.Name())
+	}
+	sort.Strings(got)
+	want := []string{
+		"best",
+		"book.colour.pdf",
+		"cover_bin0.2.hocr",
+		"cover_bin0.2.png",
+		OriginalNamesFile,
+		"page one.txt",
+		"page.1_bin0.1.hocr",
+		"page_one_00010_bin0.1.hocr",
+	}
+	sort.Strings(want)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("Expected files:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+	b, err := ioutil.ReadFile(filepath.Join(savedir, "page one.txt"))
+	if err != nil || string(b) != "page_one_0001.txt" {
+		t.Fatalf("Expected page one.txt to be renamed from page_one_0001.txt, got %q, %v", string(b), err)
+	}
+
+	// renaming which would overwrite a file is an error
+	err = ioutil.WriteFile(filepath.Join(savedir, "cover_0000.txt"), []byte("cover"), 0644)
+	if err != nil {
+		t.Fatalf("Could not create file: %v", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(savedir, "cover.txt"), []byte("cover"), 0644)
+	if err != nil {
+		t.Fatalf("Could not create file: %v", err)
+	}
+	_, err = RenameToOriginals(savedir, downloaded)
+	if err == nil {
+		t.Fatalf("Expected an error renaming over an existing file, got none")
+	}
+}
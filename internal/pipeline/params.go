@@ -0,0 +1,195 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// ParamsFile is the name of the file that the parameters a book was
+// processed with are saved to, so that its results can be reproduced
+// later. It is saved alongside the images of the book.
+const ParamsFile = "params.json"
+
+// ErrNoParams is returned by GetParams if no parameters have been
+// saved for a book
+var ErrNoParams = errors.New("No parameters saved for book")
+
+// Params records the parameters a book was processed with. It is
+// saved as JSON, like this:
+//
+//	{"training": "eng", "binmethod": "wolf", "thresholds": [0.5], "wipe": true, "wipesettings": {"hwsize": 5, ...}, "tesseractversion": "tesseract 5.3.0", "pipelineversion": "v0.1.0"}
+//
+// BinMethod is empty for books which were already binarised, and
+// Thresholds are the Sauvola or Wolf k values each page was binarised
+// with. Opts are the options sent with the book, such as custom wipe
+// thresholds. Preproc are the settings pages were binarised and wiped
+// with by Preprocess, and WipeSettings those pages were wiped with
+// otherwise, before any adaptation to each page. TesseractVersion is
+// added by RecordParamsTesseractVersion once the book has been OCRed;
+// if pages were OCRed with different versions of tesseract, each is
+// listed, separated by ", ". The version each page was OCRed with is
+// also recorded in its OcrParams sidecar.
+type Params struct {
+	Training         string            `json:"training,omitempty"`
+	BinMethod        string            `json:"binmethod,omitempty"`
+	Thresholds       []float64         `json:"thresholds,omitempty"`
+	Wipe             bool              `json:"wipe"`
+	Opts             map[string]string `json:"opts,omitempty"`
+	Preproc          *PreprocSettings  `json:"preproc,omitempty"`
+	WipeSettings     *WipeSettings     `json:"wipesettings,omitempty"`
+	TesseractVersion string            `json:"tesseractversion,omitempty"`
+	PipelineVersion  string            `json:"pipelineversion,omitempty"`
+}
+
+// PipelineVersion returns the version of bookpipeline which is
+// running, from its build information. This is the module version
+// if it was built from a release, or otherwise the revision it was
+// built from, if that was recorded.
+func PipelineVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	v := info.Main.Version
+	if v != "" && v != "(devel)" {
+		return v
+	}
+	for _, s := range info.Settings {
+		if s.Key == "vcs.revision" {
+			return s.Value
+		}
+	}
+	if v == "" {
+		return "unknown"
+	}
+	return v
+}
+
+// JobParams returns the parameters a job will be preprocessed with by
+// the function returned from PreprocessFor, with the thresholds given
+// unless the job sets others.
+func JobParams(job JobMsg, thresholds []float64, nowipe bool) (Params, error) {
+	p := Params{Training: job.Training, Wipe: !nowipe, Opts: job.Opts, PipelineVersion: PipelineVersion()}
+	single, hassingle := job.Opts["single"]
+	switch job.Opts["binmethod"] {
+	case "", "sauvola":
+		p.BinMethod = "sauvola"
+	case "otsu":
+		p.BinMethod = "otsu"
+		p.setSingleWipe()
+		return p, nil
+	case "wolf":
+		p.BinMethod = "wolf"
+		p.Thresholds = []float64{defaultWolfK}
+		p.setSingleWipe()
+		if !hassingle {
+			return p, nil
+		}
+		k, err := strconv.ParseFloat(single, 64)
+		if err != nil || k <= 0 {
+			return p, fmt.Errorf("Invalid single binarisation value %s, should be a k value", single)
+		}
+		p.Thresholds = []float64{k}
+		return p, nil
+	case "none":
+		p.BinMethod = "none"
+		p.Wipe = false
+		return p, nil
+	default:
+		return p, fmt.Errorf("Invalid binarisation method %s, should be 'sauvola', 'otsu', 'wolf' or 'none'", job.Opts["binmethod"])
+	}
+
+	if !hassingle {
+		p.Thresholds = thresholds
+		ps := DefaultPreprocSettings
+		p.Preproc = &ps
+		return p, nil
+	}
+	if single == "otsu" {
+		p.BinMethod = "otsu"
+		p.setSingleWipe()
+		return p, nil
+	}
+	ps := DefaultPreprocSettings
+	p.Preproc = &ps
+	k, err := strconv.ParseFloat(single, 64)
+	if err != nil || k <= 0 {
+		return p, fmt.Errorf("Invalid single binarisation value %s, should be a k value or 'otsu'", single)
+	}
+	p.Thresholds = []float64{k}
+	return p, nil
+}
+
+// setSingleWipe records the wipe settings used by preprocessSingle,
+// if the pages are wiped
+func (p *Params) setSingleWipe() {
+	if p.Wipe {
+		ws := singleWipeSettings()
+		p.WipeSettings = &ws
+	}
+}
+
+// WipeJobParams returns the parameters a job for an already binarised
+// book will be processed with by the function returned from WipeFor,
+// which is only wiped.
+func WipeJobParams(job JobMsg) (Params, error) {
+	p := Params{Training: job.Training, Wipe: true, Opts: job.Opts, PipelineVersion: PipelineVersion()}
+	ws, err := jobWipeSettings(job)
+	if err != nil {
+		return p, err
+	}
+	p.WipeSettings = &ws
+	return p, nil
+}
+
+// UploadParams saves the parameters for a book as JSON, and uploads
+// them to the book's directory in conn.WIPStorageId().
+func UploadParams(conn Uploader, bookname string, p Params) error {
+	return uploadJSON(conn, bookname+"/"+ParamsFile, p)
+}
+
+// GetParams downloads and parses the parameters saved for a book. If
+// none have been saved ErrNoParams is returned.
+func GetParams(conn DownloadLister, bookname string) (Params, error) {
+	var p Params
+	found, err := downloadJSON(conn, bookname+"/"+ParamsFile, &p)
+	if err == nil && !found {
+		err = ErrNoParams
+	}
+	return p, err
+}
+
+// RecordParamsTesseractVersion adds the versions of tesseract listed
+// in the TessVersionFile of a book to the parameters saved for it.
+// This should be done once all of the pages have been OCRed, by the
+// analyse stage, so that only one process updates the parameters.
+// Nothing is done if no parameters have been saved for the book.
+func RecordParamsTesseractVersion(conn DownloadUploadLister, bookname string) error {
+	p, err := GetParams(conn, bookname)
+	if err == ErrNoParams {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	versions, err := GetTesseractVersions(conn, bookname)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return nil
+	}
+	p.TesseractVersion = strings.Join(versions, ", ")
+	err = UploadParams(conn, bookname, p)
+	if err != nil {
+		return fmt.Errorf("Error saving tesseract version for %s: %v", bookname, err)
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_JobParams(t *testing.T) {
+	thresholds := []float64{0.1, 0.2}
+	cases := []struct {
+		body       string
+		nowipe     bool
+		binmethod  string
+		thresholds []float64
+		wipe       bool
+		err        bool
+	}{
+		{"book", false, "sauvola", []float64{0.1, 0.2}, true, false},
+		{"book", true, "sauvola", []float64{0.1, 0.2}, false, false},
+		{"book single=0.3", false, "sauvola", []float64{0.3}, true, false},
+		{"book single=otsu", false, "otsu", nil, true, false},
+		{"book binmethod=otsu", true, "otsu", nil, false, false},
+		{"book binmethod=wolf", false, "wolf", []float64{defaultWolfK}, true, false},
+		{"book binmethod=wolf single=0.4", false, "wolf", []float64{0.4}, true, false},
+		{"book binmethod=none", false, "none", nil, false, false},
+		{"book binmethod=niblack", false, "", nil, false, true},
+		{"book single=0", false, "", nil, false, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.body, func(t *testing.T) {
+			p, err := JobParams(ParseJobMessage(c.body), thresholds, c.nowipe)
+			if err == nil && c.err {
+				t.Fatalf("Expected an error, got none")
+			}
+			if err != nil && !c.err {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if c.err {
+				return
+			}
+			if p.BinMethod != c.binmethod || !reflect.DeepEqual(p.Thresholds, c.thresholds) || p.Wipe != c.wipe {
+				t.Fatalf("Expected binmethod %s, thresholds %v and wipe %v, got %s, %v and %v", c.binmethod, c.thresholds, c.wipe, p.BinMethod, p.Thresholds, p.Wipe)
+			}
+		})
+	}
+}
+
+// Test_RecordParams tests that the parameters a book is processed
+// with are saved to params.json, including the effective wipe
+// settings
+func Test_RecordParams(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	dir, err := ioutil.TempDir("", "paramstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conn := newTestConn(t, vlog)
+
+	_, err = GetParams(conn, "other")
+	if err != ErrNoParams {
+		t.Fatalf("Expected no parameters to be saved for a book without them, got %v", err)
+	}
+
+	singlewipe := map[string]interface{}{
+		"hwsize":      5.0,
+		"hthresh":     0.03,
+		"hmin":        30.0,
+		"hmax":        120.0,
+		"vthresh":     0.005,
+		"vmin":        30.0,
+		"adaptwindow": false,
+		"adaptthresh": false,
+	}
+	customwipe := map[string]interface{}{
+		"hwsize":      5.0,
+		"hthresh":     0.1,
+		"hmin":        30.0,
+		"hmax":        120.0,
+		"vthresh":     0.005,
+		"vmin":        30.0,
+		"adaptwindow": true,
+		"adaptthresh": false,
+	}
+	defpreproc := map[string]interface{}{
+		"bintype":          "binary",
+		"binwsize":         0.0,
+		"wipewsize":        5.0,
+		"wipeminwidthperc": 30.0,
+		"wipeminheight":    120.0,
+		"wipeedgemax":      30.0,
+	}
+
+	cases := []struct {
+		body     string
+		wipeonly bool
+		expected map[string]interface{}
+	}{
+		{"book1 lat binmethod=wolf single=0.3 wipehthresh=0.1", false, map[string]interface{}{
+			"training":     "lat",
+			"binmethod":    "wolf",
+			"thresholds":   []interface{}{0.3},
+			"wipe":         true,
+			"opts":         map[string]interface{}{"binmethod": "wolf", "single": "0.3", "wipehthresh": "0.1"},
+			"preproc":      nil,
+			"wipesettings": singlewipe,
+		}},
+		{"book2", false, map[string]interface{}{
+			"binmethod":    "sauvola",
+			"thresholds":   []interface{}{0.1, 0.2},
+			"wipe":         true,
+			"preproc":      defpreproc,
+			"wipesettings": nil,
+		}},
+		{"book3 wipehthresh=0.1", true, map[string]interface{}{
+			"binmethod":    nil,
+			"wipe":         true,
+			"preproc":      nil,
+			"wipesettings": customwipe,
+		}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.body, func(t *testing.T) {
+			job := ParseJobMessage(c.body)
+			var p Params
+			if c.wipeonly {
+				p, err = WipeJobParams(job)
+			} else {
+				p, err = JobParams(job, []float64{0.1, 0.2}, false)
+			}
+			if err != nil {
+				t.Fatalf("Error getting parameters: %v", err)
+			}
+			err = UploadParams(conn, job.Bookname, p)
+			if err != nil {
+				t.Fatalf("Error saving parameters: %v", err)
+			}
+
+			fn := filepath.Join(dir, job.Bookname+"-"+ParamsFile)
+			err = conn.Download(conn.WIPStorageId(), job.Bookname+"/"+ParamsFile, fn)
+			if err != nil {
+				t.Fatalf("Could not download %s: %v", ParamsFile, err)
+			}
+			b, err := ioutil.ReadFile(fn)
+			if err != nil {
+				t.Fatalf("Could not read %s: %v", fn, err)
+			}
+			var saved map[string]interface{}
+			err = json.Unmarshal(b, &saved)
+			if err != nil {
+				t.Fatalf("Could not parse %s: %v", fn, err)
+			}
+
+			for k, v := range c.expected {
+				if !reflect.DeepEqual(saved[k], v) {
+					t.Fatalf("Expected %s to be %v, got %v\n%s", k, v, saved[k], b)
+				}
+			}
+			if v, ok := saved["pipelineversion"].(string); !ok || v == "" {
+				t.Fatalf("Expected a pipeline version to be saved, got %v", saved["pipelineversion"])
+			}
+		})
+	}
+
+	_, err = WipeJobParams(ParseJobMessage("book wipeadapt=maybe"))
+	if err == nil {
+		t.Fatalf("Expected an error for an invalid wipeadapt option, got none")
+	}
+}
+
+func Test_RecordParamsTesseractVersion(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	conn := newTestConn(t, vlog)
+
+	versions := []byte("tesseract 4.1.1\ntesseract 5.3.0\n")
+	for _, book := range []string{"noparams", "params"} {
+		err := uploadBytes(conn, book+"/"+TessVersionFile, versions)
+		if err != nil {
+			t.Fatalf("Could not upload %s: %v", TessVersionFile, err)
+		}
+	}
+	err := UploadParams(conn, "params", Params{Training: "eng", Wipe: true})
+	if err != nil {
+		t.Fatalf("Could not upload parameters: %v", err)
+	}
+
+	err = RecordParamsTesseractVersion(conn, "noparams")
+	if err != nil {
+		t.Fatalf("Error recording tesseract version for a book without parameters: %v", err)
+	}
+	_, err = GetParams(conn, "noparams")
+	if err != ErrNoParams {
+		t.Fatalf("Expected no parameters to be saved for a book without them, got %v", err)
+	}
+
+	err = RecordParamsTesseractVersion(conn, "params")
+	if err != nil {
+		t.Fatalf("Error recording tesseract version: %v", err)
+	}
+	p, err := GetParams(conn, "params")
+	if err != nil {
+		t.Fatalf("Could not get parameters: %v", err)
+	}
+	expected := "tesseract 4.1.1, tesseract 5.3.0"
+	if p.TesseractVersion != expected || p.Training != "eng" {
+		t.Fatalf("Expected tesseract version %s to be added to the parameters, got %+v", expected, p)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"fmt"
+)
+
+// PauseKey is the name of the object which, while it exists in
+// conn.WIPStorageId(), tells bookpipeline not to take any new jobs
+// from the queues. Any jobs already being processed carry on as
+// usual. It is not inside a book directory, so is never mistaken
+// for a book.
+const PauseKey = "bookpipeline.paused"
+
+// Pauser is needed to set and clear the pause flag
+type Pauser interface {
+	DeleteObjects(bucket string, keys []string) error
+	ListObjects(bucket string, prefix string) ([]string, error)
+	Log(v ...interface{})
+	Upload(bucket string, key string, path string) error
+	WIPStorageId() string
+}
+
+// IsPaused returns whether the pipeline has been paused with Pause.
+func IsPaused(conn Lister) (bool, error) {
+	objs, err := conn.ListObjects(conn.WIPStorageId(), PauseKey)
+	if err != nil {
+		return false, fmt.Errorf("Error checking for %s: %v", PauseKey, err)
+	}
+	for _, o := range objs {
+		if o == PauseKey {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Pause stops bookpipeline processes from taking new jobs from the
+// queues, without stopping them, until Resume is called.
+func Pause(conn Pauser) error {
+	return uploadBytes(conn, PauseKey, nil)
+}
+
+// Resume lets bookpipeline processes take new jobs from the queues
+// again after Pause.
+func Resume(conn Pauser) error {
+	paused, err := IsPaused(conn)
+	if err != nil || !paused {
+		return err
+	}
+	err = conn.DeleteObjects(conn.WIPStorageId(), []string{PauseKey})
+	if err != nil {
+		return fmt.Errorf("Error deleting %s: %v", PauseKey, err)
+	}
+	return nil
+}
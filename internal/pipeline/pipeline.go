@@ -13,19 +13,22 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"image"
 	"io/ioutil"
 	"log"
 	"net/smtp"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"rescribe.xyz/bookpipeline"
-	"rescribe.xyz/preproc"
+	"rescribe.xyz/bookpipeline/internal/postproc"
 	"rescribe.xyz/utils/pkg/hocr"
 )
 
@@ -50,12 +53,28 @@ type DownloadLister interface {
 	WIPStorageId() string
 }
 
+type PrefixDownloadLister interface {
+	Download(bucket string, key string, fn string) error
+	ListObjectPrefixes(bucket string) ([]string, error)
+	ListObjects(bucket string, prefix string) ([]string, error)
+	Log(v ...interface{})
+	WIPStorageId() string
+}
+
 type Uploader interface {
 	Log(v ...interface{})
 	Upload(bucket string, key string, path string) error
 	WIPStorageId() string
 }
 
+type DownloadUploadLister interface {
+	Download(bucket string, key string, fn string) error
+	ListObjects(bucket string, prefix string) ([]string, error)
+	Log(v ...interface{})
+	Upload(bucket string, key string, path string) error
+	WIPStorageId() string
+}
+
 type Queuer interface {
 	AddToQueue(url string, msg string) error
 	AnalyseQueueId() string
@@ -110,6 +129,9 @@ type MinPipeliner interface {
 
 type pageimg struct {
 	hocr, img string
+	// rotate is set if the image needs to be rotated by 180 degrees
+	// to match the hOCR, as for colour images of reoriented pages
+	rotate bool
 }
 
 type mailSettings struct {
@@ -145,7 +167,7 @@ func download(ctx context.Context, dl chan string, process chan string, conn Dow
 		default:
 		}
 		fn := filepath.Join(dir, filepath.Base(key))
-		logger.Println("Downloading", key)
+		logger.Println(bookpipeline.DebugTag+"Downloading", key)
 		err := conn.Download(conn.WIPStorageId(), key, fn)
 		if err != nil {
 			for range dl {
@@ -174,10 +196,26 @@ func up(ctx context.Context, c chan string, done chan bool, conn Uploader, bookn
 			return
 		default:
 		}
+		// the OCR parameters and TSV are uploaded first, so they are
+		// always available once the hOCR is
+		err := upOcrParams(conn, bookname, path, logger)
+		if err != nil {
+			for range c {
+			} // consume the rest of the receiving channel so it isn't blocked
+			errc <- err
+			return
+		}
+		err = upTsv(conn, bookname, path, logger)
+		if err != nil {
+			for range c {
+			} // consume the rest of the receiving channel so it isn't blocked
+			errc <- err
+			return
+		}
 		name := filepath.Base(path)
 		key := bookname + "/" + name
-		logger.Println("Uploading", key)
-		err := conn.Upload(conn.WIPStorageId(), key, path)
+		logger.Println(bookpipeline.DebugTag+"Uploading", key)
+		err = upload(conn, key, path)
 		if err != nil {
 			for range c {
 			} // consume the rest of the receiving channel so it isn't blocked
@@ -199,10 +237,11 @@ func up(ctx context.Context, c chan string, done chan bool, conn Uploader, bookn
 // upAndQueue reads file names from a channel and uploads them with
 // the bookname/ prefix, removing the local copy of each file
 // once it has been successfully uploaded. Each done file name is
-// added to the toQueue once it has been uploaded. The done channel
-// is then written to to signal completion. If an error occurs it
-// is sent to the errc channel and the function returns early.
-func upAndQueue(ctx context.Context, c chan string, done chan bool, toQueue string, conn UploadQueuer, bookname string, training string, errc chan error, logger *log.Logger) {
+// added to the toQueue once it has been uploaded, with the training
+// and options of job. The done channel is then written to to signal
+// completion. If an error occurs it is sent to the errc channel and
+// the function returns early.
+func upAndQueue(ctx context.Context, c chan string, done chan bool, toQueue string, conn UploadQueuer, bookname string, job JobMsg, errc chan error, logger *log.Logger) {
 	for path := range c {
 		select {
 		case <-ctx.Done():
@@ -214,8 +253,8 @@ func upAndQueue(ctx context.Context, c chan string, done chan bool, toQueue stri
 		}
 		name := filepath.Base(path)
 		key := bookname + "/" + name
-		logger.Println("Uploading", key)
-		err := conn.Upload(conn.WIPStorageId(), key, path)
+		logger.Println(bookpipeline.DebugTag+"Uploading", key)
+		err := upload(conn, key, path)
 		if err != nil {
 			for range c {
 			} // consume the rest of the receiving channel so it isn't blocked
@@ -229,8 +268,9 @@ func upAndQueue(ctx context.Context, c chan string, done chan bool, toQueue stri
 			errc <- err
 			return
 		}
-		logger.Println("Adding", key, training, "to queue", toQueue)
-		err = conn.AddToQueue(toQueue, key+" "+training)
+		pgjob := JobMsg{Bookname: bookname, Page: key, Training: job.Training, Opts: job.Opts}
+		logger.Println("Adding", pgjob.String(), "to queue", toQueue)
+		err = conn.AddToQueue(toQueue, pgjob.String())
 		if err != nil {
 			for range c {
 			} // consume the rest of the receiving channel so it isn't blocked
@@ -254,7 +294,7 @@ func Preprocess(thresholds []float64, nowipe bool) func(context.Context, chan st
 			default:
 			}
 			logger.Println("Preprocessing", path)
-			done, err := preproc.PreProcMulti(path, thresholds, "binary", 0, !nowipe, 5, 30, 120, 30)
+			done, err := preprocMultiFor(path, thresholds, !nowipe, DefaultPreprocSettings)
 			if err != nil {
 				for range pre {
 				} // consume the rest of the receiving channel so it isn't blocked
@@ -270,37 +310,149 @@ func Preprocess(thresholds []float64, nowipe bool) func(context.Context, chan st
 	}
 }
 
+// Wipe wipes each prebinarised page with DefaultWipeSettings.
 func Wipe(ctx context.Context, towipe chan string, up chan string, errc chan error, logger *log.Logger) {
-	for path := range towipe {
-		select {
-		case <-ctx.Done():
-			for range towipe {
-			} // consume the rest of the receiving channel so it isn't blocked
-			errc <- ctx.Err()
-			return
-		default:
+	WipeWith(DefaultWipeSettings)(ctx, towipe, up, errc, logger)
+}
+
+// WipeWith returns a process which wipes each prebinarised page with
+// the settings given, saving the result with the suffix _bin0.0.png.
+func WipeWith(ws WipeSettings) func(context.Context, chan string, chan string, chan error, *log.Logger) {
+	return func(ctx context.Context, towipe chan string, up chan string, errc chan error, logger *log.Logger) {
+		for path := range towipe {
+			select {
+			case <-ctx.Done():
+				for range towipe {
+				} // consume the rest of the receiving channel so it isn't blocked
+				errc <- ctx.Err()
+				return
+			default:
+			}
+			logger.Println("Wiping", path)
+			outpath := strings.TrimSuffix(path, filepath.Ext(path)) + "_bin0.0.png"
+			err := wipeFile(path, outpath, ws)
+			if err != nil {
+				for range towipe {
+				} // consume the rest of the receiving channel so it isn't blocked
+				errc <- err
+				return
+			}
+			up <- outpath
 		}
-		logger.Println("Wiping", path)
-		s := strings.Split(path, ".")
-		base := strings.Join(s[:len(s)-1], "")
-		outpath := base + "_bin0.0.png"
-		err := preproc.WipeFile(path, outpath, 5, 0.03, 30, 120, 0.005, 30)
+		close(up)
+	}
+}
+
+// OcrOptions are the settings used by OcrWithOptions. The zero value
+// gives the default behaviour.
+type OcrOptions struct {
+	// Whitelist restricts recognition to only these characters, which
+	// can reduce misrecognitions for books in a single script. See
+	// ScriptWhitelist for whitelists for common scripts.
+	Whitelist string
+
+	// Blacklist prevents these characters from being recognised.
+	Blacklist string
+
+	// Psms OCRs each page once with each of these tesseract page
+	// segmentation modes, saving each hOCR with the suffix _psmN, so
+	// that Analyse can choose the best of them in the same way as it
+	// does the different binarisations of a page. This can help with
+	// pages with unusual layouts, like tables or sparse text. If it
+	// is empty each page is OCRed once with the default mode.
+	Psms []int
+
+	// Trainings fetches the training to OCR with from cloud storage
+	// before OCRing, if it isn't already installed. If it is nil the
+	// training must already be installed.
+	Trainings *TrainingCache
+
+	// AutoCrop crops each page to the ink on it, with AutoCrop,
+	// before OCRing it, which can speed up OCR of pages with large
+	// blank margins. The coordinates in the hOCR are then moved back
+	// to match the uncropped page, so PDFs are still aligned.
+	AutoCrop bool
+
+	// CropPad is the space in pixels left around the ink on each
+	// page by AutoCrop.
+	CropPad int
+
+	// Tsv also saves tesseract's TSV output alongside each hOCR, named
+	// as given by TsvName. Analyse reads the confidence of each page
+	// from this if it is there, which is much quicker than parsing
+	// the hOCR.
+	Tsv bool
+}
+
+// psmPattern matches the suffix given to hOCR files OCRed with a
+// particular page segmentation mode
+var psmPattern = regexp.MustCompile(`_psm[0-9]+$`)
+
+// ParsePsms parses a comma separated list of tesseract page
+// segmentation modes, like "3,6,11", for OcrOptions.Psms. Only the
+// modes which produce OCR results, 1 and 3 to 13, are allowed.
+func ParsePsms(s string) ([]int, error) {
+	var psms []int
+	for _, p := range strings.Split(s, ",") {
+		psm, err := strconv.Atoi(strings.TrimSpace(p))
 		if err != nil {
-			for range towipe {
-			} // consume the rest of the receiving channel so it isn't blocked
-			errc <- err
-			return
+			return nil, fmt.Errorf("Invalid page segmentation mode %s: %v", p, err)
 		}
-		up <- outpath
+		if psm < 1 || psm == 2 || psm > 13 {
+			return nil, fmt.Errorf("Invalid page segmentation mode %d: must be 1 or from 3 to 13", psm)
+		}
+		psms = append(psms, psm)
 	}
-	close(up)
+	return psms, nil
 }
 
+// HocrImage returns the name of the image that the hOCR file fn was
+// OCRed from, which is the same name with a .png suffix, less any
+// page segmentation mode suffix.
+func HocrImage(fn string) string {
+	return psmPattern.ReplaceAllString(strings.TrimSuffix(fn, ".hocr"), "") + ".png"
+}
+
+// ocrArgs returns the arguments to run tesseract with to OCR the
+// image at path, saving the hOCR to name.hocr, and the TSV to
+// name.tsv if opts.Tsv is set
+func ocrArgs(training string, path string, name string, opts OcrOptions) []string {
+	args := []string{"-l", training, path, name, "-c", "tessedit_create_hocr=1", "-c", "hocr_font_info=0"}
+	if opts.Whitelist != "" {
+		args = append(args, "-c", "tessedit_char_whitelist="+opts.Whitelist)
+	}
+	if opts.Blacklist != "" {
+		args = append(args, "-c", "tessedit_char_blacklist="+opts.Blacklist)
+	}
+	if opts.Tsv {
+		args = append(args, "-c", "tessedit_create_tsv=1")
+	}
+	return args
+}
+
+// Ocr returns a process which OCRs each image with tesseract, using
+// the default OcrOptions.
 func Ocr(training string, tesscmd string) func(context.Context, chan string, chan string, chan error, *log.Logger) {
+	return OcrWithOptions(training, tesscmd, OcrOptions{})
+}
+
+// OcrWithOptions returns a process which OCRs each image with
+// tesseract, using training and the settings in opts. If tesscmd is
+// empty tesseract is run from the path.
+func OcrWithOptions(training string, tesscmd string, opts OcrOptions) func(context.Context, chan string, chan string, chan error, *log.Logger) {
 	return func(ctx context.Context, toocr chan string, up chan string, errc chan error, logger *log.Logger) {
 		if tesscmd == "" {
 			tesscmd = "tesseract"
 		}
+		if opts.Trainings != nil {
+			err := opts.Trainings.Fetch(training)
+			if err != nil {
+				for range toocr {
+				} // consume the rest of the receiving channel so it isn't blocked
+				errc <- err
+				return
+			}
+		}
 		for path := range toocr {
 			select {
 			case <-ctx.Done():
@@ -312,61 +464,324 @@ func Ocr(training string, tesscmd string) func(context.Context, chan string, cha
 			}
 			logger.Println("OCRing", path)
 			name := strings.Replace(path, ".png", "", 1)
-			cmd := exec.Command(tesscmd, "-l", training, path, name, "-c", "tessedit_create_hocr=1", "-c", "hocr_font_info=0")
-			HideCmd(cmd)
-			var stdout, stderr bytes.Buffer
-			cmd.Stdout = &stdout
-			cmd.Stderr = &stderr
-			err := cmd.Run()
-			if err != nil {
-				for range toocr {
-				} // consume the rest of the receiving channel so it isn't blocked
-				errc <- fmt.Errorf("Error ocring %s with training %s: %s\nStdout: %s\nStderr: %s\n", path, training, err, stdout.String(), stderr.String())
-				return
+			psms := opts.Psms
+			if len(psms) == 0 {
+				psms = []int{-1}
+			}
+			imgpath := path
+			var cropoff, size image.Point
+			if opts.AutoCrop {
+				imgpath = name + ".crop.png"
+				var err error
+				cropoff, size, err = cropForOcr(path, imgpath, opts.CropPad)
+				if err != nil {
+					for range toocr {
+					} // consume the rest of the receiving channel so it isn't blocked
+					errc <- fmt.Errorf("Error cropping %s: %v", path, err)
+					return
+				}
+			}
+			var hocrs []string
+			for _, psm := range psms {
+				hocrname := name
+				if psm >= 0 {
+					hocrname = fmt.Sprintf("%s_psm%d", name, psm)
+				}
+				args := ocrArgs(training, imgpath, hocrname, opts)
+				if psm >= 0 {
+					args = append(args, "--psm", strconv.Itoa(psm))
+				}
+				cmd := exec.CommandContext(ctx, tesscmd, args...)
+				HideCmd(cmd)
+				var stdout, stderr bytes.Buffer
+				cmd.Stdout = &stdout
+				cmd.Stderr = &stderr
+				err := cmd.Run()
+				if err != nil {
+					for range toocr {
+					} // consume the rest of the receiving channel so it isn't blocked
+					errc <- fmt.Errorf("Error ocring %s with training %s: %s\nStdout: %s\nStderr: %s\n", path, training, err, stdout.String(), stderr.String())
+					return
+				}
+				lines, err := SanitiseHocrFile(hocrname + ".hocr")
+				if err != nil {
+					for range toocr {
+					} // consume the rest of the receiving channel so it isn't blocked
+					errc <- err
+					return
+				}
+				if len(lines) > 0 {
+					logger.Printf("Replaced invalid UTF-8 in %s.hocr on lines %v\n", hocrname, lines)
+				}
+				if opts.AutoCrop {
+					err = offsetHocrFile(hocrname+".hocr", cropoff, size)
+					if err != nil {
+						for range toocr {
+						} // consume the rest of the receiving channel so it isn't blocked
+						errc <- err
+						return
+					}
+				}
+				params := newOcrParams(path, training, psm)
+				params.TesseractVersion, _ = TesseractVersion(tesscmd)
+				if _, err := os.Stat(TsvName(hocrname + ".hocr")); err == nil {
+					params.Tsv = true
+				}
+				_, err = writeOcrParams(hocrname+".hocr", params)
+				if err != nil {
+					for range toocr {
+					} // consume the rest of the receiving channel so it isn't blocked
+					errc <- err
+					return
+				}
+				hocrs = append(hocrs, hocrname+".hocr")
+			}
+			if opts.AutoCrop {
+				_ = os.Remove(imgpath)
+			}
+			// the hOCRs are only passed on once the page has been OCRed
+			// with every mode. They are still uploaded one at a time,
+			// so OcrPage only counts the page as done once the hOCR
+			// for every mode has been uploaded.
+			for _, h := range hocrs {
+				up <- h
 			}
-			up <- name + ".hocr"
 		}
 		close(up)
 	}
 }
 
-func Analyse(conn Downloader, mkfullpdf bool) func(context.Context, chan string, chan string, chan error, *log.Logger) {
+// AnalyseOptions are the settings used by Analyse. The zero value
+// gives the default behaviour.
+type AnalyseOptions struct {
+	// MkFullPdf creates an extra PDF using the original full size
+	// images.
+	MkFullPdf bool
+
+	// Dictionaries are the paths to word lists for the languages of
+	// the books, keyed by the training used to OCR each page, as parsed
+	// by ParseDictionaries. If a page has a word list the best version
+	// of it is chosen using both the average confidence and the
+	// proportion of words found in the word list, rather than just the
+	// average confidence.
+	Dictionaries map[string]string
+
+	// SplitPages splits each PDF into several volumes, each with at
+	// most this many pages. If zero the PDFs are not split by pages.
+	SplitPages int
+
+	// SplitBytes splits each PDF into several volumes of roughly
+	// this size at most. If zero the PDFs are not split by size.
+	SplitBytes int
+
+	// LineConf uses the average confidence of each line, rather than
+	// of each word, when choosing the best version of each page. This
+	// can be more stable for trainings which give noisy word
+	// confidences.
+	LineConf bool
+
+	// AppendReport adds pages to the end of each PDF with the
+	// confidence graph and a summary of the confidences.
+	AppendReport bool
+
+	// MinTextConf leaves any words with a lower confidence out of the
+	// searchable text of the PDFs, though the page images are still
+	// included.
+	MinTextConf float64
+
+	// ScaleHocr scales the hOCR coordinates to the size of the colour
+	// images in the colour and full size PDFs, for when the binarised
+	// images which were OCRed are a different size.
+	ScaleHocr bool
+
+	// StreamPdf writes each page of the PDFs to disk as it is added,
+	// with bookpipeline.Fpdf.Stream, rather than building them up in
+	// memory, so that very large books can be made into PDFs without
+	// running out of memory.
+	StreamPdf bool
+
+	// ColumnOrder puts the searchable text of pages with several
+	// columns in the PDFs in reading order, one column after another,
+	// with bookpipeline.Fpdf.ColumnOrder.
+	ColumnOrder bool
+
+	// Tar packs the best hOCR of each page, its text, and the best,
+	// conf, words.jsonl and pagesizes files into a single archive,
+	// bookname.tar, which is uploaded alongside the other results.
+	Tar bool
+
+	// TarGzip compresses the archive created with Tar, which is then
+	// named bookname.tar.gz.
+	TarGzip bool
+
+	// TarOnly uploads the files packed into the archive only as part
+	// of it, rather than also uploading each of them, so that fewer
+	// objects are stored for each book. The PDFs, graph and done
+	// marker are still uploaded. It implies Tar. Books analysed with
+	// it have no best or conf file of their own in storage, so their
+	// results can only be downloaded with DownloadTar.
+	TarOnly bool
+
+	// MinBookConf marks the book as needing review rather than done,
+	// by saving NeedsReviewFile, if the average confidence of the
+	// best version of each page is below it. If zero books are never
+	// marked as needing review.
+	MinBookConf float64
+
+	// ConfWorkers is the number of hOCR files whose confidence is
+	// calculated at once. If zero they are done one at a time.
+	ConfWorkers int
+
+	// TextRules is the path to a file of substitutions, in the format
+	// read by postproc.LoadRules, which are applied to the text of
+	// each page saved with Tar, to correct systematic OCR errors. The
+	// hOCR is left unchanged.
+	TextRules string
+
+	// Bookname is the name of the book being analysed, which is used
+	// to find its files in storage. If empty the name of the directory
+	// the hOCR files were downloaded to is used, which is only the
+	// last part of names which contain "/".
+	Bookname string
+
+	// ReorientConf checks whether pages were scanned upside down. The
+	// image of any page whose best version has a lower confidence is
+	// rotated by 180 degrees and OCRed again, and the rotated version
+	// is used if its confidence is substantially higher, with the page
+	// listed in ReorientedFile. If zero pages are never rotated.
+	ReorientConf float64
+
+	// ReorientGain is how much higher the confidence of a rotated page
+	// must be for it to be used with ReorientConf. If zero a default
+	// of 10 is used.
+	ReorientGain float64
+
+	// ReorientOcr are the settings used to OCR the rotated pages with
+	// ReorientConf, which should match those the book was OCRed with.
+	// The training is the one the page was originally OCRed with.
+	ReorientOcr OcrOptions
+
+	// GraphLabelBelow only labels the pages of the graph with a
+	// confidence below it, as with bookpipeline.GraphOptions. If zero
+	// the pages outside the top and bottom 10% are labelled.
+	GraphLabelBelow float64
+
+	// GraphMaxLabels labels at most this many pages of the graph,
+	// those with the lowest confidence. If zero there is no limit.
+	GraphMaxLabels int
+}
+
+func Analyse(conn Downloader, opts AnalyseOptions) func(context.Context, chan string, chan string, chan error, *log.Logger) {
 	return func(ctx context.Context, toanalyse chan string, up chan string, errc chan error, logger *log.Logger) {
-		confs := make(map[string][]*bookpipeline.Conf)
-		bestconfs := make(map[string]*bookpipeline.Conf)
+		var confs ConfSet
 		savedir := ""
 
-		for path := range toanalyse {
-			select {
-			case <-ctx.Done():
+		var dicts dictionaries
+		if len(opts.Dictionaries) > 0 {
+			var err error
+			dicts, err = loadDictionaries(opts.Dictionaries)
+			if err != nil {
 				for range toanalyse {
 				} // consume the rest of the receiving channel so it isn't blocked
-				errc <- ctx.Err()
+				errc <- err
 				return
-			default:
 			}
-			if savedir == "" {
-				savedir = filepath.Dir(path)
+		}
+
+		var rules []postproc.Rule
+		if opts.TextRules != "" {
+			var err error
+			rules, err = postproc.LoadRules(opts.TextRules)
+			if err != nil {
+				for range toanalyse {
+				} // consume the rest of the receiving channel so it isn't blocked
+				errc <- err
+				return
 			}
-			logger.Println("Calculating confidence for", path)
-			avg, err := hocr.GetAvgConf(path)
-			if err != nil && err.Error() == "No words found" {
+		}
+
+		var err error
+		for r := range getHocrConfs(ctx, conn, opts.Bookname, toanalyse, opts.ConfWorkers, dicts, opts.LineConf, logger) {
+			// only the first error is reported, but the rest of the
+			// results are still read so that the workers aren't blocked
+			if err != nil || r.skip {
 				continue
 			}
+			if r.err != nil {
+				err = r.err
+				continue
+			}
+			if savedir == "" {
+				savedir = filepath.Dir(r.conf.Path)
+			}
+			confs.Add(r.page, r.conf, r.score)
+		}
+		if err != nil {
+			errc <- err
+			return
+		}
+
+		bookname := opts.Bookname
+		if bookname == "" {
+			bookname = filepath.Base(savedir)
+		}
+		// a book name can contain "/", so only the last part of it is
+		// used for the names of the files saved for it
+		filename := path.Base(bookname)
+
+		err = clearNeedsReview(conn, bookname)
+		if err != nil {
+			errc <- err
+			return
+		}
+
+		var reoriented []reorientation
+		if opts.ReorientConf > 0 {
+			logger.Println("Checking whether any pages with low confidence are upside down")
+			reoriented, err = reorientPages(ctx, conn, &confs, savedir, bookname, dicts, opts, logger)
+			if err != nil {
+				errc <- err
+				return
+			}
+			// the rotated images are uploaded straight away, so that
+			// they are available to download for the PDFs, but their
+			// hOCR is still needed, so is uploaded at the end
+			for _, r := range reoriented {
+				up <- r.img
+			}
+		}
+		rotated := make(map[string]bool)
+		for _, r := range reoriented {
+			rotated[filepath.Base(r.hocr)] = true
+		}
+
+		var tw *TarWriter
+		var tarfn string
+		if opts.Tar || opts.TarOnly {
+			tarfn = filepath.Join(savedir, TarName(filename, opts.TarGzip))
+			logger.Println("Creating archive", tarfn)
+			var err error
+			tw, err = NewTarWriter(tarfn, opts.TarGzip)
 			if err != nil {
-				for range toanalyse {
-				} // consume the rest of the receiving channel so it isn't blocked
-				errc <- fmt.Errorf("Error retrieving confidence for %s: %s", path, err)
+				errc <- err
 				return
 			}
-			base := filepath.Base(path)
-			codestart := strings.Index(base, "_bin")
-			name := base[0:codestart]
-			var c bookpipeline.Conf
-			c.Path = path
-			c.Code = base[codestart:]
-			c.Conf = avg
-			confs[name] = append(confs[name], &c)
+			defer tw.Close()
+		}
+		// saveResult adds a file to the archive if one is being
+		// created, and uploads it unless it is only to be saved in
+		// the archive
+		saveResult := func(fn string) error {
+			if tw != nil {
+				err := tw.AddFile(fn)
+				if err != nil {
+					return err
+				}
+			}
+			if !opts.TarOnly {
+				up <- fn
+			}
+			return nil
 		}
 
 		fn := filepath.Join(savedir, "conf")
@@ -386,22 +801,18 @@ func Analyse(conn Downloader, mkfullpdf bool) func(context.Context, chan string,
 		}
 
 		logger.Println("Finding best confidence for each page, and saving all confidences")
-		for base, conf := range confs {
-			var best float64
-			for _, c := range conf {
-				if c.Conf > best {
-					best = c.Conf
-					bestconfs[base] = c
-				}
-				_, err = fmt.Fprintf(f, "%s\t%02.f\n", c.Path, c.Conf)
-				if err != nil {
-					errc <- fmt.Errorf("Error writing confidences file: %s", err)
-					return
-				}
-			}
+		bestconfs := confs.Best()
+		err = confs.WriteConf(f)
+		if err != nil {
+			errc <- fmt.Errorf("Error writing confidences file: %s", err)
+			return
 		}
 		f.Close()
-		up <- fn
+		err = saveResult(fn)
+		if err != nil {
+			errc <- err
+			return
+		}
 
 		select {
 		case <-ctx.Done():
@@ -418,11 +829,17 @@ func Analyse(conn Downloader, mkfullpdf bool) func(context.Context, chan string,
 			return
 		}
 		defer f.Close()
-		for _, conf := range bestconfs {
-			_, err = fmt.Fprintf(f, "%s\n", filepath.Base(conf.Path))
+		err = confs.WriteBest(f)
+		if err != nil {
+			errc <- fmt.Errorf("Error writing best file: %s", err)
+			return
 		}
 		f.Close()
-		up <- fn
+		err = saveResult(fn)
+		if err != nil {
+			errc <- err
+			return
+		}
 
 		var pgs []string
 		for _, conf := range bestconfs {
@@ -430,6 +847,127 @@ func Analyse(conn Downloader, mkfullpdf bool) func(context.Context, chan string,
 		}
 		sort.Strings(pgs)
 
+		// the pages are put in the order given in the page order
+		// manifest, if one was saved when the book was uploaded,
+		// otherwise they stay in filename order
+		orderfn := filepath.Join(savedir, OrderFile)
+		err = conn.Download(conn.WIPStorageId(), filepath.Join(bookname, OrderFile), orderfn)
+		if err == nil {
+			var order PageOrder
+			order, err = ReadPageOrder(orderfn)
+			if err != nil {
+				errc <- err
+				return
+			}
+			logger.Println("Putting pages in the order given by", OrderFile)
+			order.Sort(pgs)
+		} else {
+			logger.Println("No page order found, using filename order:", err)
+		}
+
+		// any pages listed in the exclusions file, if one was saved,
+		// are left out of the PDFs and text, but their other files
+		// are kept
+		var excl PageExclusions
+		excludefn := filepath.Join(savedir, ExcludeFile)
+		err = conn.Download(conn.WIPStorageId(), filepath.Join(bookname, ExcludeFile), excludefn)
+		if err == nil {
+			excl, err = ReadPageExclusions(excludefn)
+			if err != nil {
+				errc <- err
+				return
+			}
+		}
+		pdfpgs := excl.Filter(pgs)
+		if len(pdfpgs) < len(pgs) {
+			logger.Printf("Leaving %d pages listed in %s out of the PDFs and text\n", len(pgs)-len(pdfpgs), ExcludeFile)
+		}
+
+		logger.Println("Saving the position of each word on the best version of each page")
+		fn = filepath.Join(savedir, "words.jsonl")
+		f, err = os.Create(fn)
+		if err != nil {
+			errc <- fmt.Errorf("Error creating file %s: %s", fn, err)
+			return
+		}
+		defer f.Close()
+		var pagewords []PageWords
+		for _, pg := range pgs {
+			img := HocrImage(filepath.Base(pg))
+			w, err := getPageWords(pg, img)
+			if err != nil {
+				errc <- err
+				return
+			}
+			pagewords = append(pagewords, w)
+		}
+		err = writeWordsJSONL(f, pagewords)
+		if err != nil {
+			errc <- fmt.Errorf("Error writing words file: %s", err)
+			return
+		}
+		f.Close()
+		err = saveResult(fn)
+		if err != nil {
+			errc <- err
+			return
+		}
+
+		logger.Println("Saving the size of the best version of each page")
+		fn = filepath.Join(savedir, PageSizesFile)
+		f, err = os.Create(fn)
+		if err != nil {
+			errc <- fmt.Errorf("Error creating file %s: %s", fn, err)
+			return
+		}
+		defer f.Close()
+		var bestnames []string
+		for _, pg := range pgs {
+			bestnames = append(bestnames, filepath.Base(pg))
+		}
+		err = writePageSizes(f, bestnames, pagewords)
+		if err != nil {
+			errc <- fmt.Errorf("Error writing page sizes file: %s", err)
+			return
+		}
+		f.Close()
+		err = saveResult(fn)
+		if err != nil {
+			errc <- err
+			return
+		}
+
+		if tw != nil {
+			logger.Println("Adding the best hOCR and text of each page to the archive")
+			for _, pg := range pgs {
+				err = tw.AddFile(pg)
+				if err != nil {
+					errc <- err
+					return
+				}
+				if excl.Excluded(pg) {
+					continue
+				}
+				text, err := hocr.GetText(pg)
+				if err != nil {
+					errc <- fmt.Errorf("Error getting text from %s: %v", pg, err)
+					return
+				}
+				text = postproc.ApplyRules(text, rules)
+				err = tw.Add(strings.TrimSuffix(filepath.Base(pg), ".hocr")+".txt", []byte(text))
+				if err != nil {
+					errc <- err
+					return
+				}
+			}
+			err = tw.Close()
+			if err != nil {
+				errc <- err
+				return
+			}
+			up <- tarfn
+		}
+
 		select {
 		case <-ctx.Done():
 			errc <- ctx.Err()
@@ -437,24 +975,76 @@ func Analyse(conn Downloader, mkfullpdf bool) func(context.Context, chan string,
 		default:
 		}
 
-		logger.Println("Downloading binarised and original images to create PDFs")
-		bookname, err := filepath.Rel(os.TempDir(), savedir)
+		// the graph is created before the PDFs so that it can be added
+		// to them, but it is only uploaded at the end, along with the
+		// done marker
+		logger.Println("Creating graph")
+		graphfn := filepath.Join(savedir, "graph.png")
+		f, err = os.Create(graphfn)
 		if err != nil {
-			errc <- fmt.Errorf("Failed to do filepath.Rel of %s to %s: %s", os.TempDir(), savedir, err)
+			errc <- fmt.Errorf("Error creating file %s: %s", graphfn, err)
 			return
 		}
-		colourpdf := new(bookpipeline.Fpdf)
+		defer f.Close()
+		graphopts := bookpipeline.GraphOptions{
+			XAxis:      "Page number",
+			Guidelines: true,
+			LabelBelow: opts.GraphLabelBelow,
+			MaxLabels:  opts.GraphMaxLabels,
+		}
+		err = bookpipeline.GraphWithOptions(bestconfs, bookname, graphopts, f)
+		f.Close()
+		if err != nil {
+			// a graph can't be rendered for some books, such as those
+			// with a single page, so continue without one
+			logger.Println("Error rendering graph, continuing without it:", err)
+			_ = os.Remove(graphfn)
+			graphfn = ""
+		}
+
+		select {
+		case <-ctx.Done():
+			errc <- ctx.Err()
+			return
+		default:
+		}
+
+		// addReport adds the report pages to a PDF if requested
+		summary := bookpipeline.ConfSummary(bestconfs)
+		addReport := func(pdf *bookpipeline.SplitPdf) error {
+			if !opts.AppendReport {
+				return nil
+			}
+			return pdf.AddReport(graphfn, summary)
+		}
+
+		// the DPI of the pages is only known if it was recorded when
+		// the book was uploaded, otherwise the default page size is used
+		var dpis DPIs
+		dpifn := filepath.Join(savedir, DPIFile)
+		err = conn.Download(conn.WIPStorageId(), filepath.Join(bookname, DPIFile), dpifn)
+		if err == nil {
+			dpis, err = ReadDPIs(dpifn)
+		}
+		if err != nil {
+			logger.Println("No DPI found, using the default page size:", err)
+		}
+
+		logger.Println("Downloading binarised and original images to create PDFs")
+		colourpdf := &bookpipeline.SplitPdf{MaxPages: opts.SplitPages, MaxBytes: opts.SplitBytes, MinTextConf: opts.MinTextConf, ScaleHocr: opts.ScaleHocr, PageDPI: dpis.Page, Stream: opts.StreamPdf, TempDir: savedir, ColumnOrder: opts.ColumnOrder}
 		err = colourpdf.Setup()
 		if err != nil {
 			errc <- fmt.Errorf("Failed to set up PDF: %s", err)
 			return
 		}
-		binarisedpdf := new(bookpipeline.Fpdf)
+		defer colourpdf.Close()
+		binarisedpdf := &bookpipeline.SplitPdf{MaxPages: opts.SplitPages, MaxBytes: opts.SplitBytes, MinTextConf: opts.MinTextConf, PageDPI: dpis.Page, Stream: opts.StreamPdf, TempDir: savedir, ColumnOrder: opts.ColumnOrder}
 		err = binarisedpdf.Setup()
 		if err != nil {
 			errc <- fmt.Errorf("Failed to set up PDF: %s", err)
 			return
 		}
+		defer binarisedpdf.Close()
 		binhascontent, colourhascontent := false, false
 
 		select {
@@ -466,9 +1056,9 @@ func Analyse(conn Downloader, mkfullpdf bool) func(context.Context, chan string,
 
 		var colourimgs, binimgs []pageimg
 
-		for _, pg := range pgs {
+		for _, pg := range pdfpgs {
 			base := filepath.Base(pg)
-			nosuffix := strings.TrimSuffix(base, ".hocr")
+			nosuffix := strings.TrimSuffix(HocrImage(base), ".png")
 			p := strings.SplitN(base, "_bin", 2)
 
 			var fn string
@@ -479,7 +1069,7 @@ func Analyse(conn Downloader, mkfullpdf bool) func(context.Context, chan string,
 			}
 
 			binimgs = append(binimgs, pageimg{hocr: base, img: nosuffix + ".png"})
-			colourimgs = append(colourimgs, pageimg{hocr: base, img: fn})
+			colourimgs = append(colourimgs, pageimg{hocr: base, img: fn, rotate: rotated[base]})
 		}
 
 		for _, pg := range binimgs {
@@ -490,10 +1080,10 @@ func Analyse(conn Downloader, mkfullpdf bool) func(context.Context, chan string,
 			default:
 			}
 
-			logger.Println("Downloading binarised page to add to PDF", pg.img)
+			logger.Println(bookpipeline.DebugTag+"Downloading binarised page to add to PDF", pg.img)
 			err := conn.Download(conn.WIPStorageId(), bookname+"/"+pg.img, filepath.Join(savedir, pg.img))
 			if err != nil {
-				logger.Println("Download failed; skipping page", pg.img)
+				logger.Println(bookpipeline.WarnTag+"Download failed; skipping page", pg.img)
 			} else {
 				err = binarisedpdf.AddPage(filepath.Join(savedir, pg.img), filepath.Join(savedir, pg.hocr), true)
 				if err != nil {
@@ -517,13 +1107,20 @@ func Analyse(conn Downloader, mkfullpdf bool) func(context.Context, chan string,
 		}
 
 		if binhascontent {
-			fn = filepath.Join(savedir, bookname+".binarised.pdf")
+			err = addReport(binarisedpdf)
+			if err != nil {
+				errc <- fmt.Errorf("Failed to add report to binarised pdf: %s", err)
+				return
+			}
+			fn = filepath.Join(savedir, filename+".binarised.pdf")
 			err = binarisedpdf.Save(fn)
 			if err != nil {
 				errc <- fmt.Errorf("Failed to save binarised pdf: %s", err)
 				return
 			}
-			up <- fn
+			for _, fn := range binarisedpdf.SavedPaths() {
+				up <- fn
+			}
 		}
 
 		for _, pg := range colourimgs {
@@ -534,7 +1131,7 @@ func Analyse(conn Downloader, mkfullpdf bool) func(context.Context, chan string,
 			default:
 			}
 
-			logger.Println("Downloading colour page to add to PDF", pg.img)
+			logger.Println(bookpipeline.DebugTag+"Downloading colour page to add to PDF", pg.img)
 			colourfn := pg.img
 			err = conn.Download(conn.WIPStorageId(), bookname+"/"+colourfn, filepath.Join(savedir, colourfn))
 			if err != nil {
@@ -542,7 +1139,14 @@ func Analyse(conn Downloader, mkfullpdf bool) func(context.Context, chan string,
 				logger.Println("Download failed; trying", colourfn)
 				err = conn.Download(conn.WIPStorageId(), bookname+"/"+colourfn, filepath.Join(savedir, colourfn))
 				if err != nil {
-					logger.Println("Download failed; skipping page", pg.img)
+					logger.Println(bookpipeline.WarnTag+"Download failed; skipping page", pg.img)
+				}
+			}
+			if err == nil && pg.rotate {
+				err = RotateImage(filepath.Join(savedir, colourfn), 180)
+				if err != nil {
+					errc <- fmt.Errorf("Failed to rotate %s: %s", colourfn, err)
+					return
 				}
 			}
 			if err == nil {
@@ -568,22 +1172,30 @@ func Analyse(conn Downloader, mkfullpdf bool) func(context.Context, chan string,
 		}
 
 		if colourhascontent {
-			fn = filepath.Join(savedir, bookname+".colour.pdf")
+			err = addReport(colourpdf)
+			if err != nil {
+				errc <- fmt.Errorf("Failed to add report to colour pdf: %s", err)
+				return
+			}
+			fn = filepath.Join(savedir, filename+".colour.pdf")
 			err = colourpdf.Save(fn)
 			if err != nil {
 				errc <- fmt.Errorf("Failed to save colour pdf: %s", err)
 				return
 			}
-			up <- fn
+			for _, fn := range colourpdf.SavedPaths() {
+				up <- fn
+			}
 		}
 
-		if mkfullpdf {
-			fullsizepdf := new(bookpipeline.Fpdf)
+		if opts.MkFullPdf {
+			fullsizepdf := &bookpipeline.SplitPdf{MaxPages: opts.SplitPages, MaxBytes: opts.SplitBytes, MinTextConf: opts.MinTextConf, ScaleHocr: opts.ScaleHocr, PageDPI: dpis.Page, Stream: opts.StreamPdf, TempDir: savedir, ColumnOrder: opts.ColumnOrder}
 			err = fullsizepdf.Setup()
 			if err != nil {
 				errc <- fmt.Errorf("Failed to set up PDF: %s", err)
 				return
 			}
+			defer fullsizepdf.Close()
 			for _, pg := range colourimgs {
 				select {
 				case <-ctx.Done():
@@ -592,7 +1204,7 @@ func Analyse(conn Downloader, mkfullpdf bool) func(context.Context, chan string,
 				default:
 				}
 
-				logger.Println("Downloading colour page to add to PDF", pg.img)
+				logger.Println(bookpipeline.DebugTag+"Downloading colour page to add to PDF", pg.img)
 				colourfn := pg.img
 				err = conn.Download(conn.WIPStorageId(), bookname+"/"+colourfn, filepath.Join(savedir, colourfn))
 				if err != nil {
@@ -600,7 +1212,14 @@ func Analyse(conn Downloader, mkfullpdf bool) func(context.Context, chan string,
 					logger.Println("Download failed; trying", colourfn)
 					err = conn.Download(conn.WIPStorageId(), bookname+"/"+colourfn, filepath.Join(savedir, colourfn))
 					if err != nil {
-						logger.Println("Download failed; skipping page", pg.img)
+						logger.Println(bookpipeline.WarnTag+"Download failed; skipping page", pg.img)
+					}
+				}
+				if err == nil && pg.rotate {
+					err = RotateImage(filepath.Join(savedir, colourfn), 180)
+					if err != nil {
+						errc <- fmt.Errorf("Failed to rotate %s: %s", colourfn, err)
+						return
 					}
 				}
 				if err == nil {
@@ -625,13 +1244,20 @@ func Analyse(conn Downloader, mkfullpdf bool) func(context.Context, chan string,
 			}
 
 			if colourhascontent {
-				fn = filepath.Join(savedir, bookname+".original.pdf")
+				err = addReport(fullsizepdf)
+				if err != nil {
+					errc <- fmt.Errorf("Failed to add report to full size pdf: %s", err)
+					return
+				}
+				fn = filepath.Join(savedir, filename+".original.pdf")
 				err = fullsizepdf.Save(fn)
 				if err != nil {
 					errc <- fmt.Errorf("Failed to save full size pdf: %s", err)
 					return
 				}
-				up <- fn
+				for _, fn := range fullsizepdf.SavedPaths() {
+					up <- fn
+				}
 			}
 		}
 
@@ -642,54 +1268,127 @@ func Analyse(conn Downloader, mkfullpdf bool) func(context.Context, chan string,
 		default:
 		}
 
-		logger.Println("Creating graph")
-		fn = filepath.Join(savedir, "graph.png")
-		f, err = os.Create(fn)
-		if err != nil {
-			errc <- fmt.Errorf("Error creating file %s: %s", fn, err)
-			return
-		}
-		defer f.Close()
-		err = bookpipeline.Graph(bestconfs, filepath.Base(savedir), f)
-		if err != nil {
-			_ = os.Remove(fn)
+		if opts.MinBookConf > 0 {
+			conf := meanConf(bestconfs)
+			if conf < opts.MinBookConf {
+				logger.Printf("Average confidence %.2f is below %.2f, marking book as needing review\n", conf, opts.MinBookConf)
+				fn = filepath.Join(savedir, NeedsReviewFile)
+				f, err = os.Create(fn)
+				if err != nil {
+					errc <- fmt.Errorf("Error creating file %s: %s", fn, err)
+					return
+				}
+				defer f.Close()
+				err = writeNeedsReview(f, conf, opts.MinBookConf)
+				if err != nil {
+					errc <- fmt.Errorf("Error writing needs review file: %s", err)
+					return
+				}
+				f.Close()
+				up <- fn
+			}
 		}
-		if err != nil && err.Error() != "Not enough valid confidences" {
-			errc <- fmt.Errorf("Error rendering graph: %s", err)
-			return
+
+		if len(reoriented) > 0 {
+			fn = filepath.Join(savedir, ReorientedFile)
+			f, err = os.Create(fn)
+			if err != nil {
+				errc <- fmt.Errorf("Error creating file %s: %s", fn, err)
+				return
+			}
+			defer f.Close()
+			err = writeReoriented(f, reoriented)
+			if err != nil {
+				errc <- fmt.Errorf("Error writing reoriented file: %s", err)
+				return
+			}
+			f.Close()
+			up <- fn
+			for _, r := range reoriented {
+				up <- r.hocr
+			}
 		}
 
-		select {
-		case <-ctx.Done():
-			errc <- ctx.Err()
-			return
-		default:
+		if graphfn != "" {
+			up <- graphfn
 		}
 
-		if err == nil {
-			up <- fn
+		// the done marker is uploaded last, so that a book is only
+		// considered done once all of its results are saved, whether
+		// or not it has a graph
+		fn = filepath.Join(savedir, DoneFile)
+		f, err = os.Create(fn)
+		if err != nil {
+			errc <- fmt.Errorf("Error creating file %s: %s", fn, err)
+			return
 		}
+		f.Close()
+		up <- fn
 
 		close(up)
 	}
 }
 
-func heartbeat(conn Queuer, t *time.Ticker, msg bookpipeline.Qmsg, queue string, msgc chan bookpipeline.Qmsg, errc chan error) {
+const heartbeatRetries = 3
+
+// these can be overridden in tests
+var (
+	now               = time.Now
+	downloadRetryWait = 2 * time.Second
+	ocrFor            = OcrWithOptions
+	preprocMultiFor   = preprocMulti
+)
+
+// heartbeatClock is the source of the current time used by heartbeat,
+// and how long it waits before retrying a failed extension, so that
+// tests can control them.
+type heartbeatClock struct {
+	now       func() time.Time
+	retryWait time.Duration
+}
+
+var systemClock = heartbeatClock{now: time.Now, retryWait: 5 * time.Second}
+
+// heartbeat keeps a message hidden on its queue while it is being
+// processed, by extending its visibility timeout each time a tick is
+// received on c. Rather than assuming the ticks arrive regularly, the
+// timeout is based on the time elapsed since the last successful
+// extension, so that if a tick is delayed (for example because the
+// process was paused) the next extension gives correspondingly more
+// leeway. If an extension fails it is retried a few times while the
+// message should still be hidden, and if it still fails the error is
+// sent to hberr, which should be buffered, and heartbeat returns.
+func heartbeat(conn Queuer, c <-chan time.Time, clock heartbeatClock, msg bookpipeline.Qmsg, queue string, msgc chan bookpipeline.Qmsg, hberr chan<- error) {
+	const interval = HeartbeatSeconds * time.Second
+	const maxTimeout = HeartbeatSeconds * 15 * time.Second
 	currentmsg := msg
-	for range t.C {
-		m, err := conn.QueueHeartbeat(currentmsg, queue, HeartbeatSeconds*2)
+	last := clock.now()
+	visible := 2 * interval
+	for tick := range c {
+		elapsed := tick.Sub(last)
+		if elapsed > visible {
+			conn.Log("Warning: heartbeat was delayed by", elapsed, "so the message may have been visible on the queue")
+		}
+		timeout := 2 * interval
+		if elapsed+interval > timeout {
+			timeout = elapsed + interval
+		}
+		if timeout > maxTimeout {
+			timeout = maxTimeout
+		}
+		m, err := conn.QueueHeartbeat(currentmsg, queue, int64(timeout/time.Second))
+		for i := 0; err != nil && i < heartbeatRetries && clock.now().Sub(last) < visible; i++ {
+			conn.Log("Error with heartbeat, retrying", err)
+			time.Sleep(clock.retryWait)
+			m, err = conn.QueueHeartbeat(currentmsg, queue, int64(timeout/time.Second))
+		}
 		if err != nil {
-			// This is for better debugging of the heartbeat issue
 			conn.Log("Error with heartbeat", err)
-			os.Exit(1)
-			// TODO: would be better to ensure this error stops any running
-			//       processes, as they will ultimately fail in the case of
-			//       it. could do this by setting a global variable that
-			//       processes check each time they loop.
-			errc <- err
-			t.Stop()
+			hberr <- fmt.Errorf("Error with heartbeat, message may now be visible on the queue: %v", err)
 			return
 		}
+		last = tick
+		visible = timeout
 		if m.Id != "" {
 			conn.Log("Replaced message handle as visibilitytimeout limit was reached")
 			currentmsg = m
@@ -701,44 +1400,117 @@ func heartbeat(conn Queuer, t *time.Ticker, msg bookpipeline.Qmsg, queue string,
 	}
 }
 
-// allOCRed checks whether all pages of a book have been OCRed.
-// This is determined by whether every _bin0.?.png file has a
-// corresponding .hocr file.
-func allOCRed(bookname string, conn Lister) bool {
+// requeue makes a message visible on its queue again straight away,
+// so that another process can pick it up without waiting for the
+// visibility timeout to expire. This is used when processing has been
+// interrupted, for example because the process is shutting down.
+func requeue(conn Queuer, msg bookpipeline.Qmsg, msgc chan bookpipeline.Qmsg, queue string) {
+	// check whether we're using a newer msg handle
+	select {
+	case m, ok := <-msgc:
+		if ok {
+			msg = m
+		}
+	default:
+	}
+
+	conn.Log("Making message visible on queue again", queue)
+	_, err := conn.QueueHeartbeat(msg, queue, 0)
+	if err != nil {
+		conn.Log("Error making message visible on queue again", err)
+	}
+}
+
+// hasPsmHocrs returns whether there is an hOCR for a preprocessed
+// page image for each of the page segmentation modes psms, among the
+// hOCR files listed in hocrs. The hOCRs for each mode are uploaded one
+// at a time, so a page OCRed with several modes is only complete once
+// they all are.
+func hasPsmHocrs(page string, hocrs map[string]bool, psms []int) bool {
+	for _, psm := range psms {
+		if !hocrs[fmt.Sprintf("%s_psm%d.hocr", strings.TrimSuffix(page, ".png"), psm)] {
+			return false
+		}
+	}
+	return true
+}
+
+// pagesMissingHocr returns the preprocessed page images of a book
+// which have no corresponding .hocr file, or which are missing the
+// .hocr file for any of the page segmentation modes psms, along with
+// the total number of preprocessed page images.
+func pagesMissingHocr(bookname string, conn Lister, psms []int) ([]string, int, error) {
 	objs, err := conn.ListObjects(conn.WIPStorageId(), bookname)
 	if err != nil {
-		return false
+		return nil, 0, err
 	}
 
 	preprocessedPattern := regexp.MustCompile(`_bin[0-9].[0-9].png$`)
 
-	atleastone := false
+	ocred := make(map[string]bool)
+	hocrs := make(map[string]bool)
+	for _, o := range objs {
+		if strings.HasSuffix(o, ".hocr") {
+			ocred[HocrImage(o)] = true
+			hocrs[o] = true
+		}
+	}
+
+	var missing []string
+	var total int
 	for _, png := range objs {
 		if preprocessedPattern.MatchString(png) {
-			atleastone = true
-			found := false
-			hocrname := strings.TrimSuffix(png, ".png") + ".hocr"
-			for _, hocr := range objs {
-				if hocr == hocrname {
-					found = true
-					break
-				}
-			}
-			if found == false {
-				return false
+			total++
+			if !ocred[png] || !hasPsmHocrs(png, hocrs, psms) {
+				missing = append(missing, png)
 			}
 		}
 	}
-	if atleastone == false {
-		return false
+	sort.Strings(missing)
+	return missing, total, nil
+}
+
+// VerifyPagesComplete returns the preprocessed page images of a book
+// which lack any hOCR, or which lack the hOCR for any of the page
+// segmentation modes psms, so that a book is only analysed once every
+// page has been OCRed. An error is returned if the book has no
+// preprocessed pages at all.
+func VerifyPagesComplete(conn Lister, bookname string, psms []int) ([]string, error) {
+	missing, total, err := pagesMissingHocr(bookname, conn, psms)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing pages of %s: %v", bookname, err)
 	}
-	return true
+	if total == 0 {
+		return nil, fmt.Errorf("No preprocessed pages found for %s", bookname)
+	}
+	return missing, nil
+}
+
+// bookDir creates a directory named after a book to process it in,
+// inside a new temporary directory, so that several jobs for the
+// same book can run at once without interfering with each other.
+// The temporary directory, which should be removed once processing
+// is finished, is returned along with the book directory.
+func bookDir(bookname string) (string, string, error) {
+	tmp, err := MkTempDir("bookpipeline")
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to create temporary directory: %s", err)
+	}
+	d := filepath.Join(tmp, bookname)
+	err = os.MkdirAll(d, 0755)
+	if err != nil {
+		_ = os.RemoveAll(tmp)
+		return "", "", fmt.Errorf("Failed to create directory %s: %s", d, err)
+	}
+	return tmp, d, nil
 }
 
 // OcrPage OCRs a page based on a message. It may make sense to
 // roll this back into processBook (on which it is based) once
-// working well.
-func OcrPage(ctx context.Context, msg bookpipeline.Qmsg, conn Pipeliner, process func(context.Context, chan string, chan string, chan error, *log.Logger), fromQueue string, toQueue string) error {
+// working well. If the message or the book's training manifest sets
+// a training for the page, process is replaced with OCR using that
+// training and opts.
+func OcrPage(ctx context.Context, msg bookpipeline.Qmsg, conn Pipeliner, process func(context.Context, chan string, chan string, chan error, *log.Logger), opts OcrOptions, fromQueue string, toQueue string) error {
 	dl := make(chan string)
 	msgc := make(chan bookpipeline.Qmsg)
 	processc := make(chan string)
@@ -746,49 +1518,103 @@ func OcrPage(ctx context.Context, msg bookpipeline.Qmsg, conn Pipeliner, process
 	done := make(chan bool)
 	errc := make(chan error)
 
-	msgparts := strings.Split(msg.Body, " ")
-	bookname := filepath.Dir(msgparts[0])
-	if len(msgparts) > 1 && msgparts[1] != "" {
-		process = Ocr(msgparts[1], "")
+	// whether the book has been cancelled isn't checked for each
+	// page, as that would mean listing storage for every page, so
+	// any pages of a cancelled book which are already being OCRed
+	// are finished, and the book is then dropped once it reaches
+	// the analyse queue
+	job := ParsePageMessage(msg.Body)
+	bookname := job.Bookname
+	if job.Training != "" {
+		process = ocrFor(job.Training, "", opts)
 	}
 
-	d := filepath.Join(os.TempDir(), bookname)
-	err := os.MkdirAll(d, 0755)
+	// a training set for the page in the book's training manifest
+	// overrides the training for the book
+	manifest, err := GetTrainingManifest(conn, bookname)
 	if err != nil {
-		return fmt.Errorf("Failed to create directory %s: %s", d, err)
+		conn.Log("Error getting training manifest, using the training for the book", err)
+	} else if pg, ok := pageNumber(job.Page); ok {
+		if training := manifest.Training(pg); training != "" {
+			conn.Log("Using training", training, "from training manifest for", job.Page)
+			process = ocrFor(training, "", opts)
+		}
 	}
 
+	tmp, d, err := bookDir(bookname)
+	if err != nil {
+		return err
+	}
+
+	// processing is stopped if the heartbeat fails, as the message may
+	// then be picked up by another process
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	hberr := make(chan error, 1)
 	t := time.NewTicker(HeartbeatSeconds * time.Second)
-	go heartbeat(conn, t, msg, fromQueue, msgc, errc)
+	go heartbeat(conn, t.C, systemClock, msg, fromQueue, msgc, hberr)
 
 	// these functions will do their jobs when their channels have data
 	go download(ctx, dl, processc, conn, d, errc, conn.GetLogger())
 	go process(ctx, processc, upc, errc, conn.GetLogger())
 	go up(ctx, upc, done, conn, bookname, errc, conn.GetLogger())
 
-	dl <- msgparts[0]
+	dl <- job.Page
 	close(dl)
 
 	// wait for either the done or errc channels to be sent to
 	select {
 	case err = <-errc:
 		t.Stop()
-		_ = os.RemoveAll(d)
+		_ = os.RemoveAll(tmp)
+		if ctx.Err() != nil {
+			requeue(conn, msg, msgc, fromQueue)
+		}
+		return err
+	case err = <-hberr:
+		// the message is left on the queue, rather than deleted, so
+		// that it will be processed again once it becomes visible
+		cancel()
+		t.Stop()
+		_ = os.RemoveAll(tmp)
 		return err
 	case <-ctx.Done():
 		t.Stop()
-		_ = os.RemoveAll(d)
+		_ = os.RemoveAll(tmp)
+		requeue(conn, msg, msgc, fromQueue)
 		return ctx.Err()
 	case <-done:
 	}
 
-	if allOCRed(bookname, conn) && toQueue != "" {
-		conn.Log("Sending", bookname, "to queue", toQueue)
-		err = conn.AddToQueue(toQueue, bookname)
+	// as each page is a separate job, the book is only listed to find
+	// its progress if it hasn't been recently, or if it may be
+	// complete, and the progress is only uploaded if it hasn't been
+	// recently, unless the book is complete
+	ocred, total, err := ocrPages.progress(conn, bookname, job.Page, opts.Psms)
+	if err != nil {
+		conn.Log("Error getting OCR progress", err)
+	} else if ocrPageProgress.due(bookname, ocred == total) {
+		err2 := UploadProgress(conn, bookname, Progress{Stage: stageName(conn, fromQueue), Done: ocred, Total: total})
+		if err2 != nil {
+			conn.Log("Error saving progress", err2)
+		}
+	}
+
+	if err == nil && total > 0 && ocred == total && toQueue != "" {
+		missing, err := VerifyPagesComplete(conn, bookname, opts.Psms)
 		if err != nil {
-			t.Stop()
-			_ = os.RemoveAll(d)
-			return fmt.Errorf("Error adding to queue %s: %s", bookname, err)
+			conn.Log("Error verifying all pages are OCRed", err)
+		} else if len(missing) > 0 {
+			conn.Log("Not sending", bookname, "to queue", toQueue, "as pages are missing hOCR:", missing)
+		}
+		if err == nil && len(missing) == 0 {
+			conn.Log("Sending", bookname, "to queue", toQueue)
+			err = conn.AddToQueue(toQueue, bookname)
+			if err != nil {
+				t.Stop()
+				_ = os.RemoveAll(tmp)
+				return fmt.Errorf("Error adding to queue %s: %s", bookname, err)
+			}
 		}
 	}
 
@@ -808,13 +1634,13 @@ func OcrPage(ctx context.Context, msg bookpipeline.Qmsg, conn Pipeliner, process
 	conn.Log("Deleting original message from queue", fromQueue)
 	err = conn.DelFromQueue(fromQueue, msg.Handle)
 	if err != nil {
-		_ = os.RemoveAll(d)
+		_ = os.RemoveAll(tmp)
 		return fmt.Errorf("Error deleting message from queue: %s", err)
 	}
 
-	err = os.RemoveAll(d)
+	err = os.RemoveAll(tmp)
 	if err != nil {
-		return fmt.Errorf("Failed to remove directory %s: %s", d, err)
+		return fmt.Errorf("Failed to remove directory %s: %s", tmp, err)
 	}
 
 	return nil
@@ -823,33 +1649,38 @@ func OcrPage(ctx context.Context, msg bookpipeline.Qmsg, conn Pipeliner, process
 func ProcessBook(ctx context.Context, msg bookpipeline.Qmsg, conn Pipeliner, process func(context.Context, chan string, chan string, chan error, *log.Logger), match *regexp.Regexp, fromQueue string, toQueue string) error {
 	dl := make(chan string)
 	msgc := make(chan bookpipeline.Qmsg)
+	countc := make(chan string)
 	processc := make(chan string)
 	upc := make(chan string)
 	done := make(chan bool)
 	errc := make(chan error)
 
-	msgparts := strings.Split(msg.Body, " ")
-	bookname := msgparts[0]
-
-	var training string
-	if len(msgparts) > 1 {
-		training = msgparts[1]
+	cancelled, err := dropIfCancelled(conn, msg, fromQueue)
+	if err != nil || cancelled {
+		return err
 	}
 
-	d := filepath.Join(os.TempDir(), bookname)
-	err := os.MkdirAll(d, 0755)
+	job := ParseJobMessage(msg.Body)
+	bookname := job.Bookname
+
+	tmp, d, err := bookDir(bookname)
 	if err != nil {
-		return fmt.Errorf("Failed to create directory %s: %s", d, err)
+		return err
 	}
 
+	// processing is stopped if the heartbeat fails, as the message may
+	// then be picked up by another process
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	hberr := make(chan error, 1)
 	t := time.NewTicker(HeartbeatSeconds * time.Second)
-	go heartbeat(conn, t, msg, fromQueue, msgc, errc)
+	go heartbeat(conn, t.C, systemClock, msg, fromQueue, msgc, hberr)
 
 	// these functions will do their jobs when their channels have data
-	go download(ctx, dl, processc, conn, d, errc, conn.GetLogger())
+	go download(ctx, dl, countc, conn, d, errc, conn.GetLogger())
 	go process(ctx, processc, upc, errc, conn.GetLogger())
 	if toQueue == conn.OCRPageQueueId() {
-		go upAndQueue(ctx, upc, done, toQueue, conn, bookname, training, errc, conn.GetLogger())
+		go upAndQueue(ctx, upc, done, toQueue, conn, bookname, job, errc, conn.GetLogger())
 	} else {
 		go up(ctx, upc, done, conn, bookname, errc, conn.GetLogger())
 	}
@@ -858,7 +1689,7 @@ func ProcessBook(ctx context.Context, msg bookpipeline.Qmsg, conn Pipeliner, pro
 	objs, err := conn.ListObjects(conn.WIPStorageId(), bookname)
 	if err != nil {
 		t.Stop()
-		_ = os.RemoveAll(d)
+		_ = os.RemoveAll(tmp)
 		return fmt.Errorf("Failed to get list of files for book %s: %s", bookname, err)
 	}
 	var todl []string
@@ -869,6 +1700,8 @@ func ProcessBook(ctx context.Context, msg bookpipeline.Qmsg, conn Pipeliner, pro
 		}
 		todl = append(todl, n)
 	}
+	stage := stageName(conn, fromQueue)
+	go countProgress(countc, processc, conn, bookname, stage, countPages(todl))
 	for _, a := range todl {
 		dl <- a
 	}
@@ -878,7 +1711,13 @@ func ProcessBook(ctx context.Context, msg bookpipeline.Qmsg, conn Pipeliner, pro
 	select {
 	case err = <-errc:
 		t.Stop()
-		_ = os.RemoveAll(d)
+		_ = os.RemoveAll(tmp)
+		// if the error is due to the context being cancelled, the book
+		// should be left for another process to pick up
+		if ctx.Err() != nil {
+			requeue(conn, msg, msgc, fromQueue)
+			return err
+		}
 		// if the error is in preprocessing / wipeonly, chances are that it will never
 		// complete, and will fill the ocrpage queue with parts which succeeded
 		// on each run, so in that case it's better to delete the message from
@@ -912,19 +1751,32 @@ func ProcessBook(ctx context.Context, msg bookpipeline.Qmsg, conn Pipeliner, pro
 			}
 		}
 		return err
+	case err = <-hberr:
+		// the message is left on the queue, rather than deleted, so
+		// that it will be processed again once it becomes visible
+		cancel()
+		t.Stop()
+		_ = os.RemoveAll(tmp)
+		return err
 	case <-ctx.Done():
 		t.Stop()
-		_ = os.RemoveAll(d)
+		_ = os.RemoveAll(tmp)
+		requeue(conn, msg, msgc, fromQueue)
 		return ctx.Err()
 	case <-done:
 	}
 
+	err = UploadProgress(conn, bookname, Progress{Stage: stage, Done: countPages(todl), Total: countPages(todl)})
+	if err != nil {
+		conn.Log("Error saving progress", err)
+	}
+
 	if toQueue != "" && toQueue != conn.OCRPageQueueId() {
 		conn.Log("Sending", bookname, "to queue", toQueue)
 		err = conn.AddToQueue(toQueue, bookname)
 		if err != nil {
 			t.Stop()
-			_ = os.RemoveAll(d)
+			_ = os.RemoveAll(tmp)
 			return fmt.Errorf("Error adding to queue %s: %s", bookname, err)
 		}
 	}
@@ -945,18 +1797,31 @@ func ProcessBook(ctx context.Context, msg bookpipeline.Qmsg, conn Pipeliner, pro
 	conn.Log("Deleting original message from queue", fromQueue)
 	err = conn.DelFromQueue(fromQueue, msg.Handle)
 	if err != nil {
-		_ = os.RemoveAll(d)
+		_ = os.RemoveAll(tmp)
 		return fmt.Errorf("Error deleting message from queue: %s", err)
 	}
 
-	err = os.RemoveAll(d)
+	err = os.RemoveAll(tmp)
 	if err != nil {
-		return fmt.Errorf("Failed to remove directory %s: %s", d, err)
+		return fmt.Errorf("Failed to remove directory %s: %s", tmp, err)
 	}
 
 	return nil
 }
 
+// Echo handles a message from the test queue, by just logging its
+// body and deleting it from the queue. This does no real work, but
+// enables the queue handling to be tested end-to-end without needing
+// to do any OCR.
+func Echo(msg bookpipeline.Qmsg, conn Queuer, queue string) error {
+	conn.Log("Echo:", msg.Body)
+	err := conn.DelFromQueue(queue, msg.Handle)
+	if err != nil {
+		return fmt.Errorf("Error deleting message from queue: %s", err)
+	}
+	return nil
+}
+
 // TODO: rather than relying on journald, would be nicer to save the logs
 //       ourselves maybe, so that we weren't relying on a particular systemd
 //       setup. this can be done by having the conn.Log also append line
@@ -982,7 +1847,7 @@ func SaveLogs(conn Uploader, starttime int64, hostname string) error {
 		return fmt.Errorf("Error getting logs, error: %v", err)
 	}
 	key := fmt.Sprintf("bookpipeline.log.%d.%s", starttime, hostname)
-	path := filepath.Join(os.TempDir(), key)
+	path := filepath.Join(TempDir(), key)
 	f, err := os.Create(path)
 	if err != nil {
 		return fmt.Errorf("Error creating log file: %v", err)
@@ -6,15 +6,23 @@ package pipeline
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
 	"rescribe.xyz/bookpipeline"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unicode/utf8"
 )
 
 // StrLog is a simple logger that saves to a string,
@@ -28,6 +36,25 @@ func (t *StrLog) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
+// newTestConn returns an initialised LocalConn which logs to vlog
+// and keeps its files in a new temporary directory, which is removed
+// when the test finishes
+func newTestConn(t *testing.T, vlog *log.Logger) *bookpipeline.LocalConn {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "bookpipelinetest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	conn := &bookpipeline.LocalConn{Logger: vlog, TempDir: dir}
+	err = conn.Init()
+	if err != nil {
+		t.Fatalf("Could not initialise connection: %v", err)
+	}
+	return conn
+}
+
 type PipelineTester interface {
 	Pipeliner
 	TestInit() error
@@ -40,6 +67,77 @@ type connection struct {
 	c    PipelineTester
 }
 
+// fakeConn is a LocalConn which records changes to message
+// visibility and deletions from queues, so they can be checked. The
+// first hbfail heartbeats will fail.
+type fakeConn struct {
+	*bookpipeline.LocalConn
+	mu         sync.Mutex
+	heartbeats []int64
+	deleted    []string
+	hbfail     int
+}
+
+func (f *fakeConn) QueueHeartbeat(msg bookpipeline.Qmsg, qurl string, duration int64) (bookpipeline.Qmsg, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.heartbeats = append(f.heartbeats, duration)
+	if f.hbfail > 0 {
+		f.hbfail--
+		return bookpipeline.Qmsg{}, fmt.Errorf("heartbeat failed")
+	}
+	return bookpipeline.Qmsg{}, nil
+}
+
+func (f *fakeConn) DelFromQueue(url string, handle string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deleted = append(f.deleted, handle)
+	return nil
+}
+
+// writeHocr saves a minimal hOCR file with a single line containing
+// the words given, each with the specified confidence.
+func writeHocr(path string, conf int, words ...string) error {
+	s := "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<html><body>\n" +
+		"<div class='ocr_page' id='page_1' title='image \"page.png\"; bbox 0 0 1000 1000'>\n" +
+		"<div class='ocr_carea' id='block_1_1'><p class='ocr_par' id='par_1_1'>\n" +
+		"<span class='ocr_line' id='line_1_1' title='bbox 0 0 1000 100'>\n"
+	for i, w := range words {
+		s += fmt.Sprintf("<span class='ocrx_word' id='word_1_%d' title='bbox %d 10 %d 60; x_wconf %d'>%s</span>\n", i+1, i*100, i*100+90, conf, w)
+	}
+	s += "</span>\n</p></div>\n</div>\n</body></html>\n"
+	return ioutil.WriteFile(path, []byte(s), 0644)
+}
+
+// runAnalyse runs the Analyse function on the hOCR files given,
+// returning the list of files it produced
+func runAnalyse(analyse func(context.Context, chan string, chan string, chan error, *log.Logger), hocrs []string, logger *log.Logger) ([]string, error) {
+	toanalyse := make(chan string)
+	upc := make(chan string)
+	errc := make(chan error)
+	go analyse(context.Background(), toanalyse, upc, errc, logger)
+	go func() {
+		for _, h := range hocrs {
+			toanalyse <- h
+		}
+		close(toanalyse)
+	}()
+
+	var done []string
+	for {
+		select {
+		case err := <-errc:
+			return done, err
+		case p, ok := <-upc:
+			if !ok {
+				return done, nil
+			}
+			done = append(done, p)
+		}
+	}
+}
+
 // Test_download tests the download() function inside the pipeline
 func Test_download(t *testing.T) {
 	var slog StrLog
@@ -100,7 +198,7 @@ func Test_download(t *testing.T) {
 				processchan := make(chan string)
 				errchan := make(chan error)
 
-				go download(dlchan, processchan, conn.c, tempDir, errchan, vlog)
+				go download(context.Background(), dlchan, processchan, conn.c, tempDir, errchan, vlog)
 
 				dlchan <- c.dl
 				close(dlchan)
@@ -213,7 +311,7 @@ func Test_up(t *testing.T) {
 				donechan := make(chan bool)
 				errchan := make(chan error)
 
-				go up(ulchan, donechan, conn.c, "pipelinetest", errchan, vlog)
+				go up(context.Background(), ulchan, donechan, conn.c, "pipelinetest", errchan, vlog)
 
 				ulchan <- filepath.Join(tempDir, c.ul)
 				close(ulchan)
@@ -336,7 +434,7 @@ func Test_upAndQueue(t *testing.T) {
 				donechan := make(chan bool)
 				errchan := make(chan error)
 
-				go upAndQueue(ulchan, donechan, queueurl, conn.c, "pipelinetest", "test", errchan, vlog)
+				go upAndQueue(context.Background(), ulchan, donechan, queueurl, conn.c, "pipelinetest", JobMsg{Training: "test", Opts: map[string]string{"single": "otsu"}}, errchan, vlog)
 
 				ulchan <- filepath.Join(tempDir, c.ul)
 				close(ulchan)
@@ -395,7 +493,7 @@ func Test_upAndQueue(t *testing.T) {
 					t.Fatalf("Uploaded file differs from expected, expected: '%s', got '%s'\nLog: %s", c.contents, dled, slog.log)
 				}
 
-				queueExpected := "pipelinetest/" + c.ul + " test"
+				queueExpected := "pipelinetest/" + c.ul + " test single=otsu"
 				if msg.Body != queueExpected {
 					_ = conn.c.DelFromQueue(queueurl, msg.Handle)
 					t.Fatalf("Queue contents not as expected, expected: '%s', got '%s'\nLog: %s", queueExpected, msg.Body, slog.log)
@@ -425,3 +523,955 @@ func Test_upAndQueue(t *testing.T) {
 		}
 	}
 }
+
+// Test_AnalyseSingleVersion tests that Analyse chooses the only
+// version of each page as the best, as happens when a book is
+// binarised in a single pass, even if it has zero confidence
+func Test_AnalyseSingleVersion(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	conn := newTestConn(t, vlog)
+
+	dir, err := ioutil.TempDir("", "singlepasstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	pages := []struct {
+		name string
+		conf int
+	}{
+		{"0001_bin0.0.hocr", 80},
+		{"0002_bin0.0.hocr", 70},
+		{"0003_bin0.0.hocr", 0},
+	}
+	var hocrs []string
+	for _, p := range pages {
+		fn := filepath.Join(dir, p.name)
+		err = writeHocr(fn, p.conf, "single", "pass")
+		if err != nil {
+			t.Fatalf("Could not write hOCR file %s: %v", fn, err)
+		}
+		hocrs = append(hocrs, fn)
+	}
+
+	_, err = runAnalyse(Analyse(conn, AnalyseOptions{}), hocrs, vlog)
+	if err != nil {
+		t.Fatalf("Error in Analyse: %v\nLog: %s", err, slog.log)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "best"))
+	if err != nil {
+		t.Fatalf("Could not read best file: %v", err)
+	}
+	best := strings.Fields(string(b))
+	sort.Strings(best)
+	if len(best) != len(pages) {
+		t.Fatalf("Expected %d pages in best, got %d: %v", len(pages), len(best), best)
+	}
+	for i, p := range pages {
+		if best[i] != p.name {
+			t.Fatalf("Expected %s in best file, got %s", p.name, best[i])
+		}
+	}
+}
+
+// Test_AnalyseDeterministic tests that Analyse writes the best and
+// conf files identically each time it is run on the same pages, in
+// page order, whatever order the pages are analysed in
+func Test_AnalyseDeterministic(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	conn := newTestConn(t, vlog)
+
+	dir, err := ioutil.TempDir("", "deterministictest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var hocrs []string
+	for pg := 1; pg <= 5; pg++ {
+		for i, bin := range []string{"0.1", "0.2", "0.3"} {
+			fn := filepath.Join(dir, fmt.Sprintf("%04d_bin%s.hocr", pg, bin))
+			// the first two thresholds of odd pages tie for the best
+			conf := 60 + i*10
+			if pg%2 == 1 {
+				conf = []int{80, 80, 60}[i]
+			}
+			err = writeHocr(fn, conf, "same", "again")
+			if err != nil {
+				t.Fatalf("Could not write hOCR file %s: %v", fn, err)
+			}
+			hocrs = append(hocrs, fn)
+		}
+	}
+
+	var bests, confs []string
+	for run := 0; run < 2; run++ {
+		order := make([]string, len(hocrs))
+		copy(order, hocrs)
+		if run == 1 {
+			for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+				order[i], order[j] = order[j], order[i]
+			}
+		}
+		_, err = runAnalyse(Analyse(conn, AnalyseOptions{}), order, vlog)
+		if err != nil {
+			t.Fatalf("Error in Analyse: %v\nLog: %s", err, slog.log)
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, "best"))
+		if err != nil {
+			t.Fatalf("Could not read best file: %v", err)
+		}
+		bests = append(bests, string(b))
+		b, err = ioutil.ReadFile(filepath.Join(dir, "conf"))
+		if err != nil {
+			t.Fatalf("Could not read conf file: %v", err)
+		}
+		confs = append(confs, string(b))
+	}
+
+	if bests[0] != bests[1] {
+		t.Fatalf("best files differ between runs:\n%s\n%s", bests[0], bests[1])
+	}
+	if confs[0] != confs[1] {
+		t.Fatalf("conf files differ between runs:\n%s\n%s", confs[0], confs[1])
+	}
+	lines := strings.Split(strings.TrimSpace(confs[0]), "\n")
+	if !sort.StringsAreSorted(lines) {
+		t.Fatalf("Expected conf file to be in page order, got:\n%s", confs[0])
+	}
+	expected := "0001_bin0.1.hocr\n0002_bin0.3.hocr\n0003_bin0.1.hocr\n0004_bin0.3.hocr\n0005_bin0.1.hocr\n"
+	if bests[0] != expected {
+		t.Fatalf("Expected best file:\n%s\ngot:\n%s", expected, bests[0])
+	}
+}
+
+// Test_AnalyseMinBookConf tests that Analyse marks a book whose
+// average confidence is below MinBookConf as needing review, and
+// leaves a book above it to be marked as done
+func Test_AnalyseMinBookConf(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	conn := newTestConn(t, vlog)
+
+	cases := []struct {
+		name   string
+		confs  []int
+		review bool
+		nested bool
+	}{
+		{"good", []int{80, 70, 90}, false, false},
+		{"low", []int{40, 20, 90}, true, false},
+		{"nestedname", []int{40, 20, 90}, true, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "minbookconftest")
+			if err != nil {
+				t.Fatalf("Could not create temporary directory: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			var hocrs []string
+			for i, conf := range c.confs {
+				fn := filepath.Join(dir, fmt.Sprintf("%04d_bin0.2.hocr", i+1))
+				err = writeHocr(fn, conf, "min", "conf")
+				if err != nil {
+					t.Fatalf("Could not write hOCR file %s: %v", fn, err)
+				}
+				hocrs = append(hocrs, fn)
+			}
+
+			// a marker left by a previous analysis should be cleared
+			bookname := filepath.Base(dir)
+			if c.nested {
+				bookname = "collection/" + bookname
+			}
+			err = conn.Upload(conn.WIPStorageId(), bookname+"/"+NeedsReviewFile, hocrs[0])
+			if err != nil {
+				t.Fatalf("Could not upload %s: %v", NeedsReviewFile, err)
+			}
+
+			opts := AnalyseOptions{MinBookConf: 60}
+			if c.nested {
+				opts.Bookname = bookname
+			}
+			done, err := runAnalyse(Analyse(conn, opts), hocrs, vlog)
+			if err != nil {
+				t.Fatalf("Error in Analyse: %v\nLog: %s", err, slog.log)
+			}
+
+			review, err := NeedsReview(conn, bookname)
+			if err != nil {
+				t.Fatalf("Error checking whether book needs review: %v", err)
+			}
+			if review {
+				t.Fatalf("Expected previous %s to be deleted", NeedsReviewFile)
+			}
+
+			reviewi, graph := -1, -1
+			for i, fn := range done {
+				switch filepath.Base(fn) {
+				case NeedsReviewFile:
+					reviewi = i
+				case "graph.png":
+					graph = i
+				}
+			}
+			if c.review && reviewi == -1 {
+				t.Fatalf("Expected %s to be uploaded, got %v", NeedsReviewFile, done)
+			}
+			if !c.review && reviewi != -1 {
+				t.Fatalf("Expected %s not to be uploaded, got %v", NeedsReviewFile, done)
+			}
+			if reviewi != -1 && graph != -1 && reviewi > graph {
+				t.Fatalf("Expected %s to be uploaded before graph.png, got %v", NeedsReviewFile, done)
+			}
+		})
+	}
+}
+
+// Test_AnalyseNoGraph tests that Analyse completes without a graph
+// when the confidences can't be graphed
+func Test_AnalyseNoGraph(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	conn := newTestConn(t, vlog)
+
+	cases := []struct {
+		name  string
+		pages []string
+	}{
+		{"singlepage", []string{"0001_bin0.2.hocr"}},
+		{"samepagenum", []string{"a0001_bin0.2.hocr", "b0001_bin0.2.hocr"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "nographtest")
+			if err != nil {
+				t.Fatalf("Could not create temporary directory: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			var hocrs []string
+			for _, p := range c.pages {
+				fn := filepath.Join(dir, p)
+				err = writeHocr(fn, 80, "no", "graph")
+				if err != nil {
+					t.Fatalf("Could not write hOCR file %s: %v", fn, err)
+				}
+				hocrs = append(hocrs, fn)
+			}
+
+			done, err := runAnalyse(Analyse(conn, AnalyseOptions{}), hocrs, vlog)
+			if err != nil {
+				t.Fatalf("Error in Analyse: %v\nLog: %s", err, slog.log)
+			}
+
+			uploaded := make(map[string]bool)
+			for _, fn := range done {
+				uploaded[filepath.Base(fn)] = true
+			}
+			for _, fn := range []string{"best", "conf"} {
+				if !uploaded[fn] {
+					t.Fatalf("Expected %s to be uploaded, got %v", fn, done)
+				}
+			}
+			if uploaded["graph.png"] {
+				t.Fatalf("Expected graph.png not to be uploaded")
+			}
+			if filepath.Base(done[len(done)-1]) != DoneFile {
+				t.Fatalf("Expected %s to be uploaded last, got %v", DoneFile, done)
+			}
+			if !ResultsComplete(done) {
+				t.Fatalf("Expected book to be listed as done, got %v", done)
+			}
+			_, err = os.Stat(filepath.Join(dir, "graph.png"))
+			if err == nil {
+				t.Fatalf("Expected failed graph.png to be removed")
+			}
+		})
+	}
+}
+
+// Test_AnalyseDictionary tests that using a dictionary when choosing
+// the best version of a page prefers real words to gibberish, even
+// when the gibberish has a higher confidence
+func Test_AnalyseDictionary(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	conn := newTestConn(t, vlog)
+
+	dir, err := ioutil.TempDir("", "dictionarytest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dict := filepath.Join(dir, "words.txt")
+	err = ioutil.WriteFile(dict, []byte("the\nquick\nbrown\nfox\n"), 0644)
+	if err != nil {
+		t.Fatalf("Could not write word list: %v", err)
+	}
+
+	gibberish := filepath.Join(dir, "0001_bin0.1.hocr")
+	err = writeHocr(gibberish, 90, "xqz", "vvk", "plm", "brwn")
+	if err != nil {
+		t.Fatalf("Could not write hOCR file: %v", err)
+	}
+	words := filepath.Join(dir, "0001_bin0.2.hocr")
+	err = writeHocr(words, 80, "the", "quick", "brown", "fox")
+	if err != nil {
+		t.Fatalf("Could not write hOCR file: %v", err)
+	}
+	for _, fn := range []string{gibberish, words} {
+		_, err = writeOcrParams(fn, newOcrParams(strings.TrimSuffix(fn, ".hocr")+".png", "eng", -1))
+		if err != nil {
+			t.Fatalf("Could not write OCR parameters: %v", err)
+		}
+	}
+
+	cases := []struct {
+		name string
+		opts AnalyseOptions
+		best string
+	}{
+		{"confidence", AnalyseOptions{}, "0001_bin0.1.hocr"},
+		{"dictionary", AnalyseOptions{Dictionaries: map[string]string{"": dict}}, "0001_bin0.2.hocr"},
+		{"training", AnalyseOptions{Dictionaries: map[string]string{"eng": dict}}, "0001_bin0.2.hocr"},
+		{"othertraining", AnalyseOptions{Dictionaries: map[string]string{"lat": dict}}, "0001_bin0.1.hocr"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err = runAnalyse(Analyse(conn, c.opts), []string{gibberish, words}, vlog)
+			if err != nil {
+				t.Fatalf("Error in Analyse: %v\nLog: %s", err, slog.log)
+			}
+
+			b, err := ioutil.ReadFile(filepath.Join(dir, "best"))
+			if err != nil {
+				t.Fatalf("Could not read best file: %v", err)
+			}
+			best := strings.TrimSpace(string(b))
+			if best != c.best {
+				t.Fatalf("Expected best to be %s, got %s", c.best, best)
+			}
+		})
+	}
+}
+
+// Test_ProcessBookRequeue tests that a book being processed is made
+// visible on its queue again if processing is cancelled
+func Test_ProcessBookRequeue(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	conn := &fakeConn{LocalConn: newTestConn(t, vlog)}
+
+	err := conn.Upload(conn.WIPStorageId(), "requeuetest/0001.jpg", "testdata/good/1.png")
+	if err != nil {
+		t.Fatalf("Could not upload test file: %v", err)
+	}
+
+	// a process which waits until it is cancelled
+	process := func(ctx context.Context, in chan string, up chan string, errc chan error, logger *log.Logger) {
+		for range in {
+		}
+		<-ctx.Done()
+		errc <- ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+
+	msg := bookpipeline.Qmsg{Id: "1", Handle: "requeuetest", Body: "requeuetest"}
+	err = ProcessBook(ctx, msg, conn, process, regexp.MustCompile(`.jpg$`), conn.PreQueueId(), conn.OCRPageQueueId())
+	if err != context.Canceled {
+		t.Fatalf("Expected context cancelled error, got %v\nLog: %s", err, slog.log)
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if len(conn.heartbeats) == 0 || conn.heartbeats[len(conn.heartbeats)-1] != 0 {
+		t.Fatalf("Expected message visibility to be reset to 0, got heartbeats %v\nLog: %s", conn.heartbeats, slog.log)
+	}
+	if len(conn.deleted) > 0 {
+		t.Fatalf("Message was deleted from queue when it should have been requeued\nLog: %s", slog.log)
+	}
+}
+
+// Test_AnalyseWords tests that the position of each word on the best
+// version of each page is saved with the right image name
+func Test_AnalyseWords(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	conn := newTestConn(t, vlog)
+
+	dir, err := ioutil.TempDir("", "wordstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	hocrs := []struct {
+		name  string
+		conf  int
+		words []string
+	}{
+		{"0001_bin0.1.hocr", 90, []string{"first", "page"}},
+		{"0002_bin0.1.hocr", 50, []string{"worse", "version"}},
+		{"0002_bin0.2.hocr", 85, []string{"second", "page"}},
+	}
+	var paths []string
+	for _, h := range hocrs {
+		fn := filepath.Join(dir, h.name)
+		err = writeHocr(fn, h.conf, h.words...)
+		if err != nil {
+			t.Fatalf("Could not write hOCR file %s: %v", fn, err)
+		}
+		paths = append(paths, fn)
+	}
+
+	_, err = runAnalyse(Analyse(conn, AnalyseOptions{}), paths, vlog)
+	if err != nil {
+		t.Fatalf("Error in Analyse: %v\nLog: %s", err, slog.log)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "words.jsonl"))
+	if err != nil {
+		t.Fatalf("Could not read words file: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 pages in words file, got %d", len(lines))
+	}
+	var pg PageWords
+	err = json.Unmarshal([]byte(lines[1]), &pg)
+	if err != nil {
+		t.Fatalf("Could not parse words file: %v", err)
+	}
+
+	if pg.Image != "0002_bin0.2.png" {
+		t.Fatalf("Expected image 0002_bin0.2.png, got %s", pg.Image)
+	}
+	if pg.Width != 1000 || pg.Height != 1000 {
+		t.Fatalf("Expected page dimensions 1000x1000, got %dx%d", pg.Width, pg.Height)
+	}
+	if len(pg.Words) != 2 {
+		t.Fatalf("Expected 2 words, got %d", len(pg.Words))
+	}
+	expected := Word{Text: "page", Bbox: [4]int{100, 10, 190, 60}, Conf: 85}
+	if pg.Words[1] != expected {
+		t.Fatalf("Word differs from expected, expected %v, got %v", expected, pg.Words[1])
+	}
+}
+
+// Test_AnalysePageSizes tests that the size of the best version of
+// each page is saved, matching the bbox of the hOCR page
+func Test_AnalysePageSizes(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	conn := newTestConn(t, vlog)
+
+	dir, err := ioutil.TempDir("", "pagesizestest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b, err := ioutil.ReadFile("testdata/hocr/sample.hocr")
+	if err != nil {
+		t.Fatalf("Could not read sample hOCR: %v", err)
+	}
+	sample := filepath.Join(dir, "0001_bin0.2.hocr")
+	err = ioutil.WriteFile(sample, b, 0644)
+	if err != nil {
+		t.Fatalf("Could not write hOCR file %s: %v", sample, err)
+	}
+	second := filepath.Join(dir, "0002_bin0.1.hocr")
+	err = writeHocr(second, 80, "second", "page")
+	if err != nil {
+		t.Fatalf("Could not write hOCR file %s: %v", second, err)
+	}
+
+	done, err := runAnalyse(Analyse(conn, AnalyseOptions{}), []string{sample, second}, vlog)
+	if err != nil {
+		t.Fatalf("Error in Analyse: %v\nLog: %s", err, slog.log)
+	}
+	found := false
+	for _, d := range done {
+		if d == filepath.Join(dir, PageSizesFile) {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("Expected %s to be uploaded, got %v", PageSizesFile, done)
+	}
+
+	sizes, err := ReadPageSizes(dir)
+	if err != nil {
+		t.Fatalf("Error reading page sizes: %v", err)
+	}
+	expected := map[string]PageSize{
+		"0001_bin0.2.hocr": {2480, 3508},
+		"0002_bin0.1.hocr": {1000, 1000},
+	}
+	if len(sizes) != len(expected) {
+		t.Fatalf("Expected page sizes %v, got %v", expected, sizes)
+	}
+	for k, v := range expected {
+		if sizes[k] != v {
+			t.Fatalf("Expected size of %s to be %v, got %v", k, v, sizes[k])
+		}
+	}
+}
+
+// Test_Echo tests that a message on the test queue is consumed and
+// removed from the queue by the echo handler
+func Test_Echo(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	conn := newTestConn(t, vlog)
+
+	err := conn.AddToQueue(conn.TestQueueId(), "echotest")
+	if err != nil {
+		t.Fatalf("Could not add message to test queue: %v", err)
+	}
+
+	msg, err := conn.CheckQueue(conn.TestQueueId(), 10)
+	if err != nil {
+		t.Fatalf("Error checking test queue: %v", err)
+	}
+	if msg.Body != "echotest" {
+		t.Fatalf("Expected message 'echotest' on test queue, got '%s'", msg.Body)
+	}
+
+	err = Echo(msg, conn, conn.TestQueueId())
+	if err != nil {
+		t.Fatalf("Error from echo handler: %v\nLog: %s", err, slog.log)
+	}
+
+	if !strings.Contains(slog.log, "echotest") {
+		t.Fatalf("Message body not logged by echo handler\nLog: %s", slog.log)
+	}
+
+	msg, err = conn.CheckQueue(conn.TestQueueId(), 10)
+	if err != nil {
+		t.Fatalf("Error checking test queue: %v", err)
+	}
+	if msg.Handle != "" {
+		t.Fatalf("Expected test queue to be empty, but found '%s'", msg.Body)
+	}
+}
+
+// Test_Heartbeat tests that the heartbeat keeps a message hidden
+// based on the time elapsed since it was last extended, even if a
+// tick is delayed, and that failures are retried and reported
+func Test_Heartbeat(t *testing.T) {
+	start := time.Now()
+	clock := heartbeatClock{now: func() time.Time { return start }}
+
+	cases := []struct {
+		name    string
+		ticks   []time.Duration
+		hbfail  int
+		want    []int64
+		warning bool
+		err     bool
+	}{
+		{"regular", []time.Duration{60 * time.Second, 120 * time.Second, 180 * time.Second}, 0, []int64{120, 120, 120}, false, false},
+		{"delayed", []time.Duration{60 * time.Second, 260 * time.Second, 320 * time.Second}, 0, []int64{120, 260, 120}, true, false},
+		{"longdelay", []time.Duration{2000 * time.Second}, 0, []int64{900}, true, false},
+		{"retried", []time.Duration{60 * time.Second}, 2, []int64{120, 120, 120}, false, false},
+		{"failed", []time.Duration{60 * time.Second}, 10, []int64{120, 120, 120, 120}, false, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var slog StrLog
+			vlog := log.New(&slog, "", 0)
+			conn := &fakeConn{LocalConn: &bookpipeline.LocalConn{Logger: vlog}, hbfail: c.hbfail}
+
+			tickc := make(chan time.Time, len(c.ticks))
+			for _, d := range c.ticks {
+				tickc <- start.Add(d)
+			}
+			close(tickc)
+			msgc := make(chan bookpipeline.Qmsg)
+			hberr := make(chan error, 1)
+
+			heartbeat(conn, tickc, clock, bookpipeline.Qmsg{Id: "1", Handle: "1"}, "queue", msgc, hberr)
+
+			var err error
+			select {
+			case err = <-hberr:
+			default:
+			}
+			if c.err && err == nil {
+				t.Errorf("Expected an error, got none")
+			}
+			if !c.err && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if len(conn.heartbeats) != len(c.want) {
+				t.Fatalf("Expected heartbeats %v, got %v\nLog: %s", c.want, conn.heartbeats, slog.log)
+			}
+			for i := range c.want {
+				if conn.heartbeats[i] != c.want[i] {
+					t.Fatalf("Expected heartbeats %v, got %v\nLog: %s", c.want, conn.heartbeats, slog.log)
+				}
+			}
+
+			warned := strings.Contains(slog.log, "heartbeat was delayed")
+			if warned != c.warning {
+				t.Errorf("Expected delay warning to be %v, got %v\nLog: %s", c.warning, warned, slog.log)
+			}
+		})
+	}
+}
+
+// writeHocrLines saves a minimal hOCR file with a line for each
+// slice of confidences given, containing a word with each confidence
+func writeHocrLines(path string, lines ...[]int) error {
+	s := "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<html><body>\n" +
+		"<div class='ocr_page' id='page_1' title='image \"page.png\"; bbox 0 0 1000 1000'>\n" +
+		"<div class='ocr_carea' id='block_1_1'><p class='ocr_par' id='par_1_1'>\n"
+	for l, confs := range lines {
+		s += fmt.Sprintf("<span class='ocr_line' id='line_1_%d' title='bbox 0 %d 1000 %d'>\n", l+1, l*100, l*100+90)
+		for i, c := range confs {
+			s += fmt.Sprintf("<span class='ocrx_word' id='word_%d_%d' title='bbox %d %d %d %d; x_wconf %d'>word</span>\n", l+1, i+1, i*100, l*100+10, i*100+90, l*100+60, c)
+		}
+		s += "</span>\n"
+	}
+	s += "</p></div>\n</div>\n</body></html>\n"
+	return ioutil.WriteFile(path, []byte(s), 0644)
+}
+
+// Test_AnalyseLineConf tests that the best version of a page can be
+// chosen differently when ranking by line confidence rather than by
+// word confidence
+func Test_AnalyseLineConf(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	conn := newTestConn(t, vlog)
+
+	dir, err := ioutil.TempDir("", "lineconftest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// one very poor short line and one good long line: the average
+	// word confidence is 82, but the average line confidence is 50
+	uneven := filepath.Join(dir, "0001_bin0.1.hocr")
+	err = writeHocrLines(uneven, []int{10}, []int{90, 90, 90, 90, 90, 90, 90, 90, 90})
+	if err != nil {
+		t.Fatalf("Could not write hOCR file: %v", err)
+	}
+	// two middling lines: the average word and line confidence is 70
+	even := filepath.Join(dir, "0001_bin0.2.hocr")
+	err = writeHocrLines(even, []int{70, 70, 70, 70, 70}, []int{70, 70, 70, 70, 70})
+	if err != nil {
+		t.Fatalf("Could not write hOCR file: %v", err)
+	}
+
+	cases := []struct {
+		name string
+		opts AnalyseOptions
+		best string
+	}{
+		{"words", AnalyseOptions{}, "0001_bin0.1.hocr"},
+		{"lines", AnalyseOptions{LineConf: true}, "0001_bin0.2.hocr"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err = runAnalyse(Analyse(conn, c.opts), []string{uneven, even}, vlog)
+			if err != nil {
+				t.Fatalf("Error in Analyse: %v\nLog: %s", err, slog.log)
+			}
+
+			b, err := ioutil.ReadFile(filepath.Join(dir, "best"))
+			if err != nil {
+				t.Fatalf("Could not read best file: %v", err)
+			}
+			best := strings.TrimSpace(string(b))
+			if best != c.best {
+				t.Fatalf("Expected best to be %s, got %s", c.best, best)
+			}
+		})
+	}
+}
+
+// Test_AnalysePsm tests that Analyse chooses the OCR of a page with
+// the page segmentation mode which gave the highest confidence, and
+// refers to the image it was OCRed from in the words it saves
+func Test_AnalysePsm(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	conn := newTestConn(t, vlog)
+
+	dir, err := ioutil.TempDir("", "psmtest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	pages := []struct {
+		name string
+		conf int
+	}{
+		{"0001_bin0.2_psm3.hocr", 60},
+		{"0001_bin0.2_psm6.hocr", 85},
+		{"0001_bin0.2_psm11.hocr", 70},
+	}
+	var hocrs []string
+	for _, p := range pages {
+		fn := filepath.Join(dir, p.name)
+		err = writeHocr(fn, p.conf, "a", "table")
+		if err != nil {
+			t.Fatalf("Could not write hOCR file %s: %v", fn, err)
+		}
+		hocrs = append(hocrs, fn)
+	}
+
+	_, err = runAnalyse(Analyse(conn, AnalyseOptions{}), hocrs, vlog)
+	if err != nil {
+		t.Fatalf("Error in Analyse: %v\nLog: %s", err, slog.log)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "best"))
+	if err != nil {
+		t.Fatalf("Could not read best file: %v", err)
+	}
+	best := strings.TrimSpace(string(b))
+	if best != "0001_bin0.2_psm6.hocr" {
+		t.Fatalf("Expected best to be 0001_bin0.2_psm6.hocr, got %s", best)
+	}
+
+	b, err = ioutil.ReadFile(filepath.Join(dir, "words.jsonl"))
+	if err != nil {
+		t.Fatalf("Could not read words file: %v", err)
+	}
+	if !strings.Contains(string(b), `"0001_bin0.2.png"`) {
+		t.Fatalf("Expected words to refer to image 0001_bin0.2.png, got %s", b)
+	}
+}
+
+// Test_OcrPsms tests that OCR with several page segmentation modes
+// produces an hOCR for each mode, using a fake tesseract
+func Test_OcrPsms(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping OCR which needs a shell script")
+	}
+
+	dir, err := ioutil.TempDir("", "ocrpsmtest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tesscmd := filepath.Join(dir, "tesseract")
+	script := "#!/bin/sh\necho \"$@\" > \"$4.args\"\necho '<html><body></body></html>' > \"$4.hocr\"\n"
+	err = ioutil.WriteFile(tesscmd, []byte(script), 0755)
+	if err != nil {
+		t.Fatalf("Could not create fake tesseract: %v", err)
+	}
+
+	cases := []struct {
+		name     string
+		psms     []int
+		expected []string
+	}{
+		{"default", nil, []string{"0001_bin0.2.hocr"}},
+		{"several", []int{3, 6, 11}, []string{"0001_bin0.2_psm3.hocr", "0001_bin0.2_psm6.hocr", "0001_bin0.2_psm11.hocr"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var slog StrLog
+			toocr := make(chan string, 1)
+			up := make(chan string, len(c.expected)+1)
+			errc := make(chan error, 1)
+			toocr <- filepath.Join(dir, "0001_bin0.2.png")
+			close(toocr)
+			OcrWithOptions("eng", tesscmd, OcrOptions{Psms: c.psms})(context.Background(), toocr, up, errc, log.New(&slog, "", 0))
+			select {
+			case err = <-errc:
+				t.Fatalf("Error running OCR: %v\nLog: %s", err, slog.log)
+			default:
+			}
+
+			var got []string
+			for h := range up {
+				got = append(got, filepath.Base(h))
+			}
+			if strings.Join(got, " ") != strings.Join(c.expected, " ") {
+				t.Fatalf("Expected %v, got %v", c.expected, got)
+			}
+			for i, psm := range c.psms {
+				b, err := ioutil.ReadFile(filepath.Join(dir, strings.TrimSuffix(c.expected[i], ".hocr")+".args"))
+				if err != nil {
+					t.Fatalf("Could not read arguments: %v", err)
+				}
+				if !strings.HasSuffix(strings.TrimSpace(string(b)), fmt.Sprintf("--psm %d", psm)) {
+					t.Fatalf("Expected --psm %d to be used, got %s", psm, b)
+				}
+			}
+		})
+	}
+}
+
+func Test_HocrImage(t *testing.T) {
+	cases := []struct {
+		hocr string
+		img  string
+	}{
+		{"0001_bin0.2.hocr", "0001_bin0.2.png"},
+		{"book/0001_bin0.2_psm6.hocr", "book/0001_bin0.2.png"},
+		{"0001_bin0.0_psm11.hocr", "0001_bin0.0.png"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.hocr, func(t *testing.T) {
+			img := HocrImage(c.hocr)
+			if img != c.img {
+				t.Fatalf("Expected %s, got %s", c.img, img)
+			}
+		})
+	}
+}
+
+// Test_AnalyseInvalidUTF8 tests that hOCR containing invalid UTF-8
+// is repaired, with the replacements logged, so that the words and
+// text exported from it are valid
+func Test_AnalyseInvalidUTF8(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	conn := newTestConn(t, vlog)
+
+	dir, err := ioutil.TempDir("", "utf8test")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "0001_bin0.2.hocr")
+	err = writeHocr(fn, 80, "caf\xe9", "ok")
+	if err != nil {
+		t.Fatalf("Could not write hOCR file: %v", err)
+	}
+
+	_, err = runAnalyse(Analyse(conn, AnalyseOptions{Tar: true}), []string{fn}, vlog)
+	if err != nil {
+		t.Fatalf("Error in Analyse: %v\nLog: %s", err, slog.log)
+	}
+
+	if !strings.Contains(slog.log, "Replaced invalid UTF-8 in "+fn+" on lines [6]") {
+		t.Fatalf("Expected replacement to be logged, got log: %s", slog.log)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "words.jsonl"))
+	if err != nil {
+		t.Fatalf("Could not read words file: %v", err)
+	}
+	if !utf8.Valid(b) {
+		t.Fatalf("Expected words to be valid UTF-8, got %q", b)
+	}
+	var pg PageWords
+	err = json.Unmarshal(b, &pg)
+	if err != nil {
+		t.Fatalf("Could not parse words: %v", err)
+	}
+	if len(pg.Words) != 2 || pg.Words[0].Text != "caf�" {
+		t.Fatalf("Expected invalid word to be repaired, got %v", pg.Words)
+	}
+
+	unpacked := filepath.Join(dir, "unpacked")
+	err = os.MkdirAll(unpacked, 0755)
+	if err != nil {
+		t.Fatalf("Could not create directory: %v", err)
+	}
+	err = Untar(filepath.Join(dir, TarName(filepath.Base(dir), false)), unpacked)
+	if err != nil {
+		t.Fatalf("Error unpacking archive: %v", err)
+	}
+	for _, name := range []string{"0001_bin0.2.hocr", "0001_bin0.2.txt"} {
+		b, err := ioutil.ReadFile(filepath.Join(unpacked, name))
+		if err != nil {
+			t.Fatalf("Could not read %s from archive: %v", name, err)
+		}
+		if !utf8.Valid(b) {
+			t.Fatalf("Expected %s to be valid UTF-8, got %q", name, b)
+		}
+	}
+}
+
+// Test_VerifyPagesComplete tests that the preprocessed pages of a
+// book which haven't been OCRed are found
+func Test_VerifyPagesComplete(t *testing.T) {
+	cases := []struct {
+		name    string
+		files   []string
+		psms    []int
+		missing []string
+		err     bool
+	}{
+		{"complete", []string{"0001_bin0.2.png", "0001_bin0.2.hocr", "0002_bin0.2.png", "0002_bin0.2.hocr"}, nil, nil, false},
+		{"onemissing", []string{"0001_bin0.2.png", "0001_bin0.2.hocr", "0002_bin0.2.png", "0003_bin0.2.png", "0003_bin0.2.hocr"}, nil, []string{"0002_bin0.2.png"}, false},
+		{"psm", []string{"0001_bin0.2.png", "0001_bin0.2_psm3.hocr", "0001_bin0.2_psm6.hocr"}, []int{3, 6}, nil, false},
+		{"psmmissing", []string{"0001_bin0.2.png", "0001_bin0.2_psm3.hocr", "0002_bin0.2.png", "0002_bin0.2_psm3.hocr", "0002_bin0.2_psm6.hocr"}, []int{3, 6}, []string{"0001_bin0.2.png"}, false},
+		{"unpreprocessed", []string{"0001.jpg"}, nil, nil, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conn := newTestConn(t, log.New(ioutil.Discard, "", 0))
+			for _, fn := range c.files {
+				err := conn.Upload(conn.WIPStorageId(), "verifytest/"+fn, "testdata/good/1.png")
+				if err != nil {
+					t.Fatalf("Could not upload %s: %v", fn, err)
+				}
+			}
+
+			missing, err := VerifyPagesComplete(conn, "verifytest", c.psms)
+			if c.err {
+				if err == nil {
+					t.Fatalf("Expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Error in VerifyPagesComplete: %v", err)
+			}
+			var expected []string
+			for _, fn := range c.missing {
+				expected = append(expected, "verifytest/"+fn)
+			}
+			if strings.Join(missing, " ") != strings.Join(expected, " ") {
+				t.Fatalf("Expected missing pages %v, got %v", expected, missing)
+			}
+		})
+	}
+}
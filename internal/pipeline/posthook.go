@@ -0,0 +1,42 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// RunPostHook runs an external command once a book has been
+// analysed, so that further steps, like uploading it to a repository
+// or notifying another system, can be done. The command is given the
+// name of the book and the location of its results, like
+// bucket/bookname, as arguments, and these are also set in the
+// environment as BOOKPIPELINE_BOOK and BOOKPIPELINE_LOCATION. If the
+// book was published, the location it was published to is set as
+// BOOKPIPELINE_PUBLISHED, otherwise that is empty. The command is
+// killed if ctx is cancelled or its deadline passes.
+func RunPostHook(ctx context.Context, hook string, bookname string, location string, published string) error {
+	cmd := exec.CommandContext(ctx, hook, bookname, location)
+	HideCmd(cmd)
+	cmd.Env = append(os.Environ(),
+		"BOOKPIPELINE_BOOK="+bookname,
+		"BOOKPIPELINE_LOCATION="+location,
+		"BOOKPIPELINE_PUBLISHED="+published)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("Error running post hook %s for %s: timed out\nStdout: %s\nStderr: %s", hook, bookname, stdout.String(), stderr.String())
+	}
+	if err != nil {
+		return fmt.Errorf("Error running post hook %s for %s: %v\nStdout: %s\nStderr: %s", hook, bookname, err, stdout.String(), stderr.String())
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_RunPostHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test which uses a shell script")
+	}
+
+	dir, err := ioutil.TempDir("", "posthooktest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the stub hook records its arguments and environment
+	out := filepath.Join(dir, "out")
+	hook := filepath.Join(dir, "hook")
+	script := "#!/bin/sh\necho \"$1|$2|$BOOKPIPELINE_BOOK|$BOOKPIPELINE_LOCATION|$BOOKPIPELINE_PUBLISHED\" > " + out + "\n"
+	err = ioutil.WriteFile(hook, []byte(script), 0755)
+	if err != nil {
+		t.Fatalf("Could not write stub hook: %v", err)
+	}
+
+	err = RunPostHook(context.Background(), hook, "somebook", "wip/somebook", "pub/somebook")
+	if err != nil {
+		t.Fatalf("Error running hook: %v", err)
+	}
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("Expected hook to be run: %v", err)
+	}
+	expected := "somebook|wip/somebook|somebook|wip/somebook|pub/somebook\n"
+	if string(b) != expected {
+		t.Fatalf("Expected hook to get %q, got %q", expected, b)
+	}
+
+	failing := filepath.Join(dir, "failing")
+	err = ioutil.WriteFile(failing, []byte("#!/bin/sh\necho oops >&2\nexit 3\n"), 0755)
+	if err != nil {
+		t.Fatalf("Could not write stub hook: %v", err)
+	}
+	err = RunPostHook(context.Background(), failing, "somebook", "wip/somebook", "")
+	if err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Fatalf("Expected an error including the hook's output, got %v", err)
+	}
+
+	hanging := filepath.Join(dir, "hanging")
+	err = ioutil.WriteFile(hanging, []byte("#!/bin/sh\nexec sleep 30\n"), 0755)
+	if err != nil {
+		t.Fatalf("Could not write stub hook: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = RunPostHook(ctx, hanging, "somebook", "wip/somebook", "")
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("Expected a timeout error, got %v", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Fatalf("Expected hook to be killed once it timed out")
+	}
+}
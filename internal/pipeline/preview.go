@@ -0,0 +1,112 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"rescribe.xyz/preproc"
+)
+
+// PreprocSettings are the parameters used to binarise and wipe page
+// images with preproc.PreProcMulti.
+type PreprocSettings struct {
+	BinType          string `json:"bintype"`          // binarisation type, "binary" or "zeroinv"
+	BinWsize         int    `json:"binwsize"`         // sauvola window size, set automatically if 0
+	WipeWsize        int    `json:"wipewsize"`        // window size for wiping
+	WipeMinWidthPerc int    `json:"wipeminwidthperc"` // minimum content width, as a percentage of the page width
+	WipeMinHeight    int    `json:"wipeminheight"`    // minimum content height
+	WipeEdgeMax      int    `json:"wipeedgemax"`      // maximum amount to wipe from each edge
+}
+
+// DefaultPreprocSettings are the settings used by Preprocess.
+var DefaultPreprocSettings = PreprocSettings{
+	BinType:          "binary",
+	BinWsize:         0,
+	WipeWsize:        5,
+	WipeMinWidthPerc: 30,
+	WipeMinHeight:    120,
+	WipeEdgeMax:      30,
+}
+
+// preprocMulti binarises the image at path with each of thresholds,
+// wiping it too if wipe is set, returning the paths of the results.
+func preprocMulti(path string, thresholds []float64, wipe bool, s PreprocSettings) ([]string, error) {
+	return preproc.PreProcMulti(path, thresholds, s.BinType, s.BinWsize, wipe, s.WipeWsize, s.WipeMinWidthPerc, s.WipeMinHeight, s.WipeEdgeMax)
+}
+
+// Preview runs the preprocessing used by Preprocess on a single page
+// image, so that the settings can be checked before a whole book is
+// processed. A binarised version of the image is saved in outdir for
+// each threshold, and if wipe is set a wiped version of each too,
+// named with _wiped before the _bin part. The original image is left
+// untouched, and the paths of the results are returned.
+func Preview(path string, outdir string, thresholds []float64, wipe bool, s PreprocSettings) ([]string, error) {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(filepath.Base(path), ext)
+	// preproc drops any dots when naming its results, so avoid them
+	base = strings.ReplaceAll(base, ".", "_")
+
+	names := []string{base}
+	if wipe {
+		names = append(names, base+"_wiped")
+	}
+
+	// the image is copied into a temporary directory to preprocess
+	// it, so that the original is never overwritten, even if outdir
+	// is the directory it is in
+	tmpdir, err := MkTempDir("bookpipelinepreview")
+	if err != nil {
+		return []string{}, fmt.Errorf("Error creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	var done []string
+	for i, name := range names {
+		fn := filepath.Join(tmpdir, name+ext)
+		err := copyFile(path, fn)
+		if err != nil {
+			return done, err
+		}
+		results, err := preprocMulti(fn, thresholds, i > 0, s)
+		if err != nil {
+			return done, fmt.Errorf("Error preprocessing %s: %v", path, err)
+		}
+		for _, r := range results {
+			outfn := filepath.Join(outdir, filepath.Base(r))
+			err = copyFile(r, outfn)
+			if err != nil {
+				return done, err
+			}
+			done = append(done, outfn)
+		}
+	}
+
+	return done, nil
+}
+
+// copyFile copies the file at src to dst
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("Error opening %s: %v", src, err)
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("Error creating %s: %v", dst, err)
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return fmt.Errorf("Error copying %s to %s: %v", src, dst, err)
+	}
+	return out.Close()
+}
@@ -0,0 +1,103 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func Test_Preview(t *testing.T) {
+	cases := []struct {
+		name       string
+		thresholds []float64
+		wipe       bool
+		expected   []string
+	}{
+		{"single", []float64{0.1}, false, []string{"1_bin0.1.png"}},
+		{"multiple", []float64{0.1, 0.2, 0.3}, false, []string{"1_bin0.1.png", "1_bin0.2.png", "1_bin0.3.png"}},
+		{"wipe", []float64{0.1, 0.2}, true, []string{"1_bin0.1.png", "1_bin0.2.png", "1_wiped_bin0.1.png", "1_wiped_bin0.2.png"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "previewtest")
+			if err != nil {
+				t.Fatalf("Could not create temporary directory: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			done, err := Preview("testdata/good/1.png", dir, c.thresholds, c.wipe, DefaultPreprocSettings)
+			if err != nil {
+				t.Fatalf("Error in Preview: %v", err)
+			}
+
+			var names []string
+			for _, fn := range done {
+				_, err = os.Stat(fn)
+				if err != nil {
+					t.Fatalf("Result %s was not saved: %v", fn, err)
+				}
+				names = append(names, filepath.Base(fn))
+			}
+			sort.Strings(names)
+			if strings.Join(names, " ") != strings.Join(c.expected, " ") {
+				t.Fatalf("Expected results %v, got %v", c.expected, names)
+			}
+
+			// only the results should be left in the output directory
+			found, err := ioutil.ReadDir(dir)
+			if err != nil {
+				t.Fatalf("Could not read directory: %v", err)
+			}
+			if len(found) != len(c.expected) {
+				t.Fatalf("Expected %d files in output directory, got %d", len(c.expected), len(found))
+			}
+		})
+	}
+
+	_, err := os.Stat("testdata/good/1.png")
+	if err != nil {
+		t.Fatalf("Original image was removed: %v", err)
+	}
+}
+
+func Test_PreviewSameDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "previewtest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	orig, err := ioutil.ReadFile("testdata/good/1.png")
+	if err != nil {
+		t.Fatalf("Could not read test image: %v", err)
+	}
+	path := filepath.Join(dir, "1.png")
+	err = ioutil.WriteFile(path, orig, 0644)
+	if err != nil {
+		t.Fatalf("Could not copy test image: %v", err)
+	}
+
+	done, err := Preview(path, dir, []float64{0.1}, true, DefaultPreprocSettings)
+	if err != nil {
+		t.Fatalf("Error in Preview: %v", err)
+	}
+	if len(done) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(done))
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Original image was removed: %v", err)
+	}
+	if string(b) != string(orig) {
+		t.Fatalf("Original image was changed")
+	}
+}
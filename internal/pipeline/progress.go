@@ -0,0 +1,234 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProgressFile is the name of the file that the progress of a book
+// through the current stage of the pipeline is saved to. It is
+// saved alongside the images of the book.
+const ProgressFile = "progress.json"
+
+// progressInterval is the minimum time between progress updates
+// being uploaded while a stage is running
+var progressInterval = time.Minute
+
+// Progress records how far a book has got through a stage of the
+// pipeline.
+type Progress struct {
+	Stage   string    `json:"stage"`
+	Done    int       `json:"done"`
+	Total   int       `json:"total"`
+	Updated time.Time `json:"updated"`
+}
+
+// Stalled returns whether the progress hasn't been updated for longer
+// than d at time t. Progress which has never been written is not
+// considered stalled.
+func (p Progress) Stalled(t time.Time, d time.Duration) bool {
+	if p.Updated.IsZero() {
+		return false
+	}
+	return t.Sub(p.Updated) > d
+}
+
+func (p Progress) String() string {
+	return fmt.Sprintf("%s: %d/%d pages", p.Stage, p.Done, p.Total)
+}
+
+// UploadProgress saves the progress of a book as JSON, and uploads it
+// to the book's directory in conn.WIPStorageId(). If the Updated time
+// isn't set, it is set to the current time.
+func UploadProgress(conn Uploader, bookname string, p Progress) error {
+	if p.Updated.IsZero() {
+		p.Updated = now()
+	}
+	return uploadJSON(conn, bookname+"/"+ProgressFile, p)
+}
+
+// GetProgress downloads and parses the progress of a book. If no
+// progress has been saved for the book, an empty Progress is
+// returned.
+func GetProgress(conn DownloadLister, bookname string) (Progress, error) {
+	var p Progress
+	_, err := downloadJSON(conn, bookname+"/"+ProgressFile, &p)
+	return p, err
+}
+
+// pageName returns the name of the page that a file belongs to, so
+// that for example 0001.jpg, 0001_bin0.2.png, 0001_bin0.2.hocr,
+// 0001_psm6.hocr and 0001_rot180.hocr are all counted as page 0001.
+// The suffixes are removed in the same way as by HocrImage.
+func pageName(fn string) string {
+	name := filepath.Base(fn)
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	name = psmPattern.ReplaceAllString(name, "")
+	name = strings.TrimSuffix(name, rotatedSuffix)
+	if i := strings.Index(name, "_bin"); i != -1 {
+		name = name[:i]
+	}
+	return name
+}
+
+// countPages returns the number of different pages in a list of files
+func countPages(fns []string) int {
+	pages := make(map[string]bool)
+	for _, fn := range fns {
+		pages[pageName(fn)] = true
+	}
+	return len(pages)
+}
+
+// stageName returns the name of the stage of the pipeline which
+// handles messages from queue
+func stageName(conn Queuer, queue string) string {
+	switch queue {
+	case conn.PreQueueId(), conn.PreNoWipeQueueId():
+		return "preprocess"
+	case conn.WipeQueueId():
+		return "wipeonly"
+	case conn.OCRPageQueueId():
+		return "ocrpage"
+	case conn.AnalyseQueueId():
+		return "analyse"
+	}
+	return queue
+}
+
+// countProgress passes file names from in to out, keeping count of
+// the pages which have been passed on to be processed. The progress
+// is uploaded when the first page is passed on, and then at most
+// every progressInterval. Failing to upload progress is logged, but
+// doesn't stop anything, as it is only informational.
+func countProgress(in chan string, out chan string, conn Uploader, bookname string, stage string, total int) {
+	pages := make(map[string]bool)
+	var last time.Time
+	for fn := range in {
+		out <- fn
+		pages[pageName(fn)] = true
+		if now().Sub(last) < progressInterval {
+			continue
+		}
+		last = now()
+		err := UploadProgress(conn, bookname, Progress{Stage: stage, Done: len(pages), Total: total})
+		if err != nil {
+			conn.Log("Error saving progress", err)
+		}
+	}
+	close(out)
+}
+
+// progressThrottle limits how often the progress of each book is
+// uploaded by stages where each page is handled by a separate job,
+// like OcrPage, to at most every progressInterval, in the same way
+// as countProgress does for stages which handle a whole book.
+type progressThrottle struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+// ocrPageProgress throttles the progress uploaded by OcrPage
+var ocrPageProgress = progressThrottle{last: make(map[string]time.Time)}
+
+// due returns whether the progress of a book should be uploaded now,
+// which it should be if it hasn't been within progressInterval, or
+// if final is set, in which case the book is then forgotten.
+func (p *progressThrottle) due(bookname string, final bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if final {
+		delete(p.last, bookname)
+		return true
+	}
+	if last, ok := p.last[bookname]; ok && now().Sub(last) < progressInterval {
+		return false
+	}
+	p.last[bookname] = now()
+	return true
+}
+
+// ocrPageCache caches the preprocessed pages of each book which were
+// missing hOCR when the book was last listed by OcrPage, so that the
+// whole book only needs to be listed at most every progressInterval,
+// rather than after every page is OCRed.
+type ocrPageCache struct {
+	mu    sync.Mutex
+	books map[string]*ocrPageState
+}
+
+// ocrPageState is the state of a book cached by ocrPageCache
+type ocrPageState struct {
+	missing []string
+	total   int
+	listed  time.Time
+}
+
+// ocrPages is the cache used by OcrPage
+var ocrPages = ocrPageCache{books: make(map[string]*ocrPageState)}
+
+// progress returns the number of preprocessed page images of a book
+// which have been OCRed, and the total number of them, once page has
+// been. The whole book is only listed if it hasn't been within
+// progressInterval, or if every page cached as missing hOCR has since
+// been OCRed, so that the book is never wrongly found to be complete.
+// Otherwise the pages cached as missing are checked one at a time,
+// stopping at the first which is still missing, so the number OCRed
+// may be lower than it really is, but never higher.
+func (c *ocrPageCache) progress(conn Lister, bookname string, page string, psms []int) (int, int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, ok := c.books[bookname]
+	if ok && now().Sub(s.listed) < progressInterval {
+		for len(s.missing) > 0 {
+			if s.missing[0] != page {
+				ocred, err := pageHasHocr(conn, s.missing[0], psms)
+				if err != nil {
+					return 0, 0, err
+				}
+				if !ocred {
+					return s.total - len(s.missing), s.total, nil
+				}
+			}
+			s.missing = s.missing[1:]
+		}
+	}
+
+	missing, total, err := pagesMissingHocr(bookname, conn, psms)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(missing) == 0 {
+		delete(c.books, bookname)
+	} else {
+		c.books[bookname] = &ocrPageState{missing: missing, total: total, listed: now()}
+	}
+	return total - len(missing), total, nil
+}
+
+// pageHasHocr returns whether a preprocessed page image has a
+// corresponding .hocr file, and one for each of the page segmentation
+// modes psms, listing only the files for that page.
+func pageHasHocr(conn Lister, page string, psms []int) (bool, error) {
+	objs, err := conn.ListObjects(conn.WIPStorageId(), strings.TrimSuffix(page, ".png"))
+	if err != nil {
+		return false, err
+	}
+	found := false
+	hocrs := make(map[string]bool)
+	for _, o := range objs {
+		if strings.HasSuffix(o, ".hocr") && HocrImage(o) == page {
+			found = true
+			hocrs[o] = true
+		}
+	}
+	return found && hasPsmHocrs(page, hocrs, psms), nil
+}
@@ -0,0 +1,242 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+// progressConn is a fakeConn which records each progress update
+// which is uploaded
+type progressConn struct {
+	*fakeConn
+	progress []Progress
+}
+
+func (p *progressConn) Upload(bucket string, key string, path string) error {
+	if strings.HasSuffix(key, "/"+ProgressFile) {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var pr Progress
+		err = json.Unmarshal(b, &pr)
+		if err != nil {
+			return err
+		}
+		p.mu.Lock()
+		p.progress = append(p.progress, pr)
+		p.mu.Unlock()
+	}
+	return p.fakeConn.Upload(bucket, key, path)
+}
+
+func Test_ProcessBookProgress(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	conn := &progressConn{fakeConn: &fakeConn{LocalConn: newTestConn(t, vlog)}}
+
+	for _, n := range []string{"0001.jpg", "0002.jpg", "0003.jpg"} {
+		err := conn.Upload(conn.WIPStorageId(), "progresstest/"+n, "testdata/good/1.png")
+		if err != nil {
+			t.Fatalf("Could not upload test file: %v", err)
+		}
+	}
+
+	// a process which just passes each file on to be uploaded
+	process := func(ctx context.Context, in chan string, up chan string, errc chan error, logger *log.Logger) {
+		for fn := range in {
+			up <- fn
+		}
+		close(up)
+	}
+
+	oldinterval := progressInterval
+	progressInterval = 0
+	defer func() { progressInterval = oldinterval }()
+
+	msg := bookpipeline.Qmsg{Id: "1", Handle: "progresstest", Body: "progresstest"}
+	err := ProcessBook(context.Background(), msg, conn, process, regexp.MustCompile(`.jpg$`), conn.PreQueueId(), "")
+	if err != nil {
+		t.Fatalf("Error processing book: %v\nLog: %s", err, slog.log)
+	}
+
+	expected := []int{1, 2, 3, 3}
+	if len(conn.progress) != len(expected) {
+		t.Fatalf("Expected %d progress updates, got %v\nLog: %s", len(expected), conn.progress, slog.log)
+	}
+	for i, p := range conn.progress {
+		if p.Stage != "preprocess" || p.Done != expected[i] || p.Total != 3 {
+			t.Fatalf("Expected update %d to be preprocess: %d/3 pages, got %s", i, expected[i], p)
+		}
+		if p.Updated.IsZero() {
+			t.Fatalf("Update time not set for update %d", i)
+		}
+	}
+
+	p, err := GetProgress(conn, "progresstest")
+	if err != nil {
+		t.Fatalf("Error getting progress: %v", err)
+	}
+	if p.Done != 3 || p.Total != 3 || !p.Updated.Equal(conn.progress[3].Updated) {
+		t.Fatalf("Saved progress %v differs from the last update %v", p, conn.progress[3])
+	}
+
+	p, err = GetProgress(conn, "missingbook")
+	if err != nil {
+		t.Fatalf("Error getting progress for missing book: %v", err)
+	}
+	if !p.Updated.IsZero() {
+		t.Fatalf("Expected empty progress for missing book, got %v", p)
+	}
+}
+
+func Test_ProgressStalled(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	conn := newTestConn(t, vlog)
+
+	start := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name     string
+		updated  time.Time
+		expected bool
+	}{
+		{"recent", start.Add(-5 * time.Minute), false},
+		{"stale", start.Add(-2 * time.Hour), true},
+		{"never", time.Time{}, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if !c.updated.IsZero() {
+				err := UploadProgress(conn, c.name, Progress{Stage: "ocrpage", Done: 1, Total: 10, Updated: c.updated})
+				if err != nil {
+					t.Fatalf("Error uploading progress: %v", err)
+				}
+			}
+			p, err := GetProgress(conn, c.name)
+			if err != nil {
+				t.Fatalf("Error getting progress: %v", err)
+			}
+			if p.Stalled(start, 30*time.Minute) != c.expected {
+				t.Fatalf("Expected stalled to be %v for progress updated at %v", c.expected, p.Updated)
+			}
+		})
+	}
+}
+
+func Test_progressThrottle(t *testing.T) {
+	start := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	current := start
+	oldnow := now
+	now = func() time.Time { return current }
+	defer func() { now = oldnow }()
+
+	p := progressThrottle{last: make(map[string]time.Time)}
+	steps := []struct {
+		after    time.Duration
+		book     string
+		final    bool
+		expected bool
+	}{
+		{0, "book1", false, true},
+		{10 * time.Second, "book1", false, false},
+		{10 * time.Second, "book2", false, true},
+		{20 * time.Second, "book1", true, true},
+		{30 * time.Second, "book2", false, false},
+		{71 * time.Second, "book2", false, true},
+		{72 * time.Second, "book1", false, true},
+	}
+	for _, s := range steps {
+		current = start.Add(s.after)
+		if due := p.due(s.book, s.final); due != s.expected {
+			t.Fatalf("Expected due to be %v for %s after %v, got %v", s.expected, s.book, s.after, due)
+		}
+	}
+}
+
+// listCountConn is a LocalConn which counts how many times the whole
+// of a book is listed
+type listCountConn struct {
+	*bookpipeline.LocalConn
+	booklists int
+}
+
+func (l *listCountConn) ListObjects(bucket string, prefix string) ([]string, error) {
+	if !strings.Contains(prefix, "/") {
+		l.booklists++
+	}
+	return l.LocalConn.ListObjects(bucket, prefix)
+}
+
+func Test_ocrPageCache(t *testing.T) {
+	vlog := log.New(ioutil.Discard, "", 0)
+	conn := &listCountConn{LocalConn: newTestConn(t, vlog)}
+
+	pages := []string{"book/0001_bin0.2.png", "book/0002_bin0.2.png", "book/0003_bin0.2.png"}
+	for _, pg := range pages {
+		err := conn.Upload(conn.WIPStorageId(), pg, "testdata/good/1.png")
+		if err != nil {
+			t.Fatalf("Could not upload test file: %v", err)
+		}
+	}
+	ocr := func(pg string) {
+		err := conn.Upload(conn.WIPStorageId(), strings.TrimSuffix(pg, ".png")+".hocr", "testdata/good/1.png")
+		if err != nil {
+			t.Fatalf("Could not upload hOCR: %v", err)
+		}
+	}
+
+	start := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	current := start
+	oldnow := now
+	now = func() time.Time { return current }
+	defer func() { now = oldnow }()
+
+	c := ocrPageCache{books: make(map[string]*ocrPageState)}
+	steps := []struct {
+		after     time.Duration
+		page      string
+		ocred     int
+		booklists int
+	}{
+		{0, pages[1], 1, 1},
+		// the first missing page is checked and found to be
+		// missing, so the book isn't listed again
+		{10 * time.Second, pages[2], 1, 1},
+		// once every cached page has been OCRed the book is listed
+		// to confirm it is complete
+		{20 * time.Second, pages[0], 3, 2},
+	}
+	for _, s := range steps {
+		current = start.Add(s.after)
+		ocr(s.page)
+		ocred, total, err := c.progress(conn, "book", s.page, nil)
+		if err != nil {
+			t.Fatalf("Error getting progress: %v", err)
+		}
+		if ocred != s.ocred || total != len(pages) {
+			t.Fatalf("Expected %d/%d pages OCRed after %s, got %d/%d", s.ocred, len(pages), s.page, ocred, total)
+		}
+		if conn.booklists != s.booklists {
+			t.Fatalf("Expected the book to be listed %d times after %s, got %d", s.booklists, s.page, conn.booklists)
+		}
+	}
+	if _, ok := c.books["book"]; ok {
+		t.Fatalf("Expected complete book to be removed from the cache")
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"rescribe.xyz/bookpipeline/internal/postproc"
+)
+
+type Publisher interface {
+	Copy(srcbucket string, srckey string, dstbucket string, dstkey string) error
+	Download(bucket string, key string, fn string) error
+	ListObjects(bucket string, prefix string) ([]string, error)
+	Log(v ...interface{})
+	Upload(bucket string, key string, path string) error
+	WIPStorageId() string
+}
+
+// publishFiles are the files created by Analyse which are always
+// published, in addition to any PDFs and the best hOCR files
+var publishFiles = []string{"best", "graph.png", "words.jsonl", MetaFile}
+
+// bestHocrs returns the hOCR files listed in the best file of a book,
+// which is downloaded into d
+func bestHocrs(conn Publisher, bookname string, d string) (map[string]bool, error) {
+	hocrs := make(map[string]bool)
+
+	fn := filepath.Join(d, "best")
+	err := conn.Download(conn.WIPStorageId(), bookname+"/best", fn)
+	if err != nil {
+		return hocrs, fmt.Errorf("Error downloading best file for %s: %v", bookname, err)
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return hocrs, fmt.Errorf("Error opening best file %s: %v", fn, err)
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if s.Text() != "" {
+			hocrs[s.Text()] = true
+		}
+	}
+	return hocrs, s.Err()
+}
+
+// publishText saves the text of each best hOCR file of a book, apart
+// from any pages which are excluded, as a .txt file with the same name
+// as the hOCR, as in the archive made by Analyse, and uploads it to
+// bucket, named prefix/filename. The text rules given are applied to
+// the text of each page. The files are saved in d. It returns the
+// names of the files uploaded.
+func publishText(conn Publisher, bookname string, hocrs map[string]bool, d string, bucket string, prefix string, rules []postproc.Rule) ([]string, error) {
+	var published []string
+
+	var excl PageExclusions
+	excludefn := filepath.Join(d, ExcludeFile)
+	err := conn.Download(conn.WIPStorageId(), bookname+"/"+ExcludeFile, excludefn)
+	if err == nil {
+		excl, err = ReadPageExclusions(excludefn)
+		if err != nil {
+			return published, err
+		}
+	}
+
+	var names []string
+	for h := range hocrs {
+		if !excl.Excluded(h) {
+			names = append(names, h)
+		}
+	}
+	sort.Strings(names)
+
+	for _, h := range names {
+		hocrfn := filepath.Join(d, h)
+		err = conn.Download(conn.WIPStorageId(), bookname+"/"+h, hocrfn)
+		if err != nil {
+			return published, fmt.Errorf("Error downloading %s: %v", h, err)
+		}
+		text, err := hocrText(hocrfn, rules)
+		if err != nil {
+			return published, err
+		}
+		name := strings.TrimSuffix(h, ".hocr") + ".txt"
+		fn := filepath.Join(d, name)
+		err = ioutil.WriteFile(fn, []byte(text), 0644)
+		if err != nil {
+			return published, fmt.Errorf("Error saving text %s: %v", fn, err)
+		}
+		dst := path.Join(prefix, name)
+		conn.Log("Publishing text of", h, "to", bucket+"/"+dst)
+		err = conn.Upload(bucket, dst, fn)
+		if err != nil {
+			return published, fmt.Errorf("Error uploading %s to %s: %v", fn, bucket+"/"+dst, err)
+		}
+		published = append(published, name)
+	}
+	return published, nil
+}
+
+// Publish copies the final results of a completed book (the PDFs,
+// the best hOCR files, the best file itself, the confidence graph,
+// the words file, any archive of the results and any metadata) to
+// bucket, with each file named prefix/filename, along with the text
+// of each page, as with publishText, with the text rules given
+// applied to it. The working copy of the book is left untouched. It
+// returns the names of the files published.
+func Publish(conn Publisher, bookname string, bucket string, prefix string, rules []postproc.Rule) ([]string, error) {
+	var published []string
+
+	d, err := MkTempDir("bookpipelinepublish")
+	if err != nil {
+		return published, fmt.Errorf("Error creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(d)
+
+	hocrs, err := bestHocrs(conn, bookname, d)
+	if err != nil {
+		return published, err
+	}
+
+	objs, err := conn.ListObjects(conn.WIPStorageId(), bookname+"/")
+	if err != nil {
+		return published, fmt.Errorf("Error listing files for %s: %v", bookname, err)
+	}
+
+	for _, o := range objs {
+		if !strings.HasPrefix(o, bookname+"/") {
+			continue
+		}
+		name := strings.TrimPrefix(o, bookname+"/")
+		publish := path.Ext(name) == ".pdf" || hocrs[name] || name == TarName(bookname, false) || name == TarName(bookname, true)
+		for _, f := range publishFiles {
+			if name == f {
+				publish = true
+			}
+		}
+		if !publish {
+			continue
+		}
+		dst := path.Join(prefix, name)
+		conn.Log("Publishing", o, "to", bucket+"/"+dst)
+		err = conn.Copy(conn.WIPStorageId(), o, bucket, dst)
+		if err != nil {
+			return published, fmt.Errorf("Error copying %s to %s: %v", o, bucket+"/"+dst, err)
+		}
+		published = append(published, name)
+	}
+
+	text, err := publishText(conn, bookname, hocrs, d, bucket, prefix, rules)
+	published = append(published, text...)
+	return published, err
+}
@@ -0,0 +1,134 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"rescribe.xyz/bookpipeline/internal/postproc"
+)
+
+func Test_Publish(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	conn := newTestConn(t, vlog)
+	dir := conn.TempDir
+
+	files := map[string]string{
+		"0001.jpg":                  "",
+		"0001_bin0.1.png":           "",
+		"0001_bin0.1.hocr":          "",
+		"0001_bin0.2.png":           "",
+		"0001_bin0.2.hocr":          "",
+		"0002_bin0.1.hocr":          "",
+		"0002_bin0.2.hocr":          "",
+		"best":                      "0001_bin0.2.hocr\n0002_bin0.1.hocr\n",
+		"conf":                      "",
+		"graph.png":                 "",
+		"words.jsonl":               "",
+		"meta.json":                 "{}",
+		"publishtest.colour.pdf":    "",
+		"publishtest.binarised.pdf": "",
+		"publishtest.tar.gz":        "",
+	}
+	hocrs := map[string]string{
+		"0001_bin0.2.hocr": "first",
+		"0002_bin0.1.hocr": "second",
+	}
+	for name, content := range files {
+		fn := filepath.Join(dir, "upload")
+		var err error
+		if text, ok := hocrs[name]; ok {
+			err = writeHocr(fn, 80, text, "page")
+		} else {
+			err = ioutil.WriteFile(fn, []byte(content), 0644)
+		}
+		if err != nil {
+			t.Fatalf("Could not write test file: %v", err)
+		}
+		err = conn.Upload(conn.WIPStorageId(), "publishtest/"+name, fn)
+		if err != nil {
+			t.Fatalf("Could not upload test file: %v", err)
+		}
+	}
+	// a book with a similar name which shouldn't be published
+	err := conn.Upload(conn.WIPStorageId(), "publishtest2/publishtest2.colour.pdf", filepath.Join(dir, "upload"))
+	if err != nil {
+		t.Fatalf("Could not upload test file: %v", err)
+	}
+
+	rules := []postproc.Rule{{Pattern: regexp.MustCompile(`second`), Replacement: "2nd"}}
+	published, err := Publish(conn, "publishtest", "published", "books/publishtest", rules)
+	if err != nil {
+		t.Fatalf("Error publishing book: %v\nLog: %s", err, slog.log)
+	}
+
+	expected := []string{
+		"0001_bin0.2.hocr",
+		"0001_bin0.2.txt",
+		"0002_bin0.1.hocr",
+		"0002_bin0.1.txt",
+		"best",
+		"graph.png",
+		"meta.json",
+		"publishtest.binarised.pdf",
+		"publishtest.colour.pdf",
+		"publishtest.tar.gz",
+		"words.jsonl",
+	}
+
+	sort.Strings(published)
+	if strings.Join(published, " ") != strings.Join(expected, " ") {
+		t.Fatalf("Expected to publish %v, got %v", expected, published)
+	}
+
+	var found []string
+	pubdir := filepath.Join(dir, "published", "books", "publishtest")
+	err = filepath.Walk(filepath.Join(dir, "published"), func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			found = append(found, strings.TrimPrefix(p, pubdir+string(os.PathSeparator)))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error walking published files: %v", err)
+	}
+	sort.Strings(found)
+	if strings.Join(found, " ") != strings.Join(expected, " ") {
+		t.Fatalf("Expected published files %v, got %v", expected, found)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(pubdir, "best"))
+	if err != nil {
+		t.Fatalf("Could not read published best file: %v", err)
+	}
+	if string(b) != files["best"] {
+		t.Fatalf("Published best file differs from original")
+	}
+
+	b, err = ioutil.ReadFile(filepath.Join(pubdir, "0002_bin0.1.txt"))
+	if err != nil {
+		t.Fatalf("Could not read published text: %v", err)
+	}
+	if strings.TrimSpace(string(b)) != "2nd page" {
+		t.Fatalf("Expected published text to be '2nd page' after the text rules were applied, got '%s'", b)
+	}
+
+	_, err = os.Stat(filepath.Join(dir, conn.WIPStorageId(), "publishtest", "best"))
+	if err != nil {
+		t.Fatalf("Original best file was changed: %v", err)
+	}
+}
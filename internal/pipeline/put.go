@@ -10,10 +10,10 @@ import (
 	"image"
 	_ "image/jpeg"
 	_ "image/png"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
 // null writer to enable non-verbose logging to be discarded
@@ -42,22 +42,42 @@ func (f fileWalk) Walk(path string, info os.FileInfo, err error) error {
 	return nil
 }
 
+// checkImage checks that the file at path is an image that can be
+// decoded
+func checkImage(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Opening image %s failed: %v", path, err)
+	}
+	defer f.Close()
+	_, _, err = image.Decode(f)
+	if err != nil {
+		return fmt.Errorf("Decoding image %s failed: %v", path, err)
+	}
+	return nil
+}
+
+// DefaultCheckWorkers is the number of images CheckImages and
+// CheckImageList decode at once if no other number is given. It is
+// kept small as large colour images can each take a lot of memory
+// once decoded.
+const DefaultCheckWorkers = 4
+
 // CheckImages checks that all files with a ".jpg" or ".png" suffix
-// in a directory are images that can be decoded (skipping dotfiles)
-func CheckImages(ctx context.Context, dir string) error {
+// in a directory are images that can be decoded (skipping dotfiles).
+// Up to workers images are decoded at once, or DefaultCheckWorkers if
+// workers is less than 1. If any fail, the error returned is for the
+// first in the order they were found, as if they had been checked one
+// at a time.
+func CheckImages(ctx context.Context, dir string, workers int) error {
 	checker := make(fileWalk)
 	go func() {
 		_ = filepath.Walk(dir, checker.Walk)
 		close(checker)
 	}()
 
-	n := 0
+	var paths []string
 	for path := range checker {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-		}
 		suffix := filepath.Ext(path)
 		lsuffix := strings.ToLower(suffix)
 		if lsuffix == ".jpeg" {
@@ -66,22 +86,63 @@ func CheckImages(ctx context.Context, dir string) error {
 		if lsuffix != ".jpg" && lsuffix != ".png" {
 			continue
 		}
-		f, err := os.Open(path)
-		if err != nil {
-			return fmt.Errorf("Opening image %s failed: %v", path, err)
-		}
-		_, _, err = image.Decode(f)
-		if err != nil {
-			return fmt.Errorf("Decoding image %s failed: %v", path, err)
-		}
-		n++
+		paths = append(paths, path)
 	}
 
-	if n == 0 {
+	if len(paths) == 0 {
 		return fmt.Errorf("No images found")
 	}
 
-	return nil
+	return checkImages(ctx, paths, workers)
+}
+
+// checkImages checks that each image in paths can be decoded with
+// checkImage, using up to workers at once, or DefaultCheckWorkers if
+// workers is less than 1. Once an image fails no more are started.
+// As the images are started in order, every image before one which
+// failed will have been checked, so the error returned is always for
+// the first image in paths which can't be decoded, the same as if
+// they were checked one at a time.
+func checkImages(ctx context.Context, paths []string, workers int) error {
+	if workers < 1 {
+		workers = DefaultCheckWorkers
+	}
+	failctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make([]error, len(paths))
+	todo := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range todo {
+				errs[n] = checkImage(paths[n])
+				if errs[n] != nil {
+					cancel()
+				}
+			}
+		}()
+	}
+
+queue:
+	for n := range paths {
+		select {
+		case <-failctx.Done():
+			break queue
+		case todo <- n:
+		}
+	}
+	close(todo)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
 }
 
 // DetectQueueType returns which queue to use based on the whether
@@ -100,41 +161,26 @@ func DetectQueueType(dir string, conn Queuer, nowipe bool) string {
 // 0001, to ensure they are appropriately named for further processing
 // in the pipeline.
 func UploadImages(ctx context.Context, dir string, bookname string, conn Uploader) error {
-	files, err := ioutil.ReadDir(dir)
+	pages, err := pageNames(dir)
 	if err != nil {
-		fmt.Errorf("Failed to read directory %s: %v", dir, err)
+		return err
 	}
+	return uploadPages(ctx, pages, bookname, conn)
+}
 
-	filenum := 0
-	for _, file := range files {
+// uploadPages uploads each page image into conn.WIPStorageId(), in
+// order, prefixed with the given bookname and a slash
+func uploadPages(ctx context.Context, pages []pageFile, bookname string, conn Uploader) error {
+	for _, pg := range pages {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		default:
 		}
-		if file.IsDir() {
-			continue
-		}
-		origsuffix := filepath.Ext(file.Name())
-		lsuffix := strings.ToLower(origsuffix)
-		if lsuffix == ".jpeg" {
-			lsuffix = ".jpg"
-		}
-		if lsuffix != ".jpg" && lsuffix != ".png" {
-			continue
-		}
-		origname := file.Name()
-		origbase := strings.TrimSuffix(origname, origsuffix)
-		origpath := filepath.Join(dir, origname)
-
-		safebase := strings.ReplaceAll(origbase, " ", "_")
-		newname := fmt.Sprintf("%s_%04d%s", safebase, filenum, lsuffix)
-		err = conn.Upload(conn.WIPStorageId(), filepath.Join(bookname, newname), origpath)
+		err := conn.Upload(conn.WIPStorageId(), filepath.Join(bookname, pg.name), pg.path)
 		if err != nil {
-			return fmt.Errorf("Failed to upload %s: %v", origpath, err)
+			return fmt.Errorf("Failed to upload %s: %v", pg.path, err)
 		}
-
-		filenum++
 	}
 
 	return nil
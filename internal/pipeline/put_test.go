@@ -5,10 +5,17 @@
 package pipeline
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"rescribe.xyz/bookpipeline"
+	"runtime"
 	"testing"
 )
 
@@ -31,7 +38,7 @@ func Test_CheckImages(t *testing.T) {
 				}
 			}
 
-			err := CheckImages(c.dir)
+			err := CheckImages(context.Background(), c.dir, 0)
 			if err == nil && c.err != nil {
 				t.Fatalf("Expected error '%v', got no error", c.err)
 			}
@@ -52,6 +59,98 @@ func Test_CheckImages(t *testing.T) {
 	}
 }
 
+// writeCheckImages saves n png images to dir, of the size given,
+// replacing those numbered in bad with files which can't be decoded
+func writeCheckImages(dir string, n int, size int, bad map[int]bool) error {
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	for i := 0; i < n; i++ {
+		fn := filepath.Join(dir, fmt.Sprintf("%04d.png", i))
+		if bad[i] {
+			err := ioutil.WriteFile(fn, []byte("not a png"), 0644)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		f, err := os.Create(fn)
+		if err != nil {
+			return err
+		}
+		err = png.Encode(f, img)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Test_CheckImagesParallel checks that checking images in parallel
+// finds the same bad image as checking them one at a time
+func Test_CheckImagesParallel(t *testing.T) {
+	cases := []struct {
+		name string
+		bad  map[int]bool
+	}{
+		{"good", nil},
+		{"first", map[int]bool{0: true}},
+		{"one", map[int]bool{37: true}},
+		{"several", map[int]bool{5: true, 6: true, 30: true, 59: true}},
+		{"last", map[int]bool{59: true}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "checkimagestest")
+			if err != nil {
+				t.Fatalf("Could not create temporary directory: %v", err)
+			}
+			defer os.RemoveAll(dir)
+			err = writeCheckImages(dir, 60, 10, c.bad)
+			if err != nil {
+				t.Fatalf("Could not write images: %v", err)
+			}
+
+			serial := CheckImages(context.Background(), dir, 1)
+			if (serial == nil) != (len(c.bad) == 0) {
+				t.Fatalf("Unexpected result checking images serially: %v", serial)
+			}
+			// repeat to give any differences in scheduling a chance
+			// to change the result
+			for i := 0; i < 10; i++ {
+				for _, workers := range []int{0, 2, 8, 100} {
+					err = CheckImages(context.Background(), dir, workers)
+					if fmt.Sprint(err) != fmt.Sprint(serial) {
+						t.Fatalf("Checking with %d workers gave a different result to checking serially: expected '%v', got '%v'", workers, serial, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func benchmarkCheckImages(b *testing.B, workers int) {
+	dir, err := ioutil.TempDir("", "checkimagesbench")
+	if err != nil {
+		b.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	err = writeCheckImages(dir, 50, 1000, nil)
+	if err != nil {
+		b.Fatalf("Could not write images: %v", err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err = CheckImages(context.Background(), dir, workers)
+		if err != nil {
+			b.Fatalf("Error checking images: %v", err)
+		}
+	}
+}
+
+func BenchmarkCheckImagesSerial(b *testing.B)   { benchmarkCheckImages(b, 1) }
+func BenchmarkCheckImagesParallel(b *testing.B) { benchmarkCheckImages(b, runtime.NumCPU()) }
+
 func Test_UploadImages(t *testing.T) {
 	var slog StrLog
 	vlog := log.New(&slog, "", 0)
@@ -71,7 +170,7 @@ func Test_UploadImages(t *testing.T) {
 			}
 			slog.log = ""
 
-			err = UploadImages("testdata/good", "good", conn.c)
+			err = UploadImages(context.Background(), "testdata/good", "good", conn.c)
 			if err != nil {
 				t.Fatalf("Error in UploadImages for %s: %v\nLog: %s", conn.name, err, slog.log)
 			}
@@ -0,0 +1,199 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"fmt"
+	"html/template"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/image/draw"
+	"rescribe.xyz/bookpipeline"
+)
+
+// ReportFile is the name of the HTML report written by WriteHtmlReport
+const ReportFile = "report.html"
+
+// ThumbWidth is the width in pixels of the page thumbnails in the
+// HTML report
+const ThumbWidth = 150
+
+// thumbDir is the directory thumbnails are saved in, relative to the
+// report
+const thumbDir = "thumbs"
+
+// reportPage is a page listed in the HTML report
+type reportPage struct {
+	Name  string
+	Conf  float64
+	Image string // path of the page image, relative to the report
+	Thumb string // path of the thumbnail, relative to the report
+}
+
+var reportTmpl = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Bookname}}</title>
+<style>
+td { padding: 0.5em; vertical-align: middle; }
+</style>
+</head>
+<body>
+<h1>{{.Bookname}}</h1>
+<p>{{len .Pages}} pages, listed from the lowest confidence to the highest.</p>
+<table>
+<tr><th>Page</th><th>Confidence</th><th>Image</th></tr>
+{{range .Pages}}<tr>
+<td>{{.Name}}</td>
+<td>{{printf "%.0f" .Conf}}</td>
+<td>{{if .Thumb}}<a href="{{.Image}}"><img src="{{.Thumb}}" alt="{{.Name}}"></a>{{end}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// ReadBestConfs reads the confidences of the best version of each
+// page of a book from the best and conf files written by Analyse in
+// dir. They are keyed by the filename of the best hOCR for each page,
+// which is also set as the Path.
+func ReadBestConfs(dir string) (map[string]*bookpipeline.Conf, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "best"))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading best file: %v", err)
+	}
+	best := make(map[string]bool)
+	for _, l := range strings.Split(string(b), "\n") {
+		if l != "" {
+			best[l] = true
+		}
+	}
+
+	b, err = ioutil.ReadFile(filepath.Join(dir, "conf"))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading conf file: %v", err)
+	}
+	confs := make(map[string]*bookpipeline.Conf)
+	for _, l := range strings.Split(string(b), "\n") {
+		fields := strings.Split(l, "\t")
+		if len(fields) != 2 {
+			continue
+		}
+		base := filepath.Base(fields[0])
+		if !best[base] {
+			continue
+		}
+		var c bookpipeline.Conf
+		_, err = fmt.Sscanf(fields[1], "%f", &c.Conf)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing confidence for %s: %v", base, err)
+		}
+		c.Path = base
+		confs[base] = &c
+	}
+
+	return confs, nil
+}
+
+// writeThumb saves a copy of the image at path scaled to ThumbWidth
+// pixels wide as a JPEG at thumbpath
+func writeThumb(path string, thumbpath string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Error opening image %s: %v", path, err)
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return fmt.Errorf("Error decoding image %s: %v", path, err)
+	}
+
+	b := img.Bounds()
+	if b.Dx() == 0 {
+		return fmt.Errorf("Error making thumbnail of %s: image has no width", path)
+	}
+	h := b.Dy() * ThumbWidth / b.Dx()
+	if h < 1 {
+		h = 1
+	}
+	thumb := image.NewRGBA(image.Rect(0, 0, ThumbWidth, h))
+	draw.ApproxBiLinear.Scale(thumb, thumb.Bounds(), img, b, draw.Src, nil)
+
+	out, err := os.Create(thumbpath)
+	if err != nil {
+		return fmt.Errorf("Error creating thumbnail %s: %v", thumbpath, err)
+	}
+	err = jpeg.Encode(out, thumb, nil)
+	if err != nil {
+		out.Close()
+		return fmt.Errorf("Error encoding thumbnail %s: %v", thumbpath, err)
+	}
+	return out.Close()
+}
+
+// WriteHtmlReport writes an HTML report for a book downloaded to
+// dir, listing its pages from the lowest confidence to the highest,
+// so that the worst pages can be checked first. Each page whose best
+// image (the .png named like its best hOCR) is in dir is shown with
+// a thumbnail, saved in dir/thumbs, linking to the image.
+func WriteHtmlReport(dir string, bookname string) error {
+	confs, err := ReadBestConfs(dir)
+	if err != nil {
+		return err
+	}
+
+	var pages []reportPage
+	for _, c := range confs {
+		name := strings.TrimSuffix(c.Path, ".hocr")
+		pages = append(pages, reportPage{Name: name, Conf: c.Conf})
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		if pages[i].Conf == pages[j].Conf {
+			return pages[i].Name < pages[j].Name
+		}
+		return pages[i].Conf < pages[j].Conf
+	})
+
+	err = os.MkdirAll(filepath.Join(dir, thumbDir), 0755)
+	if err != nil {
+		return fmt.Errorf("Error creating thumbnail directory: %v", err)
+	}
+	for i, p := range pages {
+		img := p.Name + ".png"
+		_, err = os.Stat(filepath.Join(dir, img))
+		if err != nil {
+			continue
+		}
+		thumb := thumbDir + "/" + p.Name + ".jpg"
+		err = writeThumb(filepath.Join(dir, img), filepath.Join(dir, thumb))
+		if err != nil {
+			return err
+		}
+		pages[i].Image = img
+		pages[i].Thumb = thumb
+	}
+
+	fn := filepath.Join(dir, ReportFile)
+	f, err := os.Create(fn)
+	if err != nil {
+		return fmt.Errorf("Error creating report %s: %v", fn, err)
+	}
+	err = reportTmpl.Execute(f, struct {
+		Bookname string
+		Pages    []reportPage
+	}{bookname, pages})
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("Error writing report %s: %v", fn, err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,89 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_WriteHtmlReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reporttest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"best": "0000_bin0.2.hocr\n0001_bin0.1.hocr\n0002_bin0.2.hocr\n",
+		"conf": "/tmp/book/0000_bin0.1.hocr\t40\n" +
+			"/tmp/book/0000_bin0.2.hocr\t80\n" +
+			"/tmp/book/0001_bin0.1.hocr\t35\n" +
+			"/tmp/book/0002_bin0.2.hocr\t90\n",
+	}
+	for fn, content := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, fn), []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("Could not write %s: %v", fn, err)
+		}
+	}
+	// no image for the last page, to check it is still listed
+	for _, fn := range []string{"0000_bin0.2.png", "0001_bin0.1.png"} {
+		err = copyFile("testdata/good/1.png", filepath.Join(dir, fn))
+		if err != nil {
+			t.Fatalf("Could not copy image: %v", err)
+		}
+	}
+
+	err = WriteHtmlReport(dir, "reportbook")
+	if err != nil {
+		t.Fatalf("Error writing report: %v", err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, ReportFile))
+	if err != nil {
+		t.Fatalf("Could not read report: %v", err)
+	}
+	report := string(b)
+
+	order := []string{"0001_bin0.1", "0000_bin0.2", "0002_bin0.2"}
+	last := -1
+	for _, name := range order {
+		i := strings.Index(report, "<td>"+name+"</td>")
+		if i == -1 {
+			t.Fatalf("Page %s not found in report:\n%s", name, report)
+		}
+		if i < last {
+			t.Fatalf("Page %s is not in order of confidence in report:\n%s", name, report)
+		}
+		last = i
+	}
+
+	worst := `<a href="0001_bin0.1.png"><img src="thumbs/0001_bin0.1.jpg"`
+	i := strings.Index(report, worst)
+	if i == -1 || i > strings.Index(report, "0000_bin0.2") {
+		t.Fatalf("Expected lowest confidence page to come first with its thumbnail, got:\n%s", report)
+	}
+	if strings.Contains(report, "thumbs/0002_bin0.2.jpg") {
+		t.Fatalf("Expected no thumbnail for page without an image, got:\n%s", report)
+	}
+
+	f, err := os.Open(filepath.Join(dir, "thumbs", "0001_bin0.1.jpg"))
+	if err != nil {
+		t.Fatalf("Could not open thumbnail: %v", err)
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		t.Fatalf("Could not decode thumbnail: %v", err)
+	}
+	if cfg.Width != ThumbWidth {
+		t.Fatalf("Expected thumbnail to be %d pixels wide, got %d", ThumbWidth, cfg.Width)
+	}
+}
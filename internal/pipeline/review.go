@@ -0,0 +1,89 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+// NeedsReviewFile is the name of the file which Analyse saves in a
+// book's directory if the average confidence of its best pages is
+// below AnalyseOptions.MinBookConf. While it exists the book is
+// considered to need review, rather than being done, even though
+// all of the usual results are still saved.
+const NeedsReviewFile = "needsreview"
+
+// ErrNeedsReview is returned by SubmitAndWait if the book finished
+// processing but was marked as needing review
+var ErrNeedsReview = errors.New("Book needs review, as its average confidence is too low")
+
+// NeedsReview returns whether Analyse marked a book as needing
+// review.
+func NeedsReview(conn Lister, bookname string) (bool, error) {
+	key := bookname + "/" + NeedsReviewFile
+	objs, err := conn.ListObjects(conn.WIPStorageId(), key)
+	if err != nil {
+		return false, fmt.Errorf("Error listing %s: %v", key, err)
+	}
+	for _, o := range objs {
+		if o == key {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ReviewClearer is the connection needed to clear a book's
+// NeedsReviewFile
+type ReviewClearer interface {
+	DeleteObjects(bucket string, keys []string) error
+	ListObjects(bucket string, prefix string) ([]string, error)
+	Log(v ...interface{})
+	WIPStorageId() string
+}
+
+// clearNeedsReview deletes the NeedsReviewFile left by a previous
+// analysis of a book, if there is one, so that a book which is
+// analysed again is only marked as needing review if it still does.
+// Nothing is done if conn can't delete objects.
+func clearNeedsReview(conn Downloader, bookname string) error {
+	c, ok := conn.(ReviewClearer)
+	if !ok {
+		return nil
+	}
+	marked, err := NeedsReview(c, bookname)
+	if err != nil || !marked {
+		return err
+	}
+	err = c.DeleteObjects(c.WIPStorageId(), []string{bookname + "/" + NeedsReviewFile})
+	if err != nil {
+		return fmt.Errorf("Error deleting previous %s for book %s: %v", NeedsReviewFile, bookname, err)
+	}
+	return nil
+}
+
+// meanConf returns the average confidence of the best version of
+// each page of a book
+func meanConf(bestconfs map[string]*bookpipeline.Conf) float64 {
+	if len(bestconfs) == 0 {
+		return 0
+	}
+	var total float64
+	for _, c := range bestconfs {
+		total += c.Conf
+	}
+	return total / float64(len(bestconfs))
+}
+
+// writeNeedsReview writes the reason a book needs review, for
+// saving as NeedsReviewFile
+func writeNeedsReview(w io.Writer, conf float64, min float64) error {
+	_, err := fmt.Fprintf(w, "Average confidence %.2f is below the minimum of %.2f\n", conf, min)
+	return err
+}
@@ -0,0 +1,118 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"strings"
+
+	_ "golang.org/x/image/tiff"
+)
+
+// newRotated returns an empty image of the same type and colour model
+// as img, with bounds r. Images which can't be drawn to, like the
+// YCbCr images decoded from colour jpegs, get an RGBA image instead.
+func newRotated(img image.Image, r image.Rectangle) draw.Image {
+	switch i := img.(type) {
+	case *image.Gray:
+		return image.NewGray(r)
+	case *image.Gray16:
+		return image.NewGray16(r)
+	case *image.NRGBA:
+		return image.NewNRGBA(r)
+	case *image.NRGBA64:
+		return image.NewNRGBA64(r)
+	case *image.RGBA64:
+		return image.NewRGBA64(r)
+	case *image.CMYK:
+		return image.NewCMYK(r)
+	case *image.Paletted:
+		return image.NewPaletted(r, i.Palette)
+	}
+	return image.NewRGBA(r)
+}
+
+// rotate returns img rotated clockwise by angle, which must be 90,
+// 180 or 270
+func rotate(img image.Image, angle int64) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	r := image.Rect(0, 0, h, w)
+	if angle == 180 {
+		r = image.Rect(0, 0, w, h)
+	}
+	dst := newRotated(img, r)
+
+	// each pixel of a greyscale image is a single byte, so binarised
+	// pages can be rotated much more quickly by copying them directly
+	src, srcok := img.(*image.Gray)
+	g, dstok := dst.(*image.Gray)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch angle {
+			case 90:
+				dx, dy = h-1-y, x
+			case 180:
+				dx, dy = w-1-x, h-1-y
+			case 270:
+				dx, dy = y, w-1-x
+			}
+			if srcok && dstok {
+				g.Pix[dy*g.Stride+dx] = src.Pix[y*src.Stride+x]
+				continue
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// RotateImage rotates an image at the given path clockwise by the
+// given angle, which can be 90, 180 or 270, replacing the original.
+// The image can be a png, jpeg or tiff, and is saved as a jpeg if
+// the path ends in .jpg, or otherwise as a png. The colour model of
+// the image is kept, so a greyscale image stays greyscale.
+func RotateImage(path string, angle int64) error {
+	switch angle {
+	case 90, 180, 270:
+	default:
+		return fmt.Errorf("Rotation angle of %d is not supported", angle)
+	}
+
+	r, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Failed to open image: %w", err)
+	}
+	img, _, err := image.Decode(r)
+	r.Close()
+	if err != nil {
+		return fmt.Errorf("Failed to decode image as png, jpeg or tiff: %w", err)
+	}
+
+	rotated := rotate(img, angle)
+
+	w, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("Failed to create rotated image: %w", err)
+	}
+	defer w.Close()
+
+	if strings.HasSuffix(path, ".jpg") {
+		err = jpeg.Encode(w, rotated, nil)
+	} else {
+		err = png.Encode(w, rotated)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to encode rotated image: %w", err)
+	}
+
+	return w.Close()
+}
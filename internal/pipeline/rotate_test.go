@@ -0,0 +1,134 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeCornerPng writes a white png with the top left pixel black,
+// so that its orientation can be checked
+func writeCornerPng(fn string, w, h int) error {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+	img.SetGray(0, 0, color.Gray{0})
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return png.Encode(f, img)
+}
+
+func Test_RotateImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotatetest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		angle  int64
+		w, h   int
+		corner image.Point
+	}{
+		{90, 3, 2, image.Point{X: 2, Y: 0}},
+		{180, 2, 3, image.Point{X: 1, Y: 2}},
+		{270, 3, 2, image.Point{X: 0, Y: 1}},
+	}
+
+	for _, c := range cases {
+		fn := filepath.Join(dir, "page.png")
+		err = writeCornerPng(fn, 2, 3)
+		if err != nil {
+			t.Fatalf("Could not write %s: %v", fn, err)
+		}
+		err = RotateImage(fn, c.angle)
+		if err != nil {
+			t.Fatalf("Error rotating by %d: %v", c.angle, err)
+		}
+		f, err := os.Open(fn)
+		if err != nil {
+			t.Fatalf("Could not open %s: %v", fn, err)
+		}
+		img, err := png.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("Could not decode rotated image as a png: %v", err)
+		}
+		if _, ok := img.(*image.Gray); !ok {
+			t.Fatalf("Expected image rotated by %d to stay greyscale, got %T", c.angle, img)
+		}
+		b := img.Bounds()
+		if b.Dx() != c.w || b.Dy() != c.h {
+			t.Fatalf("Expected image rotated by %d to be %dx%d, got %dx%d", c.angle, c.w, c.h, b.Dx(), b.Dy())
+		}
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				r, _, _, _ := img.At(x, y).RGBA()
+				black := image.Point{X: x, Y: y} == c.corner
+				if (r == 0) != black {
+					t.Fatalf("Expected only pixel %v of image rotated by %d to be black, but %d,%d has red %d", c.corner, c.angle, x, y, r)
+				}
+			}
+		}
+	}
+}
+
+func Test_RotateImageColour(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotatetest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 3))
+	red := color.NRGBA{255, 0, 0, 255}
+	img.SetNRGBA(0, 0, red)
+	fn := filepath.Join(dir, "page.png")
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatalf("Could not create %s: %v", fn, err)
+	}
+	err = png.Encode(f, img)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Could not write %s: %v", fn, err)
+	}
+
+	err = RotateImage(fn, 180)
+	if err != nil {
+		t.Fatalf("Error rotating: %v", err)
+	}
+	f, err = os.Open(fn)
+	if err != nil {
+		t.Fatalf("Could not open %s: %v", fn, err)
+	}
+	rotated, err := png.Decode(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Could not decode rotated image as a png: %v", err)
+	}
+	n, ok := rotated.(*image.NRGBA)
+	if !ok {
+		t.Fatalf("Expected rotated image to keep its colour model, got %T", rotated)
+	}
+	if n.NRGBAAt(1, 2) != red || n.NRGBAAt(0, 0) == red {
+		t.Fatalf("Expected the red pixel to be moved to the opposite corner")
+	}
+
+	err = RotateImage(fn, 45)
+	if err == nil {
+		t.Fatalf("Expected an error rotating by 45 degrees, got none")
+	}
+}
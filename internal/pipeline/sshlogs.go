@@ -0,0 +1,152 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// CommandRunner runs a command and returns its standard output. The
+// command should be stopped if ctx is cancelled.
+type CommandRunner func(ctx context.Context, name string, arg ...string) ([]byte, error)
+
+// ExecRunner is a CommandRunner which runs commands with os/exec
+func ExecRunner(ctx context.Context, name string, arg ...string) ([]byte, error) {
+	return exec.CommandContext(ctx, name, arg...).Output()
+}
+
+// HostLog is the result of getting the logs from a host
+type HostLog struct {
+	Host string
+	Log  string
+	Err  error
+}
+
+// SSHOptions control how hosts are connected to with SSH
+type SSHOptions struct {
+	User    string   // user to log in as, "admin" if unset
+	KeyFile string   // private key file to use, if set
+	Opts    []string // extra arguments to pass to ssh
+}
+
+// ParseSSHOpts splits a string of ssh arguments, such as
+// "-p 2222 -o ConnectTimeout=5", into the form used by SSHOptions.
+// As in a shell, arguments are separated by spaces, unless they are
+// quoted with single or double quotes or escaped with a backslash,
+// so options with spaces in them, like
+// -o "ProxyCommand ssh -W %h:%p bastion", are kept together.
+func ParseSSHOpts(s string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inarg := false
+	var quote rune
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			// inside double quotes a backslash only escapes these
+			if quote == '"' && !strings.ContainsRune(`"\$`+"`", r) {
+				arg.WriteRune('\\')
+			}
+			arg.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '\\':
+			escaped = true
+			inarg = true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inarg = true
+		case unicode.IsSpace(r):
+			if inarg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inarg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inarg = true
+		}
+	}
+	if escaped {
+		return nil, fmt.Errorf("SSH options end with an unfinished escape")
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("Unterminated %c quote in SSH options", quote)
+	}
+	if inarg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// sshLogArgs returns the arguments to ssh to get the last n lines of
+// the bookpipeline log from a host. Any extra options come before
+// the default of not checking host keys, as ssh uses the first value
+// given for an option, so they can override it.
+func sshLogArgs(host string, o SSHOptions, n int) []string {
+	user := o.User
+	if user == "" {
+		user = "admin"
+	}
+	args := append([]string{}, o.Opts...)
+	args = append(args, "-o", "StrictHostKeyChecking no")
+	if o.KeyFile != "" {
+		args = append(args, "-i", o.KeyFile)
+	}
+	return append(args, user+"@"+host, fmt.Sprintf("journalctl -n %d -u bookpipeline", n))
+}
+
+// getSSHLog gets the last n lines of the bookpipeline log from a
+// host over SSH, giving up after timeout
+func getSSHLog(run CommandRunner, host string, o SSHOptions, n int, timeout time.Duration) HostLog {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	out, err := run(ctx, "ssh", sshLogArgs(host, o, n)...)
+	if ctx.Err() == context.DeadlineExceeded {
+		return HostLog{Host: host, Err: fmt.Errorf("Timed out after %v", timeout)}
+	}
+	if err != nil {
+		return HostLog{Host: host, Err: err}
+	}
+	return HostLog{Host: host, Log: string(out)}
+}
+
+// GetSSHLogs gets the last n lines of the bookpipeline log from each
+// host over SSH, connecting according to o. The hosts are all
+// contacted at the same time, and each result is sent to logs as soon
+// as it is ready, so one slow host doesn't hold up the others. Any
+// host which doesn't respond within timeout is skipped, with an error
+// noting that it timed out. logs is closed once every host has been
+// dealt with.
+func GetSSHLogs(run CommandRunner, hosts []string, o SSHOptions, n int, timeout time.Duration, logs chan HostLog) {
+	var wg sync.WaitGroup
+	for _, h := range hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			logs <- getSSHLog(run, host, o, n, timeout)
+		}(h)
+	}
+	wg.Wait()
+	close(logs)
+}
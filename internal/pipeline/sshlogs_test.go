@@ -0,0 +1,124 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_GetSSHLogs(t *testing.T) {
+	// slowRunner never responds for the host "slow", only
+	// stopping once its context is cancelled
+	slowRunner := func(ctx context.Context, name string, arg ...string) ([]byte, error) {
+		if name != "ssh" {
+			t.Errorf("Expected ssh to be run, got %s", name)
+		}
+		host := arg[len(arg)-2]
+		if host == "admin@slow" {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return []byte("log for " + host), nil
+	}
+
+	timeout := 200 * time.Millisecond
+	logs := make(chan HostLog)
+	start := time.Now()
+	go GetSSHLogs(slowRunner, []string{"a", "slow", "b"}, SSHOptions{}, 5, timeout, logs)
+
+	var got []HostLog
+	for l := range logs {
+		if l.Host != "slow" && time.Since(start) >= timeout {
+			t.Fatalf("Log for %s was held up by slow host", l.Host)
+		}
+		got = append(got, l)
+	}
+
+	if time.Since(start) > 10*timeout {
+		t.Fatalf("Getting logs took %v, expected around %v", time.Since(start), timeout)
+	}
+	if len(got) != 3 {
+		t.Fatalf("Expected 3 results, got %d", len(got))
+	}
+	if got[2].Host != "slow" {
+		t.Fatalf("Expected slow host to be last, got %s", got[2].Host)
+	}
+	if got[2].Err == nil || !strings.HasPrefix(got[2].Err.Error(), "Timed out") {
+		t.Fatalf("Expected slow host to time out, got error %v", got[2].Err)
+	}
+	for _, l := range got[:2] {
+		if l.Err != nil {
+			t.Fatalf("Unexpected error for %s: %v", l.Host, l.Err)
+		}
+		if l.Log != "log for admin@"+l.Host {
+			t.Fatalf("Unexpected log for %s: %s", l.Host, l.Log)
+		}
+	}
+}
+
+func Test_sshLogArgs(t *testing.T) {
+	logcmd := "journalctl -n 5 -u bookpipeline"
+	cases := []struct {
+		name     string
+		opts     SSHOptions
+		expected []string
+	}{
+		{"default", SSHOptions{}, []string{"-o", "StrictHostKeyChecking no", "admin@host", logcmd}},
+		{"key", SSHOptions{KeyFile: "id.pem"}, []string{"-o", "StrictHostKeyChecking no", "-i", "id.pem", "admin@host", logcmd}},
+		{"user", SSHOptions{User: "ec2-user"}, []string{"-o", "StrictHostKeyChecking no", "ec2-user@host", logcmd}},
+		{"all",
+			SSHOptions{User: "ubuntu", KeyFile: "id.pem", Opts: []string{"-p", "2222", "-o", "StrictHostKeyChecking=yes"}},
+			[]string{"-p", "2222", "-o", "StrictHostKeyChecking=yes", "-o", "StrictHostKeyChecking no", "-i", "id.pem", "ubuntu@host", logcmd}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			args := sshLogArgs("host", c.opts, 5)
+			if !reflect.DeepEqual(args, c.expected) {
+				t.Fatalf("Expected args %q, got %q", c.expected, args)
+			}
+		})
+	}
+}
+
+func Test_ParseSSHOpts(t *testing.T) {
+	cases := []struct {
+		opts     string
+		expected []string
+		err      bool
+	}{
+		{"", nil, false},
+		{" -p 2222  -o StrictHostKeyChecking=yes", []string{"-p", "2222", "-o", "StrictHostKeyChecking=yes"}, false},
+		{`-o "ProxyCommand ssh -W %h:%p bastion" -p 22`, []string{"-o", "ProxyCommand ssh -W %h:%p bastion", "-p", "22"}, false},
+		{`-o 'ProxyCommand ssh -W "%h:%p" bastion'`, []string{"-o", `ProxyCommand ssh -W "%h:%p" bastion`}, false},
+		{`-o ProxyCommand\ ssh\ bastion`, []string{"-o", "ProxyCommand ssh bastion"}, false},
+		{`-o "a \"b\" \c"`, []string{"-o", `a "b" \c`}, false},
+		{`-o ""`, []string{"-o", ""}, false},
+		{`-o "ProxyCommand ssh`, nil, true},
+		{`-o ProxyCommand\`, nil, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.opts, func(t *testing.T) {
+			args, err := ParseSSHOpts(c.opts)
+			if c.err {
+				if err == nil {
+					t.Fatalf("Expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Error parsing options: %v", err)
+			}
+			if !reflect.DeepEqual(args, c.expected) {
+				t.Fatalf("Expected args %q, got %q", c.expected, args)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"strings"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+// ClassUploader is an Uploader which can store different types of
+// object with different storage classes, like AwsConn
+type ClassUploader interface {
+	UploadClass(bucket string, key string, path string, objtype string) error
+}
+
+// objectType returns the type of object a key is, as used to choose
+// its storage class. Preprocessed page images are only needed until
+// a book has been OCRed, so are intermediate, and everything else is
+// final.
+func objectType(key string) string {
+	if wipedPattern.MatchString(key) || strings.HasSuffix(key, ".bin.png") {
+		return bookpipeline.ObjectIntermediate
+	}
+	return bookpipeline.ObjectFinal
+}
+
+// upload uploads a file to the WIP storage with the storage class
+// for its type, if conn supports storage classes
+func upload(conn Uploader, key string, path string) error {
+	if c, ok := conn.(ClassUploader); ok {
+		return c.UploadClass(conn.WIPStorageId(), key, path, objectType(key))
+	}
+	return conn.Upload(conn.WIPStorageId(), key, path)
+}
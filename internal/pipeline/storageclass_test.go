@@ -0,0 +1,74 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+// classUploadConn is a LocalConn which records the type each key
+// was uploaded as
+type classUploadConn struct {
+	*bookpipeline.LocalConn
+	types map[string]string
+}
+
+func (c *classUploadConn) UploadClass(bucket string, key string, path string, objtype string) error {
+	c.types[key] = objtype
+	return c.LocalConn.Upload(bucket, key, path)
+}
+
+func Test_UploadClass(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	dir, err := ioutil.TempDir("", "storageclasstest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conn := &classUploadConn{LocalConn: newTestConn(t, vlog), types: make(map[string]string)}
+
+	expected := map[string]string{
+		"0001_bin0.2.png":  bookpipeline.ObjectIntermediate,
+		"0001.bin.png":     bookpipeline.ObjectIntermediate,
+		"0001_bin0.2.hocr": bookpipeline.ObjectFinal,
+		"book.pdf":         bookpipeline.ObjectFinal,
+		"graph.png":        bookpipeline.ObjectFinal,
+	}
+
+	upc := make(chan string)
+	done := make(chan bool)
+	errc := make(chan error)
+	go up(context.Background(), upc, done, conn, "book", errc, vlog)
+	for name := range expected {
+		fn := filepath.Join(dir, name)
+		err = ioutil.WriteFile(fn, []byte("test"), 0644)
+		if err != nil {
+			t.Fatalf("Could not write %s: %v", fn, err)
+		}
+		upc <- fn
+	}
+	close(upc)
+	select {
+	case err = <-errc:
+		t.Fatalf("Error uploading: %v\nLog: %s", err, slog.log)
+	case <-done:
+	}
+
+	for name, objtype := range expected {
+		if conn.types["book/"+name] != objtype {
+			t.Fatalf("Expected %s to be uploaded as %s, got %q", name, objtype, conn.types["book/"+name])
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// DefaultPollInterval is how often SubmitAndWait checks whether a
+// book has finished processing, if SubmitOptions.PollInterval isn't
+// set
+const DefaultPollInterval = time.Minute
+
+// SubmitOptions contains the options for SubmitAndWait
+type SubmitOptions struct {
+	// Training is the training to OCR the book with, or empty for
+	// the default
+	Training string
+	// Opts are the processing options sent in the job message, like
+	// "binmethod" or "single"
+	Opts map[string]string
+	// Upload are the options used to upload the book, such as its
+	// metadata, page order and training manifest
+	Upload UploadOptions
+	// NoWipe sends the book to the nowipe preprocess queue
+	NoWipe bool
+	// PollInterval is how often to check whether the book is done;
+	// if it is zero DefaultPollInterval is used
+	PollInterval time.Duration
+}
+
+// DoneFile is the name of the empty file which Analyse saves in a
+// book's directory once all of its results have been saved, to mark
+// it as done.
+const DoneFile = "done"
+
+// IsDone returns whether a book has finished being processed by the
+// pipeline, which is the case once ResultsComplete is true for its
+// objects.
+func IsDone(conn Lister, bookname string) (bool, error) {
+	objs, err := conn.ListObjects(conn.WIPStorageId(), bookname+"/")
+	if err != nil {
+		return false, fmt.Errorf("Error listing %s: %v", bookname, err)
+	}
+	return ResultsComplete(objs), nil
+}
+
+// ResultsComplete returns whether the objects of a book, as listed
+// from storage, show that Analyse has saved all of its results. This
+// is the case if DoneFile is there, or for books analysed before it
+// was saved, if the best file and at least one PDF are. A graph is
+// not required, as one can't be made for some books, such as those
+// with a single page.
+func ResultsComplete(objs []string) bool {
+	var best, pdf bool
+	for _, o := range objs {
+		switch name := path.Base(o); {
+		case name == DoneFile:
+			return true
+		case name == "best":
+			best = true
+		case strings.HasSuffix(name, ".pdf"):
+			pdf = true
+		}
+	}
+	return best && pdf
+}
+
+// SubmitAndWait uploads the book in dir to the pipeline as bookname,
+// adds it to the preprocess queue, and then waits until it has
+// finished processing, checking every opts.PollInterval. This does
+// the same as running booktopipeline and then watching lspipeline
+// until the book is done. If ctx is cancelled or times out before
+// the book is done, ctx.Err() is returned; the book is still left
+// in the pipeline to be processed. If the book was marked as needing
+// review by Analyse, ErrNeedsReview is returned.
+func SubmitAndWait(ctx context.Context, conn BookUploader, dir string, bookname string, opts SubmitOptions) error {
+	job := JobMsg{Bookname: bookname, Training: opts.Training, Opts: opts.Opts}
+	_, err := PreprocessFor(job, nil, false)
+	if err != nil {
+		return err
+	}
+
+	err = UploadBook(ctx, conn, dir, bookname, opts.Upload)
+	if err != nil {
+		return err
+	}
+
+	qid := DetectQueueType(dir, conn, opts.NoWipe)
+	if opts.Opts["binmethod"] == "none" {
+		qid = conn.PreQueueId()
+	}
+	err = conn.AddToQueue(qid, job.String())
+	if err != nil {
+		return fmt.Errorf("Error adding book to queue: %v", err)
+	}
+	conn.Log("Added", bookname, "to queue, waiting for it to finish")
+
+	interval := opts.PollInterval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		done, err := IsDone(conn, bookname)
+		if err != nil {
+			conn.Log("Error checking whether", bookname, "is done:", err)
+			continue
+		}
+		if !done {
+			continue
+		}
+		review, err := NeedsReview(conn, bookname)
+		if err != nil {
+			return err
+		}
+		if review {
+			return ErrNeedsReview
+		}
+		return nil
+	}
+}
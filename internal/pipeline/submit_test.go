@@ -0,0 +1,173 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+// submitConn is a LocalConn which simulates a book being processed,
+// by saving the done marker for it a while after it is added to a
+// queue
+type submitConn struct {
+	*bookpipeline.LocalConn
+	delay  time.Duration
+	marker func(conn *bookpipeline.LocalConn, bookname string) error
+
+	mu     sync.Mutex
+	queued []string
+	timer  *time.Timer
+}
+
+func (s *submitConn) AddToQueue(url string, msg string) error {
+	job := ParseJobMessage(msg)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queued = append(s.queued, msg)
+	s.timer = time.AfterFunc(s.delay, func() {
+		err := s.marker(s.LocalConn, job.Bookname)
+		if err != nil {
+			s.Log("Error saving done marker:", err)
+		}
+	})
+	return nil
+}
+
+func (s *submitConn) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+}
+
+func doneMarker(conn *bookpipeline.LocalConn, bookname string) error {
+	return conn.Upload(conn.WIPStorageId(), bookname+"/"+DoneFile, "testdata/good/1.png")
+}
+
+func bestPdfMarker(conn *bookpipeline.LocalConn, bookname string) error {
+	for _, name := range []string{"best", bookname + ".colour.pdf"} {
+		err := conn.Upload(conn.WIPStorageId(), bookname+"/"+name, "testdata/good/1.png")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func graphMarker(conn *bookpipeline.LocalConn, bookname string) error {
+	return conn.Upload(conn.WIPStorageId(), bookname+"/graph.png", "testdata/good/1.png")
+}
+
+func needsReviewMarker(conn *bookpipeline.LocalConn, bookname string) error {
+	err := conn.Upload(conn.WIPStorageId(), bookname+"/"+NeedsReviewFile, "testdata/good/1.png")
+	if err != nil {
+		return err
+	}
+	return doneMarker(conn, bookname)
+}
+
+func Test_SubmitAndWait(t *testing.T) {
+	cases := []struct {
+		name    string
+		delay   time.Duration
+		timeout time.Duration
+		marker  func(conn *bookpipeline.LocalConn, bookname string) error
+		err     error
+	}{
+		{"done", 50 * time.Millisecond, 10 * time.Second, doneMarker, nil},
+		{"bestpdf", 50 * time.Millisecond, 10 * time.Second, bestPdfMarker, nil},
+		{"needsreview", 50 * time.Millisecond, 10 * time.Second, needsReviewMarker, ErrNeedsReview},
+		{"graphonly", 50 * time.Millisecond, 200 * time.Millisecond, graphMarker, context.DeadlineExceeded},
+		{"timeout", time.Hour, 100 * time.Millisecond, doneMarker, context.DeadlineExceeded},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "submittest")
+			if err != nil {
+				t.Fatalf("Could not create temporary directory: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			vlog := log.New(ioutil.Discard, "", 0)
+			conn := &submitConn{
+				LocalConn: &bookpipeline.LocalConn{Logger: vlog, TempDir: dir},
+				delay:     c.delay,
+				marker:    c.marker,
+			}
+			defer conn.stop()
+			err = conn.Init()
+			if err != nil {
+				t.Fatalf("Could not initialise connection: %v", err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+			defer cancel()
+			opts := SubmitOptions{Training: "lat", PollInterval: 10 * time.Millisecond}
+			start := time.Now()
+			err = SubmitAndWait(ctx, conn, "testdata/good", "submittest", opts)
+			if err != c.err {
+				t.Fatalf("Expected error %v, got %v", c.err, err)
+			}
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("SubmitAndWait took %v to return", time.Since(start))
+			}
+
+			conn.mu.Lock()
+			defer conn.mu.Unlock()
+			if len(conn.queued) != 1 {
+				t.Fatalf("Expected the book to be queued once, got %v", conn.queued)
+			}
+			job := ParseJobMessage(conn.queued[0])
+			if job.Bookname != "submittest" || job.Training != "lat" {
+				t.Fatalf("Unexpected job queued: %v", conn.queued[0])
+			}
+			_, err = os.Stat(filepath.Join(dir, conn.WIPStorageId(), "submittest", OriginalNamesFile))
+			if err != nil {
+				t.Fatalf("Expected original names to be uploaded: %v", err)
+			}
+			meta, err := GetMeta(conn, "submittest")
+			if err != nil {
+				t.Fatalf("Could not get metadata: %v", err)
+			}
+			if meta[ContentHashKey] == "" {
+				t.Fatalf("Expected the content hash to be saved in the metadata, got %v", meta)
+			}
+		})
+	}
+}
+
+func Test_ResultsComplete(t *testing.T) {
+	cases := []struct {
+		name     string
+		objs     []string
+		complete bool
+	}{
+		{"all", []string{"book/best", "book/book.colour.pdf", "book/graph.png", "book/" + DoneFile}, true},
+		{"nograph", []string{"book/best", "book/book.colour.pdf"}, true},
+		{"marker", []string{"book/0001.jpg", "book/" + DoneFile}, true},
+		{"graphonly", []string{"book/0001.jpg", "book/graph.png"}, false},
+		{"nopdf", []string{"book/best", "book/graph.png"}, false},
+		{"nobest", []string{"book/book.binarised.pdf", "book/graph.png"}, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if complete := ResultsComplete(c.objs); complete != c.complete {
+				t.Fatalf("Expected ResultsComplete to be %v, got %v", c.complete, complete)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TarName returns the name of the archive of the results for a book,
+// which is bookname.tar, or bookname.tar.gz if it is compressed.
+func TarName(bookname string, compress bool) string {
+	if compress {
+		return bookname + ".tar.gz"
+	}
+	return bookname + ".tar"
+}
+
+// TarWriter writes files to a tar archive, which is optionally gzip
+// compressed.
+type TarWriter struct {
+	f      *os.File
+	gz     *gzip.Writer
+	tw     *tar.Writer
+	closed bool
+}
+
+// NewTarWriter creates a tar archive at fn, which is gzip compressed
+// if compress is set.
+func NewTarWriter(fn string, compress bool) (*TarWriter, error) {
+	f, err := os.Create(fn)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating file %s: %v", fn, err)
+	}
+	t := &TarWriter{f: f}
+	var w io.Writer = f
+	if compress {
+		t.gz = gzip.NewWriter(f)
+		w = t.gz
+	}
+	t.tw = tar.NewWriter(w)
+	return t, nil
+}
+
+// Add adds a file to the archive with the name and contents given.
+func (t *TarWriter) Add(name string, b []byte) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(b)),
+		ModTime: time.Now(),
+	}
+	err := t.tw.WriteHeader(hdr)
+	if err != nil {
+		return fmt.Errorf("Error adding %s to archive: %v", name, err)
+	}
+	_, err = t.tw.Write(b)
+	if err != nil {
+		return fmt.Errorf("Error adding %s to archive: %v", name, err)
+	}
+	return nil
+}
+
+// AddFile adds the file at path to the archive, named with its base
+// name.
+func (t *TarWriter) AddFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Error reading %s: %v", path, err)
+	}
+	return t.Add(filepath.Base(path), b)
+}
+
+// Close finishes writing the archive and closes the file. Closing
+// it again does nothing.
+func (t *TarWriter) Close() error {
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	err := t.tw.Close()
+	if err == nil && t.gz != nil {
+		err = t.gz.Close()
+	}
+	if err != nil {
+		t.f.Close()
+		return fmt.Errorf("Error finishing archive %s: %v", t.f.Name(), err)
+	}
+	return t.f.Close()
+}
+
+// Untar unpacks the tar archive fn into dir, whether it is gzip
+// compressed or not. Only plain files are unpacked, and only into
+// dir itself, so an archive can't write anywhere else.
+func Untar(fn string, dir string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return fmt.Errorf("Error opening %s: %v", fn, err)
+	}
+	defer f.Close()
+
+	var r io.Reader = bufio.NewReader(f)
+	magic, err := r.(*bufio.Reader).Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("Error decompressing %s: %v", fn, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Error reading archive %s: %v", fn, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := filepath.Base(filepath.Clean(hdr.Name))
+		if name != hdr.Name || strings.HasPrefix(name, ".") {
+			return fmt.Errorf("Error unpacking %s: invalid file name %s", fn, hdr.Name)
+		}
+		out, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			return fmt.Errorf("Error creating file %s: %v", name, err)
+		}
+		_, err = io.Copy(out, tr)
+		out.Close()
+		if err != nil {
+			return fmt.Errorf("Error unpacking %s: %v", name, err)
+		}
+	}
+}
+
+// DownloadTar downloads the archive of the results for a book,
+// compressed or not, and unpacks it into dir.
+func DownloadTar(ctx context.Context, dir string, name string, conn Downloader) error {
+	var err error
+	for _, compress := range []bool{true, false} {
+		tarname := TarName(name, compress)
+		fn := filepath.Join(dir, tarname)
+		err = downloadCtx(ctx, conn, name+"/"+tarname, fn)
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return err
+		}
+		if err != nil {
+			_ = os.Remove(fn)
+			continue
+		}
+		defer os.Remove(fn)
+		return Untar(fn, dir)
+	}
+	return fmt.Errorf("Failed to download archive for %s: %v", name, err)
+}
@@ -0,0 +1,256 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"archive/tar"
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func Test_TarRoundTrip(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	files := map[string]string{
+		"0001_bin0.2.hocr": "<html>first page</html>",
+		"0002_bin0.2.hocr": "<html>second page</html>",
+		"best":             "0001_bin0.2.hocr\n0002_bin0.2.hocr\n",
+	}
+
+	for _, compress := range []bool{false, true} {
+		name := TarName("tarbook", compress)
+		t.Run(name, func(t *testing.T) {
+			conn := newTestConn(t, vlog)
+			dir := conn.TempDir
+
+			srcdir := filepath.Join(dir, "src")
+			dstdir := filepath.Join(dir, "dst")
+			for _, d := range []string{srcdir, dstdir} {
+				err := os.MkdirAll(d, 0755)
+				if err != nil {
+					t.Fatalf("Could not create directory %s: %v", d, err)
+				}
+			}
+
+			tarfn := filepath.Join(srcdir, name)
+			tw, err := NewTarWriter(tarfn, compress)
+			if err != nil {
+				t.Fatalf("Error creating archive: %v", err)
+			}
+			for fn, content := range files {
+				path := filepath.Join(srcdir, fn)
+				err = ioutil.WriteFile(path, []byte(content), 0644)
+				if err != nil {
+					t.Fatalf("Could not write %s: %v", path, err)
+				}
+				err = tw.AddFile(path)
+				if err != nil {
+					t.Fatalf("Error adding %s to archive: %v", path, err)
+				}
+			}
+			err = tw.Add("0001.txt", []byte("first page\n"))
+			if err != nil {
+				t.Fatalf("Error adding text to archive: %v", err)
+			}
+			err = tw.Close()
+			if err != nil {
+				t.Fatalf("Error closing archive: %v", err)
+			}
+
+			err = conn.Upload(conn.WIPStorageId(), "tarbook/"+name, tarfn)
+			if err != nil {
+				t.Fatalf("Error uploading archive: %v", err)
+			}
+
+			err = DownloadTar(context.Background(), dstdir, "tarbook", conn)
+			if err != nil {
+				t.Fatalf("Error downloading archive: %v", err)
+			}
+
+			expected := map[string]string{"0001.txt": "first page\n"}
+			for fn, content := range files {
+				expected[fn] = content
+			}
+			found, err := ioutil.ReadDir(dstdir)
+			if err != nil {
+				t.Fatalf("Could not read directory: %v", err)
+			}
+			if len(found) != len(expected) {
+				var names []string
+				for _, f := range found {
+					names = append(names, f.Name())
+				}
+				t.Fatalf("Expected %d files to be unpacked, got %v", len(expected), names)
+			}
+			for fn, content := range expected {
+				b, err := ioutil.ReadFile(filepath.Join(dstdir, fn))
+				if err != nil {
+					t.Fatalf("Could not read unpacked file %s: %v", fn, err)
+				}
+				if string(b) != content {
+					t.Fatalf("Unpacked file %s differs, expected %q, got %q", fn, content, b)
+				}
+			}
+		})
+	}
+}
+
+func Test_UntarInvalidName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tartest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"../escape", "sub/file", ".hidden"} {
+		t.Run(name, func(t *testing.T) {
+			fn := filepath.Join(dir, "bad.tar")
+			f, err := os.Create(fn)
+			if err != nil {
+				t.Fatalf("Could not create archive: %v", err)
+			}
+			tw := tar.NewWriter(f)
+			err = tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: 1})
+			if err == nil {
+				_, err = tw.Write([]byte("x"))
+			}
+			if err == nil {
+				err = tw.Close()
+			}
+			f.Close()
+			if err != nil {
+				t.Fatalf("Could not write archive: %v", err)
+			}
+
+			err = Untar(fn, dir)
+			if err == nil {
+				t.Fatalf("Expected an error unpacking a file named %s", name)
+			}
+		})
+	}
+}
+
+// Test_AnalyseTar tests that Analyse uploads an archive of the
+// results when requested
+func Test_AnalyseTar(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	conn := newTestConn(t, vlog)
+
+	dir, err := ioutil.TempDir("", "analysetartest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var hocrs []string
+	for _, p := range []string{"0001_bin0.2.hocr", "0002_bin0.2.hocr"} {
+		fn := filepath.Join(dir, p)
+		err = writeHocr(fn, 80, "tar", "test")
+		if err != nil {
+			t.Fatalf("Could not write hOCR file %s: %v", fn, err)
+		}
+		hocrs = append(hocrs, fn)
+	}
+
+	done, err := runAnalyse(Analyse(conn, AnalyseOptions{Tar: true, TarGzip: true}), hocrs, vlog)
+	if err != nil {
+		t.Fatalf("Error in Analyse: %v\nLog: %s", err, slog.log)
+	}
+
+	tarname := TarName(filepath.Base(dir), true)
+	var tarfn string
+	for _, fn := range done {
+		if filepath.Base(fn) == tarname {
+			tarfn = fn
+		}
+	}
+	if tarfn == "" {
+		t.Fatalf("Expected %s to be uploaded, got %v", tarname, done)
+	}
+
+	unpacked := filepath.Join(dir, "unpacked")
+	err = os.MkdirAll(unpacked, 0755)
+	if err != nil {
+		t.Fatalf("Could not create directory: %v", err)
+	}
+	err = Untar(tarfn, unpacked)
+	if err != nil {
+		t.Fatalf("Error unpacking archive: %v", err)
+	}
+	found, err := ioutil.ReadDir(unpacked)
+	if err != nil {
+		t.Fatalf("Could not read directory: %v", err)
+	}
+	var names []string
+	for _, f := range found {
+		names = append(names, f.Name())
+	}
+	sort.Strings(names)
+	expected := []string{"0001_bin0.2.hocr", "0001_bin0.2.txt", "0002_bin0.2.hocr", "0002_bin0.2.txt", "best", "conf", "pagesizes", "words.jsonl"}
+	if strings.Join(names, " ") != strings.Join(expected, " ") {
+		t.Fatalf("Expected archive to contain %v, got %v", expected, names)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(unpacked, "0001_bin0.2.txt"))
+	if err != nil {
+		t.Fatalf("Could not read text file: %v", err)
+	}
+	if strings.TrimSpace(string(b)) != "tar test" {
+		t.Fatalf("Unexpected text in archive: %q", b)
+	}
+}
+
+// Test_AnalyseTarOnly tests that Analyse only uploads the archive,
+// and not the files in it, with TarOnly
+func Test_AnalyseTarOnly(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	conn := newTestConn(t, vlog)
+
+	dir, err := ioutil.TempDir("", "analysetaronlytest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var hocrs []string
+	for _, p := range []string{"0001_bin0.2.hocr", "0002_bin0.2.hocr"} {
+		fn := filepath.Join(dir, p)
+		err = writeHocr(fn, 80, "tar", "test")
+		if err != nil {
+			t.Fatalf("Could not write hOCR file %s: %v", fn, err)
+		}
+		hocrs = append(hocrs, fn)
+	}
+
+	done, err := runAnalyse(Analyse(conn, AnalyseOptions{TarOnly: true}), hocrs, vlog)
+	if err != nil {
+		t.Fatalf("Error in Analyse: %v\nLog: %s", err, slog.log)
+	}
+
+	uploaded := make(map[string]bool)
+	for _, fn := range done {
+		uploaded[filepath.Base(fn)] = true
+	}
+	for _, name := range []string{TarName(filepath.Base(dir), false), DoneFile} {
+		if !uploaded[name] {
+			t.Fatalf("Expected %s to be uploaded, got %v", name, done)
+		}
+	}
+	for _, name := range []string{"best", "conf", "pagesizes", "words.jsonl"} {
+		if uploaded[name] {
+			t.Fatalf("Expected %s to only be saved in the archive, got %v", name, done)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// tempBase is the directory that temporary working directories are
+// created in. If it is empty the system default is used, which is
+// $TMPDIR on Unix systems.
+var tempBase string
+
+// SetTempDir sets the directory that temporary working directories,
+// such as those used by ProcessBook and OcrPage to process a book, are
+// created in, creating it if it doesn't exist. This is useful when the
+// system temporary directory is on a partition too small for large
+// books. If dir is empty the system default is used.
+func SetTempDir(dir string) error {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("Error creating temporary directory %s: %v", dir, err)
+	}
+	tempBase = dir
+	return nil
+}
+
+// TempDir returns the directory that temporary working directories
+// are created in, as set with SetTempDir.
+func TempDir() string {
+	if tempBase == "" {
+		return os.TempDir()
+	}
+	return tempBase
+}
+
+// MkTempDir creates a new temporary directory with a name starting
+// with prefix inside TempDir(), in the same way as ioutil.TempDir.
+// It is up to the caller to remove it when it is no longer needed.
+func MkTempDir(prefix string) (string, error) {
+	return ioutil.TempDir(TempDir(), prefix)
+}
@@ -0,0 +1,74 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+// Test_SetTempDir tests that the temporary directory set is created
+// if needed, and that books are processed in it
+func Test_SetTempDir(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	dir, err := ioutil.TempDir("", "tempdirtest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "large", "volume")
+	err = SetTempDir(tmp)
+	if err != nil {
+		t.Fatalf("Error in SetTempDir: %v", err)
+	}
+	defer func() { tempBase = "" }()
+	_, err = os.Stat(tmp)
+	if err != nil {
+		t.Fatalf("Expected temporary directory to be created: %v", err)
+	}
+
+	conn := &fakeConn{LocalConn: newTestConn(t, vlog)}
+	err = conn.Upload(conn.WIPStorageId(), "tempdirtest/0001.jpg", "testdata/good/1.png")
+	if err != nil {
+		t.Fatalf("Could not upload test file: %v", err)
+	}
+
+	// a process which records where each file was downloaded to
+	var downloaded []string
+	process := func(ctx context.Context, in chan string, up chan string, errc chan error, logger *log.Logger) {
+		for fn := range in {
+			downloaded = append(downloaded, fn)
+		}
+		close(up)
+	}
+
+	msg := bookpipeline.Qmsg{Id: "1", Handle: "tempdirtest", Body: "tempdirtest"}
+	err = ProcessBook(context.Background(), msg, conn, process, regexp.MustCompile(`.jpg$`), conn.PreQueueId(), conn.OCRPageQueueId())
+	if err != nil {
+		t.Fatalf("Error in ProcessBook: %v\nLog: %s", err, slog.log)
+	}
+
+	if len(downloaded) != 1 {
+		t.Fatalf("Expected 1 file to be processed, got %v", downloaded)
+	}
+	if !strings.HasPrefix(downloaded[0], tmp+string(filepath.Separator)) {
+		t.Fatalf("Expected book to be processed in %s, got %s", tmp, downloaded[0])
+	}
+	_, err = os.Stat(downloaded[0])
+	if err == nil {
+		t.Fatalf("Expected working directory to be removed after processing")
+	}
+}
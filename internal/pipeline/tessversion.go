@@ -0,0 +1,118 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// TessVersionFile is the name of the file which the version of
+// tesseract used to OCR a book is saved to, alongside the images of
+// the book. If pages of a book were OCRed with different versions of
+// tesseract, each version is listed on its own line.
+const TessVersionFile = "tessversion"
+
+// tessVersions caches the version of each tesseract command, and the
+// last book and version which were recorded by this process, so that
+// they only need to be found once.
+var tessVersions = struct {
+	sync.Mutex
+	cmds     map[string]string
+	lastBook string
+	lastVer  string
+}{cmds: make(map[string]string)}
+
+// TesseractVersion returns the version of tesseract run by tesscmd,
+// like "tesseract 5.3.0", as reported by tesseract --version. If
+// tesscmd is empty tesseract is run from the path. The version is
+// only found once for each command, and then reused.
+func TesseractVersion(tesscmd string) (string, error) {
+	if tesscmd == "" {
+		tesscmd = "tesseract"
+	}
+
+	tessVersions.Lock()
+	defer tessVersions.Unlock()
+	if v, ok := tessVersions.cmds[tesscmd]; ok {
+		return v, nil
+	}
+
+	cmd := exec.Command(tesscmd, "--version")
+	HideCmd(cmd)
+	// older versions of tesseract print the version to stderr
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("Error getting version of %s: %v", tesscmd, err)
+	}
+	for _, l := range strings.Split(string(out), "\n") {
+		v := strings.TrimSpace(l)
+		if v != "" {
+			tessVersions.cmds[tesscmd] = v
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("Error getting version of %s: no version was printed", tesscmd)
+}
+
+// GetTesseractVersions returns the versions of tesseract which have
+// been recorded for a book, or nil if none have been.
+func GetTesseractVersions(conn DownloadLister, bookname string) ([]string, error) {
+	b, _, err := downloadBytes(conn, bookname+"/"+TessVersionFile)
+	if err != nil {
+		return nil, err
+	}
+	var versions []string
+	for _, l := range strings.Split(string(b), "\n") {
+		if l != "" {
+			versions = append(versions, l)
+		}
+	}
+	return versions, nil
+}
+
+// RecordTesseractVersion adds the version of tesseract run by tesscmd
+// to the TessVersionFile of a book, if it isn't already listed there.
+// Only the book's own file is written, so recording the version never
+// touches files shared with other stages of the pipeline.
+func RecordTesseractVersion(conn DownloadUploadLister, bookname string, tesscmd string) error {
+	v, err := TesseractVersion(tesscmd)
+	if err != nil {
+		return err
+	}
+
+	tessVersions.Lock()
+	recorded := tessVersions.lastBook == bookname && tessVersions.lastVer == v
+	tessVersions.Unlock()
+	if recorded {
+		return nil
+	}
+
+	versions, err := GetTesseractVersions(conn, bookname)
+	if err != nil {
+		return err
+	}
+	listed := false
+	for _, existing := range versions {
+		if existing == v {
+			listed = true
+		}
+	}
+	if !listed {
+		b := []byte(strings.Join(append(versions, v), "\n") + "\n")
+		err = uploadBytes(conn, bookname+"/"+TessVersionFile, b)
+		if err != nil {
+			return err
+		}
+	}
+
+	tessVersions.Lock()
+	tessVersions.lastBook = bookname
+	tessVersions.lastVer = v
+	tessVersions.Unlock()
+	return nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fakeTesseract creates a script in dir which prints a version like
+// tesseract --version does, and records each time it is run in
+// dir/runs
+func fakeTesseract(dir string, name string, version string) (string, error) {
+	fn := filepath.Join(dir, name)
+	script := "#!/bin/sh\necho run >> " + filepath.Join(dir, "runs") + "\necho '" + version + "'\necho ' leptonica-1.82.0'\n"
+	return fn, ioutil.WriteFile(fn, []byte(script), 0755)
+}
+
+func Test_RecordTesseractVersion(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test which uses a shell script")
+	}
+
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	dir, err := ioutil.TempDir("", "tessversiontest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conn := newTestConn(t, vlog)
+
+	err = UploadMeta(conn, "book", map[string]string{"library": "test"})
+	if err != nil {
+		t.Fatalf("Could not upload metadata: %v", err)
+	}
+
+	tess4, err := fakeTesseract(dir, "tesseract4", "tesseract 4.1.1")
+	if err != nil {
+		t.Fatalf("Could not create fake tesseract: %v", err)
+	}
+	tess5, err := fakeTesseract(dir, "tesseract5", "tesseract 5.3.0")
+	if err != nil {
+		t.Fatalf("Could not create fake tesseract: %v", err)
+	}
+
+	v, err := TesseractVersion(tess4)
+	if err != nil {
+		t.Fatalf("Error getting tesseract version: %v", err)
+	}
+	if v != "tesseract 4.1.1" {
+		t.Fatalf("Expected version tesseract 4.1.1, got %s", v)
+	}
+
+	cases := []struct {
+		tesscmd  string
+		expected string
+	}{
+		{tess4, "tesseract 4.1.1"},
+		{tess4, "tesseract 4.1.1"},
+		{tess5, "tesseract 4.1.1, tesseract 5.3.0"},
+		{tess4, "tesseract 4.1.1, tesseract 5.3.0"},
+	}
+	for _, c := range cases {
+		err = RecordTesseractVersion(conn, "book", c.tesscmd)
+		if err != nil {
+			t.Fatalf("Error recording tesseract version: %v\nLog: %s", err, slog.log)
+		}
+		versions, err := GetTesseractVersions(conn, "book")
+		if err != nil {
+			t.Fatalf("Error getting tesseract versions: %v", err)
+		}
+		if strings.Join(versions, ", ") != c.expected {
+			t.Fatalf("Expected tesseract versions %s, got %v", c.expected, versions)
+		}
+		meta, err := GetMeta(conn, "book")
+		if err != nil {
+			t.Fatalf("Error getting metadata: %v", err)
+		}
+		if len(meta) != 1 || meta["library"] != "test" {
+			t.Fatalf("Expected metadata to be left alone, got %v", meta)
+		}
+	}
+
+	// the version of each command should only be captured once
+	b, err := ioutil.ReadFile(filepath.Join(dir, "runs"))
+	if err != nil {
+		t.Fatalf("Could not read fake tesseract runs: %v", err)
+	}
+	if string(b) != "run\nrun\n" {
+		t.Fatalf("Expected fake tesseracts to be run once each, got runs:\n%s", string(b))
+	}
+
+	_, err = TesseractVersion(filepath.Join(dir, "nonexistent"))
+	if err == nil {
+		t.Fatalf("Expected an error getting the version of a missing command, got none")
+	}
+}
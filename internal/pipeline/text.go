@@ -0,0 +1,60 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"rescribe.xyz/bookpipeline/internal/postproc"
+	"rescribe.xyz/utils/pkg/hocr"
+)
+
+// hocrText returns the text of a hOCR file, with the text rules
+// given applied to it
+func hocrText(path string, rules []postproc.Rule) (string, error) {
+	t, err := hocr.GetText(path)
+	if err != nil {
+		return "", fmt.Errorf("Error getting text from %s: %v", path, err)
+	}
+	return postproc.ApplyRules(t, rules), nil
+}
+
+// SaveBestText saves the text of each best hOCR file listed in the
+// best file in dir into a text directory inside dir, named after the
+// page, and the text of every page into bookname.txt. The text rules
+// given are applied to the text of each page.
+func SaveBestText(dir string, bookname string, rules []postproc.Rule) error {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "best"))
+	if err != nil {
+		return fmt.Errorf("Error reading best file: %v", err)
+	}
+	err = os.MkdirAll(filepath.Join(dir, "text"), 0755)
+	if err != nil {
+		return fmt.Errorf("Error creating text directory: %v", err)
+	}
+	var full []string
+	for _, fn := range strings.Fields(string(b)) {
+		t, err := hocrText(filepath.Join(dir, fn), rules)
+		if err != nil {
+			return err
+		}
+		txtfn := filepath.Join(dir, "text", strings.TrimSuffix(fn, ".hocr")+".txt")
+		err = ioutil.WriteFile(txtfn, []byte(t), 0644)
+		if err != nil {
+			return fmt.Errorf("Error creating text file %s: %v", txtfn, err)
+		}
+		full = append(full, t)
+	}
+	fn := filepath.Join(dir, bookname+".txt")
+	err = ioutil.WriteFile(fn, []byte(strings.Join(full, "\n")), 0644)
+	if err != nil {
+		return fmt.Errorf("Error creating text file %s: %v", fn, err)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"rescribe.xyz/bookpipeline/internal/postproc"
+)
+
+func Test_SaveBestText(t *testing.T) {
+	dir, err := ioutil.TempDir("", "savebesttexttest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = writeHocr(filepath.Join(dir, "0001.hocr"), 80, "fuch", "words")
+	if err != nil {
+		t.Fatalf("Could not write hOCR: %v", err)
+	}
+	err = writeHocr(filepath.Join(dir, "0002.hocr"), 80, "more", "words")
+	if err != nil {
+		t.Fatalf("Could not write hOCR: %v", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "best"), []byte("0001.hocr\n0002.hocr\n"), 0644)
+	if err != nil {
+		t.Fatalf("Could not write best file: %v", err)
+	}
+
+	rules, err := postproc.ParseRules(strings.NewReader("\\bfuch\\b\tsuch\n"))
+	if err != nil {
+		t.Fatalf("Could not parse rules: %v", err)
+	}
+
+	err = SaveBestText(dir, "book", rules)
+	if err != nil {
+		t.Fatalf("Error saving text: %v", err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "text", "0001.txt"))
+	if err != nil {
+		t.Fatalf("Could not read page text: %v", err)
+	}
+	if !strings.Contains(string(b), "such words") {
+		t.Fatalf("Expected text rules to be applied to page text, got %q", b)
+	}
+	b, err = ioutil.ReadFile(filepath.Join(dir, "book.txt"))
+	if err != nil {
+		t.Fatalf("Could not read book text: %v", err)
+	}
+	if !strings.Contains(string(b), "such words") || !strings.Contains(string(b), "more words") {
+		t.Fatalf("Expected book text to include every page with text rules applied, got %q", b)
+	}
+}
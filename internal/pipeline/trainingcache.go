@@ -0,0 +1,98 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// DefaultTrainingsPrefix is the prefix that trainings are stored
+// under in the bucket given to TrainingCache, if its Prefix isn't
+// set
+const DefaultTrainingsPrefix = "trainings/"
+
+// TrainingCache fetches trainings which aren't installed locally
+// from cloud storage the first time they are needed, so that new
+// trainings can be deployed by uploading them, rather than by
+// rebuilding each server. Each training is stored in Bucket as
+// Prefix + name.traineddata, and once fetched it is kept in Dir and
+// reused.
+type TrainingCache struct {
+	Conn   Downloader
+	Bucket string
+
+	// Prefix is the prefix the trainings are stored under in Bucket;
+	// if it is empty DefaultTrainingsPrefix is used.
+	Prefix string
+
+	// Dir is the directory trainings are saved to, which tesseract
+	// should read trainings from; if it is empty $TESSDATA_PREFIX is
+	// used.
+	Dir string
+
+	mu sync.Mutex
+}
+
+// Fetch downloads training, or each of the trainings if several are
+// joined with '+' as for tesseract's -l option, unless it is already
+// in the cache directory. Training names can come from job messages,
+// so any which could refer to a file outside the cache directory, or
+// another key in Bucket, are rejected.
+func (c *TrainingCache) Fetch(training string) error {
+	for _, t := range strings.Split(training, "+") {
+		if t == "" || strings.ContainsAny(t, `/\`) || strings.Contains(t, "..") {
+			return fmt.Errorf("Invalid training name %s", t)
+		}
+	}
+
+	dir := c.Dir
+	if dir == "" {
+		dir = os.Getenv("TESSDATA_PREFIX")
+	}
+	if dir == "" {
+		return fmt.Errorf("Error fetching training %s: TESSDATA_PREFIX is not set", training)
+	}
+	prefix := c.Prefix
+	if prefix == "" {
+		prefix = DefaultTrainingsPrefix
+	}
+
+	// several workers may need the same training at once, so only
+	// fetch one training at a time
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, t := range strings.Split(training, "+") {
+		name := t + ".traineddata"
+		fn := filepath.Join(dir, name)
+		if _, err := os.Stat(fn); err == nil {
+			continue
+		}
+
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return fmt.Errorf("Error creating directory %s: %v", dir, err)
+		}
+		c.Conn.Log("Fetching training", t, "to", fn)
+		// download to a temporary name first, so that tesseract never
+		// sees a partial training
+		tmp := fn + ".download"
+		err = c.Conn.Download(c.Bucket, prefix+name, tmp)
+		if err != nil {
+			_ = os.Remove(tmp)
+			return fmt.Errorf("Error fetching training %s: %v", t, err)
+		}
+		err = os.Rename(tmp, fn)
+		if err != nil {
+			_ = os.Remove(tmp)
+			return fmt.Errorf("Error saving training %s: %v", t, err)
+		}
+	}
+	return nil
+}
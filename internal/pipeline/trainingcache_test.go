@@ -0,0 +1,114 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+// downloadCountConn is a LocalConn which counts the downloads of
+// each key
+type downloadCountConn struct {
+	*bookpipeline.LocalConn
+	downloads map[string]int
+}
+
+func (d *downloadCountConn) Download(bucket string, key string, fn string) error {
+	d.downloads[key]++
+	return d.LocalConn.Download(bucket, key, fn)
+}
+
+func Test_TrainingCache(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test which uses a shell script")
+	}
+
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	dir, err := ioutil.TempDir("", "trainingcachetest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conn := &downloadCountConn{LocalConn: newTestConn(t, vlog), downloads: make(map[string]int)}
+
+	trainingfn := filepath.Join(dir, "new.traineddata")
+	err = ioutil.WriteFile(trainingfn, []byte("training"), 0644)
+	if err != nil {
+		t.Fatalf("Could not write training: %v", err)
+	}
+	err = conn.Upload(conn.WIPStorageId(), DefaultTrainingsPrefix+"new.traineddata", trainingfn)
+	if err != nil {
+		t.Fatalf("Could not upload training: %v", err)
+	}
+
+	// the fake tesseract fails unless the training is in tessdata
+	tessdata := filepath.Join(dir, "tessdata")
+	tesscmd := filepath.Join(dir, "tesseract")
+	script := "#!/bin/sh\n[ -f " + tessdata + "/$2.traineddata ] || exit 1\necho '<html><body></body></html>' > \"$4.hocr\"\n"
+	err = ioutil.WriteFile(tesscmd, []byte(script), 0755)
+	if err != nil {
+		t.Fatalf("Could not write fake tesseract: %v", err)
+	}
+
+	cache := &TrainingCache{Conn: conn, Bucket: conn.WIPStorageId(), Dir: tessdata}
+	opts := OcrOptions{Trainings: cache}
+
+	for _, pg := range []string{"0001.png", "0002.png"} {
+		t.Run(pg, func(t *testing.T) {
+			img := filepath.Join(dir, pg)
+			err := ioutil.WriteFile(img, []byte{}, 0644)
+			if err != nil {
+				t.Fatalf("Could not write image: %v", err)
+			}
+
+			toocr := make(chan string, 1)
+			up := make(chan string, 1)
+			errc := make(chan error, 1)
+			toocr <- img
+			close(toocr)
+			OcrWithOptions("new", tesscmd, opts)(context.Background(), toocr, up, errc, vlog)
+			select {
+			case err := <-errc:
+				t.Fatalf("Error OCRing %s: %v\nLog: %s", pg, err, slog.log)
+			default:
+			}
+
+			if n := conn.downloads[DefaultTrainingsPrefix+"new.traineddata"]; n != 1 {
+				t.Fatalf("Expected training to be downloaded once, got %d", n)
+			}
+			b, err := ioutil.ReadFile(filepath.Join(tessdata, "new.traineddata"))
+			if err != nil || string(b) != "training" {
+				t.Fatalf("Expected training to be cached, got %s, %v", b, err)
+			}
+		})
+	}
+
+	for _, bad := range []string{"../new", "eng+../../new", "sub/new", `sub\new`, "eng+", ".."} {
+		err = cache.Fetch(bad)
+		if err == nil {
+			t.Fatalf("Expected an error fetching the invalid training %s", bad)
+		}
+	}
+
+	err = cache.Fetch("missing")
+	if err == nil {
+		t.Fatalf("Expected an error fetching a missing training")
+	}
+	_, err = os.Stat(filepath.Join(tessdata, "missing.traineddata"))
+	if err == nil {
+		t.Fatalf("Expected nothing to be cached for a missing training")
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// TrainingsFile is the name of the file that the training manifest
+// for a book is stored in. It is saved alongside the images of the
+// book.
+const TrainingsFile = "trainings.json"
+
+// TrainingManifest maps pages of a book to the training to OCR them
+// with, for books which need different trainings for different
+// pages. It is stored as a JSON object, with each key either a page
+// number or an inclusive range of page numbers like "10-12", and
+// each value the name of a training, like this:
+//
+//	{"5": "grc", "10-12": "grc", "40": "eng"}
+//
+// Page numbers are the numbers in the filenames of the pages, which
+// for books uploaded with booktopipeline start at 0 for the first
+// image. Any pages not listed are OCRed with the training for the
+// book.
+type TrainingManifest map[string]string
+
+// parsePageRange parses a page number or an inclusive range of page
+// numbers like "10-12".
+func parsePageRange(s string) (int, int, error) {
+	parts := strings.SplitN(s, "-", 2)
+	first, err := strconv.Atoi(parts[0])
+	if err != nil || first < 0 {
+		return 0, 0, fmt.Errorf("Invalid page %s, should be a page number or a range like 10-12", s)
+	}
+	if len(parts) == 1 {
+		return first, first, nil
+	}
+	last, err := strconv.Atoi(parts[1])
+	if err != nil || last < first {
+		return 0, 0, fmt.Errorf("Invalid page %s, should be a page number or a range like 10-12", s)
+	}
+	return first, last, nil
+}
+
+// ParseTrainingManifest parses and checks a training manifest.
+func ParseTrainingManifest(b []byte) (TrainingManifest, error) {
+	var m TrainingManifest
+	err := json.Unmarshal(b, &m)
+	if err != nil {
+		return m, fmt.Errorf("Error parsing training manifest: %v", err)
+	}
+	for k, v := range m {
+		_, _, err = parsePageRange(k)
+		if err != nil {
+			return m, err
+		}
+		if v == "" || strings.ContainsAny(v, " \t\n") {
+			return m, fmt.Errorf("Invalid training '%s' for page %s", v, k)
+		}
+	}
+	return m, nil
+}
+
+// Training returns the training to use for a page, or an empty
+// string if the page isn't listed. If a page is in more than one
+// range a single page number is preferred, and otherwise the
+// narrowest range.
+func (m TrainingManifest) Training(page int) string {
+	var training string
+	width := -1
+	for k, v := range m {
+		first, last, err := parsePageRange(k)
+		if err != nil || page < first || page > last {
+			continue
+		}
+		if width == -1 || last-first < width || (last-first == width && v < training) {
+			training = v
+			width = last - first
+		}
+	}
+	return training
+}
+
+// pageNumber returns the number of the page that a file belongs to,
+// from the digits at the end of its page name, so that for example
+// both book_0012.jpg and 0012_bin0.2.png are page 12.
+func pageNumber(fn string) (int, bool) {
+	name := pageName(fn)
+	i := len(name)
+	for i > 0 && name[i-1] >= '0' && name[i-1] <= '9' {
+		i--
+	}
+	n, err := strconv.Atoi(name[i:])
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// UploadTrainingManifest saves the training manifest for a book as
+// JSON, and uploads it to the book's directory in conn.WIPStorageId().
+func UploadTrainingManifest(conn Uploader, bookname string, m TrainingManifest) error {
+	return uploadJSON(conn, bookname+"/"+TrainingsFile, m)
+}
+
+// GetTrainingManifest downloads and parses the training manifest for
+// a book. If the book has no manifest an empty one is returned.
+func GetTrainingManifest(conn DownloadLister, bookname string) (TrainingManifest, error) {
+	b, found, err := downloadBytes(conn, bookname+"/"+TrainingsFile)
+	if err != nil || !found {
+		return make(TrainingManifest), err
+	}
+	return ParseTrainingManifest(b)
+}
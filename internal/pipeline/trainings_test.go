@@ -0,0 +1,172 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+func Test_ParseTrainingManifest(t *testing.T) {
+	cases := []struct {
+		manifest string
+		err      bool
+	}{
+		{`{"5": "grc", "10-12": "grc", "40": "eng"}`, false},
+		{`{}`, false},
+		{`{"five": "grc"}`, true},
+		{`{"12-10": "grc"}`, true},
+		{`{"-1": "grc"}`, true},
+		{`{"5": ""}`, true},
+		{`{"5": "grc lat"}`, true},
+		{`["grc"]`, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.manifest, func(t *testing.T) {
+			_, err := ParseTrainingManifest([]byte(c.manifest))
+			if err == nil && c.err {
+				t.Fatalf("Expected an error, got none")
+			}
+			if err != nil && !c.err {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+		})
+	}
+}
+
+func Test_TrainingManifestTraining(t *testing.T) {
+	m := TrainingManifest{"5": "grc", "10-20": "grc", "12": "eng", "11-13": "lat"}
+	cases := []struct {
+		page     int
+		expected string
+	}{
+		{0, ""},
+		{5, "grc"},
+		{6, ""},
+		{10, "grc"},
+		{11, "lat"},
+		{12, "eng"},
+		{20, "grc"},
+		{21, ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.expected, func(t *testing.T) {
+			training := m.Training(c.page)
+			if training != c.expected {
+				t.Fatalf("Expected training '%s' for page %d, got '%s'", c.expected, c.page, training)
+			}
+		})
+	}
+}
+
+func Test_pageNumber(t *testing.T) {
+	cases := []struct {
+		fn       string
+		expected int
+		ok       bool
+	}{
+		{"book/0012_bin0.2.png", 12, true},
+		{"book/scan_0003.jpg", 3, true},
+		{"book/scan_0003_bin0.0.png", 3, true},
+		{"book/cover.jpg", 0, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.fn, func(t *testing.T) {
+			n, ok := pageNumber(c.fn)
+			if n != c.expected || ok != c.ok {
+				t.Fatalf("Expected %d, %v, got %d, %v", c.expected, c.ok, n, ok)
+			}
+		})
+	}
+}
+
+// Test_OcrPageTraining tests that OcrPage uses the training from the
+// book's training manifest for pages listed in it, and the training
+// for the book otherwise
+func Test_OcrPageTraining(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	conn := &fakeConn{LocalConn: newTestConn(t, vlog)}
+
+	err := UploadTrainingManifest(conn, "trainingsbook", TrainingManifest{"2": "grc", "4-5": "eng"})
+	if err != nil {
+		t.Fatalf("Error uploading training manifest: %v", err)
+	}
+	m, err := GetTrainingManifest(conn, "trainingsbook")
+	if err != nil {
+		t.Fatalf("Error getting training manifest: %v", err)
+	}
+	if len(m) != 2 || m["4-5"] != "eng" {
+		t.Fatalf("Training manifest differs from that uploaded: %v", m)
+	}
+
+	// record the training used to OCR each page, rather than running
+	// tesseract
+	var mu sync.Mutex
+	var used []string
+	oldocrfor := ocrFor
+	ocrFor = func(training string, tesscmd string, opts OcrOptions) func(context.Context, chan string, chan string, chan error, *log.Logger) {
+		return func(ctx context.Context, toocr chan string, up chan string, errc chan error, logger *log.Logger) {
+			for path := range toocr {
+				mu.Lock()
+				used = append(used, training)
+				mu.Unlock()
+				name := strings.TrimSuffix(path, ".png") + ".hocr"
+				err := writeHocr(name, 80, training)
+				if err != nil {
+					errc <- err
+					return
+				}
+				up <- name
+			}
+			close(up)
+		}
+	}
+	defer func() { ocrFor = oldocrfor }()
+
+	cases := []struct {
+		page     string
+		body     string
+		expected string
+	}{
+		{"0001_bin0.2.png", "trainingsbook/0001_bin0.2.png lat", "lat"},
+		{"0002_bin0.2.png", "trainingsbook/0002_bin0.2.png lat", "grc"},
+		{"0003_bin0.2.png", "trainingsbook/0003_bin0.2.png", "default"},
+		{"0005_bin0.2.png", "trainingsbook/0005_bin0.2.png", "eng"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.page, func(t *testing.T) {
+			err := conn.Upload(conn.WIPStorageId(), "trainingsbook/"+c.page, "testdata/good/1.png")
+			if err != nil {
+				t.Fatalf("Could not upload test file: %v", err)
+			}
+			mu.Lock()
+			used = nil
+			mu.Unlock()
+
+			msg := bookpipeline.Qmsg{Id: c.page, Handle: c.page, Body: c.body}
+			err = OcrPage(context.Background(), msg, conn, ocrFor("default", "", OcrOptions{}), OcrOptions{}, conn.OCRPageQueueId(), "")
+			if err != nil {
+				t.Fatalf("Error in OcrPage: %v\nLog: %s", err, slog.log)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(used) != 1 || used[0] != c.expected {
+				t.Fatalf("Expected page to be OCRed with %s, got %v", c.expected, used)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+// TsvName returns the name of the TSV file saved alongside an hOCR
+// file by tesseract when OcrOptions.Tsv is set, which lists each
+// word with its confidence.
+func TsvName(hocrfn string) string {
+	return strings.TrimSuffix(hocrfn, ".hocr") + ".tsv"
+}
+
+// tsvLine identifies a line in a TSV file, as its line number is
+// only unique within its block and paragraph
+type tsvLine struct {
+	block, par, line string
+}
+
+// getTsvConfText reads a TSV file written by tesseract, returning
+// the average confidence of its words and its text, in the same way
+// as getConfText does for an hOCR file. This is much quicker than
+// parsing the hOCR, as each word is a single line of the file. The
+// confidences in the TSV are more precise than those in the hOCR,
+// which are rounded down, so the result can differ slightly.
+func getTsvConfText(path string, bylines bool) (float64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", fmt.Errorf("Error opening TSV %s: %v", path, err)
+	}
+	defer f.Close()
+
+	var total float64
+	var n int
+	var text strings.Builder
+	linetotals := make(map[tsvLine]float64)
+	linewords := make(map[tsvLine]int)
+	var lines []tsvLine // in the order they are found, to sum them in
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		// the columns are level, page_num, block_num, par_num,
+		// line_num, word_num, left, top, width, height, conf and
+		// text, and level 5 is a word
+		cols := strings.Split(s.Text(), "\t")
+		if len(cols) < 12 || cols[0] != "5" {
+			continue
+		}
+		conf, err := strconv.ParseFloat(cols[10], 64)
+		if err != nil {
+			return 0, "", fmt.Errorf("Error parsing confidence %s in TSV %s: %v", cols[10], path, err)
+		}
+		if conf < 0 {
+			continue
+		}
+		total += conf
+		n++
+		l := tsvLine{block: cols[2], par: cols[3], line: cols[4]}
+		if linewords[l] == 0 {
+			lines = append(lines, l)
+		}
+		linetotals[l] += conf
+		linewords[l]++
+		if n > 1 {
+			text.WriteString(" ")
+		}
+		text.WriteString(strings.TrimSpace(cols[11]))
+	}
+	if err = s.Err(); err != nil {
+		return 0, "", fmt.Errorf("Error reading TSV %s: %v", path, err)
+	}
+	if n == 0 {
+		return 0, "", errors.New("No words found")
+	}
+	if !bylines {
+		return total / float64(n), text.String(), nil
+	}
+	// the lines are summed in the order they were found, as floating
+	// point addition in the random order of map iteration can give
+	// slightly different results
+	var linesum float64
+	for _, l := range lines {
+		linesum += linetotals[l] / float64(linewords[l])
+	}
+	return linesum / float64(len(lines)), text.String(), nil
+}
+
+// getTsv returns the path of the TSV file for an hOCR file of the
+// book bookname, if it was saved during OCR, downloading it if it
+// isn't already there. If bookname is empty the name of the
+// directory of the hOCR file is used.
+func getTsv(conn Downloader, bookname string, hocrfn string) (string, bool) {
+	tsv := TsvName(hocrfn)
+	if _, err := os.Stat(tsv); err == nil {
+		return tsv, true
+	}
+	if bookname == "" {
+		bookname = filepath.Base(filepath.Dir(hocrfn))
+	}
+	key := bookname + "/" + filepath.Base(tsv)
+	err := conn.Download(conn.WIPStorageId(), key, tsv)
+	if err != nil {
+		_ = os.Remove(tsv)
+		return tsv, false
+	}
+	return tsv, true
+}
+
+// upTsv uploads the TSV file of an hOCR file, if it has one,
+// removing the local copy once it has been uploaded
+func upTsv(conn Uploader, bookname string, hocrfn string, logger *log.Logger) error {
+	if !strings.HasSuffix(hocrfn, ".hocr") {
+		return nil
+	}
+	tsv := TsvName(hocrfn)
+	if _, err := os.Stat(tsv); os.IsNotExist(err) {
+		return nil
+	}
+	key := bookname + "/" + filepath.Base(tsv)
+	logger.Println(bookpipeline.DebugTag+"Uploading", key)
+	err := conn.Upload(conn.WIPStorageId(), key, tsv)
+	if err != nil {
+		return err
+	}
+	return os.Remove(tsv)
+}
@@ -0,0 +1,168 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const sampleTsv = "testdata/hocr/sample.tsv"
+
+// Test_getTsvConfText tests that the confidence and text read from
+// the TSV of a page match those read from its hOCR. The confidences
+// in the hOCR are rounded down, so can be up to 1 lower.
+func Test_getTsvConfText(t *testing.T) {
+	for _, bylines := range []bool{false, true} {
+		expected, expectedtext, err := getConfText(sampleHocr, bylines)
+		if err != nil {
+			t.Fatalf("Error getting confidence from hOCR: %v", err)
+		}
+		avg, text, err := getTsvConfText(sampleTsv, bylines)
+		if err != nil {
+			t.Fatalf("Error getting confidence from TSV: %v", err)
+		}
+		if math.Abs(avg-expected) > 1 {
+			t.Fatalf("Expected confidence within 1 of %f with bylines %v, got %f", expected, bylines, avg)
+		}
+		if text != expectedtext {
+			t.Fatalf("Expected text %s, got %s", expectedtext, text)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "tsvconftest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	empty := filepath.Join(dir, "empty.tsv")
+	err = ioutil.WriteFile(empty, []byte("level\tpage_num\tblock_num\tpar_num\tline_num\tword_num\tleft\ttop\twidth\theight\tconf\ttext\n1\t1\t0\t0\t0\t0\t0\t0\t100\t100\t-1\t\n"), 0644)
+	if err != nil {
+		t.Fatalf("Could not write %s: %v", empty, err)
+	}
+	_, _, err = getTsvConfText(empty, false)
+	if err == nil || err.Error() != "No words found" {
+		t.Fatalf("Expected 'No words found' error, got %v", err)
+	}
+}
+
+// Test_AnalyseTsv tests that Analyse uses the confidence from the
+// TSV of a page when its OCR parameters show it was saved along with
+// the hOCR, and the hOCR otherwise, so that a TSV left from an
+// earlier OCR of the page isn't used
+func Test_AnalyseTsv(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	conn := newTestConn(t, vlog)
+
+	cases := []struct {
+		name string
+		tsv  bool
+		best string
+	}{
+		{"tsv", true, "0001_bin0.1.hocr\n"},
+		{"stale", false, "0001_bin0.2.hocr\n"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "analysetsvtest")
+			if err != nil {
+				t.Fatalf("Could not create temporary directory: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			var hocrs []string
+			for _, p := range []struct {
+				hocr string
+				conf int
+			}{{"0001_bin0.1.hocr", 60}, {"0001_bin0.2.hocr", 80}} {
+				fn := filepath.Join(dir, p.hocr)
+				err = writeHocr(fn, p.conf, "some", "words")
+				if err != nil {
+					t.Fatalf("Could not write hOCR file %s: %v", fn, err)
+				}
+				params := newOcrParams(strings.TrimSuffix(fn, ".hocr")+".png", "eng", -1)
+				params.Tsv = c.tsv && len(hocrs) == 0
+				_, err = writeOcrParams(fn, params)
+				if err != nil {
+					t.Fatalf("Could not write OCR parameters: %v", err)
+				}
+				hocrs = append(hocrs, fn)
+			}
+			// the TSV gives the first binarisation a higher confidence
+			// than its hOCR, so it is only chosen if the TSV is used
+			tsv := "level\tpage_num\tblock_num\tpar_num\tline_num\tword_num\tleft\ttop\twidth\theight\tconf\ttext\n" +
+				"5\t1\t1\t1\t1\t1\t0\t0\t10\t10\t90.5\tsome\n" +
+				"5\t1\t1\t1\t1\t2\t20\t0\t10\t10\t90.5\twords\n"
+			err = ioutil.WriteFile(TsvName(hocrs[0]), []byte(tsv), 0644)
+			if err != nil {
+				t.Fatalf("Could not write TSV: %v", err)
+			}
+
+			_, err = runAnalyse(Analyse(conn, AnalyseOptions{}), hocrs, vlog)
+			if err != nil {
+				t.Fatalf("Error in Analyse: %v\nLog: %s", err, slog.log)
+			}
+			b, err := ioutil.ReadFile(filepath.Join(dir, "best"))
+			if err != nil {
+				t.Fatalf("Could not read best file: %v", err)
+			}
+			if string(b) != c.best {
+				t.Fatalf("Expected best file:\n%s\ngot:\n%s", c.best, b)
+			}
+		})
+	}
+}
+
+// Test_getTsv tests that the TSV of an hOCR file is downloaded from
+// the book it belongs to, including for book names containing "/"
+func Test_getTsv(t *testing.T) {
+	cases := []struct {
+		name     string
+		bookname string
+		key      string
+		found    bool
+	}{
+		{"plain", "book", "book/0001_bin0.1.tsv", true},
+		{"slash", "collection/book", "collection/book/0001_bin0.1.tsv", true},
+		{"nobookname", "", "book/0001_bin0.1.tsv", true},
+		{"wrongbook", "collection/book", "book/0001_bin0.1.tsv", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conn := newTestConn(t, log.New(ioutil.Discard, "", 0))
+			dir := conn.TempDir
+			err := conn.Upload(conn.WIPStorageId(), c.key, sampleTsv)
+			if err != nil {
+				t.Fatalf("Could not upload TSV: %v", err)
+			}
+
+			bookdir := filepath.Join(dir, "book")
+			err = os.Mkdir(bookdir, 0700)
+			if err != nil {
+				t.Fatalf("Could not create book directory: %v", err)
+			}
+			tsv, found := getTsv(conn, c.bookname, filepath.Join(bookdir, "0001_bin0.1.hocr"))
+			if found != c.found {
+				t.Fatalf("Expected found to be %v, got %v", c.found, found)
+			}
+			_, err = os.Stat(tsv)
+			if c.found && err != nil {
+				t.Fatalf("Expected TSV to be downloaded to %s: %v", tsv, err)
+			}
+			if !c.found && err == nil {
+				t.Fatalf("Expected no TSV to be left at %s", tsv)
+			}
+		})
+	}
+}
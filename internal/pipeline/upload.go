@@ -0,0 +1,196 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// BookUploader is a Pipeliner which can also list the books in
+// storage, to check for books with the same content
+type BookUploader interface {
+	Pipeliner
+	ListObjectPrefixes(bucket string) ([]string, error)
+}
+
+// UploadOptions contains the options for UploadBook
+type UploadOptions struct {
+	// Images is a list of paths to page images to upload, in order,
+	// instead of every image in the book directory
+	Images []string
+	// CheckWorkers is the number of images to check at once, or 0
+	// for DefaultCheckWorkers
+	CheckWorkers int
+	// Meta is metadata to save with the book in meta.json, as well
+	// as the content hash of its images
+	Meta map[string]string
+	// Trainings maps page numbers to the training to use for them
+	Trainings TrainingManifest
+	// Order maps image filenames to their position in the book
+	Order PageOrder
+	// Exclusions are the pages to leave out of the PDFs and text
+	Exclusions PageExclusions
+	// DPI is the DPI the book was scanned at, or 0 if unknown
+	DPI float64
+	// AutoDPI uses the DPI recorded in each image
+	AutoDPI bool
+	// WarnLog is where warnings are logged, such as that the same
+	// images have already been uploaded; if it is nil they are
+	// logged with conn.Log
+	WarnLog *log.Logger
+}
+
+// UploadBook checks the images of the book in dir and uploads them
+// to conn.WIPStorageId() as bookname, along with their original
+// filenames, the content hash of the images, and any metadata, page
+// order, page exclusions, training manifest and DPI given in opts.
+// It doesn't add the book to a queue. An error is returned if a
+// book named bookname has already been uploaded or cancelled.
+func UploadBook(ctx context.Context, conn BookUploader, dir string, bookname string, opts UploadOptions) error {
+	warn := conn.Log
+	if opts.WarnLog != nil {
+		warn = opts.WarnLog.Println
+	}
+
+	var names map[string]string
+	var err error
+	if opts.Images != nil {
+		names = ImageListOriginalNames(opts.Images)
+	} else {
+		names, err = OriginalNames(dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	var order PageOrder
+	if opts.Order != nil {
+		order, err = opts.Order.PipelineOrder(names)
+		if err != nil {
+			return err
+		}
+	}
+
+	conn.Log("Checking that all images are valid in", dir)
+	if opts.Images != nil {
+		err = CheckImageList(ctx, opts.Images, opts.CheckWorkers)
+	} else {
+		err = CheckImages(ctx, dir, opts.CheckWorkers)
+	}
+	if err != nil {
+		return err
+	}
+
+	conn.Log("Checking that a book hasn't already been uploaded with the same images")
+	var hash string
+	if opts.Images != nil {
+		hash, err = ImageListContentHash(opts.Images)
+	} else {
+		hash, err = ContentHash(dir)
+	}
+	if err != nil {
+		return err
+	}
+	dupes, err := BooksWithContentHash(conn, hash)
+	if err != nil {
+		warn("Warning: Could not check whether the same images have already been uploaded:", err)
+	}
+	if len(dupes) > 0 {
+		warn("Warning: The same images have already been uploaded as", strings.Join(dupes, ", "))
+	}
+	meta := make(map[string]string)
+	for k, v := range opts.Meta {
+		meta[k] = v
+	}
+	meta[ContentHashKey] = hash
+
+	conn.Log("Checking that a book hasn't already been uploaded with that name")
+	err = CheckNotCancelled(conn, bookname)
+	if err != nil {
+		return err
+	}
+	list, err := conn.ListObjects(conn.WIPStorageId(), bookname)
+	if err != nil {
+		return err
+	}
+	if len(list) > 0 {
+		return fmt.Errorf("Error: There is already a book in S3 named %s", bookname)
+	}
+
+	conn.Log("Uploading all images in", dir)
+	if opts.Images != nil {
+		err = UploadImageList(ctx, opts.Images, bookname, conn)
+	} else {
+		err = UploadImages(ctx, dir, bookname, conn)
+	}
+	if err != nil {
+		return err
+	}
+
+	conn.Log("Uploading original filenames")
+	err = UploadOriginalNames(conn, bookname, names)
+	if err != nil {
+		return err
+	}
+
+	if order != nil {
+		conn.Log("Uploading page order manifest")
+		err = UploadPageOrder(conn, bookname, order)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(opts.Exclusions) > 0 {
+		conn.Log("Uploading pages to exclude")
+		err = UploadPageExclusions(conn, bookname, opts.Exclusions)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.Trainings != nil {
+		conn.Log("Uploading training manifest")
+		err = UploadTrainingManifest(conn, bookname, opts.Trainings)
+		if err != nil {
+			return err
+		}
+	}
+
+	dpis := DPIs{Book: opts.DPI}
+	if opts.AutoDPI {
+		conn.Log("Finding the DPI of each image")
+		if opts.Images != nil {
+			dpis.Pages, err = FindImageListDPIs(opts.Images)
+		} else {
+			dpis.Pages, err = FindDPIs(dir)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if dpis.Book > 0 || len(dpis.Pages) > 0 {
+		conn.Log("Uploading DPI")
+		err = UploadDPIs(conn, bookname, dpis)
+		if err != nil {
+			return err
+		}
+	}
+
+	conn.Log("Uploading metadata")
+	err = UploadMeta(conn, bookname, meta)
+	if err != nil {
+		return err
+	}
+	err = AddContentHash(conn, bookname, hash)
+	if err != nil {
+		warn("Warning: Could not record the content hash of the images:", err)
+	}
+
+	return nil
+}
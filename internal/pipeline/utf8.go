@@ -0,0 +1,49 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"unicode/utf8"
+)
+
+// SanitiseUTF8 returns b with each invalid UTF-8 byte sequence
+// replaced with the Unicode replacement character, along with the
+// number (counting from 1) of each line which had any replaced. Some
+// trainings occasionally produce invalid UTF-8, which would otherwise
+// stop the hOCR from being parsed as XML or exported.
+func SanitiseUTF8(b []byte) ([]byte, []int) {
+	if utf8.Valid(b) {
+		return b, nil
+	}
+	var lines []int
+	for i, l := range bytes.Split(b, []byte("\n")) {
+		if !utf8.Valid(l) {
+			lines = append(lines, i+1)
+		}
+	}
+	return bytes.ToValidUTF8(b, []byte(string(utf8.RuneError))), lines
+}
+
+// SanitiseHocrFile replaces any invalid UTF-8 in the hOCR file fn
+// with SanitiseUTF8, saving the result in place. The line number of
+// each replacement is returned, so that it can be reported.
+func SanitiseHocrFile(fn string) ([]int, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading hOCR %s: %v", fn, err)
+	}
+	clean, lines := SanitiseUTF8(b)
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	err = ioutil.WriteFile(fn, clean, 0644)
+	if err != nil {
+		return lines, fmt.Errorf("Error saving sanitised hOCR %s: %v", fn, err)
+	}
+	return lines, nil
+}
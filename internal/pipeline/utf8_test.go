@@ -0,0 +1,42 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"fmt"
+	"testing"
+	"unicode/utf8"
+)
+
+func Test_SanitiseUTF8(t *testing.T) {
+	cases := []struct {
+		name     string
+		in       string
+		expected string
+		lines    []int
+	}{
+		{"valid", "<span>café</span>\n", "<span>café</span>\n", nil},
+		{"replacementchar", "a�b", "a�b", nil},
+		{"invalid", "<span>caf\xe9</span>\n", "<span>caf�</span>\n", []int{1}},
+		{"run", "a\xff\xfe\xfdb", "a�b", []int{1}},
+		{"tworuns", "a\xffb\xfec\nd", "a�b�c\nd", []int{1}},
+		{"truncated", "line1\nline2 \xe2\x82\nline3 \xc3", "line1\nline2 �\nline3 �", []int{2, 3}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			out, lines := SanitiseUTF8([]byte(c.in))
+			if !utf8.Valid(out) {
+				t.Fatalf("Expected valid UTF-8, got %q", out)
+			}
+			if string(out) != c.expected {
+				t.Fatalf("Expected %q, got %q", c.expected, out)
+			}
+			if fmt.Sprint(lines) != fmt.Sprint(c.lines) {
+				t.Fatalf("Expected replacements on lines %v, got %v", c.lines, lines)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// WatchOptions are the settings used by WatchDir.
+type WatchOptions struct {
+	// Done is the directory each book is moved to once it has been
+	// processed. It is created if it doesn't exist, and is ignored
+	// if it is inside the directory being watched.
+	Done string
+
+	// Settle is how long the files of a book must stay unchanged
+	// before it is processed, so that books which are still being
+	// copied into the directory aren't processed too early. If zero
+	// a default of 10 seconds is used.
+	Settle time.Duration
+
+	// Interval is how often the directory is checked for new books.
+	// If zero a default of 2 seconds is used.
+	Interval time.Duration
+}
+
+// bookState is the state of a book directory which is being watched
+// by WatchDir
+type bookState struct {
+	// sig changes whenever a file in the book is added, removed or
+	// changed
+	sig string
+	// since is when sig was first seen
+	since time.Time
+	// failed is set if the book failed to be processed with sig,
+	// so that it is only tried again once it has been changed
+	failed bool
+}
+
+// dirSignature returns a string which changes whenever a file in dir
+// or its subdirectories is added, removed or changed
+func dirSignature(dir string) (string, error) {
+	var n int
+	var size int64
+	var latest time.Time
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		n++
+		size += info.Size()
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d %d %d", n, size, latest.UnixNano()), nil
+}
+
+// WatchDir watches the directory inbox for new book directories,
+// calling process with the path of each once its files have stopped
+// changing for opts.Settle, along with a directory to save the
+// results in, and then moving the book into opts.Done along with the
+// results. The results directory is a staging directory inside
+// opts.Done, rather than the book itself, so that a book which fails
+// to be processed is left unchanged. If process fails the error is
+// logged, any results are removed, and the book is left where it is,
+// and only processed again if it is changed. Hidden directories are
+// ignored. WatchDir runs until ctx is cancelled, when it returns
+// ctx.Err(), or an error occurs watching the directory.
+func WatchDir(ctx context.Context, inbox string, opts WatchOptions, process func(ctx context.Context, bookdir string, savedir string) error, logger *log.Logger) error {
+	if opts.Settle == 0 {
+		opts.Settle = 10 * time.Second
+	}
+	if opts.Interval == 0 {
+		opts.Interval = 2 * time.Second
+	}
+	err := os.MkdirAll(opts.Done, 0755)
+	if err != nil {
+		return fmt.Errorf("Error creating directory %s: %v", opts.Done, err)
+	}
+	done, err := filepath.Abs(opts.Done)
+	if err != nil {
+		return fmt.Errorf("Error finding path of %s: %v", opts.Done, err)
+	}
+	staging := filepath.Join(opts.Done, ".staging")
+
+	books := make(map[string]*bookState)
+	t := time.NewTicker(opts.Interval)
+	defer t.Stop()
+	for {
+		files, err := ioutil.ReadDir(inbox)
+		if err != nil {
+			return fmt.Errorf("Error reading directory %s: %v", inbox, err)
+		}
+		seen := make(map[string]bool)
+		for _, f := range files {
+			if !f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+				continue
+			}
+			dir := filepath.Join(inbox, f.Name())
+			if abs, err := filepath.Abs(dir); err == nil && abs == done {
+				continue
+			}
+			seen[dir] = true
+
+			sig, err := dirSignature(dir)
+			if err != nil {
+				// the book may have been moved away while being
+				// checked, so just try again next time
+				logger.Printf("Warning: could not check %s: %v\n", dir, err)
+				continue
+			}
+			b, ok := books[dir]
+			if !ok || b.sig != sig {
+				if !ok {
+					logger.Println("Found new book", dir)
+				}
+				books[dir] = &bookState{sig: sig, since: now()}
+				continue
+			}
+			if b.failed || now().Sub(b.since) < opts.Settle {
+				continue
+			}
+
+			logger.Println("Processing", dir)
+			savedir := filepath.Join(staging, f.Name())
+			err = os.MkdirAll(savedir, 0755)
+			if err != nil {
+				return fmt.Errorf("Error creating directory %s: %v", savedir, err)
+			}
+			err = process(ctx, dir, savedir)
+			if ctx.Err() != nil {
+				_ = os.RemoveAll(savedir)
+				return ctx.Err()
+			}
+			if err != nil {
+				logger.Printf("Error processing %s, it will be tried again if it is changed: %v\n", dir, err)
+				_ = os.RemoveAll(savedir)
+				failBook(b, dir)
+				continue
+			}
+			dest := filepath.Join(opts.Done, f.Name())
+			logger.Println("Finished processing", dir, "moving it to", dest)
+			err = os.Rename(dir, dest)
+			if err == nil {
+				err = moveContents(savedir, dest)
+			}
+			if err != nil {
+				logger.Printf("Error moving %s to %s: %v\n", dir, dest, err)
+				failBook(b, dir)
+				continue
+			}
+			_ = os.RemoveAll(savedir)
+			delete(books, dir)
+		}
+		// forget any books which have been removed
+		for dir := range books {
+			if !seen[dir] {
+				delete(books, dir)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// failBook marks a book as having failed to be processed, so that it
+// is only tried again once it has been changed. Its signature is
+// taken again, in case anything changed it while it was processed.
+func failBook(b *bookState, dir string) {
+	b.failed = true
+	if sig, err := dirSignature(dir); err == nil {
+		b.sig = sig
+	}
+}
+
+// moveContents moves each file and directory in src into dst
+func moveContents(src string, dst string) error {
+	files, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		err = os.Rename(filepath.Join(src, f.Name()), filepath.Join(dst, f.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Test_WatchDir tests that a book dropped into a watched directory
+// is processed once it has settled, and then moved to the done
+// directory, and that a book which fails is left alone
+func Test_WatchDir(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	dir, err := ioutil.TempDir("", "watchdirtest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	inbox := filepath.Join(dir, "inbox")
+	staging := filepath.Join(dir, "staging")
+	done := filepath.Join(inbox, "done")
+	for _, d := range []string{inbox, staging} {
+		err = os.Mkdir(d, 0755)
+		if err != nil {
+			t.Fatalf("Could not create directory %s: %v", d, err)
+		}
+	}
+
+	// books are written in full elsewhere and then moved into the
+	// inbox, as a folder would be dropped into it
+	dropBook := func(name string) {
+		book := filepath.Join(staging, name)
+		err := os.Mkdir(book, 0755)
+		if err != nil {
+			t.Fatalf("Could not create directory %s: %v", book, err)
+		}
+		for _, fn := range []string{"0001.jpg", "0002.jpg"} {
+			err = ioutil.WriteFile(filepath.Join(book, fn), []byte("page"), 0644)
+			if err != nil {
+				t.Fatalf("Could not write %s: %v", fn, err)
+			}
+		}
+		err = os.Rename(book, filepath.Join(inbox, name))
+		if err != nil {
+			t.Fatalf("Could not move %s into inbox: %v", name, err)
+		}
+	}
+
+	var mu sync.Mutex
+	var processed []string
+	processedc := make(chan string, 10)
+	// each book has a result written for it, even the one which then
+	// fails, as a book can fail partway through being processed
+	process := func(ctx context.Context, bookdir string, savedir string) error {
+		mu.Lock()
+		processed = append(processed, filepath.Base(bookdir))
+		mu.Unlock()
+		err := ioutil.WriteFile(filepath.Join(savedir, "result.txt"), []byte("result"), 0644)
+		processedc <- filepath.Base(bookdir)
+		if err != nil {
+			return err
+		}
+		if filepath.Base(bookdir) == "bad" {
+			return errors.New("could not process book")
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error)
+	go func() {
+		errc <- WatchDir(ctx, inbox, WatchOptions{Done: done, Settle: 100 * time.Millisecond, Interval: 10 * time.Millisecond}, process, vlog)
+	}()
+
+	dropBook("bad")
+	dropBook("good")
+
+	timeout := time.After(10 * time.Second)
+	got := make(map[string]bool)
+	for len(got) < 2 {
+		select {
+		case name := <-processedc:
+			got[name] = true
+		case err = <-errc:
+			t.Fatalf("WatchDir stopped early: %v", err)
+		case <-timeout:
+			cancel()
+			t.Fatalf("Timed out waiting for books to be processed, processed %v", got)
+		}
+	}
+
+	for {
+		_, err = os.Stat(filepath.Join(done, "good", "0001.jpg"))
+		if err == nil {
+			break
+		}
+		select {
+		case <-timeout:
+			cancel()
+			t.Fatalf("Timed out waiting for book to be moved to %s", done)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	// give the watcher time to try the failed book again if it wrongly
+	// would, before stopping it
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+	err = <-errc
+	if err != context.Canceled {
+		t.Fatalf("Expected WatchDir to return context.Canceled, got %v", err)
+	}
+
+	if _, err = os.Stat(filepath.Join(inbox, "good")); !os.IsNotExist(err) {
+		t.Fatalf("Expected processed book to be moved out of the inbox")
+	}
+	if _, err = os.Stat(filepath.Join(inbox, "bad", "0001.jpg")); err != nil {
+		t.Fatalf("Expected failed book to be left in the inbox: %v", err)
+	}
+	badfiles, err := ioutil.ReadDir(filepath.Join(inbox, "bad"))
+	if err != nil {
+		t.Fatalf("Could not read failed book: %v", err)
+	}
+	if len(badfiles) != 2 {
+		t.Fatalf("Expected failed book to be left unchanged, got %d files", len(badfiles))
+	}
+	if _, err = os.Stat(filepath.Join(done, "good", "result.txt")); err != nil {
+		t.Fatalf("Expected result to be moved along with the book: %v", err)
+	}
+	staged, err := ioutil.ReadDir(filepath.Join(done, ".staging"))
+	if err != nil {
+		t.Fatalf("Could not read staging directory: %v", err)
+	}
+	if len(staged) != 0 {
+		t.Fatalf("Expected staging directory to be empty, got %d files", len(staged))
+	}
+	if len(processed) != 2 {
+		t.Fatalf("Expected 2 books to be processed once each, got %v\nLog: %s", processed, slog.log)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"fmt"
+	"strings"
+)
+
+// runeRange is an inclusive range of characters
+type runeRange struct {
+	first, last rune
+}
+
+// commonRanges are the digits and punctuation which are used
+// alongside all scripts
+var commonRanges = []runeRange{
+	{'!', '@'},
+	{'[', '`'},
+	{'{', '~'},
+}
+
+// scriptRanges are the letters of each script, in addition to
+// commonRanges
+var scriptRanges = map[string][]runeRange{
+	"latin": {
+		{'A', 'Z'},
+		{'a', 'z'},
+		{'¡', '¿'},
+		{'À', 'Ö'},
+		{'Ø', 'ö'},
+		{'ø', 'ÿ'},
+		{'Ā', 'ſ'},
+	},
+	"greek": {
+		{'Ά', 'ώ'},
+		{'ἀ', '῾'},
+	},
+	"cyrillic": {
+		{'Ѐ', 'џ'},
+	},
+}
+
+// languageScripts maps tesseract language codes to the script they
+// are written in
+var languageScripts = map[string]string{
+	"cat": "latin",
+	"ces": "latin",
+	"dan": "latin",
+	"deu": "latin",
+	"eng": "latin",
+	"enm": "latin",
+	"fra": "latin",
+	"frm": "latin",
+	"ita": "latin",
+	"lat": "latin",
+	"nld": "latin",
+	"nor": "latin",
+	"pol": "latin",
+	"por": "latin",
+	"spa": "latin",
+	"swe": "latin",
+	"ell": "greek",
+	"grc": "greek",
+	"bel": "cyrillic",
+	"bul": "cyrillic",
+	"rus": "cyrillic",
+	"srp": "cyrillic",
+	"ukr": "cyrillic",
+}
+
+// ScriptWhitelist returns a whitelist of the characters used in a
+// script, suitable for OcrOptions.Whitelist. The name can be a script
+// (latin, greek or cyrillic) or a tesseract language code written in
+// one of them, such as eng or grc.
+func ScriptWhitelist(name string) (string, error) {
+	script := strings.ToLower(name)
+	if s, ok := languageScripts[script]; ok {
+		script = s
+	}
+	ranges, ok := scriptRanges[script]
+	if !ok {
+		return "", fmt.Errorf("Unknown script or language: %s", name)
+	}
+
+	var b strings.Builder
+	for _, rr := range append(commonRanges, ranges...) {
+		for c := rr.first; c <= rr.last; c++ {
+			b.WriteRune(c)
+		}
+	}
+	return b.String(), nil
+}
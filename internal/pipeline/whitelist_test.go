@@ -0,0 +1,147 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func Test_ocrArgs(t *testing.T) {
+	cases := []struct {
+		name     string
+		opts     OcrOptions
+		expected []string
+	}{
+		{"default", OcrOptions{}, []string{}},
+		{"whitelist", OcrOptions{Whitelist: "abc"}, []string{"-c", "tessedit_char_whitelist=abc"}},
+		{"blacklist", OcrOptions{Blacklist: "|"}, []string{"-c", "tessedit_char_blacklist=|"}},
+		{"both", OcrOptions{Whitelist: "αβγ", Blacklist: "β"}, []string{"-c", "tessedit_char_whitelist=αβγ", "-c", "tessedit_char_blacklist=β"}},
+		{"tsv", OcrOptions{Tsv: true}, []string{"-c", "tessedit_create_tsv=1"}},
+	}
+
+	base := []string{"-l", "eng", "0001.png", "0001", "-c", "tessedit_create_hocr=1", "-c", "hocr_font_info=0"}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			args := ocrArgs("eng", "0001.png", "0001", c.opts)
+			expected := append(append([]string{}, base...), c.expected...)
+			if strings.Join(args, " ") != strings.Join(expected, " ") {
+				t.Fatalf("Expected args %v, got %v", expected, args)
+			}
+		})
+	}
+}
+
+func Test_OcrWithOptions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test which uses a shell script")
+	}
+
+	cases := []struct {
+		name      string
+		opts      OcrOptions
+		whitelist bool
+	}{
+		{"nowhitelist", OcrOptions{}, false},
+		{"emptywhitelist", OcrOptions{Whitelist: ""}, false},
+		{"whitelist", OcrOptions{Whitelist: "abc"}, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "whitelisttest")
+			if err != nil {
+				t.Fatalf("Could not create temporary directory: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			// a fake tesseract which records its arguments
+			argsfn := filepath.Join(dir, "args")
+			tesscmd := filepath.Join(dir, "tesseract")
+			script := "#!/bin/sh\nfor a in \"$@\"; do echo \"$a\" >> " + argsfn + "; done\ntouch \"$4.hocr\"\n"
+			err = ioutil.WriteFile(tesscmd, []byte(script), 0755)
+			if err != nil {
+				t.Fatalf("Could not create fake tesseract: %v", err)
+			}
+
+			toocr := make(chan string, 1)
+			up := make(chan string, 1)
+			errc := make(chan error, 1)
+			toocr <- filepath.Join(dir, "0001.png")
+			close(toocr)
+			OcrWithOptions("eng", tesscmd, c.opts)(context.Background(), toocr, up, errc, log.New(ioutil.Discard, "", 0))
+			select {
+			case err = <-errc:
+				t.Fatalf("Error running OCR: %v", err)
+			default:
+			}
+
+			b, err := ioutil.ReadFile(argsfn)
+			if err != nil {
+				t.Fatalf("Could not read arguments: %v", err)
+			}
+			args := string(b)
+			if strings.Contains(args, "tessedit_char_whitelist") != c.whitelist {
+				t.Fatalf("Expected whitelist to be passed: %v, got arguments:\n%s", c.whitelist, args)
+			}
+			if c.whitelist && !strings.Contains(args, "tessedit_char_whitelist="+c.opts.Whitelist+"\n") {
+				t.Fatalf("Expected whitelist %s to be passed, got arguments:\n%s", c.opts.Whitelist, args)
+			}
+		})
+	}
+}
+
+func Test_ScriptWhitelist(t *testing.T) {
+	cases := []struct {
+		name     string
+		included string
+		excluded string
+		err      bool
+	}{
+		{"latin", "aZſé0.", "αЖ", false},
+		{"eng", "aZ", "α", false},
+		{"pol", "Źdźbłołąki", "α", false},
+		{"ces", "Přílišžluťoučkýkůň", "Ж", false},
+		{"spa", "¿Qué?¡Sí!«»°", "α", false},
+		{"grc", "αΩἄῷ,", "aЖ", false},
+		{"Greek", "α", "a", false},
+		{"rus", "ЖжЁ", "aα", false},
+		{"klingon", "", "", true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			wl, err := ScriptWhitelist(c.name)
+			if c.err {
+				if err == nil {
+					t.Fatalf("Expected an error, got whitelist %s", wl)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Error getting whitelist: %v", err)
+			}
+			for _, r := range c.included {
+				if !strings.ContainsRune(wl, r) {
+					t.Errorf("Expected %c to be in whitelist", r)
+				}
+			}
+			for _, r := range c.excluded {
+				if strings.ContainsRune(wl, r) {
+					t.Errorf("Expected %c not to be in whitelist", r)
+				}
+			}
+			if strings.ContainsRune(wl, ' ') {
+				t.Errorf("Expected space not to be in whitelist")
+			}
+		})
+	}
+}
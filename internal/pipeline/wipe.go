@@ -0,0 +1,283 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"rescribe.xyz/preproc"
+)
+
+// WipeSettings are the parameters used to wipe prebinarised page
+// images with preproc.WipeFile, which are passed to it as the
+// parameters of the same names. They are only adapted to each page
+// for pages on the wipeonly queue. Pages binarised with the otsu or
+// wolf methods are wiped with singleWipeSettings, which aren't
+// adapted, and other pages wiped by Preprocess use the wipe settings
+// in PreprocSettings.
+type WipeSettings struct {
+	HWsize  int     `json:"hwsize"`  // window size used to find the content horizontally
+	HThresh float64 `json:"hthresh"` // proportion of dark pixels for a window to be content horizontally; higher values wipe more
+	HMin    int     `json:"hmin"`
+	HMax    int     `json:"hmax"`
+	VThresh float64 `json:"vthresh"` // proportion of dark pixels for a window to be content vertically; higher values wipe more
+	VMin    int     `json:"vmin"`
+
+	// AdaptWindow scales HWsize for each image by its width relative
+	// to wipeReferenceWidth, so that the window covers the same part
+	// of the page whatever resolution it was scanned at.
+	AdaptWindow bool `json:"adaptwindow"`
+	// AdaptThresh scales HThresh and VThresh for each image by the
+	// proportion of dark pixels in it relative to
+	// wipeReferenceDensity, so that pages of sparse text aren't wiped
+	// too much, and pages of dense text with junk at the edges aren't
+	// wiped too little.
+	AdaptThresh bool `json:"adaptthresh"`
+}
+
+// DefaultWipeSettings are the settings used by Wipe.
+var DefaultWipeSettings = WipeSettings{
+	HWsize:      5,
+	HThresh:     0.03,
+	HMin:        30,
+	HMax:        120,
+	VThresh:     0.005,
+	VMin:        30,
+	AdaptWindow: true,
+	AdaptThresh: true,
+}
+
+// singleWipeSettings are the settings used to wipe pages binarised
+// by preprocessSingle, which are DefaultWipeSettings without any
+// adaptation to each page
+func singleWipeSettings() WipeSettings {
+	ws := DefaultWipeSettings
+	ws.AdaptWindow = false
+	ws.AdaptThresh = false
+	return ws
+}
+
+// wipeReferenceWidth is the width in pixels of the images that the
+// HWsize of DefaultWipeSettings suits, which is roughly that of an
+// A4 page scanned at 300 DPI
+const wipeReferenceWidth = 2500
+
+// wipeReferenceDensity is the proportion of dark pixels in the images
+// that the thresholds of DefaultWipeSettings suit, which is typical of
+// a page of text
+const wipeReferenceDensity = 0.1
+
+// wipeMaxAdapt is the most that AdaptThresh will scale the thresholds
+// by, in either direction, so that nearly blank or nearly black pages
+// don't get extreme thresholds
+const wipeMaxAdapt = 4.0
+
+// inkDensity returns the proportion of dark pixels in an image
+func inkDensity(img image.Image) float64 {
+	b := img.Bounds()
+	if b.Empty() {
+		return 0
+	}
+	dark := 0
+	if g, ok := img.(*image.Gray); ok {
+		for y := 0; y < b.Dy(); y++ {
+			for _, v := range g.Pix[y*g.Stride : y*g.Stride+b.Dx()] {
+				if v < 128 {
+					dark++
+				}
+			}
+		}
+		return float64(dark) / float64(b.Dx()*b.Dy())
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y < 128 {
+				dark++
+			}
+		}
+	}
+	return float64(dark) / float64(b.Dx()*b.Dy())
+}
+
+// adaptWipeSettings returns the settings to wipe img with, adapting ws
+// to it as set by ws.AdaptWindow and ws.AdaptThresh
+func adaptWipeSettings(img image.Image, ws WipeSettings) WipeSettings {
+	if ws.AdaptWindow {
+		w := img.Bounds().Dx()
+		ws.HWsize = int(math.Round(float64(ws.HWsize*w) / wipeReferenceWidth))
+		if ws.HWsize < 1 {
+			ws.HWsize = 1
+		}
+	}
+	if ws.AdaptThresh {
+		f := inkDensity(img) / wipeReferenceDensity
+		f = math.Max(f, 1/wipeMaxAdapt)
+		f = math.Min(f, wipeMaxAdapt)
+		ws.HThresh *= f
+		ws.VThresh *= f
+	}
+	ws.AdaptWindow = false
+	ws.AdaptThresh = false
+	return ws
+}
+
+// wipeFile wipes the image at inPath with the settings given, saving
+// the result to outPath
+func wipeFile(inPath string, outPath string, ws WipeSettings) error {
+	if ws.AdaptWindow || ws.AdaptThresh {
+		f, err := os.Open(inPath)
+		if err != nil {
+			return fmt.Errorf("Error opening %s: %v", inPath, err)
+		}
+		img, _, err := image.Decode(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("Error decoding %s: %v", inPath, err)
+		}
+		ws = adaptWipeSettings(img, ws)
+	}
+	return preproc.WipeFile(inPath, outPath, ws.HWsize, ws.HThresh, ws.HMin, ws.HMax, ws.VThresh, ws.VMin)
+}
+
+// WipeFor returns the wipe function appropriate for a job. This is
+// Wipe unless the "wipehthresh" or "wipevthresh" options are set, in
+// which case those thresholds are used exactly, instead of the
+// defaults adapted to each page, or the "wipeadapt" option is set to
+// "false", in which case the default settings are used without being
+// adapted to each page.
+func WipeFor(job JobMsg) (func(context.Context, chan string, chan string, chan error, *log.Logger), error) {
+	ws, err := jobWipeSettings(job)
+	if err != nil {
+		return nil, err
+	}
+	return WipeWith(ws), nil
+}
+
+// jobWipeSettings returns the settings WipeFor wipes the pages of a
+// job with, before they are adapted to each page.
+func jobWipeSettings(job JobMsg) (WipeSettings, error) {
+	ws := DefaultWipeSettings
+	var err error
+	ws.HThresh, err = wipeThreshold(job, "wipehthresh", ws.HThresh)
+	if err != nil {
+		return ws, err
+	}
+	ws.VThresh, err = wipeThreshold(job, "wipevthresh", ws.VThresh)
+	if err != nil {
+		return ws, err
+	}
+	_, hset := job.Opts["wipehthresh"]
+	_, vset := job.Opts["wipevthresh"]
+	if hset || vset {
+		ws.AdaptThresh = false
+	}
+	if v, ok := job.Opts["wipeadapt"]; ok {
+		adapt, err := strconv.ParseBool(v)
+		if err != nil {
+			return ws, fmt.Errorf("Invalid wipeadapt value %s, should be true or false", v)
+		}
+		ws.AdaptWindow = ws.AdaptWindow && adapt
+		ws.AdaptThresh = ws.AdaptThresh && adapt
+	}
+	return ws, nil
+}
+
+// wipeThreshold returns the threshold set by the job option key, or
+// def if it isn't set
+func wipeThreshold(job JobMsg, key string, def float64) (float64, error) {
+	v, ok := job.Opts[key]
+	if !ok {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f <= 0 || f >= 1 {
+		return 0, fmt.Errorf("Invalid %s value %s, should be between 0 and 1", key, v)
+	}
+	return f, nil
+}
+
+// Rewiper is the connection needed by Rewipe
+type Rewiper interface {
+	AddToQueue(url string, msg string) error
+	DeleteObjects(bucket string, keys []string) error
+	ListObjects(bucket string, prefix string) ([]string, error)
+	Log(v ...interface{})
+	WipeQueueId() string
+	WIPStorageId() string
+}
+
+// prebinarisedPattern matches the prebinarised page images of a book,
+// as processed by the wipeonly queue
+var prebinarisedPattern = regexp.MustCompile(`[0-9]{4,6}(.bin)?.png$`)
+
+// wipedPattern matches the preprocessed page images of a book
+var wipedPattern = regexp.MustCompile(`_bin[0-9].[0-9].png$`)
+
+// Rewipe sends a prebinarised book back to the wipeonly queue, to be
+// wiped again with the settings given and then OCRed and analysed
+// again, so that the best version of each page is chosen from the
+// new results. This is useful for books with junk left at the edges
+// because the default settings didn't suit them. The existing wiped
+// pages, their hOCR and TSV, and the graph, best file, done marker
+// and needs review marker which mark the book as done are deleted
+// first, so that the book is only analysed once all of the rewiped
+// pages have been OCRed. The OCR is done with training, or the default training if
+// it is empty. Only the thresholds in ws are used, along with
+// whether the settings are adapted to each page, as they are the
+// only wipe settings which can be set for a job with WipeFor.
+func Rewipe(conn Rewiper, bookname string, training string, ws WipeSettings) error {
+	objs, err := conn.ListObjects(conn.WIPStorageId(), bookname+"/")
+	if err != nil {
+		return fmt.Errorf("Error listing files for book %s: %v", bookname, err)
+	}
+
+	var todelete []string
+	pages := 0
+	for _, o := range objs {
+		switch {
+		case wipedPattern.MatchString(o), strings.HasSuffix(o, ".hocr"), strings.HasSuffix(o, ".tsv"), strings.HasSuffix(o, OcrParamsSuffix), path.Base(o) == "graph.png", path.Base(o) == "best", path.Base(o) == DoneFile, path.Base(o) == NeedsReviewFile:
+			todelete = append(todelete, o)
+		case prebinarisedPattern.MatchString(o):
+			pages++
+		}
+	}
+	if pages == 0 {
+		return fmt.Errorf("No prebinarised pages found for book %s, so it can't be rewiped", bookname)
+	}
+
+	if len(todelete) > 0 {
+		conn.Log("Deleting", len(todelete), "previous results for", bookname)
+		err = conn.DeleteObjects(conn.WIPStorageId(), todelete)
+		if err != nil {
+			return fmt.Errorf("Error deleting previous results for book %s: %v", bookname, err)
+		}
+	}
+
+	job := JobMsg{Bookname: bookname, Training: training, Opts: make(map[string]string)}
+	if ws.HThresh != DefaultWipeSettings.HThresh {
+		job.Opts["wipehthresh"] = strconv.FormatFloat(ws.HThresh, 'f', -1, 64)
+	}
+	if ws.VThresh != DefaultWipeSettings.VThresh {
+		job.Opts["wipevthresh"] = strconv.FormatFloat(ws.VThresh, 'f', -1, 64)
+	}
+	if !ws.AdaptWindow && !ws.AdaptThresh {
+		job.Opts["wipeadapt"] = "false"
+	}
+	err = conn.AddToQueue(conn.WipeQueueId(), job.String())
+	if err != nil {
+		return fmt.Errorf("Error adding %s to wipeonly queue: %v", bookname, err)
+	}
+	return nil
+}
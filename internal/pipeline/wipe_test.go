@@ -0,0 +1,300 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_WipeFor(t *testing.T) {
+	cases := []struct {
+		body string
+		err  bool
+	}{
+		{"book", false},
+		{"book wipehthresh=0.1", false},
+		{"book rescribev9 wipehthresh=0.1 wipevthresh=0.02", false},
+		{"book wipehthresh=0", true},
+		{"book wipevthresh=1.5", true},
+		{"book wipehthresh=lots", true},
+		{"book wipeadapt=false", false},
+		{"book wipeadapt=maybe", true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.body, func(t *testing.T) {
+			_, err := WipeFor(ParseJobMessage(c.body))
+			if err == nil && c.err {
+				t.Fatalf("Expected an error, got none")
+			}
+			if err != nil && !c.err {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+		})
+	}
+}
+
+// Test_Rewipe tests that rewiping a book with a more aggressive
+// threshold replaces its stored wiped pages
+func Test_Rewipe(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	conn := newTestConn(t, vlog)
+	dir := conn.TempDir
+
+	// a page with a block of text in the middle, and a faint line of
+	// junk near the left edge
+	img := image.NewGray(image.Rect(0, 0, 100, 100))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+	for y := 10; y < 90; y++ {
+		for x := 30; x < 70; x++ {
+			if (x+y)%3 == 0 {
+				img.Pix[y*img.Stride+x] = 0
+			}
+		}
+	}
+	for y := 40; y < 45; y++ {
+		img.Pix[y*img.Stride+5] = 0
+	}
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	if err != nil {
+		t.Fatalf("Could not encode test image: %v", err)
+	}
+	fn := filepath.Join(dir, "0001.png")
+	err = ioutil.WriteFile(fn, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatalf("Could not write test image: %v", err)
+	}
+	err = conn.Upload(conn.WIPStorageId(), "book/book_0001.png", fn)
+	if err != nil {
+		t.Fatalf("Could not upload test image: %v", err)
+	}
+
+	// wipe runs the message on the wipeonly queue, returning the
+	// wiped page saved in storage
+	wipe := func() []byte {
+		msg, err := conn.CheckQueue(conn.WipeQueueId(), 60)
+		if err != nil || msg.Handle == "" {
+			t.Fatalf("Could not get message from wipeonly queue: %v", err)
+		}
+		process, err := WipeFor(ParseJobMessage(msg.Body))
+		if err != nil {
+			t.Fatalf("Error getting wipe function: %v", err)
+		}
+		err = ProcessBook(context.Background(), msg, conn, process, prebinarisedPattern, conn.WipeQueueId(), conn.OCRPageQueueId())
+		if err != nil {
+			t.Fatalf("Error wiping: %v\nLog: %s", err, slog.log)
+		}
+		wiped := filepath.Join(dir, "wiped.png")
+		err = conn.Download(conn.WIPStorageId(), "book/book_0001_bin0.0.png", wiped)
+		if err != nil {
+			t.Fatalf("Could not download wiped page: %v", err)
+		}
+		b, err := ioutil.ReadFile(wiped)
+		if err != nil {
+			t.Fatalf("Could not read wiped page: %v", err)
+		}
+		return b
+	}
+
+	err = conn.AddToQueue(conn.WipeQueueId(), "book")
+	if err != nil {
+		t.Fatalf("Could not add book to queue: %v", err)
+	}
+	first := wipe()
+
+	// results from the first wipe, which should be removed
+	for _, o := range []string{"book/book_0001_bin0.0.hocr", "book/book_0001_bin0.0.tsv", "book/graph.png", "book/best", "book/" + DoneFile, "book/" + NeedsReviewFile} {
+		err = conn.Upload(conn.WIPStorageId(), o, fn)
+		if err != nil {
+			t.Fatalf("Could not upload %s: %v", o, err)
+		}
+	}
+
+	ws := DefaultWipeSettings
+	ws.HThresh = 0.1
+	err = Rewipe(conn, "book", "", ws)
+	if err != nil {
+		t.Fatalf("Error rewiping: %v\nLog: %s", err, slog.log)
+	}
+	objs, err := conn.ListObjects(conn.WIPStorageId(), "book/")
+	if err != nil {
+		t.Fatalf("Could not list objects: %v", err)
+	}
+	for _, o := range objs {
+		if strings.HasSuffix(o, ".hocr") || strings.HasSuffix(o, ".tsv") || strings.HasSuffix(o, "_bin0.0.png") || strings.HasSuffix(o, "graph.png") || filepath.Base(o) == "best" || filepath.Base(o) == DoneFile || filepath.Base(o) == NeedsReviewFile {
+			t.Fatalf("Expected %s to be deleted before rewiping", o)
+		}
+	}
+
+	second := wipe()
+	if bytes.Equal(first, second) {
+		t.Fatalf("Expected rewiping with a higher threshold to change the wiped page")
+	}
+
+	err = Rewipe(conn, "nobook", "", ws)
+	if err == nil {
+		t.Fatalf("Expected an error rewiping a book with no prebinarised pages, got none")
+	}
+}
+
+// wipeTestPage returns a page scale times the size of a 250x350 page,
+// with a block of text in the middle, one dark pixel in every spacing
+// pixels, and a short line of junk near the left edge
+func wipeTestPage(scale int, spacing int) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, 250*scale, 350*scale))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+	for y := 50 * scale; y < 300*scale; y++ {
+		for x := 60 * scale; x < 190*scale; x++ {
+			if (x+y)%spacing == 0 {
+				img.Pix[y*img.Stride+x] = 0
+			}
+		}
+	}
+	for y := 150 * scale; y < 152*scale; y++ {
+		for x := 10 * scale; x < 11*scale; x++ {
+			img.Pix[y*img.Stride+x] = 0
+		}
+	}
+	return img
+}
+
+// wipedFrom returns the proportion of the width of an image from the
+// left edge to the first column with any dark pixels, and from the
+// right edge to the last
+func wipedFrom(img *image.Gray) (float64, float64) {
+	b := img.Bounds()
+	dark := func(x int) bool {
+		for y := 0; y < b.Dy(); y++ {
+			if img.Pix[y*img.Stride+x] < 128 {
+				return true
+			}
+		}
+		return false
+	}
+	left, right := b.Dx(), 0
+	for x := 0; x < b.Dx(); x++ {
+		if dark(x) {
+			if x < left {
+				left = x
+			}
+			right = x + 1
+		}
+	}
+	return float64(left) / float64(b.Dx()), float64(b.Dx()-right) / float64(b.Dx())
+}
+
+func Test_adaptWipeSettings(t *testing.T) {
+	small := adaptWipeSettings(wipeTestPage(2, 3), DefaultWipeSettings)
+	large := adaptWipeSettings(wipeTestPage(4, 3), DefaultWipeSettings)
+	if small.HWsize*2 != large.HWsize {
+		t.Fatalf("Expected window to double with the image width, got %d and %d", small.HWsize, large.HWsize)
+	}
+	if math.Abs(small.HThresh-large.HThresh) > 0.001 || math.Abs(small.VThresh-large.VThresh) > 0.0001 {
+		t.Fatalf("Expected the same thresholds at each resolution, got %v and %v", small, large)
+	}
+
+	sparse := adaptWipeSettings(wipeTestPage(2, 40), DefaultWipeSettings)
+	if sparse.HThresh >= small.HThresh {
+		t.Fatalf("Expected a lower threshold for sparse text, got %v, compared to %v", sparse.HThresh, small.HThresh)
+	}
+
+	fixed := DefaultWipeSettings
+	fixed.AdaptWindow = false
+	fixed.AdaptThresh = false
+	if adaptWipeSettings(wipeTestPage(4, 40), fixed) != fixed {
+		t.Fatalf("Expected settings not to be changed when adaptation is off")
+	}
+}
+
+// Test_WipeResolutions tests that the same page scanned at two
+// resolutions is wiped in the same way with the default settings,
+// and that the adaptation of the threshold means sparse text which
+// would otherwise be wiped away is kept
+func Test_WipeResolutions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wiperestest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fixed := DefaultWipeSettings
+	fixed.AdaptWindow = false
+	fixed.AdaptThresh = false
+
+	// wipe wipes an image with ws, returning how much was wiped
+	// from each side
+	wipe := func(img *image.Gray, ws WipeSettings) (float64, float64) {
+		in := filepath.Join(dir, "in.png")
+		out := filepath.Join(dir, "out.png")
+		var buf bytes.Buffer
+		err := png.Encode(&buf, img)
+		if err != nil {
+			t.Fatalf("Could not encode test image: %v", err)
+		}
+		err = ioutil.WriteFile(in, buf.Bytes(), 0644)
+		if err != nil {
+			t.Fatalf("Could not write test image: %v", err)
+		}
+		err = wipeFile(in, out, ws)
+		if err != nil {
+			t.Fatalf("Error wiping: %v", err)
+		}
+		f, err := os.Open(out)
+		if err != nil {
+			t.Fatalf("Could not open wiped image: %v", err)
+		}
+		defer f.Close()
+		wiped, err := png.Decode(f)
+		if err != nil {
+			t.Fatalf("Could not decode wiped image: %v", err)
+		}
+		g, ok := wiped.(*image.Gray)
+		if !ok {
+			t.Fatalf("Wiped image is not greyscale")
+		}
+		return wipedFrom(g)
+	}
+
+	cases := []struct {
+		name    string
+		spacing int
+		ws      WipeSettings
+		left    float64
+	}{
+		{"dense", 3, DefaultWipeSettings, 0.24},
+		{"sparse", 40, DefaultWipeSettings, 0.24},
+		{"sparsefixed", 40, fixed, 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			l1, r1 := wipe(wipeTestPage(1, c.spacing), c.ws)
+			l2, r2 := wipe(wipeTestPage(3, c.spacing), c.ws)
+			if math.Abs(l1-l2) > 0.01 || math.Abs(r1-r2) > 0.01 {
+				t.Fatalf("Expected comparable wiping at each resolution, got %.3f,%.3f and %.3f,%.3f", l1, r1, l2, r2)
+			}
+			if math.Abs(l1-c.left) > 0.01 {
+				t.Fatalf("Expected content to start %.2f of the way across, got %.3f", c.left, l1)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"rescribe.xyz/bookpipeline"
+	"rescribe.xyz/utils/pkg/hocr"
+)
+
+// PageWords contains the position and confidence of each word on a
+// page, along with the image the positions refer to. It is designed
+// to be used by proofreading tools which need to map words back to
+// the image.
+type PageWords struct {
+	Image  string `json:"image"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Words  []Word `json:"words"`
+}
+
+// Word is a single OCRed word, with its bounding box in the form
+// [x0, y0, x1, y1] and its confidence.
+type Word struct {
+	Text string  `json:"text"`
+	Bbox [4]int  `json:"bbox"`
+	Conf float64 `json:"conf"`
+}
+
+// hocrPages is used to find the ocr_page elements of an hOCR file,
+// which the hocr package doesn't provide
+type hocrPages struct {
+	Pages []struct {
+		Class string `xml:"class,attr"`
+		Title string `xml:"title,attr"`
+	} `xml:"body>div"`
+}
+
+// getPageWords reads the words from an hOCR file, along with the
+// page dimensions, recording img as the image they refer to.
+func getPageWords(hocrfn string, img string) (PageWords, error) {
+	pg := PageWords{Image: img}
+
+	b, err := ioutil.ReadFile(hocrfn)
+	if err != nil {
+		return pg, fmt.Errorf("Error reading hOCR %s: %v", hocrfn, err)
+	}
+	b, _ = SanitiseUTF8(b)
+
+	var pages hocrPages
+	err = xml.Unmarshal(b, &pages)
+	if err != nil {
+		return pg, fmt.Errorf("Error parsing hOCR %s: %v", hocrfn, err)
+	}
+	for _, p := range pages.Pages {
+		if p.Class != "ocr_page" {
+			continue
+		}
+		box, err := hocr.BoxCoords(p.Title)
+		if err == nil {
+			pg.Width = box[2] - box[0]
+			pg.Height = box[3] - box[1]
+		}
+		break
+	}
+
+	h, err := hocr.Parse(b)
+	if err != nil {
+		return pg, fmt.Errorf("Error parsing hOCR %s: %v", hocrfn, err)
+	}
+	for _, l := range h.Lines {
+		for _, w := range l.Words {
+			box, err := hocr.BoxCoords(w.Title)
+			if err != nil {
+				continue
+			}
+			text := html.UnescapeString(strings.TrimSpace(w.Text))
+			pg.Words = append(pg.Words, Word{Text: text, Bbox: box, Conf: bookpipeline.ParseWordTitle(w.Title).Conf})
+		}
+	}
+
+	return pg, nil
+}
+
+// writeWordsJSONL writes the words of each page as JSON, with each
+// page on a separate line.
+func writeWordsJSONL(w io.Writer, pages []PageWords) error {
+	enc := json.NewEncoder(w)
+	for _, p := range pages {
+		err := enc.Encode(p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PageSizesFile is the name of the file that Analyse saves the size
+// of the best version of each page in, so that the hOCR doesn't need
+// to be parsed again to find it. Each line lists the filename of the
+// best hOCR for a page and the width and height of the page from its
+// bbox, separated by tabs, like this:
+//
+//	0001_bin0.2.hocr	2480	3508
+const PageSizesFile = "pagesizes"
+
+// PageSize is the width and height of a page.
+type PageSize struct {
+	Width, Height int
+}
+
+// writePageSizes writes the size of each page, which come from the
+// hOCR files listed in hocrs, in the format of PageSizesFile.
+func writePageSizes(w io.Writer, hocrs []string, pages []PageWords) error {
+	for i, p := range pages {
+		_, err := fmt.Fprintf(w, "%s\t%d\t%d\n", hocrs[i], p.Width, p.Height)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadPageSizes reads the size of the best version of each page of a
+// book from the PageSizesFile written by Analyse in dir. They are
+// keyed by the filename of the best hOCR for each page.
+func ReadPageSizes(dir string) (map[string]PageSize, error) {
+	fn := filepath.Join(dir, PageSizesFile)
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %s: %v", fn, err)
+	}
+	sizes := make(map[string]PageSize)
+	for _, l := range strings.Split(string(b), "\n") {
+		if l == "" {
+			continue
+		}
+		fields := strings.Split(l, "\t")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("Error parsing %s: invalid line %q", fn, l)
+		}
+		var s PageSize
+		s.Width, err = strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing width of %s: %v", fields[0], err)
+		}
+		s.Height, err = strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing height of %s: %v", fields[0], err)
+		}
+		sizes[fields[0]] = s
+	}
+	return sizes, nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// storedExts are the extensions of files which are already
+// compressed, so are stored in zip archives without compressing them
+// again
+var storedExts = []string{".gz", ".jpg", ".pdf", ".png", ".zip"}
+
+// addZipFile adds the file at path to a zip archive with the name
+// given. The file is copied into the archive as it is read, so large
+// files like PDFs are never held in memory.
+func addZipFile(zw *zip.Writer, path string, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Error opening %s: %v", path, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("Error getting details of %s: %v", path, err)
+	}
+
+	hdr, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return fmt.Errorf("Error creating zip header for %s: %v", path, err)
+	}
+	hdr.Name = name
+	hdr.Method = zip.Deflate
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, e := range storedExts {
+		if ext == e {
+			hdr.Method = zip.Store
+		}
+	}
+
+	w, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return fmt.Errorf("Error adding %s to zip: %v", name, err)
+	}
+	_, err = io.Copy(w, f)
+	if err != nil {
+		return fmt.Errorf("Error adding %s to zip: %v", name, err)
+	}
+	return nil
+}
+
+// ZipDir saves all of the files in dir, and any directories inside
+// it, to a zip archive at fn. The files are named in the archive
+// inside a directory named after the last part of dir, so that they
+// unpack into their own directory. If there is an error the partial
+// archive is removed.
+func ZipDir(dir string, fn string) (err error) {
+	f, err := os.Create(fn)
+	if err != nil {
+		return fmt.Errorf("Error creating file %s: %v", fn, err)
+	}
+	defer func() {
+		f.Close()
+		if err != nil {
+			_ = os.Remove(fn)
+		}
+	}()
+
+	zw := zip.NewWriter(f)
+	base := filepath.Dir(filepath.Clean(dir))
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		name, err := filepath.Rel(base, path)
+		if err != nil {
+			return err
+		}
+		return addZipFile(zw, path, filepath.ToSlash(name))
+	})
+	if err != nil {
+		return fmt.Errorf("Error creating zip %s: %v", fn, err)
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return fmt.Errorf("Error finishing zip %s: %v", fn, err)
+	}
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("Error closing %s: %v", fn, err)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_ZipDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ziptest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	bookdir := filepath.Join(dir, "book")
+	err = os.Mkdir(bookdir, 0755)
+	if err != nil {
+		t.Fatalf("Could not create book directory: %v", err)
+	}
+
+	files := map[string][]byte{
+		"book/book.binarised.pdf":      append([]byte("%PDF-1.3\n"), bytes.Repeat([]byte("pdf data "), 100000)...),
+		"book/0001_bin0.2.hocr":        []byte("<html>hocr</html>"),
+		"book/0001_bin0.2.txt":         []byte("text of page one"),
+		"book/graph.png":               []byte("png"),
+		"book/best":                    []byte("0001_bin0.2.hocr\n"),
+		"book/subdir/0002_bin0.1.hocr": []byte("<html>page two</html>"),
+	}
+	for name, b := range files {
+		fn := filepath.Join(dir, filepath.FromSlash(name))
+		err = os.MkdirAll(filepath.Dir(fn), 0755)
+		if err != nil {
+			t.Fatalf("Could not create directory for %s: %v", name, err)
+		}
+		err = ioutil.WriteFile(fn, b, 0644)
+		if err != nil {
+			t.Fatalf("Could not create %s: %v", name, err)
+		}
+	}
+
+	fn := filepath.Join(dir, "book.zip")
+	err = ZipDir(bookdir, fn)
+	if err != nil {
+		t.Fatalf("Error creating zip: %v", err)
+	}
+
+	r, err := zip.OpenReader(fn)
+	if err != nil {
+		t.Fatalf("Could not open zip: %v", err)
+	}
+	defer r.Close()
+
+	if len(r.File) != len(files) {
+		t.Fatalf("Expected %d entries in zip, got %d", len(files), len(r.File))
+	}
+	for _, f := range r.File {
+		expected, ok := files[f.Name]
+		if !ok {
+			t.Fatalf("Unexpected entry in zip: %s", f.Name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("Could not open %s in zip: %v", f.Name, err)
+		}
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("Could not read %s in zip: %v", f.Name, err)
+		}
+		if !bytes.Equal(b, expected) {
+			t.Fatalf("Contents of %s in zip differ from the original", f.Name)
+		}
+		if filepath.Ext(f.Name) == ".pdf" && f.Method != zip.Store {
+			t.Fatalf("Expected %s to be stored without compression", f.Name)
+		}
+		if filepath.Ext(f.Name) == ".hocr" && f.Method != zip.Deflate {
+			t.Fatalf("Expected %s to be compressed", f.Name)
+		}
+	}
+
+	err = ZipDir(filepath.Join(dir, "nonexistent"), filepath.Join(dir, "bad.zip"))
+	if err == nil {
+		t.Fatalf("Expected an error zipping a missing directory, got none")
+	}
+	_, err = os.Stat(filepath.Join(dir, "bad.zip"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("Expected partial zip to be removed")
+	}
+}
@@ -0,0 +1,340 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+// Package pipelinetest provides a conformance test for the
+// connections used by the pipeline, such as bookpipeline.AwsConn and
+// bookpipeline.LocalConn, so that each backend can be checked to
+// behave in the way the rest of the pipeline expects.
+//
+// The semantics each backend must satisfy are:
+//
+// Storage
+//
+//   - Upload saves the file at path as key in bucket, replacing any
+//     existing object with that key. Keys may contain slashes.
+//   - Download saves the object key in bucket to a file, returning
+//     an error if there is no such object.
+//   - ListObjects returns the full keys of all objects in bucket
+//     which begin with prefix, as a plain string prefix, so "book1"
+//     matches "book1/a.png" and "book10/a.png". A trailing slash
+//     should be used to list only the objects of a single book. The
+//     order of the results is not significant.
+//   - DeleteObjects removes each of keys from bucket.
+//
+// Queues
+//
+//   - CheckQueue returns a message from the queue, hiding it from
+//     further calls to CheckQueue for timeout seconds. If no message
+//     is available an empty Qmsg, with an empty Handle, is returned,
+//     and no error. The order of messages is not significant.
+//   - Once a hidden message's timeout expires it is returned by
+//     CheckQueue again, unless it has been deleted.
+//   - QueueHeartbeat hides a message which has been received for
+//     another duration seconds from the time it is called, with a
+//     duration of 0 making it visible again straight away. If the
+//     Qmsg returned has a non-empty Handle, that handle should be
+//     used from then on.
+//   - DelFromQueue deletes the message with handle from the queue.
+//     Only that message is deleted, even if the bodies of others
+//     contain its body.
+//
+// The test uses the test queue, which should be empty, and objects
+// whose keys begin with "pipelinetest/" in the WIP storage bucket.
+package pipelinetest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"rescribe.xyz/bookpipeline"
+	"rescribe.xyz/bookpipeline/internal/pipeline"
+)
+
+// prefix is the start of the keys of all objects created by the test
+const prefix = "pipelinetest/"
+
+// Pipeliner is the interface tested
+type Pipeliner interface {
+	pipeline.Pipeliner
+	DeleteObjects(bucket string, keys []string) error
+	TestInit() error
+	TestQueueId() string
+}
+
+// TestPipeliner checks that conn behaves as the pipeline expects,
+// reporting any failures with t. It calls Init and TestInit before
+// testing storage and then queue handling.
+func TestPipeliner(t *testing.T, conn Pipeliner) {
+	err := conn.Init()
+	if err != nil {
+		t.Fatalf("Could not initialise connection: %v", err)
+	}
+	err = conn.TestInit()
+	if err != nil {
+		t.Fatalf("Could not initialise test queue: %v", err)
+	}
+
+	t.Run("storage", func(t *testing.T) {
+		testStorage(t, conn)
+	})
+	t.Run("queue", func(t *testing.T) {
+		testQueue(t, conn)
+	})
+}
+
+// listTest returns the sorted keys of the test objects beginning
+// with p
+func listTest(t *testing.T, conn Pipeliner, p string) []string {
+	objs, err := conn.ListObjects(conn.WIPStorageId(), prefix+p)
+	if err != nil {
+		t.Fatalf("Error listing objects with prefix %s: %v", prefix+p, err)
+	}
+	sort.Strings(objs)
+	return objs
+}
+
+func testStorage(t *testing.T, conn Pipeliner) {
+	dir, err := ioutil.TempDir("", "pipelinetest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	bucket := conn.WIPStorageId()
+	keys := []string{"book1/0001.png", "book1/0002.png", "book10/0001.png", "book2/0001.png"}
+	var all []string
+	for _, k := range keys {
+		all = append(all, prefix+k)
+	}
+	defer func() {
+		_ = conn.DeleteObjects(bucket, listTest(t, conn, ""))
+	}()
+
+	for _, k := range all {
+		fn := filepath.Join(dir, "upload")
+		err = ioutil.WriteFile(fn, []byte(k), 0644)
+		if err != nil {
+			t.Fatalf("Could not create file to upload: %v", err)
+		}
+		err = conn.Upload(bucket, k, fn)
+		if err != nil {
+			t.Fatalf("Error uploading %s: %v", k, err)
+		}
+	}
+
+	t.Run("download", func(t *testing.T) {
+		for _, k := range all {
+			fn := filepath.Join(dir, "download")
+			err := conn.Download(bucket, k, fn)
+			if err != nil {
+				t.Fatalf("Error downloading %s: %v", k, err)
+			}
+			b, err := ioutil.ReadFile(fn)
+			if err != nil {
+				t.Fatalf("Could not read downloaded file: %v", err)
+			}
+			if string(b) != k {
+				t.Fatalf("Expected %s to contain %q, got %q", k, k, string(b))
+			}
+		}
+	})
+
+	t.Run("downloadmissing", func(t *testing.T) {
+		err := conn.Download(bucket, prefix+"missing/0001.png", filepath.Join(dir, "missing"))
+		if err == nil {
+			t.Fatalf("Expected an error downloading a missing object, got none")
+		}
+	})
+
+	t.Run("overwrite", func(t *testing.T) {
+		k := all[0]
+		fn := filepath.Join(dir, "overwrite")
+		err := ioutil.WriteFile(fn, []byte("new"), 0644)
+		if err != nil {
+			t.Fatalf("Could not create file to upload: %v", err)
+		}
+		err = conn.Upload(bucket, k, fn)
+		if err != nil {
+			t.Fatalf("Error uploading %s again: %v", k, err)
+		}
+		err = conn.Download(bucket, k, fn)
+		if err != nil {
+			t.Fatalf("Error downloading %s: %v", k, err)
+		}
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatalf("Could not read downloaded file: %v", err)
+		}
+		if string(b) != "new" {
+			t.Fatalf("Expected %s to be replaced with %q, got %q", k, "new", string(b))
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		cases := []struct {
+			prefix   string
+			expected []string
+		}{
+			{"", all},
+			{"book1", all[:3]},
+			{"book1/", all[:2]},
+			{"book2/0001", all[3:]},
+			{"book3", nil},
+		}
+		for _, c := range cases {
+			got := listTest(t, conn, c.prefix)
+			if strings.Join(got, " ") != strings.Join(c.expected, " ") {
+				t.Fatalf("Expected listing prefix %s to return %v, got %v", prefix+c.prefix, c.expected, got)
+			}
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		err := conn.DeleteObjects(bucket, all[:2])
+		if err != nil {
+			t.Fatalf("Error deleting objects: %v", err)
+		}
+		got := listTest(t, conn, "")
+		if strings.Join(got, " ") != strings.Join(all[2:], " ") {
+			t.Fatalf("Expected %v to remain after deleting, got %v", all[2:], got)
+		}
+	})
+}
+
+// checkQueue checks the test queue, failing if there is an error
+func checkQueue(t *testing.T, conn Pipeliner, timeout int64) bookpipeline.Qmsg {
+	msg, err := conn.CheckQueue(conn.TestQueueId(), timeout)
+	if err != nil {
+		t.Fatalf("Error checking queue: %v", err)
+	}
+	return msg
+}
+
+func testQueue(t *testing.T, conn Pipeliner) {
+	q := conn.TestQueueId()
+
+	t.Run("empty", func(t *testing.T) {
+		msg := checkQueue(t, conn, 10)
+		if msg.Handle != "" {
+			t.Fatalf("Expected no message on empty queue, got %s", msg.Body)
+		}
+	})
+
+	t.Run("hidden", func(t *testing.T) {
+		err := conn.AddToQueue(q, prefix+"hidden")
+		if err != nil {
+			t.Fatalf("Error adding to queue: %v", err)
+		}
+		msg := checkQueue(t, conn, 10)
+		if msg.Handle == "" || msg.Body != prefix+"hidden" {
+			t.Fatalf("Expected message %s, got %q with handle %q", prefix+"hidden", msg.Body, msg.Handle)
+		}
+		again := checkQueue(t, conn, 10)
+		if again.Handle != "" {
+			t.Fatalf("Expected message to be hidden, got %s", again.Body)
+		}
+
+		// make the message visible again with a heartbeat
+		_, err = conn.QueueHeartbeat(msg, q, 0)
+		if err != nil {
+			t.Fatalf("Error with heartbeat: %v", err)
+		}
+		again = checkQueue(t, conn, 10)
+		if again.Body != msg.Body {
+			t.Fatalf("Expected message to be visible after heartbeat of 0, got %q", again.Body)
+		}
+
+		err = conn.DelFromQueue(q, again.Handle)
+		if err != nil {
+			t.Fatalf("Error deleting from queue: %v", err)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		err := conn.AddToQueue(q, prefix+"timeout")
+		if err != nil {
+			t.Fatalf("Error adding to queue: %v", err)
+		}
+		msg := checkQueue(t, conn, 1)
+		if msg.Body != prefix+"timeout" {
+			t.Fatalf("Expected message %s, got %q", prefix+"timeout", msg.Body)
+		}
+		time.Sleep(2 * time.Second)
+		msg = checkQueue(t, conn, 10)
+		if msg.Body != prefix+"timeout" {
+			t.Fatalf("Expected message to be visible once its timeout expired, got %q", msg.Body)
+		}
+
+		// a heartbeat keeps the message hidden beyond its timeout
+		m, err := conn.QueueHeartbeat(msg, q, 10)
+		if err != nil {
+			t.Fatalf("Error with heartbeat: %v", err)
+		}
+		if m.Handle != "" {
+			msg = m
+		}
+		again := checkQueue(t, conn, 10)
+		if again.Handle != "" {
+			t.Fatalf("Expected message to be hidden after heartbeat, got %s", again.Body)
+		}
+
+		err = conn.DelFromQueue(q, msg.Handle)
+		if err != nil {
+			t.Fatalf("Error deleting from queue: %v", err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		bodies := []string{prefix + "book10", prefix + "book1"}
+		for _, b := range bodies {
+			err := conn.AddToQueue(q, b)
+			if err != nil {
+				t.Fatalf("Error adding to queue: %v", err)
+			}
+		}
+
+		var msgs []bookpipeline.Qmsg
+		for range bodies {
+			msg := checkQueue(t, conn, 10)
+			if msg.Handle == "" {
+				t.Fatalf("Expected %d messages on queue, got %d", len(bodies), len(msgs))
+			}
+			msgs = append(msgs, msg)
+		}
+
+		// delete book1, and make book10 visible again
+		for _, m := range msgs {
+			if m.Body == prefix+"book1" {
+				err := conn.DelFromQueue(q, m.Handle)
+				if err != nil {
+					t.Fatalf("Error deleting from queue: %v", err)
+				}
+			} else {
+				_, err := conn.QueueHeartbeat(m, q, 0)
+				if err != nil {
+					t.Fatalf("Error with heartbeat: %v", err)
+				}
+			}
+		}
+
+		msg := checkQueue(t, conn, 10)
+		if msg.Body != prefix+"book10" {
+			t.Fatalf("Expected %s to be left on the queue, got %q", prefix+"book10", msg.Body)
+		}
+		err := conn.DelFromQueue(q, msg.Handle)
+		if err != nil {
+			t.Fatalf("Error deleting from queue: %v", err)
+		}
+
+		msg = checkQueue(t, conn, 10)
+		if msg.Handle != "" {
+			t.Fatalf("Expected queue to be empty, got %s", msg.Body)
+		}
+	})
+}
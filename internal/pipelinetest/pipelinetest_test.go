@@ -0,0 +1,32 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipelinetest
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+func Test_LocalConn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipelinetest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	TestPipeliner(t, &bookpipeline.LocalConn{Logger: log.New(ioutil.Discard, "", 0), TempDir: dir})
+}
+
+func Test_AwsConn(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping test which needs an AWS account")
+	}
+
+	TestPipeliner(t, &bookpipeline.AwsConn{Logger: log.New(ioutil.Discard, "", 0)})
+}
@@ -0,0 +1,77 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+// Package postproc corrects systematic OCR errors in the plain text
+// produced from the OCR, such as a long s being read as an f, using
+// a list of regular expression substitutions. It only changes text,
+// so the hOCR, and the positions of the words in it, are unaffected.
+package postproc
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Rule replaces every match of Pattern with Replacement, which may
+// refer to submatches with $1 or ${name}, as with
+// regexp.ReplaceAllString.
+type Rule struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// ApplyRules applies each rule to text in turn, so later rules see
+// the results of earlier ones.
+func ApplyRules(text string, rules []Rule) string {
+	for _, r := range rules {
+		text = r.Pattern.ReplaceAllString(text, r.Replacement)
+	}
+	return text
+}
+
+// ParseRules reads rules, one per line, with the pattern and its
+// replacement separated by a tab. Blank lines, and lines starting
+// with #, are ignored. A line with no tab removes any matches of the
+// pattern.
+func ParseRules(r io.Reader) ([]Rule, error) {
+	var rules []Rule
+	s := bufio.NewScanner(r)
+	n := 0
+	for s.Scan() {
+		n++
+		l := s.Text()
+		if strings.TrimSpace(l) == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		parts := strings.SplitN(l, "\t", 2)
+		re, err := regexp.Compile(parts[0])
+		if err != nil {
+			return rules, fmt.Errorf("Error parsing rule on line %d: %v", n, err)
+		}
+		rule := Rule{Pattern: re}
+		if len(parts) > 1 {
+			rule.Replacement = parts[1]
+		}
+		rules = append(rules, rule)
+	}
+	return rules, s.Err()
+}
+
+// LoadRules reads rules from a file with ParseRules.
+func LoadRules(path string) ([]Rule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening rules file %s: %v", path, err)
+	}
+	defer f.Close()
+	rules, err := ParseRules(f)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading rules file %s: %v", path, err)
+	}
+	return rules, nil
+}
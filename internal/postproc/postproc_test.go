@@ -0,0 +1,59 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package postproc
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func Test_ApplyRules(t *testing.T) {
+	// a long s at the start or in the middle of a word is often read
+	// as an f, so it is corrected in words where that is known to
+	// happen, keeping the rest of the word
+	longs := Rule{Pattern: regexp.MustCompile(`\bf(uch|aid|ome|hall|elf)\b`), Replacement: "s$1"}
+	normalise := Rule{Pattern: regexp.MustCompile(`ſ`), Replacement: "s"}
+
+	cases := []struct {
+		name     string
+		rules    []Rule
+		text     string
+		expected string
+	}{
+		{"none", nil, "fuch as he faid", "fuch as he faid"},
+		{"longs", []Rule{longs}, "fuch as he faid, for himfelf", "such as he said, for himfelf"},
+		{"longsfirstword", []Rule{longs}, "fome of the fish", "some of the fish"},
+		{"longsnormalise", []Rule{normalise}, "ſuch as he ſaid", "such as he said"},
+		{"order", []Rule{normalise, longs}, "ſuch as he faid", "such as he said"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := ApplyRules(c.text, c.rules)
+			if got != c.expected {
+				t.Fatalf("Expected %q, got %q", c.expected, got)
+			}
+		})
+	}
+}
+
+func Test_ParseRules(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader("# long s\n\\bf(uch|aid)\\b\ts$1\n\n\\s+$\n"))
+	if err != nil {
+		t.Fatalf("Error parsing rules: %v", err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("Expected 2 rules, got %d", len(rules))
+	}
+	got := ApplyRules("fuch as he faid  ", rules)
+	if got != "such as he said" {
+		t.Fatalf("Expected rules to be applied, got %q", got)
+	}
+
+	_, err = ParseRules(strings.NewReader("ok\tfine\n(unclosed\tbad\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("Expected an error for line 2, got %v", err)
+	}
+}
@@ -6,6 +6,7 @@ package bookpipeline
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -13,6 +14,8 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
 const qidPre = "queuePre"
@@ -26,10 +29,43 @@ const storageId = "storage"
 // LocalConn is a simple implementation of the pipeliner interface
 // that doesn't rely on any "cloud" services, instead doing everything
 // on the local machine. This is particularly useful for testing.
+//
+// It is safe for concurrent use, so several workers can process
+// messages from the same queues at once. As with SQS, a message
+// received with CheckQueue is hidden from other calls to CheckQueue
+// until it is deleted or its visibility timeout expires, which can
+// be changed with QueueHeartbeat.
 type LocalConn struct {
 	// these should be set before running Init(), or left to defaults
 	TempDir string
 	Logger  *log.Logger
+
+	mu       sync.Mutex
+	inflight map[string][]inflightMsg // messages hidden from each queue
+}
+
+// inflightMsg is a message which has been received from a queue, and
+// is hidden until it is deleted or visible is reached
+type inflightMsg struct {
+	body    string
+	visible time.Time
+}
+
+// hidden returns the messages which are currently hidden on a
+// queue, removing any whose visibility timeout has expired. It must
+// be called with a.mu held.
+func (a *LocalConn) hidden(url string) []inflightMsg {
+	var msgs []inflightMsg
+	for _, m := range a.inflight[url] {
+		if time.Now().Before(m.visible) {
+			msgs = append(msgs, m)
+		}
+	}
+	if a.inflight == nil {
+		a.inflight = make(map[string][]inflightMsg)
+	}
+	a.inflight[url] = msgs
+	return msgs
 }
 
 // MinimalInit does the bare minimum initialisation
@@ -49,7 +85,7 @@ func (a *LocalConn) MinimalInit() error {
 	}
 
 	if a.Logger == nil {
-		a.Logger = log.New(os.Stdout, "", 0)
+		a.Logger = NewLogger(os.Stdout, 0, LogDebug)
 	}
 
 	return nil
@@ -70,8 +106,12 @@ func (a *LocalConn) TestInit() error {
 	return nil
 }
 
-// CheckQueue checks for any messages in a queue
+// CheckQueue checks for any messages in a queue, returning the
+// first one which isn't hidden, and hiding it for timeout seconds
 func (a *LocalConn) CheckQueue(url string, timeout int64) (Qmsg, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
 	f, err := os.Open(filepath.Join(a.TempDir, url))
 	if err != nil {
 		f, err = os.Create(filepath.Join(a.TempDir, url))
@@ -79,36 +119,69 @@ func (a *LocalConn) CheckQueue(url string, timeout int64) (Qmsg, error) {
 	if err != nil {
 		return Qmsg{}, err
 	}
-	if err != nil {
-		return Qmsg{}, err
-	}
 	defer f.Close()
-	r := bufio.NewReader(f)
-	s, err := r.ReadString('\n')
-	if err != nil && err != io.EOF {
-		return Qmsg{}, err
+
+	// count how many copies of each message are hidden, so that
+	// that many are skipped
+	skip := make(map[string]int)
+	for _, m := range a.hidden(url) {
+		skip[m.body]++
 	}
-	s = strings.TrimRight(s, "\n")
 
-	return Qmsg{Body: s, Handle: s}, nil
+	r := bufio.NewReader(f)
+	for {
+		s, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return Qmsg{}, err
+		}
+		s = strings.TrimRight(s, "\n")
+		if s != "" && skip[s] > 0 {
+			skip[s]--
+		} else if s != "" {
+			visible := time.Now().Add(time.Duration(timeout) * time.Second)
+			a.inflight[url] = append(a.inflight[url], inflightMsg{body: s, visible: visible})
+			return Qmsg{Body: s, Handle: s}, nil
+		}
+		if err == io.EOF {
+			return Qmsg{}, nil
+		}
+	}
 }
 
-// QueueHeartbeat is a no-op with LocalConn
+// QueueHeartbeat changes the visibility timeout of a message which
+// has been received from a queue, so that it is hidden for another
+// duration seconds. A duration of 0 makes it visible again straight
+// away. As the handle of a message never changes with LocalConn, an
+// empty Qmsg is always returned.
 func (a *LocalConn) QueueHeartbeat(msg Qmsg, qurl string, duration int64) (Qmsg, error) {
-	return Qmsg{}, nil
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	msgs := a.hidden(qurl)
+	for i, m := range msgs {
+		if m.body == msg.Handle {
+			msgs[i].visible = time.Now().Add(time.Duration(duration) * time.Second)
+			return Qmsg{}, nil
+		}
+	}
+	return Qmsg{}, fmt.Errorf("Message %s is not in progress on queue %s", msg.Handle, qurl)
 }
 
 // GetQueueDetails gets the number of in progress and available
 // messages for a queue. These are returned as strings.
 func (a *LocalConn) GetQueueDetails(url string) (string, string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
 	b, err := ioutil.ReadFile(filepath.Join(a.TempDir, url))
 	if err != nil {
 		return "", "", err
 	}
 	s := string(b)
 	n := strings.Count(s, "\n")
+	inprogress := len(a.hidden(url))
 
-	return fmt.Sprintf("%d", n), "0", nil
+	return fmt.Sprintf("%d", n-inprogress), fmt.Sprintf("%d", inprogress), nil
 }
 
 func (a *LocalConn) PreQueueId() string {
@@ -139,6 +212,8 @@ func (a *LocalConn) WIPStorageId() string {
 	return storageId
 }
 
+// prefixwalker lists the files in dirpath whose key, their path
+// relative to dirpath with forward slashes, begins with prefix
 func prefixwalker(dirpath string, prefix string, list *[]ObjMeta) filepath.WalkFunc {
 	return func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -150,6 +225,10 @@ func prefixwalker(dirpath string, prefix string, list *[]ObjMeta) filepath.WalkF
 		n := strings.TrimPrefix(path, dirpath)
 		n = strings.TrimPrefix(n, "/")
 		n = strings.TrimPrefix(n, "\\")
+		n = filepath.ToSlash(n)
+		if !strings.HasPrefix(n, prefix) {
+			return nil
+		}
 		o := ObjMeta{Name: n, Date: info.ModTime()}
 		*list = append(*list, o)
 		return nil
@@ -174,6 +253,22 @@ func (a *LocalConn) ListObjectsWithMeta(bucket string, prefix string) ([]ObjMeta
 	return list, err
 }
 
+// ListObjectPrefixes lists the top level directories in a bucket,
+// with a trailing slash as for AwsConn
+func (a *LocalConn) ListObjectPrefixes(bucket string) ([]string, error) {
+	var prefixes []string
+	files, err := ioutil.ReadDir(filepath.Join(a.TempDir, bucket))
+	if err != nil {
+		return prefixes, err
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			prefixes = append(prefixes, f.Name()+"/")
+		}
+	}
+	return prefixes, nil
+}
+
 func (a *LocalConn) ListObjectWithMeta(bucket string, prefix string) (ObjMeta, error) {
 	list, err := a.ListObjectsWithMeta(bucket, prefix)
 	if err != nil {
@@ -187,6 +282,9 @@ func (a *LocalConn) ListObjectWithMeta(bucket string, prefix string) (ObjMeta, e
 
 // AddToQueue adds a message to a queue
 func (a *LocalConn) AddToQueue(url string, msg string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
 	f, err := os.OpenFile(filepath.Join(a.TempDir, url), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return err
@@ -198,25 +296,37 @@ func (a *LocalConn) AddToQueue(url string, msg string) error {
 
 // DelFromQueue deletes a message from a queue
 func (a *LocalConn) DelFromQueue(url string, handle string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
 	b, err := ioutil.ReadFile(filepath.Join(a.TempDir, url))
 	if err != nil {
 		return err
 	}
-	s := string(b)
 
-	i := strings.Index(s, handle)
-	if i == -1 {
+	// remove the first line which is exactly the handle, so that
+	// other messages which contain it are left alone
+	lines := strings.SplitAfter(string(b), "\n")
+	found := false
+	var complete string
+	for _, l := range lines {
+		if !found && strings.TrimRight(l, "\n") == handle {
+			found = true
+			continue
+		}
+		complete += l
+	}
+	if !found {
 		return fmt.Errorf("Warning: %s not found in queue %s, so not deleted", handle, url)
 	}
 
-	// store the joining of part before and part after handle
-	var complete string
-	if len(s) >= len(handle)+1 {
-		if i > 0 {
-			complete = s[:i]
+	// the message is no longer in progress, so stop hiding it
+	msgs := a.hidden(url)
+	for j, m := range msgs {
+		if m.body == handle {
+			a.inflight[url] = append(msgs[:j], msgs[j+1:]...)
+			break
 		}
-		// the '+1' is for the newline character
-		complete += s[i+len(handle)+1:]
 	}
 
 	f, err := os.Create(filepath.Join(a.TempDir, url))
@@ -228,8 +338,81 @@ func (a *LocalConn) DelFromQueue(url string, handle string) error {
 	return err
 }
 
+// RemovePrefixesFromQueue removes any messages in a queue whose
+// body starts with the specified prefix.
+func (a *LocalConn) RemovePrefixesFromQueue(url string, prefix string) error {
+	return a.removeFromQueue(url, func(body string) bool {
+		return strings.HasPrefix(body, prefix)
+	})
+}
+
+// RemoveBookFromQueue removes any messages in a queue for a book, as
+// found by MsgBook. As with AwsConn, messages which are currently
+// hidden, as they are being processed, are left alone.
+func (a *LocalConn) RemoveBookFromQueue(url string, bookname string) error {
+	return a.removeFromQueue(url, func(body string) bool {
+		return MsgBook(body) == bookname
+	})
+}
+
+// removeFromQueue removes any messages in a queue for which match
+// returns true, other than those which are hidden.
+func (a *LocalConn) removeFromQueue(url string, match func(string) bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	b, err := ioutil.ReadFile(filepath.Join(a.TempDir, url))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	skip := make(map[string]int)
+	for _, m := range a.hidden(url) {
+		skip[m.body]++
+	}
+
+	var complete string
+	for _, l := range strings.SplitAfter(string(b), "\n") {
+		body := strings.TrimRight(l, "\n")
+		if body != "" && skip[body] > 0 {
+			skip[body]--
+		} else if body != "" && match(body) {
+			a.Logger.Printf(DebugTag+"Removing %s from queue\n", body)
+			continue
+		}
+		complete += l
+	}
+
+	return ioutil.WriteFile(filepath.Join(a.TempDir, url), []byte(complete), 0644)
+}
+
 // Download just copies the file from TempDir/bucket/key to path
 func (a *LocalConn) Download(bucket string, key string, path string) error {
+	return a.DownloadWithContext(context.Background(), bucket, key, path)
+}
+
+// ctxReader is a reader which stops reading once its context is
+// cancelled
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	err := c.ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// DownloadWithContext copies the file from TempDir/bucket/key to path,
+// as with Download, but stops if ctx is cancelled, removing the
+// partially copied file.
+func (a *LocalConn) DownloadWithContext(ctx context.Context, bucket string, key string, path string) error {
 	fin, err := os.Open(filepath.Join(a.TempDir, bucket, key))
 	if err != nil {
 		return err
@@ -242,7 +425,11 @@ func (a *LocalConn) Download(bucket string, key string, path string) error {
 	}
 	defer f.Close()
 
-	_, err = io.Copy(f, fin)
+	_, err = io.Copy(f, ctxReader{ctx: ctx, r: fin})
+	if err != nil {
+		f.Close()
+		_ = os.Remove(path)
+	}
 	return err
 }
 
@@ -268,6 +455,18 @@ func (a *LocalConn) Upload(bucket string, key string, path string) error {
 	return err
 }
 
+// UploadClass is the same as Upload, as there are no storage
+// classes locally
+func (a *LocalConn) UploadClass(bucket string, key string, path string, objtype string) error {
+	return a.Upload(bucket, key, path)
+}
+
+// Copy just copies the file from TempDir/srcbucket/srckey to
+// TempDir/dstbucket/dstkey
+func (a *LocalConn) Copy(srcbucket string, srckey string, dstbucket string, dstkey string) error {
+	return a.Upload(dstbucket, dstkey, filepath.Join(a.TempDir, srcbucket, srckey))
+}
+
 // Deletes a list of objects
 func (a *LocalConn) DeleteObjects(bucket string, keys []string) error {
 	for _, v := range keys {
@@ -287,5 +486,5 @@ func (a *LocalConn) GetLogger() *log.Logger {
 // Log records an item in the with the Logger. Arguments are handled
 // as with fmt.Println.
 func (a *LocalConn) Log(v ...interface{}) {
-	a.Logger.Println(v...)
+	LogMessage(a.Logger, v...)
 }
@@ -0,0 +1,150 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Test_LocalConnWorkers tests that several workers can take messages
+// from the same LocalConn queue at once, with each message processed
+// only once
+func Test_LocalConnWorkers(t *testing.T) {
+	vlog := log.New(ioutil.Discard, "", 0)
+
+	dir, err := ioutil.TempDir("", "localconntest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conn := &LocalConn{Logger: vlog, TempDir: dir}
+	err = conn.Init()
+	if err != nil {
+		t.Fatalf("Could not initialise connection: %v", err)
+	}
+
+	const pages = 50
+	for i := 0; i < pages; i++ {
+		err = conn.AddToQueue(conn.OCRPageQueueId(), fmt.Sprintf("book/%04d_bin0.2.png", i))
+		if err != nil {
+			t.Fatalf("Error adding to queue: %v", err)
+		}
+	}
+
+	var mu sync.Mutex
+	done := make(map[string]int)
+	perworker := make([]int, 2)
+	errc := make(chan error, len(perworker))
+	for w := range perworker {
+		go func(w int) {
+			for {
+				msg, err := conn.CheckQueue(conn.OCRPageQueueId(), 60)
+				if err != nil {
+					errc <- err
+					return
+				}
+				if msg.Handle == "" {
+					errc <- nil
+					return
+				}
+				mu.Lock()
+				done[msg.Body]++
+				perworker[w]++
+				mu.Unlock()
+				// give the other worker a chance to take a message
+				time.Sleep(time.Millisecond)
+				err = conn.DelFromQueue(conn.OCRPageQueueId(), msg.Handle)
+				if err != nil {
+					errc <- err
+					return
+				}
+			}
+		}(w)
+	}
+	for range perworker {
+		err = <-errc
+		if err != nil {
+			t.Fatalf("Error processing queue: %v", err)
+		}
+	}
+
+	if len(done) != pages {
+		t.Fatalf("Expected %d pages to be processed, got %d", pages, len(done))
+	}
+	for page, n := range done {
+		if n != 1 {
+			t.Errorf("Page %s was processed %d times", page, n)
+		}
+	}
+	for w, n := range perworker {
+		if n == 0 {
+			t.Errorf("Worker %d processed no pages", w)
+		}
+	}
+}
+
+func Test_LocalConnVisibility(t *testing.T) {
+	vlog := log.New(ioutil.Discard, "", 0)
+
+	dir, err := ioutil.TempDir("", "localconntest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conn := &LocalConn{Logger: vlog, TempDir: dir}
+	err = conn.Init()
+	if err != nil {
+		t.Fatalf("Could not initialise connection: %v", err)
+	}
+
+	q := conn.PreQueueId()
+	err = conn.AddToQueue(q, "book")
+	if err != nil {
+		t.Fatalf("Error adding to queue: %v", err)
+	}
+
+	msg, err := conn.CheckQueue(q, 60)
+	if err != nil || msg.Body != "book" {
+		t.Fatalf("Expected to receive message, got %v, %v", msg, err)
+	}
+	avail, inprog, err := conn.GetQueueDetails(q)
+	if err != nil || avail != "0" || inprog != "1" {
+		t.Fatalf("Expected 0 available and 1 in progress messages, got %s, %s, %v", avail, inprog, err)
+	}
+	m, err := conn.CheckQueue(q, 60)
+	if err != nil || m.Handle != "" {
+		t.Fatalf("Expected in progress message to be hidden, got %v, %v", m, err)
+	}
+
+	_, err = conn.QueueHeartbeat(msg, q, 0)
+	if err != nil {
+		t.Fatalf("Error with heartbeat: %v", err)
+	}
+	msg, err = conn.CheckQueue(q, 60)
+	if err != nil || msg.Body != "book" {
+		t.Fatalf("Expected message to be visible after heartbeat of 0, got %v, %v", msg, err)
+	}
+
+	err = conn.DelFromQueue(q, msg.Handle)
+	if err != nil {
+		t.Fatalf("Error deleting from queue: %v", err)
+	}
+	avail, inprog, err = conn.GetQueueDetails(q)
+	if err != nil || avail != "0" || inprog != "0" {
+		t.Fatalf("Expected empty queue, got %s, %s, %v", avail, inprog, err)
+	}
+	_, err = conn.QueueHeartbeat(msg, q, 60)
+	if err == nil {
+		t.Fatalf("Expected an error with heartbeat for a deleted message")
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+// LogLevel is how important a log message is. Loggers made with
+// NewLogger only log messages at or above their level.
+type LogLevel int
+
+const (
+	LogError LogLevel = iota
+	LogWarn
+	LogInfo
+	LogDebug
+)
+
+// DebugTag starts log messages which are only useful when debugging,
+// such as those logged for every file downloaded. It is removed
+// before the message is logged.
+const DebugTag = "[debug] "
+
+// WarnTag and ErrorTag start log messages which are warnings or
+// errors, for messages whose wording doesn't show their level. Like
+// DebugTag they are removed before the message is logged.
+const (
+	WarnTag  = "[warn] "
+	ErrorTag = "[error] "
+)
+
+// levelTags are the tags which set the level of a log message
+var levelTags = map[string]LogLevel{
+	DebugTag: LogDebug,
+	WarnTag:  LogWarn,
+	ErrorTag: LogError,
+}
+
+var logLevelNames = []string{"error", "warn", "info", "debug"}
+
+func (l LogLevel) String() string {
+	if l < LogError || l > LogDebug {
+		return fmt.Sprintf("LogLevel(%d)", int(l))
+	}
+	return logLevelNames[l]
+}
+
+// ParseLogLevel returns the LogLevel named s, which is one of
+// "error", "warn", "info" or "debug".
+func ParseLogLevel(s string) (LogLevel, error) {
+	for i, n := range logLevelNames {
+		if strings.ToLower(s) == n {
+			return LogLevel(i), nil
+		}
+	}
+	return LogError, errors.New(fmt.Sprintf("Unknown log level %s, should be one of %s", s, strings.Join(logLevelNames, ", ")))
+}
+
+// MessageLevel returns the level of a log message. Messages are
+// logged throughout the pipeline as plain text, so the level is set
+// by starting a message with DebugTag, WarnTag or ErrorTag. Untagged
+// messages starting with "Error" or "Failed" are taken to be errors,
+// and those starting with "Warning" to be warnings. Anything else is
+// informational.
+func MessageLevel(msg string) LogLevel {
+	for tag, level := range levelTags {
+		if strings.HasPrefix(msg, tag) {
+			return level
+		}
+	}
+	switch {
+	case strings.HasPrefix(msg, "Error"), strings.HasPrefix(msg, "Failed"):
+		return LogError
+	case strings.HasPrefix(msg, "Warning"):
+		return LogWarn
+	}
+	return LogInfo
+}
+
+// trimLevelTag removes any tag setting the level of a log message
+func trimLevelTag(msg string) string {
+	for tag := range levelTags {
+		if strings.HasPrefix(msg, tag) {
+			return strings.TrimPrefix(msg, tag)
+		}
+	}
+	return msg
+}
+
+// levelWriter is used by NewLogger to filter messages by their level
+// before they are passed on to out, which adds any timestamp.
+type levelWriter struct {
+	out   *log.Logger
+	level LogLevel
+}
+
+func (w *levelWriter) Write(p []byte) (int, error) {
+	msg := string(p)
+	if MessageLevel(msg) > w.level {
+		return len(p), nil
+	}
+	return len(p), w.out.Output(2, trimLevelTag(msg))
+}
+
+// NewLogger returns a logger which writes messages at or above level
+// to w, with flag setting the properties of each line as with
+// log.New. Any tag setting the level of a message is removed before
+// it is logged.
+func NewLogger(w io.Writer, flag int, level LogLevel) *log.Logger {
+	return log.New(&levelWriter{out: log.New(w, "", flag), level: level}, "", 0)
+}
+
+// LogMessage logs a message with l, as l.Println does. Loggers made
+// by NewLogger use any tag setting the level of the message to filter
+// it, and then remove it, so for other loggers the tag is removed
+// here instead, so that it is never shown.
+func LogMessage(l *log.Logger, v ...interface{}) {
+	if _, ok := l.Writer().(*levelWriter); !ok && len(v) > 0 {
+		if s, ok := v[0].(string); ok {
+			v = append([]interface{}{trimLevelTag(s)}, v[1:]...)
+		}
+	}
+	l.Println(v...)
+}
+
+// VerboseLogger returns the logger for a tool with the -v and
+// -loglevel flags. If verbose is set all messages are logged, as
+// with the "debug" level. Otherwise messages at or above the level
+// named by loglevel are logged, or none if it is empty.
+func VerboseLogger(verbose bool, loglevel string, w io.Writer, flag int) (*log.Logger, error) {
+	if verbose {
+		return NewLogger(w, flag, LogDebug), nil
+	}
+	if loglevel == "" {
+		return log.New(ioutil.Discard, "", flag), nil
+	}
+	level, err := ParseLogLevel(loglevel)
+	if err != nil {
+		return nil, err
+	}
+	return NewLogger(w, flag, level), nil
+}
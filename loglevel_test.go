@@ -0,0 +1,108 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+func Test_LogLevel(t *testing.T) {
+	msgs := []string{
+		"Error downloading page",
+		"Failed to OCR page",
+		"Warning: page is blank",
+		"Finished analysing book",
+		DebugTag + "Downloading page",
+		WarnTag + "Download failed; skipping page",
+		ErrorTag + "Could not save page",
+	}
+
+	cases := []struct {
+		level    string
+		expected []string
+	}{
+		{"error", []string{"Error downloading page", "Failed to OCR page", "Could not save page"}},
+		{"warn", []string{"Error downloading page", "Failed to OCR page", "Warning: page is blank", "Download failed; skipping page", "Could not save page"}},
+		{"info", []string{"Error downloading page", "Failed to OCR page", "Warning: page is blank", "Finished analysing book", "Download failed; skipping page", "Could not save page"}},
+		{"debug", []string{"Error downloading page", "Failed to OCR page", "Warning: page is blank", "Finished analysing book", "Downloading page", "Download failed; skipping page", "Could not save page"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.level, func(t *testing.T) {
+			level, err := ParseLogLevel(c.level)
+			if err != nil {
+				t.Fatalf("Error parsing log level: %v", err)
+			}
+			var buf bytes.Buffer
+			l := NewLogger(&buf, 0, level)
+			for _, m := range msgs {
+				l.Println(m)
+			}
+			got := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			if strings.Join(got, "|") != strings.Join(c.expected, "|") {
+				t.Fatalf("Expected %q, got %q", c.expected, got)
+			}
+		})
+	}
+
+	_, err := ParseLogLevel("loud")
+	if err == nil {
+		t.Fatalf("Expected an error parsing an unknown log level, got none")
+	}
+
+	var buf bytes.Buffer
+	l, err := VerboseLogger(false, "", &buf, 0)
+	if err != nil {
+		t.Fatalf("Error creating logger: %v", err)
+	}
+	l.Println("Error downloading page")
+	if buf.Len() != 0 {
+		t.Fatalf("Expected nothing to be logged without -v or -loglevel, got %q", buf.String())
+	}
+	l, err = VerboseLogger(true, "error", &buf, 0)
+	if err != nil {
+		t.Fatalf("Error creating logger: %v", err)
+	}
+	l.Println(DebugTag + "Downloading page")
+	if buf.String() != "Downloading page\n" {
+		t.Fatalf("Expected -v to log debug messages, got %q", buf.String())
+	}
+}
+
+func Test_LogMessage(t *testing.T) {
+	cases := []struct {
+		name     string
+		v        []interface{}
+		expected string
+	}{
+		{"untagged", []interface{}{"Bucket already exists"}, "Bucket already exists\n"},
+		{"debug", []interface{}{DebugTag + "Bucket already exists"}, "Bucket already exists\n"},
+		{"warn", []interface{}{WarnTag + "Download failed; skipping page", "0001.png"}, "Download failed; skipping page 0001.png\n"},
+		{"notstring", []interface{}{3, DebugTag}, "3 " + DebugTag + "\n"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			LogMessage(log.New(&buf, "", 0), c.v...)
+			if buf.String() != c.expected {
+				t.Fatalf("Expected %q, got %q", c.expected, buf.String())
+			}
+
+			// loggers made by NewLogger still filter on the tag
+			buf.Reset()
+			LogMessage(NewLogger(&buf, 0, LogInfo), c.v...)
+			if c.name == "debug" {
+				c.expected = ""
+			}
+			if buf.String() != c.expected {
+				t.Fatalf("Expected %q from a level logger, got %q", c.expected, buf.String())
+			}
+		})
+	}
+}
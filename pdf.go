@@ -15,6 +15,9 @@ import (
 	_ "image/png"
 	"io/ioutil"
 	"os"
+	"regexp"
+	"strings"
+	"time"
 
 	//"github.com/phpdave11/gofpdf"
 	"github.com/nickjwhite/gofpdf" // adds SetCellStretchToFit function
@@ -31,62 +34,178 @@ func pxToPt(i int) float64 {
 	return float64(i) / pageWidth
 }
 
+var ocrPageRe = regexp.MustCompile(`<[^>]*class=['"]ocr_page['"][^>]*>`)
+
+// hocrPageSize returns the width and height of the image an hOCR
+// document was made from, according to the bbox of its ocr_page
+// element, and whether it was found
+func hocrPageSize(b []byte) (int, int, bool) {
+	m := ocrPageRe.Find(b)
+	if m == nil {
+		return 0, 0, false
+	}
+	coords, err := hocr.BoxCoords(string(m))
+	if err != nil {
+		return 0, 0, false
+	}
+	w, h := coords[2]-coords[0], coords[3]-coords[1]
+	return w, h, w > 0 && h > 0
+}
+
 // Fpdf abstracts the gofpdf.Fpdf adding some useful methods
 type Fpdf struct {
-	fpdf *gofpdf.Fpdf
+	// MinTextConf can be set before running AddPage() to leave out
+	// any words with a lower confidence from the (invisible) text,
+	// so that searches are less likely to find garbage. The image of
+	// the page is always included.
+	MinTextConf float64
+
+	// ScaleHocr can be set before running AddPage() to scale the
+	// coordinates in the hOCR to the size of the image, if it differs
+	// from the size of the image that was OCRed. This is needed when
+	// a page was OCRed from a resized copy, such as when the OCR of
+	// a binarised image is used with the colour original.
+	ScaleHocr bool
+
+	// DPI can be set before running AddPage() to size each page by
+	// the resolution its image was scanned at, so that the pages of
+	// the PDF have their true physical size. If it is zero the size
+	// is set with pageWidth, as with pxToPt.
+	DPI float64
+
+	// PageDPI can be set before running AddPage() to give the DPI of
+	// each image, for books whose pages were scanned at different
+	// resolutions. If it returns zero for an image DPI is used.
+	PageDPI func(imgpath string) float64
+
+	// Font can be set before running Setup() to use a different
+	// TrueType font for the (invisible) text, for books with
+	// characters which the default font, DejaVu Sans Condensed,
+	// doesn't cover. Any character without a glyph in the font is
+	// lost when the text is selected or searched. It can either be
+	// the contents of a .ttf file, or a font compressed with zlib,
+	// as generated by fonttobytes.
+	Font []byte
+
+	// Footer can be set before running AddPage() to stamp visible
+	// text at the bottom of each page, like "OCR by Rescribe,
+	// 2022-10-01", to record where the OCR came from. Each page is
+	// made taller to leave a margin below its image for the footer,
+	// so that it never covers any of the page.
+	Footer string
+
+	// Stream can be set before running Setup() to write each page to
+	// a temporary file as it is added, rather than building the whole
+	// PDF in memory until Save() is run, so that the memory used stays
+	// roughly the same however many pages there are. This is needed
+	// for very large books. The whole font is embedded, rather than
+	// just the characters used, so small PDFs are larger. The file is
+	// created in TempDir, or the default directory for temporary files
+	// if that is empty, and is moved to the path given to Save().
+	Stream  bool
+	TempDir string
+
+	// ColumnOrder can be set before running AddPage() to put the
+	// (invisible) text of pages with several columns in reading
+	// order, one column after another, rather than in the order of
+	// the hOCR, which can interleave the lines of the columns. This
+	// makes searching and selecting text across lines work as
+	// expected.
+	ColumnOrder bool
+
+	fpdf     *gofpdf.Fpdf
+	stream   *pdfStream
+	imgbytes int
+	covers   int
+}
+
+// footerHeight is the height in pt of the margin added below each
+// page for the footer, and footerFontSize is the largest size of the
+// footer text, which is made smaller if needed to fit on the page
+const (
+	footerHeight   = 18
+	footerFontSize = 8
+)
+
+// fontBytes returns the TrueType font in b, decompressing it first
+// if it was compressed with zlib, as fonts embedded with fonttobytes
+// are
+func fontBytes(b []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(b))
+	if err == zlib.ErrHeader {
+		return b, nil
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not open compressed font: %v", err))
+	}
+	defer r.Close()
+	var buf bytes.Buffer
+	_, err = buf.ReadFrom(r)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not read compressed font: %v", err))
+	}
+	return buf.Bytes(), nil
 }
 
 // Setup creates a new PDF with appropriate settings and fonts
 func (p *Fpdf) Setup() error {
-	p.fpdf = gofpdf.New("P", "pt", "A5", "")
-
 	// Even though it's invisible, we need to add a font which can do
 	// UTF-8 so that text renders correctly.
 	// We embed the font directly in the binary, compressed with zlib
-	c := bytes.NewBuffer(dejavucondensed)
-	r, err := zlib.NewReader(c)
-	defer r.Close()
-	if err != nil {
-		return errors.New(fmt.Sprintf("Could not open compressed font: %v", err))
+	font := dejavucondensed
+	if p.Font != nil {
+		font = p.Font
 	}
-	var b bytes.Buffer
-	_, err = b.ReadFrom(r)
+	b, err := fontBytes(font)
 	if err != nil {
-		return errors.New(fmt.Sprintf("Could not read compressed font: %v", err))
+		return err
+	}
+
+	if p.Stream {
+		p.stream, err = newPdfStream(p.TempDir, b)
+		return err
 	}
-	p.fpdf.AddUTF8FontFromBytes("dejavu", "", b.Bytes())
+
+	p.fpdf = gofpdf.New("P", "pt", "A5", "")
+	p.fpdf.AddUTF8FontFromBytes("dejavu", "", b)
 
 	p.fpdf.SetFont("dejavu", "", 10)
 	p.fpdf.SetAutoPageBreak(false, float64(0))
 	return p.fpdf.Error()
 }
 
-// AddPage adds a page to the pdf with an image and (invisible)
-// text from an hocr file
-func (p *Fpdf) AddPage(imgpath, hocrpath string, smaller bool) error {
-	file, err := ioutil.ReadFile(hocrpath)
-	if err != nil {
-		return errors.New(fmt.Sprintf("Could not read file %s: %v", hocrpath, err))
+// pxPerPt returns the number of pixels of the image at imgpath which
+// should take up each pt of the PDF, according to its DPI if known
+func (p *Fpdf) pxPerPt(imgpath string) float64 {
+	dpi := p.DPI
+	if p.PageDPI != nil {
+		if d := p.PageDPI(imgpath); d > 0 {
+			dpi = d
+		}
 	}
-	h, err := hocr.Parse(file)
-	if err != nil {
-		return errors.New(fmt.Sprintf("Could not parse hocr in file %s: %v", hocrpath, err))
+	if dpi > 0 {
+		return dpi / 72
 	}
+	return pageWidth
+}
 
+// pageJpeg decodes the image at imgpath and encodes it as a JPEG to
+// add to a PDF, scaling it down first if smaller is set. The bounds
+// of the original image are returned along with the JPEG.
+func pageJpeg(imgpath string, smaller bool) (*bytes.Buffer, image.Rectangle, error) {
 	imgf, err := os.Open(imgpath)
-	defer imgf.Close()
 	if err != nil {
-		return errors.New(fmt.Sprintf("Could not open file %s: %v", imgpath, err))
+		return nil, image.Rectangle{}, errors.New(fmt.Sprintf("Could not open file %s: %v", imgpath, err))
 	}
+	defer imgf.Close()
 	img, _, err := image.Decode(imgf)
 	if err != nil {
-		return errors.New(fmt.Sprintf("Could not decode image: %v", err))
+		return nil, image.Rectangle{}, errors.New(fmt.Sprintf("Could not decode image: %v", err))
 	}
 
 	const smallerImgHeight = 1000
 
 	b := img.Bounds()
-
 	smallerImgWidth := b.Max.X * smallerImgHeight / b.Max.Y
 	if smaller {
 		r := image.Rect(0, 0, smallerImgWidth, smallerImgHeight)
@@ -97,44 +216,394 @@ func (p *Fpdf) AddPage(imgpath, hocrpath string, smaller bool) error {
 
 	var buf bytes.Buffer
 	err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpeg.DefaultQuality})
-	if err != nil {
-		return err
-	}
+	return &buf, b, err
+}
 
-	p.fpdf.AddPageFormat("P", gofpdf.SizeType{Wd: pxToPt(b.Dx()), Ht: pxToPt(b.Dy())})
+// pdfWord is a word of the (invisible) text of a page, with the
+// position of its top left corner and its size in pt
+type pdfWord struct {
+	x, y, w, h float64
+	text       string
+}
 
-	_ = p.fpdf.RegisterImageOptionsReader(imgpath, gofpdf.ImageOptions{ImageType: "jpeg"}, &buf)
-	p.fpdf.ImageOptions(imgpath, 0, 0, pxToPt(b.Dx()), pxToPt(b.Dy()), false, gofpdf.ImageOptions{}, 0, "")
+// pageWords returns the words in the hOCR file at hocrpath to add to
+// a page made from an image with bounds b, leaving out any with a
+// confidence below p.MinTextConf, in column order if p.ColumnOrder
+// is set
+func (p *Fpdf) pageWords(hocrpath string, file []byte, b image.Rectangle, pxpt float64) ([]pdfWord, error) {
+	// replace any invalid UTF-8, which would stop the hOCR being parsed
+	file = bytes.ToValidUTF8(file, []byte("\uFFFD"))
+	h, err := hocr.Parse(file)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not parse hocr in file %s: %v", hocrpath, err))
+	}
 
-	p.fpdf.SetTextRenderingMode(3)
+	sx, sy := 1.0, 1.0
+	if p.ScaleHocr {
+		if w, h, ok := hocrPageSize(file); ok {
+			sx = float64(b.Dx()) / float64(w)
+			sy = float64(b.Dy()) / float64(h)
+		}
+	}
 
+	var lines []pdfLine
 	for _, l := range h.Lines {
 		linecoords, err := hocr.BoxCoords(l.Title)
 		if err != nil {
 			continue
 		}
-		lineheight := pxToPt(linecoords[3] - linecoords[1])
+		lineheight := float64(linecoords[3]-linecoords[1]) / pxpt * sy
+		line := pdfLine{
+			x0: float64(linecoords[0]) / pxpt * sx,
+			y0: float64(linecoords[1]) / pxpt * sy,
+			x1: float64(linecoords[2]) / pxpt * sx,
+		}
 		for _, w := range l.Words {
 			coords, err := hocr.BoxCoords(w.Title)
 			if err != nil {
 				continue
 			}
-			p.fpdf.SetXY(pxToPt(coords[0]), pxToPt(linecoords[1]))
-			p.fpdf.SetCellMargin(0)
-			p.fpdf.SetFontSize(lineheight)
-			cellW := pxToPt(coords[2] - coords[0])
-			cellText := html.UnescapeString(w.Text)
-			p.fpdf.SetCellStretchToFit(cellW, cellText)
-			// Adding a space after each word causes fewer line breaks to
-			// be erroneously inserted when copy pasting from the PDF, for
-			// some reason.
-			p.fpdf.CellFormat(cellW, lineheight, cellText+" ", "", 0, "T", false, 0, "")
+			if t := ParseWordTitle(w.Title); t.HasConf && t.Conf < p.MinTextConf {
+				continue
+			}
+			line.words = append(line.words, pdfWord{
+				x:    float64(coords[0]) / pxpt * sx,
+				y:    float64(linecoords[1]) / pxpt * sy,
+				w:    float64(coords[2]-coords[0]) / pxpt * sx,
+				h:    lineheight,
+				text: html.UnescapeString(w.Text),
+			})
 		}
+		lines = append(lines, line)
+	}
+
+	if p.ColumnOrder {
+		lines = columnOrder(lines)
+	}
+	var words []pdfWord
+	for _, l := range lines {
+		words = append(words, l.words...)
+	}
+	return words, nil
+}
+
+// AddPage adds a page to the pdf with an image and (invisible)
+// text from an hocr file
+func (p *Fpdf) AddPage(imgpath, hocrpath string, smaller bool) error {
+	file, err := ioutil.ReadFile(hocrpath)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Could not read file %s: %v", hocrpath, err))
+	}
+
+	buf, b, err := pageJpeg(imgpath, smaller)
+	if err != nil {
+		return err
+	}
+	p.imgbytes += buf.Len()
+
+	pxpt := p.pxPerPt(imgpath)
+	words, err := p.pageWords(hocrpath, file, b, pxpt)
+	if err != nil {
+		return err
+	}
+
+	pageW, pageH := float64(b.Dx())/pxpt, float64(b.Dy())/pxpt
+	footerH := 0.0
+	if p.Footer != "" {
+		footerH = footerHeight
+	}
+
+	if p.stream != nil {
+		img, err := p.stream.image(buf.Bytes())
+		if err != nil {
+			return err
+		}
+		var c bytes.Buffer
+		drawImage(&c, pageH+footerH, 0, 0, pageW, pageH)
+		for _, w := range words {
+			// Adding a space after each word, as below
+			p.stream.text(&c, pageH+footerH, w.x, w.y, w.h, w.h, w.w, w.text+" ", false)
+		}
+		if p.Footer != "" {
+			p.addFooter(&c, pageW, pageH)
+		}
+		return p.stream.addPage(pageW, pageH+footerH, img, c.Bytes())
+	}
+
+	p.fpdf.AddPageFormat("P", gofpdf.SizeType{Wd: pageW, Ht: pageH + footerH})
+
+	_ = p.fpdf.RegisterImageOptionsReader(imgpath, gofpdf.ImageOptions{ImageType: "jpeg"}, buf)
+	p.fpdf.ImageOptions(imgpath, 0, 0, pageW, pageH, false, gofpdf.ImageOptions{}, 0, "")
+
+	p.fpdf.SetTextRenderingMode(3)
+
+	for _, w := range words {
+		p.fpdf.SetXY(w.x, w.y)
+		p.fpdf.SetCellMargin(0)
+		p.fpdf.SetFontSize(w.h)
+		p.fpdf.SetCellStretchToFit(w.w, w.text)
+		// Adding a space after each word causes fewer line breaks to
+		// be erroneously inserted when copy pasting from the PDF, for
+		// some reason.
+		p.fpdf.CellFormat(w.w, w.h, w.text+" ", "", 0, "T", false, 0, "")
+	}
+
+	if p.Footer != "" {
+		p.addFooter(nil, pageW, pageH)
 	}
 	return p.fpdf.Error()
 }
 
+// addFooter writes the footer as visible text, centred in the margin
+// below an image of width w and height h at the top of the page. If
+// the PDF is streamed it is added to the page content c.
+func (p *Fpdf) addFooter(c *bytes.Buffer, w, h float64) {
+	if p.stream != nil {
+		size := float64(footerFontSize)
+		if sw := p.stream.stringWidth(p.Footer, size); sw > w {
+			size = footerFontSize * w / sw
+		}
+		x := (w - p.stream.stringWidth(p.Footer, size)) / 2
+		p.stream.text(c, h+footerHeight, x, h, footerHeight, size, 0, p.Footer, true)
+		return
+	}
+	p.fpdf.ResetCellStretch(0, "")
+	p.fpdf.SetTextRenderingMode(0)
+	p.fpdf.SetFontSize(footerFontSize)
+	if sw := p.fpdf.GetStringWidth(p.Footer); sw > w {
+		p.fpdf.SetFontSize(footerFontSize * w / sw)
+	}
+	p.fpdf.SetXY(0, h)
+	p.fpdf.SetCellMargin(0)
+	p.fpdf.CellFormat(w, footerHeight, p.Footer, "", 0, "CM", false, 0, "")
+}
+
+// addImagePage adds a page containing just an image, sized to fit it
+func (p *Fpdf) addImagePage(imgpath string) error {
+	buf, b, err := pageJpeg(imgpath, false)
+	if err != nil {
+		return err
+	}
+	p.imgbytes += buf.Len()
+
+	w, h := pxToPt(b.Dx()), pxToPt(b.Dy())
+	if p.stream != nil {
+		img, err := p.stream.image(buf.Bytes())
+		if err != nil {
+			return err
+		}
+		var c bytes.Buffer
+		drawImage(&c, h, 0, 0, w, h)
+		return p.stream.addPage(w, h, img, c.Bytes())
+	}
+
+	p.fpdf.AddPageFormat("P", gofpdf.SizeType{Wd: w, Ht: h})
+	_ = p.fpdf.RegisterImageOptionsReader(imgpath, gofpdf.ImageOptions{ImageType: "jpeg"}, buf)
+	p.fpdf.ImageOptions(imgpath, 0, 0, w, h, false, gofpdf.ImageOptions{}, 0, "")
+	return p.fpdf.Error()
+}
+
+// addTextPage adds an A5 page of visible text, with each string in
+// lines on a separate line
+func (p *Fpdf) addTextPage(lines []string) error {
+	const margin = 36
+	const lineheight = 14
+	if p.stream != nil {
+		var c bytes.Buffer
+		for i, l := range lines {
+			p.stream.text(&c, a5Height, margin, float64(margin+i*lineheight), lineheight, 10, 0, l, true)
+		}
+		return p.stream.addPage(a5Width, a5Height, 0, c.Bytes())
+	}
+	p.fpdf.AddPage()
+	p.fpdf.SetTextRenderingMode(0)
+	p.fpdf.SetFontSize(10)
+	for i, l := range lines {
+		p.fpdf.SetXY(margin, float64(margin+i*lineheight))
+		p.fpdf.CellFormat(0, lineheight, l, "", 0, "L", false, 0, "")
+	}
+	return p.fpdf.Error()
+}
+
+// AddCover adds a page of visible text, with each string in lines on
+// a separate line, such as the name and metadata of the book. It
+// should be run before AddPage() so that it is the first page.
+func (p *Fpdf) AddCover(lines []string) error {
+	p.covers++
+	return p.addTextPage(lines)
+}
+
+// AddReport adds pages to the end of the PDF with an overview of the
+// quality of the OCR; a page with the confidence graph image, if
+// graphpath is not "", followed by a page with the summary text.
+func (p *Fpdf) AddReport(graphpath string, summary []string) error {
+	if graphpath != "" {
+		err := p.addImagePage(graphpath)
+		if err != nil {
+			return err
+		}
+	}
+	return p.addTextPage(summary)
+}
+
+// pageCount returns the number of pages in the PDF
+func (p *Fpdf) pageCount() int {
+	if p.stream != nil {
+		return p.stream.pageCount()
+	}
+	return p.fpdf.PageCount()
+}
+
 // Save saves the PDF to the file at path
 func (p *Fpdf) Save(path string) error {
+	if p.stream != nil {
+		return p.stream.save(path)
+	}
 	return p.fpdf.OutputFileAndClose(path)
 }
+
+// Close removes the temporary file a PDF is streamed to, if Stream is
+// set. It should be run once the PDF is finished with, so that the
+// file isn't left behind if Save is never reached, and does nothing
+// if the PDF has been saved or isn't streamed.
+func (p *Fpdf) Close() error {
+	if p.stream != nil {
+		return p.stream.abort()
+	}
+	return nil
+}
+
+// SplitPdf is a searchable PDF which is split into several volumes,
+// each of which is a complete PDF, so that very large books can be
+// made into files of a manageable size. A new volume is started by
+// AddPage once the current one reaches MaxPages pages, or once the
+// images in it reach MaxBytes bytes (so volumes may end up slightly
+// larger than MaxBytes). If either are zero they aren't used as a
+// limit. MinTextConf, ScaleHocr, DPI, PageDPI, Font, Footer, Stream,
+// TempDir and ColumnOrder are used for each volume, as with Fpdf. If
+// Cover is set, each volume starts with a cover page with those
+// lines, added with AddCover, which doesn't count towards MaxPages.
+type SplitPdf struct {
+	// these should be set before running Setup(), or left to defaults
+	MaxPages    int
+	MaxBytes    int
+	MinTextConf float64
+	ScaleHocr   bool
+	DPI         float64
+	PageDPI     func(imgpath string) float64
+	Font        []byte
+	Footer      string
+	Cover       []string
+	Stream      bool
+	TempDir     string
+	ColumnOrder bool
+
+	vols  []*Fpdf
+	saved []string
+}
+
+// newVolume starts a new volume of the PDF
+func (p *SplitPdf) newVolume() error {
+	v := &Fpdf{MinTextConf: p.MinTextConf, ScaleHocr: p.ScaleHocr, DPI: p.DPI, PageDPI: p.PageDPI, Font: p.Font, Footer: p.Footer, Stream: p.Stream, TempDir: p.TempDir, ColumnOrder: p.ColumnOrder}
+	err := v.Setup()
+	if err != nil {
+		_ = v.Close()
+		return err
+	}
+	if p.Cover != nil {
+		err = v.AddCover(p.Cover)
+		if err != nil {
+			_ = v.Close()
+			return err
+		}
+	}
+	p.vols = append(p.vols, v)
+	return nil
+}
+
+// Setup creates the first volume of the PDF
+func (p *SplitPdf) Setup() error {
+	p.vols = nil
+	return p.newVolume()
+}
+
+// AddPage adds a page to the current volume, first starting a new
+// volume if the current one is full
+func (p *SplitPdf) AddPage(imgpath, hocrpath string, smaller bool) error {
+	cur := p.vols[len(p.vols)-1]
+	n := cur.pageCount() - cur.covers
+	if n > 0 && ((p.MaxPages > 0 && n >= p.MaxPages) || (p.MaxBytes > 0 && cur.imgbytes >= p.MaxBytes)) {
+		err := p.newVolume()
+		if err != nil {
+			return err
+		}
+		cur = p.vols[len(p.vols)-1]
+	}
+	return cur.AddPage(imgpath, hocrpath, smaller)
+}
+
+// AddReport adds report pages, as with Fpdf.AddReport, to the end of
+// the last volume
+func (p *SplitPdf) AddReport(graphpath string, summary []string) error {
+	return p.vols[len(p.vols)-1].AddReport(graphpath, summary)
+}
+
+// VolumePath returns the path that volume n (starting at 1) of a
+// split PDF is saved to, which is the path with _part{n} added before
+// the .pdf suffix.
+func VolumePath(path string, n int) string {
+	return fmt.Sprintf("%s_part%d.pdf", strings.TrimSuffix(path, ".pdf"), n)
+}
+
+// DefaultPdfName is the default template for the name of the final
+// searchable PDF of a book, used by PdfName.
+const DefaultPdfName = "{book}.pdf"
+
+// PdfName expands a template for the name of the final PDF of a
+// book, replacing {book} with the book name and {date} with the date
+// in the form 2006-01-02. Any whitespace in the book name is replaced
+// with underscores, so that the name is safe to use in shell scripts
+// and URLs.
+func PdfName(template string, bookname string, date time.Time) string {
+	safename := strings.Join(strings.Fields(bookname), "_")
+	r := strings.NewReplacer("{book}", safename, "{date}", date.Format("2006-01-02"))
+	return r.Replace(template)
+}
+
+// Save saves each volume of the PDF. If there is only one volume it
+// is saved to path, otherwise they are saved to paths given by
+// VolumePath.
+func (p *SplitPdf) Save(path string) error {
+	p.saved = nil
+	if len(p.vols) == 1 {
+		p.saved = append(p.saved, path)
+		return p.vols[0].Save(path)
+	}
+	for i, v := range p.vols {
+		fn := VolumePath(path, i+1)
+		err := v.Save(fn)
+		if err != nil {
+			return err
+		}
+		p.saved = append(p.saved, fn)
+	}
+	return nil
+}
+
+// Close runs Close for each volume of the PDF, removing any temporary
+// files they are streamed to which haven't been saved
+func (p *SplitPdf) Close() error {
+	var err error
+	for _, v := range p.vols {
+		e := v.Close()
+		if err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// SavedPaths returns the paths of each file saved by Save
+func (p *SplitPdf) SavedPaths() []string {
+	return p.saved
+}
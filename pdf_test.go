@@ -0,0 +1,1076 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/image/font/gofont/goregular"
+	"rescribe.xyz/pdf"
+)
+
+const testHocr = `<?xml version="1.0" encoding="UTF-8"?>
+<html><body>
+<div class='ocr_page' id='page_1' title='image "page.png"; bbox 0 0 20 20'>
+<div class='ocr_carea' id='block_1_1'><p class='ocr_par' id='par_1_1'>
+<span class='ocr_line' id='line_1_1' title='bbox 0 0 20 10'>
+<span class='ocrx_word' id='word_1_1' title='bbox 0 0 20 10; x_wconf 90'>test</span>
+</span>
+</p></div>
+</div>
+</body></html>
+`
+
+func Test_SplitPdf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookpipelinetest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	imgpath := filepath.Join(dir, "page.png")
+	f, err := os.Create(imgpath)
+	if err != nil {
+		t.Fatalf("Could not create image: %v", err)
+	}
+	err = png.Encode(f, image.NewGray(image.Rect(0, 0, 20, 20)))
+	f.Close()
+	if err != nil {
+		t.Fatalf("Could not encode image: %v", err)
+	}
+	hocrpath := filepath.Join(dir, "page.hocr")
+	err = ioutil.WriteFile(hocrpath, []byte(testHocr), 0644)
+	if err != nil {
+		t.Fatalf("Could not create hOCR: %v", err)
+	}
+
+	cases := []struct {
+		name     string
+		maxpages int
+		pages    int
+		expected []int
+	}{
+		{"nosplit", 0, 10, []int{10}},
+		{"under", 200, 150, []int{150}},
+		{"split", 200, 500, []int{200, 200, 100}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pdf := &SplitPdf{MaxPages: c.maxpages}
+			err := pdf.Setup()
+			if err != nil {
+				t.Fatalf("Could not set up PDF: %v", err)
+			}
+			for i := 0; i < c.pages; i++ {
+				err = pdf.AddPage(imgpath, hocrpath, false)
+				if err != nil {
+					t.Fatalf("Could not add page %d: %v", i, err)
+				}
+			}
+
+			if len(pdf.vols) != len(c.expected) {
+				t.Fatalf("Expected %d volumes, got %d", len(c.expected), len(pdf.vols))
+			}
+			for i, v := range pdf.vols {
+				if v.fpdf.PageCount() != c.expected[i] {
+					t.Fatalf("Expected volume %d to have %d pages, got %d", i+1, c.expected[i], v.fpdf.PageCount())
+				}
+			}
+
+			out := filepath.Join(dir, c.name+".pdf")
+			err = pdf.Save(out)
+			if err != nil {
+				t.Fatalf("Could not save PDF: %v", err)
+			}
+			saved := pdf.SavedPaths()
+			if len(saved) != len(c.expected) {
+				t.Fatalf("Expected %d files to be saved, got %d", len(c.expected), len(saved))
+			}
+			for i, fn := range saved {
+				if len(saved) > 1 && fn != VolumePath(out, i+1) {
+					t.Fatalf("Unexpected volume name %s", fn)
+				}
+				b, err := ioutil.ReadFile(fn)
+				if err != nil {
+					t.Fatalf("Could not read saved PDF %s: %v", fn, err)
+				}
+				if !bytes.HasPrefix(b, []byte("%PDF")) || !bytes.Contains(b[len(b)-10:], []byte("%%EOF")) {
+					t.Fatalf("Saved PDF %s is not a complete PDF", fn)
+				}
+			}
+		})
+	}
+}
+
+const testHocrConfs = `<?xml version="1.0" encoding="UTF-8"?>
+<html><body>
+<div class='ocr_page' id='page_1' title='image "page.png"; bbox 0 0 60 20'>
+<div class='ocr_carea' id='block_1_1'><p class='ocr_par' id='par_1_1'>
+<span class='ocr_line' id='line_1_1' title='bbox 0 0 60 10'>
+<span class='ocrx_word' id='word_1_1' title='bbox 0 0 20 10; x_wconf 90'>good</span>
+<span class='ocrx_word' id='word_1_2' title='bbox 20 0 40 10; x_wconf 30'>bad</span>
+<span class='ocrx_word' id='word_1_3' title='bbox 40 0 60 10; x_wconf 75'>fine</span>
+</span>
+</p></div>
+</div>
+</body></html>
+`
+
+// utf16be encodes a string of characters from the basic multilingual
+// plane in the way gofpdf encodes text with a UTF-8 font
+func utf16be(s string) []byte {
+	var b []byte
+	for _, c := range s {
+		b = append(b, byte(c>>8), byte(c))
+	}
+	return b
+}
+
+func Test_MinTextConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookpipelinetest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	imgpath := filepath.Join(dir, "page.png")
+	f, err := os.Create(imgpath)
+	if err != nil {
+		t.Fatalf("Could not create image: %v", err)
+	}
+	err = png.Encode(f, image.NewGray(image.Rect(0, 0, 60, 20)))
+	f.Close()
+	if err != nil {
+		t.Fatalf("Could not encode image: %v", err)
+	}
+	hocrpath := filepath.Join(dir, "page.hocr")
+	err = ioutil.WriteFile(hocrpath, []byte(testHocrConfs), 0644)
+	if err != nil {
+		t.Fatalf("Could not create hOCR: %v", err)
+	}
+
+	cases := []struct {
+		name    string
+		minconf float64
+		words   []string
+	}{
+		{"none", 0, []string{"good", "bad", "fine"}},
+		{"some", 50, []string{"good", "fine"}},
+		{"most", 80, []string{"good"}},
+		{"all", 95, []string{}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pdf := &SplitPdf{MinTextConf: c.minconf}
+			err := pdf.Setup()
+			if err != nil {
+				t.Fatalf("Could not set up PDF: %v", err)
+			}
+			// disable compression so the content stream can be checked
+			pdf.vols[0].fpdf.SetCompression(false)
+			err = pdf.AddPage(imgpath, hocrpath, false)
+			if err != nil {
+				t.Fatalf("Could not add page: %v", err)
+			}
+			out := filepath.Join(dir, c.name+".pdf")
+			err = pdf.Save(out)
+			if err != nil {
+				t.Fatalf("Could not save PDF: %v", err)
+			}
+			b, err := ioutil.ReadFile(out)
+			if err != nil {
+				t.Fatalf("Could not read saved PDF: %v", err)
+			}
+
+			// each word is written with a separate Tj operator
+			n := bytes.Count(b, []byte(")Tj"))
+			if n != len(c.words) {
+				t.Fatalf("Expected %d words in text layer, got %d", len(c.words), n)
+			}
+			for _, w := range c.words {
+				if !bytes.Contains(b, utf16be(w)) {
+					t.Fatalf("Word %s not found in text layer", w)
+				}
+			}
+			if !bytes.Contains(b, []byte(" Do")) {
+				t.Fatalf("Image not placed on page")
+			}
+		})
+	}
+}
+
+func Test_AddReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookpipelinetest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	imgpath := filepath.Join(dir, "page.png")
+	graphpath := filepath.Join(dir, "graph.png")
+	for _, fn := range []string{imgpath, graphpath} {
+		f, err := os.Create(fn)
+		if err != nil {
+			t.Fatalf("Could not create image: %v", err)
+		}
+		err = png.Encode(f, image.NewGray(image.Rect(0, 0, 20, 20)))
+		f.Close()
+		if err != nil {
+			t.Fatalf("Could not encode image: %v", err)
+		}
+	}
+	hocrpath := filepath.Join(dir, "page.hocr")
+	err = ioutil.WriteFile(hocrpath, []byte(testHocr), 0644)
+	if err != nil {
+		t.Fatalf("Could not create hOCR: %v", err)
+	}
+
+	summary := ConfSummary(map[string]*Conf{
+		"a": {Path: "0001.hocr", Conf: 80},
+		"b": {Path: "0002.hocr", Conf: 40},
+		"c": {Path: "0003.hocr", Conf: 60},
+	})
+
+	cases := []struct {
+		name      string
+		maxpages  int
+		pages     int
+		graphpath string
+		expected  []int
+	}{
+		{"report", 0, 3, graphpath, []int{5}},
+		{"nograph", 0, 3, "", []int{4}},
+		{"split", 2, 3, graphpath, []int{2, 3}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pdf := &SplitPdf{MaxPages: c.maxpages}
+			err := pdf.Setup()
+			if err != nil {
+				t.Fatalf("Could not set up PDF: %v", err)
+			}
+			for i := 0; i < c.pages; i++ {
+				err = pdf.AddPage(imgpath, hocrpath, false)
+				if err != nil {
+					t.Fatalf("Could not add page %d: %v", i, err)
+				}
+			}
+			err = pdf.AddReport(c.graphpath, summary)
+			if err != nil {
+				t.Fatalf("Could not add report: %v", err)
+			}
+
+			if len(pdf.vols) != len(c.expected) {
+				t.Fatalf("Expected %d volumes, got %d", len(c.expected), len(pdf.vols))
+			}
+			for i, v := range pdf.vols {
+				if v.fpdf.PageCount() != c.expected[i] {
+					t.Fatalf("Expected volume %d to have %d pages, got %d", i+1, c.expected[i], v.fpdf.PageCount())
+				}
+			}
+
+			pdf.vols[len(pdf.vols)-1].fpdf.SetCompression(false)
+			err = pdf.Save(filepath.Join(dir, c.name+".pdf"))
+			if err != nil {
+				t.Fatalf("Could not save PDF: %v", err)
+			}
+			saved := pdf.SavedPaths()
+			b, err := ioutil.ReadFile(saved[len(saved)-1])
+			if err != nil {
+				t.Fatalf("Could not read saved PDF: %v", err)
+			}
+			for _, l := range summary {
+				if !bytes.Contains(b, utf16be(l)) {
+					t.Fatalf("Summary line '%s' not found in PDF", l)
+				}
+			}
+		})
+	}
+}
+
+func Test_ConfSummary(t *testing.T) {
+	confs := make(map[string]*Conf)
+	for i := 1; i <= 12; i++ {
+		p := fmt.Sprintf("%04d.hocr", i)
+		confs[p] = &Conf{Path: p, Conf: float64(i * 5)}
+	}
+	summary := ConfSummary(confs)
+	if len(summary) != 3+maxSummaryPages {
+		t.Fatalf("Expected %d summary lines, got %d", 3+maxSummaryPages, len(summary))
+	}
+	expected := []string{"Pages: 12", "Average confidence: 32", "Lowest confidence pages:", "    0001.hocr: 5"}
+	for i, e := range expected {
+		if summary[i] != e {
+			t.Fatalf("Expected line %d to be '%s', got '%s'", i, e, summary[i])
+		}
+	}
+	if summary[len(summary)-1] != "    0010.hocr: 50" {
+		t.Fatalf("Unexpected last summary line '%s'", summary[len(summary)-1])
+	}
+}
+
+const testHocrHalf = `<?xml version="1.0" encoding="UTF-8"?>
+<html><body>
+<div class='ocr_page' id='page_1' title='image "page.png"; bbox 0 0 290 145; ppageno 0'>
+<div class='ocr_carea' id='block_1_1'><p class='ocr_par' id='par_1_1'>
+<span class='ocr_line' id='line_1_1' title='bbox 0 29 290 58'>
+<span class='ocrx_word' id='word_1_1' title='bbox 58 29 116 58; x_wconf 90'>test</span>
+</span>
+</p></div>
+</div>
+</body></html>
+`
+
+func Test_ScaleHocr(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookpipelinetest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the colour image is twice the size of the image OCRed
+	imgpath := filepath.Join(dir, "page.png")
+	f, err := os.Create(imgpath)
+	if err != nil {
+		t.Fatalf("Could not create image: %v", err)
+	}
+	err = png.Encode(f, image.NewGray(image.Rect(0, 0, 580, 290)))
+	f.Close()
+	if err != nil {
+		t.Fatalf("Could not encode image: %v", err)
+	}
+	hocrpath := filepath.Join(dir, "page.hocr")
+	err = ioutil.WriteFile(hocrpath, []byte(testHocrHalf), 0644)
+	if err != nil {
+		t.Fatalf("Could not create hOCR: %v", err)
+	}
+
+	tdRe := regexp.MustCompile(`BT ([0-9.]+) ([0-9.]+) Td`)
+
+	cases := []struct {
+		name  string
+		scale bool
+		x     string
+	}{
+		{"unscaled", false, "10.00"},
+		{"scaled", true, "20.00"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pdf := &Fpdf{ScaleHocr: c.scale}
+			err := pdf.Setup()
+			if err != nil {
+				t.Fatalf("Could not set up PDF: %v", err)
+			}
+			// disable compression so the content stream can be checked
+			pdf.fpdf.SetCompression(false)
+			err = pdf.AddPage(imgpath, hocrpath, false)
+			if err != nil {
+				t.Fatalf("Could not add page: %v", err)
+			}
+			out := filepath.Join(dir, c.name+".pdf")
+			err = pdf.Save(out)
+			if err != nil {
+				t.Fatalf("Could not save PDF: %v", err)
+			}
+			b, err := ioutil.ReadFile(out)
+			if err != nil {
+				t.Fatalf("Could not read saved PDF: %v", err)
+			}
+
+			// the word starts at 58px in the hOCR, which is 116px in
+			// the image, and pages are 5.8 pixels per pt
+			m := tdRe.FindSubmatch(b)
+			if m == nil {
+				t.Fatalf("No text position found in PDF")
+			}
+			if string(m[1]) != c.x {
+				t.Fatalf("Expected word at x position %s, got %s", c.x, m[1])
+			}
+		})
+	}
+}
+
+func Test_PdfName(t *testing.T) {
+	date := time.Date(2022, 3, 14, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		template string
+		bookname string
+		expected string
+	}{
+		{DefaultPdfName, "book", "book.pdf"},
+		{DefaultPdfName, "my  old\tbook ", "my_old_book.pdf"},
+		{"{book} searchable.pdf", "book", "book searchable.pdf"},
+		{"{book}-{date}.pdf", "a book", "a_book-2022-03-14.pdf"},
+		{"ocr.pdf", "book", "ocr.pdf"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.expected, func(t *testing.T) {
+			n := PdfName(c.template, c.bookname, date)
+			if n != c.expected {
+				t.Fatalf("Expected %s, got %s", c.expected, n)
+			}
+		})
+	}
+}
+
+func Test_DPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookpipelinetest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a US letter page scanned at 300 DPI
+	imgpath := filepath.Join(dir, "page.png")
+	f, err := os.Create(imgpath)
+	if err != nil {
+		t.Fatalf("Could not create image: %v", err)
+	}
+	err = png.Encode(f, image.NewGray(image.Rect(0, 0, 2550, 3300)))
+	f.Close()
+	if err != nil {
+		t.Fatalf("Could not encode image: %v", err)
+	}
+	hocrpath := filepath.Join(dir, "page.hocr")
+	err = ioutil.WriteFile(hocrpath, []byte(testHocr), 0644)
+	if err != nil {
+		t.Fatalf("Could not create hOCR: %v", err)
+	}
+
+	cases := []struct {
+		name    string
+		dpi     float64
+		pagedpi func(string) float64
+		width   float64
+	}{
+		{"default", 0, nil, 2550 / pageWidth},
+		{"300dpi", 300, nil, 8.5 * 72},
+		{"page", 300, func(string) float64 { return 150 }, 17 * 72},
+		{"unknownpage", 300, func(string) float64 { return 0 }, 8.5 * 72},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pdf := &Fpdf{DPI: c.dpi, PageDPI: c.pagedpi}
+			err := pdf.Setup()
+			if err != nil {
+				t.Fatalf("Could not set up PDF: %v", err)
+			}
+			err = pdf.AddPage(imgpath, hocrpath, true)
+			if err != nil {
+				t.Fatalf("Could not add page: %v", err)
+			}
+			w, h := pdf.fpdf.GetPageSize()
+			if fmt.Sprintf("%.2f", w) != fmt.Sprintf("%.2f", c.width) {
+				t.Fatalf("Expected page width %.2fpt, got %.2fpt", c.width, w)
+			}
+			if fmt.Sprintf("%.2f", h) != fmt.Sprintf("%.2f", c.width*3300/2550) {
+				t.Fatalf("Expected page height %.2fpt, got %.2fpt", c.width*3300/2550, h)
+			}
+		})
+	}
+}
+
+// Test_InvalidUTF8 tests that a page whose hOCR contains invalid
+// UTF-8 can still be added to a PDF
+func Test_InvalidUTF8(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookpipelinetest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	imgpath := filepath.Join(dir, "page.png")
+	f, err := os.Create(imgpath)
+	if err != nil {
+		t.Fatalf("Could not create image: %v", err)
+	}
+	err = png.Encode(f, image.NewGray(image.Rect(0, 0, 20, 20)))
+	f.Close()
+	if err != nil {
+		t.Fatalf("Could not encode image: %v", err)
+	}
+	hocrpath := filepath.Join(dir, "page.hocr")
+	err = ioutil.WriteFile(hocrpath, bytes.Replace([]byte(testHocr), []byte(">test<"), []byte(">t\xffst<"), 1), 0644)
+	if err != nil {
+		t.Fatalf("Could not create hOCR: %v", err)
+	}
+
+	pdf := &Fpdf{}
+	err = pdf.Setup()
+	if err != nil {
+		t.Fatalf("Could not set up PDF: %v", err)
+	}
+	err = pdf.AddPage(imgpath, hocrpath, false)
+	if err != nil {
+		t.Fatalf("Could not add page: %v", err)
+	}
+	err = pdf.Save(filepath.Join(dir, "out.pdf"))
+	if err != nil {
+		t.Fatalf("Could not save PDF: %v", err)
+	}
+}
+
+const testHocrGreek = `<?xml version="1.0" encoding="UTF-8"?>
+<html><body>
+<div class='ocr_page' id='page_1' title='image "page.png"; bbox 0 0 60 20'>
+<div class='ocr_carea' id='block_1_1'><p class='ocr_par' id='par_1_1'>
+<span class='ocr_line' id='line_1_1' title='bbox 0 0 60 10'>
+<span class='ocrx_word' id='word_1_1' title='bbox 0 0 30 10; x_wconf 90'>λόγος</span>
+<span class='ocrx_word' id='word_1_2' title='bbox 30 0 60 10; x_wconf 90'>Αθήνα</span>
+</span>
+</p></div>
+</div>
+</body></html>
+`
+
+// extractedText returns the text of every page of the PDF at path,
+// as read by a PDF reader using the fonts' mappings to Unicode
+func extractedText(path string) (string, error) {
+	r, err := pdf.Open(path)
+	if err != nil {
+		return "", err
+	}
+	var s strings.Builder
+	for n := 1; n <= r.NumPage(); n++ {
+		for _, t := range r.Page(n).Content().Text {
+			s.WriteString(t.S)
+		}
+	}
+	return s.String(), nil
+}
+
+// Test_Font tests that Greek text in the text layer can be extracted
+// from the PDF, with both the default font and a custom one
+func Test_Font(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookpipelinetest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	imgpath := filepath.Join(dir, "page.png")
+	f, err := os.Create(imgpath)
+	if err != nil {
+		t.Fatalf("Could not create image: %v", err)
+	}
+	err = png.Encode(f, image.NewGray(image.Rect(0, 0, 60, 20)))
+	f.Close()
+	if err != nil {
+		t.Fatalf("Could not encode image: %v", err)
+	}
+	hocrpath := filepath.Join(dir, "page.hocr")
+	err = ioutil.WriteFile(hocrpath, []byte(testHocrGreek), 0644)
+	if err != nil {
+		t.Fatalf("Could not create hOCR: %v", err)
+	}
+
+	var compressed bytes.Buffer
+	w := zlib.NewWriter(&compressed)
+	_, err = w.Write(goregular.TTF)
+	w.Close()
+	if err != nil {
+		t.Fatalf("Could not compress font: %v", err)
+	}
+
+	cases := []struct {
+		name string
+		font []byte
+	}{
+		{"default", nil},
+		{"ttf", goregular.TTF},
+		{"compressed", compressed.Bytes()},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pdf := &Fpdf{Font: c.font}
+			err := pdf.Setup()
+			if err != nil {
+				t.Fatalf("Could not set up PDF: %v", err)
+			}
+			err = pdf.AddPage(imgpath, hocrpath, false)
+			if err != nil {
+				t.Fatalf("Could not add page: %v", err)
+			}
+			out := filepath.Join(dir, c.name+".pdf")
+			err = pdf.Save(out)
+			if err != nil {
+				t.Fatalf("Could not save PDF: %v", err)
+			}
+			text, err := extractedText(out)
+			if err != nil {
+				t.Fatalf("Could not extract text from PDF: %v", err)
+			}
+
+			for _, word := range []string{"λόγος", "Αθήνα"} {
+				if !strings.Contains(text, word) {
+					t.Fatalf("Word %s not found in text extracted from PDF: %q", word, text)
+				}
+			}
+		})
+	}
+}
+
+func Test_Footer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookpipelinetest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	imgpath := filepath.Join(dir, "page.png")
+	f, err := os.Create(imgpath)
+	if err != nil {
+		t.Fatalf("Could not create image: %v", err)
+	}
+	err = png.Encode(f, image.NewGray(image.Rect(0, 0, 720, 1080)))
+	f.Close()
+	if err != nil {
+		t.Fatalf("Could not encode image: %v", err)
+	}
+	hocrpath := filepath.Join(dir, "page.hocr")
+	err = ioutil.WriteFile(hocrpath, []byte(testHocr), 0644)
+	if err != nil {
+		t.Fatalf("Could not create hOCR: %v", err)
+	}
+
+	const footer = "OCR by Rescribe, 2022-10-01"
+	cover := []string{"Test book", "library: Test Library"}
+
+	cases := []struct {
+		name   string
+		footer string
+		cover  []string
+	}{
+		{"none", "", nil},
+		{"footer", footer, nil},
+		{"cover", "", cover},
+		{"both", footer, cover},
+	}
+
+	const pages = 3
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pdf := &SplitPdf{Footer: c.footer, Cover: c.cover, DPI: 72}
+			err := pdf.Setup()
+			if err != nil {
+				t.Fatalf("Could not set up PDF: %v", err)
+			}
+			// disable compression so the content stream can be checked
+			pdf.vols[0].fpdf.SetCompression(false)
+			for i := 0; i < pages; i++ {
+				err = pdf.AddPage(imgpath, hocrpath, false)
+				if err != nil {
+					t.Fatalf("Could not add page %d: %v", i, err)
+				}
+			}
+
+			fpdf := pdf.vols[0].fpdf
+			expected := pages
+			if c.cover != nil {
+				expected++
+			}
+			if fpdf.PageCount() != expected {
+				t.Fatalf("Expected %d pages, got %d", expected, fpdf.PageCount())
+			}
+
+			// the footer goes in a margin below the image, rather
+			// than over it
+			expectedHt := 1080.0
+			if c.footer != "" {
+				expectedHt += footerHeight
+			}
+			for n := fpdf.PageCount() - pages + 1; n <= fpdf.PageCount(); n++ {
+				wd, ht, _ := fpdf.PageSize(n)
+				if wd != 720 || ht != expectedHt {
+					t.Fatalf("Expected page %d to be 720x%.0f, got %.0fx%.0f", n, expectedHt, wd, ht)
+				}
+			}
+
+			out := filepath.Join(dir, c.name+".pdf")
+			err = pdf.Save(out)
+			if err != nil {
+				t.Fatalf("Could not save PDF: %v", err)
+			}
+			b, err := ioutil.ReadFile(out)
+			if err != nil {
+				t.Fatalf("Could not read saved PDF: %v", err)
+			}
+
+			// each page has its own content stream, so the footer
+			// should appear once for each page
+			n := bytes.Count(b, utf16be(footer))
+			if c.footer != "" && n != pages {
+				t.Fatalf("Expected footer to appear on each of the %d pages, found it %d times", pages, n)
+			}
+			if c.footer == "" && n != 0 {
+				t.Fatalf("Expected no footer, found it %d times", n)
+			}
+			for _, l := range cover {
+				n := bytes.Count(b, utf16be(l))
+				if c.cover != nil && n != 1 {
+					t.Fatalf("Expected cover line '%s' to appear once, found it %d times", l, n)
+				}
+				if c.cover == nil && n != 0 {
+					t.Fatalf("Expected no cover, found '%s' %d times", l, n)
+				}
+			}
+		})
+	}
+}
+
+var (
+	bfcharRe = regexp.MustCompile(`<([0-9A-F]{4})> <([0-9A-F]+)>`)
+	showRe   = regexp.MustCompile(`<([0-9A-F]*)> Tj`)
+)
+
+// readStream returns the decoded contents of a PDF stream
+func readStream(v pdf.Value) ([]byte, error) {
+	r := v.Reader()
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// streamedText returns the text shown on a page of a streamed PDF,
+// decoded with the ToUnicode map of its font
+func streamedText(p pdf.Page) (string, error) {
+	cmap, err := readStream(p.V.Key("Resources").Key("Font").Key("F1").Key("ToUnicode"))
+	if err != nil {
+		return "", err
+	}
+	chars := make(map[string]string)
+	for _, m := range bfcharRe.FindAllStringSubmatch(string(cmap), -1) {
+		var u []uint16
+		for i := 0; i+4 <= len(m[2]); i += 4 {
+			n, _ := strconv.ParseUint(m[2][i:i+4], 16, 16)
+			u = append(u, uint16(n))
+		}
+		chars[m[1]] = string(utf16.Decode(u))
+	}
+
+	content, err := readStream(p.V.Key("Contents"))
+	if err != nil {
+		return "", err
+	}
+	var s strings.Builder
+	for _, m := range showRe.FindAllStringSubmatch(string(content), -1) {
+		for i := 0; i+4 <= len(m[1]); i += 4 {
+			s.WriteString(chars[m[1][i:i+4]])
+		}
+	}
+	return s.String(), nil
+}
+
+// pdfPages returns the size of each page of the PDF at path in pt,
+// and if streamed is set the text of each page, read with
+// streamedText
+func pdfPages(path string, streamed bool) ([][2]float64, []string, error) {
+	r, err := pdf.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var sizes [][2]float64
+	var texts []string
+	for n := 1; n <= r.NumPage(); n++ {
+		p := r.Page(n)
+		// the MediaBox may be set on the page tree rather than the page
+		box := p.V.Key("MediaBox")
+		for v := p.V; box.IsNull() && !v.IsNull(); v = v.Key("Parent") {
+			box = v.Key("MediaBox")
+		}
+		sizes = append(sizes, [2]float64{box.Index(2).Float64() - box.Index(0).Float64(), box.Index(3).Float64() - box.Index(1).Float64()})
+		if streamed {
+			text, err := streamedText(p)
+			if err != nil {
+				return sizes, texts, fmt.Errorf("Could not read text of page %d: %v", n, err)
+			}
+			texts = append(texts, text)
+		}
+	}
+	return sizes, texts, nil
+}
+
+// Test_Stream tests that a streamed PDF is a valid PDF, with the same
+// pages as one which isn't streamed, and that its text can be
+// extracted
+func Test_Stream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookpipelinetest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	imgpath := filepath.Join(dir, "page.png")
+	f, err := os.Create(imgpath)
+	if err != nil {
+		t.Fatalf("Could not create image: %v", err)
+	}
+	err = png.Encode(f, image.NewRGBA(image.Rect(0, 0, 60, 20)))
+	f.Close()
+	if err != nil {
+		t.Fatalf("Could not encode image: %v", err)
+	}
+	hocrpath := filepath.Join(dir, "page.hocr")
+	err = ioutil.WriteFile(hocrpath, []byte(strings.Replace(testHocrConfs, "fine", "λόγος", 1)), 0644)
+	if err != nil {
+		t.Fatalf("Could not create hOCR: %v", err)
+	}
+
+	const pages = 5
+	var sizes [2][][2]float64
+	var texts []string
+	for i, stream := range []bool{false, true} {
+		p := &SplitPdf{MinTextConf: 50, DPI: 72, Footer: "OCR by Rescribe", Cover: []string{"Test book"}, Stream: stream, TempDir: dir}
+		err = p.Setup()
+		if err != nil {
+			t.Fatalf("Could not set up PDF: %v", err)
+		}
+		for n := 0; n < pages; n++ {
+			err = p.AddPage(imgpath, hocrpath, false)
+			if err != nil {
+				t.Fatalf("Could not add page %d: %v", n, err)
+			}
+		}
+		err = p.AddReport(imgpath, []string{"Average confidence: 65"})
+		if err != nil {
+			t.Fatalf("Could not add report: %v", err)
+		}
+		out := filepath.Join(dir, fmt.Sprintf("stream%v.pdf", stream))
+		err = p.Save(out)
+		if err != nil {
+			t.Fatalf("Could not save PDF: %v", err)
+		}
+		sizes[i], texts, err = pdfPages(out, stream)
+		if err != nil {
+			t.Fatalf("Could not read PDF saved with stream %v: %v", stream, err)
+		}
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Could not read directory: %v", err)
+	}
+	for _, fi := range files {
+		if strings.HasPrefix(fi.Name(), "bookpipelinepdf") {
+			t.Fatalf("Expected the temporary file %s to be moved when saved", fi.Name())
+		}
+	}
+
+	if len(sizes[1]) != pages+3 {
+		t.Fatalf("Expected %d pages in the streamed PDF, got %d", pages+3, len(sizes[1]))
+	}
+	for n := range sizes[0] {
+		s0, s1 := sizes[0][n], sizes[1][n]
+		if math.Abs(s0[0]-s1[0]) > 0.1 || math.Abs(s0[1]-s1[1]) > 0.1 {
+			t.Fatalf("Expected page %d of the streamed PDF to be %.2fx%.2f, got %.2fx%.2f", n+1, s0[0], s0[1], s1[0], s1[1])
+		}
+	}
+
+	expected := []string{"Test book", "good", "λόγος", "OCR by Rescribe"}
+	for _, e := range expected {
+		if !strings.Contains(strings.Join(texts, "\n"), e) {
+			t.Fatalf("Expected %s in the text of the streamed PDF, got %v", e, texts)
+		}
+	}
+	if strings.Contains(strings.Join(texts, "\n"), "bad") {
+		t.Fatalf("Expected a word with a low confidence to be left out of the streamed PDF, got %v", texts)
+	}
+}
+
+func Test_StreamClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookpipelinetest")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	imgpath := filepath.Join(dir, "page.png")
+	f, err := os.Create(imgpath)
+	if err != nil {
+		t.Fatalf("Could not create image: %v", err)
+	}
+	err = png.Encode(f, image.NewRGBA(image.Rect(0, 0, 60, 20)))
+	f.Close()
+	if err != nil {
+		t.Fatalf("Could not encode image: %v", err)
+	}
+	hocrpath := filepath.Join(dir, "page.hocr")
+	err = ioutil.WriteFile(hocrpath, []byte(testHocrConfs), 0644)
+	if err != nil {
+		t.Fatalf("Could not create hOCR: %v", err)
+	}
+
+	tempfiles := func() []string {
+		var names []string
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("Could not read directory: %v", err)
+		}
+		for _, fi := range files {
+			if strings.HasPrefix(fi.Name(), "bookpipelinepdf") {
+				names = append(names, fi.Name())
+			}
+		}
+		return names
+	}
+
+	// a PDF which is abandoned before it is saved, with two volumes
+	p := &SplitPdf{MaxPages: 1, Stream: true, TempDir: dir}
+	err = p.Setup()
+	if err != nil {
+		t.Fatalf("Could not set up PDF: %v", err)
+	}
+	for n := 0; n < 2; n++ {
+		err = p.AddPage(imgpath, hocrpath, false)
+		if err != nil {
+			t.Fatalf("Could not add page %d: %v", n, err)
+		}
+	}
+	if len(tempfiles()) != 2 {
+		t.Fatalf("Expected a temporary file for each volume, got %v", tempfiles())
+	}
+	err = p.Close()
+	if err != nil {
+		t.Fatalf("Could not close PDF: %v", err)
+	}
+	if len(tempfiles()) != 0 {
+		t.Fatalf("Expected the temporary files to be removed by Close, got %v", tempfiles())
+	}
+
+	// closing a saved PDF should leave it alone
+	p = &SplitPdf{Stream: true, TempDir: dir}
+	err = p.Setup()
+	if err != nil {
+		t.Fatalf("Could not set up PDF: %v", err)
+	}
+	err = p.AddPage(imgpath, hocrpath, false)
+	if err != nil {
+		t.Fatalf("Could not add page: %v", err)
+	}
+	out := filepath.Join(dir, "saved.pdf")
+	err = p.Save(out)
+	if err != nil {
+		t.Fatalf("Could not save PDF: %v", err)
+	}
+	err = p.Close()
+	if err != nil {
+		t.Fatalf("Could not close saved PDF: %v", err)
+	}
+	_, err = os.Stat(out)
+	if err != nil {
+		t.Fatalf("Expected saved PDF to still exist after Close: %v", err)
+	}
+}
+
+// benchmarkPdfMemory adds pages to a PDF, reporting how much the
+// memory in use has grown once they are added, just before it is
+// saved
+func benchmarkPdfMemory(b *testing.B, stream bool, pages int) {
+	dir, err := ioutil.TempDir("", "bookpipelinebench")
+	if err != nil {
+		b.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	imgpath := filepath.Join(dir, "page.png")
+	f, err := os.Create(imgpath)
+	if err != nil {
+		b.Fatalf("Could not create image: %v", err)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, 500, 750))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 7)
+	}
+	err = png.Encode(f, img)
+	f.Close()
+	if err != nil {
+		b.Fatalf("Could not encode image: %v", err)
+	}
+	hocrpath := filepath.Join(dir, "page.hocr")
+	err = ioutil.WriteFile(hocrpath, []byte(testHocrConfs), 0644)
+	if err != nil {
+		b.Fatalf("Could not create hOCR: %v", err)
+	}
+
+	// each page needs its own image, as images added to a PDF built
+	// in memory are only stored once for each path
+	var imgs []string
+	for n := 0; n < pages; n++ {
+		fn := filepath.Join(dir, fmt.Sprintf("page%d.png", n))
+		err = os.Link(imgpath, fn)
+		if err != nil {
+			b.Fatalf("Could not link image: %v", err)
+		}
+		imgs = append(imgs, fn)
+	}
+
+	b.ResetTimer()
+	var grown uint64
+	for i := 0; i < b.N; i++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+
+		p := &Fpdf{Stream: stream, TempDir: dir}
+		err = p.Setup()
+		if err != nil {
+			b.Fatalf("Could not set up PDF: %v", err)
+		}
+		for n, img := range imgs {
+			err = p.AddPage(img, hocrpath, false)
+			if err != nil {
+				b.Fatalf("Could not add page %d: %v", n, err)
+			}
+		}
+
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		if after.HeapAlloc > before.HeapAlloc {
+			grown += after.HeapAlloc - before.HeapAlloc
+		}
+
+		err = p.Save(filepath.Join(dir, "bench.pdf"))
+		if err != nil {
+			b.Fatalf("Could not save PDF: %v", err)
+		}
+	}
+	b.ReportMetric(float64(grown)/float64(b.N)/1024/1024, "heapMB")
+}
+
+// BenchmarkPdfMemory shows how the memory used grows with the number
+// of pages for a PDF built in memory and one which is streamed. The
+// heapMB reported should grow with the pages for the former, and stay
+// roughly flat for the latter.
+func BenchmarkPdfMemory(b *testing.B) {
+	for _, stream := range []bool{false, true} {
+		for _, pages := range []int{10, 40, 160} {
+			b.Run(fmt.Sprintf("stream=%v/pages=%d", stream, pages), func(b *testing.B) {
+				benchmarkPdfMemory(b, stream, pages)
+			})
+		}
+	}
+}
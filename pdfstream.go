@@ -0,0 +1,401 @@
+// Copyright 2022 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+)
+
+// pdfStream writes a PDF to a file one page at a time, as used by
+// Fpdf when Stream is set. Each object is written as soon as it is
+// made, so only the offsets of the objects and the glyphs used need
+// to be kept in memory until the PDF is finished by save. The objects
+// which need to know about every page or glyph, which are the page
+// tree and the font, are written at the end.
+type pdfStream struct {
+	f   *os.File
+	w   *bufio.Writer
+	off int64 // number of bytes written so far
+	err error // first error writing to the file
+
+	closed bool // whether the file has been saved or removed by abort
+
+	objs  []int64 // offset of each object, numbered from 1
+	pages []int   // object number of each page
+
+	font     *sfnt.Font
+	fontdata []byte
+	fontbuf  sfnt.Buffer
+	upem     float64
+	glyphs   map[sfnt.GlyphIndex]rune // character each glyph used is for
+	widths   map[sfnt.GlyphIndex]int  // width of each glyph used, in 1000ths of the font size
+}
+
+// object numbers which are reserved for objects that are written at
+// the end, but which need to be referred to before then
+const (
+	catalogObj = 1
+	pagesObj   = 2
+	fontObj    = 3
+)
+
+// a5Width and a5Height are the size in pt of an A5 page, which is
+// used for pages of text
+const (
+	a5Width  = 420.94
+	a5Height = 595.28
+)
+
+// newPdfStream starts writing a PDF to a temporary file in dir, or
+// the default directory for temporary files if dir is empty, using
+// the TrueType font in fontdata for any text.
+func newPdfStream(dir string, fontdata []byte) (*pdfStream, error) {
+	f, err := sfnt.Parse(fontdata)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not parse font: %v", err))
+	}
+	tmp, err := ioutil.TempFile(dir, "bookpipelinepdf")
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not create temporary file: %v", err))
+	}
+	s := &pdfStream{
+		f:        tmp,
+		w:        bufio.NewWriter(tmp),
+		objs:     make([]int64, fontObj),
+		font:     f,
+		fontdata: fontdata,
+		upem:     float64(f.UnitsPerEm()),
+		glyphs:   make(map[sfnt.GlyphIndex]rune),
+		widths:   make(map[sfnt.GlyphIndex]int),
+	}
+	s.printf("%%PDF-1.4\n%%\xe2\xe3\xcf\xd3\n")
+	return s, s.err
+}
+
+// write writes b to the file, recording any error
+func (s *pdfStream) write(b []byte) {
+	if s.err != nil {
+		return
+	}
+	n, err := s.w.Write(b)
+	s.off += int64(n)
+	s.err = err
+}
+
+// printf writes formatted text to the file, recording any error
+func (s *pdfStream) printf(format string, a ...interface{}) {
+	s.write([]byte(fmt.Sprintf(format, a...)))
+}
+
+// newObj returns the number of a new object, to be written with
+// beginObj
+func (s *pdfStream) newObj() int {
+	s.objs = append(s.objs, 0)
+	return len(s.objs)
+}
+
+// beginObj starts writing object n
+func (s *pdfStream) beginObj(n int) {
+	s.objs[n-1] = s.off
+	s.printf("%d 0 obj\n", n)
+}
+
+// dictObj writes a dictionary as object n
+func (s *pdfStream) dictObj(n int, dict string) {
+	s.beginObj(n)
+	s.printf("<< %s >>\nendobj\n", dict)
+}
+
+// streamObj writes data as a new stream object, with dict added to
+// its dictionary, compressing it first if compress is set, and
+// returns the number of the object
+func (s *pdfStream) streamObj(dict string, data []byte, compress bool) int {
+	if compress {
+		var buf bytes.Buffer
+		w := zlib.NewWriter(&buf)
+		_, _ = w.Write(data)
+		_ = w.Close()
+		data = buf.Bytes()
+		dict += " /Filter /FlateDecode"
+	}
+	n := s.newObj()
+	s.beginObj(n)
+	s.printf("<< %s /Length %d >>\nstream\n", strings.TrimSpace(dict), len(data))
+	s.write(data)
+	s.printf("\nendstream\nendobj\n")
+	return n
+}
+
+// image writes a JPEG image, returning the number of its object
+func (s *pdfStream) image(jpg []byte) (int, error) {
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(jpg))
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Could not read JPEG: %v", err))
+	}
+	space := "/DeviceRGB"
+	if cfg.ColorModel == color.GrayModel {
+		space = "/DeviceGray"
+	}
+	dict := fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace %s /BitsPerComponent 8 /Filter /DCTDecode", cfg.Width, cfg.Height, space)
+	return s.streamObj(dict, jpg, false), s.err
+}
+
+// addPage writes a page of width w and height h in pt, with the
+// content given, and img as its image XObject if it isn't 0
+func (s *pdfStream) addPage(w, h float64, img int, content []byte) error {
+	c := s.streamObj("", content, true)
+	xobj := ""
+	if img != 0 {
+		xobj = fmt.Sprintf("/XObject << /Im %d 0 R >>", img)
+	}
+	n := s.newObj()
+	s.dictObj(n, fmt.Sprintf("/Type /Page /Parent %d 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /Font << /F1 %d 0 R >> %s >> /Contents %d 0 R", pagesObj, w, h, fontObj, xobj, c))
+	s.pages = append(s.pages, n)
+	return s.err
+}
+
+// drawImage adds the operators to draw the image of the page, as
+// written by image, at x, y (from the top left) with size w x h to
+// the content c of a page of height pageh
+func drawImage(c *bytes.Buffer, pageh, x, y, w, h float64) {
+	fmt.Fprintf(c, "q %.2f 0 0 %.2f %.2f %.2f cm /Im Do Q\n", w, h, x, pageh-y-h)
+}
+
+// encode returns the glyphs of a string as a hex string, for showing
+// with the font, along with its width in 1000ths of the font size.
+// Any characters the font doesn't have a glyph for are shown with its
+// missing glyph, so are lost when the text is extracted.
+func (s *pdfStream) encode(txt string) (string, float64) {
+	var hex strings.Builder
+	width := 0
+	for _, r := range txt {
+		g, err := s.font.GlyphIndex(&s.fontbuf, r)
+		if err != nil {
+			g = 0
+		}
+		w, ok := s.widths[g]
+		if !ok {
+			adv, err := s.font.GlyphAdvance(&s.fontbuf, g, fixed.I(int(s.upem)), font.HintingNone)
+			if err == nil {
+				w = int(float64(adv) / 64 * 1000 / s.upem)
+			}
+			s.widths[g] = w
+		}
+		if _, ok := s.glyphs[g]; !ok && g != 0 {
+			s.glyphs[g] = r
+		}
+		fmt.Fprintf(&hex, "%04X", uint16(g))
+		width += w
+	}
+	return hex.String(), float64(width)
+}
+
+// stringWidth returns the width in pt of txt at font size size
+func (s *pdfStream) stringWidth(txt string, size float64) float64 {
+	_, w := s.encode(txt)
+	return w * size / 1000
+}
+
+// text adds the operators to show txt at font size size to the
+// content c of a page of height pageh. It is placed as gofpdf places
+// text in a cell with its top left at x, y and height cellh, and is
+// stretched horizontally to be stretchw wide, if that isn't 0.
+// Invisible text is used for the searchable text of a page.
+func (s *pdfStream) text(c *bytes.Buffer, pageh, x, y, cellh, size, stretchw float64, txt string, visible bool) {
+	hex, w := s.encode(txt)
+	tz := 100.0
+	if stretchw > 0 && w > 0 && size > 0 {
+		tz = stretchw / (w * size / 1000) * 100
+	}
+	mode := 3
+	if visible {
+		mode = 0
+	}
+	baseline := pageh - (y + 0.5*cellh + 0.3*size)
+	fmt.Fprintf(c, "BT %d Tr /F1 %.2f Tf %.0f Tz 1 0 0 1 %.2f %.2f Tm <%s> Tj ET\n", mode, size, tz, x, baseline, hex)
+}
+
+// pageCount returns the number of pages written so far
+func (s *pdfStream) pageCount() int {
+	return len(s.pages)
+}
+
+// fontName returns the PostScript name of the font, with any
+// characters which aren't allowed in a PDF name removed
+func (s *pdfStream) fontName() string {
+	name, err := s.font.Name(&s.fontbuf, sfnt.NameIDPostScript)
+	if err != nil {
+		return "Font"
+	}
+	name = strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
+			return r
+		}
+		return -1
+	}, name)
+	if name == "" {
+		return "Font"
+	}
+	return name
+}
+
+// toUnicode returns a CMap mapping each glyph used to the character
+// it is for, so that the text can be extracted
+func (s *pdfStream) toUnicode(gids []sfnt.GlyphIndex) []byte {
+	var b bytes.Buffer
+	b.WriteString("/CIDInit /ProcSet findresource begin\n12 dict begin\nbegincmap\n")
+	b.WriteString("/CIDSystemInfo << /Registry (Adobe) /Ordering (UCS) /Supplement 0 >> def\n")
+	b.WriteString("/CMapName /Adobe-Identity-UCS def\n/CMapType 2 def\n")
+	b.WriteString("1 begincodespacerange\n<0000> <FFFF>\nendcodespacerange\n")
+	for i := 0; i < len(gids); i += 100 {
+		end := i + 100
+		if end > len(gids) {
+			end = len(gids)
+		}
+		fmt.Fprintf(&b, "%d beginbfchar\n", end-i)
+		for _, g := range gids[i:end] {
+			fmt.Fprintf(&b, "<%04X> <", uint16(g))
+			for _, u := range utf16.Encode([]rune{s.glyphs[g]}) {
+				fmt.Fprintf(&b, "%04X", u)
+			}
+			b.WriteString(">\n")
+		}
+		b.WriteString("endbfchar\n")
+	}
+	b.WriteString("endcmap\nCMapName currentdict /CMap defineresource pop\nend\nend\n")
+	return b.Bytes()
+}
+
+// writeFont writes the font objects, embedding the whole font
+func (s *pdfStream) writeFont() {
+	name := s.fontName()
+	scale := func(v fixed.Int26_6) int {
+		return int(float64(v) / 64 * 1000 / s.upem)
+	}
+	ppem := fixed.I(int(s.upem))
+	bounds, err := s.font.Bounds(&s.fontbuf, ppem, font.HintingNone)
+	if err != nil {
+		bounds = fixed.Rectangle26_6{}
+	}
+	metrics, err := s.font.Metrics(&s.fontbuf, ppem, font.HintingNone)
+	if err != nil {
+		metrics = font.Metrics{}
+	}
+
+	var gids []sfnt.GlyphIndex
+	for g := range s.widths {
+		gids = append(gids, g)
+	}
+	sort.Slice(gids, func(i, j int) bool { return gids[i] < gids[j] })
+	var widths strings.Builder
+	for _, g := range gids {
+		fmt.Fprintf(&widths, "%d [%d] ", g, s.widths[g])
+	}
+	var mapped []sfnt.GlyphIndex
+	for _, g := range gids {
+		if _, ok := s.glyphs[g]; ok {
+			mapped = append(mapped, g)
+		}
+	}
+
+	file := s.streamObj(fmt.Sprintf("/Length1 %d", len(s.fontdata)), s.fontdata, true)
+	desc := s.newObj()
+	s.dictObj(desc, fmt.Sprintf("/Type /FontDescriptor /FontName /%s /Flags 32 /FontBBox [%d %d %d %d] /ItalicAngle 0 /Ascent %d /Descent %d /CapHeight %d /StemV 80 /FontFile2 %d 0 R",
+		name, scale(bounds.Min.X), -scale(bounds.Max.Y), scale(bounds.Max.X), -scale(bounds.Min.Y),
+		scale(metrics.Ascent), -scale(metrics.Descent), scale(metrics.Ascent), file))
+	cid := s.newObj()
+	s.dictObj(cid, fmt.Sprintf("/Type /Font /Subtype /CIDFontType2 /BaseFont /%s /CIDSystemInfo << /Registry (Adobe) /Ordering (Identity) /Supplement 0 >> /FontDescriptor %d 0 R /CIDToGIDMap /Identity /DW 1000 /W [%s]", name, desc, strings.TrimSpace(widths.String())))
+	tounicode := s.streamObj("", s.toUnicode(mapped), true)
+	s.dictObj(fontObj, fmt.Sprintf("/Type /Font /Subtype /Type0 /BaseFont /%s /Encoding /Identity-H /DescendantFonts [%d 0 R] /ToUnicode %d 0 R", name, cid, tounicode))
+}
+
+// save finishes the PDF, writing the font, page tree and cross
+// reference table, and moves it to path
+func (s *pdfStream) save(path string) error {
+	s.writeFont()
+
+	var kids strings.Builder
+	for _, pg := range s.pages {
+		fmt.Fprintf(&kids, "%d 0 R ", pg)
+	}
+	s.dictObj(pagesObj, fmt.Sprintf("/Type /Pages /Kids [%s] /Count %d", strings.TrimSpace(kids.String()), len(s.pages)))
+	s.dictObj(catalogObj, fmt.Sprintf("/Type /Catalog /Pages %d 0 R", pagesObj))
+
+	xref := s.off
+	s.printf("xref\n0 %d\n0000000000 65535 f \n", len(s.objs)+1)
+	for _, o := range s.objs {
+		s.printf("%010d 00000 n \n", o)
+	}
+	s.printf("trailer\n<< /Size %d /Root %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(s.objs)+1, catalogObj, xref)
+
+	if s.err == nil {
+		s.err = s.w.Flush()
+	}
+	err := s.f.Close()
+	s.closed = true
+	if s.err == nil {
+		s.err = err
+	}
+	if s.err != nil {
+		_ = os.Remove(s.f.Name())
+		return errors.New(fmt.Sprintf("Could not write PDF: %v", s.err))
+	}
+	return moveFile(s.f.Name(), path)
+}
+
+// abort stops writing the PDF and removes its temporary file. It
+// does nothing if the PDF has already been saved.
+func (s *pdfStream) abort() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	_ = s.f.Close()
+	err := os.Remove(s.f.Name())
+	if err != nil && !os.IsNotExist(err) {
+		return errors.New(fmt.Sprintf("Could not remove temporary PDF: %v", err))
+	}
+	return nil
+}
+
+// moveFile moves the file at src to dst, copying it if it can't just
+// be renamed, such as when they are on different filesystems
+func moveFile(src, dst string) error {
+	if os.Rename(src, dst) == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Could not open %s: %v", src, err))
+	}
+	defer os.Remove(src)
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Could not create %s: %v", dst, err))
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return errors.New(fmt.Sprintf("Could not copy PDF to %s: %v", dst, err))
+	}
+	return out.Close()
+}